@@ -0,0 +1,73 @@
+package vk
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// AdminRegistrar is implemented by features that expose operational endpoints on the admin router
+type AdminRegistrar interface {
+	RegisterAdmin(r *Router)
+}
+
+// AdminRouter returns the router for operational endpoints, which is served on the admin port (see UseAdminPort)
+// rather than alongside public traffic. It has its own middleware chain (add an allowlist or authentication using
+// WithMiddlewares) and its requests are logged quietly. Routes must be added before the server is started.
+func (s *Server) AdminRouter() *Router {
+	return s.adminRouter
+}
+
+// RegisterAdmin registers the admin endpoints of each of the provided features on the admin router
+func (s *Server) RegisterAdmin(features ...AdminRegistrar) {
+	if s.started.Load().(bool) {
+		return
+	}
+
+	for _, f := range features {
+		f.RegisterAdmin(s.adminRouter)
+	}
+}
+
+// newAdminRouter creates the admin router
+func newAdminRouter(options *Options) *Router {
+	r := NewRouter(options.Logger, "")
+	r.quiet = true
+
+	return r
+}
+
+// finalizeAdmin mounts the admin routes, with error handling outside of any user-provided middleware
+func (s *Server) finalizeAdmin() {
+	s.adminRouter.WithMiddlewares(ErrorMiddleware())
+	s.adminRouter.Finalize()
+}
+
+// startAdmin mounts the admin routes and starts serving them if the admin port is set
+func (s *Server) startAdmin() {
+	s.finalizeAdmin()
+
+	if s.adminServer == nil {
+		return
+	}
+
+	s.options.Logger.Debug("serving admin on", s.adminServer.Addr)
+
+	go func() {
+		if err := s.adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			s.options.Logger.Error(fmt.Errorf("admin server failed: %w", err))
+		}
+	}()
+}
+
+func goAdminServer(options *Options, handler http.Handler) *http.Server {
+	if options.AdminPort == 0 {
+		return nil
+	}
+
+	s := &http.Server{
+		Addr:    fmt.Sprintf(":%d", options.AdminPort),
+		Handler: handler,
+	}
+
+	return s
+}
@@ -0,0 +1,203 @@
+package vk
+
+import (
+	"hash/fnv"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// AffinityCloseCode is the close code of a websocket connection closed by AffinityRedirectMiddleware because another
+// replica owns its key. The close reason is the owner's URL
+const AffinityCloseCode = 4307
+
+// maxCloseReasonBytes is the longest reason a close frame can carry (RFC 6455, section 5.5)
+const maxCloseReasonBytes = 123
+
+// Peer is a replica of a deployment that keys can be owned by
+type Peer struct {
+	ID  string // the replica's stable identity, which keys are hashed with
+	URL string // the URL that the replica is reachable at, i.e. https://replica-2.example.com
+}
+
+// PeerDirectory lists the replicas of a deployment, including the one it is called from
+type PeerDirectory interface {
+	Peers() []Peer
+}
+
+// StaticPeers is a PeerDirectory of a fixed list of replicas
+type StaticPeers []Peer
+
+// Peers returns the list
+func (s StaticPeers) Peers() []Peer {
+	return s
+}
+
+// DynamicPeers is a PeerDirectory whose replicas are listed by a refresh function, such as one querying service
+// discovery. The list is refreshed when it is older than the interval, and the last list is kept if refreshing fails
+type DynamicPeers struct {
+	refresh  func() ([]Peer, error)
+	interval time.Duration
+
+	lock      sync.Mutex
+	peers     []Peer
+	refreshed time.Time
+}
+
+// NewDynamicPeers creates a DynamicPeers, and lists its replicas for the first time
+func NewDynamicPeers(interval time.Duration, refresh func() ([]Peer, error)) (*DynamicPeers, error) {
+	d := &DynamicPeers{
+		refresh:  refresh,
+		interval: interval,
+	}
+
+	if err := d.Refresh(); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// Peers returns the replicas, refreshing them first if the list is older than the interval
+func (d *DynamicPeers) Peers() []Peer {
+	d.lock.Lock()
+	stale := time.Since(d.refreshed) >= d.interval
+	if stale {
+		// the other requests keep using the current list while this one refreshes it
+		d.refreshed = time.Now()
+	}
+	d.lock.Unlock()
+
+	if stale {
+		_ = d.Refresh()
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.peers
+}
+
+// Refresh lists the replicas now, such as when membership is known to have changed
+func (d *DynamicPeers) Refresh() error {
+	peers, err := d.refresh()
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	// a failed refresh is retried after the interval rather than with every request
+	d.refreshed = time.Now()
+
+	if err != nil {
+		return err
+	}
+
+	d.peers = peers
+
+	return nil
+}
+
+// AffinityOwner returns the replica that owns key, using rendezvous hashing: each replica's score for the key is
+// computed independently and the highest wins, so a replica joining or leaving only moves the keys it gains or
+// owned, and every replica with the same list agrees on the owner. It returns false if there are no replicas
+func AffinityOwner(key string, peers []Peer) (Peer, bool) {
+	var owner Peer
+	var best uint64
+	found := false
+
+	for _, p := range peers {
+		score := affinityScore(p.ID, key)
+
+		if !found || score > best || (score == best && p.ID < owner.ID) {
+			owner, best, found = p, score, true
+		}
+	}
+
+	return owner, found
+}
+
+// affinityScore is the score of the replica id for key, the FNV-1a hash of the two mixed with the splitmix64
+// finalizer, as FNV alone is too weak in its high bits to spread keys evenly
+func affinityScore(id, key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	h.Write([]byte{0})
+	h.Write([]byte(key))
+
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+
+	return x
+}
+
+// AffinityRedirectMiddleware sends each request to the replica that owns its key, for state that lives in a single
+// replica's memory (such as a Hub's rooms). Requests whose key is owned by selfID, that have no key (keyFn returns
+// ""), or for which peers lists no replicas, are served by this replica. Other requests are redirected to the owner's
+// URL with a 307, keeping their path and query. Websocket upgrades are accepted and closed straight away with
+// AffinityCloseCode and the owner's URL as the reason, as browsers don't follow redirects of the handshake; if the
+// URL is too long for a close frame, the handshake is redirected instead
+func AffinityRedirectMiddleware(selfID string, peers PeerDirectory, keyFn func(*Ctx) string) Middleware {
+	return Named("affinity", func(inner HandlerFunc) HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request, ctx *Ctx) error {
+			key := keyFn(ctx)
+			if key == "" {
+				return inner(w, r, ctx)
+			}
+
+			owner, ok := AffinityOwner(key, peers.Peers())
+			if !ok || owner.ID == selfID {
+				return inner(w, r, ctx)
+			}
+
+			ctx.Log.Debug("affinity: key", key, "is owned by", owner.ID)
+
+			if ctx.IsWebSocketUpgrade() && len(owner.URL) <= maxCloseReasonBytes {
+				return closeWithOwner(w, r, ctx, owner)
+			}
+
+			http.Redirect(w, r, owner.URL+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+
+			return nil
+		}
+	})
+}
+
+// closeWithOwner accepts a websocket handshake and closes the connection with the owner's URL
+func closeWithOwner(w http.ResponseWriter, r *http.Request, ctx *Ctx, owner Peer) error {
+	var handshakeErr error
+
+	upgrader := websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool {
+			return true
+		},
+		Error: func(w http.ResponseWriter, r *http.Request, status int, reason error) {
+			handshakeErr = E(status, reason.Error())
+		},
+	}
+
+	conn, err := upgrader.Upgrade(w, r, handshakeHeaders(ctx.RespHeaders))
+	if err != nil {
+		if handshakeErr != nil {
+			return handshakeErr
+		}
+
+		return E(http.StatusInternalServerError, err.Error())
+	}
+
+	defer conn.Close()
+
+	msg := websocket.FormatCloseMessage(AffinityCloseCode, owner.URL)
+
+	// the connection is hijacked, so there is no response left to send an error with
+	if err := conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second)); err != nil {
+		ctx.Log.Debug("affinity: failed to close websocket:", err.Error())
+	}
+
+	return nil
+}
@@ -0,0 +1,300 @@
+package vk
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// ResponseSummary describes the response to a request, as observed by Afterware
+type ResponseSummary struct {
+	// Status is the status that was sent: 500 if the handler panicked, and 101 for websocket upgrades
+	Status int
+
+	// ContentType is the response's Content-Type header, or the type detected from its body if it had none
+	ContentType string
+
+	// Bytes is the length of the response body
+	Bytes int64
+
+	// Body is the start of the response body, only captured for Afterware added with AfterWithBody
+	Body []byte
+
+	// Truncated is true if the body was longer than the limit given to AfterWithBody
+	Truncated bool
+}
+
+// Afterware observes the response to a request once it has been written, such as to count responses by status or
+// audit error bodies. It can't change the response, and runs even if the handler returned an error or panicked.
+// For websocket routes, it runs once the connection's handler has returned
+type Afterware func(r *http.Request, ctx *Ctx, resp ResponseSummary)
+
+// afterwareCall is a set of Afterware registered by a route's After layer, along with how much of the body it sees
+type afterwareCall struct {
+	afterware []Afterware
+	bodyLimit int64
+}
+
+// After returns a Middleware that calls each of afterware with a summary of the response once it has been written,
+// see Afterware. Only requests that reach it are observed, so it should come before any middleware that might
+// reject requests it needs to see. The Afterware of a route run innermost first
+func After(afterware ...Afterware) Middleware {
+	return AfterWithBody(0, afterware...)
+}
+
+// AfterWithBody is After with the first maxBytes of the response body included in the summary. Buffering the body
+// has a cost, so this should be limited to the routes that need it
+func AfterWithBody(maxBytes int64, afterware ...Afterware) Middleware {
+	call := afterwareCall{afterware: afterware, bodyLimit: maxBytes}
+
+	return Named("after", func(inner HandlerFunc) HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request, ctx *Ctx) error {
+			ctx.addAfterware(call)
+
+			return inner(w, r, ctx)
+		}
+	})
+}
+
+// After adds Afterware to every route in the group, see After
+func (g *RouteGroup) After(afterware ...Afterware) *RouteGroup {
+	return g.WithMiddlewares(After(afterware...))
+}
+
+// addAfterware registers Afterware to be called once the response has been written
+func (c *Ctx) addAfterware(call afterwareCall) {
+	if c.summary == nil {
+		return
+	}
+
+	c.afterware = append(c.afterware, call)
+
+	c.summary.lock.Lock()
+	defer c.summary.lock.Unlock()
+
+	if call.bodyLimit > c.summary.bodyLimit {
+		c.summary.bodyLimit = call.bodyLimit
+	}
+}
+
+// runAfterware calls the Afterware registered for the request with the summary of its response, innermost first
+func (rt *Router) runAfterware(r *http.Request, ctx *Ctx) {
+	if len(ctx.afterware) == 0 {
+		return
+	}
+
+	// the response is complete, so a panicking afterware is only logged
+	defer func() {
+		if value := recover(); value != nil {
+			ctx.Log.ErrorString(fmt.Sprintf("recovered panic in afterware for %s %s: %v", r.Method, r.URL.Path, value))
+		}
+	}()
+
+	summary := ctx.summary.summary()
+
+	for i := len(ctx.afterware) - 1; i >= 0; i-- {
+		call := ctx.afterware[i]
+
+		resp := summary
+		resp.Body = nil
+
+		if call.bodyLimit > 0 {
+			resp.Body = summary.Body
+			if int64(len(resp.Body)) > call.bodyLimit {
+				resp.Body = resp.Body[:call.bodyLimit]
+			}
+
+			resp.Truncated = summary.Bytes > call.bodyLimit
+		}
+
+		for _, fn := range call.afterware {
+			fn(r, ctx, resp)
+		}
+	}
+}
+
+// summaryWriter records what is written to the client for Afterware, capturing the body only once an Afterware
+// that wants it has been registered. When a handler times out, the 504 sent in its place is recorded instead, see
+// timeOut, so the summary can be read and written from different goroutines
+type summaryWriter struct {
+	http.ResponseWriter
+	status      int
+	contentType string
+	bytes       int64
+	body        bytes.Buffer
+	bodyLimit   int64
+	timedOut    bool
+	lock        sync.Mutex
+}
+
+func (sw *summaryWriter) WriteHeader(status int) {
+	sw.lock.Lock()
+
+	if sw.timedOut {
+		sw.lock.Unlock()
+		return
+	}
+
+	// informational responses precede the actual one
+	if sw.status == 0 && status >= http.StatusOK {
+		sw.status = status
+		sw.contentType = sw.ResponseWriter.Header().Get(contentTypeHeaderKey)
+	}
+
+	sw.lock.Unlock()
+
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *summaryWriter) Write(b []byte) (int, error) {
+	if !sw.start(b) {
+		return 0, http.ErrHandlerTimeout
+	}
+
+	n, err := sw.ResponseWriter.Write(b)
+	sw.record(b[:n], int64(n))
+
+	return n, err
+}
+
+// ReadFrom copies from src using the underlying ResponseWriter's ReadFrom if it has one, see readFrom. The body
+// isn't captured when it is copied this way
+func (sw *summaryWriter) ReadFrom(src io.Reader) (int64, error) {
+	if !sw.start(nil) {
+		return 0, http.ErrHandlerTimeout
+	}
+
+	n, err := readFrom(sw.ResponseWriter, src)
+	sw.record(nil, n)
+
+	return n, err
+}
+
+// Flush flushes the underlying ResponseWriter if it supports flushing
+func (sw *summaryWriter) Flush() {
+	if !sw.start(nil) {
+		return
+	}
+
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack hijacks the underlying ResponseWriter's connection, which is recorded as a websocket upgrade
+func (sw *summaryWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := sw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("ResponseWriter does not implement http.Hijacker")
+	}
+
+	sw.lock.Lock()
+
+	if sw.timedOut {
+		sw.lock.Unlock()
+		return nil, nil, http.ErrHandlerTimeout
+	}
+
+	if sw.status == 0 {
+		sw.status = http.StatusSwitchingProtocols
+	}
+
+	sw.lock.Unlock()
+
+	return h.Hijack()
+}
+
+// start records the implicit 200 of a response whose body is written without calling WriteHeader, and detects the
+// content type from the first bytes of the body if it has none, as http.ResponseWriter does. It returns false if
+// the handler has timed out, and its writes are to be dropped
+func (sw *summaryWriter) start(b []byte) bool {
+	sw.lock.Lock()
+	defer sw.lock.Unlock()
+
+	if sw.timedOut {
+		return false
+	}
+
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+		sw.contentType = sw.ResponseWriter.Header().Get(contentTypeHeaderKey)
+	}
+
+	if sw.contentType == "" && sw.bytes == 0 && len(b) > 0 {
+		sw.contentType = http.DetectContentType(b)
+	}
+
+	return true
+}
+
+// record counts the n bytes written, and captures b up to the body limit
+func (sw *summaryWriter) record(b []byte, n int64) {
+	sw.lock.Lock()
+	defer sw.lock.Unlock()
+
+	if sw.timedOut {
+		return
+	}
+
+	sw.bytes += n
+
+	if remaining := sw.bodyLimit - int64(sw.body.Len()); remaining > 0 {
+		if int64(len(b)) > remaining {
+			b = b[:remaining]
+		}
+
+		sw.body.Write(b)
+	}
+}
+
+// timeOut calls respond to write a response to w in place of the handler's, such as the 504 of a handler that has
+// timed out, and records that response rather than the handler's, whose writes are dropped from then on
+func (sw *summaryWriter) timeOut(w http.ResponseWriter, respond func(w http.ResponseWriter)) {
+	sw.lock.Lock()
+	defer sw.lock.Unlock()
+
+	rec := &summaryWriter{ResponseWriter: w, bodyLimit: sw.bodyLimit}
+	respond(rec)
+
+	sw.timedOut = true
+	sw.status = rec.status
+	sw.contentType = rec.contentType
+	sw.bytes = rec.bytes
+
+	sw.body.Reset()
+	sw.body.Write(rec.body.Bytes())
+}
+
+// responseStatus returns the status of the response, or 0 if it hasn't started
+func (sw *summaryWriter) responseStatus() int {
+	sw.lock.Lock()
+	defer sw.lock.Unlock()
+
+	return sw.status
+}
+
+// summary returns the summary of the response, which is an empty 200 if nothing was written
+func (sw *summaryWriter) summary() ResponseSummary {
+	sw.lock.Lock()
+	defer sw.lock.Unlock()
+
+	summary := ResponseSummary{
+		Status:      sw.status,
+		ContentType: sw.contentType,
+		Bytes:       sw.bytes,
+		Body:        sw.body.Bytes(),
+	}
+
+	if summary.Status == 0 {
+		summary.Status = http.StatusOK
+		summary.ContentType = sw.ResponseWriter.Header().Get(contentTypeHeaderKey)
+	}
+
+	return summary
+}
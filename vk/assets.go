@@ -0,0 +1,287 @@
+package vk
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"html/template"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	assetHashLength     = 12
+	immutableAssetCache = "public, max-age=31536000, immutable"
+)
+
+// WithFingerprints makes Static also serve each file at a content-addressed path, i.e. /static/app-<hash>.js for
+// /static/app.js, with a far-future immutable Cache-Control. Hashes are computed when a file is first requested or
+// referenced and then cached, see AssetManifest. Paths with an unknown hash are served from the logical file
+// with normal caching
+func WithFingerprints() MountOption {
+	return func(o *mountOptions) {
+		o.fingerprint = true
+	}
+}
+
+// WithFingerprintRevalidation is WithFingerprints for development, where files change while the server is
+// running: each lookup checks the file's size and modification time, and its hash is recomputed if either changed
+func WithFingerprintRevalidation() MountOption {
+	return func(o *mountOptions) {
+		o.fingerprint = true
+		o.revalidate = true
+	}
+}
+
+// assetMount is a fingerprinted Static mount, with its prefix relative to the group that holds it
+type assetMount struct {
+	prefix string
+	store  *assetStore
+}
+
+type assetHash struct {
+	sum     string // the full hash, of which paths use the first assetHashLength characters
+	size    int64
+	modTime time.Time
+}
+
+// assetStore computes and caches the content hashes of the files in a FileSystem
+type assetStore struct {
+	fs         http.FileSystem
+	revalidate bool
+
+	lock   sync.RWMutex
+	hashes map[string]assetHash // by logical path, relative to the mount
+}
+
+func newAssetStore(fs http.FileSystem, revalidate bool) *assetStore {
+	a := &assetStore{
+		fs:         fs,
+		revalidate: revalidate,
+		hashes:     map[string]assetHash{},
+	}
+
+	return a
+}
+
+// hashOf returns the hash of the file at the logical path, or false if it is not a file
+func (a *assetStore) hashOf(logical string) (string, bool) {
+	a.lock.RLock()
+	cached, ok := a.hashes[logical]
+	a.lock.RUnlock()
+
+	if ok && !a.revalidate {
+		return cached.sum[:assetHashLength], true
+	}
+
+	file, err := a.fs.Open("/" + logical)
+	if err != nil {
+		return "", false
+	}
+
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		return "", false
+	}
+
+	sum, err := a.hashFile(logical, file, info)
+	if err != nil {
+		return "", false
+	}
+
+	return sum[:assetHashLength], true
+}
+
+// hashFile returns the full hash of the open file at the logical path, recomputing it unless its size and
+// modification time are unchanged, and leaves the file at its start
+func (a *assetStore) hashFile(logical string, file http.File, info os.FileInfo) (string, error) {
+	a.lock.RLock()
+	cached, ok := a.hashes[logical]
+	a.lock.RUnlock()
+
+	if ok && info.Size() == cached.size && info.ModTime().Equal(cached.modTime) {
+		return cached.sum, nil
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	computed := assetHash{
+		sum:     hex.EncodeToString(h.Sum(nil)),
+		size:    info.Size(),
+		modTime: info.ModTime(),
+	}
+
+	a.lock.Lock()
+	a.hashes[logical] = computed
+	a.lock.Unlock()
+
+	return computed.sum, nil
+}
+
+// hashed returns the content-addressed path of the file at the logical path, or false if it is not a file
+func (a *assetStore) hashed(logical string) (string, bool) {
+	hash, ok := a.hashOf(logical)
+	if !ok {
+		return "", false
+	}
+
+	ext := path.Ext(logical)
+
+	return strings.TrimSuffix(logical, ext) + "-" + hash + ext, true
+}
+
+// resolve returns the logical path to serve for the requested path, and whether it was requested by its current hash
+func (a *assetStore) resolve(requested string) (string, bool) {
+	ext := path.Ext(requested)
+	base := strings.TrimSuffix(requested, ext)
+
+	i := strings.LastIndex(base, "-")
+	if i < 0 || len(base)-i-1 != assetHashLength {
+		return requested, false
+	}
+
+	// a file whose name really does end with something hash-like is served as it is
+	if _, isFile := a.hashOf(requested); isFile {
+		return requested, false
+	}
+
+	logical := base[:i] + ext
+
+	hash, ok := a.hashOf(logical)
+	if !ok {
+		return requested, false
+	}
+
+	return logical, hash == base[i+1:]
+}
+
+// handler serves content-addressed paths from the logical files using next, a file server
+func (a *assetStore) handler(next HandlerFunc) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, ctx *Ctx) error {
+		requested := strings.TrimPrefix(r.URL.Path, "/")
+
+		logical, current := a.resolve(requested)
+		if logical != requested {
+			r.URL.Path = "/" + logical
+			r.URL.RawPath = ""
+		}
+
+		if current {
+			w.Header().Set("Cache-Control", immutableAssetCache)
+		}
+
+		return next(w, r, ctx)
+	}
+}
+
+// manifest adds the hashed path of every file in the store to m, with both paths below prefix
+func (a *assetStore) manifest(prefix string, m map[string]string) {
+	var walk func(dir string)
+
+	walk = func(dir string) {
+		f, err := a.fs.Open("/" + dir)
+		if err != nil {
+			return
+		}
+
+		entries, err := f.Readdir(-1)
+		f.Close()
+
+		if err != nil {
+			return
+		}
+
+		for _, e := range entries {
+			logical := path.Join(dir, e.Name())
+
+			if e.IsDir() {
+				walk(logical)
+			} else if hashed, ok := a.hashed(logical); ok {
+				m[prefix+"/"+logical] = prefix + "/" + hashed
+			}
+		}
+	}
+
+	walk("")
+}
+
+// assetMounts returns the group's fingerprinted mounts with the group's prefix applied
+func (g *RouteGroup) assetMounts() []assetMount {
+	mounts := make([]assetMount, len(g.assets))
+	for i, a := range g.assets {
+		mounts[i] = assetMount{prefix: ensureLeadingSlash(g.prefix) + a.prefix, store: a.store}
+	}
+
+	return mounts
+}
+
+// AssetManifest maps the path of every file served by a Static mount using WithFingerprints to its
+// content-addressed path, i.e. "/static/app.js" to "/static/app-3f2a9c1b7d4e.js"
+func (rt *Router) AssetManifest() map[string]string {
+	manifest := map[string]string{}
+
+	for _, a := range rt.assetMounts() {
+		a.store.manifest(a.prefix, manifest)
+	}
+
+	return manifest
+}
+
+// AssetPath returns the content-addressed path for the path of a file served by a Static mount using
+// WithFingerprints, or the path unchanged if there is no such file
+func (rt *Router) AssetPath(logical string) string {
+	mounts := rt.assetMounts()
+
+	// the most specific mount wins when they are nested
+	sort.Slice(mounts, func(i, j int) bool { return len(mounts[i].prefix) > len(mounts[j].prefix) })
+
+	for _, a := range mounts {
+		if !strings.HasPrefix(logical, a.prefix+"/") {
+			continue
+		}
+
+		if hashed, ok := a.store.hashed(strings.TrimPrefix(logical, a.prefix+"/")); ok {
+			return a.prefix + "/" + hashed
+		}
+	}
+
+	return logical
+}
+
+// TemplateFuncs returns template functions for referencing assets, namely `asset`, which is AssetPath:
+// <script src="{{ asset "/static/app.js" }}"></script>
+func (rt *Router) TemplateFuncs() template.FuncMap {
+	return template.FuncMap{
+		"asset": rt.AssetPath,
+	}
+}
+
+// AssetManifest returns the asset manifest of the server's router, see Router.AssetManifest
+func (s *Server) AssetManifest() map[string]string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.internalRouter.AssetManifest()
+}
+
+// TemplateFuncs returns the template functions of the server's router, see Router.TemplateFuncs
+func (s *Server) TemplateFuncs() template.FuncMap {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.internalRouter.TemplateFuncs()
+}
@@ -0,0 +1,346 @@
+package vk
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultAuditActorClaim   = "sub"
+	defaultAuditBodyMaxBytes = DefaultBodyMaxBytes
+)
+
+// AuditRecord is the journal entry for a state-changing request. The body is recorded only as the SHA-256 hash of
+// its first bytes, up to the auditor's limit (see Auditor.SetBodyMaxBytes)
+type AuditRecord struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Route     string    `json:"route"`           // the route that handled the request, i.e. /users/:id
+	Actor     string    `json:"actor,omitempty"` // the actor claim, see Auditor.SetActorClaim
+	BodyHash  string    `json:"body_sha256"`
+	Truncated bool      `json:"body_truncated,omitempty"` // the body was longer than the bytes hashed
+	Status    int       `json:"status"`
+}
+
+// AuditJournal stores AuditRecords. Append must not return until the record is as durable as the journal promises,
+// and an error from Append means the record may have been lost
+type AuditJournal interface {
+	Append(record AuditRecord) error
+	Close() error
+}
+
+// AuditFailurePolicy is what an Auditor does with a request whose record can't be appended to the journal
+type AuditFailurePolicy int
+
+const (
+	// AuditFailClosed fails the request with 503 instead of sending the handler's response
+	AuditFailClosed AuditFailurePolicy = iota
+	// AuditDegrade sends the handler's response as usual, logging the failure and counting it in AuditStats
+	AuditDegrade
+)
+
+// AuditStats reports the records an Auditor has appended to its journal, and the appends that failed
+type AuditStats struct {
+	Records  uint64 `json:"records"`
+	Failures uint64 `json:"failures"`
+}
+
+// Auditor journals the state-changing requests (POST, PUT, PATCH and DELETE) that pass through its Middleware
+type Auditor struct {
+	journal AuditJournal
+	policy  AuditFailurePolicy
+
+	lock         sync.RWMutex
+	actorClaim   string
+	bodyMaxBytes int64
+
+	records  uint64
+	failures uint64
+}
+
+// AuditMiddleware returns a Middleware that appends a record of each state-changing request to journal, failing
+// closed, see NewAuditor for details
+func AuditMiddleware(journal AuditJournal) Middleware {
+	return NewAuditor(journal, AuditFailClosed).Middleware()
+}
+
+// NewAuditor creates an Auditor that appends to journal, with policy deciding what happens when it can't.
+//
+// Records are appended once the handler has returned, so that they include the response status. With
+// AuditFailClosed the handler's response is held back until then, so no client is told that a change succeeded
+// without it having been journaled, but the handler's changes have already been made: the 503 means the outcome is
+// unknown, not that nothing happened
+func NewAuditor(journal AuditJournal, policy AuditFailurePolicy) *Auditor {
+	a := &Auditor{
+		journal:      journal,
+		policy:       policy,
+		actorClaim:   defaultAuditActorClaim,
+		bodyMaxBytes: defaultAuditBodyMaxBytes,
+	}
+
+	return a
+}
+
+// SetActorClaim sets the claim (see ClaimsKey) recorded as the actor, which is sub by default. It can be a
+// dot-separated path into nested claims, i.e. act.sub
+func (a *Auditor) SetActorClaim(claim string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.actorClaim = claim
+}
+
+// SetBodyMaxBytes sets how much of each body is hashed, DefaultBodyMaxBytes by default. The rest of a longer body
+// isn't read once the handler has returned, and its record is marked as Truncated
+func (a *Auditor) SetBodyMaxBytes(maxBytes int64) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if maxBytes <= 0 {
+		maxBytes = defaultAuditBodyMaxBytes
+	}
+
+	a.bodyMaxBytes = maxBytes
+}
+
+// Stats returns the number of records appended and the number of appends that failed
+func (a *Auditor) Stats() AuditStats {
+	stats := AuditStats{
+		Records:  atomic.LoadUint64(&a.records),
+		Failures: atomic.LoadUint64(&a.failures),
+	}
+
+	return stats
+}
+
+// RegisterAdmin mounts GET /audit on the admin router, reporting the auditor's stats
+func (a *Auditor) RegisterAdmin(r *Router) {
+	r.GET("/audit", func(w http.ResponseWriter, _ *http.Request, ctx *Ctx) error {
+		return RespondJSON(ctx.Context, w, a.Stats(), http.StatusOK)
+	})
+}
+
+// Middleware returns a Middleware that journals state-changing requests. It must be placed after the middleware
+// that sets the claims under ClaimsKey (i.e. closer to the handler)
+func (a *Auditor) Middleware() Middleware {
+	return Named("audit", func(inner HandlerFunc) HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request, ctx *Ctx) error {
+			if !isStateChanging(r.Method) {
+				return inner(w, r, ctx)
+			}
+
+			a.lock.RLock()
+			body := &hashingBody{hash: sha256.New(), limit: a.bodyMaxBytes}
+			a.lock.RUnlock()
+
+			if r.Body != nil {
+				body.ReadCloser = r.Body
+				r.Body = body
+			}
+
+			aw := &auditWriter{ResponseWriter: w, hold: a.policy == AuditFailClosed}
+			if aw.hold {
+				aw.header = w.Header().Clone()
+				ctx.RespHeaders = aw.header
+
+				defer func() { ctx.RespHeaders = w.Header() }()
+			}
+
+			err := inner(aw, r, ctx)
+
+			status := aw.status
+			if status == 0 {
+				status = http.StatusOK
+
+				if err != nil {
+					status = http.StatusInternalServerError
+					if e, ok := err.(Error); ok {
+						status = e.Status()
+					}
+				}
+			}
+
+			record := AuditRecord{
+				Time:      time.Now().UTC(),
+				RequestID: ctx.RequestID(),
+				Method:    r.Method,
+				Path:      r.URL.Path,
+				Route:     ctx.route,
+				Actor:     a.actor(ctx),
+				BodyHash:  body.sum(),
+				Truncated: body.truncated(),
+				Status:    status,
+			}
+
+			if appendErr := a.journal.Append(record); appendErr != nil {
+				atomic.AddUint64(&a.failures, 1)
+				ctx.Log.Warn("failed to append audit record for", r.Method, r.URL.Path, ":", appendErr.Error())
+
+				if aw.hold {
+					return E(http.StatusServiceUnavailable, "the request could not be audited")
+				}
+
+				return err
+			}
+
+			atomic.AddUint64(&a.records, 1)
+
+			if aw.hold {
+				aw.release()
+			}
+
+			return err
+		}
+	})
+}
+
+// actor returns the actor claim of the request, if it has one
+func (a *Auditor) actor(ctx *Ctx) string {
+	claims := ctx.Get(ClaimsKey)
+	if claims == nil {
+		return ""
+	}
+
+	a.lock.RLock()
+	claim := a.actorClaim
+	a.lock.RUnlock()
+
+	value, ok := lookupClaim(claims, claim)
+	if !ok {
+		return ""
+	}
+
+	return sanitizeClaim(value, defaultClaimMaxLength)
+}
+
+// isStateChanging returns true for the methods of requests that are audited
+func isStateChanging(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+
+	return false
+}
+
+// hashingBody hashes the first limit bytes of a request body as it is read, so that it never has to be held in memory
+type hashingBody struct {
+	io.ReadCloser
+	hash  hash.Hash
+	limit int64
+	read  int64
+}
+
+func (b *hashingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+
+	if remaining := b.limit - b.read; remaining > 0 {
+		hashed := int64(n)
+		if hashed > remaining {
+			hashed = remaining
+		}
+
+		b.hash.Write(p[:hashed])
+	}
+
+	b.read += int64(n)
+
+	return n, err
+}
+
+// sum reads whatever the handler left of the body up to the limit (and one byte more, to tell if it was truncated),
+// and returns the hex-encoded hash of the bytes hashed
+func (b *hashingBody) sum() string {
+	if b.ReadCloser != nil && b.read <= b.limit {
+		_, _ = io.CopyN(io.Discard, b, b.limit-b.read+1)
+	}
+
+	return hex.EncodeToString(b.hash.Sum(nil))
+}
+
+// truncated returns true if the body was longer than the bytes hashed
+func (b *hashingBody) truncated() bool {
+	return b.read > b.limit
+}
+
+// auditWriter records the status of a response. If hold is set, the response (including its headers) is buffered
+// until release is called, so that it can be replaced with an error if the request can't be audited
+type auditWriter struct {
+	http.ResponseWriter
+	hold   bool
+	header http.Header
+	status int
+	buf    bytes.Buffer
+}
+
+func (aw *auditWriter) Header() http.Header {
+	if aw.hold {
+		return aw.header
+	}
+
+	return aw.ResponseWriter.Header()
+}
+
+func (aw *auditWriter) WriteHeader(status int) {
+	if aw.status != 0 {
+		return
+	}
+
+	aw.status = status
+
+	if !aw.hold {
+		aw.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (aw *auditWriter) Write(b []byte) (int, error) {
+	if aw.status == 0 {
+		aw.WriteHeader(http.StatusOK)
+	}
+
+	if aw.hold {
+		return aw.buf.Write(b)
+	}
+
+	return aw.ResponseWriter.Write(b)
+}
+
+// Flush flushes the underlying ResponseWriter if it supports flushing, unless the response is being held back
+func (aw *auditWriter) Flush() {
+	if aw.hold {
+		return
+	}
+
+	if f, ok := aw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// release sends the held response to the underlying ResponseWriter
+func (aw *auditWriter) release() {
+	dst := aw.ResponseWriter.Header()
+	for key := range dst {
+		delete(dst, key)
+	}
+
+	for key, values := range aw.header {
+		dst[key] = values
+	}
+
+	if aw.status != 0 {
+		aw.ResponseWriter.WriteHeader(aw.status)
+	}
+
+	if aw.buf.Len() > 0 {
+		_, _ = aw.ResponseWriter.Write(aw.buf.Bytes())
+	}
+}
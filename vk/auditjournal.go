@@ -0,0 +1,277 @@
+package vk
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const fileJournalBufferSize = 64 * 1024
+
+// FileJournalConfig configures a FileJournal
+type FileJournalConfig struct {
+	Path string // the journal file, which is appended to if it exists
+
+	// SyncInterval is how often appended records are written out and fsynced. With 0, every record is fsynced before
+	// Append returns, and otherwise records appended since the last sync are lost if the process or machine crashes
+	// (and write errors are only returned by the Append after they happen), so deployments that must fail closed
+	// should leave it at 0
+	SyncInterval time.Duration
+
+	// MaxBytes is the size beyond which the file is rotated (renamed with a timestamp suffix, i.e.
+	// audit.log.20220601T143000.000000000Z) and a new one started, 0 to never rotate
+	MaxBytes int64
+}
+
+// FileJournalStats reports the activity of a FileJournal
+type FileJournalStats struct {
+	Records   uint64 `json:"records"`
+	Syncs     uint64 `json:"syncs"`
+	Rotations uint64 `json:"rotations"`
+	Errors    uint64 `json:"errors"`
+}
+
+// FileJournal is an AuditJournal that appends records to a file as lines of JSON. A crash can at worst leave a
+// partial last line, which is terminated when the file is next opened so that it can't corrupt the next record
+type FileJournal struct {
+	config FileJournalConfig
+
+	lock  sync.Mutex
+	file  *os.File
+	buf   *bufio.Writer
+	size  int64
+	err   error // a failed background sync, returned by the next Append
+	stats FileJournalStats
+
+	closed bool
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// NewFileJournal opens (or creates) the journal file, and starts syncing it every SyncInterval if it is set
+func NewFileJournal(config FileJournalConfig) (*FileJournal, error) {
+	if config.Path == "" {
+		return nil, errors.New("journal path is required")
+	}
+
+	j := &FileJournal{
+		config: config,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	if err := j.open(); err != nil {
+		return nil, errors.Wrap(err, "failed to open")
+	}
+
+	if config.SyncInterval > 0 {
+		go j.syncEvery(config.SyncInterval)
+	} else {
+		close(j.done)
+	}
+
+	return j, nil
+}
+
+// Append writes the record as a line of JSON, and fsyncs it unless SyncInterval is set. If the record is larger
+// than the space left before MaxBytes, the file is rotated first
+func (j *FileJournal) Append(record AuditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return errors.Wrap(err, "failed to Marshal record")
+	}
+
+	line = append(line, '\n')
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if j.closed {
+		return errors.New("journal is closed")
+	}
+
+	if j.err != nil {
+		err, j.err = j.err, nil
+		return err
+	}
+
+	if j.config.MaxBytes > 0 && j.size > 0 && j.size+int64(len(line)) > j.config.MaxBytes {
+		if err := j.rotate(); err != nil {
+			return j.fail(errors.Wrap(err, "failed to rotate"))
+		}
+	}
+
+	if _, err := j.buf.Write(line); err != nil {
+		return j.fail(errors.Wrap(err, "failed to Write"))
+	}
+
+	j.size += int64(len(line))
+	j.stats.Records++
+
+	if j.config.SyncInterval == 0 {
+		if err := j.sync(); err != nil {
+			return j.fail(err)
+		}
+	}
+
+	return nil
+}
+
+// Sync writes out and fsyncs the records appended since the last sync
+func (j *FileJournal) Sync() error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if j.closed {
+		return nil
+	}
+
+	if err := j.sync(); err != nil {
+		return j.fail(err)
+	}
+
+	return nil
+}
+
+// Close syncs and closes the file. Appending to a closed journal fails
+func (j *FileJournal) Close() error {
+	j.lock.Lock()
+
+	if j.closed {
+		j.lock.Unlock()
+		return nil
+	}
+
+	j.closed = true
+	close(j.stop)
+
+	err := j.sync()
+	if closeErr := j.file.Close(); err == nil && closeErr != nil {
+		err = errors.Wrap(closeErr, "failed to Close")
+	}
+
+	j.lock.Unlock()
+
+	<-j.done
+
+	return err
+}
+
+// Stats returns the journal's counters
+func (j *FileJournal) Stats() FileJournalStats {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	return j.stats
+}
+
+// open opens the file at the configured path, terminating a partial last line left by a crash
+func (j *FileJournal) open() error {
+	file, err := os.OpenFile(j.config.Path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	j.file = file
+	j.size = info.Size()
+	j.buf = bufio.NewWriterSize(file, fileJournalBufferSize)
+
+	if j.size > 0 {
+		last := make([]byte, 1)
+		if _, err := file.ReadAt(last, j.size-1); err == nil && last[0] != '\n' {
+			_, _ = j.buf.Write([]byte{'\n'})
+			j.size++
+		}
+	}
+
+	return nil
+}
+
+// rotate syncs the current file, renames it, and opens a new one in its place. The current file is only closed once
+// the new one is open, so a failed rotation leaves the journal appending to it. It must be called with the lock held
+func (j *FileJournal) rotate() error {
+	if err := j.sync(); err != nil {
+		return err
+	}
+
+	rotated := fmt.Sprintf("%s.%s", j.config.Path, time.Now().UTC().Format("20060102T150405.000000000Z"))
+	if err := os.Rename(j.config.Path, rotated); err != nil {
+		return errors.Wrap(err, "failed to Rename")
+	}
+
+	current := j.file
+
+	if err := j.open(); err != nil {
+		// move the current file back, so that it's the one being appended to at the configured path
+		_ = os.Rename(rotated, j.config.Path)
+		return errors.Wrap(err, "failed to open")
+	}
+
+	// the rotated file has been synced, so an error closing it can't lose records
+	_ = current.Close()
+
+	j.stats.Rotations++
+
+	return nil
+}
+
+// sync flushes the buffer and fsyncs the file, it must be called with the lock held
+func (j *FileJournal) sync() error {
+	if j.buf.Buffered() == 0 {
+		return nil
+	}
+
+	if err := j.buf.Flush(); err != nil {
+		return errors.Wrap(err, "failed to Flush")
+	}
+
+	if err := j.file.Sync(); err != nil {
+		return errors.Wrap(err, "failed to Sync")
+	}
+
+	j.stats.Syncs++
+
+	return nil
+}
+
+// fail counts err and discards whatever is buffered, since a bufio.Writer that has failed never writes again. It
+// must be called with the lock held
+func (j *FileJournal) fail(err error) error {
+	j.stats.Errors++
+	j.buf.Reset(j.file)
+
+	return err
+}
+
+func (j *FileJournal) syncEvery(interval time.Duration) {
+	defer close(j.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-j.stop:
+			return
+		case <-ticker.C:
+			j.lock.Lock()
+			if !j.closed {
+				if err := j.sync(); err != nil {
+					j.err = j.fail(err)
+				}
+			}
+			j.lock.Unlock()
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package vk
+
+import (
+	"reflect"
+	"runtime"
+	"sync"
+)
+
+var (
+	backgroundLock sync.RWMutex
+
+	// backgroundFuncs are the functions run as goroutines that outlive the requests that start them, such as tickers
+	// and the writers of websocket connections, or that start such goroutines themselves
+	backgroundFuncs = []interface{}{
+		(*Server).startAdmin,
+		(*Server).StartCtx,
+		(*Server).passGates,
+		(*Panics).summarizeEvery,
+		(*Health).Run,
+		(*Degradation).Run,
+		(*InFlightRequests).watch,
+		(*ConnLimiter).reapIdle,
+		(*Throttler).watchdog,
+		(*FileJournal).syncEvery,
+		(*certStore).watch,
+		(*JWKS).run,
+		(*JWKS).refresh,
+		(*ResponseCache).refresh,
+		(*Hub).write,
+		(*registeredConn).keepAlive,
+	}
+
+	backgroundNames []string
+)
+
+// RegisterBackground declares fn as a function that runs as a long-lived goroutine, or whose own goroutines are,
+// such as a metrics ticker started by a middleware, so that leak checks (see vtest.LeakCheck) don't report them
+func RegisterBackground(fn interface{}) {
+	backgroundLock.Lock()
+	defer backgroundLock.Unlock()
+
+	backgroundFuncs = append(backgroundFuncs, fn)
+	backgroundNames = nil
+}
+
+// BackgroundGoroutines returns the names of the functions declared with RegisterBackground, including vk's own. A
+// goroutine started by one of them has the name of the function, followed by .funcN for an anonymous one
+func BackgroundGoroutines() []string {
+	backgroundLock.Lock()
+	defer backgroundLock.Unlock()
+
+	if backgroundNames == nil {
+		backgroundNames = make([]string, 0, len(backgroundFuncs))
+
+		for _, fn := range backgroundFuncs {
+			if f := runtime.FuncForPC(reflect.ValueOf(fn).Pointer()); f != nil {
+				backgroundNames = append(backgroundNames, f.Name())
+			}
+		}
+	}
+
+	names := make([]string, len(backgroundNames))
+	copy(names, backgroundNames)
+
+	return names
+}
@@ -0,0 +1,335 @@
+package vk
+
+import (
+	"bytes"
+	"encoding"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	formContentType      = "application/x-www-form-urlencoded"
+	multipartFormType    = "multipart/form-data"
+	multipartMemoryBytes = 10 << 20
+)
+
+// Validatable is implemented by types that check their own values once they have been decoded, by Bind and by the
+// types declared with BindTo. A body that it returns an error for is rejected with 422
+type Validatable interface {
+	Validate() error
+}
+
+// Binding is a Middleware that configures ctx.Bind for the routes it is added to, such as with MaxBytes and Strict:
+//
+//	g := vk.Group("/imports").WithMiddlewares(vk.Binding(vk.MaxBytes(10<<20), vk.Strict()))
+//
+// Options that aren't set keep the value of an outer Binding, or the server's default
+func Binding(opts ...JSONOption) Middleware {
+	return Named("binding", func(inner HandlerFunc) HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request, ctx *Ctx) error {
+			spec := ctx.bindSpec()
+			for _, opt := range opts {
+				opt(&spec)
+			}
+
+			ctx.binding = &spec
+
+			return inner(w, r, ctx)
+		}
+	})
+}
+
+// useBindMaxBytes sets the limit of the bodies decoded by ctx.Bind, DefaultBodyMaxBytes if maxBytes <= 0
+func (rt *Router) useBindMaxBytes(maxBytes int64) {
+	rt.bindMaxBytes = maxBytes
+}
+
+// bindSpec returns how Bind decodes the request's body: as set with Binding, or else with the server's limit
+func (c *Ctx) bindSpec() BodySpec {
+	if c.binding != nil {
+		return *c.binding
+	}
+
+	spec := BodySpec{MaxBytes: c.bindMaxBytes}
+	if spec.MaxBytes <= 0 {
+		spec.MaxBytes = DefaultBodyMaxBytes
+	}
+
+	return spec
+}
+
+// Bind decodes the request's body into dest, which must be a pointer, according to its Content-Type: JSON
+// (application/json or a +json type), or a form (application/x-www-form-urlencoded or multipart/form-data), whose
+// values are set on the fields named by their `form` tag, or else their `json` tag or name. Nested structs are
+// filled from names joined with dots, such as address.city. The files of a multipart form are available from
+// r.MultipartForm.
+//
+// Bodies larger than the limit set with Binding (the server's Body.MaxBytes, or DefaultBodyMaxBytes) are rejected
+// with 413, those with another Content-Type with 415, and those that are empty or can't be decoded with 400. If dest
+// is Validatable, a body it returns an error for is rejected with 422. JSON bodies of an older schema version of
+// dest's type are migrated first, see BindVersions. Each is a vk.Error that ErrorMiddleware responds with. The body
+// is buffered, so that it can still be read by the handler or a later middleware
+func (c *Ctx) Bind(r *http.Request, dest interface{}) error {
+	v := reflect.ValueOf(dest)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return fmt.Errorf("Bind requires a non-nil pointer, got %T", dest)
+	}
+
+	spec := c.bindSpec()
+
+	mediaType, params, _ := mime.ParseMediaType(r.Header.Get(contentTypeHeaderKey))
+
+	isJSON := mediaType == jsonContentType || strings.HasSuffix(mediaType, "+json")
+	if !isJSON && mediaType != formContentType && mediaType != multipartFormType {
+		return E(http.StatusUnsupportedMediaType, "content type must be application/json, "+formContentType+" or "+multipartFormType)
+	}
+
+	if encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); encoding != "" && encoding != "identity" {
+		return E(http.StatusUnsupportedMediaType, fmt.Sprintf("unsupported Content-Encoding %q", encoding))
+	}
+
+	data, err := readBindBody(r, spec.MaxBytes)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case isJSON:
+		if data, err = migrateBindBody(r.Header, data, dest); err != nil {
+			return err
+		}
+
+		if err := spec.decode(data, dest); err != nil {
+			return E(http.StatusBadRequest, "invalid JSON: "+err.Error())
+		}
+	case mediaType == formContentType:
+		values, err := url.ParseQuery(string(data))
+		if err != nil {
+			return E(http.StatusBadRequest, "invalid form: "+err.Error())
+		}
+
+		if err := decodeForm(values, v.Elem(), ""); err != nil {
+			return E(http.StatusBadRequest, "invalid form: "+err.Error())
+		}
+	default:
+		form, err := multipart.NewReader(bytes.NewReader(data), params["boundary"]).ReadForm(multipartMemoryBytes)
+		if err != nil {
+			return E(http.StatusBadRequest, "invalid multipart form: "+err.Error())
+		}
+
+		r.MultipartForm = form
+		c.OnCleanup(func() { _ = form.RemoveAll() })
+
+		if err := decodeForm(form.Value, v.Elem(), ""); err != nil {
+			return E(http.StatusBadRequest, "invalid form: "+err.Error())
+		}
+	}
+
+	if validator, ok := dest.(Validatable); ok {
+		if err := validator.Validate(); err != nil {
+			return E(http.StatusUnprocessableEntity, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// readBindBody reads the request's body up to maxBytes, and replaces it with a copy so that it can be read again
+func readBindBody(r *http.Request, maxBytes int64) ([]byte, error) {
+	if r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 {
+		return nil, E(http.StatusBadRequest, "request body is empty")
+	}
+
+	if r.ContentLength > maxBytes {
+		return nil, E(http.StatusRequestEntityTooLarge, http.StatusText(http.StatusRequestEntityTooLarge))
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxBytes+1))
+	r.Body.Close()
+
+	if err != nil {
+		return nil, E(http.StatusBadRequest, "failed to read request body")
+	}
+
+	if int64(len(data)) > maxBytes {
+		return nil, E(http.StatusRequestEntityTooLarge, http.StatusText(http.StatusRequestEntityTooLarge))
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(data))
+	r.ContentLength = int64(len(data))
+
+	if len(data) == 0 {
+		return nil, E(http.StatusBadRequest, "request body is empty")
+	}
+
+	return data, nil
+}
+
+// decodeForm sets the fields of the struct v from the form values, prefixing their names with prefix
+func decodeForm(values map[string][]string, v reflect.Value, prefix string) error {
+	if v.Kind() != reflect.Struct {
+		return errors.New("forms can only be bound to structs")
+	}
+
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name := formFieldName(field)
+		if name == "-" {
+			continue
+		}
+
+		if field.Anonymous && field.Tag.Get("form") == "" && field.Type.Kind() == reflect.Struct {
+			if err := decodeForm(values, v.Field(i), prefix); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if err := decodeFormField(values, v.Field(i), prefix+name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// decodeFormField sets a field from the form values for name, or from those below it if it is a nested struct
+func decodeFormField(values map[string][]string, f reflect.Value, name string) error {
+	if f.Kind() == reflect.Ptr {
+		if !hasFormValues(values, name, f.Type().Elem()) {
+			return nil
+		}
+
+		if f.IsNil() {
+			f.Set(reflect.New(f.Type().Elem()))
+		}
+
+		return decodeFormField(values, f.Elem(), name)
+	}
+
+	if f.Kind() == reflect.Struct && !implementsTextUnmarshaler(f) {
+		return decodeForm(values, f, name+".")
+	}
+
+	raw, ok := values[name]
+	if !ok || len(raw) == 0 {
+		return nil
+	}
+
+	if f.Kind() == reflect.Slice && f.Type().Elem().Kind() != reflect.Uint8 {
+		slice := reflect.MakeSlice(f.Type(), len(raw), len(raw))
+
+		for i, s := range raw {
+			if err := setFormValue(slice.Index(i), s); err != nil {
+				return errors.Wrapf(err, "field %s", name)
+			}
+		}
+
+		f.Set(slice)
+
+		return nil
+	}
+
+	if err := setFormValue(f, raw[0]); err != nil {
+		return errors.Wrapf(err, "field %s", name)
+	}
+
+	return nil
+}
+
+// setFormValue parses s into f
+func setFormValue(f reflect.Value, s string) error {
+	if u, ok := f.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(s))
+	}
+
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+
+		f.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, f.Type().Bits())
+		if err != nil {
+			return err
+		}
+
+		f.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, f.Type().Bits())
+		if err != nil {
+			return err
+		}
+
+		f.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(s, f.Type().Bits())
+		if err != nil {
+			return err
+		}
+
+		f.SetFloat(n)
+	case reflect.Slice:
+		f.SetBytes([]byte(s))
+	default:
+		return fmt.Errorf("unsupported type %s", f.Type())
+	}
+
+	return nil
+}
+
+// formFieldName returns the name of a struct field in a form: its form tag, else its json tag, else its name
+func formFieldName(field reflect.StructField) string {
+	for _, key := range []string{"form", "json"} {
+		if name, _, _ := strings.Cut(field.Tag.Get(key), ","); name != "" {
+			return name
+		}
+	}
+
+	return field.Name
+}
+
+// hasFormValues returns true if the form has a value for name, or for a field below it if t is a struct
+func hasFormValues(values map[string][]string, name string, t reflect.Type) bool {
+	if _, ok := values[name]; ok {
+		return true
+	}
+
+	if t.Kind() != reflect.Struct {
+		return false
+	}
+
+	for key := range values {
+		if strings.HasPrefix(key, name+".") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func implementsTextUnmarshaler(f reflect.Value) bool {
+	_, ok := f.Addr().Interface().(encoding.TextUnmarshaler)
+	return ok
+}
@@ -0,0 +1,205 @@
+package vk
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// BindVersioning declares how the schema version of the bodies bound to a type is read, see BindVersions
+type BindVersioning struct {
+	// Current is the version that the type decodes, which bodies of older versions are migrated to
+	Current int
+
+	// Header is the request header that declares the body's version, such as X-Schema-Version
+	Header string
+
+	// Field is the top-level field of a JSON body that declares its version, such as schema_version, as a number or
+	// a string, which is used if the header isn't sent. It is set to Current (as a number) when a body is migrated,
+	// so the type should declare it as a number if it is bound strictly
+	Field string
+
+	// Default is the version of bodies that don't declare one, Current if it is 0
+	Default int
+}
+
+// BindMigrationStep up-converts a JSON body by one version, editing its top-level fields in place
+type BindMigrationStep func(raw map[string]json.RawMessage) error
+
+// bindVersions are the versioning and migration steps registered for a type
+type bindVersions struct {
+	BindVersioning
+	steps []BindMigrationStep // steps[i] migrates from oldest+i to oldest+i+1
+}
+
+var (
+	bindVersionsLock sync.RWMutex
+	bindVersionTypes = map[reflect.Type]*bindVersions{}
+)
+
+// BindVersions declares the schema versions of the JSON bodies bound to T, by Bind and by routes that declare T with
+// BindTo. Bodies of the Current version are decoded as they are, and those of older versions are first migrated by
+// the steps registered with BindMigration, so that handlers only see the latest shape. Bodies of a version that isn't
+// supported are rejected with 400, naming the supported range. Versions are usually declared once at startup:
+//
+//	vk.BindVersions[UserRequest](vk.BindVersioning{Current: 3, Header: "X-Schema-Version", Field: "schema_version"})
+//	vk.BindMigration[UserRequest](renameFullName) // from 1 to 2
+//	vk.BindMigration[UserRequest](splitAddress)   // from 2 to 3
+func BindVersions[T any](versioning BindVersioning) {
+	t := typeOf[T]()
+
+	bindVersionsLock.Lock()
+	defer bindVersionsLock.Unlock()
+
+	versions, ok := bindVersionTypes[t]
+	if !ok {
+		versions = &bindVersions{}
+		bindVersionTypes[t] = versions
+	}
+
+	if versioning.Default == 0 {
+		versioning.Default = versioning.Current
+	}
+
+	versions.BindVersioning = versioning
+}
+
+// BindMigration adds a migration step for the JSON bodies bound to T. Steps are applied in the order they are
+// registered, the last one migrating to the Current version declared with BindVersions, so that each step added
+// supports one more version: with Current 3 and two steps, versions 1 to 3 are accepted. A step that returns an
+// error rejects the body with 400
+func BindMigration[T any](step BindMigrationStep) {
+	t := typeOf[T]()
+
+	bindVersionsLock.Lock()
+	defer bindVersionsLock.Unlock()
+
+	versions, ok := bindVersionTypes[t]
+	if !ok {
+		versions = &bindVersions{}
+		bindVersionTypes[t] = versions
+	}
+
+	versions.steps = append(versions.steps, step)
+}
+
+// bindVersionsOf returns the versions registered for the type that v points to, or nil
+func bindVersionsOf(v interface{}) *bindVersions {
+	bindVersionsLock.RLock()
+	defer bindVersionsLock.RUnlock()
+
+	if len(bindVersionTypes) == 0 {
+		return nil
+	}
+
+	t := reflect.TypeOf(v)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	versions, ok := bindVersionTypes[t]
+	if !ok || versions.Current == 0 {
+		return nil
+	}
+
+	copied := *versions
+	copied.steps = versions.steps[:len(versions.steps):len(versions.steps)]
+
+	return &copied
+}
+
+// migrateBindBody migrates the JSON body data to the latest version of the type that v points to, returning it as
+// it is if the type has no versions or the body is of the latest one
+func migrateBindBody(header http.Header, data []byte, v interface{}) ([]byte, error) {
+	versions := bindVersionsOf(v)
+	if versions == nil {
+		return data, nil
+	}
+
+	return versions.migrate(header, data)
+}
+
+// oldest returns the oldest version that can be migrated to the current one
+func (b *bindVersions) oldest() int {
+	return b.Current - len(b.steps)
+}
+
+// unsupported returns the error for a body of a version that can't be migrated
+func (b *bindVersions) unsupported(version string) Error {
+	if b.oldest() == b.Current {
+		return E(http.StatusBadRequest, fmt.Sprintf("unsupported schema version %s, the supported version is %d", version, b.Current))
+	}
+
+	return E(http.StatusBadRequest, fmt.Sprintf("unsupported schema version %s, the supported versions are %d to %d", version, b.oldest(), b.Current))
+}
+
+func (b *bindVersions) migrate(header http.Header, data []byte) ([]byte, error) {
+	version := b.Default
+	declared := ""
+
+	var raw map[string]json.RawMessage
+
+	if b.Header != "" {
+		declared = strings.TrimSpace(header.Get(b.Header))
+	}
+
+	// the body is only parsed if it may declare its version, which it can't unless it contains the field's name
+	if declared == "" && b.Field != "" && bytes.Contains(data, []byte(strconv.Quote(b.Field))) {
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return nil, E(http.StatusBadRequest, "invalid JSON: "+err.Error())
+		}
+
+		if field, ok := raw[b.Field]; ok {
+			declared = strings.Trim(string(field), `"`)
+		}
+	}
+
+	if declared != "" {
+		parsed, err := strconv.Atoi(declared)
+		if err != nil {
+			return nil, b.unsupported(strconv.Quote(declared))
+		}
+
+		version = parsed
+	}
+
+	if version == b.Current {
+		return data, nil
+	}
+
+	if version < b.oldest() || version > b.Current {
+		return nil, b.unsupported(strconv.Itoa(version))
+	}
+
+	if raw == nil {
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return nil, E(http.StatusBadRequest, "invalid JSON: "+err.Error())
+		}
+
+		if raw == nil {
+			return nil, E(http.StatusBadRequest, "a versioned body must be a JSON object")
+		}
+	}
+
+	for from := version; from < b.Current; from++ {
+		if err := b.steps[from-b.oldest()](raw); err != nil {
+			return nil, E(http.StatusBadRequest, fmt.Sprintf("failed to migrate body from schema version %d: %s", from, err.Error()))
+		}
+	}
+
+	if b.Field != "" {
+		raw[b.Field] = json.RawMessage(strconv.Itoa(b.Current))
+	}
+
+	migrated, err := json.Marshal(raw)
+	if err != nil {
+		return nil, E(http.StatusBadRequest, "failed to migrate body: "+err.Error())
+	}
+
+	return migrated, nil
+}
@@ -0,0 +1,275 @@
+package vk
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultBodyMaxBytes is the limit of a body preset that doesn't set MaxBytes
+	DefaultBodyMaxBytes = 1 << 20
+
+	jsonContentType = "application/json"
+)
+
+// BodySpec describes the request bodies that a route accepts, as declared with Body. It is reported by
+// Router.Routes, so that documentation such as request schemas can be generated from it
+type BodySpec struct {
+	ContentType string       `json:"content_type,omitempty"` // the media type of the body, i.e. application/json
+	MaxBytes    int64        `json:"max_bytes"`              // the limit of the body, after decompression
+	Strict      bool         `json:"strict,omitempty"`       // unknown fields are rejected
+	AllowGzip   bool         `json:"allow_gzip,omitempty"`   // bodies can be sent with Content-Encoding: gzip
+	Type        reflect.Type `json:"-"`                      // the type the body is bound to, see BindTo
+
+	bind      func() interface{}
+	conflicts []string
+}
+
+// BodyOption declares part of a route's body preset, see Body
+type BodyOption func(*BodySpec)
+
+// JSONOption configures the JSON body preset, see JSON
+type JSONOption func(*BodySpec)
+
+// Body is a Middleware that declares the body a route accepts, and parses it before the handler runs:
+//
+//	g.POST("/import", h, vk.Body(vk.JSON(vk.MaxBytes(10<<20), vk.Strict()), vk.AllowGzip(), vk.BindTo[ImportRequest]()))
+//
+// Bodies that are larger than the preset's limit are rejected with 413, and those with a Content-Type or
+// Content-Encoding it doesn't accept with 415. When a type is declared with BindTo, the body is decoded into it (400
+// if that fails) and available from ctx.Bound, after bodies of older schema versions are migrated (see BindVersions).
+// A route can only have one preset, including those of its groups, and Finalize refuses to mount the routes of a
+// router that has a route with more than one
+func Body(opts ...BodyOption) Middleware {
+	spec := &BodySpec{MaxBytes: DefaultBodyMaxBytes}
+	for _, opt := range opts {
+		opt(spec)
+	}
+
+	return func(inner HandlerFunc) HandlerFunc {
+		handler := func(w http.ResponseWriter, r *http.Request, ctx *Ctx) error {
+			if ctx.IsWebSocketUpgrade() {
+				return inner(w, r, ctx)
+			}
+
+			if err := spec.parse(w, r, ctx); err != nil {
+				return err
+			}
+
+			return inner(w, r, ctx)
+		}
+
+		// attach the spec to the chain so that it can be validated and reported without handling a request
+		l := &chainLink{name: "body", next: inner, handler: handler, value: spec}
+
+		return l.serve
+	}
+}
+
+// JSON declares that the body is JSON, which must be sent with the Content-Type application/json (or a +json type)
+func JSON(opts ...JSONOption) BodyOption {
+	return func(s *BodySpec) {
+		if s.ContentType != "" {
+			s.conflicts = append(s.conflicts, "the body's content type is declared more than once")
+		}
+
+		s.ContentType = jsonContentType
+
+		for _, opt := range opts {
+			opt(s)
+		}
+	}
+}
+
+// MaxBytes limits the body to maxBytes, after it has been decompressed. It is DefaultBodyMaxBytes by default
+func MaxBytes(maxBytes int64) JSONOption {
+	return func(s *BodySpec) {
+		s.MaxBytes = maxBytes
+	}
+}
+
+// Strict rejects bodies with fields that aren't in the type they are bound to. Types that contain a scalar
+// registered with RegisterScalar are decoded leniently, as DecodeJSON would
+func Strict() JSONOption {
+	return func(s *BodySpec) {
+		s.Strict = true
+	}
+}
+
+// AllowGzip accepts bodies sent with Content-Encoding: gzip, which are decompressed for the handler
+func AllowGzip() BodyOption {
+	return func(s *BodySpec) {
+		s.AllowGzip = true
+	}
+}
+
+// BindTo declares that the body is decoded into a *T, which the handler gets from ctx.Bound. If *T is Validatable,
+// bodies that it returns an error for are rejected with 422
+func BindTo[T any]() BodyOption {
+	return func(s *BodySpec) {
+		if s.bind != nil {
+			s.conflicts = append(s.conflicts, "the body is bound to more than one type")
+		}
+
+		s.Type = reflect.TypeOf((*T)(nil)).Elem()
+		s.bind = func() interface{} { return new(T) }
+	}
+}
+
+// Bound returns the body decoded by the route's Body preset, which is a pointer to the type declared with BindTo, or
+// nil if it didn't declare one
+func (c *Ctx) Bound() interface{} {
+	if c == nil {
+		return nil
+	}
+
+	return c.bound
+}
+
+// parse applies the preset to the request, replacing its body with the (decompressed and limited) body
+func (s *BodySpec) parse(w http.ResponseWriter, r *http.Request, ctx *Ctx) error {
+	if s.ContentType != "" {
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get(contentTypeHeaderKey))
+		if mediaType != s.ContentType && !(s.ContentType == jsonContentType && strings.HasSuffix(mediaType, "+json")) {
+			return E(http.StatusUnsupportedMediaType, "content type must be "+s.ContentType)
+		}
+	}
+
+	if r.Body == nil || r.Body == http.NoBody {
+		if s.bind != nil {
+			return E(http.StatusBadRequest, "request body is empty")
+		}
+
+		return nil
+	}
+
+	encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+
+	switch {
+	case encoding == "" || encoding == "identity":
+		if r.ContentLength > s.MaxBytes {
+			return E(http.StatusRequestEntityTooLarge, http.StatusText(http.StatusRequestEntityTooLarge))
+		}
+	case encoding == "gzip" && s.AllowGzip:
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return E(http.StatusBadRequest, "invalid gzip body")
+		}
+
+		r.Body = &gzipBody{Reader: gz, wire: r.Body}
+
+		// the handler receives the decompressed body
+		r.Header.Del("Content-Encoding")
+		r.ContentLength = -1
+	default:
+		return E(http.StatusUnsupportedMediaType, fmt.Sprintf("unsupported Content-Encoding %q", encoding))
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, s.MaxBytes)
+
+	if s.bind == nil {
+		return nil
+	}
+
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return E(http.StatusRequestEntityTooLarge, http.StatusText(http.StatusRequestEntityTooLarge))
+		}
+
+		if errors.Is(err, gzip.ErrChecksum) || errors.Is(err, gzip.ErrHeader) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return E(http.StatusBadRequest, "invalid gzip body")
+		}
+
+		return E(http.StatusBadRequest, "failed to read request body")
+	}
+
+	v := s.bind()
+
+	if data, err = migrateBindBody(r.Header, data, v); err != nil {
+		return err
+	}
+
+	if err := s.decode(data, v); err != nil {
+		return E(http.StatusBadRequest, "invalid JSON: "+err.Error())
+	}
+
+	if validator, ok := v.(Validatable); ok {
+		if err := validator.Validate(); err != nil {
+			return E(http.StatusUnprocessableEntity, err.Error())
+		}
+	}
+
+	ctx.bound = v
+
+	// the handler can still read the body it was sent
+	r.Body = io.NopCloser(bytes.NewReader(data))
+	r.ContentLength = int64(len(data))
+
+	return nil
+}
+
+// decode decodes data into v, rejecting unknown fields if the preset is strict
+func (s *BodySpec) decode(data []byte, v interface{}) error {
+	if !s.Strict || planFor(reflect.TypeOf(v).Elem()).kind != planPlain {
+		return DecodeJSON(data, v)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+
+	if dec.More() {
+		return errors.New("unexpected data after the top-level value")
+	}
+
+	return nil
+}
+
+// gzipBody decompresses a request body, closing the body as it was sent
+type gzipBody struct {
+	*gzip.Reader
+	wire io.ReadCloser
+}
+
+func (b *gzipBody) Close() error {
+	b.Reader.Close()
+	return b.wire.Close()
+}
+
+// bodySpecOf returns the body preset of a route's handler, or an error if it has more than one
+func bodySpecOf(handler HandlerFunc) (*BodySpec, error) {
+	var found *BodySpec
+
+	for _, v := range chainValues(handler) {
+		spec, ok := v.(*BodySpec)
+		if !ok {
+			continue
+		}
+
+		if found != nil {
+			return nil, errors.New("more than one body preset is declared")
+		}
+
+		if len(spec.conflicts) > 0 {
+			return nil, errors.New(strings.Join(spec.conflicts, ", "))
+		}
+
+		found = spec
+	}
+
+	return found, nil
+}
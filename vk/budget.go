@@ -0,0 +1,148 @@
+package vk
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DeadlineHeader carries the time a request has left, in milliseconds, see UseDeadlinePropagation
+const DeadlineHeader = "X-Deadline-Ms"
+
+const (
+	defaultDeadlineAllowance = 10 * time.Millisecond
+	defaultMaxDeadlineBudget = 5 * time.Minute
+	minDeadlineBudget        = time.Millisecond
+)
+
+// DeadlinePropagation configures how the time left to handle a request is shared with the services it calls
+type DeadlinePropagation struct {
+	Header    string        // the header carrying the budget, DeadlineHeader by default
+	Allowance time.Duration // taken off the budget of each outbound call for the network, 10ms by default
+	Max       time.Duration // the largest budget accepted or sent, larger ones are clamped to it, 5 minutes by default
+}
+
+// withDefaults returns the settings with the empty ones set to their defaults
+func (d DeadlinePropagation) withDefaults() DeadlinePropagation {
+	if d.Header == "" {
+		d.Header = DeadlineHeader
+	}
+
+	if d.Allowance <= 0 {
+		d.Allowance = defaultDeadlineAllowance
+	}
+
+	if d.Max <= 0 {
+		d.Max = defaultMaxDeadlineBudget
+	}
+
+	return d
+}
+
+// clamp bounds a budget between a millisecond and the maximum
+func (d *DeadlinePropagation) clamp(budget time.Duration) time.Duration {
+	if budget < minDeadlineBudget {
+		return minDeadlineBudget
+	}
+
+	if budget > d.Max {
+		return d.Max
+	}
+
+	return budget
+}
+
+// inbound returns the budget declared by a request, and false if it didn't declare a valid one
+func (d *DeadlinePropagation) inbound(r *http.Request) (time.Duration, bool) {
+	if d == nil {
+		return 0, false
+	}
+
+	value := strings.TrimSpace(r.Header.Get(d.Header))
+	if value == "" {
+		return 0, false
+	}
+
+	ms, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || ms < 0 {
+		return 0, false
+	}
+
+	// very large values are clamped before being converted, so that they can't overflow
+	if ms > d.Max.Milliseconds() {
+		return d.Max, true
+	}
+
+	return d.clamp(time.Duration(ms) * time.Millisecond), true
+}
+
+// outbound sets the budget of a call with the given deadline on its headers, less the network allowance
+func (d *DeadlinePropagation) outbound(h http.Header, deadline time.Time) {
+	budget := d.clamp(time.Until(deadline) - d.Allowance)
+
+	h.Set(d.Header, strconv.FormatInt(budget.Milliseconds(), 10))
+}
+
+// useDeadlineBudget gives the request the deadline declared by its client, unless it already has an earlier one,
+// returning the request with that deadline and a function that releases it and logs how long the request took
+func (c *Ctx) useDeadlineBudget(r *http.Request, budget time.Duration) (*http.Request, func()) {
+	start, log := time.Now(), c.Log
+
+	reqCtx, cancelReq := context.WithTimeout(r.Context(), budget)
+	handlerCtx, cancelHandler := context.WithTimeout(c.Context, budget)
+
+	c.Context = handlerCtx
+	c.budget = budget
+
+	done := func() {
+		cancelReq()
+		cancelHandler()
+
+		took := time.Since(start)
+
+		logFn := log.Debug
+		if took > budget {
+			logFn = log.Warn
+		}
+
+		logFn(fmt.Sprintf("deadline budget: declared %dms, took %dms", budget.Milliseconds(), took.Milliseconds()))
+	}
+
+	return r.WithContext(reqCtx), done
+}
+
+// DeadlineBudget returns the time the request's client declared it had left to handle the request (see
+// UseDeadlinePropagation), or 0 if it didn't declare one
+func (c *Ctx) DeadlineBudget() time.Duration {
+	if c == nil {
+		return 0
+	}
+
+	return c.budget
+}
+
+// applyDeadlineHeader sets the budget of an outbound call whose context is callCtx on its headers, if the router
+// propagates deadlines and the call has one
+func (c *Ctx) applyDeadlineHeader(h http.Header, callCtx context.Context) {
+	if c == nil || c.deadlines == nil {
+		return
+	}
+
+	if deadline, ok := callCtx.Deadline(); ok {
+		c.deadlines.outbound(h, deadline)
+	}
+}
+
+// useDeadlinePropagation sets how the router's requests share their deadlines, or turns it off if d is nil
+func (rt *Router) useDeadlinePropagation(d *DeadlinePropagation) {
+	if d == nil {
+		rt.deadlines = nil
+		return
+	}
+
+	withDefaults := d.withDefaults()
+	rt.deadlines = &withDefaults
+}
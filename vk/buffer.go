@@ -0,0 +1,84 @@
+package vk
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// minPooledBufferBytes is the capacity that new pooled buffers are created with, at the least
+	minPooledBufferBytes = 512
+
+	// maxPooledBufferBytes is the capacity of the largest buffer returned to the pool, larger ones are dropped so
+	// that a single huge response doesn't pin its memory for as long as the pool keeps the buffer
+	maxPooledBufferBytes = 64 << 10
+)
+
+// pooledBufferBytes is the capacity that new pooled buffers are created with, a moving average of the bytes
+// written to the buffers returned to the pool, so that typical responses fit without growing the buffer
+var pooledBufferBytes int64 = minPooledBufferBytes
+
+var bufferPool = sync.Pool{New: func() interface{} {
+	return bytes.NewBuffer(make([]byte, 0, atomic.LoadInt64(&pooledBufferBytes)))
+}}
+
+// getBuffer returns an empty buffer from the pool
+func getBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+// putBuffer returns buf to the pool, nothing may use it (or a slice of its bytes) afterwards
+func putBuffer(buf *bytes.Buffer) {
+	if buf == nil {
+		return
+	}
+
+	size := atomic.LoadInt64(&pooledBufferBytes)
+	size += (int64(buf.Len()) - size) / 8
+
+	if size < minPooledBufferBytes {
+		size = minPooledBufferBytes
+	} else if size > maxPooledBufferBytes {
+		size = maxPooledBufferBytes
+	}
+
+	atomic.StoreInt64(&pooledBufferBytes, size)
+
+	if buf.Cap() > maxPooledBufferBytes {
+		return
+	}
+
+	buf.Reset()
+	bufferPool.Put(buf)
+}
+
+// Buffer returns a buffer for building the request's response, such as one encoded with a library that writes to
+// an io.Writer. It is empty when it is first returned, and the same buffer is returned for the rest of the request.
+// The buffer is taken from a pool and returned to it once the response is written, so neither it nor its bytes may
+// be used (or kept) after the handler returns; copy them to keep them
+func (c *Ctx) Buffer() *bytes.Buffer {
+	if c.buffer == nil {
+		c.buffer = getBuffer()
+	}
+
+	return c.buffer
+}
+
+// releaseBuffer returns the Ctx's buffer to the pool, if it took one
+func (c *Ctx) releaseBuffer() {
+	putBuffer(c.buffer)
+	c.buffer = nil
+}
+
+// encodeJSONTo encodes v into buf like json.Marshal, without the newline written by json.Encoder
+func encodeJSONTo(buf *bytes.Buffer, v interface{}) error {
+	if err := json.NewEncoder(buf).Encode(v); err != nil {
+		return err
+	}
+
+	buf.Truncate(buf.Len() - 1)
+
+	return nil
+}
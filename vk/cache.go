@@ -0,0 +1,688 @@
+package vk
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultCacheMaxEntries   = 1000
+	defaultCacheMaxBodyBytes = 1 << 20
+
+	// cacheRefreshTimeout bounds a background refresh, which isn't cancelled with the request that started it
+	cacheRefreshTimeout = 30 * time.Second
+	// cacheRefreshBackoff is how long after a failed background refresh the next one can start
+	cacheRefreshBackoff = time.Second
+
+	cacheStatusHeader  = "X-Cache"
+	surrogateKeyHeader = "Surrogate-Key"
+
+	staleWarning              = `110 - "Response is Stale"`
+	revalidationFailedWarning = `111 - "Revalidation Failed"`
+)
+
+// CacheOptions configures a ResponseCache
+type CacheOptions struct {
+	// TTL is how long a response is fresh, and served from the cache without calling the handler
+	TTL time.Duration
+
+	// StaleWhileRevalidate is how long after TTL a stale response is still served, while it is refreshed in the
+	// background by a single request
+	StaleWhileRevalidate time.Duration
+
+	// StaleIfError is how long after TTL a stale response is served if the handler fails to refresh it, with an
+	// error or a 5xx status
+	StaleIfError time.Duration
+
+	// Key identifies the response to a request, its method and URI (path and query) by default. It must include
+	// anything that the response varies on, such as the user for personalised responses
+	Key func(ctx *Ctx) string
+
+	// Tags returns the tags of a response, which are purged by a mutation route declared with Invalidates, such as
+	// CacheTags("user:{id}"). The space-separated tags of a Surrogate-Key header set by the handler are added to them
+	Tags func(ctx *Ctx) []string
+
+	// MaxEntries is the number of responses kept, 1000 by default. Once it is reached, new responses aren't cached
+	// until expired ones are removed
+	MaxEntries int
+
+	// MaxBodyBytes is the size of the largest response that is cached, 1MB by default
+	MaxBodyBytes int64
+
+	// Now returns the current time, time.Now by default
+	Now func() time.Time
+}
+
+// CacheStats counts the requests handled by a ResponseCache
+type CacheStats struct {
+	Entries         int    `json:"entries"`
+	Hits            uint64 `json:"hits"`
+	Misses          uint64 `json:"misses"`         // requests that called the handler
+	Stale           uint64 `json:"stale"`          // stale responses served while being refreshed
+	StaleIfError    uint64 `json:"stale_if_error"` // stale responses served because the handler failed
+	Refreshes       uint64 `json:"refreshes"`      // successful background refreshes
+	RefreshFailures uint64 `json:"refresh_failures"`
+	Refreshing      int32  `json:"refreshing"` // background refreshes running, at most one per key
+}
+
+// cacheState is the state of a key's entry at a point in time
+type cacheState int
+
+const (
+	cacheMissing cacheState = iota
+	cacheFresh
+	cacheStale        // served while it is refreshed in the background
+	cacheStaleIfError // only served if the handler fails
+)
+
+// cacheEntry is a cached response. Its response fields are never modified, so it can be served without the lock
+type cacheEntry struct {
+	status int
+	header http.Header
+	body   []byte
+	stored time.Time
+	tags   []string
+
+	// guarded by the cache's lock
+	refreshing bool
+	retryAt    time.Time // a failed refresh isn't retried before
+}
+
+// cacheCall is the handler call filling a key, which other requests for the key wait for
+type cacheCall struct {
+	done chan struct{}
+}
+
+// ResponseCache caches the successful responses of GET and HEAD requests, and serves them while they are fresh. Once
+// a response expires, it can be served stale while a single background refresh replaces it (see
+// CacheOptions.StaleWhileRevalidate), so that popular responses expiring don't make their clients wait, and while
+// the handler fails (see CacheOptions.StaleIfError). Concurrent requests for a response that isn't cached wait for
+// the first of them instead of all calling the handler.
+//
+// Responses are buffered, and only 200 responses without a Set-Cookie header or a Cache-Control of no-store or
+// private are cached. Each response has an X-Cache header of HIT, MISS or STALE, and cached ones have an Age header.
+// Responses can be tagged (see CacheOptions.Tags) for mutation routes to purge them, see Invalidates
+type ResponseCache struct {
+	opts CacheOptions
+
+	lock        sync.Mutex
+	entries     map[string]*cacheEntry
+	calls       map[string]*cacheCall
+	tagged      map[string]map[string]bool // the keys of the entries with each tag
+	invalidated uint64                     // incremented by each purge, so that responses it raced aren't stored
+
+	hits            uint64
+	misses          uint64
+	stale           uint64
+	staleIfError    uint64
+	refreshes       uint64
+	refreshFailures uint64
+	refreshing      int32
+}
+
+// CacheMiddleware returns a Middleware that caches responses with opts, see NewResponseCache. Each call creates a
+// separate cache, so routes can be given their own options
+func CacheMiddleware(opts CacheOptions) Middleware {
+	return NewResponseCache(opts).Middleware()
+}
+
+// NewResponseCache creates a ResponseCache, see ResponseCache
+func NewResponseCache(opts CacheOptions) *ResponseCache {
+	if opts.Key == nil {
+		opts.Key = func(ctx *Ctx) string {
+			return ctx.request.Method + " " + ctx.request.URL.RequestURI()
+		}
+	}
+
+	if opts.MaxEntries <= 0 {
+		opts.MaxEntries = defaultCacheMaxEntries
+	}
+
+	if opts.MaxBodyBytes <= 0 {
+		opts.MaxBodyBytes = defaultCacheMaxBodyBytes
+	}
+
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+
+	c := &ResponseCache{
+		opts:    opts,
+		entries: map[string]*cacheEntry{},
+		calls:   map[string]*cacheCall{},
+		tagged:  map[string]map[string]bool{},
+	}
+
+	return c
+}
+
+// Stats returns the number of cached responses and how requests were served
+func (c *ResponseCache) Stats() CacheStats {
+	c.lock.Lock()
+	entries := len(c.entries)
+	c.lock.Unlock()
+
+	stats := CacheStats{
+		Entries:         entries,
+		Hits:            atomic.LoadUint64(&c.hits),
+		Misses:          atomic.LoadUint64(&c.misses),
+		Stale:           atomic.LoadUint64(&c.stale),
+		StaleIfError:    atomic.LoadUint64(&c.staleIfError),
+		Refreshes:       atomic.LoadUint64(&c.refreshes),
+		RefreshFailures: atomic.LoadUint64(&c.refreshFailures),
+		Refreshing:      atomic.LoadInt32(&c.refreshing),
+	}
+
+	return stats
+}
+
+// RegisterAdmin mounts GET /cache on the admin router, reporting the cache's stats
+func (c *ResponseCache) RegisterAdmin(r *Router) {
+	r.GET("/cache", func(w http.ResponseWriter, _ *http.Request, ctx *Ctx) error {
+		return RespondJSON(ctx.Context, w, c.Stats(), http.StatusOK)
+	})
+}
+
+// Middleware returns a Middleware that serves responses from the cache
+func (c *ResponseCache) Middleware() Middleware {
+	return Named("cache", func(inner HandlerFunc) HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request, ctx *Ctx) error {
+			if r.Method != http.MethodGet && r.Method != http.MethodHead {
+				return inner(w, r, ctx)
+			}
+
+			// the key function reads the request from the Ctx
+			ctx.useRequest(r)
+			key := c.opts.Key(ctx)
+
+			ctx.invalidation.register(c)
+
+			for {
+				now := c.opts.Now()
+
+				c.lock.Lock()
+
+				entry := c.entries[key]
+				state := c.state(entry, now)
+
+				switch state {
+				case cacheFresh:
+					c.lock.Unlock()
+					atomic.AddUint64(&c.hits, 1)
+
+					return c.serve(w, entry, now, "HIT", "")
+				case cacheStale:
+					refresh := !entry.refreshing && !now.Before(entry.retryAt)
+					if refresh {
+						entry.refreshing = true
+					}
+
+					c.lock.Unlock()
+					atomic.AddUint64(&c.stale, 1)
+
+					if refresh {
+						rctx, rr := detachCtx(ctx, r)
+						go c.refresh(key, entry, rr, rctx, inner)
+					}
+
+					return c.serve(w, entry, now, "STALE", staleWarning)
+				}
+
+				// a missing or expired response is filled by one request, which the others wait for
+				if call, ok := c.calls[key]; ok {
+					c.lock.Unlock()
+
+					select {
+					case <-call.done:
+						continue
+					case <-r.Context().Done():
+						return r.Context().Err()
+					}
+				}
+
+				call := &cacheCall{done: make(chan struct{})}
+				c.calls[key] = call
+				c.lock.Unlock()
+
+				return c.fill(key, entry, state, call, w, r, ctx, inner)
+			}
+		}
+	})
+}
+
+// fill calls the handler for a response that isn't fresh, caching it if it succeeds or serving the stale entry if
+// it fails within the stale-if-error window
+func (c *ResponseCache) fill(key string, entry *cacheEntry, state cacheState, call *cacheCall, w http.ResponseWriter, r *http.Request, ctx *Ctx, inner HandlerFunc) error {
+	defer func() {
+		c.lock.Lock()
+		delete(c.calls, key)
+		c.lock.Unlock()
+
+		close(call.done)
+	}()
+
+	rec := newCacheRecorder(w, c.opts.MaxBodyBytes)
+	invalidated := c.invalidations()
+
+	err := c.record(rec, r, ctx, inner)
+
+	if state == cacheStaleIfError && !rec.passthrough && !rec.committed && (err != nil || rec.status >= http.StatusInternalServerError) {
+		atomic.AddUint64(&c.staleIfError, 1)
+
+		if err != nil {
+			ctx.Log.Warn(fmt.Sprintf("cache: serving stale %s after the handler failed: %s", key, err))
+		}
+
+		return c.serve(w, entry, c.opts.Now(), "STALE", revalidationFailedWarning)
+	}
+
+	atomic.AddUint64(&c.misses, 1)
+
+	if err == nil && rec.cacheable() {
+		c.store(key, rec, c.tags(ctx, rec), invalidated)
+	}
+
+	rec.finish()
+
+	return err
+}
+
+// refresh replaces a stale entry in the background
+func (c *ResponseCache) refresh(key string, stale *cacheEntry, r *http.Request, ctx *Ctx, inner HandlerFunc) {
+	atomic.AddInt32(&c.refreshing, 1)
+
+	succeeded := false
+
+	defer func() {
+		if value := recover(); value != nil {
+			ctx.Log.ErrorString(fmt.Sprintf("cache: recovered panic refreshing %s: %v", key, value))
+		}
+
+		c.lock.Lock()
+		stale.refreshing = false
+		if !succeeded {
+			stale.retryAt = c.opts.Now().Add(cacheRefreshBackoff)
+		}
+		c.lock.Unlock()
+
+		if succeeded {
+			atomic.AddUint64(&c.refreshes, 1)
+		} else {
+			atomic.AddUint64(&c.refreshFailures, 1)
+		}
+
+		atomic.AddInt32(&c.refreshing, -1)
+	}()
+
+	defer runDetachedCleanups(ctx)
+
+	rec := newCacheRecorder(nil, c.opts.MaxBodyBytes)
+	invalidated := c.invalidations()
+
+	if err := c.record(rec, r, ctx, inner); err != nil {
+		ctx.Log.Warn(fmt.Sprintf("cache: failed to refresh %s: %s", key, err))
+		return
+	}
+
+	if rec.cacheable() {
+		c.store(key, rec, c.tags(ctx, rec), invalidated)
+		succeeded = true
+	}
+}
+
+// record calls inner with rec, which collects the headers it sets on the Ctx
+func (c *ResponseCache) record(rec *cacheRecorder, r *http.Request, ctx *Ctx, inner HandlerFunc) error {
+	headers := ctx.RespHeaders
+	ctx.RespHeaders = rec.header
+
+	ctx.onCommit(func(int) {
+		rec.commit()
+	})
+
+	defer func() {
+		ctx.RespHeaders = headers
+	}()
+
+	return inner(rec, r, ctx)
+}
+
+// state returns the state of entry at now
+func (c *ResponseCache) state(entry *cacheEntry, now time.Time) cacheState {
+	if entry == nil {
+		return cacheMissing
+	}
+
+	age := now.Sub(entry.stored)
+
+	switch {
+	case age < c.opts.TTL:
+		return cacheFresh
+	case age < c.opts.TTL+c.opts.StaleWhileRevalidate:
+		return cacheStale
+	case age < c.opts.TTL+c.opts.StaleIfError:
+		return cacheStaleIfError
+	}
+
+	return cacheMissing
+}
+
+// store caches the recorded response, unless the cache is full of unexpired entries, or it was purged while the
+// response was being produced (invalidated is the count of purges when it started), as it may predate the mutation
+func (c *ResponseCache) store(key string, rec *cacheRecorder, tags []string, invalidated uint64) {
+	now := c.opts.Now()
+
+	entry := &cacheEntry{
+		status: rec.status,
+		header: rec.header.Clone(),
+		body:   rec.body.Bytes(),
+		stored: now,
+		tags:   tags,
+	}
+
+	if entry.status == 0 {
+		entry.status = http.StatusOK
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.invalidated != invalidated {
+		return
+	}
+
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.opts.MaxEntries {
+		c.sweep(now)
+
+		if len(c.entries) >= c.opts.MaxEntries {
+			return
+		}
+	}
+
+	c.remove(key)
+	c.entries[key] = entry
+
+	for _, tag := range tags {
+		keys, ok := c.tagged[tag]
+		if !ok {
+			keys = map[string]bool{}
+			c.tagged[tag] = keys
+		}
+
+		keys[key] = true
+	}
+}
+
+// remove removes the entry of key and its tags, with the lock held
+func (c *ResponseCache) remove(key string) {
+	entry, ok := c.entries[key]
+	if !ok {
+		return
+	}
+
+	delete(c.entries, key)
+
+	for _, tag := range entry.tags {
+		if keys, ok := c.tagged[tag]; ok {
+			delete(keys, key)
+
+			if len(keys) == 0 {
+				delete(c.tagged, tag)
+			}
+		}
+	}
+}
+
+// sweep removes the entries that can no longer be served
+func (c *ResponseCache) sweep(now time.Time) {
+	for key, e := range c.entries {
+		if c.state(e, now) == cacheMissing && !e.refreshing {
+			c.remove(key)
+		}
+	}
+}
+
+// Invalidate purges the responses tagged with any of tags, and keeps responses that were being produced while it
+// happened from being stored. It makes ResponseCache a CacheInvalidator
+func (c *ResponseCache) Invalidate(_ context.Context, tags []string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.invalidated++
+
+	for _, tag := range tags {
+		for key := range c.tagged[tag] {
+			c.remove(key)
+		}
+	}
+
+	return nil
+}
+
+// invalidations returns the number of purges so far, see store
+func (c *ResponseCache) invalidations() uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.invalidated
+}
+
+// tags returns the tags of a recorded response, from CacheOptions.Tags and its Surrogate-Key header
+func (c *ResponseCache) tags(ctx *Ctx, rec *cacheRecorder) []string {
+	var tags []string
+	if c.opts.Tags != nil {
+		tags = append(tags, c.opts.Tags(ctx)...)
+	}
+
+	for _, v := range rec.header.Values(surrogateKeyHeader) {
+		tags = append(tags, strings.Fields(v)...)
+	}
+
+	return tags
+}
+
+// serve writes a cached response
+func (c *ResponseCache) serve(w http.ResponseWriter, entry *cacheEntry, now time.Time, status, warning string) error {
+	header := w.Header()
+	for k, v := range entry.header {
+		header[k] = v
+	}
+
+	age := now.Sub(entry.stored)
+	if age < 0 {
+		age = 0
+	}
+
+	header.Set("Age", strconv.Itoa(int(age.Seconds())))
+	header.Set(cacheStatusHeader, status)
+
+	if warning != "" {
+		header.Set("Warning", warning)
+	}
+
+	w.WriteHeader(entry.status)
+	_, err := w.Write(entry.body)
+
+	return err
+}
+
+// cacheRecorder buffers a response so that it can be cached, writing it to w once the handler has finished. A
+// response larger than the limit is written to w as it is produced instead, and isn't cached
+type cacheRecorder struct {
+	w      http.ResponseWriter // nil for background refreshes
+	header http.Header
+	status int
+	body   bytes.Buffer
+	limit  int64
+
+	passthrough bool // the response was too large to buffer, and is being written to w
+	committed   bool // the response was written below the recorder, see CommitResponse
+	finished    bool
+}
+
+func newCacheRecorder(w http.ResponseWriter, limit int64) *cacheRecorder {
+	return &cacheRecorder{w: w, header: http.Header{}, limit: limit}
+}
+
+func (rec *cacheRecorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *cacheRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+}
+
+func (rec *cacheRecorder) Write(p []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+
+	if rec.passthrough {
+		return rec.w.Write(p)
+	}
+
+	if int64(rec.body.Len()+len(p)) > rec.limit {
+		if rec.w == nil {
+			return 0, http.ErrContentLength
+		}
+
+		rec.passthrough = true
+		rec.finish()
+
+		return rec.w.Write(p)
+	}
+
+	rec.body.Write(p)
+
+	return len(p), nil
+}
+
+// cacheable returns true if the response can be cached
+func (rec *cacheRecorder) cacheable() bool {
+	if rec.passthrough || rec.committed || (rec.status != 0 && rec.status != http.StatusOK) {
+		return false
+	}
+
+	if len(rec.header.Values("Set-Cookie")) > 0 {
+		return false
+	}
+
+	for _, v := range rec.header.Values("Cache-Control") {
+		for _, directive := range strings.Split(v, ",") {
+			switch strings.ToLower(strings.TrimSpace(directive)) {
+			case "no-store", "private":
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// commit hands the response over to CommitResponse, which writes it below the recorder, with the headers set so far.
+// It isn't cached, and anything written to the recorder afterwards is a second response
+func (rec *cacheRecorder) commit() {
+	rec.committed = true
+
+	if rec.w == nil || rec.finished {
+		return
+	}
+
+	header := rec.w.Header()
+	for k, v := range rec.header {
+		header[k] = v
+	}
+}
+
+// finish writes the recorded headers, status and body to w
+func (rec *cacheRecorder) finish() {
+	if rec.finished {
+		return
+	}
+
+	rec.finished = true
+
+	header := rec.w.Header()
+	for k, v := range rec.header {
+		header[k] = v
+	}
+
+	header.Set(cacheStatusHeader, "MISS")
+
+	// a handler that wrote nothing (such as one that returned an error) leaves the response to the error middleware
+	if rec.status == 0 {
+		return
+	}
+
+	rec.w.WriteHeader(rec.status)
+
+	if rec.body.Len() > 0 {
+		_, _ = rec.w.Write(rec.body.Bytes())
+	}
+
+	rec.body = bytes.Buffer{}
+}
+
+// detachCtx returns copies of ctx and r for handling the request in the background: they have the values of the
+// request's contexts, but aren't cancelled with it, and the Ctx has its own headers and cleanups
+func detachCtx(ctx *Ctx, r *http.Request) (*Ctx, *http.Request) {
+	detached := *ctx
+	detached.RespHeaders = http.Header{}
+	detached.cleanups = nil
+	detached.cleanupCounter = nil
+	detached.outboundHeaders = nil
+	detached.vary = nil
+	detached.patch = nil
+	detached.retriesUsed = 0
+
+	// a background request has no client to commit a response to
+	detached.guard = nil
+	detached.commitHooks = nil
+
+	reqCtx, cancelReq := context.WithTimeout(detachedContext{r.Context()}, cacheRefreshTimeout)
+	handlerCtx, cancelHandler := context.WithTimeout(detachedContext{ctx.Context}, cacheRefreshTimeout)
+
+	detached.Context = handlerCtx
+	detached.OnCleanup(cancelReq)
+	detached.OnCleanup(cancelHandler)
+
+	dr := r.WithContext(reqCtx)
+	detached.useRequest(dr)
+
+	return &detached, dr
+}
+
+// runDetachedCleanups calls the cleanups of a Ctx created by detachCtx, last registered first
+func runDetachedCleanups(ctx *Ctx) {
+	for i := len(ctx.cleanups) - 1; i >= 0; i-- {
+		func() {
+			defer func() {
+				if value := recover(); value != nil {
+					ctx.Log.ErrorString(fmt.Sprintf("recovered panic in cleanup %s: %v", funcName(ctx.cleanups[i]), value))
+				}
+			}()
+
+			ctx.cleanups[i]()
+		}()
+	}
+
+	ctx.cleanups = nil
+}
+
+// detachedContext has the values of its parent, but not its deadline or cancellation
+type detachedContext struct {
+	parent context.Context
+}
+
+func (d detachedContext) Deadline() (time.Time, bool)       { return time.Time{}, false }
+func (d detachedContext) Done() <-chan struct{}             { return nil }
+func (d detachedContext) Err() error                        { return nil }
+func (d detachedContext) Value(key interface{}) interface{} { return d.parent.Value(key) }
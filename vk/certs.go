@@ -0,0 +1,249 @@
+package vk
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/acme/autocert"
+
+	"github.com/suborbital/vektor/vlog"
+)
+
+const defaultCertReloadInterval = 10 * time.Second
+
+// certStore holds the certificates loaded from a directory of <hostname>.crt/.key pairs. The certificates are swapped
+// atomically on reload, so in-flight handshakes keep using the certificate they were given
+type certStore struct {
+	dir      string
+	interval time.Duration
+	log      *vlog.Logger
+	certs    atomic.Value // map[string]*tls.Certificate
+
+	reloads  uint64
+	failures uint64
+
+	// held while loading, as a reload can be forced while the directory is being watched
+	loadLock sync.Mutex
+	loaded   bool
+	modTimes map[string]time.Time
+}
+
+// newCertStore loads the certificates in dir
+func newCertStore(dir string, log *vlog.Logger) (*certStore, error) {
+	c := &certStore{
+		dir:      dir,
+		log:      log,
+		modTimes: map[string]time.Time{},
+	}
+
+	c.certs.Store(map[string]*tls.Certificate{})
+
+	if _, err := c.reload(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// get returns the certificate for host, or nil if there isn't one
+func (c *certStore) get(host string) *tls.Certificate {
+	return c.certs.Load().(map[string]*tls.Certificate)[host]
+}
+
+// reload loads any certificates that have been added or changed since the last load, returning true if any were.
+// A pair that fails to load (i.e. one that is partially written) is skipped, and its previous certificate is kept
+func (c *certStore) reload() (bool, error) {
+	c.loadLock.Lock()
+	defer c.loadLock.Unlock()
+
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		atomic.AddUint64(&c.failures, 1)
+		return false, errors.Wrap(err, "failed to ReadDir")
+	}
+
+	current := c.certs.Load().(map[string]*tls.Certificate)
+	next := make(map[string]*tls.Certificate, len(current))
+	modTimes := make(map[string]time.Time, len(current))
+	changed := false
+
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".crt" {
+			continue
+		}
+
+		host := strings.ToLower(strings.TrimSuffix(entry.Name(), ".crt"))
+		certFile := filepath.Join(c.dir, entry.Name())
+		keyFile := strings.TrimSuffix(certFile, ".crt") + ".key"
+
+		modTime, err := latestModTime(certFile, keyFile)
+		if err != nil {
+			continue
+		}
+
+		modTimes[host] = modTime
+
+		if existing, ok := current[host]; ok && c.modTimes[host].Equal(modTime) {
+			next[host] = existing
+			continue
+		}
+
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			atomic.AddUint64(&c.failures, 1)
+			c.log.Error(errors.Wrapf(err, "[vk] failed to load certificate for %s", host))
+
+			if existing, ok := current[host]; ok {
+				next[host] = existing
+				modTimes[host] = c.modTimes[host]
+			}
+
+			continue
+		}
+
+		if c.loaded {
+			atomic.AddUint64(&c.reloads, 1)
+			c.log.Info("[vk] reloaded certificate for", host)
+		} else {
+			c.log.Debug("loaded certificate for", host)
+		}
+
+		next[host] = &cert
+		changed = true
+	}
+
+	if len(next) != len(current) {
+		changed = true
+	}
+
+	c.modTimes = modTimes
+	c.loaded = true
+	c.certs.Store(next)
+
+	return changed, nil
+}
+
+// watch reloads the certificates every interval, until done is closed
+func (c *certStore) watch(done <-chan struct{}) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		if _, err := c.reload(); err != nil {
+			c.log.Error(errors.Wrap(err, "[vk] failed to reload certificates"))
+		}
+	}
+}
+
+// count returns the number of certificates loaded
+func (c *certStore) count() int {
+	return len(c.certs.Load().(map[string]*tls.Certificate))
+}
+
+func latestModTime(files ...string) (time.Time, error) {
+	var latest time.Time
+
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+
+	return latest, nil
+}
+
+// certSelector chooses a certificate for each TLS handshake based on its SNI, see UseCertDir
+type certSelector struct {
+	hook        func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	store       *certStore
+	defaultHost string
+	manager     *autocert.Manager
+}
+
+// GetCertificate tries, in order: the GetCertificate hook, the certificate directory, autocert for hosts allowed by
+// the host policy, and finally the default certificate. The handshake fails if none of them have a certificate
+func (s *certSelector) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	host := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+
+	if s.hook != nil {
+		cert, err := s.hook(hello)
+		if err != nil || cert != nil {
+			return cert, err
+		}
+	}
+
+	if s.store != nil && host != "" {
+		if cert := s.store.get(host); cert != nil {
+			return cert, nil
+		}
+	}
+
+	if s.manager != nil && host != "" && s.manager.HostPolicy(context.Background(), host) == nil {
+		return s.manager.GetCertificate(hello)
+	}
+
+	if s.store != nil && s.defaultHost != "" {
+		if cert := s.store.get(s.defaultHost); cert != nil {
+			return cert, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no certificate available for %q", host)
+}
+
+// newCertSelector creates a selector from the options, and the autocert manager if one is needed
+func newCertSelector(options *Options) (*certSelector, error) {
+	s := &certSelector{
+		hook:        options.GetCertificate,
+		defaultHost: strings.ToLower(options.DefaultCertHost),
+	}
+
+	if options.CertDir != "" {
+		store, err := newCertStore(options.CertDir, options.Logger)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to load certificates from %s", options.CertDir)
+		}
+
+		store.interval = options.CertReloadInterval
+		if store.interval <= 0 {
+			store.interval = defaultCertReloadInterval
+		}
+
+		s.store = store
+	}
+
+	if !options.DisableAutocert && (options.Domain != "" || options.HostPolicy != nil) {
+		s.manager = &autocert.Manager{
+			Cache:      autocert.DirCache("~/.autocert"),
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(options.Domain),
+		}
+
+		if policy := options.HostPolicy; policy != nil {
+			s.manager.HostPolicy = func(_ context.Context, host string) error {
+				return policy(host)
+			}
+		}
+	}
+
+	return s, nil
+}
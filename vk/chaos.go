@@ -0,0 +1,323 @@
+package vk
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ChaosFault is a kind of fault injected by a Chaos
+type ChaosFault string
+
+const (
+	ChaosLatency  ChaosFault = "latency"  // the request is delayed before it is handled
+	ChaosError    ChaosFault = "error"    // the request gets an error status without being handled
+	ChaosTruncate ChaosFault = "truncate" // the response body is cut off and the connection closed
+	ChaosDrop     ChaosFault = "drop"     // the connection is closed without a response
+)
+
+// ErrChaosTruncated is returned by the writes of a response that a Chaos is truncating
+var ErrChaosTruncated = errors.New("response truncated by injected fault")
+
+// ChaosRule injects a fault into a fraction of the requests to matching routes
+type ChaosRule struct {
+	Method      string     `json:"method,omitempty"` // matches every method if empty
+	Route       string     `json:"route,omitempty"`  // the route's pattern, i.e. /users/:id, matches every route if empty
+	Probability float64    `json:"probability"`      // the fraction of matching requests that get the fault, 0 to 1
+	Fault       ChaosFault `json:"fault"`
+
+	Latency       time.Duration `json:"latency,omitempty"`        // ChaosLatency's delay
+	Jitter        time.Duration `json:"jitter,omitempty"`         // a random extra delay of up to Jitter
+	Status        int           `json:"status,omitempty"`         // ChaosError's status, 503 by default
+	TruncateAfter int           `json:"truncate_after,omitempty"` // the bytes of the body that ChaosTruncate lets through
+}
+
+// ChaosConfig configures a Chaos
+type ChaosConfig struct {
+	Enabled bool // whether faults are injected at first, see Chaos.SetEnabled
+	Rules   []ChaosRule
+
+	// Seed seeds the random numbers that decide which requests get faults, so that runs can be repeated. A seed of
+	// 0 uses the current time
+	Seed int64
+}
+
+// ChaosInjection counts the faults injected into a route's requests
+type ChaosInjection struct {
+	Method string     `json:"method"`
+	Route  string     `json:"route"`
+	Fault  ChaosFault `json:"fault"`
+	Count  uint64     `json:"count"`
+}
+
+// ChaosStats reports the state of a Chaos
+type ChaosStats struct {
+	Enabled  bool             `json:"enabled"`
+	Rules    []ChaosRule      `json:"rules"`
+	Injected []ChaosInjection `json:"injected"`
+}
+
+type chaosKey struct {
+	method string
+	route  string
+	fault  ChaosFault
+}
+
+// Chaos injects faults into requests for resilience testing. It only ever does so on servers created with
+// UseChaos, and never in builds with the nochaos tag, so that it can't be turned on in production by accident
+type Chaos struct {
+	lock     sync.Mutex
+	enabled  bool
+	rules    []ChaosRule
+	rng      *rand.Rand
+	injected map[chaosKey]uint64
+}
+
+// NewChaos creates a Chaos
+func NewChaos(cfg ChaosConfig) *Chaos {
+	seed := cfg.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	c := &Chaos{
+		enabled:  cfg.Enabled,
+		rules:    append([]ChaosRule{}, cfg.Rules...),
+		rng:      rand.New(rand.NewSource(seed)),
+		injected: map[chaosKey]uint64{},
+	}
+
+	return c
+}
+
+// ChaosMiddleware returns a Middleware that injects faults according to cfg, see Chaos
+func ChaosMiddleware(cfg ChaosConfig) Middleware {
+	return NewChaos(cfg).Middleware()
+}
+
+// Middleware returns a Middleware that injects faults into the requests that match the chaos' rules. Each request
+// gets at most one fault, from the first rule that matches it and whose probability it falls within
+func (c *Chaos) Middleware() Middleware {
+	return Named("chaos", func(inner HandlerFunc) HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request, ctx *Ctx) error {
+			if !chaosCompiled || !ctx.chaosAllowed || ctx.IsWebSocketUpgrade() {
+				return inner(w, r, ctx)
+			}
+
+			rule, ok := c.roll(r.Method, ctx.route)
+			if !ok {
+				return inner(w, r, ctx)
+			}
+
+			ctx.Log.Warn(r.Method, r.URL.String(), "injected fault", "chaos="+string(rule.Fault))
+
+			switch rule.Fault {
+			case ChaosLatency:
+				if err := c.delay(ctx, rule); err != nil {
+					return err
+				}
+			case ChaosError:
+				status := rule.Status
+				if status == 0 {
+					status = http.StatusServiceUnavailable
+				}
+
+				return E(status, http.StatusText(status))
+			case ChaosTruncate:
+				tw := &truncateWriter{ResponseWriter: w, remaining: rule.TruncateAfter}
+				err := inner(tw, r, ctx)
+
+				if tw.truncated {
+					if f, ok := w.(http.Flusher); ok {
+						f.Flush()
+					}
+
+					// closes the connection, so that the client can tell the response is incomplete
+					panic(http.ErrAbortHandler)
+				}
+
+				return err
+			case ChaosDrop:
+				panic(http.ErrAbortHandler)
+			}
+
+			return inner(w, r, ctx)
+		}
+	})
+}
+
+// SetEnabled turns fault injection on or off
+func (c *Chaos) SetEnabled(enabled bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.enabled = enabled
+}
+
+// SetRules replaces the chaos' rules
+func (c *Chaos) SetRules(rules []ChaosRule) error {
+	for _, rule := range rules {
+		if rule.Probability < 0 || rule.Probability > 1 {
+			return errors.Errorf("probability %v is not between 0 and 1", rule.Probability)
+		}
+
+		switch rule.Fault {
+		case ChaosLatency, ChaosError, ChaosTruncate, ChaosDrop:
+		default:
+			return errors.Errorf("unknown fault %q", rule.Fault)
+		}
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.rules = append([]ChaosRule{}, rules...)
+
+	return nil
+}
+
+// Stats returns the chaos' rules and the faults it has injected into each route
+func (c *Chaos) Stats() ChaosStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	stats := ChaosStats{
+		Enabled:  c.enabled,
+		Rules:    append([]ChaosRule{}, c.rules...),
+		Injected: []ChaosInjection{},
+	}
+
+	for key, count := range c.injected {
+		stats.Injected = append(stats.Injected, ChaosInjection{Method: key.method, Route: key.route, Fault: key.fault, Count: count})
+	}
+
+	sort.Slice(stats.Injected, func(i, j int) bool {
+		a, b := stats.Injected[i], stats.Injected[j]
+		if a.Route != b.Route {
+			return a.Route < b.Route
+		}
+
+		if a.Method != b.Method {
+			return a.Method < b.Method
+		}
+
+		return a.Fault < b.Fault
+	})
+
+	return stats
+}
+
+// RegisterAdmin mounts GET /chaos on the admin router, reporting the chaos' stats, and PUT /chaos, which takes
+// {"enabled": true, "rules": [...]} to change them. Rules are left as they are if they are omitted
+func (c *Chaos) RegisterAdmin(r *Router) {
+	r.GET("/chaos", func(w http.ResponseWriter, _ *http.Request, ctx *Ctx) error {
+		return RespondJSON(ctx.Context, w, c.Stats(), http.StatusOK)
+	})
+
+	r.PUT("/chaos", func(w http.ResponseWriter, req *http.Request, ctx *Ctx) error {
+		var update struct {
+			Enabled *bool        `json:"enabled"`
+			Rules   *[]ChaosRule `json:"rules"`
+		}
+
+		if err := json.NewDecoder(req.Body).Decode(&update); err != nil {
+			return E(http.StatusBadRequest, "invalid JSON: "+err.Error())
+		}
+
+		if update.Rules != nil {
+			if err := c.SetRules(*update.Rules); err != nil {
+				return E(http.StatusBadRequest, err.Error())
+			}
+		}
+
+		if update.Enabled != nil {
+			c.SetEnabled(*update.Enabled)
+		}
+
+		return RespondJSON(ctx.Context, w, c.Stats(), http.StatusOK)
+	})
+}
+
+// roll returns the rule whose fault the request gets, if any, counting it
+func (c *Chaos) roll(method, route string) (ChaosRule, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.enabled {
+		return ChaosRule{}, false
+	}
+
+	for _, rule := range c.rules {
+		if (rule.Method != "" && rule.Method != method) || (rule.Route != "" && rule.Route != route) {
+			continue
+		}
+
+		if c.rng.Float64() >= rule.Probability {
+			continue
+		}
+
+		c.injected[chaosKey{method: method, route: route, fault: rule.Fault}]++
+
+		return rule, true
+	}
+
+	return ChaosRule{}, false
+}
+
+// delay sleeps for the rule's latency, returning early with an error if the request is cancelled
+func (c *Chaos) delay(ctx *Ctx, rule ChaosRule) error {
+	d := rule.Latency
+
+	if rule.Jitter > 0 {
+		c.lock.Lock()
+		d += time.Duration(c.rng.Int63n(int64(rule.Jitter)))
+		c.lock.Unlock()
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Context.Done():
+		return ctx.Context.Err()
+	}
+}
+
+// truncateWriter lets through the first bytes of a response, and fails every write after them
+type truncateWriter struct {
+	http.ResponseWriter
+	remaining int
+	truncated bool
+}
+
+func (tw *truncateWriter) Write(b []byte) (int, error) {
+	if len(b) <= tw.remaining {
+		tw.remaining -= len(b)
+		return tw.ResponseWriter.Write(b)
+	}
+
+	n, _ := tw.ResponseWriter.Write(b[:tw.remaining])
+	tw.remaining = 0
+	tw.truncated = true
+
+	return n, ErrChaosTruncated
+}
+
+// Flush flushes the underlying ResponseWriter if it supports flushing
+func (tw *truncateWriter) Flush() {
+	if f, ok := tw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// useChaos sets whether the router's Ctxs allow Chaos to inject faults, see UseChaos
+func (rt *Router) useChaos(allowed bool) {
+	rt.chaosAllowed = allowed
+}
@@ -0,0 +1,6 @@
+//go:build nochaos
+
+package vk
+
+// chaosCompiled is false in builds with the nochaos tag, which never inject faults whatever their options
+const chaosCompiled = false
@@ -0,0 +1,230 @@
+package vk
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	// ClaimsKey is the Ctx key (see Ctx.Set) under which auth middleware store a request's claims for
+	// ClaimsPropagation, as a map with string keys such as a decoded JWT's claims
+	ClaimsKey = "vk.claims"
+
+	defaultClaimMaxLength = 128
+)
+
+// ClaimRule selects a claim to forward, and where to forward it to
+type ClaimRule struct {
+	Claim      string // the claim's name, or a dot-separated path into nested claims, i.e. org.id
+	ScopeField string // the field of the log scope the claim is added to, if set
+	Header     string // the header the claim is sent to downstream services in, if set
+	MaxLength  int    // values longer than this are truncated, 128 by default
+}
+
+// ClaimsPropagation returns a Middleware that forwards the claims selected by rules to the request's log scope and
+// to downstream services as headers. It must be placed after the middleware that sets the claims under ClaimsKey
+// (i.e. closer to the handler). Only the claims in rules are ever forwarded, and only if they are strings, numbers
+// or booleans, with anything that isn't printable ASCII removed so that they are safe to use as header values.
+//
+// The headers are available from Ctx.OutboundHeaders for calls made by handlers, and are set on requests proxied
+// by NewProxy routes behind the middleware. Headers with the rules' names sent by the client are always removed,
+// so downstream services can trust them, including from the requests that no route handles, which the fallback
+// proxy (see UseFallbackAddress) forwards without those of any ClaimsPropagation of the router's routes
+func ClaimsPropagation(rules []ClaimRule) Middleware {
+	rules = append([]ClaimRule{}, rules...)
+
+	var names []string
+
+	for i, rule := range rules {
+		if rule.Claim == "" {
+			panic("claim rule without a claim")
+		}
+
+		if rule.MaxLength <= 0 {
+			rules[i].MaxLength = defaultClaimMaxLength
+		}
+
+		if rule.Header != "" {
+			names = append(names, http.CanonicalHeaderKey(rule.Header))
+		}
+	}
+
+	return namedWithValue("claims", claimHeaders(names), func(inner HandlerFunc) HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request, ctx *Ctx) error {
+			for _, name := range names {
+				r.Header.Del(name)
+			}
+
+			ctx.claimHeaders = names
+
+			claims := ctx.Get(ClaimsKey)
+			if claims == nil {
+				return inner(w, r, ctx)
+			}
+
+			var fields map[string]interface{}
+
+			for _, rule := range rules {
+				value, ok := lookupClaim(claims, rule.Claim)
+				if !ok {
+					continue
+				}
+
+				str := sanitizeClaim(value, rule.MaxLength)
+				if str == "" {
+					continue
+				}
+
+				if rule.ScopeField != "" {
+					if fields == nil {
+						fields = scopeFields(ctx.Scope())
+					}
+
+					fields[rule.ScopeField] = str
+				}
+
+				if rule.Header != "" {
+					if ctx.outboundHeaders == nil {
+						ctx.outboundHeaders = http.Header{}
+					}
+
+					ctx.outboundHeaders.Set(rule.Header, str)
+				}
+			}
+
+			if fields != nil {
+				ctx.UseScope(fields)
+			}
+
+			return inner(w, r, ctx)
+		}
+	})
+}
+
+// claimHeaders are the names of the headers set by a ClaimsPropagation, the metadata of its layers
+type claimHeaders []string
+
+// claimHeadersOf returns the names of the headers set by the ClaimsPropagation middleware of routes
+func claimHeadersOf(routes []httpRouteHandler) []string {
+	seen := map[string]bool{}
+
+	var names []string
+
+	for _, r := range routes {
+		for _, v := range chainValues(r.wrapped()) {
+			headers, ok := v.(claimHeaders)
+			if !ok {
+				continue
+			}
+
+			for _, name := range headers {
+				if !seen[name] {
+					seen[name] = true
+					names = append(names, name)
+				}
+			}
+		}
+	}
+
+	return names
+}
+
+// OutboundHeaders returns the headers set by ClaimsPropagation, to add to requests made to downstream services
+func (c *Ctx) OutboundHeaders() http.Header {
+	if c == nil || c.outboundHeaders == nil {
+		return http.Header{}
+	}
+
+	return c.outboundHeaders.Clone()
+}
+
+// applyOutboundHeaders replaces the claim headers in h with those of the Ctx
+func (c *Ctx) applyOutboundHeaders(h http.Header) {
+	if c == nil {
+		return
+	}
+
+	for _, name := range c.claimHeaders {
+		h.Del(name)
+	}
+
+	for key, values := range c.outboundHeaders {
+		h[key] = append([]string{}, values...)
+	}
+}
+
+// lookupClaim returns the claim at path, which is a dot-separated path of keys into nested maps
+func lookupClaim(claims interface{}, path string) (interface{}, bool) {
+	value := claims
+
+	for _, key := range strings.Split(path, ".") {
+		m := reflect.ValueOf(value)
+		if m.Kind() != reflect.Map || m.Type().Key().Kind() != reflect.String {
+			return nil, false
+		}
+
+		v := m.MapIndex(reflect.ValueOf(key).Convert(m.Type().Key()))
+		if !v.IsValid() {
+			return nil, false
+		}
+
+		value = v.Interface()
+	}
+
+	return value, true
+}
+
+// sanitizeClaim converts a claim to a string that is safe to use in a header, or an empty string if it can't be
+func sanitizeClaim(value interface{}, maxLength int) string {
+	var str string
+
+	switch v := value.(type) {
+	case string:
+		str = v
+	case float64:
+		str = strconv.FormatFloat(v, 'f', -1, 64)
+	case json.Number:
+		str = v.String()
+	case bool, int, int32, int64, uint, uint32, uint64:
+		str = fmt.Sprint(v)
+	default:
+		return ""
+	}
+
+	str = strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e {
+			return -1
+		}
+
+		return r
+	}, str)
+
+	str = strings.TrimSpace(str)
+
+	if len(str) > maxLength {
+		str = str[:maxLength]
+	}
+
+	return str
+}
+
+// scopeFields returns the fields of a log scope as a map that more can be added to
+func scopeFields(scope interface{}) map[string]interface{} {
+	fields := map[string]interface{}{}
+
+	if scope == nil {
+		return fields
+	}
+
+	data, err := json.Marshal(scope)
+	if err != nil || json.Unmarshal(data, &fields) != nil {
+		// the scope isn't a JSON object, so it's kept as it is
+		return map[string]interface{}{"scope": scope}
+	}
+
+	return fields
+}
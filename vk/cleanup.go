@@ -0,0 +1,110 @@
+package vk
+
+import (
+	"fmt"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// defaultSlowCleanupThreshold is how long a cleanup callback can run before it is logged as slow
+const defaultSlowCleanupThreshold = 100 * time.Millisecond
+
+// CleanupStats counts the cleanup callbacks registered with Ctx.OnCleanup and how many of them have run,
+// which are equal when no request is being handled unless cleanups are leaking
+type CleanupStats struct {
+	Registered uint64 `json:"registered"`
+	Run        uint64 `json:"run"`
+}
+
+// cleanupCounter counts the cleanups of a router's requests
+type cleanupCounter struct {
+	registered uint64
+	run        uint64
+}
+
+// OnCleanup registers fn to be called once the request has been handled: after the response has been written,
+// including when the handler panicked or the client disconnected. Callbacks are called in the reverse order of
+// their registration, so middleware can release what they acquired after the handlers they wrap. A panic in one
+// callback is logged and doesn't prevent the others from running
+func (c *Ctx) OnCleanup(fn func()) {
+	if c == nil || fn == nil {
+		return
+	}
+
+	c.cleanups = append(c.cleanups, fn)
+
+	if c.cleanupCounter != nil {
+		atomic.AddUint64(&c.cleanupCounter.registered, 1)
+	}
+}
+
+// runCleanups calls the Ctx's cleanup callbacks, last registered first, and logs any that were slow
+func (rt *Router) runCleanups(ctx *Ctx) {
+	var slow []string
+
+	for i := len(ctx.cleanups) - 1; i >= 0; i-- {
+		fn := ctx.cleanups[i]
+
+		start := time.Now()
+		rt.runCleanup(ctx, fn)
+
+		if elapsed := time.Since(start); elapsed > rt.slowCleanup {
+			slow = append(slow, fmt.Sprintf("%s (%dms)", funcName(fn), elapsed.Milliseconds()))
+		}
+	}
+
+	ctx.cleanups = nil
+
+	if len(slow) > 0 {
+		ctx.Log.Warn(fmt.Sprintf("cleanups took longer than %dms:", rt.slowCleanup.Milliseconds()), strings.Join(slow, ", "))
+	}
+}
+
+// runCleanup calls fn, recovering and logging any panic
+func (rt *Router) runCleanup(ctx *Ctx, fn func()) {
+	defer func() {
+		atomic.AddUint64(&rt.cleanups.run, 1)
+
+		if value := recover(); value != nil {
+			ctx.Log.ErrorString(fmt.Sprintf("recovered panic in cleanup %s: %v", funcName(fn), value))
+		}
+	}()
+
+	fn()
+}
+
+// useSlowCleanupThreshold sets how long a cleanup can run before it is logged as slow, or the default if 0
+func (rt *Router) useSlowCleanupThreshold(threshold time.Duration) {
+	if threshold <= 0 {
+		threshold = defaultSlowCleanupThreshold
+	}
+
+	rt.slowCleanup = threshold
+}
+
+// Cleanups returns the number of cleanups registered by the router's requests and how many of them have run
+func (rt *Router) Cleanups() CleanupStats {
+	return CleanupStats{
+		Registered: atomic.LoadUint64(&rt.cleanups.registered),
+		Run:        atomic.LoadUint64(&rt.cleanups.run),
+	}
+}
+
+// Cleanups returns the cleanup stats of the server's router, see Router.Cleanups
+func (s *Server) Cleanups() CleanupStats {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.internalRouter.Cleanups()
+}
+
+func funcName(fn func()) string {
+	if f := runtime.FuncForPC(reflect.ValueOf(fn).Pointer()); f != nil {
+		return f.Name()
+	}
+
+	return "unknown"
+}
@@ -0,0 +1,171 @@
+package vk
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// the states of a request's response commitment, see CommitResponse
+const (
+	commitNone int32 = iota
+	commitDone
+	commitFailed
+)
+
+var (
+	// ErrAlreadyCommitted is returned by CommitResponse if the request's response has already been committed
+	ErrAlreadyCommitted = errors.New("the response has already been committed")
+
+	// ErrResponseStarted is returned by CommitResponse if the handler has already started writing its response
+	ErrResponseStarted = errors.New("the response has already started")
+
+	// ErrClientGone is returned by CommitResponse if the request's context is done, such as when the client has
+	// disconnected, before the response could be committed
+	ErrClientGone = errors.New("the client went away before the response was committed")
+
+	// errCommitUnavailable is returned by CommitResponse for a Ctx that isn't handling a request of a Router
+	errCommitUnavailable = errors.New("CommitResponse is only available to the handlers of a Router")
+)
+
+// CommitResponse writes the response to the client straight away, before the handler returns, so that a handler
+// can commit to its response before performing a side effect that mustn't be repeated, such as charging a card:
+//
+//	if err := ctx.CommitResponse(http.StatusAccepted, receipt); err != nil {
+//		return err // the client can't have seen the receipt, so it will retry
+//	}
+//
+//	charge(receipt)
+//
+// body is sent like the Respond helpers do: []byte with RespondBytes, a string with RespondString, and anything else
+// with RespondJSON (or the group's ResponseEncoder). The response is written in full, with a Content-Length, and
+// flushed to the client. It is written below the writers of the route's middleware, so middleware that transform
+// responses, such as Compress, don't apply to it, but those that must know about it are told before it is written:
+// ResponseCache doesn't cache it, and Invalidates purges its tags first. Afterware still runs once the handler has
+// returned, with the committed status.
+//
+// Once the response is committed the request's response is final: an error returned or a panic raised by the
+// handler afterwards is logged and reported (see IsolationDomain), but no error response is written, and a second
+// response is dropped (see DoubleResponseError). The handler can carry on with work after the response, and
+// OnCleanup callbacks still run once it returns.
+//
+// If the request's context is done, such as when the client has disconnected, ErrClientGone is returned and nothing
+// is written. A failure to write the response is returned as well, after which Committed is false and no other
+// response is attempted. Committing twice returns ErrAlreadyCommitted, and committing after the handler has started
+// its response returns ErrResponseStarted
+func (c *Ctx) CommitResponse(status int, body interface{}) error {
+	if c == nil || c.guard == nil {
+		return errCommitUnavailable
+	}
+
+	if atomic.LoadInt32(&c.commit) != commitNone {
+		return ErrAlreadyCommitted
+	}
+
+	if c.guard.started {
+		return ErrResponseStarted
+	}
+
+	if c.request != nil && c.request.Context().Err() != nil {
+		return ErrClientGone
+	}
+
+	// the middleware that keep their own view of the response are told before it is written below them
+	for _, hook := range c.commitHooks {
+		hook(status)
+	}
+
+	rec := &commitRecorder{header: c.guard.Header()}
+
+	var err error
+
+	switch b := body.(type) {
+	case []byte:
+		err = RespondBytes(c.Context, rec, b, status)
+	case string:
+		err = RespondString(c.Context, rec, b, status)
+	default:
+		err = RespondJSON(c.Context, rec, body, status)
+	}
+
+	if err != nil {
+		return errors.Wrap(err, "failed to encode committed response")
+	}
+
+	if bodyAllowed(status) {
+		rec.header.Set("Content-Length", strconv.Itoa(len(rec.body)))
+	}
+
+	atomic.StoreInt32(&c.commit, commitFailed)
+
+	c.guard.WriteHeader(status)
+
+	if len(rec.body) > 0 {
+		if _, err := c.guard.Write(rec.body); err != nil {
+			return errors.Wrap(err, "failed to write committed response")
+		}
+	}
+
+	c.guard.Flush()
+
+	// a client that went away while the response was written may not have received it
+	if c.request != nil && c.request.Context().Err() != nil {
+		return ErrClientGone
+	}
+
+	atomic.StoreInt32(&c.commit, commitDone)
+
+	return nil
+}
+
+// onCommit registers fn to be called with the status of a response committed with CommitResponse, before it is
+// written, by middleware whose writers it bypasses
+func (c *Ctx) onCommit(fn func(status int)) {
+	c.commitHooks = append(c.commitHooks, fn)
+}
+
+// Committed returns true if the request's response was committed with CommitResponse, and written and flushed
+// without error
+func (c *Ctx) Committed() bool {
+	if c == nil {
+		return false
+	}
+
+	return atomic.LoadInt32(&c.commit) == commitDone
+}
+
+// commitAttempted returns true if CommitResponse started writing the response, whether or not it succeeded, in
+// which case the router writes no other response
+func (c *Ctx) commitAttempted() bool {
+	if c == nil {
+		return false
+	}
+
+	return atomic.LoadInt32(&c.commit) != commitNone
+}
+
+// commitRecorder captures the body that the Respond helpers write for CommitResponse, so that it can be sent with
+// its length. Its headers are the response's
+type commitRecorder struct {
+	header http.Header
+	body   []byte
+}
+
+func (cr *commitRecorder) Header() http.Header {
+	return cr.header
+}
+
+func (cr *commitRecorder) WriteHeader(int) {}
+
+func (cr *commitRecorder) Write(b []byte) (int, error) {
+	cr.body = append(cr.body, b...)
+
+	return len(b), nil
+}
+
+// bodyAllowed returns true if a response with the given status can have a body
+func bodyAllowed(status int) bool {
+	return status >= http.StatusOK && status != http.StatusNoContent && status != http.StatusNotModified
+}
@@ -0,0 +1,397 @@
+package vk
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Encoder compresses into the writer it was created with or last Reset to, such as a *gzip.Writer
+type Encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// Encoding is a content coding that the compression middleware can use, with a level for small and large responses
+type Encoding struct {
+	Name       string // the Content-Encoding token, i.e. "gzip" or "br"
+	SmallLevel int    // the level for responses smaller than the policy's LargeSize, or of unknown size
+	LargeLevel int
+	NewEncoder func(w io.Writer, level int) (Encoder, error)
+}
+
+// GzipEncoding returns the gzip Encoding using the given levels
+func GzipEncoding(smallLevel, largeLevel int) Encoding {
+	return Encoding{
+		Name:       "gzip",
+		SmallLevel: smallLevel,
+		LargeLevel: largeLevel,
+		NewEncoder: func(w io.Writer, level int) (Encoder, error) {
+			return gzip.NewWriterLevel(w, level)
+		},
+	}
+}
+
+// CompressionPolicy decides whether and how AdaptiveCompressionMiddleware compresses a response. The size of a
+// response is its Content-Length if it has one, otherwise up to max(MinSize, LargeSize) bytes are buffered to find out
+type CompressionPolicy struct {
+	MinSize   int      // responses smaller than this are sent uncompressed
+	LargeSize int      // responses at least this large use each Encoding's LargeLevel
+	SkipTypes []string // media types that are never compressed, where those ending with "/" (i.e. "image/") match a prefix
+	Encodings []Encoding
+}
+
+// DefaultCompressionPolicy skips responses under 1KB and already-compressed media, and uses gzip at level 1 below
+// 64KB and level 6 above it. To prefer brotli, add an Encoding for it before gzip
+func DefaultCompressionPolicy() CompressionPolicy {
+	return CompressionPolicy{
+		MinSize:   1 << 10,
+		LargeSize: 64 << 10,
+		SkipTypes: []string{
+			"image/",
+			"video/",
+			"audio/",
+			"font/woff",
+			"font/woff2",
+			"application/zip",
+			"application/gzip",
+			"application/x-gzip",
+			"application/x-brotli",
+			"application/zstd",
+		},
+		Encodings: []Encoding{GzipEncoding(gzip.BestSpeed, gzip.DefaultCompression)},
+	}
+}
+
+// CompressionMiddleware gzips response bodies for clients that accept it. Responses that already have
+// a Content-Encoding, and those without a body (204, 304, HEAD) are passed through. It is upgrade-aware:
+// websocket handshakes are given the original ResponseWriter so that the connection can be hijacked.
+// Every response is compressed at the default level, see AdaptiveCompressionMiddleware for a policy
+func CompressionMiddleware() Middleware {
+	return AdaptiveCompressionMiddleware(CompressionPolicy{
+		Encodings: []Encoding{GzipEncoding(gzip.DefaultCompression, gzip.DefaultCompression)},
+	})
+}
+
+// AdaptiveCompressionMiddleware is CompressionMiddleware using policy to choose whether to compress a response,
+// with which of the Encodings the client accepts (preferring those listed first), and at what level.
+// It panics if an Encoding cannot create an encoder at one of its levels
+func AdaptiveCompressionMiddleware(policy CompressionPolicy) Middleware {
+	c := newCompressor(policy)
+
+	return Named("compression", func(inner HandlerFunc) HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request, ctx *Ctx) error {
+			if ctx.IsWebSocketUpgrade() || r.Method == http.MethodHead {
+				return inner(w, r, ctx)
+			}
+
+			ctx.AddVary("Accept-Encoding")
+
+			encoding, ok := c.negotiate(r.Header)
+			if !ok {
+				return inner(w, r, ctx)
+			}
+
+			cw := &compressWriter{ResponseWriter: w, compressor: c, encoding: encoding}
+			defer cw.close()
+
+			return inner(cw, r, ctx)
+		}
+	})
+}
+
+// encoderKey identifies the pool of encoders for an Encoding at one of its levels
+type encoderKey struct {
+	encoding int
+	level    int
+}
+
+// compressor is a CompressionPolicy prepared for use, with a pool of encoders per encoding and level
+type compressor struct {
+	CompressionPolicy
+	pools map[encoderKey]*sync.Pool
+}
+
+func newCompressor(policy CompressionPolicy) *compressor {
+	c := &compressor{
+		CompressionPolicy: policy,
+		pools:             map[encoderKey]*sync.Pool{},
+	}
+
+	for i, e := range policy.Encodings {
+		for _, level := range []int{e.SmallLevel, e.LargeLevel} {
+			key := encoderKey{encoding: i, level: level}
+			if _, exists := c.pools[key]; exists {
+				continue
+			}
+
+			if _, err := e.NewEncoder(io.Discard, level); err != nil {
+				panic(fmt.Sprintf("vk: cannot create %s encoder at level %d: %s", e.Name, level, err))
+			}
+
+			newEncoder, level := e.NewEncoder, level
+
+			c.pools[key] = &sync.Pool{New: func() interface{} {
+				enc, _ := newEncoder(io.Discard, level)
+				return enc
+			}}
+		}
+	}
+
+	return c
+}
+
+// negotiate returns the index of the Encoding to use for a request, the most preferred by the client's Accept-Encoding
+// q-values and then by the order of the policy's Encodings, or false if the client accepts none of them
+func (c *compressor) negotiate(h http.Header) (int, bool) {
+	accepted := map[string]float64{}
+
+	for _, v := range h.Values("Accept-Encoding") {
+		for _, part := range strings.Split(v, ",") {
+			token, params, _ := strings.Cut(part, ";")
+
+			q := 1.0
+			if param, value, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.EqualFold(strings.TrimSpace(param), "q") {
+				parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+				if err != nil {
+					continue
+				}
+
+				q = parsed
+			}
+
+			accepted[strings.ToLower(strings.TrimSpace(token))] = q
+		}
+	}
+
+	chosen, best := -1, 0.0
+
+	for i, e := range c.Encodings {
+		q, ok := accepted[strings.ToLower(e.Name)]
+		if !ok {
+			q = accepted["*"]
+		}
+
+		if q > best {
+			chosen, best = i, q
+		}
+	}
+
+	return chosen, chosen >= 0
+}
+
+// skips returns true if responses of the media type are never compressed
+func (c *compressor) skips(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = strings.ToLower(strings.TrimSpace(contentType))
+	}
+
+	for _, skip := range c.SkipTypes {
+		if mediaType == skip || (strings.HasSuffix(skip, "/") && strings.HasPrefix(mediaType, skip)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// bufferSize is the number of bytes to buffer in order to know whether a response is at least MinSize and LargeSize
+func (c *compressor) bufferSize() int {
+	if c.LargeSize > c.MinSize {
+		return c.LargeSize
+	}
+
+	return c.MinSize
+}
+
+// compressWriter buffers the start of a response until it can decide whether to compress it and at which level,
+// and then writes through an encoder from the compressor's pools
+type compressWriter struct {
+	http.ResponseWriter
+	compressor *compressor
+	encoding   int // the index of the negotiated Encoding
+
+	status  int
+	decided bool
+	buf     []byte
+	enc     Encoder
+	pool    *sync.Pool
+}
+
+func (c *compressWriter) WriteHeader(status int) {
+	if c.status != 0 {
+		return
+	}
+
+	// informational responses are passed through, a final status follows them
+	if status < http.StatusOK {
+		c.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	c.status = status
+
+	if status == http.StatusNoContent || status == http.StatusNotModified || c.Header().Get("Content-Encoding") != "" {
+		_ = c.decide(false)
+	}
+}
+
+func (c *compressWriter) Write(b []byte) (int, error) {
+	if c.status == 0 {
+		c.WriteHeader(http.StatusOK)
+	}
+
+	if !c.decided {
+		c.buf = append(c.buf, b...)
+
+		if c.decidable() || len(c.buf) >= c.compressor.bufferSize() {
+			if err := c.decide(false); err != nil {
+				return 0, err
+			}
+		}
+
+		return len(b), nil
+	}
+
+	if c.enc != nil {
+		return c.enc.Write(b)
+	}
+
+	return c.ResponseWriter.Write(b)
+}
+
+// ReadFrom copies from src, bypassing compression when the response isn't compressed so that the
+// underlying ResponseWriter's ReadFrom can be used, see readFrom
+func (c *compressWriter) ReadFrom(src io.Reader) (int64, error) {
+	if c.status == 0 {
+		c.WriteHeader(http.StatusOK)
+	}
+
+	if !c.decided && c.decidable() {
+		if err := c.decide(false); err != nil {
+			return 0, err
+		}
+	}
+
+	if !c.decided || c.enc != nil {
+		return io.Copy(writerOnly{c}, src)
+	}
+
+	return readFrom(c.ResponseWriter, src)
+}
+
+// decidable returns true if the response's headers are enough to decide whether to compress it
+func (c *compressWriter) decidable() bool {
+	h := c.Header()
+	if h.Get(contentTypeHeaderKey) != "" && c.compressor.skips(h.Get(contentTypeHeaderKey)) {
+		return true
+	}
+
+	return h.Get("Content-Length") != "" && (h.Get(contentTypeHeaderKey) != "" || len(c.buf) > 0)
+}
+
+// decide chooses whether to compress the response and writes its header followed by anything buffered. final
+// is true if the response is complete, so the size of what's buffered is the size of the response
+func (c *compressWriter) decide(final bool) error {
+	c.decided = true
+
+	h := c.Header()
+	if h.Get(contentTypeHeaderKey) == "" && len(c.buf) > 0 {
+		h.Set(contentTypeHeaderKey, http.DetectContentType(c.buf))
+	}
+
+	size, sizeKnown := len(c.buf), final
+	if length, err := strconv.Atoi(h.Get("Content-Length")); err == nil {
+		size, sizeKnown = length, true
+	}
+
+	compress := c.status >= http.StatusOK &&
+		c.status != http.StatusNoContent &&
+		c.status != http.StatusNotModified &&
+		c.status != http.StatusPartialContent &&
+		h.Get("Content-Encoding") == "" &&
+		!c.compressor.skips(h.Get(contentTypeHeaderKey)) &&
+		!(sizeKnown && (size == 0 || size < c.compressor.MinSize))
+
+	if compress {
+		encoding := c.compressor.Encodings[c.encoding]
+
+		level := encoding.SmallLevel
+		if size >= c.compressor.LargeSize {
+			level = encoding.LargeLevel
+		}
+
+		c.pool = c.compressor.pools[encoderKey{encoding: c.encoding, level: level}]
+		c.enc = c.pool.Get().(Encoder)
+		c.enc.Reset(c.ResponseWriter)
+
+		h.Set("Content-Encoding", encoding.Name)
+		h.Del("Content-Length")
+
+		// the compressed body isn't byte-for-byte the content that a strong ETag identifies, so ranges can't be
+		// resumed from it
+		if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			h.Set("ETag", "W/"+etag)
+		}
+	} else if final && h.Get("Content-Length") == "" && c.status != http.StatusNoContent && c.status != http.StatusNotModified {
+		h.Set("Content-Length", strconv.Itoa(len(c.buf)))
+	}
+
+	c.ResponseWriter.WriteHeader(c.status)
+
+	buf := c.buf
+	c.buf = nil
+
+	if len(buf) == 0 {
+		return nil
+	}
+
+	var err error
+	if c.enc != nil {
+		_, err = c.enc.Write(buf)
+	} else {
+		_, err = c.ResponseWriter.Write(buf)
+	}
+
+	return err
+}
+
+// Flush flushes any compressed data to the client. A response of unknown size is compressed once it is flushed
+func (c *compressWriter) Flush() {
+	if !c.decided {
+		if c.status == 0 {
+			c.WriteHeader(http.StatusOK)
+		}
+
+		_ = c.decide(false)
+	}
+
+	if c.enc != nil {
+		_ = c.enc.Flush()
+	}
+
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// close sends a response that is still buffered, and returns the encoder to its pool
+func (c *compressWriter) close() {
+	if c.status != 0 && !c.decided {
+		_ = c.decide(true)
+	}
+
+	if c.enc != nil {
+		_ = c.enc.Close()
+		c.enc.Reset(io.Discard)
+		c.pool.Put(c.enc)
+		c.enc = nil
+	}
+}
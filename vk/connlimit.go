@@ -0,0 +1,347 @@
+package vk
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/suborbital/vektor/vlog"
+)
+
+const (
+	// connRejectionLogInterval is how often the rejected connections of each client are logged
+	connRejectionLogInterval = time.Minute
+
+	// connRejectionLogMaxClients is how many clients' rejected connections are rate limited in their own right. Beyond
+	// it, the rejected connections of other clients aren't logged until the earliest are forgotten
+	connRejectionLogMaxClients = 1024
+
+	// connReapMaxInterval is the longest the reaper waits between looking for idle connections
+	connReapMaxInterval = time.Second
+)
+
+// ConnStats reports the connections open to the server's listener and those it closed
+type ConnStats struct {
+	Open           int            `json:"open"`
+	Clients        int            `json:"clients"`         // clients with at least one open connection
+	States         map[string]int `json:"states"`          // open connections by state: new, active, idle or hijacked
+	MaxConnections int            `json:"max_connections"` // 0 if unlimited
+	MaxPerClient   int            `json:"max_per_client"`  // 0 if unlimited
+	RejectedGlobal uint64         `json:"rejected_global"` // connections closed on accept because the server was at MaxConnections
+	RejectedClient uint64         `json:"rejected_client"` // connections closed on accept because the client was at MaxPerClient
+	Reaped         uint64         `json:"reaped"`          // idle connections closed because their client was over the reaping threshold
+}
+
+// ConnLimiter caps the connections open to the server's listener at once, across the server and for each client
+// (identified by the connection's remote IP address, which is the proxy's when the server is behind one).
+// Connections beyond either cap are closed as soon as they are accepted, before any request is read from them.
+//
+// With idle reaping, a client holding more connections than the reaping threshold has those that have been idle
+// (or have not sent a request) for longer than the reaping duration closed, longest idle first, until it is back at
+// the threshold. It works below the http.Server's IdleTimeout, so that a few clients idling thousands of keep-alive
+// connections can't exhaust the server's file descriptors
+type ConnLimiter struct {
+	lock           sync.Mutex
+	maxConnections int
+	maxPerClient   int
+	reapThreshold  int
+	reapAfter      time.Duration
+	conns          map[*limitedConn]struct{}
+	clients        map[string]int
+	logged         map[string]time.Time // when each client's rejected connections were last logged, up to connRejectionLogMaxClients
+
+	rejectedGlobal uint64
+	rejectedClient uint64
+	reaped         uint64
+}
+
+func newConnLimiter(options *Options) *ConnLimiter {
+	l := &ConnLimiter{
+		maxConnections: options.MaxConnections,
+		maxPerClient:   options.MaxConnectionsPerClient,
+		reapThreshold:  options.IdleReapThreshold,
+		reapAfter:      options.IdleReapAfter,
+		conns:          map[*limitedConn]struct{}{},
+		clients:        map[string]int{},
+		logged:         map[string]time.Time{},
+	}
+
+	return l
+}
+
+// SetLimits changes the limits, taking effect for the next connection. Connections that are already open are not
+// closed if they exceed the new limits
+func (l *ConnLimiter) SetLimits(maxConnections, maxPerClient int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.maxConnections = maxConnections
+	l.maxPerClient = maxPerClient
+}
+
+// Stats returns the number of open connections by state, the limits, and the number of connections closed by reason
+func (l *ConnLimiter) Stats() ConnStats {
+	if l == nil {
+		return ConnStats{}
+	}
+
+	l.lock.Lock()
+	stats := ConnStats{
+		Open:           len(l.conns),
+		Clients:        len(l.clients),
+		States:         map[string]int{},
+		MaxConnections: l.maxConnections,
+		MaxPerClient:   l.maxPerClient,
+	}
+
+	for c := range l.conns {
+		stats.States[c.state.String()]++
+	}
+	l.lock.Unlock()
+
+	stats.RejectedGlobal = atomic.LoadUint64(&l.rejectedGlobal)
+	stats.RejectedClient = atomic.LoadUint64(&l.rejectedClient)
+	stats.Reaped = atomic.LoadUint64(&l.reaped)
+
+	return stats
+}
+
+// RegisterAdmin mounts GET /connections on the admin router, reporting the limiter's stats
+func (l *ConnLimiter) RegisterAdmin(r *Router) {
+	r.GET("/connections", func(w http.ResponseWriter, _ *http.Request, ctx *Ctx) error {
+		return RespondJSON(ctx.Context, w, l.Stats(), http.StatusOK)
+	})
+}
+
+// Connections returns the server's connection limiter, whose limits can be changed while the server is running
+func (s *Server) Connections() *ConnLimiter {
+	return s.connections
+}
+
+// listener wraps inner so that the connections it accepts are counted and limited. It works for both HTTP and TLS,
+// as the TLS listener wraps it in turn
+func (l *ConnLimiter) listener(inner net.Listener, logger *vlog.Logger) net.Listener {
+	return &limitListener{Listener: inner, limiter: l, logger: logger}
+}
+
+// admit takes a slot for the connection, returning it wrapped to release the slot when it is closed, or an error
+// if either limit has been reached
+func (l *ConnLimiter) admit(conn net.Conn, now time.Time) (*limitedConn, error) {
+	client := connClient(conn)
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.maxConnections > 0 && len(l.conns) >= l.maxConnections {
+		atomic.AddUint64(&l.rejectedGlobal, 1)
+		return nil, fmt.Errorf("too many connections (max %d)", l.maxConnections)
+	}
+
+	if l.maxPerClient > 0 && l.clients[client] >= l.maxPerClient {
+		atomic.AddUint64(&l.rejectedClient, 1)
+		return nil, fmt.Errorf("too many connections from this client (max %d)", l.maxPerClient)
+	}
+
+	c := &limitedConn{Conn: conn, limiter: l, client: client, state: http.StateNew, since: now}
+
+	l.conns[c] = struct{}{}
+	l.clients[client]++
+
+	return c, nil
+}
+
+// release frees the connection's slot
+func (l *ConnLimiter) release(c *limitedConn) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if _, ok := l.conns[c]; !ok {
+		return
+	}
+
+	delete(l.conns, c)
+
+	if l.clients[c.client]--; l.clients[c.client] <= 0 {
+		delete(l.clients, c.client)
+	}
+}
+
+// trackConn is used as part of the http.Server's ConnState hook to record the state of each connection
+func (l *ConnLimiter) trackConn(conn net.Conn, state http.ConnState) {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+
+	c, ok := conn.(*limitedConn)
+	if !ok {
+		return
+	}
+
+	if state == http.StateClosed {
+		l.release(c)
+		return
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	c.state = state
+	c.since = time.Now()
+}
+
+// shouldLog returns true if the client's rejected connections haven't been logged within the last interval
+func (l *ConnLimiter) shouldLog(client string, now time.Time) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	last, ok := l.logged[client]
+	if ok && now.Sub(last) < connRejectionLogInterval {
+		return false
+	}
+
+	if !ok && len(l.logged) >= connRejectionLogMaxClients {
+		// the clients logged more than an interval ago would be logged again anyway
+		for c, at := range l.logged {
+			if now.Sub(at) >= connRejectionLogInterval {
+				delete(l.logged, c)
+			}
+		}
+
+		if len(l.logged) >= connRejectionLogMaxClients {
+			return false
+		}
+	}
+
+	l.logged[client] = now
+
+	return true
+}
+
+// reapIdle closes the idle connections of the clients over the reaping threshold until done is closed
+func (l *ConnLimiter) reapIdle(done <-chan struct{}, logger *vlog.Logger) {
+	if l.reapThreshold <= 0 || l.reapAfter <= 0 {
+		return
+	}
+
+	interval := l.reapAfter / 2
+	if interval > connReapMaxInterval {
+		interval = connReapMaxInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			if reaped := l.reap(now); reaped > 0 {
+				logger.Debug(fmt.Sprintf("[vk] closed %d idle connections of clients over the reaping threshold", reaped))
+			}
+		}
+	}
+}
+
+// reap closes the connections that have been idle for longer than reapAfter of each client over the threshold,
+// longest idle first, until the client is back at the threshold. It returns the number of connections closed
+func (l *ConnLimiter) reap(now time.Time) int {
+	l.lock.Lock()
+
+	idle := map[string][]*limitedConn{}
+
+	for c := range l.conns {
+		if l.clients[c.client] <= l.reapThreshold {
+			continue
+		}
+
+		if (c.state == http.StateIdle || c.state == http.StateNew) && now.Sub(c.since) >= l.reapAfter {
+			idle[c.client] = append(idle[c.client], c)
+		}
+	}
+
+	var reap []*limitedConn
+
+	for client, conns := range idle {
+		sort.Slice(conns, func(i, j int) bool { return conns[i].since.Before(conns[j].since) })
+
+		excess := l.clients[client] - l.reapThreshold
+		if len(conns) > excess {
+			conns = conns[:excess]
+		}
+
+		reap = append(reap, conns...)
+	}
+
+	l.lock.Unlock()
+
+	for _, c := range reap {
+		c.Close()
+	}
+
+	atomic.AddUint64(&l.reaped, uint64(len(reap)))
+
+	return len(reap)
+}
+
+// limitListener admits the connections it accepts through its ConnLimiter, closing those beyond the limits
+type limitListener struct {
+	net.Listener
+	limiter *ConnLimiter
+	logger  *vlog.Logger
+}
+
+func (ll *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := ll.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		now := time.Now()
+
+		c, err := ll.limiter.admit(conn, now)
+		if err == nil {
+			return c, nil
+		}
+
+		client := connClient(conn)
+		if ll.limiter.shouldLog(client, now) {
+			ll.logger.Warn(fmt.Sprintf("[vk] closed connection from %s: %s", client, err.Error()))
+		}
+
+		conn.Close()
+	}
+}
+
+// limitedConn holds a slot of its ConnLimiter until it is closed. Its state and since are guarded by the limiter
+type limitedConn struct {
+	net.Conn
+	limiter *ConnLimiter
+	client  string
+	state   http.ConnState
+	since   time.Time // when the connection entered its state
+}
+
+func (c *limitedConn) Close() error {
+	c.limiter.release(c)
+
+	return c.Conn.Close()
+}
+
+// connClient returns the IP address of the connection's remote end
+func connClient(conn net.Conn) string {
+	addr := conn.RemoteAddr().String()
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+
+	return host
+}
@@ -0,0 +1,199 @@
+package vk
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// ConsistencyTokenHeader carries a session consistency token, in responses and in the requests that follow them
+	ConsistencyTokenHeader = "X-Consistency-Token"
+
+	defaultConsistencyCookieName = "vk_consistency"
+	defaultConsistencyCookieTTL  = time.Minute
+
+	// maxConsistencyTokenLength is the longest token accepted from a request, longer ones are ignored
+	maxConsistencyTokenLength = 512
+)
+
+// ConsistencyCookieOptions configures the cookie that carries consistency tokens for clients (such as browsers)
+// that can't send them back as a header, see UseConsistencyCookie
+type ConsistencyCookieOptions struct {
+	Secret []byte        // signs the cookie, so that clients can't forge tokens
+	Name   string        // vk_consistency by default
+	TTL    time.Duration // how long the cookie (and the token in it) is accepted, 1m by default
+
+	// Now can be replaced for testing, it timestamps the cookies and checks their expiry
+	Now func() time.Time
+}
+
+// consistencyCookie signs and verifies consistency cookies
+type consistencyCookie struct {
+	ConsistencyCookieOptions
+}
+
+// SetConsistencyToken sets the consistency token describing the position of the request's writes, which is sent
+// to the client in the X-Consistency-Token header (and a signed cookie, see UseConsistencyCookie) for it to send
+// back with its next requests. It must be called before the response is written. The token is opaque to vk
+func (c *Ctx) SetConsistencyToken(token string) {
+	if c == nil || c.RespHeaders == nil {
+		return
+	}
+
+	c.RespHeaders.Set(ConsistencyTokenHeader, token)
+
+	if c.consistencyCookie == nil {
+		return
+	}
+
+	cookie := c.consistencyCookie.cookie(token, c.consistencyCookie.Now(), c.IsTLS())
+
+	// a token set earlier in the request is replaced rather than sent alongside this one
+	prefix := cookie.Name + "="
+
+	var cookies []string
+	for _, v := range c.RespHeaders.Values("Set-Cookie") {
+		if !strings.HasPrefix(v, prefix) {
+			cookies = append(cookies, v)
+		}
+	}
+
+	c.RespHeaders["Set-Cookie"] = append(cookies, cookie.String())
+}
+
+// ConsistencyToken returns the consistency token sent with the request, from the X-Consistency-Token header or, if
+// there is none, the consistency cookie. It returns an empty string if the request has neither, or if the cookie's
+// signature is invalid or it has expired
+func (c *Ctx) ConsistencyToken() string {
+	if c == nil {
+		return ""
+	}
+
+	return c.consistencyToken
+}
+
+// useConsistencyCookie sets the options of the consistency cookie, which is disabled if opts has no secret
+func (rt *Router) useConsistencyCookie(opts ConsistencyCookieOptions) {
+	if len(opts.Secret) == 0 {
+		rt.consistencyCookie = nil
+		return
+	}
+
+	if opts.Name == "" {
+		opts.Name = defaultConsistencyCookieName
+	}
+
+	if opts.TTL <= 0 {
+		opts.TTL = defaultConsistencyCookieTTL
+	}
+
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+
+	rt.consistencyCookie = &consistencyCookie{opts}
+}
+
+// consistencyTokenFrom returns the request's consistency token, preferring the header over the cookie
+func consistencyTokenFrom(r *http.Request, cookie *consistencyCookie) string {
+	if token := r.Header.Get(ConsistencyTokenHeader); token != "" {
+		if validConsistencyToken(token) {
+			return token
+		}
+
+		return ""
+	}
+
+	if cookie == nil {
+		return ""
+	}
+
+	c, err := r.Cookie(cookie.Name)
+	if err != nil {
+		return ""
+	}
+
+	token, ok := cookie.verify(c.Value, cookie.Now())
+	if !ok || !validConsistencyToken(token) {
+		return ""
+	}
+
+	return token
+}
+
+// validConsistencyToken returns true if token is short and printable, so that it is safe to log
+func validConsistencyToken(token string) bool {
+	if len(token) > maxConsistencyTokenLength {
+		return false
+	}
+
+	for i := 0; i < len(token); i++ {
+		if token[i] < 0x21 || token[i] > 0x7e {
+			return false
+		}
+	}
+
+	return true
+}
+
+// cookie returns the cookie carrying token, as <token>.<expiry>.<signature>, all base64url-encoded but the expiry,
+// which is in Unix milliseconds
+func (cc *consistencyCookie) cookie(token string, now time.Time, secure bool) *http.Cookie {
+	expires := now.Add(cc.TTL)
+
+	payload := base64.RawURLEncoding.EncodeToString([]byte(token)) + "." + strconv.FormatInt(expires.UnixMilli(), 10)
+
+	cookie := &http.Cookie{
+		Name:     cc.Name,
+		Value:    payload + "." + cc.sign(payload),
+		Path:     "/",
+		MaxAge:   int(cc.TTL.Seconds()),
+		Secure:   secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+
+	return cookie
+}
+
+// verify returns the token in value if its signature is valid and it hasn't expired
+func (cc *consistencyCookie) verify(value string, now time.Time) (string, bool) {
+	i := strings.LastIndexByte(value, '.')
+	if i < 0 {
+		return "", false
+	}
+
+	payload, signature := value[:i], value[i+1:]
+	if !hmac.Equal([]byte(signature), []byte(cc.sign(payload))) {
+		return "", false
+	}
+
+	encoded, expiry, ok := strings.Cut(payload, ".")
+	if !ok {
+		return "", false
+	}
+
+	expires, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil || now.UnixMilli() >= expires {
+		return "", false
+	}
+
+	token, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", false
+	}
+
+	return string(token), true
+}
+
+func (cc *consistencyCookie) sign(payload string) string {
+	mac := hmac.New(sha256.New, cc.Secret)
+	mac.Write([]byte(payload))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
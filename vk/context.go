@@ -1,8 +1,10 @@
 package vk
 
 import (
+	"bytes"
 	"context"
 	"net/http"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/julienschmidt/httprouter"
@@ -13,7 +15,13 @@ import (
 // ctxKey is a type to represent a key in the Ctx context.
 type ctxKey string
 
-// Ctx serves a similar purpose to context.Context, but has some typed fields
+// Ctx serves a similar purpose to context.Context, but has some typed fields. A *Ctx is a context.Context itself,
+// delegating to its Context, which the router derives from the request's context so that it is cancelled when the
+// client goes away, so it can be passed straight to database calls and other functions taking a context.
+//
+// A zero-value or nil *Ctx is safe to use: Set and UseScope/UseRequestID do nothing on a nil
+// *Ctx, Get and Scope return nil, RequestID returns an empty string for a nil *Ctx, and a
+// zero-value Ctx lazily uses context.Background and a no-op logger.
 type Ctx struct {
 	Context     context.Context
 	Log         *vlog.Logger
@@ -21,10 +29,79 @@ type Ctx struct {
 	RespHeaders http.Header
 	requestID   string
 	scope       interface{}
+	request     *http.Request
+	route       string // the route that matched the request, i.e. /users/:id
+	retriesUsed int32  // shared retry budget, see Retry
+	trustProxy  bool   // whether X-Forwarded-* headers are trusted, see IsTLS
+
+	errorFormatter ErrorFormatter // the formatter of the route's groups, see WithErrorFormatter
+	notifier       Notifier       // see Notify
+	cleanups       []func()       // see OnCleanup
+	cleanupCounter *cleanupCounter
+	webSockets     *WebSocketLimiter // applied to websocket upgrades, see WrapWebsocket
+	wsOptions      WSOptions         // see WebSocketOptions
+	sockets        *ConnRegistry     // see Sockets
+
+	claimHeaders    []string       // the headers set by ClaimsPropagation, which are removed from proxied requests
+	outboundHeaders http.Header    // see OutboundHeaders
+	outboundCalls   *OutboundCalls // see HTTPClient
+
+	patch *MergePatch // see ApplyMergePatch
+	bound interface{} // see Bound
+	vary  []string    // see AddVary
+
+	binding      *BodySpec // set with Binding, see Bind
+	bindMaxBytes int64     // the server's limit for Bind
+
+	buffer *bytes.Buffer // see Buffer
+
+	correlation        Correlation        // see Correlation
+	correlationHeaders CorrelationHeaders // see UseCorrelationHeaders
+
+	consistencyToken  string             // see ConsistencyToken
+	consistencyCookie *consistencyCookie // see SetConsistencyToken
+	stateSealer       *StateSealer       // see SealState
+
+	dependencies *dependencies // see Resolve
+	devMode      bool
+	devCapture   *devCapture        // see serveDevErrorPage
+	chaosAllowed bool               // see UseChaos
+	retirements  *Retirements       // see Retire
+	cache        *Cache             // see CacheFrom
+	invalidation *cacheInvalidation // see Invalidates
+
+	closing <-chan struct{} // closed when the server starts shutting down, see WrapWebsocket
+
+	snapshot func() RouteSnapshot // the serving router's Snapshot, see OpsGroup
+
+	summary   *summaryWriter  // records the response for afterware
+	afterware []afterwareCall // see After
+
+	deadlines *DeadlinePropagation // see UseDeadlinePropagation
+	budget    time.Duration        // see DeadlineBudget
+
+	phase  *runningPhase // see PhaseBudget
+	phases []PhaseTiming // see PhaseTimings
+
+	domain *IsolationDomain // see Domain
+
+	guard       *responseGuard // the request's innermost response writer, see CommitResponse
+	commit      int32          // see CommitResponse
+	commitHooks []func(int)    // see onCommit
+
+	chainProbe **chainLink // set only when TraceChain is probing a handler
 }
 
-// NewCtx creates a new Ctx
+// NewCtx creates a new Ctx. A nil log is replaced by a no-op logger, and nil headers by an empty http.Header
 func NewCtx(log *vlog.Logger, params httprouter.Params, headers http.Header) *Ctx {
+	if log == nil {
+		log = vlog.Noop()
+	}
+
+	if headers == nil {
+		headers = http.Header{}
+	}
+
 	ctx := &Ctx{
 		Context:     context.Background(),
 		Log:         log,
@@ -37,21 +114,68 @@ func NewCtx(log *vlog.Logger, params httprouter.Params, headers http.Header) *Ct
 
 // Set sets a value on the Ctx's embedded Context (a la key/value store)
 func (c *Ctx) Set(key string, val interface{}) {
+	if c == nil {
+		return
+	}
+
+	if c.Context == nil {
+		c.Context = context.Background()
+	}
+
 	realKey := ctxKey(key)
 	c.Context = context.WithValue(c.Context, realKey, val)
 }
 
 // Get gets a value from the Ctx's embedded Context (a la key/value store)
 func (c *Ctx) Get(key string) interface{} {
+	if c == nil || c.Context == nil {
+		return nil
+	}
+
 	realKey := ctxKey(key)
 	val := c.Context.Value(realKey)
 
 	return val
 }
 
+// Deadline returns the deadline of the Ctx's Context, if it has one
+func (c *Ctx) Deadline() (time.Time, bool) {
+	return c.baseContext().Deadline()
+}
+
+// Done returns a channel that is closed when the Ctx's Context is cancelled: when the client goes away, the request's
+// deadline passes (see TimeoutMiddleware and UseHandlerTimeout), or for a websocket handler, when the server starts
+// shutting down
+func (c *Ctx) Done() <-chan struct{} {
+	return c.baseContext().Done()
+}
+
+// Err returns why the Ctx's Context was cancelled, or nil if it hasn't been
+func (c *Ctx) Err() error {
+	return c.baseContext().Err()
+}
+
+// Value returns the value of key in the Ctx's Context
+func (c *Ctx) Value(key interface{}) interface{} {
+	return c.baseContext().Value(key)
+}
+
+// baseContext returns the Ctx's Context, or context.Background if it is nil
+func (c *Ctx) baseContext() context.Context {
+	if c == nil || c.Context == nil {
+		return context.Background()
+	}
+
+	return c.Context
+}
+
 // UseScope sets an object to be the scope of the request, including setting the logger's scope
 // the scope can be retrieved later with the Scope() method
 func (c *Ctx) UseScope(scope interface{}) {
+	if c == nil {
+		return
+	}
+
 	c.Log = c.Log.CreateScoped(scope)
 
 	c.scope = scope
@@ -59,19 +183,53 @@ func (c *Ctx) UseScope(scope interface{}) {
 
 // Scope retrieves the context's scope
 func (c *Ctx) Scope() interface{} {
+	if c == nil {
+		return nil
+	}
+
 	return c.scope
 }
 
 // UseRequestID is a setter for the request ID
 func (c *Ctx) UseRequestID(id string) {
+	if c == nil {
+		return
+	}
+
 	c.requestID = id
 }
 
 // RequestID returns the request ID of the current request, generating one if none exists.
 func (c *Ctx) RequestID() string {
+	if c == nil {
+		return ""
+	}
+
 	if c.requestID == "" {
 		c.requestID = uuid.New().String()
 	}
 
 	return c.requestID
 }
+
+// IsWebSocketUpgrade returns true if the request being handled is a websocket handshake, i.e. a GET request with
+// a Connection header containing the "upgrade" token and an Upgrade header of "websocket" (RFC 6455, section 4.1).
+// It returns false if the Ctx was not created by a Router
+func (c *Ctx) IsWebSocketUpgrade() bool {
+	if c == nil || c.request == nil {
+		return false
+	}
+
+	return isWebSocketUpgrade(c.request)
+}
+
+// useRequest sets the request that the Ctx belongs to
+func (c *Ctx) useRequest(r *http.Request) {
+	c.request = r
+}
+
+func isWebSocketUpgrade(r *http.Request) bool {
+	return r.Method == http.MethodGet &&
+		headerHasToken(r.Header, "Connection", "upgrade") &&
+		headerHasToken(r.Header, "Upgrade", "websocket")
+}
@@ -0,0 +1,235 @@
+package vk
+
+import (
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// CorrelationIDHeader carries the ID shared by every request made on behalf of the same originating request
+	CorrelationIDHeader = "X-Correlation-ID"
+
+	// CausationIDHeader carries the ID of the request that directly caused this one
+	CausationIDHeader = "X-Causation-ID"
+
+	// ClientIDHeader carries the ID of the client application that originated the request
+	ClientIDHeader = "X-Client-ID"
+
+	// SessionIDHeader carries the ID of the end user's session that originated the request
+	SessionIDHeader = "X-Session-ID"
+
+	// maxCorrelationIDLength is the longest ID accepted from a request, longer ones are ignored
+	maxCorrelationIDLength = 256
+)
+
+// CorrelationHeaders names the headers that carry a request's Correlation, see UseCorrelationHeaders. Empty names
+// are replaced by the defaults, i.e. X-Request-ID and X-Correlation-ID
+type CorrelationHeaders struct {
+	RequestID     string
+	CorrelationID string
+	CausationID   string
+	ClientID      string
+	SessionID     string
+}
+
+// withDefaults returns the names with the empty ones replaced by the default headers
+func (h CorrelationHeaders) withDefaults() CorrelationHeaders {
+	if h.RequestID == "" {
+		h.RequestID = RequestIDHeader
+	}
+
+	if h.CorrelationID == "" {
+		h.CorrelationID = CorrelationIDHeader
+	}
+
+	if h.CausationID == "" {
+		h.CausationID = CausationIDHeader
+	}
+
+	if h.ClientID == "" {
+		h.ClientID = ClientIDHeader
+	}
+
+	if h.SessionID == "" {
+		h.SessionID = SessionIDHeader
+	}
+
+	return h
+}
+
+// Correlation identifies a request and its place in the chain of requests that led to it
+type Correlation struct {
+	requestID     string
+	correlationID string
+	causationID   string
+	clientID      string
+	sessionID     string
+}
+
+// RequestID returns the ID of the request itself, the same as Ctx.RequestID
+func (c Correlation) RequestID() string {
+	return c.requestID
+}
+
+// CorrelationID returns the ID shared by the whole chain. It is taken from the request's correlation header, or its
+// request ID header if the caller only sent that, and is the request's own ID if the request starts the chain
+func (c Correlation) CorrelationID() string {
+	return c.correlationID
+}
+
+// CausationID returns the ID of the request that directly caused this one. It is taken from the request's causation
+// header, or its request ID header if the caller only sent that, and is the request's own ID if it starts the chain
+func (c Correlation) CausationID() string {
+	return c.causationID
+}
+
+// ClientID returns the ID of the client application that originated the chain, if the request carried one
+func (c Correlation) ClientID() string {
+	return c.clientID
+}
+
+// SessionID returns the ID of the end user's session that originated the chain, if the request carried one
+func (c Correlation) SessionID() string {
+	return c.sessionID
+}
+
+// Correlation returns the request's correlation block, which is included in the request's log scope, echoed in
+// the response headers (the request and correlation IDs), and carried by the requests made on its behalf with
+// HTTPClient and proxies
+func (c *Ctx) Correlation() Correlation {
+	if c == nil {
+		return Correlation{}
+	}
+
+	corr := c.correlation
+	corr.requestID = c.RequestID()
+
+	if corr.correlationID == "" {
+		corr.correlationID = corr.requestID
+	}
+
+	if corr.causationID == "" {
+		corr.causationID = corr.requestID
+	}
+
+	return corr
+}
+
+// correlationScope is the log scope of every request, the request_id field predates the rest of the block
+type correlationScope struct {
+	RequestID        string `json:"request_id"`
+	CorrelationID    string `json:"correlation_id"`
+	CausationID      string `json:"causation_id"`
+	ClientID         string `json:"client_id,omitempty"`
+	SessionID        string `json:"session_id,omitempty"`
+	ConsistencyToken string `json:"consistency_token,omitempty"`
+}
+
+// correlationFrom returns the correlation block carried by the headers of an inbound request
+func correlationFrom(h http.Header, names CorrelationHeaders) Correlation {
+	names = names.withDefaults()
+
+	caller := correlationHeader(h, names.RequestID)
+
+	corr := Correlation{
+		correlationID: correlationHeader(h, names.CorrelationID),
+		causationID:   correlationHeader(h, names.CausationID),
+		clientID:      correlationHeader(h, names.ClientID),
+		sessionID:     correlationHeader(h, names.SessionID),
+	}
+
+	if corr.correlationID == "" {
+		corr.correlationID = caller
+	}
+
+	if corr.causationID == "" {
+		corr.causationID = caller
+	}
+
+	return corr
+}
+
+// correlationHeader returns the value of the header, or an empty string if it is too long to be an ID
+func correlationHeader(h http.Header, name string) string {
+	value := h.Get(name)
+	if len(value) > maxCorrelationIDLength {
+		return ""
+	}
+
+	return value
+}
+
+// applyCorrelation sets the headers of a request made on behalf of the one described by corr, which becomes the
+// new request's cause
+func applyCorrelation(h http.Header, names CorrelationHeaders, corr Correlation) {
+	names = names.withDefaults()
+
+	h.Set(names.RequestID, corr.requestID)
+	h.Set(names.CorrelationID, corr.correlationID)
+	h.Set(names.CausationID, corr.requestID)
+
+	for name, value := range map[string]string{names.ClientID: corr.clientID, names.SessionID: corr.sessionID} {
+		if value != "" {
+			h.Set(name, value)
+		} else {
+			h.Del(name)
+		}
+	}
+}
+
+// applyCorrelationHeaders sets the correlation headers of a request made on behalf of the Ctx's request
+func (c *Ctx) applyCorrelationHeaders(h http.Header) {
+	if c == nil {
+		return
+	}
+
+	applyCorrelation(h, c.correlationHeaders, c.Correlation())
+}
+
+// useCorrelation reads the request's correlation block, adds it to the log scope, and echoes it in the response
+func (c *Ctx) useCorrelation(r *http.Request, names CorrelationHeaders) {
+	c.correlationHeaders = names.withDefaults()
+	c.correlation = correlationFrom(r.Header, names)
+
+	corr := c.Correlation()
+
+	c.RespHeaders.Set(c.correlationHeaders.RequestID, corr.requestID)
+	c.RespHeaders.Set(c.correlationHeaders.CorrelationID, corr.correlationID)
+
+	c.UseScope(correlationScope{
+		RequestID:        corr.requestID,
+		CorrelationID:    corr.correlationID,
+		CausationID:      corr.causationID,
+		ClientID:         corr.clientID,
+		SessionID:        corr.sessionID,
+		ConsistencyToken: c.consistencyToken,
+	})
+}
+
+// applyCorrelation sets the correlation headers of a request forwarded by the proxy. Requests with a Ctx are made
+// on behalf of its request, the rest (i.e. those forwarded by the fallback proxy) get a correlation block of their own
+func (p *proxy) applyCorrelation(r *http.Request) {
+	if ctx := CtxFromContext(r.Context()); ctx != nil {
+		ctx.applyCorrelationHeaders(r.Header)
+		return
+	}
+
+	corr := correlationFrom(r.Header, p.correlationHeaders)
+	corr.requestID = uuid.New().String()
+
+	if corr.correlationID == "" {
+		corr.correlationID = corr.requestID
+	}
+
+	applyCorrelation(r.Header, p.correlationHeaders, corr)
+}
+
+// useCorrelationHeaders sets the names of the headers that carry the correlation block, see UseCorrelationHeaders
+func (rt *Router) useCorrelationHeaders(names CorrelationHeaders) {
+	rt.correlationHeaders = names.withDefaults()
+
+	if rt.fallbackProxy != nil {
+		rt.fallbackProxy.correlationHeaders = rt.correlationHeaders
+	}
+}
@@ -0,0 +1,331 @@
+package vk
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// defaultHandlerGrace is how long a handler can run beyond its soft deadline before it is abandoned
+const defaultHandlerGrace = 5 * time.Second
+
+// useHandlerTimeout sets the soft deadline of the router's handlers, 0 to disable it, and the grace period beyond it
+// after which they are abandoned, or the default if 0
+func (rt *Router) useHandlerTimeout(soft, grace time.Duration) {
+	if grace <= 0 {
+		grace = defaultHandlerGrace
+	}
+
+	rt.handlerTimeout = soft
+	rt.handlerGrace = grace
+}
+
+// AbandonedHandlers returns the number of handlers that were still running at their hard deadline, see UseHandlerTimeout
+func (rt *Router) AbandonedHandlers() uint64 {
+	return atomic.LoadUint64(&rt.abandoned)
+}
+
+// AbandonedHandlers returns the number of handlers abandoned by the server's router, see Router.AbandonedHandlers
+func (s *Server) AbandonedHandlers() uint64 {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.internalRouter.AbandonedHandlers()
+}
+
+// serveWithDeadline serves the request from another goroutine, so that it can be answered with a 504 once the soft
+// deadline has passed, whether or not the handler returns. At the soft deadline, the request's contexts are cancelled
+// and, if the handler hasn't started its response, a 504 is written and anything it writes later is discarded. If it
+// is still running at the hard deadline it is abandoned: its writes are discarded and it is logged and counted
+func (rt *Router) serveWithDeadline(route string, w http.ResponseWriter, r *http.Request, ctx *Ctx, entry inFlightEntry, inner HandlerFunc) {
+	start := time.Now()
+
+	// the handler can change the Ctx's logger, so the one it started with is used from this goroutine
+	log, requestID, formatter := ctx.Log, ctx.RequestID(), ctx.errorFormatter
+
+	reqCtx, cancelReq := context.WithTimeout(r.Context(), rt.handlerTimeout)
+	handlerCtx, cancelHandler := context.WithTimeout(ctx.Context, rt.handlerTimeout)
+
+	r = r.WithContext(reqCtx)
+	ctx.Context = handlerCtx
+
+	dw := newDeadlineWriter(w)
+	ctx.RespHeaders = dw.header
+
+	sw := &summaryWriter{ResponseWriter: dw}
+	ctx.summary = sw
+
+	var panicked interface{}
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		defer entry.done()
+		defer cancelReq()
+		defer cancelHandler()
+
+		// the router recovers every panic but http.ErrAbortHandler, which net/http can only handle from the request's
+		// goroutine, so it is re-raised there rather than crashing the process
+		defer func() {
+			panicked = recover()
+		}()
+
+		rt.serve(dw, r, ctx, inner)
+	}()
+
+	soft := time.NewTimer(rt.handlerTimeout)
+	defer soft.Stop()
+
+	select {
+	case <-done:
+		repanic(panicked)
+		return
+	case <-soft.C:
+	}
+
+	cancelReq()
+	cancelHandler()
+
+	abandon := func() {
+		dw.discard()
+
+		atomic.AddUint64(&rt.abandoned, 1)
+		entry.abandon()
+
+		log.Warn(fmt.Sprintf("abandoned handler for %s %s (request %s) still running after %dms", r.Method, route, requestID, time.Since(start).Milliseconds()))
+	}
+
+	// the 504 is recorded as the request's response, for its log line, afterware and degradation
+	timedOut := dw.timeOut(func() {
+		sw.timeOut(w, func(w http.ResponseWriter) {
+			respondError(w, r, formatter, E(http.StatusGatewayTimeout, "handler timed out"))
+		})
+	})
+
+	if timedOut {
+		// the 504 is complete, so the response is finished while the handler is watched in the background
+		go func() {
+			hard := time.NewTimer(rt.handlerGrace)
+			defer hard.Stop()
+
+			select {
+			case <-done:
+				// the 504 has been sent, so the handler's panic has no response left to abort
+				if panicked != nil && panicked != http.ErrAbortHandler {
+					log.Warn(fmt.Sprintf("handler for %s %s (request %s) panicked after timing out: %v", r.Method, route, requestID, panicked))
+				}
+			case <-hard.C:
+				abandon()
+			}
+		}()
+
+		return
+	}
+
+	// the handler's response has started, so it has until the hard deadline to finish it
+	hard := time.NewTimer(rt.handlerGrace)
+	defer hard.Stop()
+
+	select {
+	case <-done:
+		repanic(panicked)
+	case <-hard.C:
+		abandon()
+	}
+}
+
+// repanic re-raises a panic recovered from another goroutine, if there was one
+func repanic(value interface{}) {
+	if value != nil {
+		panic(value)
+	}
+}
+
+// deadlineWriter lets a handler's response be replaced by a 504 until it has started, and discards what the handler
+// writes once it has timed out or been abandoned. The handler's headers are kept apart until its response starts,
+// so that they can't race with the 504
+type deadlineWriter struct {
+	w      http.ResponseWriter
+	header http.Header
+
+	lock      sync.Mutex
+	started   bool
+	discarded bool
+}
+
+func newDeadlineWriter(w http.ResponseWriter) *deadlineWriter {
+	dw := &deadlineWriter{
+		w:      w,
+		header: w.Header().Clone(),
+	}
+
+	return dw
+}
+
+func (dw *deadlineWriter) Header() http.Header {
+	return dw.header
+}
+
+func (dw *deadlineWriter) WriteHeader(status int) {
+	dw.lock.Lock()
+	defer dw.lock.Unlock()
+
+	if dw.discarded || dw.started {
+		return
+	}
+
+	dw.start()
+	dw.w.WriteHeader(status)
+}
+
+func (dw *deadlineWriter) Write(b []byte) (int, error) {
+	dw.lock.Lock()
+	defer dw.lock.Unlock()
+
+	if dw.discarded {
+		return 0, http.ErrHandlerTimeout
+	}
+
+	if !dw.started {
+		dw.start()
+	}
+
+	return dw.w.Write(b)
+}
+
+// Flush flushes the underlying ResponseWriter if it supports flushing and the response hasn't been discarded
+func (dw *deadlineWriter) Flush() {
+	dw.lock.Lock()
+	defer dw.lock.Unlock()
+
+	if dw.discarded {
+		return
+	}
+
+	if !dw.started {
+		dw.start()
+	}
+
+	if f, ok := dw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// ReadFrom copies from src using the underlying ResponseWriter's ReadFrom if it has one, see readFrom
+func (dw *deadlineWriter) ReadFrom(src io.Reader) (int64, error) {
+	dw.lock.Lock()
+	defer dw.lock.Unlock()
+
+	if dw.discarded {
+		return 0, http.ErrHandlerTimeout
+	}
+
+	if !dw.started {
+		dw.start()
+	}
+
+	return readFrom(dw.w, src)
+}
+
+// Hijack hijacks the underlying ResponseWriter's connection, after which the response can't be replaced by a 504
+func (dw *deadlineWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	dw.lock.Lock()
+	defer dw.lock.Unlock()
+
+	h, ok := dw.w.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("ResponseWriter does not implement http.Hijacker")
+	}
+
+	if dw.discarded {
+		return nil, nil, http.ErrHandlerTimeout
+	}
+
+	if !dw.started {
+		dw.start()
+	}
+
+	return h.Hijack()
+}
+
+// start copies the handler's headers to the underlying ResponseWriter, it must be called with the lock held
+func (dw *deadlineWriter) start() {
+	dw.started = true
+
+	dst := dw.w.Header()
+	for key := range dst {
+		delete(dst, key)
+	}
+
+	for key, values := range dw.header {
+		dst[key] = values
+	}
+}
+
+// timeOut calls respond and discards the handler's writes from then on, unless its response has already started
+func (dw *deadlineWriter) timeOut(respond func()) bool {
+	dw.lock.Lock()
+	defer dw.lock.Unlock()
+
+	if dw.started || dw.discarded {
+		return false
+	}
+
+	dw.discarded = true
+	respond()
+
+	return true
+}
+
+// respondNow sends the response written by respond to w straight away, with its Content-Length, so that the client
+// has all of it even though the handler that w belongs to hasn't returned
+func respondNow(w http.ResponseWriter, respond func(w http.ResponseWriter)) {
+	rec := newCacheRecorder(nil, maxPooledBufferBytes)
+	respond(rec)
+
+	for key, values := range rec.header {
+		w.Header()[key] = values
+	}
+
+	status := rec.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(rec.body.Len()))
+	w.WriteHeader(status)
+	_, _ = w.Write(rec.body.Bytes())
+
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// finish hands the response back to the underlying ResponseWriter once the handler has returned, copying the
+// handler's headers to it if its response hasn't started, so that an error it returned is sent with them
+func (dw *deadlineWriter) finish() {
+	dw.lock.Lock()
+	defer dw.lock.Unlock()
+
+	if !dw.started && !dw.discarded {
+		dw.start()
+	}
+}
+
+// discard discards the handler's writes from then on
+func (dw *deadlineWriter) discard() {
+	dw.lock.Lock()
+	defer dw.lock.Unlock()
+
+	dw.discarded = true
+}
@@ -0,0 +1,354 @@
+package vk
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// dedupSweepInterval is how often a MemoryDedupStore removes expired keys
+const dedupSweepInterval = time.Minute
+
+// DedupState is what a DedupStore knows about a key
+type DedupState int
+
+const (
+	// DedupNew means the key hasn't been seen (or has expired), and is now claimed by the request
+	DedupNew DedupState = iota
+	// DedupInProgress means the request that claimed the key hasn't finished
+	DedupInProgress
+	// DedupSeen means a request with the key has been handled successfully
+	DedupSeen
+)
+
+// DedupStore records the keys of the requests handled by a Deduplicator. Unlike a response cache, it only needs
+// to know whether a key has been seen, so entries are small
+type DedupStore interface {
+	// Begin claims key for ttl if it is new, otherwise it returns the key's state and when it was first seen
+	Begin(key string, ttl time.Duration) (DedupState, time.Time, error)
+	// Finish ends the claim on key. If the request succeeded, the key is kept as seen until it expires, otherwise it
+	// is forgotten so that the event can be delivered again
+	Finish(key string, succeeded bool) error
+}
+
+// DedupStats reports the requests that passed through a Deduplicator
+type DedupStats struct {
+	Handled     uint64 `json:"handled"` // requests with a new key, which were passed to the handler
+	Duplicates  uint64 `json:"duplicates"`
+	InProgress  uint64 `json:"in_progress"` // duplicates that arrived while the first delivery was being handled
+	KeyErrors   uint64 `json:"key_errors"`
+	StoreErrors uint64 `json:"store_errors"`
+}
+
+// dedupResponse is the body of the response to a duplicate request
+type dedupResponse struct {
+	Duplicate bool      `json:"duplicate"`
+	FirstSeen time.Time `json:"first_seen"`
+}
+
+// Deduplicator short-circuits requests whose key has already been handled, such as webhook events that a provider
+// delivers again. Duplicates are answered with a success status so that the provider stops retrying
+type Deduplicator struct {
+	keyFn func(*Ctx) (string, error)
+	store DedupStore
+	ttl   time.Duration
+
+	duplicateStatus int32
+
+	handled     uint64
+	duplicates  uint64
+	inProgress  uint64
+	keyErrors   uint64
+	storeErrors uint64
+}
+
+// DedupMiddleware returns a Middleware that handles each key returned by keyFn once within ttl, see NewDeduplicator
+func DedupMiddleware(keyFn func(*Ctx) (string, error), store DedupStore, ttl time.Duration) Middleware {
+	return NewDeduplicator(keyFn, store, ttl).Middleware()
+}
+
+// NewDeduplicator creates a Deduplicator that keys requests with keyFn, such as DedupByHeader or DedupByBodyHash.
+//
+// The first request with a key is handled, and the key is kept in store for ttl if it succeeds (with a 2xx status).
+// Later requests with the key get a 200 (see SetDuplicateStatus) with a body marking them as duplicates, and requests
+// that arrive while the first is being handled get a 409 so that they are retried. If keyFn or the store fails, the
+// request is handled as usual, so handlers should still be idempotent
+func NewDeduplicator(keyFn func(*Ctx) (string, error), store DedupStore, ttl time.Duration) *Deduplicator {
+	d := &Deduplicator{
+		keyFn:           keyFn,
+		store:           store,
+		ttl:             ttl,
+		duplicateStatus: http.StatusOK,
+	}
+
+	return d
+}
+
+// SetDuplicateStatus sets the status of the response to a duplicate request, which should be one that the sender
+// treats as a success
+func (d *Deduplicator) SetDuplicateStatus(status int) {
+	atomic.StoreInt32(&d.duplicateStatus, int32(status))
+}
+
+// Stats returns the number of requests handled and short-circuited
+func (d *Deduplicator) Stats() DedupStats {
+	stats := DedupStats{
+		Handled:     atomic.LoadUint64(&d.handled),
+		Duplicates:  atomic.LoadUint64(&d.duplicates),
+		InProgress:  atomic.LoadUint64(&d.inProgress),
+		KeyErrors:   atomic.LoadUint64(&d.keyErrors),
+		StoreErrors: atomic.LoadUint64(&d.storeErrors),
+	}
+
+	return stats
+}
+
+// RegisterAdmin mounts GET /dedup on the admin router, reporting the deduplicator's stats
+func (d *Deduplicator) RegisterAdmin(r *Router) {
+	r.GET("/dedup", func(w http.ResponseWriter, _ *http.Request, ctx *Ctx) error {
+		return RespondJSON(ctx.Context, w, d.Stats(), http.StatusOK)
+	})
+}
+
+// Middleware returns a Middleware that short-circuits duplicate requests
+func (d *Deduplicator) Middleware() Middleware {
+	return Named("dedup", func(inner HandlerFunc) HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request, ctx *Ctx) error {
+			// the key function reads the request from the Ctx
+			ctx.useRequest(r)
+
+			key, err := d.keyFn(ctx)
+			if err != nil || key == "" {
+				atomic.AddUint64(&d.keyErrors, 1)
+
+				reason := "empty key"
+				if err != nil {
+					reason = err.Error()
+				}
+
+				ctx.Log.Warn("dedup: handling", r.Method, r.URL.Path, "without deduplication:", reason)
+
+				return inner(w, r, ctx)
+			}
+
+			state, firstSeen, err := d.store.Begin(key, d.ttl)
+			if err != nil {
+				atomic.AddUint64(&d.storeErrors, 1)
+				ctx.Log.Error(errors.Wrap(err, "dedup: failed to Begin"))
+
+				return inner(w, r, ctx)
+			}
+
+			switch state {
+			case DedupSeen:
+				atomic.AddUint64(&d.duplicates, 1)
+				ctx.Log.Debug("dedup: short-circuited duplicate", r.Method, r.URL.Path)
+
+				return RespondJSON(ctx.Context, w, dedupResponse{Duplicate: true, FirstSeen: firstSeen}, int(atomic.LoadInt32(&d.duplicateStatus)))
+			case DedupInProgress:
+				atomic.AddUint64(&d.inProgress, 1)
+
+				return E(http.StatusConflict, "a request with the same key is being handled")
+			}
+
+			atomic.AddUint64(&d.handled, 1)
+
+			dw := &dedupWriter{ResponseWriter: w}
+
+			succeeded := false
+			defer func() {
+				// a panicking handler leaves succeeded false, releasing the key
+				if err := d.store.Finish(key, succeeded); err != nil {
+					atomic.AddUint64(&d.storeErrors, 1)
+					ctx.Log.Error(errors.Wrap(err, "dedup: failed to Finish"))
+				}
+			}()
+
+			err = inner(dw, r, ctx)
+
+			status := dw.status
+			if status == 0 && err == nil {
+				status = http.StatusOK
+			}
+
+			succeeded = err == nil && status >= 200 && status < 300
+
+			return err
+		}
+	})
+}
+
+// DedupByHeader returns a key function for DedupMiddleware that keys requests by the value of a header, such as a
+// webhook provider's event ID. Requests without the header are handled without deduplication
+func DedupByHeader(name string) func(*Ctx) (string, error) {
+	return func(ctx *Ctx) (string, error) {
+		value := ctx.request.Header.Get(name)
+		if value == "" {
+			return "", errors.Errorf("missing %s header", name)
+		}
+
+		return name + ":" + value, nil
+	}
+}
+
+// DedupByBodyHash returns a key function for DedupMiddleware that keys requests by the SHA-256 hash of their method,
+// path and body. The body is read into memory (up to maxBytes, larger bodies aren't deduplicated) and replaced, so
+// that the handler can still read it
+func DedupByBodyHash(maxBytes int64) func(*Ctx) (string, error) {
+	return func(ctx *Ctx) (string, error) {
+		r := ctx.request
+		if r.Body == nil || r.Body == http.NoBody {
+			return "", errors.New("request has no body")
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxBytes+1))
+
+		// whatever was read is put back, followed by anything left unread
+		r.Body = readCloser{Reader: io.MultiReader(bytes.NewReader(body), r.Body), Closer: r.Body}
+
+		if err != nil {
+			return "", errors.Wrap(err, "failed to ReadAll")
+		}
+
+		if int64(len(body)) > maxBytes {
+			return "", errors.Errorf("body is larger than %d bytes", maxBytes)
+		}
+
+		hash := sha256.New()
+		fmt.Fprintf(hash, "%s %s\n", r.Method, r.URL.Path)
+		hash.Write(body)
+
+		return "sha256:" + hex.EncodeToString(hash.Sum(nil)), nil
+	}
+}
+
+// readCloser combines a Reader and a Closer
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// dedupWriter records the status of a response
+type dedupWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (dw *dedupWriter) WriteHeader(status int) {
+	if dw.status == 0 {
+		dw.status = status
+	}
+
+	dw.ResponseWriter.WriteHeader(status)
+}
+
+func (dw *dedupWriter) Write(b []byte) (int, error) {
+	if dw.status == 0 {
+		dw.status = http.StatusOK
+	}
+
+	return dw.ResponseWriter.Write(b)
+}
+
+// Flush flushes the underlying ResponseWriter if it supports flushing
+func (dw *dedupWriter) Flush() {
+	if f, ok := dw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// MemoryDedupStore is a DedupStore that keeps keys in memory, for a single server
+type MemoryDedupStore struct {
+	lock      sync.Mutex
+	entries   map[string]*dedupEntry
+	lastSweep time.Time
+}
+
+type dedupEntry struct {
+	firstSeen  time.Time
+	expires    time.Time
+	inProgress bool
+}
+
+// NewMemoryDedupStore creates an empty MemoryDedupStore
+func NewMemoryDedupStore() *MemoryDedupStore {
+	m := &MemoryDedupStore{
+		entries:   map[string]*dedupEntry{},
+		lastSweep: time.Now(),
+	}
+
+	return m
+}
+
+// Begin claims key for ttl if it is new or has expired
+func (m *MemoryDedupStore) Begin(key string, ttl time.Duration) (DedupState, time.Time, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	now := time.Now()
+
+	if e, ok := m.entries[key]; ok && (e.inProgress || now.Before(e.expires)) {
+		if e.inProgress {
+			return DedupInProgress, e.firstSeen, nil
+		}
+
+		return DedupSeen, e.firstSeen, nil
+	}
+
+	m.sweep(now)
+
+	m.entries[key] = &dedupEntry{firstSeen: now, expires: now.Add(ttl), inProgress: true}
+
+	return DedupNew, now, nil
+}
+
+// Finish keeps key until it expires if the request succeeded, or forgets it
+func (m *MemoryDedupStore) Finish(key string, succeeded bool) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	e, ok := m.entries[key]
+	if !ok {
+		return nil
+	}
+
+	if !succeeded {
+		delete(m.entries, key)
+		return nil
+	}
+
+	e.inProgress = false
+
+	return nil
+}
+
+// Len returns the number of keys in the store
+func (m *MemoryDedupStore) Len() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return len(m.entries)
+}
+
+// sweep removes the expired keys that no request is holding, at most once every dedupSweepInterval
+func (m *MemoryDedupStore) sweep(now time.Time) {
+	if now.Sub(m.lastSweep) < dedupSweepInterval {
+		return
+	}
+
+	m.lastSweep = now
+
+	for key, e := range m.entries {
+		if !e.inProgress && !now.Before(e.expires) {
+			delete(m.entries, key)
+		}
+	}
+}
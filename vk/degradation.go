@@ -0,0 +1,523 @@
+package vk
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/suborbital/vektor/vlog"
+)
+
+// ReadinessState is the readiness of the server as graded by a Degradation
+type ReadinessState string
+
+const (
+	ReadinessHealthy   ReadinessState = "healthy"
+	ReadinessDegraded  ReadinessState = "degraded"
+	ReadinessUnhealthy ReadinessState = "unhealthy"
+)
+
+const (
+	defaultDegradationWindow     = time.Minute
+	defaultDegradationHysteresis = 0.1
+	defaultSignalMinRequests     = 20
+	defaultLatencyQuantile       = 0.99
+	defaultLatencyDegraded       = time.Second
+	defaultInFlightDegraded      = 0.8
+	defaultInFlightUnhealthy     = 1
+	defaultErrorRateDegraded     = 0.05
+	defaultErrorRateUnhealthy    = 0.5
+
+	// degradationSlots is the number of slots the window is divided into, it moves forward one slot at a time
+	degradationSlots = 10
+)
+
+// the names of the signals in a DegradationReport
+const (
+	LatencySignalName   = "latency"
+	InFlightSignalName  = "in_flight"
+	ErrorRateSignalName = "error_rate"
+)
+
+// LatencySignal degrades readiness when a quantile of the latency of the requests in the window is high
+type LatencySignal struct {
+	Enabled bool
+
+	// Quantile is the quantile of the window's latencies that is graded, 0.99 by default
+	Quantile float64
+
+	// Degraded is the latency from which the server is degraded, 1s by default. Unhealthy is the latency from which
+	// it is unhealthy, 4 times Degraded by default
+	Degraded  time.Duration
+	Unhealthy time.Duration
+
+	// MinRequests is the number of requests the window needs before the signal is graded, 20 by default
+	MinRequests uint64
+}
+
+// InFlightSignal degrades readiness when the number of requests being handled nears the server's concurrency cap
+type InFlightSignal struct {
+	Enabled bool
+
+	// Limit is the concurrency cap, the RateLimit's MaxConcurrent by default. The signal is off without one
+	Limit int64
+
+	// Degraded and Unhealthy are the fractions of Limit from which the server is degraded (0.8 by default) and
+	// unhealthy (1 by default)
+	Degraded  float64
+	Unhealthy float64
+
+	// Current returns the number of requests being handled, by default those handled by the server's routers
+	Current func() int64
+}
+
+// ErrorRateSignal degrades readiness when the fraction of the window's requests that failed with a 5xx is high
+type ErrorRateSignal struct {
+	Enabled bool
+
+	// Degraded and Unhealthy are the error rates from which the server is degraded (0.05 by default) and
+	// unhealthy (0.5 by default)
+	Degraded  float64
+	Unhealthy float64
+
+	// MinRequests is the number of requests the window needs before the signal is graded, 20 by default
+	MinRequests uint64
+}
+
+// DegradationOptions configures a Degradation. Each signal is off unless it is Enabled
+type DegradationOptions struct {
+	Latency   LatencySignal
+	InFlight  InFlightSignal
+	ErrorRate ErrorRateSignal
+
+	// Window is how far back the latencies and errors of requests are graded, 1m by default
+	Window time.Duration
+
+	// Hysteresis is the fraction a signal must fall below a threshold it crossed before its state improves, which
+	// avoids flapping when it hovers around the threshold. It defaults to 0.1
+	Hysteresis float64
+
+	// the statuses served by the readiness endpoint in each state, 200, 203 and 503 by default
+	HealthyStatus   int
+	DegradedStatus  int
+	UnhealthyStatus int
+
+	// Now can be replaced for testing, it places requests in the window
+	Now func() time.Time
+}
+
+// SignalReport is the grade of one signal in a DegradationReport. Latencies are in milliseconds, and the in-flight
+// signal's value and thresholds are numbers of requests
+type SignalReport struct {
+	Name      string         `json:"name"`
+	State     ReadinessState `json:"state"`
+	Score     float64        `json:"score"`
+	Value     float64        `json:"value"`
+	Degraded  float64        `json:"degraded"`
+	Unhealthy float64        `json:"unhealthy"`
+}
+
+// DegradationReport is the readiness of the server graded from its signals. Its score is that of its worst signal,
+// from 1 when healthy down to 0 when unhealthy, for load balancers that weigh their backends
+type DegradationReport struct {
+	State   ReadinessState `json:"state"`
+	Score   float64        `json:"score"`
+	Status  int            `json:"status"`
+	Signals []SignalReport `json:"signals"`
+}
+
+// DegradationChanged is emitted when the score or state of the server's Degradation changes
+type DegradationChanged struct {
+	From          ReadinessState
+	To            ReadinessState
+	PreviousScore float64
+	Score         float64
+	Signals       []SignalReport
+}
+
+func (DegradationChanged) serverEvent() {}
+
+// degradationSlot holds the requests completed during one slot of the window
+type degradationSlot struct {
+	epoch    int64
+	latency  LatencyHistogram
+	requests uint64
+	failures uint64
+}
+
+// Degradation grades the readiness of the server from signals of its load: the latency and error rate of its
+// recent requests, and the number of requests it is handling. The readiness endpoint of a Health using it (see
+// HealthOptions.Degradation) serves a degraded status and a score, so that load balancers can send a struggling
+// server less traffic before it fails outright
+type Degradation struct {
+	opts DegradationOptions
+	log  *vlog.Logger
+	slot time.Duration
+
+	inFlight int64
+
+	windowLock sync.Mutex
+	slots      [degradationSlots]degradationSlot
+
+	lock     sync.Mutex
+	signals  map[string]ReadinessState
+	state    ReadinessState
+	score    float64
+	onChange []func(DegradationChanged)
+}
+
+// NewDegradation creates a Degradation, whose changes are logged with log if it isn't nil
+func NewDegradation(opts DegradationOptions, log *vlog.Logger) *Degradation {
+	if opts.Window <= 0 {
+		opts.Window = defaultDegradationWindow
+	}
+
+	if opts.Hysteresis <= 0 || opts.Hysteresis >= 1 {
+		opts.Hysteresis = defaultDegradationHysteresis
+	}
+
+	if opts.HealthyStatus == 0 {
+		opts.HealthyStatus = http.StatusOK
+	}
+
+	if opts.DegradedStatus == 0 {
+		opts.DegradedStatus = http.StatusNonAuthoritativeInfo
+	}
+
+	if opts.UnhealthyStatus == 0 {
+		opts.UnhealthyStatus = http.StatusServiceUnavailable
+	}
+
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+
+	if opts.Latency.Quantile <= 0 || opts.Latency.Quantile > 1 {
+		opts.Latency.Quantile = defaultLatencyQuantile
+	}
+
+	if opts.Latency.Degraded <= 0 {
+		opts.Latency.Degraded = defaultLatencyDegraded
+	}
+
+	if opts.Latency.Unhealthy <= opts.Latency.Degraded {
+		opts.Latency.Unhealthy = 4 * opts.Latency.Degraded
+	}
+
+	if opts.Latency.MinRequests == 0 {
+		opts.Latency.MinRequests = defaultSignalMinRequests
+	}
+
+	if opts.InFlight.Degraded <= 0 {
+		opts.InFlight.Degraded = defaultInFlightDegraded
+	}
+
+	if opts.InFlight.Unhealthy <= opts.InFlight.Degraded {
+		opts.InFlight.Unhealthy = math.Max(defaultInFlightUnhealthy, opts.InFlight.Degraded)
+	}
+
+	if opts.ErrorRate.Degraded <= 0 {
+		opts.ErrorRate.Degraded = defaultErrorRateDegraded
+	}
+
+	if opts.ErrorRate.Unhealthy <= opts.ErrorRate.Degraded {
+		opts.ErrorRate.Unhealthy = math.Max(defaultErrorRateUnhealthy, opts.ErrorRate.Degraded)
+	}
+
+	if opts.ErrorRate.MinRequests == 0 {
+		opts.ErrorRate.MinRequests = defaultSignalMinRequests
+	}
+
+	d := &Degradation{
+		opts:    opts,
+		log:     log,
+		slot:    opts.Window / degradationSlots,
+		signals: map[string]ReadinessState{},
+		state:   ReadinessHealthy,
+		score:   1,
+	}
+
+	if d.slot <= 0 {
+		d.slot = 1
+	}
+
+	return d
+}
+
+// Observe records a completed request, failed if it was answered with a 5xx. The server's routers observe their
+// requests if UseReadinessDegradation is set
+func (d *Degradation) Observe(latency time.Duration, failed bool) {
+	epoch := d.opts.Now().UnixNano() / int64(d.slot)
+
+	d.windowLock.Lock()
+	defer d.windowLock.Unlock()
+
+	slot := &d.slots[epoch%degradationSlots]
+	if slot.epoch != epoch {
+		*slot = degradationSlot{epoch: epoch}
+	}
+
+	slot.latency.Observe(latency)
+	slot.requests++
+
+	if failed {
+		slot.failures++
+	}
+}
+
+// OnChange adds a function that is called whenever the score or state changes
+func (d *Degradation) OnChange(fn func(DegradationChanged)) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.onChange = append(d.onChange, fn)
+}
+
+// Evaluate grades the signals, reporting and logging a change of score or state. It is called for every report of
+// a Health using the Degradation, and by Run
+func (d *Degradation) Evaluate() DegradationReport {
+	latency, requests, failures := d.window()
+
+	d.lock.Lock()
+
+	report := DegradationReport{State: ReadinessHealthy, Score: 1, Signals: []SignalReport{}}
+
+	grade := func(name string, value, degraded, unhealthy float64) {
+		signal := SignalReport{Name: name, Value: value, Degraded: degraded, Unhealthy: unhealthy}
+		signal.State, signal.Score = gradeSignal(value, degraded, unhealthy, d.opts.Hysteresis, d.signals[name])
+
+		d.signals[name] = signal.State
+
+		report.Signals = append(report.Signals, signal)
+		report.Score = math.Min(report.Score, signal.Score)
+
+		if worse(signal.State, report.State) {
+			report.State = signal.State
+		}
+	}
+
+	if o := d.opts.Latency; o.Enabled {
+		var value time.Duration
+		if requests >= o.MinRequests {
+			value = latency.Quantile(o.Quantile)
+		}
+
+		grade(LatencySignalName, milliseconds(value), milliseconds(o.Degraded), milliseconds(o.Unhealthy))
+	}
+
+	if o := d.opts.InFlight; o.Enabled && o.Limit > 0 {
+		current := atomic.LoadInt64(&d.inFlight)
+		if o.Current != nil {
+			current = o.Current()
+		}
+
+		limit := float64(o.Limit)
+
+		grade(InFlightSignalName, float64(current), o.Degraded*limit, o.Unhealthy*limit)
+	}
+
+	if o := d.opts.ErrorRate; o.Enabled {
+		var rate float64
+		if requests >= o.MinRequests {
+			rate = float64(failures) / float64(requests)
+		}
+
+		grade(ErrorRateSignalName, rate, o.Degraded, o.Unhealthy)
+	}
+
+	report.Status = d.status(report.State)
+
+	change := DegradationChanged{From: d.state, To: report.State, PreviousScore: d.score, Score: report.Score, Signals: report.Signals}
+	changed := change.From != change.To || change.PreviousScore != change.Score
+
+	d.state, d.score = report.State, report.Score
+	observers := d.onChange
+
+	d.lock.Unlock()
+
+	if changed {
+		d.logChange(change)
+
+		for _, fn := range observers {
+			fn(change)
+		}
+	}
+
+	return report
+}
+
+// Run evaluates the signals every interval until ctx is done, so that changes are reported even if the readiness
+// endpoint isn't being probed
+func (d *Degradation) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			d.Evaluate()
+		}
+	}
+}
+
+// RegisterAdmin mounts GET /degradation on the admin router, reporting the graded signals
+func (d *Degradation) RegisterAdmin(r *Router) {
+	r.GET("/degradation", func(w http.ResponseWriter, _ *http.Request, ctx *Ctx) error {
+		return RespondJSON(ctx.Context, w, d.Evaluate(), http.StatusOK)
+	})
+}
+
+// window returns the latencies, requests and failures of the slots within the window
+func (d *Degradation) window() (*LatencyHistogram, uint64, uint64) {
+	current := d.opts.Now().UnixNano() / int64(d.slot)
+
+	latency := &LatencyHistogram{}
+
+	var requests, failures uint64
+
+	d.windowLock.Lock()
+	defer d.windowLock.Unlock()
+
+	for i := range d.slots {
+		slot := &d.slots[i]
+		if slot.requests == 0 || slot.epoch <= current-degradationSlots || slot.epoch > current {
+			continue
+		}
+
+		latency.merge(&slot.latency)
+		requests += slot.requests
+		failures += slot.failures
+	}
+
+	return latency, requests, failures
+}
+
+// status returns the readiness endpoint's status for state
+func (d *Degradation) status(state ReadinessState) int {
+	switch state {
+	case ReadinessDegraded:
+		return d.opts.DegradedStatus
+	case ReadinessUnhealthy:
+		return d.opts.UnhealthyStatus
+	}
+
+	return d.opts.HealthyStatus
+}
+
+func (d *Degradation) logChange(change DegradationChanged) {
+	if d.log == nil {
+		return
+	}
+
+	var signals []string
+	for _, s := range change.Signals {
+		if s.State != ReadinessHealthy {
+			signals = append(signals, fmt.Sprintf("%s %s (%g)", s.Name, s.State, s.Value))
+		}
+	}
+
+	msg := fmt.Sprintf("readiness %s, score %g (was %s, %g)", change.To, change.Score, change.From, change.PreviousScore)
+	if len(signals) > 0 {
+		msg += ": " + strings.Join(signals, ", ")
+	}
+
+	if worse(change.To, change.From) {
+		d.log.Warn(msg)
+		return
+	}
+
+	d.log.Info(msg)
+}
+
+// begin counts a request being handled, returning the time it started
+func (d *Degradation) begin() time.Time {
+	atomic.AddInt64(&d.inFlight, 1)
+
+	return d.opts.Now()
+}
+
+// observeRequest records a request handled by a router once its response has been written. Streamed responses
+// and websockets aren't observed, as their latencies are those of the client's session
+func (d *Degradation) observeRequest(start time.Time, w http.ResponseWriter, ctx *Ctx) {
+	atomic.AddInt64(&d.inFlight, -1)
+
+	if ctx.IsWebSocketUpgrade() || isStreamingResponse(w.Header()) {
+		return
+	}
+
+	status := http.StatusOK
+	if ctx.summary != nil {
+		if started := ctx.summary.responseStatus(); started != 0 {
+			status = started
+		}
+	}
+
+	d.Observe(d.opts.Now().Sub(start), status >= http.StatusInternalServerError)
+}
+
+// gradeSignal returns the state and score of a signal's value. A signal only improves once its value falls below the
+// threshold it crossed by the hysteresis fraction. A degraded signal's score falls from 1 to 0 between its thresholds
+func gradeSignal(value, degraded, unhealthy, hysteresis float64, previous ReadinessState) (ReadinessState, float64) {
+	enterUnhealthy := unhealthy
+	if previous == ReadinessUnhealthy {
+		enterUnhealthy *= 1 - hysteresis
+	}
+
+	enterDegraded := degraded
+	if previous == ReadinessDegraded || previous == ReadinessUnhealthy {
+		enterDegraded *= 1 - hysteresis
+	}
+
+	switch {
+	case value >= enterUnhealthy:
+		return ReadinessUnhealthy, 0
+	case value >= enterDegraded:
+		score := 1 - (value-degraded)/(unhealthy-degraded)
+
+		// a degraded signal never scores as a healthy or an unhealthy one
+		return ReadinessDegraded, math.Max(0.01, math.Min(0.99, math.Round(score*100)/100))
+	}
+
+	return ReadinessHealthy, 1
+}
+
+// readinessRanks orders the readiness states from best to worst
+var readinessRanks = map[ReadinessState]int{ReadinessHealthy: 0, ReadinessDegraded: 1, ReadinessUnhealthy: 2}
+
+// worse returns true if state a is worse than state b
+func worse(a, b ReadinessState) bool {
+	return readinessRanks[a] > readinessRanks[b]
+}
+
+func milliseconds(d time.Duration) float64 {
+	return math.Round(float64(d)/float64(time.Microsecond)) / 1000
+}
+
+// newServerDegradation creates the Degradation set with UseReadinessDegradation, limiting the in-flight signal to the
+// server's concurrency cap unless the options set a limit
+func newServerDegradation(o *Options) *Degradation {
+	opts := *o.Degradation
+	if opts.InFlight.Limit == 0 {
+		opts.InFlight.Limit = int64(o.RateLimit.MaxConcurrent)
+	}
+
+	return NewDegradation(opts, o.Logger)
+}
+
+// useDegradation sets the Degradation that observes the router's requests
+func (rt *Router) useDegradation(d *Degradation) {
+	rt.degradation = d
+}
+
+// Degradation returns the server's Degradation, which is nil unless UseReadinessDegradation is set. Give it to the
+// Health serving the readiness endpoint with HealthOptions.Degradation
+func (s *Server) Degradation() *Degradation {
+	return s.degradation
+}
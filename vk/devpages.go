@@ -0,0 +1,510 @@
+package vk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"html/template"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	devReplayPrefix      = "/__vk/replay/"
+	devReplayHeader      = "X-Vk-Replay"
+	maxDevCaptures       = 16
+	maxDevCaptureBody    = 64 << 10
+	devRedactedValue     = "[redacted]"
+	devErrorPageMimeType = "text/html"
+)
+
+// devRedactedHeaders are the request headers whose values the dev error page doesn't show
+var devRedactedHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"X-Api-Key",
+	"X-Auth-Token",
+}
+
+// devRedactedFields are the substrings of JSON object keys whose values the dev error page doesn't show
+var devRedactedFields = []string{"password", "secret", "token", "apikey", "api_key"}
+
+type devCaptureKey struct{}
+
+// devCapture records a request handled in dev mode, so that a 500 can be rendered as an error page (see
+// serveDevErrorPage) and the request replayed through the router from it
+type devCapture struct {
+	lock sync.Mutex
+
+	ctx     *Ctx
+	id      string // the request's ID, set when the capture is kept
+	method  string
+	url     string
+	header  http.Header
+	body    *bytes.Buffer
+	source  io.ReadCloser // the request's body, read into body for replay
+	started time.Time
+	layers  []devLayer
+
+	captures *devCaptures // kept in if the request is rendered as an error page
+
+	panicType    string
+	panicMessage string
+	stack        string
+	err          string
+}
+
+// devLayer is the timing of a layer of the route's chain, see chainLink.serve
+type devLayer struct {
+	Name     string
+	Depth    int
+	Duration time.Duration
+	Returned bool // false if the layer panicked
+}
+
+// devCapturingBody copies what is read of a request's body into its capture, up to maxDevCaptureBody
+type devCapturingBody struct {
+	io.ReadCloser
+	capture *devCapture
+}
+
+func (b *devCapturingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.capture.keep(p[:n])
+
+	return n, err
+}
+
+// useDevCapture starts recording r in dev mode, returning the request to handle
+func (rt *Router) useDevCapture(r *http.Request, ctx *Ctx) *http.Request {
+	capture := &devCapture{
+		ctx:     ctx,
+		method:  r.Method,
+		url:     r.URL.RequestURI(),
+		header:  r.Header.Clone(),
+		body:    &bytes.Buffer{},
+		started: time.Now(),
+
+		captures: rt.devCaptures,
+	}
+
+	if r.Body != nil && r.Body != http.NoBody {
+		capture.source = r.Body
+		r.Body = &devCapturingBody{ReadCloser: r.Body, capture: capture}
+	}
+
+	ctx.devCapture = capture
+
+	return r.WithContext(context.WithValue(r.Context(), devCaptureKey{}, capture))
+}
+
+// keep appends p to the captured body, up to one byte over the limit so that truncation can be detected
+func (c *devCapture) keep(p []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if room := maxDevCaptureBody + 1 - c.body.Len(); room > 0 {
+		if len(p) > room {
+			p = p[:room]
+		}
+
+		c.body.Write(p)
+	}
+}
+
+// enter records the start of a layer of the chain, returning the function that records its end
+func (c *devCapture) enter(name string) func(returned *bool) {
+	start := time.Now()
+
+	c.lock.Lock()
+	depth := 0
+	for _, l := range c.layers {
+		if l.Duration < 0 {
+			depth++
+		}
+	}
+
+	i := len(c.layers)
+	c.layers = append(c.layers, devLayer{Name: name, Depth: depth, Duration: -1})
+	c.lock.Unlock()
+
+	return func(returned *bool) {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+
+		c.layers[i].Duration = time.Since(start)
+		c.layers[i].Returned = *returned
+	}
+}
+
+// panicked records the panic recovered for the request
+func (c *devCapture) panicked(report PanicReport) {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.panicType, c.panicMessage, c.stack = report.Type, report.Message, report.Stack
+}
+
+// failed records the error returned for the request
+func (c *devCapture) failed(err error) {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.err = err.Error()
+}
+
+// truncated returns true if the body was too large to be captured in full, in which case it can't be replayed
+func (c *devCapture) truncated() bool {
+	return c.body.Len() > maxDevCaptureBody
+}
+
+// finish reads what the handler left of the body, so that the request can be replayed
+func (c *devCapture) finish() {
+	if c.source != nil {
+		_, _ = io.Copy(io.Discard, &devCapturingBody{ReadCloser: io.NopCloser(io.LimitReader(c.source, maxDevCaptureBody+1)), capture: c})
+		c.source = nil
+	}
+}
+
+// devCaptures keeps the most recent captures that were rendered as error pages, for them to be replayed
+type devCaptures struct {
+	lock     sync.Mutex
+	captures [maxDevCaptures]*devCapture
+	next     int
+}
+
+func (d *devCaptures) add(c *devCapture) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.captures[d.next] = c
+	d.next = (d.next + 1) % maxDevCaptures
+}
+
+func (d *devCaptures) find(id string) *devCapture {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	for _, c := range d.captures {
+		if c != nil && c.id == id {
+			return c
+		}
+	}
+
+	return nil
+}
+
+// wantsDevErrorPage returns true if r comes from a browser, which lists text/html in its Accept header
+func wantsDevErrorPage(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, part := range strings.Split(accept, ",") {
+			mime := strings.TrimSpace(strings.SplitN(part, ";", 2)[0])
+			if strings.EqualFold(mime, devErrorPageMimeType) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// serveDevErrorPage renders err as an HTML error page if r was captured in dev mode (see UseDevMode), err is a 500,
+// and the client is a browser, returning false for the error to be formatted as usual otherwise
+func serveDevErrorPage(w http.ResponseWriter, r *http.Request, err Error) bool {
+	if r == nil || err.Status() != http.StatusInternalServerError || !wantsDevErrorPage(r) {
+		return false
+	}
+
+	capture, ok := r.Context().Value(devCaptureKey{}).(*devCapture)
+	if !ok || capture.captures == nil {
+		return false
+	}
+
+	capture.finish()
+	capture.id = capture.ctx.RequestID()
+	capture.captures.add(capture)
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+
+	if execErr := devErrorPage.Execute(buf, capture.page(err)); execErr != nil {
+		return false
+	}
+
+	w.Header().Set(contentTypeHeaderKey, "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(err.Status())
+	_, _ = w.Write(buf.Bytes())
+
+	return true
+}
+
+// serveDevReplay re-dispatches a captured request through the router, if r asks for one in dev mode
+func (rt *Router) serveDevReplay(w http.ResponseWriter, r *http.Request) bool {
+	if !rt.devMode || rt.devCaptures == nil || !strings.HasPrefix(r.URL.Path, devReplayPrefix) {
+		return false
+	}
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		respondError(w, r, DefaultErrorFormatter, E(http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed)))
+		return true
+	}
+
+	capture := rt.devCaptures.find(strings.TrimPrefix(r.URL.Path, devReplayPrefix))
+	if capture == nil {
+		respondError(w, r, DefaultErrorFormatter, E(http.StatusNotFound, "the request is no longer captured"))
+		return true
+	}
+
+	if capture.truncated() {
+		respondError(w, r, DefaultErrorFormatter, E(http.StatusUnprocessableEntity, "the request's body was too large to capture"))
+		return true
+	}
+
+	replay, err := http.NewRequestWithContext(r.Context(), capture.method, capture.url, bytes.NewReader(capture.body.Bytes()))
+	if err != nil {
+		respondError(w, r, DefaultErrorFormatter, E(http.StatusInternalServerError, err.Error()))
+		return true
+	}
+
+	replay.Header = capture.header.Clone()
+	replay.Header.Set(devReplayHeader, capture.id)
+	replay.Host = r.Host
+	replay.RemoteAddr = r.RemoteAddr
+	replay.TLS = r.TLS
+
+	rt.log.Debug("replaying request", capture.id, capture.method, capture.url)
+
+	rt.ServeHTTP(w, replay)
+
+	return true
+}
+
+// useDevCaptures keeps the captures of the error pages rendered in dev mode
+func (rt *Router) useDevCaptures(dev bool) {
+	if dev && rt.devCaptures == nil {
+		rt.devCaptures = &devCaptures{}
+	}
+}
+
+// devPage is the data of devErrorPage
+type devPage struct {
+	Status     int
+	StatusText string
+	Message    string
+	Method     string
+	URL        string
+	RequestID  string
+	Error      string
+	PanicType  string
+	Panic      string
+	Stack      string
+	Headers    [][2]string
+	Body       string
+	Truncated  bool
+	Layers     []devPageLayer
+	ReplayPath string
+	Replayed   string
+	Elapsed    string
+}
+
+type devPageLayer struct {
+	Name     string
+	Indent   int
+	Duration string
+	Panicked bool
+}
+
+func (c *devCapture) page(err Error) devPage {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	page := devPage{
+		Status:     err.Status(),
+		StatusText: http.StatusText(err.Status()),
+		Message:    err.Message(),
+		Method:     c.method,
+		URL:        c.url,
+		RequestID:  c.id,
+		Error:      c.err,
+		PanicType:  c.panicType,
+		Panic:      c.panicMessage,
+		Stack:      c.stack,
+		Headers:    redactDevHeaders(c.header),
+		Truncated:  c.truncated(),
+		ReplayPath: devReplayPrefix + c.id,
+		Replayed:   c.header.Get(devReplayHeader),
+		Elapsed:    time.Since(c.started).Round(time.Microsecond).String(),
+	}
+
+	body := c.body.Bytes()
+	if page.Truncated {
+		body = body[:maxDevCaptureBody]
+	}
+
+	page.Body = redactDevBody(body)
+
+	for _, l := range c.layers {
+		layer := devPageLayer{Name: l.Name, Indent: l.Depth * 16, Duration: "running", Panicked: !l.Returned && l.Duration >= 0}
+		if l.Duration >= 0 {
+			layer.Duration = l.Duration.Round(time.Microsecond).String()
+		}
+
+		page.Layers = append(page.Layers, layer)
+	}
+
+	return page
+}
+
+// redactDevHeaders returns the headers sorted by name, with the values of devRedactedHeaders replaced
+func redactDevHeaders(h http.Header) [][2]string {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		if name != devReplayHeader {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	headers := make([][2]string, 0, len(names))
+	for _, name := range names {
+		value := strings.Join(h[name], ", ")
+
+		for _, redacted := range devRedactedHeaders {
+			if strings.EqualFold(name, redacted) {
+				value = devRedactedValue
+			}
+		}
+
+		headers = append(headers, [2]string{name, value})
+	}
+
+	return headers
+}
+
+// redactDevBody returns body with the values of the devRedactedFields of JSON objects replaced, or as it is if it
+// isn't JSON
+func redactDevBody(body []byte) string {
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return string(body)
+	}
+
+	redacted, err := json.MarshalIndent(redactDevValue(v), "", "  ")
+	if err != nil {
+		return string(body)
+	}
+
+	return string(redacted)
+}
+
+func redactDevValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for key, field := range val {
+			if isDevRedactedField(key) {
+				val[key] = devRedactedValue
+			} else {
+				val[key] = redactDevValue(field)
+			}
+		}
+	case []interface{}:
+		for i := range val {
+			val[i] = redactDevValue(val[i])
+		}
+	}
+
+	return v
+}
+
+func isDevRedactedField(key string) bool {
+	key = strings.ToLower(key)
+
+	for _, field := range devRedactedFields {
+		if strings.Contains(key, field) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// devErrorPage is self-contained, so that it renders without loading anything from the network
+var devErrorPage = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Status}} {{.StatusText}}: {{.Method}} {{.URL}}</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; margin: 0; color: #222; background: #fafafa; }
+header { background: #b3261e; color: #fff; padding: 16px 24px; }
+header h1 { margin: 0; font-size: 20px; }
+header p { margin: 4px 0 0; opacity: 0.85; }
+section { background: #fff; margin: 16px 24px; padding: 12px 16px; border: 1px solid #ddd; border-radius: 4px; }
+h2 { font-size: 15px; margin: 0 0 8px; }
+pre { font-family: Menlo, Consolas, monospace; font-size: 12px; white-space: pre-wrap; word-break: break-all; margin: 0; }
+table { border-collapse: collapse; font-family: Menlo, Consolas, monospace; font-size: 12px; }
+td { padding: 2px 12px 2px 0; vertical-align: top; }
+.panicked { color: #b3261e; font-weight: bold; }
+.muted { color: #777; }
+button { font-size: 14px; padding: 6px 14px; }
+</style>
+</head>
+<body>
+<header>
+<h1>{{.Status}} {{.StatusText}}</h1>
+<p>{{.Method}} {{.URL}} &middot; request {{.RequestID}} &middot; {{.Elapsed}}{{if .Replayed}} &middot; replay of {{.Replayed}}{{end}}</p>
+</header>
+{{if .Panic}}<section>
+<h2>panic: {{.PanicType}}</h2>
+<pre>{{.Panic}}</pre>
+</section>
+<section>
+<h2>Stack</h2>
+<pre>{{.Stack}}</pre>
+</section>
+{{else}}<section>
+<h2>Error</h2>
+<pre>{{if .Error}}{{.Error}}{{else}}{{.Message}}{{end}}</pre>
+</section>
+{{end}}<section>
+<h2>Middleware chain</h2>
+{{if .Layers}}<table>
+{{range .Layers}}<tr><td style="padding-left: {{.Indent}}px"{{if .Panicked}} class="panicked"{{end}}>{{.Name}}</td><td>{{.Duration}}{{if .Panicked}} (panicked){{end}}</td></tr>
+{{end}}</table>{{else}}<p class="muted">the route has no named layers</p>{{end}}
+</section>
+<section>
+<h2>Request headers</h2>
+<table>
+{{range .Headers}}<tr><td>{{index . 0}}</td><td>{{index . 1}}</td></tr>
+{{end}}</table>
+</section>
+<section>
+<h2>Request body</h2>
+{{if .Body}}<pre>{{.Body}}</pre>{{else}}<p class="muted">empty</p>{{end}}
+{{if .Truncated}}<p class="muted">the body was truncated, so the request can't be replayed</p>{{end}}
+</section>
+<section>
+<form method="post" action="{{.ReplayPath}}">
+<button type="submit"{{if .Truncated}} disabled{{end}}>Replay request</button>
+<span class="muted">re-dispatches the captured request through the router</span>
+</form>
+</section>
+</body>
+</html>
+`))
@@ -0,0 +1,252 @@
+package vk
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultDomain is the isolation domain of routes whose groups don't set one with Domain
+const DefaultDomain = "default"
+
+// DomainStats counts the requests handled by the routes of an isolation domain, and the errors and panics among them
+type DomainStats struct {
+	Requests uint64 `json:"requests"`
+	Errors   uint64 `json:"errors"`
+	Panics   uint64 `json:"panics"`
+}
+
+// DomainError describes an error returned by a route of an isolation domain, see IsolationDomain.OnError
+type DomainError struct {
+	Domain    string
+	Method    string
+	Route     string // the route that matched the request, i.e. /users/:id
+	RequestID string
+	Status    int // the status of the error's response, 500 for errors that aren't a vk.Error
+	Err       error
+}
+
+// IsolationDomain separates the failures of a set of routes, such as those of an embedded plugin, from the rest of
+// the router's: their errors and panics are counted in its own stats and reported to its own observers, and its
+// panics are tracked by its own Panics rather than the router's, so they never reach the router's OnNewPanic or
+// OnPanicSummary hooks. Routes join a domain through their groups, see RouteGroup.Domain
+type IsolationDomain struct {
+	name   string
+	panics *Panics
+
+	requests uint64
+	errors   uint64
+	panicked uint64
+
+	lock    sync.RWMutex
+	onError []func(DomainError)
+	onPanic []func(PanicReport)
+}
+
+// isolationDomains are the isolation domains of a Router, by name
+type isolationDomains struct {
+	lock    sync.Mutex
+	domains map[string]*IsolationDomain
+}
+
+func newIsolationDomains(panics *Panics) *isolationDomains {
+	d := &isolationDomains{
+		domains: map[string]*IsolationDomain{
+			// the default domain's panics are the router's
+			DefaultDomain: {name: DefaultDomain, panics: panics},
+		},
+	}
+
+	return d
+}
+
+// get returns the domain with the given name, creating it if it doesn't exist yet
+func (d *isolationDomains) get(name string) *IsolationDomain {
+	if name == "" {
+		name = DefaultDomain
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	domain, ok := d.domains[name]
+	if !ok {
+		domain = &IsolationDomain{name: name, panics: newPanics()}
+		d.domains[name] = domain
+	}
+
+	return domain
+}
+
+// Domain places the group's routes, including those of its subgroups, in the named isolation domain, unless a
+// subgroup sets its own. Observers and stats of the domain are found with Router.IsolationDomain
+func (g *RouteGroup) Domain(name string) *RouteGroup {
+	g.domain = name
+
+	return g
+}
+
+// IsolationDomain returns the named isolation domain of the router's routes, which exists even before any group
+// sets it, so that its observers can be registered up front. DefaultDomain is that of routes that don't set one
+func (rt *Router) IsolationDomain(name string) *IsolationDomain {
+	return rt.domains.get(name)
+}
+
+// DomainStats returns the stats of each of the router's isolation domains, by name
+func (rt *Router) DomainStats() map[string]DomainStats {
+	rt.domains.lock.Lock()
+	defer rt.domains.lock.Unlock()
+
+	stats := make(map[string]DomainStats, len(rt.domains.domains))
+	for name, d := range rt.domains.domains {
+		stats[name] = d.Stats()
+	}
+
+	return stats
+}
+
+// IsolationDomain returns the named isolation domain of the server's router, see Router.IsolationDomain
+func (s *Server) IsolationDomain(name string) *IsolationDomain {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.internalRouter.IsolationDomain(name)
+}
+
+// DomainStats returns the stats of each of the isolation domains of the server's router, by name
+func (s *Server) DomainStats() map[string]DomainStats {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.internalRouter.DomainStats()
+}
+
+// Name returns the domain's name
+func (d *IsolationDomain) Name() string {
+	return d.name
+}
+
+// OnError adds a function that is called with each error returned by the domain's routes
+func (d *IsolationDomain) OnError(fn func(DomainError)) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.onError = append(d.onError, fn)
+}
+
+// OnPanic adds a function that is called with the report of each panic recovered from the domain's routes
+func (d *IsolationDomain) OnPanic(fn func(PanicReport)) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.onPanic = append(d.onPanic, fn)
+}
+
+// Panics returns the domain's panic tracker, which is the router's for DefaultDomain
+func (d *IsolationDomain) Panics() *Panics {
+	return d.panics
+}
+
+// Stats returns the domain's counters
+func (d *IsolationDomain) Stats() DomainStats {
+	stats := DomainStats{
+		Requests: atomic.LoadUint64(&d.requests),
+		Errors:   atomic.LoadUint64(&d.errors),
+		Panics:   atomic.LoadUint64(&d.panicked),
+	}
+
+	return stats
+}
+
+// failed counts an error returned by one of the domain's routes and reports it to the domain's observers
+func (d *IsolationDomain) failed(ctx *Ctx, r *http.Request, err error) {
+	if d == nil {
+		return
+	}
+
+	atomic.AddUint64(&d.errors, 1)
+
+	d.lock.RLock()
+	observers := d.onError
+	d.lock.RUnlock()
+
+	if len(observers) == 0 {
+		return
+	}
+
+	status := http.StatusInternalServerError
+	if e, ok := err.(Error); ok {
+		status = e.Status()
+	}
+
+	report := DomainError{
+		Domain:    d.name,
+		Method:    r.Method,
+		Route:     ctx.route,
+		RequestID: ctx.RequestID(),
+		Status:    status,
+		Err:       err,
+	}
+
+	for _, fn := range observers {
+		fn(report)
+	}
+}
+
+// recordPanic tracks a panic recovered from one of the domain's routes and reports it to the domain's observers,
+// returning its report and whether its fingerprint is new to the domain
+func (d *IsolationDomain) recordPanic(value interface{}, stack []byte) (PanicReport, bool) {
+	report, isNew := d.panics.record(value, stack)
+
+	atomic.AddUint64(&d.panicked, 1)
+
+	d.lock.RLock()
+	observers := d.onPanic
+	d.lock.RUnlock()
+
+	for _, fn := range observers {
+		fn(report)
+	}
+
+	return report, isNew
+}
+
+// routeDomain returns the domain set by the route's innermost group that sets one, or DefaultDomain
+func routeDomain(r httpRouteHandler) string {
+	for _, g := range r.groups {
+		if g.domain != "" {
+			return g.domain
+		}
+	}
+
+	return DefaultDomain
+}
+
+// withDomain returns inner, counting its requests in domain and placing them in it
+func withDomain(domain *IsolationDomain, inner HandlerFunc) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, ctx *Ctx) error {
+		atomic.AddUint64(&domain.requests, 1)
+
+		ctx.domain = domain
+
+		return inner(w, r, ctx)
+	}
+}
+
+// Domain returns the name of the isolation domain of the request's route, DefaultDomain if its groups don't set one
+func (c *Ctx) Domain() string {
+	if c == nil || c.domain == nil {
+		return DefaultDomain
+	}
+
+	return c.domain.name
+}
+
+// domainLabel returns a suffix naming the request's domain for its log lines, or nothing for DefaultDomain
+func (c *Ctx) domainLabel() string {
+	if c == nil || c.domain == nil || c.domain.name == DefaultDomain {
+		return ""
+	}
+
+	return ", domain: " + c.domain.name
+}
@@ -0,0 +1,227 @@
+package vk
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// doubleResponseLogInterval is how often a route's double responses are logged outside of dev mode
+	doubleResponseLogInterval = time.Hour
+
+	// callSiteDepth is how many frames of the code that started a response are recorded
+	callSiteDepth = 8
+)
+
+// DoubleResponseError describes a second response attempted for a request whose response had already started, such
+// as by a handler that writes to the ResponseWriter and then also returns a response, or by a middleware that
+// responds and then calls the next handler anyway. In dev mode (see UseDevMode) it is panicked with, so that the bug
+// can't be missed
+type DoubleResponseError struct {
+	Method string
+	Route  string
+	First  []string // the frames of the code that started the response, only recorded in dev mode
+	Second []string // the frames of the code that attempted the second response
+}
+
+func (e DoubleResponseError) Error() string {
+	first := "unknown, recorded in dev mode only"
+	if len(e.First) > 0 {
+		first = "\n\t" + strings.Join(e.First, "\n\t")
+	}
+
+	return fmt.Sprintf("[vk] double response for %s %s, the second one was dropped\nfirst response: %s\nsecond response:\n\t%s",
+		e.Method, e.Route, first, strings.Join(e.Second, "\n\t"))
+}
+
+// DoubleResponses returns the number of second responses that were dropped, see DoubleResponseError
+func (rt *Router) DoubleResponses() uint64 {
+	return atomic.LoadUint64(&rt.doubles.count)
+}
+
+// DoubleResponses returns the number of second responses dropped by the server's router, see Router.DoubleResponses
+func (s *Server) DoubleResponses() uint64 {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.internalRouter.DoubleResponses()
+}
+
+// doubleResponses counts double responses, and limits how often each route's are logged
+type doubleResponses struct {
+	count  uint64
+	lock   sync.Mutex
+	logged map[string]time.Time // when each route's double responses were last logged
+}
+
+func newDoubleResponses() *doubleResponses {
+	return &doubleResponses{logged: map[string]time.Time{}}
+}
+
+// shouldLog returns true if the route's double responses haven't been logged within the last interval
+func (d *doubleResponses) shouldLog(route string, now time.Time) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if last, ok := d.logged[route]; ok && now.Sub(last) < doubleResponseLogInterval {
+		return false
+	}
+
+	d.logged[route] = now
+
+	return true
+}
+
+// responseGuard lets a request have a single response. Once its response has started, another call to WriteHeader
+// is a second response: it is reported, and it and everything written after it are dropped. In dev mode, the call
+// site of the first response is recorded so that both can be reported, and the second response panics
+type responseGuard struct {
+	http.ResponseWriter
+	rt         *Router
+	r          *http.Request
+	ctx        *Ctx
+	started    bool
+	first      []string
+	discarding bool
+}
+
+func (rg *responseGuard) WriteHeader(status int) {
+	if rg.discarding {
+		return
+	}
+
+	// informational responses precede the actual one
+	if status < http.StatusOK {
+		rg.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	if rg.started {
+		rg.double()
+		return
+	}
+
+	rg.start()
+	rg.ResponseWriter.WriteHeader(status)
+}
+
+func (rg *responseGuard) Write(b []byte) (int, error) {
+	if rg.discarding {
+		return len(b), nil
+	}
+
+	started := rg.started
+	rg.start()
+
+	n, err := rg.ResponseWriter.Write(b)
+
+	// a refused write, such as one beyond the maximum response size, doesn't start the response, so that the error
+	// response replacing it isn't a second one
+	if n == 0 && err != nil && !started {
+		rg.started = false
+		rg.first = nil
+	}
+
+	return n, err
+}
+
+// ReadFrom copies from src using the underlying ResponseWriter's ReadFrom if it has one, see readFrom
+func (rg *responseGuard) ReadFrom(src io.Reader) (int64, error) {
+	if rg.discarding {
+		return io.Copy(io.Discard, src)
+	}
+
+	rg.start()
+
+	return readFrom(rg.ResponseWriter, src)
+}
+
+// Flush flushes the underlying ResponseWriter if it supports flushing
+func (rg *responseGuard) Flush() {
+	if rg.discarding {
+		return
+	}
+
+	rg.start()
+
+	if f, ok := rg.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack hijacks the underlying ResponseWriter's connection, after which the handler is responsible for the response
+func (rg *responseGuard) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := rg.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("ResponseWriter does not implement http.Hijacker")
+	}
+
+	rg.start()
+
+	return h.Hijack()
+}
+
+// start records that the response has started, and where from in dev mode
+func (rg *responseGuard) start() {
+	if rg.started {
+		return
+	}
+
+	rg.started = true
+
+	if rg.rt.devMode {
+		rg.first = callSite()
+	}
+}
+
+// double reports a second response and discards it, panicking in dev mode
+func (rg *responseGuard) double() {
+	rg.discarding = true
+
+	atomic.AddUint64(&rg.rt.doubles.count, 1)
+
+	err := DoubleResponseError{Method: rg.r.Method, Route: rg.ctx.route, First: rg.first, Second: callSite()}
+
+	if rg.rt.devMode {
+		rg.ctx.Log.Error(err)
+		panic(err)
+	}
+
+	if rg.rt.doubles.shouldLog(rg.r.Method+" "+rg.ctx.route, time.Now()) {
+		rg.ctx.Log.Error(err)
+	}
+}
+
+// callSite returns the frames of the calling goroutine's stack that are outside of vk and the standard library,
+// formatted as function (file:line)
+func callSite() []string {
+	pcs := make([]uintptr, 64)
+	n := runtime.Callers(2, pcs)
+
+	frames := runtime.CallersFrames(pcs[:n])
+	found := make([]string, 0, callSiteDepth)
+
+	for len(found) < callSiteDepth {
+		frame, more := frames.Next()
+
+		if frame.Function != "" && !isStdlibFunction(frame.Function) && !strings.HasPrefix(frame.Function, vkPackagePrefix) {
+			found = append(found, fmt.Sprintf("%s (%s:%d)", frame.Function, frame.File, frame.Line))
+		}
+
+		if !more {
+			break
+		}
+	}
+
+	return found
+}
@@ -0,0 +1,351 @@
+package vk
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+)
+
+// the checks of a dry run, which name the problems they find, see DryRunProblem
+const (
+	DryRunOptions    = "options"
+	DryRunRoutes     = "routes"
+	DryRunMiddleware = "middleware"
+	DryRunAssets     = "assets"
+	DryRunTLS        = "tls"
+	DryRunGates      = "gates"
+	DryRunChecks     = "checks"
+)
+
+// DryRunProblem is a problem found by Server.DryRun
+type DryRunProblem struct {
+	Check   string `json:"check"`
+	Message string `json:"message"`
+}
+
+// DryRunReport is the outcome of Server.DryRun, which is logged as the scope of a single entry
+type DryRunReport struct {
+	Passed       bool            `json:"passed"`
+	Problems     []DryRunProblem `json:"problems"`
+	Routes       int             `json:"routes"`
+	GatesRun     []string        `json:"gates_run"`
+	GatesSkipped []string        `json:"gates_skipped"` // gates that don't support dry runs, see GateDryRun
+}
+
+// DryRunError is returned by Server.DryRun with every problem it found
+type DryRunError struct {
+	Report DryRunReport
+}
+
+func (e *DryRunError) Error() string {
+	problems := make([]string, len(e.Report.Problems))
+	for i, p := range e.Report.Problems {
+		problems[i] = p.Check + ": " + p.Message
+	}
+
+	return fmt.Sprintf("dry run found %d problems: %s", len(problems), strings.Join(problems, "; "))
+}
+
+// Problems returns the messages of the problems found by the given check
+func (e *DryRunError) Problems(check string) []string {
+	var messages []string
+
+	for _, p := range e.Report.Problems {
+		if p.Check == check {
+			messages = append(messages, p.Message)
+		}
+	}
+
+	return messages
+}
+
+type dryRunKey struct{}
+
+// IsDryRun returns true if ctx is that of a gate run by Server.DryRun, which should validate its configuration
+// (such as connecting to a database) without performing its side effects (such as running migrations)
+func IsDryRun(ctx context.Context) bool {
+	dryRun, _ := ctx.Value(dryRunKey{}).(bool)
+
+	return dryRun
+}
+
+// GateDryRun runs the gate during dry runs (see Server.DryRun), with a context for which IsDryRun is true. Gates
+// without it are skipped by dry runs
+func GateDryRun() GateOption {
+	return func(g *gate) {
+		g.dryRun = true
+	}
+}
+
+// dryRunCheck is a check added with DryRunCheck
+type dryRunCheck struct {
+	name string
+	fn   func() error
+}
+
+// dryRunChecks are the checks added to a server with DryRunCheck
+type dryRunChecks struct {
+	lock sync.Mutex
+	list []dryRunCheck
+}
+
+// DryRunCheck adds a check that DryRun runs, for anything the application would otherwise only find wrong when it
+// is first used, such as parsing the templates that its handlers render
+func (s *Server) DryRunCheck(name string, fn func() error) {
+	s.dryRunChecks.lock.Lock()
+	defer s.dryRunChecks.lock.Unlock()
+
+	s.dryRunChecks.list = append(s.dryRunChecks.list, dryRunCheck{name: name, fn: fn})
+}
+
+// DryRun performs the server's startup without binding any listeners or serving any requests, and returns a
+// DryRunError with every problem it finds, rather than only the first, so that a deployment pipeline can catch them
+// before a release: the options are validated, the routes are validated and mounted on a scratch router to detect
+// conflicts, every route's middleware chain is built and its Requires checked against the provided dependencies, the
+// fingerprinted Static mounts are hashed, the certificates of the certificate directory are loaded, and the gates
+// declared with GateDryRun and the checks added with DryRunCheck are run. The outcome is logged as a single entry
+// scoped with the DryRunReport. The server can still be started afterwards
+func (s *Server) DryRun() error {
+	report := DryRunReport{Problems: []DryRunProblem{}, GatesRun: []string{}, GatesSkipped: []string{}}
+
+	problem := func(check, format string, args ...interface{}) {
+		report.Problems = append(report.Problems, DryRunProblem{Check: check, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if err := s.options.Validate(); err != nil {
+		if optionsErr, ok := err.(OptionsError); ok {
+			for _, p := range optionsErr.Problems {
+				problem(DryRunOptions, "%s", p)
+			}
+		} else {
+			problem(DryRunOptions, "%s", err)
+		}
+	}
+
+	s.lock.RLock()
+	router := s.internalRouter
+	s.lock.RUnlock()
+
+	report.Routes = s.dryRunRoutes(router, problem)
+
+	for _, a := range router.assetMounts() {
+		if err := dryRunAssets(a); err != nil {
+			problem(DryRunAssets, "%s: %s", a.prefix, err)
+		}
+	}
+
+	if s.options.TLSConfig == nil && s.options.CertDir != "" {
+		for _, err := range dryRunCertDir(s.options.CertDir, time.Now()) {
+			problem(DryRunTLS, "%s", err)
+		}
+	}
+
+	ran, skipped, failed := s.gates.dryRun()
+	report.GatesRun = append(report.GatesRun, ran...)
+	report.GatesSkipped = append(report.GatesSkipped, skipped...)
+
+	for _, name := range ran {
+		if err, ok := failed[name]; ok {
+			problem(DryRunGates, "%s: %s", name, err)
+		}
+	}
+
+	s.dryRunChecks.lock.Lock()
+	checks := append([]dryRunCheck{}, s.dryRunChecks.list...)
+	s.dryRunChecks.lock.Unlock()
+
+	for _, c := range checks {
+		if err := recoverDryRun(c.fn); err != nil {
+			problem(DryRunChecks, "%s: %s", c.name, err)
+		}
+	}
+
+	report.Passed = len(report.Problems) == 0
+
+	log := s.options.Logger.CreateScoped(report)
+
+	if report.Passed {
+		log.Info("dry run passed,", report.Routes, "routes checked")
+		return nil
+	}
+
+	err := &DryRunError{Report: report}
+	log.ErrorString(err.Error())
+
+	return err
+}
+
+// dryRunRoutes validates the router's routes and mounts them on a scratch router, reporting their problems, and
+// returns the number of routes
+func (s *Server) dryRunRoutes(rt *Router, problem func(check, format string, args ...interface{})) int {
+	if rt.RouteGroup == nil {
+		return 0
+	}
+
+	// the routes of groups that aren't a tree can't be listed
+	if err := rt.validateGroups(); err != nil {
+		problem(DryRunRoutes, "%s", err)
+		return 0
+	}
+
+	routes := rt.RouteGroup.httpRouteHandlers()
+	scratch := httprouter.New()
+
+	for _, r := range routes {
+		// httprouter panics on a route that conflicts with one already mounted
+		if err := recoverDryRun(func() error {
+			scratch.Handle(r.Method, r.Path, func(http.ResponseWriter, *http.Request, httprouter.Params) {})
+			return nil
+		}); err != nil {
+			problem(DryRunRoutes, "%s %s: %s", r.Method, r.Path, err)
+			continue
+		}
+
+		var handler HandlerFunc
+
+		// middleware are otherwise applied on a route's first request
+		if err := recoverDryRun(func() error {
+			handler = r.wrapped()
+			return nil
+		}); err != nil {
+			problem(DryRunMiddleware, "%s %s: %s", r.Method, r.Path, err)
+			continue
+		}
+
+		if _, err := bodySpecOf(handler); err != nil {
+			problem(DryRunRoutes, "%s %s: %s", r.Method, r.Path, err)
+		}
+
+		for _, v := range chainValues(handler) {
+			if req, ok := v.(dependencyRequirement); ok {
+				if _, provided := s.dependencies.get(req.t); !provided {
+					problem(DryRunMiddleware, "%s %s: requires a dependency of type %s, which hasn't been provided", r.Method, r.Path, req.t)
+				}
+			}
+		}
+	}
+
+	return len(routes)
+}
+
+// dryRun runs the gates declared with GateDryRun, in order, returning the names of those it ran and skipped, and
+// the error of each that failed
+func (g *gates) dryRun() ([]string, []string, map[string]error) {
+	g.lock.Lock()
+	list := append([]gate{}, g.list...)
+	g.lock.Unlock()
+
+	ctx := context.WithValue(context.Background(), dryRunKey{}, true)
+
+	var ran, skipped []string
+
+	failed := map[string]error{}
+
+	for _, gt := range list {
+		if !gt.dryRun {
+			skipped = append(skipped, gt.name)
+			continue
+		}
+
+		ran = append(ran, gt.name)
+
+		if err := gt.run(ctx); err != nil {
+			failed[gt.name] = err
+		}
+	}
+
+	return ran, skipped, failed
+}
+
+// dryRunAssets checks that a fingerprinted Static mount can be read, and computes its hashes
+func dryRunAssets(a assetMount) error {
+	f, err := a.store.fs.Open("/")
+	if err != nil {
+		return errors.Wrap(err, "failed to Open")
+	}
+
+	f.Close()
+
+	a.store.manifest(a.prefix, map[string]string{})
+
+	return nil
+}
+
+// dryRunCertDir loads every certificate in dir as the server would, returning an error for each pair that fails to
+// load, or that has expired
+func dryRunCertDir(dir string, now time.Time) []error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return []error{errors.Wrapf(err, "failed to read certificate directory %s", dir)}
+	}
+
+	var errs []error
+
+	certs := 0
+
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".crt" {
+			continue
+		}
+
+		certs++
+
+		certFile := filepath.Join(dir, entry.Name())
+		keyFile := strings.TrimSuffix(certFile, ".crt") + ".key"
+
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			errs = append(errs, errors.Wrapf(err, "failed to load %s", entry.Name()))
+			continue
+		}
+
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			errs = append(errs, errors.Wrapf(err, "failed to parse %s", entry.Name()))
+			continue
+		}
+
+		if now.After(leaf.NotAfter) {
+			errs = append(errs, errors.Errorf("%s expired at %s", entry.Name(), leaf.NotAfter.Format(time.RFC3339)))
+		}
+	}
+
+	if certs == 0 {
+		errs = append(errs, errors.Errorf("certificate directory %s has no certificates", dir))
+	}
+
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+
+	return errs
+}
+
+// recoverDryRun calls fn, returning a panic as its error
+func recoverDryRun(fn func() error) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = errors.Errorf("panicked: %v", recovered)
+		}
+	}()
+
+	return fn()
+}
+
+// exitDryRun performs the dry run requested with the DRY_RUN option and exits, with 1 if it found any problems
+func (s *Server) exitDryRun() {
+	if err := s.DryRun(); err != nil {
+		os.Exit(1)
+	}
+
+	os.Exit(0)
+}
@@ -0,0 +1,138 @@
+package vk
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// ResponseEncoderFunc encodes the value passed to RespondJSON by the routes of a group, returning the body and its
+// content type, see RouteGroup.ResponseEncoder
+type ResponseEncoderFunc func(v interface{}) ([]byte, string, error)
+
+// ErrorEncoderFunc encodes an error of the routes of a group, returning the body and its content type
+type ErrorEncoderFunc func(err Error) ([]byte, string)
+
+type responseEncoderKey struct{}
+
+// ResponseEncoder sets how the group's routes encode their responses, for clients that can't take JSON. The values
+// passed to RespondJSON are encoded by encode rather than marshalled to JSON. They are given to it as the handler
+// passed them, unless the response is redacted (see RedactionOptions) or has a field selection (see
+// AllowFieldSelection): those are applied to the value's JSON, which is then decoded into the maps, slices and
+// json.Numbers given to encode, so that encode never sees what the caller may not. The _meta of JSON responses
+// isn't added. Its content type is used unless
+// the handler set a Content-Type header itself. The group's errors, including those of panics and of unmatched
+// requests below its prefix, are encoded by encodeError, or by encode if it is nil, replacing the error formatter
+// of any group it is added to. Like WithErrorFormatter, it is inherited by nested groups unless they set their own
+func (g *RouteGroup) ResponseEncoder(encode ResponseEncoderFunc, encodeError ErrorEncoderFunc) *RouteGroup {
+	g.encoder = encode
+
+	if encodeError == nil {
+		encodeError = func(err Error) ([]byte, string) {
+			body, contentType, encodeErr := encode(err)
+			if encodeErr != nil {
+				return []byte(http.StatusText(err.Status())), "text/plain"
+			}
+
+			return body, contentType
+		}
+	}
+
+	g.errorFormatter = encoderErrorFormatter(encodeError)
+
+	return g
+}
+
+// encoderErrorFormatter returns an ErrorFormatter that writes errors encoded by encodeError
+func encoderErrorFormatter(encodeError ErrorEncoderFunc) ErrorFormatter {
+	return func(w http.ResponseWriter, _ *http.Request, err Error) {
+		body, contentType := encodeError(err)
+
+		w.Header().Set(contentTypeHeaderKey, contentType)
+		w.WriteHeader(err.Status())
+		_, _ = w.Write(body)
+	}
+}
+
+// responseEncoder returns the encoder of the route's innermost group that has one, or nil
+func responseEncoder(r httpRouteHandler) ResponseEncoderFunc {
+	for _, g := range r.groups {
+		if g.encoder != nil {
+			return g.encoder
+		}
+	}
+
+	return nil
+}
+
+// withResponseEncoder returns inner, handing encoder to the Respond helpers of its requests
+func withResponseEncoder(encoder ResponseEncoderFunc, inner HandlerFunc) HandlerFunc {
+	if encoder == nil {
+		return inner
+	}
+
+	return func(w http.ResponseWriter, r *http.Request, ctx *Ctx) error {
+		ctx.Context = context.WithValue(ctx.Context, responseEncoderKey{}, encoder)
+
+		return inner(w, r, ctx)
+	}
+}
+
+func responseEncoderFrom(ctx context.Context) ResponseEncoderFunc {
+	if ctx == nil {
+		return nil
+	}
+
+	encoder, _ := ctx.Value(responseEncoderKey{}).(ResponseEncoderFunc)
+
+	return encoder
+}
+
+// respondEncoded sends data encoded by encoder, keeping a Content-Type set by the handler
+func respondEncoded(ctx context.Context, w http.ResponseWriter, encoder ResponseEncoderFunc, data interface{}, statusCode int) error {
+	data, err := encodableValue(ctx, data, statusCode)
+	if err != nil {
+		return err
+	}
+
+	body, contentType, err := encoder(data)
+	if err != nil {
+		return err
+	}
+
+	if w.Header().Get(contentTypeHeaderKey) == "" {
+		w.Header().Set(contentTypeHeaderKey, contentType)
+	}
+
+	return respondBytes(ctx, w, body, statusCode)
+}
+
+// encodableValue returns data as a ResponseEncoderFunc is given it: unchanged, unless the request's response is
+// redacted or has a field selection, in which case it is the decoded JSON of the redacted and selected value
+func encodableValue(ctx context.Context, data interface{}, statusCode int) (interface{}, error) {
+	state := redactionFrom(ctx)
+	selecting := fieldSelectionFrom(ctx) != nil && statusCode >= 200 && statusCode < 300
+
+	if !selecting && (state == nil || state.bypass) {
+		return data, nil
+	}
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+
+	if err := encodeResponseJSON(ctx, buf, data, statusCode); err != nil {
+		return nil, err
+	}
+
+	decoder := json.NewDecoder(buf)
+	decoder.UseNumber()
+
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, errors.Wrap(err, "failed to Decode redacted response")
+	}
+
+	return value, nil
+}
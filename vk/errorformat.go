@@ -0,0 +1,161 @@
+package vk
+
+import (
+	"net/http"
+	"strings"
+)
+
+// ErrorFormatter writes the response for an error. When set on a group with WithErrorFormatter, it is used for
+// errors returned by the group's handlers, for their panics, and for requests below the group's prefix that match
+// no route (404) or method (405)
+type ErrorFormatter func(w http.ResponseWriter, r *http.Request, err Error)
+
+// DefaultErrorFormatter writes vk's error body, i.e. {"status": 404, "message": "not found"}
+func DefaultErrorFormatter(w http.ResponseWriter, _ *http.Request, err Error) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+
+	if marshalErr := encodeJSONTo(buf, err); marshalErr != nil {
+		respondError(w, nil, nil, E(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError)))
+		return
+	}
+
+	w.Header().Set(contentTypeHeaderKey, "application/json")
+	w.WriteHeader(err.Status())
+	_, _ = w.Write(buf.Bytes())
+}
+
+// legacyErrorEnvelope is the error body of LegacyErrorFormatter
+type legacyErrorEnvelope struct {
+	Error legacyError `json:"error"`
+}
+
+type legacyError struct {
+	Code string `json:"code"`
+	Msg  string `json:"msg"`
+}
+
+// LegacyErrorFormatter writes errors as {"error": {"code": "NOT_FOUND", "msg": "not found"}}, for clients of
+// services migrated to vk that expect that shape. code returns the code of an error; if it is nil, errors with
+// a `Code() string` method use it, and others use their status text in upper snake case
+func LegacyErrorFormatter(code func(Error) string) ErrorFormatter {
+	if code == nil {
+		code = legacyErrorCode
+	}
+
+	return func(w http.ResponseWriter, _ *http.Request, err Error) {
+		buf := getBuffer()
+		defer putBuffer(buf)
+
+		_ = encodeJSONTo(buf, legacyErrorEnvelope{Error: legacyError{Code: code(err), Msg: err.Message()}})
+
+		w.Header().Set(contentTypeHeaderKey, "application/json")
+		w.WriteHeader(err.Status())
+		_, _ = w.Write(buf.Bytes())
+	}
+}
+
+func legacyErrorCode(err Error) string {
+	if coded, ok := err.(interface{ Code() string }); ok {
+		return coded.Code()
+	}
+
+	text := http.StatusText(err.Status())
+	if text == "" {
+		return "ERROR"
+	}
+
+	return strings.ToUpper(strings.NewReplacer(" ", "_", "-", "_", "'", "").Replace(text))
+}
+
+// WithErrorFormatter sets the formatter for the errors of the group's routes, overriding that of any group it is
+// added to. Setting it on a Router sets the default for all of its routes
+func (g *RouteGroup) WithErrorFormatter(formatter ErrorFormatter) *RouteGroup {
+	g.errorFormatter = formatter
+
+	return g
+}
+
+// prefixFormatter is the error formatter of a group, mounted below prefix
+type prefixFormatter struct {
+	segments  []string
+	formatter ErrorFormatter
+}
+
+// errorFormatter returns the formatter of the route's innermost group that has one, and records it as the
+// formatter for unmatched requests below that group's prefix
+func (rt *Router) errorFormatter(r httpRouteHandler) ErrorFormatter {
+	for i, g := range r.groups {
+		if g.errorFormatter == nil {
+			continue
+		}
+
+		// the route's groups are innermost first, so the group's prefix is that of every group from the outermost to it
+		prefix := ""
+		for j := len(r.groups) - 1; j >= i; j-- {
+			prefix += ensureLeadingSlash(r.groups[j].prefix)
+		}
+
+		segments := []string{}
+		if prefix = strings.Trim(prefix, "/"); prefix != "" {
+			segments = strings.Split(prefix, "/")
+		}
+
+		rt.formatters = append(rt.formatters, prefixFormatter{segments: segments, formatter: g.errorFormatter})
+
+		return g.errorFormatter
+	}
+
+	return nil
+}
+
+// unmatchedFormatter returns the formatter of the group with the longest prefix that matches path, or nil
+func (rt *Router) unmatchedFormatter(path string) ErrorFormatter {
+	segments := splitPath(path)
+
+	var formatter ErrorFormatter
+	longest := -1
+
+	for _, f := range rt.formatters {
+		if len(f.segments) > longest && matchPrefixSegments(f.segments, segments) {
+			formatter, longest = f.formatter, len(f.segments)
+		}
+	}
+
+	return formatter
+}
+
+// matchPrefixSegments returns true if the path begins with the segments of prefix, with matchSegments' semantics
+func matchPrefixSegments(prefix, path []string) bool {
+	if len(prefix) > len(path) {
+		return false
+	}
+
+	for i, p := range prefix {
+		if strings.HasPrefix(p, "*") {
+			return true
+		}
+
+		if !strings.HasPrefix(p, ":") && p != path[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// respondError writes err using formatter, or as its status text if there is none. In dev mode, 500s are rendered
+// for browsers as an error page instead, see serveDevErrorPage
+func respondError(w http.ResponseWriter, r *http.Request, formatter ErrorFormatter, err Error) {
+	if serveDevErrorPage(w, r, err) {
+		return
+	}
+
+	if formatter != nil {
+		formatter(w, r, err)
+		return
+	}
+
+	w.WriteHeader(err.Status())
+	_, _ = w.Write([]byte(http.StatusText(err.Status())))
+}
@@ -0,0 +1,194 @@
+package vk
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	eventBufferSize    = 64
+	drainProgressEvery = 50 * time.Millisecond
+)
+
+// ServerEvent is a lifecycle event emitted by the server, see Server.Events
+type ServerEvent interface {
+	serverEvent()
+}
+
+// ListenerBound is emitted when the server's listener has been bound to Addr
+type ListenerBound struct {
+	Addr string
+}
+
+// GateStarted is emitted when a startup gate starts running, see Server.Gate
+type GateStarted struct {
+	Name string
+}
+
+// GateFinished is emitted when a startup gate has finished running. Err is nil if it passed
+type GateFinished struct {
+	Name     string
+	Duration time.Duration
+	Err      error
+}
+
+// Ready is emitted when the server is about to begin serving requests, once its startup gates have passed
+type Ready struct{}
+
+// ShutdownStarted is emitted when the server begins shutting down
+type ShutdownStarted struct {
+	Reason string
+}
+
+// DrainProgress is emitted while the server is shutting down with the number of connections still handling requests.
+// It is emitted once when shutdown begins, and again whenever the number changes
+type DrainProgress struct {
+	Active int
+}
+
+// Stopped is the final event, emitted when the server has stopped. Err is nil if the server was shut down cleanly
+type Stopped struct {
+	Err error
+}
+
+func (ListenerBound) serverEvent()   {}
+func (GateStarted) serverEvent()     {}
+func (GateFinished) serverEvent()    {}
+func (Ready) serverEvent()           {}
+func (ShutdownStarted) serverEvent() {}
+func (DrainProgress) serverEvent()   {}
+func (Stopped) serverEvent()         {}
+
+// lifecycle tracks the server's events, active connections, and terminal error
+type lifecycle struct {
+	lock    sync.Mutex
+	events  chan ServerEvent
+	dropped uint64
+	stopped bool
+	err     error
+
+	connLock sync.Mutex
+	active   map[net.Conn]struct{}
+}
+
+func newLifecycle() *lifecycle {
+	l := &lifecycle{
+		events: make(chan ServerEvent, eventBufferSize),
+		active: map[net.Conn]struct{}{},
+	}
+
+	return l
+}
+
+// Events returns the channel of the server's lifecycle events, which is closed after the Stopped event. The channel
+// is buffered and never blocks the server: if it is full, the oldest event is dropped (see DroppedEvents)
+func (s *Server) Events() <-chan ServerEvent {
+	return s.lifecycle.events
+}
+
+// DroppedEvents returns the number of lifecycle events dropped because the Events channel was full
+func (s *Server) DroppedEvents() uint64 {
+	s.lifecycle.lock.Lock()
+	defer s.lifecycle.lock.Unlock()
+
+	return s.lifecycle.dropped
+}
+
+// Err returns the error that stopped the server, or nil if it is still running or was shut down cleanly
+func (s *Server) Err() error {
+	s.lifecycle.lock.Lock()
+	defer s.lifecycle.lock.Unlock()
+
+	return s.lifecycle.err
+}
+
+// emit sends an event without blocking, dropping the oldest buffered event if the channel is full
+func (l *lifecycle) emit(event ServerEvent) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.send(event)
+}
+
+func (l *lifecycle) send(event ServerEvent) {
+	if l.stopped {
+		return
+	}
+
+	for {
+		select {
+		case l.events <- event:
+			return
+		default:
+		}
+
+		select {
+		case <-l.events:
+			l.dropped++
+		default:
+		}
+	}
+}
+
+// stop records the terminal error and emits the Stopped event, only the first call has any effect
+func (l *lifecycle) stop(err error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.stopped {
+		return
+	}
+
+	l.send(Stopped{Err: err})
+
+	l.err = err
+	l.stopped = true
+	close(l.events)
+}
+
+// trackConn is used as the http.Server's ConnState hook to count connections that are handling requests
+func (l *lifecycle) trackConn(conn net.Conn, state http.ConnState) {
+	l.connLock.Lock()
+	defer l.connLock.Unlock()
+
+	if state == http.StateActive {
+		l.active[conn] = struct{}{}
+	} else {
+		delete(l.active, conn)
+	}
+}
+
+func (l *lifecycle) activeConns() int {
+	l.connLock.Lock()
+	defer l.connLock.Unlock()
+
+	return len(l.active)
+}
+
+// reportDrain emits DrainProgress when called and whenever the number of active connections changes, until done is closed
+func (l *lifecycle) reportDrain(done <-chan struct{}) {
+	last := l.activeConns()
+	l.emit(DrainProgress{Active: last})
+
+	report := func() {
+		if active := l.activeConns(); active != last {
+			last = active
+			l.emit(DrainProgress{Active: active})
+		}
+	}
+
+	ticker := time.NewTicker(drainProgressEvery)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			report()
+			return
+		case <-ticker.C:
+			report()
+		}
+	}
+}
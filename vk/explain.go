@@ -0,0 +1,182 @@
+package vk
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	routerLayer = "router"
+	routeLayer  = "route"
+)
+
+// Validate checks that the router's groups form a tree: a group can only be added to one parent, and never to
+// itself or to one of its own subgroups, and that no route declares more than one Body preset. Finalize refuses to
+// mount the routes of a router that fails it
+func (rt *Router) Validate() error {
+	if rt.RouteGroup == nil {
+		return nil
+	}
+
+	if err := rt.validateGroups(); err != nil {
+		return err
+	}
+
+	for _, r := range rt.RouteGroup.httpRouteHandlers() {
+		if _, err := bodySpecOf(r.wrapped()); err != nil {
+			return errors.Wrapf(err, "route %s %s", r.Method, r.Path)
+		}
+	}
+
+	return nil
+}
+
+// validateGroups returns an error if a group is added to more than one group, or to itself
+func (rt *Router) validateGroups() error {
+	parents := map[*RouteGroup]*RouteGroup{}
+	onPath := map[*RouteGroup]bool{}
+
+	var walk func(g *RouteGroup, path []*RouteGroup) error
+	walk = func(g *RouteGroup, path []*RouteGroup) error {
+		onPath[g] = true
+		defer delete(onPath, g)
+
+		path = append(path, g)
+
+		for _, child := range g.children {
+			if onPath[child] {
+				return errors.Errorf("route group %s is added to itself through %s", groupName(child), groupPath(append(path, child)))
+			}
+
+			if parent, ok := parents[child]; ok && parent == g {
+				return errors.Errorf("route group %s is added to %s more than once", groupName(child), groupName(g))
+			} else if ok {
+				return errors.Errorf("route group %s is added to both %s and %s, a group can only be added once", groupName(child), groupName(parent), groupName(g))
+			}
+
+			parents[child] = g
+
+			if err := walk(child, path); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	return walk(rt.RouteGroup, nil)
+}
+
+// ExplainRoute returns the layers that a request to path would pass through, outermost first, each prefixed with the
+// layer that added it: "router" for the router's own middleware (such as the server's error middleware), "group
+// <prefix>" for those of a group, and "route" for those passed when the route was added, followed by "handler":
+//
+//	router: error
+//	group /api: auth
+//	group /v1: ratelimit
+//	route: dedup
+//	handler
+//
+// A parent group's middleware always run before its subgroups'. path can be a route's pattern or a request path
+func (rt *Router) ExplainRoute(method, path string) ([]string, error) {
+	if err := rt.Validate(); err != nil {
+		return nil, err
+	}
+
+	routes := rt.RouteGroup.httpRouteHandlers()
+
+	// a pattern is matched exactly, so that /users/:id isn't explained as /users/*rest
+	for _, r := range routes {
+		if r.Method == method && r.Path == path {
+			return rt.explain(r), nil
+		}
+	}
+
+	segments := splitPath(path)
+
+	for _, r := range routes {
+		if r.Method == method && matchSegments(splitPath(r.Path), segments) {
+			return rt.explain(r), nil
+		}
+	}
+
+	return nil, errors.Errorf("no route matches %s %s", method, path)
+}
+
+// explain returns the route's chain of layers with their provenance, see ExplainRoute
+func (rt *Router) explain(r httpRouteHandler) []string {
+	handler := r.Handler
+	layers := TraceChain(handler)
+
+	explained := make([]string, 0, len(layers)+len(r.middleware))
+
+	// each middleware wraps the chain built so far, so the names it adds are at the start of the chain
+	for i := len(layers) - 1; i >= 0; i-- {
+		name := layers[i]
+		if name != handlerLayerName || i != len(layers)-1 {
+			name = routeLayer + ": " + name
+		}
+
+		explained = append(explained, name)
+	}
+
+	for i, mw := range r.middleware {
+		if mw == nil {
+			continue
+		}
+
+		handler = WrapHandler(handler, mw)
+
+		chain := TraceChain(handler)
+		added := chain[:len(chain)-len(layers)]
+		layers = chain
+
+		origin := routerLayer
+		if r.origins[i] != rt.RouteGroup {
+			origin = "group " + groupName(r.origins[i])
+		}
+
+		for j := len(added) - 1; j >= 0; j-- {
+			explained = append(explained, origin+": "+added[j])
+		}
+	}
+
+	// the chain was built from the handler outwards
+	for i, j := 0, len(explained)-1; i < j; i, j = i+1, j-1 {
+		explained[i], explained[j] = explained[j], explained[i]
+	}
+
+	return explained
+}
+
+// logExplained logs the chain of every route at debug level
+func (rt *Router) logExplained(routes []httpRouteHandler) {
+	for _, r := range routes {
+		rt.log.Debug("route", r.Method, r.Path, "runs", strings.Join(rt.explain(r), " -> "))
+	}
+}
+
+// useExplainRoutes sets whether Finalize logs the chain of every route, see ExplainRoute
+func (rt *Router) useExplainRoutes(explain bool) {
+	rt.explainRoutes = explain
+}
+
+// groupName identifies a group by its prefix
+func groupName(g *RouteGroup) string {
+	if g.prefix == "" {
+		return "/"
+	}
+
+	return ensureLeadingSlash(g.prefix)
+}
+
+// groupPath describes a chain of groups, i.e. "/a -> /b -> /a"
+func groupPath(path []*RouteGroup) string {
+	names := make([]string, len(path))
+	for i, g := range path {
+		names[i] = groupName(g)
+	}
+
+	return strings.Join(names, " -> ")
+}
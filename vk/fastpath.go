@@ -0,0 +1,224 @@
+package vk
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// fastPathLogSample is how many requests to a fast-path route are served for each one that is logged
+const fastPathLogSample = 1024
+
+// FastResult selects which of a fast-path route's responses is written, by its index in the responses given to
+// FastPath
+type FastResult int
+
+// FastResponse is a response of a fast-path route, which is prepared when the route is registered and written as
+// it is for each request that selects it
+type FastResponse struct {
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+// FastCtx is the reduced Ctx of a fast-path route. It is reused across requests, so it must not be kept after the
+// handler returns
+type FastCtx struct {
+	Params httprouter.Params
+}
+
+// FastHandlerFunc handles a request to a fast-path route, returning the response to write
+type FastHandlerFunc func(r *http.Request, ctx *FastCtx) FastResult
+
+// fastRoute is a fast-path route's handler and prepared responses
+type fastRoute struct {
+	handler   FastHandlerFunc
+	responses []preparedFastResponse
+	served    uint64 // for sampled logging
+}
+
+// preparedFastResponse is a FastResponse with its headers canonicalized and completed ahead of time
+type preparedFastResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+var fastCtxPool = sync.Pool{New: func() interface{} {
+	return &FastCtx{}
+}}
+
+var fastPathInternalError = prepareFastResponse(FastResponse{
+	Status: http.StatusInternalServerError,
+	Body:   []byte(http.StatusText(http.StatusInternalServerError)),
+})
+
+// FastPath returns the handler of a fast-path route, for endpoints that serve very large numbers of tiny, fixed
+// responses such as a 202 with no body. The handler selects one of responses, which defaults to a single empty 202,
+// and the router writes it without a Ctx, JSON encoding, content type detection or per-request logging (only one
+// in every 1024 requests is logged, at debug level), and recovers its panics with a bare 500, i.e.
+//
+//	server.POST("/ingest", vk.FastPath(ingest, vk.FastResponse{Status: http.StatusAccepted}))
+//
+// A fast-path route has no errors to handle, so it skips ErrorMiddleware, but a route with any other middleware (its
+// own or its groups'), in an isolation domain, or on a router with CORS, in-flight tracking or a handler timeout is
+// served by the standard path, which writes the same responses, so that none of them is ever skipped
+func FastPath(handler FastHandlerFunc, responses ...FastResponse) HandlerFunc {
+	if len(responses) == 0 {
+		responses = []FastResponse{{Status: http.StatusAccepted}}
+	}
+
+	route := &fastRoute{handler: handler, responses: make([]preparedFastResponse, len(responses))}
+	for i, resp := range responses {
+		route.responses[i] = prepareFastResponse(resp)
+	}
+
+	l := &chainLink{name: "fastpath", handler: route.serveStandard, value: route}
+
+	return l.serve
+}
+
+// prepareFastResponse canonicalizes the response's header keys, and sets its Content-Length and Content-Type
+func prepareFastResponse(resp FastResponse) preparedFastResponse {
+	// the values are shared by every response, so they are capped for appends to them to copy them
+	header := http.Header{}
+	for key, values := range resp.Header {
+		header[http.CanonicalHeaderKey(key)] = values[:len(values):len(values)]
+	}
+
+	status := resp.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	if status != http.StatusNoContent && status != http.StatusNotModified {
+		header["Content-Length"] = []string{strconv.Itoa(len(resp.Body))}
+	}
+
+	if len(resp.Body) > 0 && header.Get(contentTypeHeaderKey) == "" {
+		header[contentTypeHeaderKey] = []string{http.DetectContentType(resp.Body)}
+	}
+
+	return preparedFastResponse{status: status, header: header, body: resp.Body}
+}
+
+// errorLayer is the metadata of ErrorMiddleware's layer, which fast-path routes skip, see fastRouteFor
+type errorLayer struct{}
+
+// fastRouteFor returns the fast-path route that serves r, or nil if r must be served by the standard path, because
+// something other than its error handling would otherwise be skipped
+func (rt *Router) fastRouteFor(r httpRouteHandler) (fast *fastRoute) {
+	fast = fastRouteOf(r.Handler)
+	if fast == nil {
+		return nil
+	}
+
+	if rt.cors != nil || rt.inFlight != nil || rt.handlerTimeout > 0 || routeDomain(r) != DefaultDomain {
+		return nil
+	}
+
+	// a chain that can't be built is left to fail on the route's first request
+	defer func() {
+		if recover() != nil {
+			fast = nil
+		}
+	}()
+
+	for l := linkOf(r.wrapped()); l != nil; l = linkOf(l.next) {
+		switch l.value.(type) {
+		case *fastRoute:
+			return fast
+		case errorLayer:
+		default:
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// fastRouteOf returns the fast-path route of a handler returned by FastPath, or nil
+func fastRouteOf(handler HandlerFunc) *fastRoute {
+	if l := linkOf(handler); l != nil {
+		if route, ok := l.value.(*fastRoute); ok {
+			return route
+		}
+	}
+
+	return nil
+}
+
+// response returns the prepared response selected by result
+func (f *fastRoute) response(result FastResult) *preparedFastResponse {
+	if result < 0 || int(result) >= len(f.responses) {
+		return &fastPathInternalError
+	}
+
+	return &f.responses[result]
+}
+
+// serveStandard serves the route through the standard path, when it has been wrapped in middleware
+func (f *fastRoute) serveStandard(w http.ResponseWriter, r *http.Request, ctx *Ctx) error {
+	resp := f.response(f.handler(r, &FastCtx{Params: ctx.Params}))
+	resp.write(w, ctx.RespHeaders)
+
+	return nil
+}
+
+// write writes the response, sharing its header values with header
+func (p *preparedFastResponse) write(w http.ResponseWriter, header http.Header) {
+	for key, values := range p.header {
+		header[key] = values
+	}
+
+	w.WriteHeader(p.status)
+
+	if len(p.body) > 0 {
+		_, _ = w.Write(p.body)
+	}
+}
+
+// fastHandle returns the Handle that serves a fast-path route
+func (rt *Router) fastHandle(route string, f *fastRoute) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		defer rt.recoverFastPanic(w, route)
+
+		ctx := fastCtxPool.Get().(*FastCtx)
+		ctx.Params = params
+
+		resp := f.response(f.handler(r, ctx))
+
+		ctx.Params = nil
+		fastCtxPool.Put(ctx)
+
+		resp.write(w, w.Header())
+
+		if atomic.AddUint64(&f.served, 1)%fastPathLogSample == 1 {
+			rt.log.Debug("fast path", r.Method, route, "served", strconv.FormatUint(atomic.LoadUint64(&f.served), 10), "requests")
+		}
+	}
+}
+
+// recoverFastPanic records a fast-path route's panic like recoverPanic, responding with a bare 500
+func (rt *Router) recoverFastPanic(w http.ResponseWriter, route string) {
+	value := recover()
+	if value == nil {
+		return
+	}
+
+	if value == http.ErrAbortHandler {
+		panic(value)
+	}
+
+	report, isNew := rt.panics.record(value, debug.Stack())
+	if isNew {
+		rt.log.ErrorString(fmt.Sprintf("recovered panic [%s] in fast path %s: %s\n%s", report.Fingerprint, route, report.Message, report.Stack))
+	}
+
+	fastPathInternalError.write(w, w.Header())
+}
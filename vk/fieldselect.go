@@ -0,0 +1,156 @@
+package vk
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// FieldsParam is the query parameter that selects the fields of a response, see AllowFieldSelection
+const FieldsParam = "fields"
+
+type fieldSelectionKey struct{}
+
+// fieldSelection is a tree of the selected fields by their JSON names. Every field of a value is selected by a nil
+// selection, such as that of a field selected without any of its own fields
+type fieldSelection map[string]fieldSelection
+
+// field returns the selection of a field, and whether it is selected at all
+func (s fieldSelection) field(name string) (fieldSelection, bool) {
+	if s == nil {
+		return nil, true
+	}
+
+	sub, ok := s[name]
+
+	return sub, ok
+}
+
+// AllowFieldSelection is a Middleware that lets clients trim the route's successful JSON responses to the fields
+// listed in the fields query parameter, as dotted paths of JSON names such as ?fields=id,name,owner.email. The fields
+// of the elements of lists and maps are selected the same way as those of a single object. Fields that the response's
+// type doesn't have, or that the caller isn't permitted to see (see RedactionOptions), fail the response with a 400
+func AllowFieldSelection() Middleware {
+	return Named("fieldselection", func(inner HandlerFunc) HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request, ctx *Ctx) error {
+			param := r.URL.Query().Get(FieldsParam)
+			if param == "" {
+				return inner(w, r, ctx)
+			}
+
+			sel, err := parseFieldSelection(param)
+			if err != nil {
+				return err
+			}
+
+			ctx.Context = context.WithValue(ctx.Context, fieldSelectionKey{}, sel)
+
+			return inner(w, r, ctx)
+		}
+	})
+}
+
+// parseFieldSelection parses a comma-separated list of dotted paths
+func parseFieldSelection(param string) (fieldSelection, error) {
+	sel := fieldSelection{}
+
+	for _, path := range strings.Split(param, ",") {
+		names := strings.Split(strings.TrimSpace(path), ".")
+
+		node := sel
+
+		for i, name := range names {
+			if name == "" {
+				return nil, E(http.StatusBadRequest, "invalid "+FieldsParam+": empty field name in "+param)
+			}
+
+			sub, ok := node[name]
+
+			if i == len(names)-1 {
+				// the whole field, even if some of its fields were selected too
+				node[name] = nil
+				break
+			}
+
+			if ok && sub == nil {
+				// already selected whole
+				break
+			}
+
+			if !ok {
+				sub = fieldSelection{}
+				node[name] = sub
+			}
+
+			node = sub
+		}
+	}
+
+	return sel, nil
+}
+
+func fieldSelectionFrom(ctx context.Context) fieldSelection {
+	if ctx == nil {
+		return nil
+	}
+
+	sel, _ := ctx.Value(fieldSelectionKey{}).(fieldSelection)
+
+	return sel
+}
+
+// selectJSON encodes the fields of v selected by sel into buf, redacting them for r, or returns a 400 listing the
+// selected fields that v's type doesn't have or r doesn't permit
+func selectJSON(buf *bytes.Buffer, v interface{}, r *redaction, sel fieldSelection) error {
+	if v != nil {
+		unknown := []string{}
+		redactPlanFor(reflect.TypeOf(v)).unknownFields(sel, r, "", &unknown)
+
+		if len(unknown) > 0 {
+			sort.Strings(unknown)
+
+			return E(http.StatusBadRequest, "unknown "+FieldsParam+": "+strings.Join(unknown, ", "))
+		}
+	}
+
+	return redactJSON(buf, v, r, sel)
+}
+
+// unknownFields adds the paths of the fields selected by sel that the plan doesn't have, or r doesn't permit
+func (p *redactPlan) unknownFields(sel fieldSelection, r *redaction, prefix string, unknown *[]string) {
+	switch p.kind {
+	case planPointer, planSlice, planArray, planMap:
+		p.elem.unknownFields(sel, r, prefix, unknown)
+	case planInterface:
+		// the fields depend on the value, so those it doesn't have are left out
+	case planStruct:
+		for name, sub := range sel {
+			f, ok := p.field(name)
+			if !ok || !r.permits(f.scopes) {
+				*unknown = append(*unknown, prefix+name)
+				continue
+			}
+
+			if sub != nil {
+				f.plan.unknownFields(sub, r, prefix+name+".", unknown)
+			}
+		}
+	default:
+		for name := range sel {
+			*unknown = append(*unknown, prefix+name)
+		}
+	}
+}
+
+func (p *redactPlan) field(name string) (redactField, bool) {
+	for _, f := range p.fields {
+		if f.name == name {
+			return f, true
+		}
+	}
+
+	return redactField{}, false
+}
@@ -0,0 +1,379 @@
+package vk
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+)
+
+const (
+	// frameHeaderBytes is the size of a frame's envelope: its version, its type, and the length of its payload
+	frameHeaderBytes = 6
+
+	defaultMaxFrameBytes = 1 << 20
+)
+
+var (
+	// ErrFrameVersion is the error of a FrameError for a client that offered none of the protocol's versions, or a
+	// frame with a version other than the negotiated one
+	ErrFrameVersion = errors.New("unsupported frame protocol version")
+
+	// ErrFrameTooLarge is the error of a FrameError for a frame whose payload is larger than the protocol allows
+	ErrFrameTooLarge = errors.New("frame is too large")
+
+	// ErrFrameMalformed is the error of a FrameError for a message that isn't a well-formed frame
+	ErrFrameMalformed = errors.New("malformed frame")
+
+	// ErrFrameType is the error of a FrameError for a frame whose type has no codec, see FrameConn.Receive
+	ErrFrameType = errors.New("unknown frame type")
+)
+
+// FrameError describes a frame that broke the protocol. When it is returned by FrameConn.ReadFrame, the connection
+// has been sent a close message with CloseCode
+type FrameError struct {
+	Err       error // one of ErrFrameVersion, ErrFrameTooLarge, ErrFrameMalformed or ErrFrameType
+	Detail    string
+	CloseCode int
+}
+
+func (e *FrameError) Error() string {
+	return e.Err.Error() + ": " + e.Detail
+}
+
+func (e *FrameError) Unwrap() error {
+	return e.Err
+}
+
+// FrameEncoder converts a value to the payload of a frame
+type FrameEncoder func(value interface{}) ([]byte, error)
+
+// FrameDecoder converts the payload of a frame to a value
+type FrameDecoder func(payload []byte) (interface{}, error)
+
+type frameCodec struct {
+	msgType uint8
+	typ     reflect.Type
+	encode  FrameEncoder
+	decode  FrameDecoder
+}
+
+// FrameCodecs maps the types of frames to Go types, for FrameConn.Send and FrameConn.Receive. It is safe for
+// concurrent use
+type FrameCodecs struct {
+	lock     sync.RWMutex
+	byType   map[uint8]frameCodec
+	byGoType map[reflect.Type]frameCodec
+}
+
+// NewFrameCodecs creates an empty FrameCodecs
+func NewFrameCodecs() *FrameCodecs {
+	c := &FrameCodecs{
+		byType:   map[uint8]frameCodec{},
+		byGoType: map[reflect.Type]frameCodec{},
+	}
+
+	return c
+}
+
+// Register maps frames of msgType to values of type t, which are encoded and decoded with the functions, i.e.
+// codecs.Register(1, reflect.TypeOf(Position{}), encodePosition, decodePosition)
+func (c *FrameCodecs) Register(msgType uint8, t reflect.Type, encode FrameEncoder, decode FrameDecoder) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	codec := frameCodec{msgType: msgType, typ: t, encode: encode, decode: decode}
+
+	c.byType[msgType] = codec
+	c.byGoType[t] = codec
+}
+
+func (c *FrameCodecs) forType(msgType uint8) (frameCodec, bool) {
+	if c == nil {
+		return frameCodec{}, false
+	}
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	codec, ok := c.byType[msgType]
+
+	return codec, ok
+}
+
+func (c *FrameCodecs) forGoType(t reflect.Type) (frameCodec, bool) {
+	if c == nil {
+		return frameCodec{}, false
+	}
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	codec, ok := c.byGoType[t]
+
+	return codec, ok
+}
+
+// FrameProtocol is a binary protocol over websockets, whose messages are frames: a version byte, a type byte, and a
+// length-prefixed payload. The version is negotiated during the handshake with a subprotocol of the form v1.name,
+// such as v2.telemetry, by adding the protocol's Negotiate middleware to the websocket route:
+//
+//	proto := &vk.FrameProtocol{Name: "telemetry", Versions: []uint8{1, 2}}
+//
+//	g := vk.Group("/realtime").WithMiddlewares(proto.Negotiate())
+//	g.WebSocket("/ws", func(r *http.Request, ctx *vk.Ctx, conn *websocket.Conn) error {
+//		frames, err := proto.Conn(conn)
+//		...
+//	})
+type FrameProtocol struct {
+	Name          string
+	Versions      []uint8      // the versions the server supports, the highest one offered by the client is chosen
+	MaxFrameBytes int          // the largest payload of a frame, 1MiB by default
+	Codecs        *FrameCodecs // the Go types of the frames, see FrameConn.Send
+}
+
+// Subprotocols returns the subprotocols of each of the protocol's versions, highest first, for a client to offer
+// with websocket.Dialer's Subprotocols
+func (p *FrameProtocol) Subprotocols() []string {
+	versions := append([]uint8{}, p.Versions...)
+	sort.Slice(versions, func(i, j int) bool { return versions[i] > versions[j] })
+
+	protocols := make([]string, len(versions))
+	for i, v := range versions {
+		protocols[i] = p.subprotocol(v)
+	}
+
+	return protocols
+}
+
+// Negotiate is a Middleware that accepts the highest version of the protocol offered by the client's subprotocols,
+// and rejects upgrades that offer none of them with a 400
+func (p *FrameProtocol) Negotiate() Middleware {
+	return Named("frames", func(inner HandlerFunc) HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request, ctx *Ctx) error {
+			offered := websocket.Subprotocols(r)
+
+			chosen, chosenVersion := "", -1
+
+			for _, sub := range offered {
+				if v, ok := p.parseSubprotocol(sub); ok && p.supports(v) && int(v) > chosenVersion {
+					chosen, chosenVersion = sub, int(v)
+				}
+			}
+
+			if chosen == "" {
+				err := &FrameError{
+					Err:       ErrFrameVersion,
+					Detail:    fmt.Sprintf("offered %q, supported %q", offered, p.Subprotocols()),
+					CloseCode: websocket.CloseProtocolError,
+				}
+
+				return E(http.StatusBadRequest, err.Error())
+			}
+
+			ctx.RespHeaders.Set("Sec-WebSocket-Protocol", chosen)
+
+			return inner(w, r, ctx)
+		}
+	})
+}
+
+// Conn returns a FrameConn for a connection whose subprotocol is one of the protocol's versions, on the server (once
+// Negotiate has chosen it) or on the client. It limits the size of the connection's messages to MaxFrameBytes
+func (p *FrameProtocol) Conn(conn *websocket.Conn) (*FrameConn, error) {
+	version, ok := p.parseSubprotocol(conn.Subprotocol())
+	if !ok || !p.supports(version) {
+		return nil, &FrameError{
+			Err:       ErrFrameVersion,
+			Detail:    fmt.Sprintf("the connection's subprotocol %q is not a supported version of %s", conn.Subprotocol(), p.Name),
+			CloseCode: websocket.CloseProtocolError,
+		}
+	}
+
+	maxBytes := p.MaxFrameBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultMaxFrameBytes
+	}
+
+	conn.SetReadLimit(int64(maxBytes + frameHeaderBytes))
+
+	fc := &FrameConn{
+		conn:     conn,
+		version:  version,
+		maxBytes: maxBytes,
+		codecs:   p.Codecs,
+	}
+
+	return fc, nil
+}
+
+func (p *FrameProtocol) subprotocol(version uint8) string {
+	return fmt.Sprintf("v%d.%s", version, p.Name)
+}
+
+// parseSubprotocol returns the version of a subprotocol of the form v1.name
+func (p *FrameProtocol) parseSubprotocol(sub string) (uint8, bool) {
+	v, name, ok := strings.Cut(sub, ".")
+	if !ok || name != p.Name || !strings.HasPrefix(v, "v") {
+		return 0, false
+	}
+
+	version, err := strconv.ParseUint(strings.TrimPrefix(v, "v"), 10, 8)
+	if err != nil {
+		return 0, false
+	}
+
+	return uint8(version), true
+}
+
+func (p *FrameProtocol) supports(version uint8) bool {
+	for _, v := range p.Versions {
+		if v == version {
+			return true
+		}
+	}
+
+	return false
+}
+
+// FrameConn reads and writes the frames of a FrameProtocol on a websocket connection. Like the connection, it
+// supports one concurrent reader and one concurrent writer
+type FrameConn struct {
+	conn     *websocket.Conn
+	version  uint8
+	maxBytes int
+	codecs   *FrameCodecs
+}
+
+// Version returns the version of the protocol negotiated for the connection
+func (c *FrameConn) Version() uint8 {
+	return c.version
+}
+
+// WriteFrame writes a frame of msgType with the payload, returning a FrameError without writing it if the payload is
+// larger than the protocol's MaxFrameBytes
+func (c *FrameConn) WriteFrame(msgType uint8, payload []byte) error {
+	if len(payload) > c.maxBytes {
+		return &FrameError{
+			Err:       ErrFrameTooLarge,
+			Detail:    fmt.Sprintf("%d bytes, the maximum is %d", len(payload), c.maxBytes),
+			CloseCode: websocket.CloseMessageTooBig,
+		}
+	}
+
+	frame := make([]byte, frameHeaderBytes+len(payload))
+	frame[0] = c.version
+	frame[1] = msgType
+	binary.BigEndian.PutUint32(frame[2:frameHeaderBytes], uint32(len(payload)))
+	copy(frame[frameHeaderBytes:], payload)
+
+	return c.conn.WriteMessage(websocket.BinaryMessage, frame)
+}
+
+// ReadFrame reads the next frame, returning its type and payload. A message that breaks the protocol (that is too
+// large, has another version, or isn't a frame) is returned as a FrameError, once the connection has been sent a
+// close message with its CloseCode
+func (c *FrameConn) ReadFrame() (uint8, []byte, error) {
+	kind, data, err := c.conn.ReadMessage()
+	if err != nil {
+		if errors.Is(err, websocket.ErrReadLimit) {
+			// the websocket package has already sent the close message
+			return 0, nil, &FrameError{
+				Err:       ErrFrameTooLarge,
+				Detail:    fmt.Sprintf("the maximum is %d bytes", c.maxBytes),
+				CloseCode: websocket.CloseMessageTooBig,
+			}
+		}
+
+		return 0, nil, err
+	}
+
+	frameErr := c.check(kind, data)
+	if frameErr != nil {
+		c.closeWith(frameErr)
+		return 0, nil, frameErr
+	}
+
+	return data[1], data[frameHeaderBytes:], nil
+}
+
+// check returns a FrameError if the message isn't a frame of the connection's version
+func (c *FrameConn) check(kind int, data []byte) *FrameError {
+	if kind != websocket.BinaryMessage {
+		return &FrameError{Err: ErrFrameMalformed, Detail: "frames must be binary messages", CloseCode: websocket.CloseUnsupportedData}
+	}
+
+	if len(data) < frameHeaderBytes {
+		return &FrameError{Err: ErrFrameMalformed, Detail: fmt.Sprintf("%d bytes is shorter than the header", len(data)), CloseCode: websocket.CloseProtocolError}
+	}
+
+	if data[0] != c.version {
+		return &FrameError{Err: ErrFrameVersion, Detail: fmt.Sprintf("got version %d, negotiated %d", data[0], c.version), CloseCode: websocket.CloseProtocolError}
+	}
+
+	length := binary.BigEndian.Uint32(data[2:frameHeaderBytes])
+	if int64(length) > int64(c.maxBytes) {
+		return &FrameError{Err: ErrFrameTooLarge, Detail: fmt.Sprintf("%d bytes, the maximum is %d", length, c.maxBytes), CloseCode: websocket.CloseMessageTooBig}
+	}
+
+	if int(length) != len(data)-frameHeaderBytes {
+		return &FrameError{Err: ErrFrameMalformed, Detail: fmt.Sprintf("declared %d bytes, got %d", length, len(data)-frameHeaderBytes), CloseCode: websocket.CloseProtocolError}
+	}
+
+	return nil
+}
+
+// Send encodes a value with the codec registered for its type and writes it as a frame
+func (c *FrameConn) Send(value interface{}) error {
+	codec, ok := c.codecs.forGoType(reflect.TypeOf(value))
+	if !ok {
+		return fmt.Errorf("no frame codec is registered for %T", value)
+	}
+
+	payload, err := codec.encode(value)
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode %T", value)
+	}
+
+	return c.WriteFrame(codec.msgType, payload)
+}
+
+// Receive reads the next frame and decodes it with the codec registered for its type. A frame of a type without a
+// codec is returned as a FrameError, and the connection is closed like for ReadFrame
+func (c *FrameConn) Receive() (interface{}, error) {
+	msgType, payload, err := c.ReadFrame()
+	if err != nil {
+		return nil, err
+	}
+
+	codec, ok := c.codecs.forType(msgType)
+	if !ok {
+		frameErr := &FrameError{Err: ErrFrameType, Detail: fmt.Sprintf("type %d", msgType), CloseCode: websocket.CloseUnsupportedData}
+		c.closeWith(frameErr)
+
+		return nil, frameErr
+	}
+
+	value, err := codec.decode(payload)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to decode frame of type %d", msgType)
+	}
+
+	return value, nil
+}
+
+// closeWith sends a close message with the error's close code
+func (c *FrameConn) closeWith(err *FrameError) {
+	reason := err.Err.Error()
+
+	msg := websocket.FormatCloseMessage(err.CloseCode, reason)
+	c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+}
@@ -0,0 +1,262 @@
+package vk
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/suborbital/vektor/vlog"
+)
+
+const (
+	defaultGateTimeout = time.Minute
+
+	// gateRetryAfter is the Retry-After, in seconds, of the requests that arrive while the gates are running
+	gateRetryAfter = 5
+)
+
+// GateOption configures a startup gate, see Server.Gate
+type GateOption func(*gate)
+
+// GateTimeout sets how long a gate may take before it is cancelled and fails, 1 minute by default
+func GateTimeout(timeout time.Duration) GateOption {
+	return func(g *gate) {
+		g.timeout = timeout
+	}
+}
+
+// GateGroup runs the gate in parallel with the other gates of the group, at the position of the group's first gate
+func GateGroup(group string) GateOption {
+	return func(g *gate) {
+		g.group = group
+	}
+}
+
+// GateError is returned by Start when startup gates fail, with the error of each gate that failed
+type GateError struct {
+	Failed map[string]error
+}
+
+func (e *GateError) Error() string {
+	names := make([]string, 0, len(e.Failed))
+	for name := range e.Failed {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	failures := make([]string, len(names))
+	for i, name := range names {
+		failures[i] = fmt.Sprintf("%s: %s", name, e.Failed[name])
+	}
+
+	return "startup gates failed: " + strings.Join(failures, "; ")
+}
+
+type gate struct {
+	name    string
+	fn      func(ctx context.Context) error
+	timeout time.Duration
+	group   string
+	dryRun  bool // see GateDryRun
+}
+
+// gates are run after the listener is bound and before requests are served, in the order they were added
+type gates struct {
+	lock   sync.Mutex
+	list   []gate
+	passed uint32 // set once the gates have passed
+	err    error
+}
+
+func newGates() *gates {
+	return &gates{}
+}
+
+// Gate adds a startup gate, which must pass before the server serves any requests, such as running migrations or
+// syncing a feature flag client. Gates run in the order they are added (see GateGroup to run some in parallel) once
+// the listener is bound, and requests that arrive in the meantime are answered with a 503 without reaching any
+// routes, except for the liveness endpoint of OpsGroup. If a gate fails or panics, Start returns a GateError without
+// serving any requests
+func (s *Server) Gate(name string, fn func(ctx context.Context) error, opts ...GateOption) {
+	if s.started.Load().(bool) {
+		return
+	}
+
+	g := gate{name: name, fn: fn, timeout: defaultGateTimeout}
+	for _, o := range opts {
+		o(&g)
+	}
+
+	s.gates.lock.Lock()
+	defer s.gates.lock.Unlock()
+
+	s.gates.list = append(s.gates.list, g)
+}
+
+// passGates runs the gates, then emits Ready or closes the server with the gates' error
+func (s *Server) passGates() {
+	if err := s.gates.run(s.closing, s.options.Logger, s.lifecycle.emit); err != nil {
+		s.options.Logger.Error(err)
+		s.server.Close()
+
+		return
+	}
+
+	s.lifecycle.emit(Ready{})
+}
+
+// stages groups the gates into the stages they run in, each of which runs in parallel
+func (g *gates) stages() [][]gate {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	stages := [][]gate{}
+	groups := map[string]int{}
+
+	for _, gt := range g.list {
+		if i, ok := groups[gt.group]; ok && gt.group != "" {
+			stages[i] = append(stages[i], gt)
+			continue
+		}
+
+		groups[gt.group] = len(stages)
+		stages = append(stages, []gate{gt})
+	}
+
+	return stages
+}
+
+// run runs the stages of gates in order, stopping at the first stage with a failed gate. The gates pass once they all
+// have
+func (g *gates) run(ctx context.Context, logger *vlog.Logger, emit func(ServerEvent)) error {
+	for _, stage := range g.stages() {
+		failed := map[string]error{}
+
+		var lock sync.Mutex
+		var wg sync.WaitGroup
+
+		for _, gt := range stage {
+			wg.Add(1)
+
+			go func(gt gate) {
+				defer wg.Done()
+
+				emit(GateStarted{Name: gt.name})
+
+				start := time.Now()
+				err := gt.run(ctx)
+				elapsed := time.Since(start)
+
+				emit(GateFinished{Name: gt.name, Duration: elapsed, Err: err})
+
+				if err != nil {
+					lock.Lock()
+					failed[gt.name] = err
+					lock.Unlock()
+
+					return
+				}
+
+				logger.Info("gate", gt.name, "passed in", elapsed.String())
+			}(gt)
+		}
+
+		wg.Wait()
+
+		if len(failed) > 0 {
+			err := &GateError{Failed: failed}
+
+			g.lock.Lock()
+			g.err = err
+			g.lock.Unlock()
+
+			return err
+		}
+	}
+
+	atomic.StoreUint32(&g.passed, 1)
+
+	return nil
+}
+
+// run calls the gate's function, failing it if it hasn't returned by its timeout
+func (gt gate) run(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, gt.timeout)
+	defer cancel()
+
+	result := make(chan error, 1)
+
+	go func() {
+		// a panicking gate fails, rather than crashing the server
+		defer func() {
+			if value := recover(); value != nil {
+				result <- fmt.Errorf("panicked: %v", value)
+			}
+		}()
+
+		result <- gt.fn(ctx)
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("did not pass within %s: %w", gt.timeout, ctx.Err())
+	}
+}
+
+// open returns true once the gates have passed
+func (g *gates) open() bool {
+	return atomic.LoadUint32(&g.passed) == 1
+}
+
+// failed returns the error of the gates, if they failed
+func (g *gates) failed() error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	return g.err
+}
+
+// livenessRoute marks the route of a liveness endpoint, which is served while the gates run
+type livenessRoute struct{}
+
+// liveness is the Middleware of liveness routes, see livenessRoute
+func liveness() Middleware {
+	return namedWithValue("liveness", livenessRoute{}, func(inner HandlerFunc) HandlerFunc {
+		return inner
+	})
+}
+
+// isLiveness returns true if the handler's chain was marked with liveness
+func isLiveness(handler HandlerFunc) bool {
+	for _, v := range chainValues(handler) {
+		if _, ok := v.(livenessRoute); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// servesLiveness returns true if the request is for one of the liveness routes of the server's router
+func (s *Server) servesLiveness(r *http.Request) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.internalRouter.livenessRoutes[r.Method+" "+r.URL.Path]
+}
+
+// respondGating answers a request that arrived before the gates passed
+func respondGating(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", fmt.Sprintf("%d", gateRetryAfter))
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write([]byte("starting up"))
+}
@@ -1,9 +1,9 @@
 package vk
 
 import (
-	"fmt"
 	"net/http"
 	"strings"
+	"sync"
 )
 
 // RouteGroup represents a group of routes
@@ -12,12 +12,38 @@ type RouteGroup struct {
 	httpRoutes []httpRouteHandler
 	wsRoutes   []wsRouteHandler
 	middleware []Middleware
+	flags      []string
+	disabled   int32
+	states     []*routeState // of the routers the group's routes are mounted on, see Disable
+	statesLock sync.Mutex
+	assets     []assetMount  // fingerprinted Static mounts, see AssetManifest
+	quiet      bool          // log the group's routes quietly
+	ops        bool          // the group's routes are operational endpoints, see OpsGroup
+	children   []*RouteGroup // the groups added with AddGroup, see Router.Validate
+
+	errorFormatter ErrorFormatter
+	encoder        ResponseEncoderFunc // see ResponseEncoder
+	domain         string              // see Domain
 }
 
 type httpRouteHandler struct {
 	Method  string
 	Path    string
 	Handler HandlerFunc
+	groups  []*RouteGroup // every group the route belongs to, used to determine if it is enabled
+
+	// middleware are the layers of the route's groups, innermost first, which wrapped applies to Handler.
+	// Routes added by the same group share their groups and middleware slices, so they must never be modified
+	middleware []Middleware
+	origins    []*RouteGroup // the group that added each of middleware, see Router.ExplainRoute
+}
+
+// chainKey identifies routes that share their groups and middleware slices
+type chainKey struct {
+	groups        **RouteGroup
+	groupsLen     int
+	middleware    *Middleware
+	middlewareLen int
 }
 
 type wsRouteHandler struct {
@@ -86,7 +112,9 @@ func (g *RouteGroup) WebSocket(path string, handler WebSocketHandlerFunc) {
 // the subgroup's prefix is added to all of the routes it contains,
 // with the resulting path being "/group.prefix/subgroup.prefix/route/path/here"
 func (g *RouteGroup) AddGroup(group *RouteGroup) {
+	g.children = append(g.children, group)
 	g.httpRoutes = append(g.httpRoutes, group.httpRouteHandlers()...)
+	g.assets = append(g.assets, group.assetMounts()...)
 }
 
 // WithMiddlewares takes a list of Middlewares and will apply all of them to every handler in the group. Like in the
@@ -100,27 +128,106 @@ func (g *RouteGroup) WithMiddlewares(middleware ...Middleware) *RouteGroup {
 	return g
 }
 
-// httpRouteHandlers computes the "full" path for each handler, and creates
-// a HandlerFunc that chains together the group's middlewares
-// before calling the inner HandlerFunc. It can be called 'recursively'
-// since groups can be added to groups
+// httpRouteHandlers computes the "full" path for each handler, along with the chain of group middlewares
+// that wrapped applies before calling the inner HandlerFunc. It can be called 'recursively' since groups
+// can be added to groups, so the middleware captured by each call is what the group has at that time
 func (g *RouteGroup) httpRouteHandlers() []httpRouteHandler {
 	routes := make([]httpRouteHandler, len(g.httpRoutes))
+	prefix := ensureLeadingSlash(g.prefix)
+
+	// routes added by the same subgroup (or directly to this group) have identical chains, which
+	// are composed once and shared instead of being built for each route
+	type chain struct {
+		groups     []*RouteGroup
+		middleware []Middleware
+		origins    []*RouteGroup
+	}
+
+	chains := map[chainKey]chain{}
 
 	for i, r := range g.httpRoutes {
-		fullPath := fmt.Sprintf("%s%s", ensureLeadingSlash(g.prefix), ensureLeadingSlash(r.Path))
-		augR := httpRouteHandler{
-			Method:  r.Method,
-			Path:    fullPath,
-			Handler: WrapHandler(r.Handler, g.middleware...),
+		key := r.chainKey()
+
+		c, ok := chains[key]
+		if !ok {
+			c.groups = make([]*RouteGroup, 0, len(r.groups)+1)
+			c.groups = append(append(c.groups, r.groups...), g)
+
+			c.middleware = make([]Middleware, 0, len(r.middleware)+len(g.middleware))
+			c.middleware = append(append(c.middleware, r.middleware...), g.middleware...)
+
+			c.origins = make([]*RouteGroup, 0, len(c.middleware))
+			c.origins = append(c.origins, r.origins...)
+			for range g.middleware {
+				c.origins = append(c.origins, g)
+			}
+
+			chains[key] = c
 		}
 
-		routes[i] = augR
+		routes[i] = httpRouteHandler{
+			Method:     r.Method,
+			Path:       prefix + ensureLeadingSlash(r.Path),
+			Handler:    r.Handler,
+			groups:     c.groups,
+			middleware: c.middleware,
+			origins:    c.origins,
+		}
 	}
 
 	return routes
 }
 
+// chainKey returns the identity of the route's groups and middleware slices
+func (r httpRouteHandler) chainKey() chainKey {
+	key := chainKey{groupsLen: len(r.groups), middlewareLen: len(r.middleware)}
+
+	if len(r.groups) > 0 {
+		key.groups = &r.groups[0]
+	}
+
+	if len(r.middleware) > 0 {
+		key.middleware = &r.middleware[0]
+	}
+
+	return key
+}
+
+// inGroup returns true if any of the route's groups satisfies fn
+func (r httpRouteHandler) inGroup(fn func(g *RouteGroup) bool) bool {
+	for _, g := range r.groups {
+		if fn(g) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// wrapped returns the route's handler wrapped in the middleware of its groups
+func (r httpRouteHandler) wrapped() HandlerFunc {
+	return WrapHandler(r.Handler, r.middleware...)
+}
+
+// lazy returns a HandlerFunc that wraps the route's handler when it handles its first request,
+// so that routes which are never requested don't build their chain of middleware
+func (r httpRouteHandler) lazy() HandlerFunc {
+	if len(r.middleware) == 0 {
+		return r.Handler
+	}
+
+	var once sync.Once
+	var handler HandlerFunc
+
+	return func(w http.ResponseWriter, req *http.Request, ctx *Ctx) error {
+		once.Do(func() {
+			handler = r.wrapped()
+		})
+
+		return handler(w, req, ctx)
+	}
+}
+
 func (g *RouteGroup) addHttpRouteHandler(method string, path string, handler HandlerFunc) {
 	rh := httpRouteHandler{
 		Method:  method,
@@ -0,0 +1,325 @@
+package vk
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultHealthTimeout  = 5 * time.Second
+	defaultHealthInterval = 10 * time.Second
+	defaultHealthJitter   = 0.1
+)
+
+// HealthStatus is the state of a health check
+type HealthStatus string
+
+const (
+	HealthOK      HealthStatus = "ok"
+	HealthFailing HealthStatus = "failing"
+	HealthUnknown HealthStatus = "unknown" // the check hasn't completed yet, or its last result is too old to trust
+)
+
+// HealthCheck is a named probe of something the server depends on, such as a database ping
+type HealthCheck struct {
+	Name  string
+	Check func(ctx context.Context) error
+
+	// Timeout is how long the probe may take before it is cancelled and counted as failing, 5s by default
+	Timeout time.Duration
+
+	// Interval is how long a result is cached (its TTL) and how often the probe runs in the background, 10s by default
+	Interval time.Duration
+
+	// Staleness is how old a result can get, if the probe stops completing, before the check is reported as
+	// unknown. It is 3 intervals by default
+	Staleness time.Duration
+
+	// Critical checks flip readiness when they aren't ok, others only annotate the report
+	Critical bool
+}
+
+// HealthOptions configures a Health
+type HealthOptions struct {
+	// Jitter is the fraction of each check's Interval by which its schedule is randomly offset, so that a fleet of
+	// servers doesn't probe a shared dependency in lockstep. It defaults to 0.1
+	Jitter float64
+
+	// Now can be replaced for testing, it is used to timestamp results and measure latency
+	Now func() time.Time
+
+	// Degradation grades the readiness of a server whose critical checks pass, such as Server.Degradation. The
+	// report then includes its state and score, and is served with the status of its state
+	Degradation *Degradation
+}
+
+// HealthCheckReport is the state of one check in a HealthReport
+type HealthCheckReport struct {
+	Name      string       `json:"name"`
+	Status    HealthStatus `json:"status"`
+	Critical  bool         `json:"critical"`
+	LatencyMs int64        `json:"latency_ms"`
+	AgeMs     int64        `json:"age_ms"`
+	Error     string       `json:"error,omitempty"`
+}
+
+// HealthReport is the readiness of the server and the state of each of its checks
+type HealthReport struct {
+	Ready       bool                `json:"ready"`
+	Checks      []HealthCheckReport `json:"checks"`
+	Degradation *DegradationReport  `json:"degradation,omitempty"`
+}
+
+// healthResult is the outcome of a check's most recent probe
+type healthResult struct {
+	err     error
+	at      time.Time
+	latency time.Duration
+}
+
+// healthState caches the result of a check, and ensures that only one of its probes runs at a time
+type healthState struct {
+	HealthCheck
+
+	lock    sync.Mutex
+	result  *healthResult
+	probing bool
+}
+
+// Health runs health checks in the background and serves their cached results, so that frequent readiness
+// probes never wait for or add load to the dependencies being checked
+type Health struct {
+	opts   HealthOptions
+	checks []*healthState
+}
+
+// NewHealth creates a Health with the given checks
+func NewHealth(opts HealthOptions, checks ...HealthCheck) *Health {
+	if opts.Jitter <= 0 || opts.Jitter >= 1 {
+		opts.Jitter = defaultHealthJitter
+	}
+
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+
+	h := &Health{opts: opts}
+
+	for _, c := range checks {
+		if c.Timeout <= 0 {
+			c.Timeout = defaultHealthTimeout
+		}
+
+		if c.Interval <= 0 {
+			c.Interval = defaultHealthInterval
+		}
+
+		if c.Staleness <= 0 {
+			c.Staleness = 3 * c.Interval
+		}
+
+		h.checks = append(h.checks, &healthState{HealthCheck: c})
+	}
+
+	return h
+}
+
+// Run probes each check on its interval until ctx is done, starting each at a random point within its first interval
+func (h *Health) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+
+	for _, c := range h.checks {
+		wg.Add(1)
+
+		go func(c *healthState) {
+			defer wg.Done()
+
+			timer := time.NewTimer(time.Duration(rand.Int63n(int64(c.Interval))))
+			defer timer.Stop()
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-timer.C:
+				}
+
+				h.probe(ctx, c)
+
+				timer.Reset(h.jittered(c.Interval))
+			}
+		}(c)
+	}
+
+	wg.Wait()
+}
+
+// Refresh probes every check whose cached result has expired, waiting for them to complete
+func (h *Health) Refresh(ctx context.Context) {
+	var wg sync.WaitGroup
+
+	for _, c := range h.checks {
+		if !h.expired(c) {
+			continue
+		}
+
+		wg.Add(1)
+
+		go func(c *healthState) {
+			defer wg.Done()
+			h.probe(ctx, c)
+		}(c)
+	}
+
+	wg.Wait()
+}
+
+// Report returns the cached state of every check without waiting for any probes. Checks whose results have
+// expired are probed in the background, for the benefit of the next report
+func (h *Health) Report() HealthReport {
+	report := HealthReport{
+		Ready:  true,
+		Checks: make([]HealthCheckReport, len(h.checks)),
+	}
+
+	now := h.opts.Now()
+
+	for i, c := range h.checks {
+		if h.expired(c) {
+			go h.probe(context.Background(), c)
+		}
+
+		c.lock.Lock()
+		result := c.result
+		c.lock.Unlock()
+
+		r := HealthCheckReport{Name: c.Name, Status: HealthUnknown, Critical: c.Critical}
+
+		if result != nil {
+			age := now.Sub(result.at)
+
+			r.LatencyMs = result.latency.Milliseconds()
+			r.AgeMs = age.Milliseconds()
+
+			switch {
+			case age > c.Staleness:
+				r.Error = "last result is stale"
+			case result.err != nil:
+				r.Status = HealthFailing
+				r.Error = result.err.Error()
+			default:
+				r.Status = HealthOK
+			}
+		}
+
+		if c.Critical && r.Status != HealthOK {
+			report.Ready = false
+		}
+
+		report.Checks[i] = r
+	}
+
+	if h.opts.Degradation != nil {
+		degradation := h.opts.Degradation.Evaluate()
+		report.Degradation = &degradation
+
+		if degradation.State == ReadinessUnhealthy {
+			report.Ready = false
+		}
+	}
+
+	return report
+}
+
+// Handler responds with the HealthReport, with a 503 status if the server isn't ready. With a Degradation, a
+// server whose critical checks pass is served with the status of its graded state
+func (h *Health) Handler() HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request, ctx *Ctx) error {
+		report := h.Report()
+
+		status := http.StatusOK
+		if report.Degradation != nil {
+			status = report.Degradation.Status
+		}
+
+		if !report.Ready && status < http.StatusInternalServerError {
+			status = http.StatusServiceUnavailable
+		}
+
+		return RespondJSON(ctx.Context, w, report, status)
+	}
+}
+
+// RegisterAdmin mounts GET /ready on the admin router, serving the HealthReport
+func (h *Health) RegisterAdmin(r *Router) {
+	r.GET("/ready", h.Handler())
+}
+
+// expired returns true if the check has no result younger than its interval and isn't already being probed
+func (h *Health) expired(c *healthState) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return !c.probing && (c.result == nil || h.opts.Now().Sub(c.result.at) >= c.Interval)
+}
+
+// probe runs the check and caches its result, unless it is already being probed
+func (h *Health) probe(ctx context.Context, c *healthState) {
+	c.lock.Lock()
+	if c.probing {
+		c.lock.Unlock()
+		return
+	}
+
+	c.probing = true
+	c.lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+
+	start := h.opts.Now()
+
+	err := runHealthCheck(ctx, c.Check)
+
+	result := &healthResult{err: err, at: h.opts.Now()}
+	result.latency = result.at.Sub(start)
+
+	c.lock.Lock()
+	c.result = result
+	c.probing = false
+	c.lock.Unlock()
+}
+
+// runHealthCheck runs check, returning when it does or once ctx is done, whichever is first
+func runHealthCheck(ctx context.Context, check func(ctx context.Context) error) error {
+	done := make(chan error, 1)
+
+	go func() {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				done <- errors.Errorf("check panicked: %v", recovered)
+			}
+		}()
+
+		done <- check(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "check timed out")
+	}
+}
+
+// jittered returns d offset randomly by up to the Jitter fraction of it in either direction
+func (h *Health) jittered(d time.Duration) time.Duration {
+	spread := float64(d) * h.opts.Jitter
+
+	return d + time.Duration(spread*(2*rand.Float64()-1))
+}
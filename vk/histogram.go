@@ -0,0 +1,155 @@
+package vk
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// histogramMin is the upper bound of a LatencyHistogram's first bucket
+	histogramMin = 100 * time.Microsecond
+	// histogramGrowth is the ratio between the bounds of consecutive buckets, which limits the error of a quantile
+	// to about 10%
+	histogramGrowth = 1.1
+	// histogramBuckets covers latencies up to about an hour, longer ones are counted in an overflow bucket
+	histogramBuckets = 184
+)
+
+// histogramBounds are the upper bounds of the buckets of every LatencyHistogram
+var histogramBounds = func() [histogramBuckets]time.Duration {
+	var bounds [histogramBuckets]time.Duration
+
+	bound := float64(histogramMin)
+	for i := range bounds {
+		bounds[i] = time.Duration(bound)
+		bound *= histogramGrowth
+	}
+
+	return bounds
+}()
+
+// LatencyHistogram counts durations in fixed, exponentially sized buckets, so that its memory use is the same
+// however many it records. Its zero value is ready to use, and it is safe for concurrent use
+type LatencyHistogram struct {
+	counts   [histogramBuckets + 1]uint64
+	total    uint64
+	overflow int64 // the longest duration beyond the last bucket, as nanoseconds
+}
+
+// Observe records a duration
+func (h *LatencyHistogram) Observe(d time.Duration) {
+	i := bucketFor(d)
+	if i == histogramBuckets {
+		for {
+			longest := atomic.LoadInt64(&h.overflow)
+			if int64(d) <= longest || atomic.CompareAndSwapInt64(&h.overflow, longest, int64(d)) {
+				break
+			}
+		}
+	}
+
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.total, 1)
+}
+
+// merge adds the durations recorded by other
+func (h *LatencyHistogram) merge(other *LatencyHistogram) {
+	for i := range other.counts {
+		if count := atomic.LoadUint64(&other.counts[i]); count > 0 {
+			atomic.AddUint64(&h.counts[i], count)
+		}
+	}
+
+	atomic.AddUint64(&h.total, atomic.LoadUint64(&other.total))
+
+	for longest := atomic.LoadInt64(&other.overflow); ; {
+		current := atomic.LoadInt64(&h.overflow)
+		if longest <= current || atomic.CompareAndSwapInt64(&h.overflow, current, longest) {
+			break
+		}
+	}
+}
+
+// Count returns the number of durations recorded
+func (h *LatencyHistogram) Count() uint64 {
+	return atomic.LoadUint64(&h.total)
+}
+
+// Quantile returns an estimate of the q quantile (between 0 and 1) of the recorded durations, interpolated within
+// the bucket it falls in, or 0 if none have been recorded
+func (h *LatencyHistogram) Quantile(q float64) time.Duration {
+	var counts [histogramBuckets + 1]uint64
+
+	var total uint64
+	for i := range counts {
+		counts[i] = atomic.LoadUint64(&h.counts[i])
+		total += counts[i]
+	}
+
+	if total == 0 {
+		return 0
+	}
+
+	q = math.Max(0, math.Min(1, q))
+	rank := q * float64(total)
+
+	var seen uint64
+	for i, count := range counts {
+		if count == 0 || float64(seen+count) < rank {
+			seen += count
+			continue
+		}
+
+		lower, upper := bucketBounds(i)
+		if i == histogramBuckets {
+			upper = time.Duration(atomic.LoadInt64(&h.overflow))
+		}
+
+		position := (rank - float64(seen)) / float64(count)
+
+		return lower + time.Duration(position*float64(upper-lower))
+	}
+
+	return bucketUpper(histogramBuckets - 1)
+}
+
+// bucketFor returns the index of the bucket that d is counted in
+func bucketFor(d time.Duration) int {
+	if d <= histogramMin {
+		return 0
+	}
+
+	i := int(math.Ceil(math.Log(float64(d)/float64(histogramMin)) / math.Log(histogramGrowth)))
+	if i > histogramBuckets {
+		i = histogramBuckets
+	}
+
+	// rounding can put d one bucket off its bounds
+	for i > 0 && d <= histogramBounds[i-1] {
+		i--
+	}
+
+	for i < histogramBuckets && d > histogramBounds[i] {
+		i++
+	}
+
+	return i
+}
+
+// bucketBounds returns the lower and upper bounds of bucket i
+func bucketBounds(i int) (time.Duration, time.Duration) {
+	if i == 0 {
+		return 0, histogramBounds[0]
+	}
+
+	return histogramBounds[i-1], bucketUpper(i)
+}
+
+func bucketUpper(i int) time.Duration {
+	if i >= histogramBuckets {
+		return histogramBounds[histogramBuckets-1]
+	}
+
+	return histogramBounds[i]
+}
@@ -0,0 +1,578 @@
+package vk
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultHubQueueSize    = 256
+	defaultHubSendBuffer   = 16
+	defaultHubWriteTimeout = 10 * time.Second
+	defaultHubShards       = 16
+)
+
+var (
+	// ErrNoNotifier is returned by Ctx.Notify if the server has no Notifier, see UseNotifier
+	ErrNoNotifier = errors.New("no notifier is configured")
+
+	// ErrNotifyQueueFull is returned when a notification is dropped because the Hub's queue is full
+	ErrNotifyQueueFull = errors.New("notification queue is full")
+)
+
+// Notifier delivers notifications published by handlers with Ctx.Notify, such as to websocket subscribers
+type Notifier interface {
+	Notify(topic string, payload interface{}) error
+}
+
+// HubEncoder serializes a payload for the connections that negotiated a subprotocol, returning the data and its
+// websocket message type (websocket.TextMessage or websocket.BinaryMessage)
+type HubEncoder func(payload interface{}) ([]byte, int, error)
+
+// HubConn is a connection that a Hub writes to, such as a *websocket.Conn
+type HubConn interface {
+	Subprotocol() string
+	SetWriteDeadline(t time.Time) error
+	WritePreparedMessage(msg *websocket.PreparedMessage) error
+	Close() error
+}
+
+// HubOptions configures a Hub
+type HubOptions struct {
+	// QueueSize is the number of notifications that can wait to be fanned out, 256 by default
+	QueueSize int
+
+	// SendBuffer is the number of messages that can wait to be written to each connection, 16 by default
+	SendBuffer int
+
+	// WriteTimeout is how long a write to a connection may take before it is closed, 10s by default
+	WriteTimeout time.Duration
+
+	// Encoders serialize payloads for the connections that negotiated each subprotocol, such as a msgpack encoder
+	// for "msgpack". Connections without an encoder receive JSON
+	Encoders map[string]HubEncoder
+
+	// DisconnectSlow closes a connection whose send buffer is full, rather than dropping the messages that don't fit
+	DisconnectSlow bool
+
+	// Shards is the number of shards that rooms are spread over, each with its own lock, 16 by default
+	Shards int
+
+	// Resume makes the connections joined with JoinSession resumable after they drop, see HubResumeOptions
+	Resume HubResumeOptions
+}
+
+// HubStats reports the activity of a Hub
+type HubStats struct {
+	Rooms            int    `json:"rooms"`
+	Connections      int    `json:"connections"`
+	Published        uint64 `json:"published"`         // notifications fanned out
+	Encoded          uint64 `json:"encoded"`           // payloads serialized, once per encoding used in a room
+	Dropped          uint64 `json:"dropped"`           // notifications dropped because the queue was full
+	DroppedSlow      uint64 `json:"dropped_slow"`      // messages not sent to connections whose send buffer was full
+	DisconnectedSlow uint64 `json:"disconnected_slow"` // connections closed because their send buffer was full
+
+	Sessions        int    `json:"sessions"`         // resumable sessions, connected or not
+	ReplayBytes     int64  `json:"replay_bytes"`     // the size of the messages kept for sessions
+	Resumed         uint64 `json:"resumed"`          // sessions resumed by a reconnecting client
+	ResumeExpired   uint64 `json:"resume_expired"`   // resume tokens presented for sessions that couldn't be resumed
+	SessionsExpired uint64 `json:"sessions_expired"` // sessions removed after being disconnected for the TTL
+	SessionsEvicted uint64 `json:"sessions_evicted"` // sessions removed to stay within MaxSessions or MaxBytes
+}
+
+// notification is a published message waiting to be fanned out
+type notification struct {
+	topic   string
+	payload interface{}
+}
+
+// hubMessage is a message waiting to be written to a connection
+type hubMessage struct {
+	msg *websocket.PreparedMessage
+	seq uint64 // the message's position in its session, or 0 if the connection isn't resumable
+}
+
+// hubConn is a connection in one of the Hub's rooms, whose messages are written by its own goroutine
+type hubConn struct {
+	conn     HubConn
+	room     string
+	encoding string      // the subprotocol whose encoder is used, or empty for JSON
+	session  *hubSession // set if the connection is resumable
+	send     chan hubMessage
+	leave    func()
+	slow     int32 // the connection is being disconnected for falling behind
+}
+
+// hubShard holds some of the Hub's rooms, so that joining and fanning out in different rooms rarely contend
+type hubShard struct {
+	lock     sync.RWMutex
+	rooms    map[string]map[*hubConn]struct{}
+	detached map[string]map[*hubSession]struct{} // the disconnected sessions of each room, which keep its messages
+}
+
+// Hub fans notifications out to the websocket connections in its rooms, where a notification's topic is the room.
+// It is a Notifier, so handlers that only have a Ctx can publish to it (see UseNotifier and Ctx.Notify).
+//
+// Notify never blocks: notifications are queued and fanned out by Run, and are dropped when the queue is full. Each
+// payload is serialized once per encoding (see HubOptions.Encoders), however many connections receive it, and
+// messages are delivered to each connection in the order they were published. A connection that doesn't keep up
+// misses the messages that don't fit in its send buffer (or is disconnected, see HubOptions.DisconnectSlow) rather
+// than slowing down the others
+type Hub struct {
+	opts   HubOptions
+	queue  chan notification
+	shards []hubShard
+
+	sessionsLock sync.Mutex
+	sessions     map[string]*hubSession
+
+	published        uint64
+	encoded          uint64
+	dropped          uint64
+	droppedSlow      uint64
+	disconnectedSlow uint64
+	replayBytes      int64
+	resumed          uint64
+	resumeExpired    uint64
+	sessionsExpired  uint64
+	sessionsEvicted  uint64
+}
+
+// NewHub creates a Hub, which delivers notifications once Run is called
+func NewHub(opts HubOptions) *Hub {
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = defaultHubQueueSize
+	}
+
+	if opts.SendBuffer <= 0 {
+		opts.SendBuffer = defaultHubSendBuffer
+	}
+
+	if opts.WriteTimeout <= 0 {
+		opts.WriteTimeout = defaultHubWriteTimeout
+	}
+
+	if opts.Shards <= 0 {
+		opts.Shards = defaultHubShards
+	}
+
+	if opts.Resume.TTL <= 0 {
+		opts.Resume.TTL = defaultHubSessionTTL
+	}
+
+	if opts.Resume.MaxMessages <= 0 {
+		opts.Resume.MaxMessages = defaultHubReplayMessages
+	}
+
+	if opts.Resume.MaxSessions <= 0 {
+		opts.Resume.MaxSessions = defaultHubMaxSessions
+	}
+
+	if opts.Resume.MaxBytes <= 0 {
+		opts.Resume.MaxBytes = defaultHubMaxReplayBytes
+	}
+
+	if opts.Resume.Now == nil {
+		opts.Resume.Now = time.Now
+	}
+
+	h := &Hub{
+		opts:     opts,
+		queue:    make(chan notification, opts.QueueSize),
+		shards:   make([]hubShard, opts.Shards),
+		sessions: map[string]*hubSession{},
+	}
+
+	for i := range h.shards {
+		h.shards[i].rooms = map[string]map[*hubConn]struct{}{}
+		h.shards[i].detached = map[string]map[*hubSession]struct{}{}
+	}
+
+	return h
+}
+
+// Notify queues payload to be sent to the connections in the topic's room. A []byte payload is sent as it is,
+// anything else is marshalled to JSON. It returns ErrNotifyQueueFull if the notification was dropped
+func (h *Hub) Notify(topic string, payload interface{}) error {
+	select {
+	case h.queue <- notification{topic: topic, payload: payload}:
+		return nil
+	default:
+		atomic.AddUint64(&h.dropped, 1)
+		return ErrNotifyQueueFull
+	}
+}
+
+// Join adds a connection to a room, returning a function that removes it. The Hub writes the room's messages
+// to the connection, so the caller must not write to it too; it should read from the connection until it is
+// closed (which also handles pings), and then leave
+func (h *Hub) Join(room string, conn *websocket.Conn) (leave func()) {
+	return h.JoinConn(room, conn)
+}
+
+// JoinConn adds a HubConn to a room, see Join. Its messages are serialized with the encoder of its subprotocol
+func (h *Hub) JoinConn(room string, conn HubConn) (leave func()) {
+	c := h.newHubConn(conn, nil)
+
+	shard := h.shard(room)
+
+	shard.lock.Lock()
+	h.addToRoom(shard, room, c)
+	shard.lock.Unlock()
+
+	go h.write(c, nil)
+
+	return c.leave
+}
+
+// newHubConn creates the Hub's side of a connection, whose leave function removes it from its room. A session's
+// connection leaves its session behind in the room, to keep its messages until it is resumed
+func (h *Hub) newHubConn(conn HubConn, session *hubSession) *hubConn {
+	c := &hubConn{
+		conn:     conn,
+		encoding: h.encodingOf(conn),
+		session:  session,
+		send:     make(chan hubMessage, h.opts.SendBuffer),
+	}
+
+	var once sync.Once
+
+	c.leave = func() {
+		once.Do(func() { h.leaveRoom(c) })
+	}
+
+	return c
+}
+
+// addToRoom adds a connection to a room. The shard's lock must be held
+func (h *Hub) addToRoom(shard *hubShard, room string, c *hubConn) {
+	if shard.rooms[room] == nil {
+		shard.rooms[room] = map[*hubConn]struct{}{}
+	}
+
+	shard.rooms[room][c] = struct{}{}
+	c.room = room
+}
+
+// leaveRoom removes a connection from its room and stops its writer
+func (h *Hub) leaveRoom(c *hubConn) {
+	shard := h.shard(c.room)
+
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	delete(shard.rooms[c.room], c)
+	if len(shard.rooms[c.room]) == 0 {
+		delete(shard.rooms, c.room)
+	}
+
+	if s := c.session; s != nil {
+		s.lock.Lock()
+		if s.conn == c && !s.gone {
+			s.conn = nil
+			s.detachedAt = h.opts.Resume.Now()
+
+			if shard.detached[c.room] == nil {
+				shard.detached[c.room] = map[*hubSession]struct{}{}
+			}
+
+			shard.detached[c.room][s] = struct{}{}
+		}
+		s.lock.Unlock()
+	}
+
+	close(c.send)
+}
+
+// write writes pending and then the messages sent to the connection, until it leaves. Resumable connections skip
+// the messages that were already in pending, and mark those they write as delivered to their session
+func (h *Hub) write(c *hubConn, pending []hubMessage) {
+	failed := false
+	var last uint64
+
+	deliver := func(m hubMessage) {
+		if failed || atomic.LoadInt32(&c.slow) == 1 {
+			return
+		}
+
+		_ = c.conn.SetWriteDeadline(time.Now().Add(h.opts.WriteTimeout))
+
+		if err := c.conn.WritePreparedMessage(m.msg); err != nil {
+			failed = true
+			c.leave()
+			c.conn.Close()
+
+			return
+		}
+
+		if c.session != nil && m.seq != 0 {
+			c.session.delivered(h, c, m.seq)
+		}
+	}
+
+	for _, m := range pending {
+		deliver(m)
+
+		if m.seq > last {
+			last = m.seq
+		}
+	}
+
+	for m := range c.send {
+		if m.seq != 0 && m.seq <= last {
+			continue
+		}
+
+		deliver(m)
+	}
+
+	if atomic.LoadInt32(&c.slow) == 1 {
+		c.conn.Close()
+	}
+}
+
+// encodingOf returns the subprotocol of a connection if the Hub has an encoder for it, or empty for JSON
+func (h *Hub) encodingOf(conn HubConn) string {
+	if _, ok := h.opts.Encoders[conn.Subprotocol()]; ok {
+		return conn.Subprotocol()
+	}
+
+	return ""
+}
+
+// Subscribers returns the number of connections in a room
+func (h *Hub) Subscribers(room string) int {
+	shard := h.shard(room)
+
+	shard.lock.RLock()
+	defer shard.lock.RUnlock()
+
+	return len(shard.rooms[room])
+}
+
+// Run fans out queued notifications until ctx is done. If sessions are resumable, it also removes those that expired
+func (h *Hub) Run(ctx context.Context) {
+	var sweep <-chan time.Time
+
+	if len(h.opts.Resume.Secret) > 0 {
+		ticker := time.NewTicker(defaultHubSessionSweepPeriod)
+		defer ticker.Stop()
+
+		sweep = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case n := <-h.queue:
+			atomic.AddUint64(&h.published, 1)
+			_ = h.Broadcast(n.topic, n.payload)
+		case <-sweep:
+			h.sweepSessions(h.opts.Resume.Now())
+		}
+	}
+}
+
+// Broadcast sends payload to the connections in a room straight away, in the caller's goroutine, rather than
+// queueing it like Notify. It blocks until the message has been handed to each connection's send buffer (not until
+// it has been written), and returns an error if the payload can't be serialized
+func (h *Hub) Broadcast(room string, payload interface{}) error {
+	shard := h.shard(room)
+
+	var slow []*hubConn
+	var kept bool
+
+	err := func() error {
+		shard.lock.RLock()
+		defer shard.lock.RUnlock()
+
+		conns := shard.rooms[room]
+		detached := shard.detached[room]
+
+		if len(conns) == 0 && len(detached) == 0 {
+			return nil
+		}
+
+		// each encoding is only serialized if a connection in the room uses it
+		messages := map[string]preparedMessage{}
+
+		prepared := func(encoding string) (preparedMessage, error) {
+			pm, ok := messages[encoding]
+			if !ok {
+				var err error
+				if pm, err = h.prepare(encoding, payload); err != nil {
+					return pm, err
+				}
+
+				messages[encoding] = pm
+			}
+
+			return pm, nil
+		}
+
+		var now time.Time
+		if len(h.opts.Resume.Secret) > 0 {
+			now = h.opts.Resume.Now()
+		}
+
+		// disconnected sessions keep the message until they are resumed
+		for s := range detached {
+			pm, err := prepared(s.encoding)
+			if err != nil {
+				return err
+			}
+
+			s.append(h, pm.msg, pm.size, now)
+			kept = true
+		}
+
+		for c := range conns {
+			pm, err := prepared(c.encoding)
+			if err != nil {
+				return err
+			}
+
+			msg := hubMessage{msg: pm.msg}
+			if c.session != nil {
+				msg.seq = c.session.append(h, pm.msg, pm.size, now)
+				kept = true
+			}
+
+			select {
+			case c.send <- msg:
+			default:
+				atomic.AddUint64(&h.droppedSlow, 1)
+
+				if h.opts.DisconnectSlow {
+					slow = append(slow, c)
+				}
+			}
+		}
+
+		return nil
+	}()
+
+	// leaving takes the shard's write lock, so slow connections are removed once it has been released
+	for _, c := range slow {
+		if atomic.CompareAndSwapInt32(&c.slow, 0, 1) {
+			atomic.AddUint64(&h.disconnectedSlow, 1)
+			c.leave()
+		}
+	}
+
+	if kept && atomic.LoadInt64(&h.replayBytes) > h.opts.Resume.MaxBytes {
+		h.enforceSessionLimits()
+	}
+
+	return err
+}
+
+// Stats returns the Hub's current state and counters
+func (h *Hub) Stats() HubStats {
+	stats := HubStats{}
+
+	for i := range h.shards {
+		shard := &h.shards[i]
+
+		shard.lock.RLock()
+		stats.Rooms += len(shard.rooms)
+		for _, conns := range shard.rooms {
+			stats.Connections += len(conns)
+		}
+		shard.lock.RUnlock()
+	}
+
+	stats.Published = atomic.LoadUint64(&h.published)
+	stats.Encoded = atomic.LoadUint64(&h.encoded)
+	stats.Dropped = atomic.LoadUint64(&h.dropped)
+	stats.DroppedSlow = atomic.LoadUint64(&h.droppedSlow)
+	stats.DisconnectedSlow = atomic.LoadUint64(&h.disconnectedSlow)
+
+	h.sessionsLock.Lock()
+	stats.Sessions = len(h.sessions)
+	h.sessionsLock.Unlock()
+
+	stats.ReplayBytes = atomic.LoadInt64(&h.replayBytes)
+	stats.Resumed = atomic.LoadUint64(&h.resumed)
+	stats.ResumeExpired = atomic.LoadUint64(&h.resumeExpired)
+	stats.SessionsExpired = atomic.LoadUint64(&h.sessionsExpired)
+	stats.SessionsEvicted = atomic.LoadUint64(&h.sessionsEvicted)
+
+	return stats
+}
+
+// RegisterAdmin mounts GET /hub on the admin router, reporting the hub's stats
+func (h *Hub) RegisterAdmin(r *Router) {
+	r.GET("/hub", func(w http.ResponseWriter, _ *http.Request, ctx *Ctx) error {
+		return RespondJSON(ctx.Context, w, h.Stats(), http.StatusOK)
+	})
+}
+
+// preparedMessage is a payload prepared for an encoding, along with its serialized size
+type preparedMessage struct {
+	msg  *websocket.PreparedMessage
+	size int
+}
+
+// prepare serializes payload with the encoder of a subprotocol (or as JSON if it is empty), unless it is a []byte
+func (h *Hub) prepare(encoding string, payload interface{}) (preparedMessage, error) {
+	data, ok := payload.([]byte)
+	messageType := websocket.TextMessage
+
+	if !ok {
+		var err error
+
+		if encoding == "" {
+			data, err = json.Marshal(payload)
+		} else {
+			data, messageType, err = h.opts.Encoders[encoding](payload)
+		}
+
+		if err != nil {
+			return preparedMessage{}, errors.Wrap(err, "failed to encode payload")
+		}
+
+		atomic.AddUint64(&h.encoded, 1)
+	}
+
+	msg, err := websocket.NewPreparedMessage(messageType, data)
+	if err != nil {
+		return preparedMessage{}, errors.Wrap(err, "failed to NewPreparedMessage")
+	}
+
+	return preparedMessage{msg: msg, size: len(data)}, nil
+}
+
+// shard returns the shard holding a room
+func (h *Hub) shard(room string) *hubShard {
+	// FNV-1a, inlined so that hashing doesn't allocate
+	hash := uint32(2166136261)
+	for i := 0; i < len(room); i++ {
+		hash ^= uint32(room[i])
+		hash *= 16777619
+	}
+
+	return &h.shards[hash%uint32(len(h.shards))]
+}
+
+// useNotifier sets the Notifier that the router's Ctxs publish to
+func (rt *Router) useNotifier(notifier Notifier) {
+	rt.notifier = notifier
+}
+
+// Notify publishes payload to topic using the server's Notifier, see UseNotifier
+func (c *Ctx) Notify(topic string, payload interface{}) error {
+	if c == nil || c.notifier == nil {
+		return ErrNoNotifier
+	}
+
+	return c.notifier.Notify(topic, payload)
+}
@@ -0,0 +1,441 @@
+package vk
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultHubSessionTTL         = 2 * time.Minute
+	defaultHubReplayMessages     = 100
+	defaultHubMaxSessions        = 10000
+	defaultHubMaxReplayBytes     = 64 << 20
+	defaultHubSessionSweepPeriod = 10 * time.Second
+
+	// HubResumeParam is the query parameter that a reconnecting client sends its resume token in, see ResumeToken
+	HubResumeParam = "resume"
+
+	// HubSessionStarted is the type of the first message on a new resumable connection
+	HubSessionStarted = "session"
+	// HubSessionResumed is the type of the first message on a resumed connection, which is followed by the messages
+	// that were missed
+	HubSessionResumed = "resumed"
+	// HubResumeExpired is the type of the first message on a connection whose token couldn't be resumed, because
+	// its session or some of its messages expired. The connection starts a new session, whose token it carries
+	HubResumeExpired = "resume_expired"
+)
+
+// HubResumeOptions configures resumable connections, see Hub.JoinSession
+type HubResumeOptions struct {
+	// Secret signs resume tokens, so that clients can't guess the tokens of other sessions. Sessions are only
+	// resumable if it is set
+	Secret []byte
+
+	// TTL is how long a disconnected session can be resumed, and how long a message is kept for it, 2m by default
+	TTL time.Duration
+
+	// MaxMessages is the number of undelivered messages kept for each session, 100 by default
+	MaxMessages int
+
+	// MaxSessions is the number of sessions kept, 10000 by default, and MaxBytes the total size of the messages kept
+	// for them, 64MB by default. Past either, the sessions that disconnected first are evicted
+	MaxSessions int
+	MaxBytes    int64
+
+	// Now returns the current time, time.Now by default
+	Now func() time.Time
+}
+
+// HubSessionMessage is the JSON text message that a Hub sends first on a resumable connection
+type HubSessionMessage struct {
+	Type     string `json:"type"`  // HubSessionStarted, HubSessionResumed or HubResumeExpired
+	Token    string `json:"token"` // presented by the client to resume the session after reconnecting
+	Replayed int    `json:"replayed,omitempty"`
+}
+
+// ResumeToken returns the resume token in the request's query, see HubResumeParam
+func ResumeToken(r *http.Request) string {
+	return r.URL.Query().Get(HubResumeParam)
+}
+
+// replayMessage is a message kept for a session until it has been written to one of its connections
+type replayMessage struct {
+	hubMessage
+	size int
+	at   time.Time
+}
+
+// hubSession is the state of a resumable connection, which outlives the connection by the TTL
+type hubSession struct {
+	id       string
+	room     string
+	encoding string
+
+	lock       sync.Mutex
+	conn       *hubConn // nil while disconnected
+	detachedAt time.Time
+	pending    []replayMessage // undelivered messages, oldest first
+	nextSeq    uint64
+	lost       bool // undelivered messages were dropped, so the session can't be resumed
+	gone       bool // the session expired or was evicted
+}
+
+// append keeps a message for the session, dropping the oldest ones past the limits, and returns its sequence number
+func (s *hubSession) append(h *Hub, msg *websocket.PreparedMessage, size int, now time.Time) uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.gone {
+		return 0
+	}
+
+	s.nextSeq++
+	s.pending = append(s.pending, replayMessage{hubMessage: hubMessage{msg: msg, seq: s.nextSeq}, size: size, at: now})
+	atomic.AddInt64(&h.replayBytes, int64(size))
+
+	s.trim(h, now)
+
+	return s.nextSeq
+}
+
+// trim drops the messages past the session's limits. The session's lock must be held
+func (s *hubSession) trim(h *Hub, now time.Time) {
+	resume := h.opts.Resume
+
+	drop := 0
+	for drop < len(s.pending) && (len(s.pending)-drop > resume.MaxMessages || now.Sub(s.pending[drop].at) > resume.TTL) {
+		drop++
+	}
+
+	if drop > 0 {
+		s.lost = true
+		s.release(h, drop)
+	}
+}
+
+// delivered drops the messages up to seq, once they have been written to the session's current connection
+func (s *hubSession) delivered(h *Hub, c *hubConn, seq uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.conn != c {
+		return
+	}
+
+	n := 0
+	for n < len(s.pending) && s.pending[n].seq <= seq {
+		n++
+	}
+
+	s.release(h, n)
+}
+
+// release drops the first n pending messages. The session's lock must be held
+func (s *hubSession) release(h *Hub, n int) {
+	var size int64
+	for _, m := range s.pending[:n] {
+		size += int64(m.size)
+	}
+
+	s.pending = append(s.pending[:0], s.pending[n:]...)
+	atomic.AddInt64(&h.replayBytes, -size)
+}
+
+// expire marks a disconnected session as gone and drops its messages, returning false if it is connected
+func (s *hubSession) expire(h *Hub) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.conn != nil {
+		return false
+	}
+
+	s.gone = true
+	s.release(h, len(s.pending))
+
+	return true
+}
+
+// JoinSession adds a connection to a room like JoinConn, as a resumable session (see HubOptions.Resume). token is
+// the token the client presented after reconnecting (such as with ResumeToken, or in its first message), or empty
+// for a new session.
+//
+// The first message on the connection is a HubSessionMessage with the session's token. Messages published to the
+// room are kept for the session until they have been written, so if the connection drops, a client that reconnects
+// within the TTL receives the messages it missed, in order, before live messages resume. If its session or any of
+// its undelivered messages expired, it gets a HubResumeExpired message and a new session instead. Without a Secret,
+// JoinSession is the same as JoinConn
+func (h *Hub) JoinSession(room string, conn HubConn, token string) (leave func()) {
+	if len(h.opts.Resume.Secret) == 0 {
+		return h.JoinConn(room, conn)
+	}
+
+	encoding := h.encodingOf(conn)
+	now := h.opts.Resume.Now()
+
+	if token != "" {
+		if s := h.lookupSession(token, room, encoding); s != nil {
+			if c, replay, ok := h.resume(s, conn, now); ok {
+				atomic.AddUint64(&h.resumed, 1)
+
+				first := h.sessionMessage(HubSessionResumed, token, len(replay))
+
+				go h.write(c, append([]hubMessage{first}, replay...))
+
+				return c.leave
+			}
+
+			h.dropSession(s)
+		}
+
+		atomic.AddUint64(&h.resumeExpired, 1)
+	}
+
+	kind := HubSessionStarted
+	if token != "" {
+		kind = HubResumeExpired
+	}
+
+	c := h.startSession(room, encoding, conn)
+
+	go h.write(c, []hubMessage{h.sessionMessage(kind, h.sessionToken(c.session.id), 0)})
+
+	h.enforceSessionLimits()
+
+	return c.leave
+}
+
+// lookupSession returns the session that token identifies, if its signature is valid and it belongs to the room
+func (h *Hub) lookupSession(token, room, encoding string) *hubSession {
+	id, signature, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(h.signSession(id))) {
+		return nil
+	}
+
+	h.sessionsLock.Lock()
+	s := h.sessions[id]
+	h.sessionsLock.Unlock()
+
+	if s == nil || s.room != room || s.encoding != encoding {
+		return nil
+	}
+
+	return s
+}
+
+// resume attaches conn to a disconnected session, returning the messages it missed, or false if it can't be resumed.
+// A session that is still connected (because its client reconnected before its old connection failed) is taken over
+func (h *Hub) resume(s *hubSession, conn HubConn, now time.Time) (*hubConn, []hubMessage, bool) {
+	s.lock.Lock()
+	old := s.conn
+	s.lock.Unlock()
+
+	if old != nil {
+		old.leave()
+		old.conn.Close()
+	}
+
+	shard := h.shard(s.room)
+
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.gone || s.conn != nil || now.Sub(s.detachedAt) > h.opts.Resume.TTL {
+		return nil, nil, false
+	}
+
+	s.trim(h, now)
+
+	if s.lost {
+		return nil, nil, false
+	}
+
+	// the room is locked, so nothing can be published between taking the missed messages and joining
+	replay := make([]hubMessage, len(s.pending))
+	for i, m := range s.pending {
+		replay[i] = m.hubMessage
+	}
+
+	delete(shard.detached[s.room], s)
+	if len(shard.detached[s.room]) == 0 {
+		delete(shard.detached, s.room)
+	}
+
+	c := h.newHubConn(conn, s)
+	s.conn = c
+	h.addToRoom(shard, s.room, c)
+
+	return c, replay, true
+}
+
+// startSession registers a new session, and joins conn to its room as the session's connection
+func (h *Hub) startSession(room, encoding string, conn HubConn) *hubConn {
+	s := &hubSession{id: uuid.New().String(), room: room, encoding: encoding}
+
+	// the session is connected before it is registered, so that it can't be evicted first
+	c := h.newHubConn(conn, s)
+	s.conn = c
+
+	h.sessionsLock.Lock()
+	h.sessions[s.id] = s
+	h.sessionsLock.Unlock()
+
+	shard := h.shard(room)
+
+	shard.lock.Lock()
+	h.addToRoom(shard, room, c)
+	shard.lock.Unlock()
+
+	return c
+}
+
+// dropSession removes a session that can't be resumed
+func (h *Hub) dropSession(s *hubSession) {
+	if !s.expire(h) {
+		return
+	}
+
+	h.sessionsLock.Lock()
+	delete(h.sessions, s.id)
+	h.sessionsLock.Unlock()
+
+	h.undetach(s)
+}
+
+// undetach removes a session from its room's disconnected sessions
+func (h *Hub) undetach(s *hubSession) {
+	shard := h.shard(s.room)
+
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	delete(shard.detached[s.room], s)
+	if len(shard.detached[s.room]) == 0 {
+		delete(shard.detached, s.room)
+	}
+}
+
+// enforceSessionLimits evicts the sessions that disconnected first until the number of sessions and the size of their
+// messages are within the limits. Connected sessions are never evicted
+func (h *Hub) enforceSessionLimits() {
+	resume := h.opts.Resume
+
+	h.sessionsLock.Lock()
+
+	over := len(h.sessions) - resume.MaxSessions
+	overBytes := atomic.LoadInt64(&h.replayBytes) - resume.MaxBytes
+
+	if over <= 0 && overBytes <= 0 {
+		h.sessionsLock.Unlock()
+		return
+	}
+
+	type candidate struct {
+		s          *hubSession
+		detachedAt time.Time
+	}
+
+	candidates := []candidate{}
+
+	for _, s := range h.sessions {
+		s.lock.Lock()
+		if s.conn == nil {
+			candidates = append(candidates, candidate{s, s.detachedAt})
+		}
+		s.lock.Unlock()
+	}
+
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].detachedAt.Before(candidates[j].detachedAt) })
+
+	var evicted []*hubSession
+
+	for _, c := range candidates {
+		if over <= 0 && overBytes <= 0 {
+			break
+		}
+
+		before := atomic.LoadInt64(&h.replayBytes)
+
+		if c.s.expire(h) {
+			delete(h.sessions, c.s.id)
+			evicted = append(evicted, c.s)
+
+			over--
+			overBytes -= before - atomic.LoadInt64(&h.replayBytes)
+		}
+	}
+
+	h.sessionsLock.Unlock()
+
+	for _, s := range evicted {
+		h.undetach(s)
+	}
+
+	atomic.AddUint64(&h.sessionsEvicted, uint64(len(evicted)))
+}
+
+// sweepSessions removes the sessions that have been disconnected for longer than the TTL
+func (h *Hub) sweepSessions(now time.Time) {
+	var expired []*hubSession
+
+	h.sessionsLock.Lock()
+
+	for id, s := range h.sessions {
+		s.lock.Lock()
+		stale := s.conn == nil && now.Sub(s.detachedAt) > h.opts.Resume.TTL
+		s.lock.Unlock()
+
+		if stale && s.expire(h) {
+			delete(h.sessions, id)
+			expired = append(expired, s)
+		}
+	}
+
+	h.sessionsLock.Unlock()
+
+	for _, s := range expired {
+		h.undetach(s)
+	}
+
+	atomic.AddUint64(&h.sessionsExpired, uint64(len(expired)))
+}
+
+// sessionMessage prepares the HubSessionMessage that starts a resumable connection
+func (h *Hub) sessionMessage(kind, token string, replayed int) hubMessage {
+	data, _ := json.Marshal(HubSessionMessage{Type: kind, Token: token, Replayed: replayed})
+
+	msg, err := websocket.NewPreparedMessage(websocket.TextMessage, data)
+	if err != nil {
+		// only fails for invalid message types
+		panic(errors.Wrap(err, "failed to NewPreparedMessage"))
+	}
+
+	return hubMessage{msg: msg}
+}
+
+// sessionToken returns the signed token that resumes a session
+func (h *Hub) sessionToken(id string) string {
+	return id + "." + h.signSession(id)
+}
+
+func (h *Hub) signSession(id string) string {
+	mac := hmac.New(sha256.New, h.opts.Resume.Secret)
+	mac.Write([]byte(id))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,167 @@
+package vk
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// HeaderChecks selects the request header checks made before routing, see UseHeaderHygiene.
+//
+// net/http's server already rejects requests with conflicting Content-Length values, more than one Host header or
+// header names that aren't tokens, and drops the Content-Length of a chunked request, before they reach vk. The
+// first four checks therefore only apply to requests that reach the handler without its parsing, such as those built
+// in process or served by another HTTP implementation. DuplicateSingletons applies to every request.
+//
+// Obsolete line folding (a header continued on a line starting with a space or tab) isn't checked: net/http joins
+// the continuation onto the header's value with a space, so it can't be told apart from a value containing one. A
+// proxy in front of the server should reject or unfold it itself
+type HeaderChecks struct {
+	ConflictingContentLength          bool // more than one distinct Content-Length value
+	ContentLengthWithTransferEncoding bool // both Content-Length and Transfer-Encoding
+	DuplicateHost                     bool // more than one Host header
+	InvalidHeaderNames                bool // header names that aren't RFC 7230 tokens, such as those with spaces or colons
+	DuplicateSingletons               bool // more than one of a header that may only appear once, see singletonHeaders
+}
+
+// AllHeaderChecks returns HeaderChecks with every check enabled
+func AllHeaderChecks() HeaderChecks {
+	checks := HeaderChecks{
+		ConflictingContentLength:          true,
+		ContentLengthWithTransferEncoding: true,
+		DuplicateHost:                     true,
+		InvalidHeaderNames:                true,
+		DuplicateSingletons:               true,
+	}
+
+	return checks
+}
+
+// enabled returns true if any check is enabled
+func (h HeaderChecks) enabled() bool {
+	return h != HeaderChecks{}
+}
+
+// singletonHeaders may only appear once in a request, as a second value could be read by a proxy in front of the
+// server differently than by the server itself
+var singletonHeaders = []string{
+	"Authorization",
+	"Content-Type",
+	"Content-Encoding",
+	"Expect",
+	"Proxy-Authorization",
+	"Transfer-Encoding",
+}
+
+// useHeaderHygiene sets the checks the router makes on requests before routing them
+func (rt *Router) useHeaderHygiene(checks HeaderChecks) {
+	rt.headerChecks = checks
+}
+
+// checkHeaders rejects requests that fail the router's header checks with 400, returning false if it did. The
+// offending header names are logged, but never their values, which could contain credentials
+func (rt *Router) checkHeaders(w http.ResponseWriter, r *http.Request) bool {
+	if !rt.headerChecks.enabled() {
+		return true
+	}
+
+	check, names := rt.headerChecks.check(r)
+	if check == "" {
+		return true
+	}
+
+	rt.log.Warn("security: rejected request from", r.RemoteAddr, "that failed the", check, "header check:", strings.Join(names, ", "))
+
+	// whatever follows on the connection can't be trusted to be framed as the client intended
+	w.Header().Set("Connection", "close")
+
+	respondError(w, r, rt.unmatchedFormatter(r.URL.Path), E(http.StatusBadRequest, "malformed request headers"))
+
+	return false
+}
+
+// check returns the name of the first check that r fails and the headers involved, or an empty string if it passes
+func (h HeaderChecks) check(r *http.Request) (string, []string) {
+	if h.InvalidHeaderNames {
+		var invalid []string
+
+		for name := range r.Header {
+			if !isHeaderToken(name) {
+				invalid = append(invalid, name)
+			}
+		}
+
+		if len(invalid) > 0 {
+			sort.Strings(invalid)
+			return "invalid header names", invalid
+		}
+	}
+
+	if h.ConflictingContentLength && len(headerValues(r.Header, "Content-Length")) > 1 {
+		return "conflicting Content-Length", []string{"Content-Length"}
+	}
+
+	if h.ContentLengthWithTransferEncoding && len(r.Header.Values("Content-Length")) > 0 &&
+		(len(r.TransferEncoding) > 0 || len(r.Header.Values("Transfer-Encoding")) > 0) {
+		return "Content-Length with Transfer-Encoding", []string{"Content-Length", "Transfer-Encoding"}
+	}
+
+	// incoming requests have their Host header moved to r.Host, so any left in r.Header came from somewhere else
+	if hosts := r.Header.Values("Host"); h.DuplicateHost && (len(hosts) > 1 || (len(hosts) == 1 && hosts[0] != r.Host)) {
+		return "duplicate Host", []string{"Host"}
+	}
+
+	if h.DuplicateSingletons {
+		var duplicated []string
+
+		for _, name := range singletonHeaders {
+			if len(r.Header.Values(name)) > 1 {
+				duplicated = append(duplicated, name)
+			}
+		}
+
+		if len(duplicated) > 0 {
+			return "duplicate headers", duplicated
+		}
+	}
+
+	return "", nil
+}
+
+// headerValues returns the distinct comma-separated values of the header
+func headerValues(h http.Header, name string) []string {
+	seen := map[string]bool{}
+
+	var values []string
+
+	for _, value := range h.Values(name) {
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" && !seen[v] {
+				seen[v] = true
+				values = append(values, v)
+			}
+		}
+	}
+
+	return values
+}
+
+// isHeaderToken returns true if name is a token (RFC 7230, section 3.2.6), which header names must be
+func isHeaderToken(name string) bool {
+	if name == "" {
+		return false
+	}
+
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0:
+		default:
+			return false
+		}
+	}
+
+	return true
+}
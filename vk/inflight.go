@@ -0,0 +1,182 @@
+package vk
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/suborbital/vektor/vlog"
+)
+
+// InFlightRequest describes a request that is being handled
+type InFlightRequest struct {
+	RequestID string        `json:"request_id"`
+	Method    string        `json:"method"`
+	Route     string        `json:"route"` // the pattern of the route, i.e. /users/:id
+	Path      string        `json:"path"`
+	ClientIP  string        `json:"client_ip"`
+	Start     time.Time     `json:"start"`
+	Duration  time.Duration `json:"duration"`
+	Abandoned bool          `json:"abandoned,omitempty"` // the handler outlived its hard deadline, see UseHandlerTimeout
+}
+
+// InFlightRequests is a registry of the requests being handled by a server's routers, enabled with UseInFlightTracking
+type InFlightRequests struct {
+	lock    sync.Mutex
+	nextID  uint64
+	entries map[uint64]InFlightRequest
+}
+
+func newInFlightRequests() *InFlightRequests {
+	f := &InFlightRequests{
+		entries: map[uint64]InFlightRequest{},
+	}
+
+	return f
+}
+
+// Requests returns the requests currently being handled, oldest first
+func (f *InFlightRequests) Requests() []InFlightRequest {
+	if f == nil {
+		return []InFlightRequest{}
+	}
+
+	now := time.Now()
+
+	f.lock.Lock()
+
+	requests := make([]InFlightRequest, 0, len(f.entries))
+	for _, req := range f.entries {
+		req.Duration = now.Sub(req.Start)
+		requests = append(requests, req)
+	}
+
+	f.lock.Unlock()
+
+	sort.Slice(requests, func(i, j int) bool { return requests[i].Start.Before(requests[j].Start) })
+
+	return requests
+}
+
+// RegisterAdmin mounts GET /inflight on the admin router, reporting the requests currently being handled
+func (f *InFlightRequests) RegisterAdmin(r *Router) {
+	r.GET("/inflight", func(w http.ResponseWriter, _ *http.Request, ctx *Ctx) error {
+		return RespondJSON(ctx.Context, w, f.Requests(), http.StatusOK)
+	})
+}
+
+// inFlightEntry is a request's entry in the registry, which is a no-op if tracking is disabled
+type inFlightEntry struct {
+	f  *InFlightRequests
+	id uint64
+}
+
+// done removes the request once it has been handled
+func (e inFlightEntry) done() {
+	if e.f == nil {
+		return
+	}
+
+	e.f.lock.Lock()
+	delete(e.f.entries, e.id)
+	e.f.lock.Unlock()
+}
+
+// abandon flags the request as abandoned
+func (e inFlightEntry) abandon() {
+	if e.f == nil {
+		return
+	}
+
+	e.f.lock.Lock()
+	if req, ok := e.f.entries[e.id]; ok {
+		req.Abandoned = true
+		e.f.entries[e.id] = req
+	}
+	e.f.lock.Unlock()
+}
+
+// add registers a request, returning its entry to remove once it has been handled
+func (f *InFlightRequests) add(route string, r *http.Request, ctx *Ctx) inFlightEntry {
+	if f == nil {
+		return inFlightEntry{}
+	}
+
+	req := InFlightRequest{
+		RequestID: ctx.RequestID(),
+		Method:    r.Method,
+		Route:     route,
+		Path:      r.URL.Path,
+		ClientIP:  clientIP(r, ctx.trustProxy),
+		Start:     time.Now(),
+	}
+
+	f.lock.Lock()
+	f.nextID++
+	id := f.nextID
+	f.entries[id] = req
+	f.lock.Unlock()
+
+	return inFlightEntry{f: f, id: id}
+}
+
+// watch logs a warning every threshold for each request that has been in flight for longer than threshold, until
+// done is closed
+func (f *InFlightRequests) watch(done <-chan struct{}, log *vlog.Logger, threshold time.Duration) {
+	ticker := time.NewTicker(threshold)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			for _, req := range f.Requests() {
+				if req.Duration < threshold {
+					// requests are sorted oldest first, so none of the rest are stuck
+					break
+				}
+
+				log.Warn(fmt.Sprintf("request %s stuck for %ds on %s %s", req.RequestID, int(req.Duration.Seconds()), req.Method, req.Route))
+			}
+		}
+	}
+}
+
+// useInFlight sets the registry that the router's requests are added to, or nil to disable tracking
+func (rt *Router) useInFlight(registry *InFlightRequests) {
+	rt.inFlight = registry
+}
+
+// InFlight returns the requests currently being handled, oldest first. It is always empty unless UseInFlightTracking
+// is set. A Router shares its registry with any router it was swapped in for, so requests still being handled by the
+// previous router are included
+func (rt *Router) InFlight() []InFlightRequest {
+	return rt.inFlight.Requests()
+}
+
+// InFlight returns the server's in-flight request registry, which is nil unless UseInFlightTracking is set
+func (s *Server) InFlight() *InFlightRequests {
+	return s.inFlight
+}
+
+// clientIP returns the IP address of the client, using X-Forwarded-For if the proxy setting it is trusted
+func clientIP(r *http.Request, trustProxy bool) string {
+	if trustProxy {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			first, _, _ := strings.Cut(forwarded, ",")
+			return strings.TrimSpace(first)
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
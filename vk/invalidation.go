@@ -0,0 +1,257 @@
+package vk
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// CacheInvalidator purges cached responses by tag. The server's own (see Server.CacheInvalidator) purges the
+// ResponseCaches of its routes, and one set with UseCacheInvalidator is also given every purge made by a route
+// declared with Invalidates, such as to publish it to other instances, which would purge their own with theirs
+type CacheInvalidator interface {
+	Invalidate(ctx context.Context, tags []string) error
+}
+
+// cacheInvalidation purges the ResponseCaches that the server's requests have gone through
+type cacheInvalidation struct {
+	lock   sync.RWMutex
+	caches map[*ResponseCache]bool
+	remote CacheInvalidator
+}
+
+func newCacheInvalidation(remote CacheInvalidator) *cacheInvalidation {
+	ci := &cacheInvalidation{
+		caches: map[*ResponseCache]bool{},
+		remote: remote,
+	}
+
+	return ci
+}
+
+// register adds a cache to be purged. Caches are registered by their first request, before which they have
+// nothing to purge
+func (ci *cacheInvalidation) register(c *ResponseCache) {
+	if ci == nil {
+		return
+	}
+
+	ci.lock.RLock()
+	registered := ci.caches[c]
+	ci.lock.RUnlock()
+
+	if registered {
+		return
+	}
+
+	ci.lock.Lock()
+	ci.caches[c] = true
+	ci.lock.Unlock()
+}
+
+// Invalidate purges the responses tagged with any of tags from the server's ResponseCaches
+func (ci *cacheInvalidation) Invalidate(ctx context.Context, tags []string) error {
+	if ci == nil {
+		return nil
+	}
+
+	ci.lock.RLock()
+	defer ci.lock.RUnlock()
+
+	for c := range ci.caches {
+		_ = c.Invalidate(ctx, tags)
+	}
+
+	return nil
+}
+
+// purge purges tags locally, and then from the remote invalidator if there is one, logging its failure
+func (ci *cacheInvalidation) purge(ctx *Ctx, tags []string) {
+	if ci == nil || len(tags) == 0 {
+		return
+	}
+
+	_ = ci.Invalidate(ctx, tags)
+
+	if ci.remote != nil {
+		if err := ci.remote.Invalidate(ctx, tags); err != nil {
+			ctx.Log.Warn(fmt.Sprintf("cache: failed to publish the invalidation of %s: %s", strings.Join(tags, ", "), err))
+		}
+	}
+}
+
+// useCacheInvalidation sets the invalidation of the server's response caches
+func (rt *Router) useCacheInvalidation(ci *cacheInvalidation) {
+	rt.invalidation = ci
+}
+
+// CacheInvalidator returns the invalidator of the server's response caches, which only purges those of this
+// instance. A CacheInvalidator set with UseCacheInvalidator that receives purges from other instances calls it
+func (s *Server) CacheInvalidator() CacheInvalidator {
+	return s.invalidation
+}
+
+// tagTemplate is a cache tag with {param} placeholders for the route's parameters, i.e. user:{id}
+type tagTemplate struct {
+	template string
+	parts    []string // literal text at even indexes, parameter names at odd ones
+}
+
+func parseTagTemplate(template string) tagTemplate {
+	t := tagTemplate{template: template}
+
+	rest := template
+	for {
+		open := strings.Index(rest, "{")
+		if open < 0 {
+			break
+		}
+
+		end := strings.Index(rest[open:], "}")
+		if end < 0 {
+			break
+		}
+
+		t.parts = append(t.parts, rest[:open], rest[open+1:open+end])
+		rest = rest[open+end+1:]
+	}
+
+	t.parts = append(t.parts, rest)
+
+	return t
+}
+
+// expand interpolates the route's parameters into the template, failing if one of them is missing or empty
+func (t tagTemplate) expand(params interface{ ByName(string) string }) (string, error) {
+	if len(t.parts) == 1 {
+		return t.template, nil
+	}
+
+	var b strings.Builder
+
+	for i, part := range t.parts {
+		if i%2 == 0 {
+			b.WriteString(part)
+			continue
+		}
+
+		value := params.ByName(part)
+		if value == "" {
+			return "", fmt.Errorf("the route has no %q parameter", part)
+		}
+
+		b.WriteString(value)
+	}
+
+	return b.String(), nil
+}
+
+// expandTags expands templates for the request, logging and skipping those that fail
+func expandTags(ctx *Ctx, templates []tagTemplate) []string {
+	tags := make([]string, 0, len(templates))
+
+	for _, t := range templates {
+		tag, err := t.expand(ctx.Params)
+		if err != nil {
+			ctx.Log.Warn(fmt.Sprintf("cache: skipping tag %s: %s", t.template, err))
+			continue
+		}
+
+		tags = append(tags, tag)
+	}
+
+	return tags
+}
+
+// CacheTags returns a CacheOptions.Tags function that tags responses with templates, whose {param} placeholders are
+// replaced by the route's parameters, i.e. CacheTags("user:{id}") for a route /users/:id. Templates whose
+// parameters the route doesn't have are logged and skipped
+func CacheTags(templates ...string) func(ctx *Ctx) []string {
+	parsed := make([]tagTemplate, len(templates))
+	for i, t := range templates {
+		parsed[i] = parseTagTemplate(t)
+	}
+
+	return func(ctx *Ctx) []string {
+		return expandTags(ctx, parsed)
+	}
+}
+
+// Invalidates is a route Middleware for mutation routes, which purges the cached responses tagged with any of tags
+// (see CacheOptions.Tags) when the route succeeds. Tags can have {param} placeholders for the route's parameters,
+// i.e. vk.Invalidates("user:{id}", "user-list") for a route /users/:id; a tag whose parameters the route doesn't have
+// is logged and skipped. The purge happens synchronously, as soon as the route responds with a 2xx status and before
+// its response is written, so that requests made once the client has the response don't get stale responses from
+// this instance. Other instances are purged by the CacheInvalidator set with UseCacheInvalidator, if there is one
+func Invalidates(tags ...string) Middleware {
+	templates := make([]tagTemplate, len(tags))
+	for i, t := range tags {
+		templates[i] = parseTagTemplate(t)
+	}
+
+	return Named("invalidates", func(inner HandlerFunc) HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request, ctx *Ctx) error {
+			iw := &invalidatingWriter{ResponseWriter: w, purge: func() {
+				ctx.invalidation.purge(ctx, expandTags(ctx, templates))
+			}}
+
+			// a committed response is written below iw, so its tags are purged before it is
+			ctx.onCommit(iw.invalidate)
+
+			err := inner(iw, r, ctx)
+
+			// a handler that succeeds without writing anything gets a 200
+			if err == nil && iw.status == 0 {
+				iw.invalidate(http.StatusOK)
+			}
+
+			return err
+		}
+	})
+}
+
+// invalidatingWriter purges tags before a successful response is written
+type invalidatingWriter struct {
+	http.ResponseWriter
+	purge  func()
+	status int
+}
+
+// invalidate purges the tags if status is the route's first, successful, status
+func (iw *invalidatingWriter) invalidate(status int) {
+	if iw.status != 0 {
+		return
+	}
+
+	iw.status = status
+
+	if status >= 200 && status < 300 {
+		iw.purge()
+	}
+}
+
+func (iw *invalidatingWriter) WriteHeader(status int) {
+	// informational responses aren't the route's status
+	if status >= 200 {
+		iw.invalidate(status)
+	}
+
+	iw.ResponseWriter.WriteHeader(status)
+}
+
+func (iw *invalidatingWriter) Write(b []byte) (int, error) {
+	iw.invalidate(http.StatusOK)
+
+	return iw.ResponseWriter.Write(b)
+}
+
+// Flush flushes the underlying ResponseWriter if it supports flushing
+func (iw *invalidatingWriter) Flush() {
+	iw.invalidate(http.StatusOK)
+
+	if f, ok := iw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
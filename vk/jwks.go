@@ -0,0 +1,549 @@
+package vk
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/suborbital/vektor/vlog"
+)
+
+const (
+	defaultJWKSRefreshInterval    = time.Hour
+	defaultJWKSMinRefreshInterval = time.Minute
+	defaultJWKSStaleIfError       = 24 * time.Hour
+	defaultJWKSTimeout            = 10 * time.Second
+
+	maxJWKSBytes = 1 << 20
+)
+
+var (
+	// ErrUnknownKey is returned by JWKS.Key when the key set has no key with the requested kid, even after refreshing
+	ErrUnknownKey = errors.New("no key with the requested kid")
+
+	// ErrJWKSUnavailable is returned by JWKS.Key when the key set has never been fetched, or is older than its
+	// stale-if-error tolerance, and can't be refreshed
+	ErrJWKSUnavailable = errors.New("key set is unavailable")
+)
+
+// JWKSOptions configures the JWKS that verifies the tokens of the JWT middleware, with VK_JWKS_* variables
+type JWKSOptions struct {
+	URL string `env:"URL"` // where the key set is fetched from
+
+	// RefreshInterval is how long a key set is used before it is refreshed if its response has no Cache-Control
+	// max-age, 1 hour by default
+	RefreshInterval time.Duration `env:"REFRESH_INTERVAL"`
+
+	// MinRefreshInterval is the least time between refreshes, however short the max-age and however many tokens have
+	// unknown kids, 1 minute by default
+	MinRefreshInterval time.Duration `env:"MIN_REFRESH_INTERVAL"`
+
+	// StaleIfError is how long an expired key set is still used while it can't be refreshed, if its response has no
+	// Cache-Control stale-if-error, 24 hours by default
+	StaleIfError time.Duration `env:"STALE_IF_ERROR"`
+
+	// Timeout is how long fetching the key set may take, whatever the Client's own timeout, 10 seconds by default
+	Timeout time.Duration `env:"TIMEOUT"`
+
+	Client *http.Client // http.DefaultClient by default
+}
+
+// JWKSStats reports the state of a JWKS
+type JWKSStats struct {
+	URL             string    `json:"url"`
+	Keys            int       `json:"keys"`
+	PreviousKeys    int       `json:"previous_keys"`
+	FetchedAt       time.Time `json:"fetched_at,omitempty"`
+	ExpiresAt       time.Time `json:"expires_at,omitempty"`
+	StaleUntil      time.Time `json:"stale_until,omitempty"`
+	Refreshes       uint64    `json:"refreshes"`
+	RefreshFailures uint64    `json:"refresh_failures"`
+	LastError       string    `json:"last_error,omitempty"`
+}
+
+// JWKS is a JSON Web Key Set fetched from a URL and refreshed in the background as its Cache-Control allows. Keys are
+// looked up by their kid. The keys of the previous key set are kept until the next refresh, so that tokens signed
+// just before a rotation still verify, and a kid that isn't known triggers a refresh (at most once per
+// MinRefreshInterval) in case the keys have just been rotated
+type JWKS struct {
+	opts JWKSOptions
+	log  *vlog.Logger
+
+	lock        sync.RWMutex
+	refreshing  *jwksRefresh // the fetch that is running, so that only one runs at a time
+	current     map[string]crypto.PublicKey
+	previous    map[string]crypto.PublicKey
+	fetchedAt   time.Time
+	expiresAt   time.Time
+	staleUntil  time.Time
+	attemptedAt time.Time
+	lastErr     error
+	refreshes   uint64
+	failures    uint64
+}
+
+// jwksRefresh is a fetch of the key set, which every refresh started while it runs waits for
+type jwksRefresh struct {
+	done chan struct{}
+	err  error
+}
+
+// NewJWKS creates a JWKS for opts.URL, which is fetched when the first key is looked up
+func NewJWKS(log *vlog.Logger, opts JWKSOptions) *JWKS {
+	if opts.RefreshInterval <= 0 {
+		opts.RefreshInterval = defaultJWKSRefreshInterval
+	}
+
+	if opts.MinRefreshInterval <= 0 {
+		opts.MinRefreshInterval = defaultJWKSMinRefreshInterval
+	}
+
+	if opts.StaleIfError <= 0 {
+		opts.StaleIfError = defaultJWKSStaleIfError
+	}
+
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultJWKSTimeout
+	}
+
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+
+	k := &JWKS{
+		opts:     opts,
+		log:      log,
+		current:  map[string]crypto.PublicKey{},
+		previous: map[string]crypto.PublicKey{},
+	}
+
+	return k
+}
+
+// Key returns the public key with kid. An expired key set is used while it is refreshed in the background, or for
+// as long as its stale-if-error tolerance allows if it can't be. Waiting for the key set to be fetched, for a kid that
+// isn't known, stops when ctx is done
+func (k *JWKS) Key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	key, found, usable := k.lookup(kid)
+	if found && usable {
+		return key, nil
+	}
+
+	// the key set may have been rotated, or may never have been fetched
+	err := k.refresh(ctx, false)
+
+	key, found, usable = k.lookup(kid)
+
+	switch {
+	case !usable:
+		if err == nil {
+			err = k.lastError()
+		}
+
+		return nil, fmt.Errorf("%w: %s", ErrJWKSUnavailable, err)
+	case !found:
+		return nil, ErrUnknownKey
+	}
+
+	return key, nil
+}
+
+// Refresh fetches the key set now, whenever it was last fetched, or waits for the fetch that is running
+func (k *JWKS) Refresh(ctx context.Context) error {
+	return k.refresh(ctx, true)
+}
+
+// Stats returns the state of the key set
+func (k *JWKS) Stats() JWKSStats {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+
+	stats := JWKSStats{
+		URL:             k.opts.URL,
+		Keys:            len(k.current),
+		PreviousKeys:    len(k.previous),
+		FetchedAt:       k.fetchedAt,
+		ExpiresAt:       k.expiresAt,
+		StaleUntil:      k.staleUntil,
+		Refreshes:       k.refreshes,
+		RefreshFailures: k.failures,
+	}
+
+	if k.lastErr != nil {
+		stats.LastError = k.lastErr.Error()
+	}
+
+	return stats
+}
+
+// lookup returns the key with kid from the current or previous key set, and whether the key set can be used. It
+// starts a refresh in the background if the key set has expired
+func (k *JWKS) lookup(kid string) (crypto.PublicKey, bool, bool) {
+	now := time.Now()
+
+	k.lock.RLock()
+
+	key, found := k.current[kid]
+	if !found {
+		key, found = k.previous[kid]
+	}
+
+	usable := !k.fetchedAt.IsZero() && now.Before(k.staleUntil)
+	expired := usable && !now.Before(k.expiresAt) && k.refreshAllowed(now)
+
+	k.lock.RUnlock()
+
+	if expired {
+		k.startRefresh(false)
+	}
+
+	return key, found, usable
+}
+
+// refreshAllowed returns true if the least time between refreshes has passed, it must be called with lock held
+func (k *JWKS) refreshAllowed(now time.Time) bool {
+	return k.attemptedAt.IsZero() || now.Sub(k.attemptedAt) >= k.opts.MinRefreshInterval
+}
+
+func (k *JWKS) lastError() error {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+
+	if k.lastErr == nil {
+		return errors.New("refreshed too recently")
+	}
+
+	return k.lastErr
+}
+
+// refresh fetches the key set, unless force is false and it was attempted less than MinRefreshInterval ago, and
+// waits for it until ctx is done. A failed refresh keeps the current key set
+func (k *JWKS) refresh(ctx context.Context, force bool) error {
+	call := k.startRefresh(force)
+	if call == nil {
+		return nil
+	}
+
+	select {
+	case <-call.done:
+		return call.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// startRefresh starts fetching the key set in the background, unless a fetch is already running, in which case it
+// is returned, or force is false and one was attempted less than MinRefreshInterval ago, in which case nil is
+func (k *JWKS) startRefresh(force bool) *jwksRefresh {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	if k.refreshing != nil {
+		return k.refreshing
+	}
+
+	now := time.Now()
+
+	if !force && !k.refreshAllowed(now) {
+		return nil
+	}
+
+	// the attempt is recorded before fetching, so that lookups don't start another while it runs
+	k.attemptedAt = now
+
+	call := &jwksRefresh{done: make(chan struct{})}
+	k.refreshing = call
+
+	go k.runRefresh(call)
+
+	return call
+}
+
+// runRefresh fetches the key set for call, within the Timeout option whoever is waiting for it
+func (k *JWKS) runRefresh(call *jwksRefresh) {
+	ctx, cancel := context.WithTimeout(context.Background(), k.opts.Timeout)
+	defer cancel()
+
+	keys, cacheControl, err := k.fetch(ctx)
+
+	now := time.Now()
+
+	k.lock.Lock()
+
+	k.refreshing = nil
+	call.err = err
+
+	defer close(call.done)
+
+	if err != nil {
+		k.failures++
+		k.lastErr = err
+
+		k.lock.Unlock()
+
+		k.log.Error(errors.Wrapf(err, "[vk] failed to refresh JWKS from %s", k.opts.URL))
+
+		return
+	}
+
+	maxAge, staleIfError := k.freshness(cacheControl)
+
+	// the keys that were just rotated out are kept until the next rotation
+	previous := map[string]crypto.PublicKey{}
+	for kid, key := range k.current {
+		if _, ok := keys[kid]; !ok {
+			previous[kid] = key
+		}
+	}
+
+	if len(previous) == 0 {
+		for kid, key := range k.previous {
+			if _, ok := keys[kid]; !ok {
+				previous[kid] = key
+			}
+		}
+	}
+
+	k.previous = previous
+	k.current = keys
+	k.fetchedAt = now
+	k.expiresAt = now.Add(maxAge)
+	k.staleUntil = k.expiresAt.Add(staleIfError)
+	k.refreshes++
+	k.lastErr = nil
+
+	k.lock.Unlock()
+
+	k.log.Info("[vk] refreshed JWKS from", k.opts.URL, "with", len(keys), "keys and", len(previous), "previous keys")
+}
+
+// freshness returns how long a key set is fresh for, and then used while it can't be refreshed, from the
+// Cache-Control of its response
+func (k *JWKS) freshness(cacheControl string) (time.Duration, time.Duration) {
+	maxAge, staleIfError := k.opts.RefreshInterval, k.opts.StaleIfError
+
+	for _, directive := range strings.Split(cacheControl, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+
+		seconds, err := strconv.Atoi(strings.Trim(value, `"`))
+
+		switch strings.ToLower(name) {
+		case "max-age":
+			if err == nil {
+				maxAge = time.Duration(seconds) * time.Second
+			}
+		case "stale-if-error":
+			if err == nil {
+				staleIfError = time.Duration(seconds) * time.Second
+			}
+		case "no-cache", "no-store":
+			maxAge = 0
+		}
+	}
+
+	if maxAge < k.opts.MinRefreshInterval {
+		maxAge = k.opts.MinRefreshInterval
+	}
+
+	return maxAge, staleIfError
+}
+
+// fetch gets and parses the key set, returning it with the Cache-Control of its response
+func (k *JWKS) fetch(ctx context.Context) (map[string]crypto.PublicKey, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, k.opts.URL, nil)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "failed to NewRequest")
+	}
+
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := k.opts.Client.Do(req)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "failed to Do")
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxJWKSBytes))
+	if err != nil {
+		return nil, "", errors.Wrap(err, "failed to ReadAll")
+	}
+
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return keys, resp.Header.Get("Cache-Control"), nil
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseJWKS returns the signing keys of a key set by their kid. Keys of unsupported types are skipped, but a set
+// without any supported keys is an error
+func parseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, errors.Wrap(err, "invalid JWKS")
+	}
+
+	keys := map[string]crypto.PublicKey{}
+
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		key, err := jwk.publicKey()
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid key %q", jwk.Kid)
+		}
+
+		if key != nil {
+			keys[jwk.Kid] = key
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("JWKS has no supported signing keys")
+	}
+
+	return keys, nil
+}
+
+// publicKey returns the key, or nil if its type isn't supported
+func (j jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch j.Kty {
+	case "RSA":
+		n, err := decodeKeyInt(j.N)
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := decodeKeyInt(j.E)
+		if err != nil {
+			return nil, err
+		}
+
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+
+		switch j.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, nil
+		}
+
+		x, err := decodeKeyInt(j.X)
+		if err != nil {
+			return nil, err
+		}
+
+		y, err := decodeKeyInt(j.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on the curve")
+		}
+
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if j.Crv != "Ed25519" {
+			return nil, nil
+		}
+
+		x, err := base64.RawURLEncoding.DecodeString(j.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+
+		return ed25519.PublicKey(x), nil
+	}
+
+	return nil, nil
+}
+
+func decodeKeyInt(s string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(data) == 0 {
+		return nil, errors.New("invalid key parameter")
+	}
+
+	return new(big.Int).SetBytes(data), nil
+}
+
+// run refreshes the key set whenever it expires, or MinRefreshInterval after a failed refresh, until done is closed
+func (k *JWKS) run(done <-chan struct{}) {
+	for {
+		timer := time.NewTimer(time.Until(k.nextRefresh()))
+
+		select {
+		case <-done:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		// failures are logged and counted, and retried
+		k.refresh(context.Background(), false)
+	}
+}
+
+func (k *JWKS) nextRefresh() time.Time {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+
+	if k.attemptedAt.IsZero() {
+		return time.Now()
+	}
+
+	next := k.expiresAt
+	if k.lastErr != nil || next.Before(k.attemptedAt) {
+		next = k.attemptedAt
+	}
+
+	if earliest := k.attemptedAt.Add(k.opts.MinRefreshInterval); next.Before(earliest) {
+		next = earliest
+	}
+
+	return next
+}
@@ -0,0 +1,237 @@
+package vk
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	_ "crypto/sha256" // registers the hashes of the algorithms
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const defaultJWTLeeway = 30 * time.Second
+
+// JWTOptions configures the JWT middleware
+type JWTOptions struct {
+	Issuer   string        // the iss that tokens must have, any if empty
+	Audience string        // the aud that tokens must include, any if empty
+	Leeway   time.Duration // the clock skew allowed when checking exp and nbf, 30s by default
+}
+
+// jwtAlgorithm is a signature algorithm that tokens can be signed with. none and the HMAC algorithms are never
+// accepted, as the key set only has public keys
+type jwtAlgorithm struct {
+	hash crypto.Hash
+	pss  bool
+}
+
+var jwtAlgorithms = map[string]jwtAlgorithm{
+	"RS256": {hash: crypto.SHA256},
+	"RS384": {hash: crypto.SHA384},
+	"RS512": {hash: crypto.SHA512},
+	"PS256": {hash: crypto.SHA256, pss: true},
+	"PS384": {hash: crypto.SHA384, pss: true},
+	"PS512": {hash: crypto.SHA512, pss: true},
+	"ES256": {hash: crypto.SHA256},
+	"ES384": {hash: crypto.SHA384},
+	"ES512": {hash: crypto.SHA512},
+	"EdDSA": {},
+}
+
+// JWT is a Middleware that authenticates requests with a bearer token signed by one of the keys in keys, setting its
+// claims under ClaimsKey as a map[string]interface{}. Requests without a valid token fail with a 401, and those whose
+// token can't be verified because the key set is unavailable with a 503
+func JWT(keys *JWKS, opts JWTOptions) Middleware {
+	if opts.Leeway <= 0 {
+		opts.Leeway = defaultJWTLeeway
+	}
+
+	return Named("jwt", func(inner HandlerFunc) HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request, ctx *Ctx) error {
+			token := strings.TrimSpace(r.Header.Get("Authorization"))
+			if len(token) < 7 || !strings.EqualFold(token[:7], "bearer ") {
+				ctx.RespHeaders.Set("WWW-Authenticate", "Bearer")
+				return E(http.StatusUnauthorized, "missing bearer token")
+			}
+
+			claims, err := verifyJWT(ctx.Context, keys, strings.TrimSpace(token[7:]), opts)
+			if err != nil {
+				ctx.Log.Debug("[vk] rejected token:", err.Error())
+
+				if errors.Is(err, ErrJWKSUnavailable) {
+					return E(http.StatusServiceUnavailable, "unable to verify token")
+				}
+
+				ctx.RespHeaders.Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+
+				return E(http.StatusUnauthorized, "invalid token")
+			}
+
+			ctx.Set(ClaimsKey, claims)
+
+			return inner(w, r, ctx)
+		}
+	})
+}
+
+// verifyJWT returns the claims of a compact JWS token, once its signature and registered claims are checked
+func verifyJWT(ctx context.Context, keys *JWKS, token string, opts JWTOptions) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, errors.Wrap(err, "invalid header")
+	}
+
+	alg, ok := jwtAlgorithms[header.Alg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported algorithm %q", header.Alg)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid signature encoding")
+	}
+
+	key, err := keys.Key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := alg.verify(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, err
+	}
+
+	claims := map[string]interface{}{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, errors.Wrap(err, "invalid claims")
+	}
+
+	if err := checkJWTClaims(claims, opts, time.Now()); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+// verify checks the signature of input with key, which must be of the algorithm's type
+func (a jwtAlgorithm) verify(name string, key crypto.PublicKey, input, signature []byte) error {
+	invalid := errors.New("invalid signature")
+
+	var digest []byte
+	if a.hash != 0 {
+		h := a.hash.New()
+		h.Write(input)
+		digest = h.Sum(nil)
+	}
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(name, "RS") && !strings.HasPrefix(name, "PS") {
+			break
+		}
+
+		var err error
+		if a.pss {
+			err = rsa.VerifyPSS(k, a.hash, digest, signature, nil)
+		} else {
+			err = rsa.VerifyPKCS1v15(k, a.hash, digest, signature)
+		}
+
+		if err != nil {
+			return invalid
+		}
+
+		return nil
+	case *ecdsa.PublicKey:
+		if !strings.HasPrefix(name, "ES") {
+			break
+		}
+
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return invalid
+		}
+
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+
+		if !ecdsa.Verify(k, digest, r, s) {
+			return invalid
+		}
+
+		return nil
+	case ed25519.PublicKey:
+		if name != "EdDSA" {
+			break
+		}
+
+		if !ed25519.Verify(k, input, signature) {
+			return invalid
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("algorithm %s doesn't match the key's type %T", name, key)
+}
+
+// checkJWTClaims checks the token's exp, nbf, iss and aud
+func checkJWTClaims(claims map[string]interface{}, opts JWTOptions, now time.Time) error {
+	if exp, ok := claims["exp"].(float64); ok && now.After(time.Unix(int64(exp), 0).Add(opts.Leeway)) {
+		return errors.New("token has expired")
+	}
+
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(opts.Leeway).Before(time.Unix(int64(nbf), 0)) {
+		return errors.New("token is not valid yet")
+	}
+
+	if opts.Issuer != "" && claims["iss"] != opts.Issuer {
+		return fmt.Errorf("unexpected issuer %v", claims["iss"])
+	}
+
+	if opts.Audience == "" {
+		return nil
+	}
+
+	switch aud := claims["aud"].(type) {
+	case string:
+		if aud == opts.Audience {
+			return nil
+		}
+	case []interface{}:
+		for _, a := range aud {
+			if a == opts.Audience {
+				return nil
+			}
+		}
+	}
+
+	return fmt.Errorf("token is not for audience %s", opts.Audience)
+}
@@ -0,0 +1,109 @@
+package vk
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// KeyMaterialStats reports the state of a server's certificates and JWKS
+type KeyMaterialStats struct {
+	Certificates       int        `json:"certificates"`
+	CertReloads        uint64     `json:"cert_reloads"`
+	CertReloadFailures uint64     `json:"cert_reload_failures"`
+	JWKS               *JWKSStats `json:"jwks,omitempty"`
+}
+
+// KeyMaterial manages the keys that a server rotates while it is running: the certificates of its certificate
+// directory (see UseCertDir) and its JWKS (see UseJWKS). Both are reloaded in the background once the server starts,
+// and are swapped without affecting existing connections
+type KeyMaterial struct {
+	certs *certStore // nil without a certificate directory
+	jwks  *JWKS      // nil without a JWKS URL
+}
+
+func newKeyMaterial(options *Options) *KeyMaterial {
+	k := &KeyMaterial{}
+
+	if options.JWKS.URL != "" {
+		k.jwks = NewJWKS(options.Logger, options.JWKS)
+	}
+
+	return k
+}
+
+// KeyMaterial returns the server's key material
+func (s *Server) KeyMaterial() *KeyMaterial {
+	return s.keys
+}
+
+// JWKS returns the server's JWKS for the JWT middleware, or nil if it has no JWKS URL
+func (k *KeyMaterial) JWKS() *JWKS {
+	return k.jwks
+}
+
+// Refresh reloads the certificates and refreshes the JWKS now, rather than waiting for them to be due
+func (k *KeyMaterial) Refresh(ctx context.Context) error {
+	var err error
+
+	if k.certs != nil {
+		if _, certErr := k.certs.reload(); certErr != nil {
+			err = errors.Wrap(certErr, "failed to reload certificates")
+		}
+	}
+
+	if k.jwks != nil {
+		if jwksErr := k.jwks.Refresh(ctx); jwksErr != nil && err == nil {
+			err = errors.Wrap(jwksErr, "failed to refresh JWKS")
+		}
+	}
+
+	return err
+}
+
+// Stats returns the state of the certificates and JWKS, and how often they have been reloaded
+func (k *KeyMaterial) Stats() KeyMaterialStats {
+	stats := KeyMaterialStats{}
+
+	if k.certs != nil {
+		stats.Certificates = k.certs.count()
+		stats.CertReloads = atomic.LoadUint64(&k.certs.reloads)
+		stats.CertReloadFailures = atomic.LoadUint64(&k.certs.failures)
+	}
+
+	if k.jwks != nil {
+		jwks := k.jwks.Stats()
+		stats.JWKS = &jwks
+	}
+
+	return stats
+}
+
+// RegisterAdmin mounts GET /keys on the admin router, reporting the key material's stats, and POST /keys/refresh,
+// which forces a refresh and responds with the stats, or a 502 if either of them failed
+func (k *KeyMaterial) RegisterAdmin(r *Router) {
+	r.GET("/keys", func(w http.ResponseWriter, _ *http.Request, ctx *Ctx) error {
+		return RespondJSON(ctx.Context, w, k.Stats(), http.StatusOK)
+	})
+
+	r.POST("/keys/refresh", func(w http.ResponseWriter, _ *http.Request, ctx *Ctx) error {
+		if err := k.Refresh(ctx.Context); err != nil {
+			return E(http.StatusBadGateway, err.Error())
+		}
+
+		return RespondJSON(ctx.Context, w, k.Stats(), http.StatusOK)
+	})
+}
+
+// run reloads the certificates and refreshes the JWKS in the background, until done is closed
+func (k *KeyMaterial) run(done <-chan struct{}) {
+	if k.certs != nil {
+		go k.certs.watch(done)
+	}
+
+	if k.jwks != nil {
+		go k.jwks.run(done)
+	}
+}
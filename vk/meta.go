@@ -0,0 +1,114 @@
+package vk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+const metaFieldName = "_meta"
+
+// MetaProvider builds the `_meta` object that is injected into JSON object responses
+type MetaProvider func(ctx *Ctx, status int) interface{}
+
+type metaContextKey struct{}
+
+// metaState is carried in the request context so that RespondJSON can inject metadata
+type metaState struct {
+	provider MetaProvider
+	ctx      *Ctx
+	skip     bool
+}
+
+// SkipResponseMeta is a Middleware that opts a route out of `_meta` injection
+func SkipResponseMeta() Middleware {
+	return Named("skipmeta", func(inner HandlerFunc) HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request, ctx *Ctx) error {
+			if state := metaStateFrom(ctx.Context); state != nil {
+				state.skip = true
+			}
+
+			return inner(w, r, ctx)
+		}
+	})
+}
+
+// useResponseMeta sets the provider used to inject `_meta` into JSON object responses
+func (rt *Router) useResponseMeta(provider MetaProvider) {
+	rt.metaProvider = provider
+}
+
+// withMeta adds the Router's meta provider to the Ctx's context if one is configured
+func (rt *Router) withMeta(ctx *Ctx) {
+	if rt.metaProvider == nil {
+		return
+	}
+
+	ctx.Context = context.WithValue(ctx.Context, metaContextKey{}, &metaState{provider: rt.metaProvider, ctx: ctx})
+}
+
+func metaStateFrom(ctx context.Context) *metaState {
+	if ctx == nil {
+		return nil
+	}
+
+	state, _ := ctx.Value(metaContextKey{}).(*metaState)
+
+	return state
+}
+
+// injectMeta adds the `_meta` field to jsonData if it is a JSON object and the request has a
+// meta provider. Arrays and primitives are returned untouched, as is jsonData on any failure
+func injectMeta(ctx context.Context, jsonData []byte, status int) []byte {
+	state := metaStateFrom(ctx)
+	if state == nil || state.skip {
+		return jsonData
+	}
+
+	if !isJSONObject(jsonData) {
+		return jsonData
+	}
+
+	meta, err := json.Marshal(state.provider(state.ctx, status))
+	if err != nil {
+		state.ctx.Log.Error(err)
+		return jsonData
+	}
+
+	return spliceField(jsonData, metaFieldName, meta)
+}
+
+func isJSONObject(data []byte) bool {
+	data = bytes.TrimSpace(data)
+
+	return len(data) >= 2 && data[0] == '{' && data[len(data)-1] == '}'
+}
+
+// spliceField inserts "name":value before the closing brace of the JSON object obj without
+// decoding it. The closing brace is always the last byte of a valid object, so braces within
+// strings or nested objects have no effect
+func spliceField(obj []byte, name string, value []byte) []byte {
+	obj = bytes.TrimSpace(obj)
+	end := len(obj) - 1
+
+	// an empty object needs no separating comma
+	empty := len(bytes.TrimSpace(obj[1:end])) == 0
+
+	spliced := make([]byte, 0, len(obj)+len(name)+len(value)+4)
+	spliced = append(spliced, obj[:end]...)
+
+	if empty {
+		spliced = spliced[:1]
+	} else {
+		spliced = append(spliced, ',')
+	}
+
+	spliced = append(spliced, '"')
+	spliced = append(spliced, name...)
+	spliced = append(spliced, '"', ':')
+	spliced = append(spliced, value...)
+	spliced = append(spliced, '}')
+
+	return spliced
+}
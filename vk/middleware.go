@@ -1,9 +1,10 @@
 package vk
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/pkg/errors"
@@ -14,13 +15,13 @@ type Middleware func(HandlerFunc) HandlerFunc
 
 // ContentTypeMiddleware allows the content-type to be set
 func ContentTypeMiddleware(contentType string) Middleware {
-	return func(inner HandlerFunc) HandlerFunc {
+	return Named("contenttype", func(inner HandlerFunc) HandlerFunc {
 		return func(w http.ResponseWriter, r *http.Request, ctx *Ctx) error {
 			ctx.RespHeaders.Set(contentTypeHeaderKey, contentType)
 
 			return inner(w, r, ctx)
 		}
-	}
+	})
 }
 
 // WrapHandler takes an inner HandlerFunc, and a list of Middlewares, and returns a resolved handler that wraps the
@@ -31,35 +32,139 @@ func ContentTypeMiddleware(contentType string) Middleware {
 //
 // The wrap would look like this:
 // - incoming request -> traces -> logs -> errors -> panics -> coreHandler
+//
+// Each layer is recorded so that the resulting chain can be inspected with TraceChain.
 func WrapHandler(handler HandlerFunc, mw ...Middleware) HandlerFunc {
 	for _, m := range mw {
 		if m != nil {
-			handler = m(handler)
+			wrapped := m(handler)
+			if linkOf(wrapped) == nil {
+				wrapped = link(middlewareName(m), handler, wrapped)
+			}
+
+			handler = wrapped
 		}
 	}
 
 	return handler
 }
 
+// WrapWebsocket converts a WebSocketHandlerFunc into a HandlerFunc. The headers set on the Ctx by middleware are sent
+// with the 101 handshake response (see handshakeHeaders), including Sec-WebSocket-Protocol to accept a subprotocol.
+// Failed handshakes are returned as a vk.Error, so they are formatted like any other error response. The upgrade is
+// configured with WSOptions (see UseWebSocketOptions and WebSocketOptions), and the connection is registered in the
+// server's ConnRegistry until the handler returns. The handler's ctx.Context is cancelled when the server starts
+// shutting down, so that it can close the connection, and when the connection is closed for failing a ping
 func WrapWebsocket(handler WebSocketHandlerFunc) HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request, ctx *Ctx) error {
+		var handshakeErr error
+
+		opts := ctx.wsOptions.withDefaults()
+
 		upgrader := websocket.Upgrader{
-			ReadBufferSize:  1024,
-			WriteBufferSize: 1024,
-			CheckOrigin: func(r *http.Request) bool {
-				return true
+			ReadBufferSize:  opts.ReadBufferSize,
+			WriteBufferSize: opts.WriteBufferSize,
+			CheckOrigin:     opts.CheckOrigin,
+			Error: func(w http.ResponseWriter, r *http.Request, status int, reason error) {
+				w.Header().Set("Sec-WebSocket-Version", "13")
+				handshakeErr = E(status, reason.Error())
 			},
 		}
 
-		conn, err := upgrader.Upgrade(w, r, nil)
+		if ctx.webSockets != nil {
+			release, err := ctx.webSockets.acquire(ctx)
+			if err != nil {
+				return err
+			}
+
+			sw := &slotWriter{ResponseWriter: w, release: release}
+			w = sw
+
+			// the slot is released when the hijacked connection closes, or here if the handshake fails
+			defer func() {
+				if !sw.hijacked {
+					release()
+				}
+			}()
+		}
+
+		conn, err := upgrader.Upgrade(w, r, handshakeHeaders(ctx.RespHeaders))
 		if err != nil {
+			if handshakeErr != nil {
+				return handshakeErr
+			}
+
 			return E(http.StatusInternalServerError, err.Error())
 		}
 
-		return handler(r, ctx, conn)
+		connCtx, cancel := context.WithCancel(ctx.Context)
+		defer cancel()
+
+		ctx.Context = connCtx
+
+		// the connection outlives the server's graceful shutdown, which doesn't wait for hijacked connections, so the
+		// handler's context is cancelled when the shutdown starts for it to close the connection
+		if closing := ctx.closing; closing != nil {
+			go func() {
+				select {
+				case <-closing:
+					cancel()
+				case <-connCtx.Done():
+				}
+			}()
+		}
+
+		sockets := ctx.sockets
+		if sockets == nil {
+			sockets = NewConnRegistry()
+		}
+
+		registered := sockets.register(ctx.RequestID(), conn, opts, cancel)
+		defer sockets.unregister(registered)
+
+		err = handler(r, ctx, conn)
+
+		// tell the client why the connection is closing, unless the handler already has
+		if closing := ctx.closing; closing != nil {
+			select {
+			case <-closing:
+				msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+				conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+			default:
+			}
+		}
+
+		return err
 	}
 }
 
+// handshakeExcludedHeaders cannot be sent with a 101 response: the framing headers because it has no body
+// (RFC 7230, section 3.3), and the headers of the websocket handshake itself, which are written by the upgrader
+var handshakeExcludedHeaders = []string{
+	"Content-Length",
+	"Content-Type",
+	"Content-Encoding",
+	"Transfer-Encoding",
+	"Connection",
+	"Upgrade",
+	"Sec-WebSocket-Accept",
+	"Sec-WebSocket-Extensions",
+}
+
+// handshakeHeaders returns the headers from h that can be sent with a websocket handshake response
+func handshakeHeaders(h http.Header) http.Header {
+	if len(h) == 0 {
+		return nil
+	}
+
+	headers := h.Clone()
+	for _, key := range handshakeExcludedHeaders {
+		headers.Del(key)
+	}
+
+	return headers
+}
+
 // CORSHandler enables CORS for a route
 // pass "*" to allow all domains, or empty string to allow none
 func CORSHandler(domain string) HandlerFunc {
@@ -74,36 +179,160 @@ func enableCors(ctx *Ctx, domain string) {
 	if domain != "" {
 		ctx.RespHeaders.Set("Access-Control-Allow-Origin", domain)
 		ctx.RespHeaders.Set("X-Requested-With", "XMLHttpRequest")
-		ctx.RespHeaders.Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, Authorization, cache-control")
+		ctx.RespHeaders.Set("Access-Control-Allow-Headers", corsDefaultHeaders)
 	}
 }
 
+// BodyLimitMiddleware limits request bodies to maxBytes, responding with 413 if the Content-Length is too large
+// and causing reads beyond the limit to fail otherwise. It is upgrade-aware: websocket handshakes have no body
+// and are passed through untouched
+func BodyLimitMiddleware(maxBytes int64) Middleware {
+	return Named("bodylimit", func(inner HandlerFunc) HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request, ctx *Ctx) error {
+			if ctx.IsWebSocketUpgrade() {
+				return inner(w, r, ctx)
+			}
+
+			if r.ContentLength > maxBytes {
+				return E(http.StatusRequestEntityTooLarge, http.StatusText(http.StatusRequestEntityTooLarge))
+			}
+
+			if r.Body != nil {
+				r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+			}
+
+			return inner(w, r, ctx)
+		}
+	})
+}
+
+// TimeoutMiddleware gives the handler a deadline of timeout. Once it passes, the handler's contexts (ctx.Context and the
+// request's) are cancelled and, if the handler hasn't started its response, a 504 is sent straight away and anything
+// the handler writes later is discarded, so only one of the two responses is ever written. The middleware still waits
+// for the handler to return, so handlers should return once their context is cancelled. It is upgrade-aware: websocket
+// connections are long-lived and are never given a deadline
+func TimeoutMiddleware(timeout time.Duration) Middleware {
+	return Named("timeout", func(inner HandlerFunc) HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request, ctx *Ctx) error {
+			if ctx.IsWebSocketUpgrade() {
+				return inner(w, r, ctx)
+			}
+
+			// the handler can change the Ctx's logger, so the one it started with is used from this goroutine
+			log, formatter, headers := ctx.Log, ctx.errorFormatter, ctx.RespHeaders
+
+			reqCtx, cancelReq := context.WithTimeout(r.Context(), timeout)
+			defer cancelReq()
+
+			handlerCtx, cancelHandler := context.WithTimeout(ctx.Context, timeout)
+			defer cancelHandler()
+
+			dw := newDeadlineWriter(w)
+			ctx.Context, ctx.RespHeaders = handlerCtx, dw.header
+
+			var err error
+			var panicked interface{}
+
+			done := make(chan struct{})
+
+			go func() {
+				defer close(done)
+
+				// a panic is re-raised from the request's goroutine, where the router recovers it
+				defer func() {
+					panicked = recover()
+				}()
+
+				err = inner(dw, r.WithContext(reqCtx), ctx)
+			}()
+
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+
+			timedOut := false
+
+			select {
+			case <-done:
+			case <-timer.C:
+				cancelReq()
+				cancelHandler()
+
+				timedOut = dw.timeOut(func() {
+					respondNow(w, func(w http.ResponseWriter) {
+						respondError(w, r, formatter, E(http.StatusGatewayTimeout, "request timed out"))
+					})
+				})
+
+				<-done
+			}
+
+			ctx.RespHeaders = headers
+			dw.finish()
+
+			if panicked != nil {
+				panic(panicked)
+			}
+
+			if timedOut {
+				if err != nil {
+					log.Warn("request timed out:", err.Error())
+				} else {
+					log.Warn("request timed out after", timeout.String())
+				}
+
+				// the 504 has been sent, so there is nothing left to respond with
+				return nil
+			}
+
+			return err
+		}
+	})
+}
+
 // ErrorMiddleware returns a middleware that wraps a handler.
 func ErrorMiddleware() Middleware {
-	return func(inner HandlerFunc) HandlerFunc {
+	return namedWithValue("error", errorLayer{}, func(inner HandlerFunc) HandlerFunc {
 		return func(w http.ResponseWriter, r *http.Request, ctx *Ctx) error {
 			if err := inner(w, r, ctx); err != nil {
-				ctx.Log.ErrorString(fmt.Sprintf("ERROR: traceid: %s, msg: %s", ctx.RequestID(), err.Error()))
+				ctx.Log.ErrorString(fmt.Sprintf("ERROR: traceid: %s, msg: %s%s", ctx.RequestID(), err.Error(), ctx.domainLabel()))
+				ctx.domain.failed(ctx, r, err)
+
+				// the committed response is final, see CommitResponse
+				if ctx.commitAttempted() {
+					return nil
+				}
+				ctx.devCapture.failed(err)
 
 				if e, ok := err.(Error); ok {
+					if serveDevErrorPage(w, r, e) {
+						return nil
+					}
+
 					// we received a trusted error, which means we can pass on the status and message set on it.
+					if ctx.errorFormatter != nil {
+						ctx.errorFormatter(w, r, e)
+						return nil
+					}
+
 					w.WriteHeader(e.Status())
-					errJson, err := json.Marshal(e)
-					if err != nil {
+
+					buf := getBuffer()
+					defer putBuffer(buf)
+
+					if err := encodeJSONTo(buf, e); err != nil {
 						return errors.Wrap(err, "could not marshal error into json")
 					}
 
-					_, _ = w.Write(errJson)
+					_, _ = w.Write(buf.Bytes())
 					return nil
 				}
 
 				// we received an error from someplace else, return a generic 500
-				w.WriteHeader(http.StatusInternalServerError)
-				_, _ = w.Write([]byte(http.StatusText(http.StatusInternalServerError)))
+				respondError(w, r, ctx.errorFormatter, E(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError)))
 				return nil
 			}
 
 			return nil
 		}
-	}
+	})
 }
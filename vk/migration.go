@@ -0,0 +1,349 @@
+package vk
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+)
+
+const (
+	variantVK     = "vk"
+	variantLegacy = "legacy"
+)
+
+// cutoverPercent is the chain value set by Cutover
+type cutoverPercent int
+
+// Cutover is a route Middleware that marks the route as being migrated from the legacy handler of the server's
+// Migration: percent of clients are served by the route, and the rest by the legacy handler. A client's share is
+// derived from a hash of its IP, so it stays on the same side until the percentage changes, and raising the
+// percentage only ever moves clients from the legacy handler to vk. The percentage can be changed while the server is
+// running with Migration.SetCutover, or through the admin router
+func Cutover(percent int) Middleware {
+	if percent < 0 {
+		percent = 0
+	} else if percent > 100 {
+		percent = 100
+	}
+
+	return func(inner HandlerFunc) HandlerFunc {
+		// the split happens before any of the router's middleware run, so this layer only marks the route
+		l := &chainLink{name: "cutover", next: inner, handler: inner, value: cutoverPercent(percent)}
+
+		return l.serve
+	}
+}
+
+// MigrationVariantStats counts the requests served by one side of a migrated route
+type MigrationVariantStats struct {
+	Requests  uint64  `json:"requests"`
+	Errors    uint64  `json:"errors"` // responses with a 5xx status
+	ErrorRate float64 `json:"error_rate"`
+}
+
+// MigrationRouteStats reports the cutover of a route and how each side has fared
+type MigrationRouteStats struct {
+	Method  string                `json:"method"`
+	Route   string                `json:"route"`
+	Percent int                   `json:"percent"`
+	VK      MigrationVariantStats `json:"vk"`
+	Legacy  MigrationVariantStats `json:"legacy"`
+}
+
+// MigrationStats reports the routes being migrated, and the requests that were always served by the legacy handler
+type MigrationStats struct {
+	Routes    []MigrationRouteStats `json:"routes"`
+	Unmatched uint64                `json:"unmatched"` // requests that no vk route handles
+}
+
+// migrationVariant counts the requests served by one side of a route
+type migrationVariant struct {
+	requests uint64
+	errors   uint64
+}
+
+func (v *migrationVariant) stats() MigrationVariantStats {
+	stats := MigrationVariantStats{
+		Requests: atomic.LoadUint64(&v.requests),
+		Errors:   atomic.LoadUint64(&v.errors),
+	}
+
+	if stats.Requests > 0 {
+		stats.ErrorRate = float64(stats.Errors) / float64(stats.Requests)
+	}
+
+	return stats
+}
+
+// migrationRoute is a route registered with Cutover
+type migrationRoute struct {
+	method  string
+	route   string
+	percent int32
+
+	vk     migrationVariant
+	legacy migrationVariant
+}
+
+// Migration runs vk side by side with a legacy http.Handler, such as a gorilla/mux router, while routes are moved
+// over one at a time. Requests that no vk route handles are served by the legacy handler, routes registered with
+// Cutover are split between the two, and every other route is served by vk alone. Set it with UseMigration
+type Migration struct {
+	legacy http.Handler
+
+	lock   sync.RWMutex
+	routes map[string]*migrationRoute // keyed by method and route
+
+	unmatched uint64
+}
+
+// MigrationRouter creates a Migration from legacy, the handler that serves every route that hasn't been moved to vk
+func MigrationRouter(legacy http.Handler) *Migration {
+	m := &Migration{
+		legacy: legacy,
+		routes: map[string]*migrationRoute{},
+	}
+
+	return m
+}
+
+// SetCutover changes the percentage of clients served by vk for a route registered with Cutover, such as
+// SetCutover(http.MethodGet, "/users/:id", 50)
+func (m *Migration) SetCutover(method, route string, percent int) error {
+	if percent < 0 || percent > 100 {
+		return errors.Errorf("cutover percentage %d is not between 0 and 100", percent)
+	}
+
+	m.lock.RLock()
+	mr, ok := m.routes[method+" "+route]
+	m.lock.RUnlock()
+
+	if !ok {
+		return errors.Errorf("%s %s is not registered with Cutover", method, route)
+	}
+
+	atomic.StoreInt32(&mr.percent, int32(percent))
+
+	return nil
+}
+
+// Stats returns the cutover of each route and the requests served by each side, so their error rates can be compared
+// before a percentage is raised
+func (m *Migration) Stats() MigrationStats {
+	m.lock.RLock()
+	routes := make([]MigrationRouteStats, 0, len(m.routes))
+
+	for _, mr := range m.routes {
+		routes = append(routes, MigrationRouteStats{
+			Method:  mr.method,
+			Route:   mr.route,
+			Percent: int(atomic.LoadInt32(&mr.percent)),
+			VK:      mr.vk.stats(),
+			Legacy:  mr.legacy.stats(),
+		})
+	}
+	m.lock.RUnlock()
+
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].Route != routes[j].Route {
+			return routes[i].Route < routes[j].Route
+		}
+
+		return routes[i].Method < routes[j].Method
+	})
+
+	stats := MigrationStats{
+		Routes:    routes,
+		Unmatched: atomic.LoadUint64(&m.unmatched),
+	}
+
+	return stats
+}
+
+// cutoverRequest is the body of PUT /migration/cutover
+type cutoverRequest struct {
+	Method  string `json:"method"`
+	Route   string `json:"route"`
+	Percent *int   `json:"percent"`
+}
+
+// RegisterAdmin mounts GET /migration on the admin router, reporting the migration's stats, and PUT
+// /migration/cutover, which sets a route's percentage with a body like {"method":"GET","route":"/users/:id","percent":50}
+func (m *Migration) RegisterAdmin(r *Router) {
+	r.GET("/migration", func(w http.ResponseWriter, _ *http.Request, ctx *Ctx) error {
+		return RespondJSON(ctx.Context, w, m.Stats(), http.StatusOK)
+	})
+
+	r.PUT("/migration/cutover", func(w http.ResponseWriter, req *http.Request, ctx *Ctx) error {
+		body := cutoverRequest{}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			return E(http.StatusBadRequest, "invalid cutover: "+err.Error())
+		}
+
+		if body.Percent == nil {
+			return E(http.StatusBadRequest, "invalid cutover: percent is required")
+		}
+
+		if err := m.SetCutover(body.Method, body.Route, *body.Percent); err != nil {
+			return E(http.StatusBadRequest, err.Error())
+		}
+
+		ctx.Log.Info("migration: cutover of", body.Method, body.Route, "set to", fmt.Sprintf("%d%%", *body.Percent))
+
+		return RespondJSON(ctx.Context, w, m.Stats(), http.StatusOK)
+	})
+}
+
+// register adds a route with its initial percentage, keeping the percentage of a route that is already registered
+// (such as by the router that was swapped out) so that changes made while running aren't lost
+func (m *Migration) register(method, route string, percent cutoverPercent) *migrationRoute {
+	key := method + " " + route
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if mr, ok := m.routes[key]; ok {
+		return mr
+	}
+
+	mr := &migrationRoute{method: method, route: route, percent: int32(percent)}
+	m.routes[key] = mr
+
+	return mr
+}
+
+// useMigration sets the Migration whose legacy handler serves the requests that the router's routes don't
+func (rt *Router) useMigration(m *Migration) {
+	rt.migration = m
+}
+
+// splitCutover returns handle wrapped to send the share of clients that haven't been cut over to the legacy handler,
+// or handle itself if the route isn't registered with Cutover
+func (rt *Router) splitCutover(r httpRouteHandler, handle httprouter.Handle) httprouter.Handle {
+	if rt.migration == nil {
+		return handle
+	}
+
+	var percent cutoverPercent
+	found := false
+
+	for _, v := range chainValues(r.Handler) {
+		if p, ok := v.(cutoverPercent); ok {
+			percent, found = p, true
+			break
+		}
+	}
+
+	if !found {
+		return handle
+	}
+
+	mr := rt.migration.register(r.Method, r.Path, percent)
+
+	return func(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		start := time.Now()
+
+		variant, counts := variantVK, &mr.vk
+		if cutoverBucket(clientIP(req, rt.trustProxy)) >= atomic.LoadInt32(&mr.percent) {
+			variant, counts = variantLegacy, &mr.legacy
+		}
+
+		mw := &migrationWriter{ResponseWriter: w}
+
+		if variant == variantLegacy {
+			rt.migration.legacy.ServeHTTP(mw, req)
+		} else {
+			handle(mw, req, params)
+		}
+
+		status := mw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		atomic.AddUint64(&counts.requests, 1)
+		if status >= http.StatusInternalServerError {
+			atomic.AddUint64(&counts.errors, 1)
+		}
+
+		logFn := rt.log.Info
+		if rt.quiet || rt.quietRoutes[req.URL.Path] {
+			logFn = rt.log.Debug
+		}
+
+		completed := fmt.Sprintf("completed (%d: %s) in %dms", status, http.StatusText(status), time.Since(start).Milliseconds())
+		logFn(req.Method, req.URL.String(), completed, "variant="+variant)
+	}
+}
+
+// serveLegacy serves a request that no route handles with the migration's legacy handler, returning false if the
+// router has no Migration
+func (rt *Router) serveLegacy(w http.ResponseWriter, r *http.Request) bool {
+	if rt.migration == nil {
+		return false
+	}
+
+	atomic.AddUint64(&rt.migration.unmatched, 1)
+	rt.migration.legacy.ServeHTTP(w, r)
+
+	return true
+}
+
+// cutoverBucket places a client in one of 100 buckets, those below a route's percentage are served by vk
+func cutoverBucket(client string) int32 {
+	h := fnv.New32a()
+	h.Write([]byte(client))
+
+	return int32(h.Sum32() % 100)
+}
+
+// migrationWriter records the status of a response, passing flushes and hijacks through to the legacy handler
+type migrationWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (mw *migrationWriter) WriteHeader(status int) {
+	if mw.status == 0 {
+		mw.status = status
+	}
+
+	mw.ResponseWriter.WriteHeader(status)
+}
+
+func (mw *migrationWriter) Write(b []byte) (int, error) {
+	if mw.status == 0 {
+		mw.status = http.StatusOK
+	}
+
+	return mw.ResponseWriter.Write(b)
+}
+
+// Flush flushes the underlying ResponseWriter if it supports flushing
+func (mw *migrationWriter) Flush() {
+	if f, ok := mw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack hijacks the underlying ResponseWriter's connection, for websockets
+func (mw *migrationWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := mw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("ResponseWriter does not implement http.Hijacker")
+	}
+
+	mw.status = http.StatusSwitchingProtocols
+
+	return h.Hijack()
+}
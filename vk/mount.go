@@ -0,0 +1,166 @@
+package vk
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// MountWildcard is the name of the route parameter holding the path below a Mount or Static prefix. It is
+// normalized to be relative, i.e. "docs/index.html", and is empty for requests to the prefix itself
+const MountWildcard = "filepath"
+
+// BarePrefix determines how Mount and Static handle requests for their prefix without a trailing slash
+type BarePrefix int
+
+const (
+	// BarePrefixServe serves the prefix directly, with an empty MountWildcard
+	BarePrefixServe BarePrefix = iota
+
+	// BarePrefixRedirect redirects the prefix to the prefix with a trailing slash
+	BarePrefixRedirect
+)
+
+// MountOption configures Mount and Static
+type MountOption func(*mountOptions)
+
+type mountOptions struct {
+	bare        BarePrefix
+	fingerprint bool
+	revalidate  bool
+	singleRange bool
+}
+
+func newMountOptions(opts []MountOption) mountOptions {
+	options := mountOptions{}
+	for _, o := range opts {
+		o(&options)
+	}
+
+	return options
+}
+
+// WithBarePrefix sets how requests for a mounted prefix without a trailing slash are handled,
+// the default is BarePrefixServe
+func WithBarePrefix(bare BarePrefix) MountOption {
+	return func(o *mountOptions) {
+		o.bare = bare
+	}
+}
+
+var mountMethods = []string{
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodPost,
+	http.MethodPut,
+	http.MethodPatch,
+	http.MethodDelete,
+}
+
+// Mount serves a subtree of paths with handler, which sees request paths relative to prefix (as with
+// http.StripPrefix) and can find the vk Ctx in the request context (see WrapStdHandlerWithCtx). Both the
+// prefix itself and every path below it are handled, see WithBarePrefix
+func (g *RouteGroup) Mount(prefix string, handler http.Handler, opts ...MountOption) {
+	g.mount(prefix, mountMethods, WrapStdHandlerWithCtx(handler), newMountOptions(opts))
+}
+
+// Static serves the files in fs below prefix, for GET and HEAD requests. Files are served with a strong ETag
+// computed from their content, and in ranges so that downloads can be resumed, see RespondRanged. The ETag of a file
+// is computed when it is first served, and again once its size or modification time changes. See WithFingerprints
+// to serve content-addressed copies of each file for cache-busting
+func (g *RouteGroup) Static(prefix string, fs http.FileSystem, opts ...MountOption) {
+	options := newMountOptions(opts)
+	prefix = mountPrefix(prefix)
+
+	handler := newFileServer(fs, options).serve
+
+	if options.fingerprint {
+		assets := newAssetStore(fs, options.revalidate)
+		handler = assets.handler(handler)
+
+		g.assets = append(g.assets, assetMount{prefix: prefix, store: assets})
+	}
+
+	g.mount(prefix, []string{http.MethodGet, http.MethodHead}, handler, options)
+}
+
+func (g *RouteGroup) mount(prefix string, methods []string, handler HandlerFunc, options mountOptions) {
+	prefix = mountPrefix(prefix)
+	subtree := mountedHandler(handler)
+
+	bare := subtree
+	if options.bare == BarePrefixRedirect {
+		bare = redirectToSubtree
+	}
+
+	for _, method := range methods {
+		g.Handle(method, prefix+"/*"+MountWildcard, subtree)
+
+		// httprouter's catch-all requires at least the trailing slash, so the prefix is registered too
+		if prefix != "" {
+			g.Handle(method, prefix, bare)
+		}
+	}
+}
+
+// mountPrefix normalizes a mount prefix to have a leading slash and no trailing slash
+func mountPrefix(prefix string) string {
+	return strings.TrimSuffix(ensureLeadingSlash(prefix), "/")
+}
+
+// mountedHandler normalizes the MountWildcard parameter and strips the mount prefix from the request's URL
+func mountedHandler(handler HandlerFunc) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, ctx *Ctx) error {
+		rel := strings.TrimPrefix(ctx.Params.ByName(MountWildcard), "/")
+
+		params := make(httprouter.Params, 0, len(ctx.Params)+1)
+		for _, p := range ctx.Params {
+			if p.Key != MountWildcard {
+				params = append(params, p)
+			}
+		}
+
+		ctx.Params = append(params, httprouter.Param{Key: MountWildcard, Value: rel})
+
+		stripped := new(http.Request)
+		*stripped = *r
+
+		u := *r.URL
+		u.Path = "/" + rel
+		u.RawPath = escapedSuffix(r.URL.EscapedPath(), u.Path)
+		stripped.URL = &u
+
+		return handler(w, stripped, ctx)
+	}
+}
+
+// escapedSuffix returns the suffix of the escaped path that decodes to path, so that encoded
+// characters in the wildcard (such as %2F) are preserved when the prefix is stripped
+func escapedSuffix(escaped, path string) string {
+	for i := strings.LastIndex(escaped, "/"); i >= 0; i = strings.LastIndex(escaped[:i], "/") {
+		if unescaped, err := url.PathUnescape(escaped[i:]); err == nil && unescaped == path {
+			return escaped[i:]
+		}
+	}
+
+	return ""
+}
+
+// redirectToSubtree redirects a request for a mount prefix to the prefix with a trailing slash
+func redirectToSubtree(w http.ResponseWriter, r *http.Request, _ *Ctx) error {
+	status := http.StatusMovedPermanently
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		status = http.StatusPermanentRedirect
+	}
+
+	location := r.URL.EscapedPath() + "/"
+	if r.URL.RawQuery != "" {
+		location += "?" + r.URL.RawQuery
+	}
+
+	http.Redirect(w, r, location, status)
+
+	return nil
+}
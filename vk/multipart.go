@@ -0,0 +1,260 @@
+package vk
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	multipartContentType = "multipart/mixed"
+
+	// MultipartErrorContentType is the Content-Type of the parts created by ErrorPart
+	MultipartErrorContentType = "application/vnd.vk.error+json"
+
+	// multipartStatusHeader holds the status of a part, i.e. "404 Not Found", see Part.Status
+	multipartStatusHeader = "Status"
+
+	// multipartDrainIdle is how long a stopped stream's channel is drained without receiving a part before the
+	// producer is assumed to have stopped without closing it
+	multipartDrainIdle = time.Second
+)
+
+// Part is one part of a multipart response. Its body is Reader if it is set (and closed once written if it is an
+// io.Closer), or Body otherwise
+type Part struct {
+	Header textproto.MIMEHeader // such as Content-Type and Content-ID
+	Status int                  // sent as the part's Status header if set, for the status of each resource in a batch
+	Body   []byte
+	Reader io.Reader
+}
+
+// ErrorPart creates a part describing err, so that a resource that failed can be reported without ending the
+// stream. Its body is vk's error JSON, and its Status is that of err if it is a vk.Error or 500 otherwise
+func ErrorPart(contentID string, err error) Part {
+	vkErr, ok := err.(Error)
+	if !ok {
+		vkErr = E(http.StatusInternalServerError, err.Error())
+	}
+
+	body, _ := json.Marshal(vkErr)
+
+	header := textproto.MIMEHeader{}
+	header.Set(contentTypeHeaderKey, MultipartErrorContentType)
+
+	if contentID != "" {
+		header.Set("Content-ID", contentID)
+	}
+
+	return Part{Header: header, Status: vkErr.Status(), Body: body}
+}
+
+// MultipartStream is a multipart/mixed response whose parts are written and flushed as they are produced, such as
+// the resources of a bulk fetch. Create one with Multipart or MultipartFunc, and send it from a handler with Respond:
+//
+//	return vk.Multipart(parts).Respond(w, r, ctx)
+type MultipartStream struct {
+	next func(ctx context.Context) (Part, error)
+	stop func()
+}
+
+// Multipart creates a stream that writes each part received from parts until it is closed. If the stream stops
+// early (the client disconnects or the request's context is done), parts is drained in the background until it is
+// closed or no part has been sent for a second, so that the producer is never blocked; producers should also stop
+// sending once the request's context (r.Context()) is done
+func Multipart(parts <-chan Part) *MultipartStream {
+	s := MultipartFunc(func(ctx context.Context) (Part, error) {
+		select {
+		case part, ok := <-parts:
+			if !ok {
+				return Part{}, io.EOF
+			}
+
+			return part, nil
+		case <-ctx.Done():
+			return Part{}, ctx.Err()
+		}
+	})
+
+	s.stop = func() {
+		go drainParts(parts, multipartDrainIdle)
+	}
+
+	return s
+}
+
+// drainParts receives from parts until it is closed or nothing has been sent on it for idle
+func drainParts(parts <-chan Part, idle time.Duration) {
+	timer := time.NewTimer(idle)
+	defer timer.Stop()
+
+	for {
+		select {
+		case _, ok := <-parts:
+			if !ok {
+				return
+			}
+
+			if !timer.Stop() {
+				<-timer.C
+			}
+
+			timer.Reset(idle)
+		case <-timer.C:
+			return
+		}
+	}
+}
+
+// MultipartFunc creates a stream that calls next for each part until it returns io.EOF. The context passed to next
+// is cancelled when the client disconnects or the request's context is done
+func MultipartFunc(next func(ctx context.Context) (Part, error)) *MultipartStream {
+	return &MultipartStream{next: next}
+}
+
+// Respond writes the stream to w, with a generated boundary. Errors that occur before the first part is written are
+// returned as usual, but once the response has started, errors are logged and the stream is ended without its
+// closing boundary, so that clients can tell it was cut short. A client disconnecting is not an error
+func (s *MultipartStream) Respond(w http.ResponseWriter, r *http.Request, ctx *Ctx) error {
+	streamCtx, cancel := streamContext(r, ctx)
+	defer cancel()
+
+	mw := multipart.NewWriter(w)
+
+	started := false
+	start := func() {
+		if started {
+			return
+		}
+
+		started = true
+
+		w.Header().Set(contentTypeHeaderKey, fmt.Sprintf("%s; boundary=%s", multipartContentType, mw.Boundary()))
+		w.Header().Del("Content-Length")
+		w.WriteHeader(http.StatusOK)
+	}
+
+	flush := func() {
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+
+	// abort ends the stream early, returning err only if nothing has been written yet
+	abort := func(err error) error {
+		if s.stop != nil {
+			s.stop()
+		}
+
+		if streamCtx.Err() != nil {
+			ctx.Log.Debug("multipart stream stopped:", err.Error())
+			return nil
+		}
+
+		if !started {
+			return err
+		}
+
+		ctx.Log.Error(errors.Wrap(err, "multipart stream aborted"))
+		flush()
+
+		return nil
+	}
+
+	for {
+		part, err := s.next(streamCtx)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return abort(err)
+		}
+
+		start()
+
+		if err := writePart(mw, part); err != nil {
+			// failing to write means that the client has gone away, whereas a part's reader failing is a real error
+			if _, isRead := err.(partReadError); !isRead {
+				cancel()
+			}
+
+			return abort(err)
+		}
+
+		flush()
+	}
+
+	start()
+
+	if err := mw.Close(); err != nil {
+		cancel()
+		return abort(err)
+	}
+
+	flush()
+
+	return nil
+}
+
+// writePart writes a part's headers and body to mw
+func writePart(mw *multipart.Writer, part Part) error {
+	header := textproto.MIMEHeader{}
+	for key, values := range part.Header {
+		header[key] = values
+	}
+
+	if part.Status != 0 {
+		header.Set(multipartStatusHeader, fmt.Sprintf("%d %s", part.Status, http.StatusText(part.Status)))
+	}
+
+	pw, err := mw.CreatePart(header)
+	if err != nil {
+		return errors.Wrap(err, "failed to CreatePart")
+	}
+
+	if part.Reader == nil {
+		_, err = pw.Write(part.Body)
+		return err
+	}
+
+	if closer, ok := part.Reader.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	src := &partReader{Reader: part.Reader}
+	if _, err := io.Copy(pw, src); err != nil {
+		if src.err != nil {
+			return partReadError{src.err}
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// partReader records the error returned by a part's reader, to tell it apart from errors writing to the client
+type partReader struct {
+	io.Reader
+	err error
+}
+
+func (p *partReader) Read(b []byte) (int, error) {
+	n, err := p.Reader.Read(b)
+	if err != nil && err != io.EOF {
+		p.err = err
+	}
+
+	return n, err
+}
+
+// partReadError is the error of a part's reader
+type partReadError struct {
+	error
+}
@@ -0,0 +1,196 @@
+package vk
+
+import (
+	"context"
+	"io"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	ndjsonContentType       = "application/x-ndjson"
+	defaultNDJSONFlushRows  = 100
+	defaultNDJSONFlushBytes = 32 << 10
+)
+
+// NDJSONStream is a newline-delimited JSON (JSON Lines) response that is written row by row
+// without buffering the whole body. Create one with NDJSON or NDJSONFunc, and send it from a
+// handler with Respond:
+//
+//	return vk.NDJSON(rows).Respond(w, r, ctx)
+type NDJSONStream struct {
+	next         func(ctx context.Context) (interface{}, error)
+	stop         func()
+	flushRows    int
+	flushBytes   int
+	abortOnError bool
+}
+
+// NDJSON creates a stream that writes each row received from rows until it is closed. If the
+// stream stops early (the client disconnects or the request's context is done), rows is drained
+// in the background so that the producer is never blocked; producers should also stop sending
+// once the request's context (r.Context()) is done
+func NDJSON(rows <-chan interface{}) *NDJSONStream {
+	s := NDJSONFunc(func(ctx context.Context) (interface{}, error) {
+		select {
+		case row, ok := <-rows:
+			if !ok {
+				return nil, io.EOF
+			}
+
+			return row, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	})
+
+	s.stop = func() {
+		go func() {
+			for range rows {
+			}
+		}()
+	}
+
+	return s
+}
+
+// NDJSONFunc creates a stream that calls next for each row until it returns io.EOF. The context
+// passed to next is cancelled when the client disconnects or the request's context is done
+func NDJSONFunc(next func(ctx context.Context) (interface{}, error)) *NDJSONStream {
+	s := &NDJSONStream{
+		next:       next,
+		flushRows:  defaultNDJSONFlushRows,
+		flushBytes: defaultNDJSONFlushBytes,
+	}
+
+	return s
+}
+
+// FlushEvery sets how often the stream is flushed to the client, after the given number of rows
+// or bytes, whichever comes first. Values <= 0 leave the default (100 rows, 32KiB) in place
+func (s *NDJSONStream) FlushEvery(rows, bytes int) *NDJSONStream {
+	if rows > 0 {
+		s.flushRows = rows
+	}
+
+	if bytes > 0 {
+		s.flushBytes = bytes
+	}
+
+	return s
+}
+
+// AbortOnError stops the stream when a row fails to be marshalled, rather than logging and skipping it
+func (s *NDJSONStream) AbortOnError() *NDJSONStream {
+	s.abortOnError = true
+	return s
+}
+
+// Respond writes the stream to w. Errors that occur before the first row is written are returned
+// as usual, but once the response has started errors are logged and the stream is ended, since the
+// status can no longer be changed. A client disconnecting is not an error
+func (s *NDJSONStream) Respond(w http.ResponseWriter, r *http.Request, ctx *Ctx) error {
+	streamCtx, cancel := streamContext(r, ctx)
+	defer cancel()
+
+	started := false
+	start := func() {
+		if started {
+			return
+		}
+
+		started = true
+
+		w.Header().Set(contentTypeHeaderKey, ndjsonContentType)
+		w.Header().Del("Content-Length")
+		w.WriteHeader(http.StatusOK)
+	}
+
+	flush := func() {
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+
+	// abort ends the stream early, returning err only if nothing has been written yet
+	abort := func(err error) error {
+		if s.stop != nil {
+			s.stop()
+		}
+
+		if streamCtx.Err() != nil {
+			ctx.Log.Debug("ndjson stream stopped:", err.Error())
+			return nil
+		}
+
+		if !started {
+			return err
+		}
+
+		ctx.Log.Error(errors.Wrap(err, "ndjson stream aborted"))
+		flush()
+
+		return nil
+	}
+
+	rows, bytes := 0, 0
+
+	for {
+		row, err := s.next(streamCtx)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return abort(err)
+		}
+
+		line, err := EncodeJSON(row)
+		if err != nil {
+			if s.abortOnError {
+				return abort(errors.Wrap(err, "failed to EncodeJSON row"))
+			}
+
+			ctx.Log.Error(errors.Wrap(err, "failed to EncodeJSON row, skipping"))
+			continue
+		}
+
+		start()
+
+		if _, err := w.Write(append(line, '\n')); err != nil {
+			cancel()
+			return abort(err)
+		}
+
+		rows++
+		bytes += len(line) + 1
+
+		if rows >= s.flushRows || bytes >= s.flushBytes {
+			flush()
+			rows, bytes = 0, 0
+		}
+	}
+
+	start()
+	flush()
+
+	return nil
+}
+
+// streamContext returns a context that is done when either the client disconnects or the Ctx's context is done
+func streamContext(r *http.Request, ctx *Ctx) (context.Context, context.CancelFunc) {
+	streamCtx, cancel := context.WithCancel(r.Context())
+
+	if ctx == nil || ctx.Context == nil {
+		return streamCtx, cancel
+	}
+
+	go func() {
+		select {
+		case <-ctx.Context.Done():
+			cancel()
+		case <-streamCtx.Done():
+		}
+	}()
+
+	return streamCtx, cancel
+}
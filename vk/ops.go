@@ -0,0 +1,170 @@
+package vk
+
+import (
+	"expvar"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// defaultOpsPrefix is where OpsGroup mounts the ops endpoints if no prefix is set
+const defaultOpsPrefix = "/-/"
+
+// OpsConfig configures the group of operational endpoints created by OpsGroup. Its OpsOptions can be set from the
+// environment (see OpsConfigFromOptions), the rest is provided by the application
+type OpsConfig struct {
+	OpsOptions
+
+	// AppName is reported by the version endpoint
+	AppName string
+
+	// Guard protects every ops endpoint, such as with an allowlist or a token check
+	Guard Middleware
+
+	// Health serves the readiness endpoint, which reports ready with no checks if it is nil
+	Health *Health
+
+	// Metrics serves the metrics endpoint, such as a Prometheus handler, which is asked for the uncompressed text
+	// format so that the vk_route_info metrics can be added to it
+	Metrics http.Handler
+
+	// Routes returns the route table, such as Server.Routes. The endpoint isn't mounted if it is nil
+	Routes func() []RouteInfo
+
+	// Snapshot returns the route snapshot served as vk_route_info metrics by the metrics endpoint (see
+	// WriteRouteInfo), the snapshot of the router serving the request if it is nil
+	Snapshot func() RouteSnapshot
+}
+
+// OpsVersion is the response of the version endpoint
+type OpsVersion struct {
+	App      string `json:"app,omitempty"`
+	Version  string `json:"version,omitempty"`
+	Revision string `json:"revision,omitempty"` // the VCS revision the binary was built from, if it was recorded
+	Go       string `json:"go"`
+}
+
+// OpsConfigFromOptions returns an OpsConfig with o.Ops and the server's app name
+func OpsConfigFromOptions(o *Options) OpsConfig {
+	if o == nil {
+		return OpsConfig{}
+	}
+
+	return OpsConfig{OpsOptions: o.Ops, AppName: o.AppName}
+}
+
+// OpsGroup creates a group with the enabled ops endpoints below cfg.Prefix (/-/ by default), all behind cfg.Guard:
+//
+//	GET health   liveness, always 200 while the server is serving, including while its startup gates run
+//	GET ready    the readiness report of cfg.Health, see Health.Handler
+//	GET metrics  cfg.Metrics, followed by the vk_route_info metrics of the routes, see WriteRouteInfo
+//	GET version  the app name, version, VCS revision and Go version, see OpsVersion
+//	GET vars     the expvar variables
+//	GET routes   the route table returned by cfg.Routes
+//
+// Its routes are logged quietly and flagged as ops routes in RouteInfo, so that tooling which generates API
+// descriptions or reports route usage can leave them out
+func OpsGroup(cfg OpsConfig) *RouteGroup {
+	prefix := cfg.Prefix
+	if prefix == "" {
+		prefix = defaultOpsPrefix
+	}
+
+	g := Group(strings.TrimSuffix(prefix, "/"))
+	g.quiet = true
+	g.ops = true
+
+	if cfg.Guard != nil {
+		g.WithMiddlewares(cfg.Guard)
+	}
+
+	if cfg.EnableHealth {
+		g.GET("/health", func(w http.ResponseWriter, _ *http.Request, ctx *Ctx) error {
+			return RespondJSON(ctx.Context, w, map[string]string{"status": "ok"}, http.StatusOK)
+		}, liveness())
+	}
+
+	if cfg.EnableReady {
+		health := cfg.Health
+		if health == nil {
+			health = NewHealth(HealthOptions{})
+		}
+
+		g.GET("/ready", health.Handler())
+	}
+
+	if cfg.EnableMetrics {
+		g.GET("/metrics", opsMetrics(cfg))
+	}
+
+	if cfg.EnableVersion {
+		version := opsVersion(cfg.AppName, cfg.Release)
+
+		g.GET("/version", func(w http.ResponseWriter, _ *http.Request, ctx *Ctx) error {
+			return RespondJSON(ctx.Context, w, version, http.StatusOK)
+		})
+	}
+
+	if cfg.EnableVars {
+		g.GET("/vars", WrapStdHandlerWithCtx(expvar.Handler()))
+	}
+
+	if cfg.EnableRoutes && cfg.Routes != nil {
+		g.GET("/routes", func(w http.ResponseWriter, _ *http.Request, ctx *Ctx) error {
+			return RespondJSON(ctx.Context, w, cfg.Routes(), http.StatusOK)
+		})
+	}
+
+	return g
+}
+
+// opsMetrics serves cfg.Metrics, if it is set, followed by the route info metrics of cfg.Snapshot or of the router
+// serving the request. cfg.Metrics is asked for the uncompressed text format, which the route info can be appended to
+func opsMetrics(cfg OpsConfig) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, ctx *Ctx) error {
+		snapshot := cfg.Snapshot
+		if snapshot == nil {
+			snapshot = ctx.snapshot
+		}
+
+		w.Header().Set(contentTypeHeaderKey, routeInfoContentType)
+
+		if cfg.Metrics != nil {
+			text := r.Clone(r.Context())
+			text.Header.Del("Accept-Encoding")
+			text.Header.Set("Accept", "text/plain")
+
+			cfg.Metrics.ServeHTTP(w, text)
+		}
+
+		if snapshot == nil {
+			return nil
+		}
+
+		return WriteRouteInfo(w, snapshot(), cfg.AppName)
+	}
+}
+
+// opsVersion returns the version information of the running binary, falling back to its module version if
+// version is empty
+func opsVersion(app, version string) OpsVersion {
+	v := OpsVersion{App: app, Version: version, Go: runtime.Version()}
+
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return v
+	}
+
+	if v.Version == "" && info.Main.Version != "(devel)" {
+		v.Version = info.Main.Version
+	}
+
+	for _, s := range info.Settings {
+		if s.Key == "vcs.revision" {
+			v.Revision = s.Value
+		}
+	}
+
+	return v
+}
@@ -0,0 +1,226 @@
+package vk
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/suborbital/vektor/vlog"
+)
+
+// logEnvVars are the variables read by the default logger, below the server's prefix
+var logEnvVars = []string{"LOG_LEVEL", "LOG_FILE", "LOG_PREFIX"}
+
+// envPrefixes are the environment prefixes of every Options in the process, so that the variables of one server
+// aren't reported as unknown by another whose prefix is shorter, such as VK_ADMIN_PORT for a server using VK_
+var envPrefixes = struct {
+	lock     sync.Mutex
+	prefixes map[string]bool
+}{prefixes: map[string]bool{}}
+
+func registerEnvPrefix(prefix string) {
+	envPrefixes.lock.Lock()
+	defer envPrefixes.lock.Unlock()
+
+	envPrefixes.prefixes[prefix] = true
+}
+
+// longerEnvPrefixes returns the registered prefixes that start with prefix and are longer than it
+func longerEnvPrefixes(prefix string) []string {
+	envPrefixes.lock.Lock()
+	defer envPrefixes.lock.Unlock()
+
+	var longer []string
+
+	for p := range envPrefixes.prefixes {
+		if len(p) > len(prefix) && strings.HasPrefix(p, prefix) {
+			longer = append(longer, p)
+		}
+	}
+
+	return longer
+}
+
+// commonLogOptions configures the default logger from the common prefix's variables, which the server's own
+// variables then override
+func commonLogOptions(common string) []vlog.OptionsModifier {
+	if common == "" {
+		return nil
+	}
+
+	var opts []vlog.OptionsModifier
+
+	if level, ok := os.LookupEnv(common + "LOG_LEVEL"); ok {
+		opts = append(opts, vlog.Level(level))
+	}
+
+	if file, ok := os.LookupEnv(common + "LOG_FILE"); ok {
+		opts = append(opts, vlog.ToFile(file))
+	}
+
+	if logPrefix, ok := os.LookupEnv(common + "LOG_PREFIX"); ok {
+		opts = append(opts, vlog.LogPrefix(logPrefix))
+	}
+
+	return opts
+}
+
+// unknownEnv returns a problem for each environment variable with the server's prefix, or its common prefix, that
+// isn't one of its settings, such as VK_HTTP_PRT. Variables in the sections of Options are left to
+// unknownSectionVars, and those of the other prefixes in the process to their own Options
+func (o *Options) unknownEnv() []string {
+	prefix := o.EnvPrefix
+	if prefix == "" {
+		prefix = defaultEnvPrefix
+	}
+
+	prefixes := []string{prefix, o.CommonEnvPrefix}
+
+	var problems []string
+
+	for _, p := range prefixes {
+		if p == "" {
+			continue
+		}
+
+		if !strings.HasSuffix(p, "_") {
+			p = p + "_"
+		}
+
+		problems = append(problems, unknownEnvVars(p, os.Environ(), longerEnvPrefixes(p))...)
+	}
+
+	return problems
+}
+
+// unknownEnvVars returns a problem for each variable in environ with the prefix that isn't a setting of Options,
+// suggesting the setting it is closest to, if any
+func unknownEnvVars(prefix string, environ, others []string) []string {
+	known := knownEnvKeys()
+
+	var problems []string
+
+	for _, kv := range environ {
+		name, _, _ := strings.Cut(kv, "=")
+		if !strings.HasPrefix(name, prefix) || hasAnyPrefix(name, others) {
+			continue
+		}
+
+		key := strings.TrimPrefix(name, prefix)
+		if known[key] {
+			continue
+		}
+
+		inSection := false
+		for sectionPrefix := range optionSections {
+			inSection = inSection || strings.HasPrefix(key, sectionPrefix)
+		}
+
+		if inSection {
+			continue
+		}
+
+		if suggestion := closestEnvKey(key, known); suggestion != "" {
+			problems = append(problems, fmt.Sprintf("unknown setting %s (did you mean %s%s?)", name, prefix, suggestion))
+		} else {
+			problems = append(problems, fmt.Sprintf("unknown setting %s", name))
+		}
+	}
+
+	sort.Strings(problems)
+
+	return problems
+}
+
+// knownEnvKeys returns the variables of Options outside of its sections, and those of the default logger
+func knownEnvKeys() map[string]bool {
+	known := map[string]bool{}
+
+	t := reflect.TypeOf(Options{})
+	for i := 0; i < t.NumField(); i++ {
+		if name, _, _ := strings.Cut(t.Field(i).Tag.Get("env"), ","); name != "" {
+			known[name] = true
+		}
+	}
+
+	for _, key := range logEnvVars {
+		known[key] = true
+	}
+
+	return known
+}
+
+// closestEnvKey returns the known key that is at most two edits from key, or "" if there is none
+func closestEnvKey(key string, known map[string]bool) string {
+	best, bestDistance := "", 3
+
+	for k := range known {
+		if d := editDistance(key, k); d < bestDistance || (d == bestDistance && k < best) {
+			best, bestDistance = k, d
+		}
+	}
+
+	return best
+}
+
+// editDistance returns the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+
+		prev = cur
+	}
+
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+
+	if c < a {
+		a = c
+	}
+
+	return a
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// warnUnknownEnv logs the unknown variables found by Options.unknownEnv, which fail Validate in strict mode instead
+func (s *Server) warnUnknownEnv() {
+	if s.options.StrictEnv {
+		return
+	}
+
+	for _, problem := range s.options.unknownEnv() {
+		s.options.Logger.Warn("[vk]", problem)
+	}
+}
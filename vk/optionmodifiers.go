@@ -3,6 +3,7 @@ package vk
 import (
 	"crypto/tls"
 	"net/http"
+	"time"
 
 	"github.com/suborbital/vektor/vlog"
 )
@@ -41,6 +42,13 @@ func UseHTTPPort(port int) OptionsModifier {
 	}
 }
 
+// UseAdminPort sets the port on which the admin router is served, the admin server is disabled by default
+func UseAdminPort(port int) OptionsModifier {
+	return func(o *Options) {
+		o.AdminPort = port
+	}
+}
+
 // UseLogger allows a custom logger to be used
 func UseLogger(logger *vlog.Logger) OptionsModifier {
 	return func(o *Options) {
@@ -62,6 +70,23 @@ func UseEnvPrefix(prefix string) OptionsModifier {
 	}
 }
 
+// UseCommonEnvPrefix reads the options that aren't set with the server's own prefix from variables with a prefix
+// shared by several servers in the process, so that VK_COMMON_LOG_LEVEL applies to servers with the prefixes
+// VK_PUBLIC and VK_ADMIN unless VK_PUBLIC_LOG_LEVEL overrides it for one of them
+func UseCommonEnvPrefix(prefix string) OptionsModifier {
+	return func(o *Options) {
+		o.CommonEnvPrefix = prefix
+	}
+}
+
+// UseStrictEnv makes unknown variables with the server's prefixes (such as VK_HTTP_PRT) fail Validate and Start,
+// rather than being logged as warnings when the server starts
+func UseStrictEnv() OptionsModifier {
+	return func(o *Options) {
+		o.StrictEnv = true
+	}
+}
+
 // UseInspector sets a function that will be allowed to inspect every HTTP request
 // before it reaches VK's internal router, but cannot modify said request or affect
 // the handling of said request in any way. Use at your own risk, as it may introduce
@@ -92,3 +117,372 @@ func UseFallbackAddress(address string) OptionsModifier {
 		o.FallbackAddress = address
 	}
 }
+
+// UseFallbackProxyOptions sets how the fallback proxy streams requests and responses, see ProxyOptions
+func UseFallbackProxyOptions(opts ProxyOptions) OptionsModifier {
+	return func(o *Options) {
+		o.FallbackProxy = opts
+	}
+}
+
+// UseHTTPSRedirect causes the HTTP listener to redirect all requests to HTTPS with a 308 status when TLS is in use and
+// the HTTP port is set. ACME challenges (/.well-known/acme-challenge/*) and any exempt paths are not redirected, which
+// is useful for health checks that load balancers perform over plain HTTP
+func UseHTTPSRedirect(exemptPaths ...string) OptionsModifier {
+	return func(o *Options) {
+		o.HTTPSRedirect = true
+		o.RedirectExemptPaths = exemptPaths
+	}
+}
+
+// UseCanonicalHost sets the external host (optionally including a port) used in the Location header of HTTPS
+// redirects, by default the request's host is used
+func UseCanonicalHost(host string) OptionsModifier {
+	return func(o *Options) {
+		o.CanonicalHost = host
+	}
+}
+
+// UseCertDir serves TLS using the certificates in dir, which are named <hostname>.crt and <hostname>.key and are
+// selected using the SNI of each connection. Clients requesting an unknown hostname are given the certificate for
+// defaultHost, or have their handshake terminated if it is empty. The directory is checked for changes every 10s
+func UseCertDir(dir, defaultHost string) OptionsModifier {
+	return func(o *Options) {
+		o.CertDir = dir
+		o.DefaultCertHost = defaultHost
+	}
+}
+
+// UseCertReloadInterval sets how often the certificate directory is checked for changes
+func UseCertReloadInterval(interval time.Duration) OptionsModifier {
+	return func(o *Options) {
+		o.CertReloadInterval = interval
+	}
+}
+
+// UseGetCertificate sets a hook that is consulted before any other certificate source. Returning a nil certificate
+// and nil error falls through to the certificate directory, autocert, and the default certificate
+func UseGetCertificate(getCert func(*tls.ClientHelloInfo) (*tls.Certificate, error)) OptionsModifier {
+	return func(o *Options) {
+		o.GetCertificate = getCert
+	}
+}
+
+// UseHostPolicy enables autocert (LetsEncrypt) for any hostname that policy allows by returning nil, rather than
+// just the configured domain. Certificates from the directory and hook take precedence over autocert
+func UseHostPolicy(policy func(host string) error) OptionsModifier {
+	return func(o *Options) {
+		o.HostPolicy = policy
+	}
+}
+
+// UseAutocert turns acquiring certificates from LetsEncrypt for the domain (or the hosts allowed by UseHostPolicy) on
+// or off, it is on by default. With it off, certificates must come from the certificate directory or hook
+func UseAutocert(enabled bool) OptionsModifier {
+	return func(o *Options) {
+		o.DisableAutocert = !enabled
+	}
+}
+
+// UseResponseMeta injects a `_meta` field built by provider into every JSON object written by RespondJSON.
+// Arrays and other JSON values are left untouched, and routes can opt out using the SkipResponseMeta middleware
+func UseResponseMeta(provider MetaProvider) OptionsModifier {
+	return func(o *Options) {
+		o.ResponseMeta = provider
+	}
+}
+
+// UseRedaction leaves the struct fields restricted with a vk tag out of the JSON responses written by RespondJSON,
+// unless the caller has one of their scopes. Routes can use their own RedactionOptions with the Redaction middleware,
+// and handlers can opt out with Ctx.BypassRedaction
+func UseRedaction(opts RedactionOptions) OptionsModifier {
+	return func(o *Options) {
+		o.Redaction = &opts
+	}
+}
+
+// UseMaxResponseBytes sets the maximum size of a response body. Larger bodies passed to the Respond helpers are replaced
+// with a 500, and streamed responses that exceed it are terminated by closing the connection. Use the MaxResponseBytes
+// middleware to override it for a route. The default, 0, is unlimited
+func UseMaxResponseBytes(maxBytes int64) OptionsModifier {
+	return func(o *Options) {
+		o.MaxResponseBytes = maxBytes
+	}
+}
+
+// UseTrustProxy trusts the X-Forwarded-* headers set by a proxy in front of the server, such as when
+// determining whether a request was made using TLS (see Ctx.IsTLS). Only use it when every request
+// passes through a proxy that overwrites those headers
+func UseTrustProxy() OptionsModifier {
+	return func(o *Options) {
+		o.TrustProxy = true
+	}
+}
+
+// UseStrictResponses treats handlers that return a nil error without writing a response as failures, logging
+// them and responding with a 500 rather than an empty 200
+func UseStrictResponses() OptionsModifier {
+	return func(o *Options) {
+		o.StrictResponses = true
+	}
+}
+
+// UseInFlightTracking keeps a registry of the requests being handled (see Router.InFlight and Server.InFlight).
+// If stuckAfter is above 0, requests that have been in flight for longer than it are logged periodically
+func UseInFlightTracking(stuckAfter time.Duration) OptionsModifier {
+	return func(o *Options) {
+		o.TrackInFlight = true
+		o.StuckRequestThreshold = stuckAfter
+	}
+}
+
+// UseSlowCleanupThreshold sets how long a callback registered with Ctx.OnCleanup can run before it is logged as
+// slow, 100ms by default
+func UseSlowCleanupThreshold(threshold time.Duration) OptionsModifier {
+	return func(o *Options) {
+		o.SlowCleanupThreshold = threshold
+	}
+}
+
+// UseHandlerTimeout gives handlers a soft deadline, after which the request's context is cancelled and a 504 is
+// sent if the handler hasn't started its response, and a hard deadline grace later (5s if 0), after which a handler
+// that is still running is abandoned and logged. Unlike the http.Server's WriteTimeout, the connection is left intact
+func UseHandlerTimeout(soft, grace time.Duration) OptionsModifier {
+	return func(o *Options) {
+		o.HandlerTimeout = soft
+		o.HandlerGrace = grace
+	}
+}
+
+// UseTimeoutLearning records the latency of every route's requests, so that a timeout can be recommended for each
+// (see Router.TimeoutRecommendations) before UseHandlerTimeout is turned on
+func UseTimeoutLearning() OptionsModifier {
+	return func(o *Options) {
+		o.LearnTimeouts = true
+	}
+}
+
+// UseExplainRoutes logs the chain of layers of every route when it is mounted, at debug level, see Router.ExplainRoute
+func UseExplainRoutes() OptionsModifier {
+	return func(o *Options) {
+		o.ExplainRoutes = true
+	}
+}
+
+// UseRouteDump writes the route snapshot, along with the build information of the binary, to the file at path as
+// JSON once the routes have been mounted, see Server.SnapshotWithBuild. A failure to write it is logged as a warning
+func UseRouteDump(path string) OptionsModifier {
+	return func(o *Options) {
+		o.RouteDumpPath = path
+	}
+}
+
+// UseDevMode makes mistakes that would otherwise be reported at request time fail loudly, such as Resolve panicking
+// when a dependency is missing, or a second response panicking with both call sites (see DoubleResponseError), and
+// renders 500s for browsers as error pages that can replay the request. It should not be used in production
+func UseDevMode(dev bool) OptionsModifier {
+	return func(o *Options) {
+		o.DevMode = dev
+	}
+}
+
+// UseChaos allows a Chaos to inject faults into the server's requests, which it never does otherwise. It should
+// only be used in test and staging environments, and has no effect in builds with the nochaos tag
+func UseChaos() OptionsModifier {
+	return func(o *Options) {
+		o.AllowChaos = true
+	}
+}
+
+// UseHeaderHygiene rejects requests whose headers fail checks with 400 before they are routed (including to the
+// fallback proxy), logging the names of the offending headers. Use AllHeaderChecks, or disable the checks that
+// legitimate clients trip. Go's HTTP server already rejects some of these requests before vk sees them, the checks
+// also cover requests that reach the server's ServeHTTP in other ways
+func UseHeaderHygiene(checks HeaderChecks) OptionsModifier {
+	return func(o *Options) {
+		o.HeaderChecks = checks
+	}
+}
+
+// UseConsistencyCookie also sends the tokens set with Ctx.SetConsistencyToken in a signed cookie, and accepts them
+// from it, for clients (such as browsers) that can't send them back in a header. A token in the header takes
+// precedence over the cookie
+func UseConsistencyCookie(opts ConsistencyCookieOptions) OptionsModifier {
+	return func(o *Options) {
+		o.ConsistencyCookie = opts
+	}
+}
+
+// UseDryRun makes Start perform a dry run (see Server.DryRun) instead of starting, and exit the process with 0 if it
+// passed or 1 if it found problems, such as to check a release's configuration before rolling it out
+func UseDryRun() OptionsModifier {
+	return func(o *Options) {
+		o.DryRun = true
+	}
+}
+
+// UseStateSealing sets the keys with which Ctx.SealState seals the state that handlers round-trip through clients,
+// and with which Ctx.OpenState opens it. The first key seals, and every key opens, so that keys can be rotated
+func UseStateSealing(opts StateSealingOptions) OptionsModifier {
+	return func(o *Options) {
+		o.StateSealing = opts
+	}
+}
+
+// UseCorrelationHeaders changes the names of the headers that carry each request's Correlation, in requests and
+// responses alike. Names left empty keep their defaults
+func UseCorrelationHeaders(names CorrelationHeaders) OptionsModifier {
+	return func(o *Options) {
+		o.CorrelationHeaders = names
+	}
+}
+
+// UseWebSocketLimits caps the websocket connections open at once across the server (503 beyond it) and for
+// each client (429 beyond it), 0 for no limit. The limits can be changed later with Server.WebSockets
+func UseWebSocketLimits(maxConnections, maxPerClient int) OptionsModifier {
+	return func(o *Options) {
+		o.MaxWebSockets = maxConnections
+		o.MaxWebSocketsPerClient = maxPerClient
+	}
+}
+
+// UseWebSocketClientKey sets the function identifying the client of a websocket upgrade for its per-client limit,
+// which is the client's IP address by default
+func UseWebSocketClientKey(clientKey func(ctx *Ctx) string) OptionsModifier {
+	return func(o *Options) {
+		o.WebSocketClientKey = clientKey
+	}
+}
+
+// UseWebSocketOptions sets the buffer sizes, origin check and keepalive of the server's websocket routes, which can
+// be overridden for some of them with the WebSocketOptions middleware
+func UseWebSocketOptions(opts WSOptions) OptionsModifier {
+	return func(o *Options) {
+		o.WebSocket = opts
+	}
+}
+
+// UseConnectionLimits caps the connections open to the server at once, across the server and for each client IP
+// address, 0 for no limit. Connections beyond either cap are closed as soon as they are accepted. The limits can be
+// changed later with Server.Connections
+func UseConnectionLimits(maxConnections, maxPerClient int) OptionsModifier {
+	return func(o *Options) {
+		o.MaxConnections = maxConnections
+		o.MaxConnectionsPerClient = maxPerClient
+	}
+}
+
+// UseIdleReaping closes the connections of clients holding more than threshold connections once they have been idle
+// for idleAfter, until the client is back at the threshold
+func UseIdleReaping(threshold int, idleAfter time.Duration) OptionsModifier {
+	return func(o *Options) {
+		o.IdleReapThreshold = threshold
+		o.IdleReapAfter = idleAfter
+	}
+}
+
+// UseCORS sets the options of the middleware created by CORSFromOptions
+func UseCORS(cors CORSOptions) OptionsModifier {
+	return func(o *Options) {
+		o.CORS = cors
+	}
+}
+
+// UseRateLimit sets the options of the middleware created by RateLimitFromOptions
+func UseRateLimit(limit RateLimitOptions) OptionsModifier {
+	return func(o *Options) {
+		o.RateLimit = limit
+	}
+}
+
+// UseBodyLimit sets the options of the middleware created by BodyLimitFromOptions
+func UseBodyLimit(body BodyOptions) OptionsModifier {
+	return func(o *Options) {
+		o.Body = body
+	}
+}
+
+// UseOps sets the options of the group created by OpsGroup with OpsConfigFromOptions
+func UseOps(ops OpsOptions) OptionsModifier {
+	return func(o *Options) {
+		o.Ops = ops
+	}
+}
+
+// UseJWKS sets the JWKS of the server's KeyMaterial, which verifies the tokens of the JWT middleware
+func UseJWKS(jwks JWKSOptions) OptionsModifier {
+	return func(o *Options) {
+		o.JWKS = jwks
+	}
+}
+
+// UseNotifier sets the Notifier that handlers publish to with Ctx.Notify, such as a Hub
+func UseNotifier(notifier Notifier) OptionsModifier {
+	return func(o *Options) {
+		o.Notifier = notifier
+	}
+}
+
+// UseCacheInvalidator sets a CacheInvalidator that is given the purges of the routes declared with Invalidates,
+// after the server's own response caches are purged, such as one publishing them to the other instances of the service
+func UseCacheInvalidator(invalidator CacheInvalidator) OptionsModifier {
+	return func(o *Options) {
+		o.CacheInvalidator = invalidator
+	}
+}
+
+// UseCache sets the options of the server's Cache of values, see Server.Cache
+func UseCache(opts ValueCacheOptions) OptionsModifier {
+	return func(o *Options) {
+		o.Cache = opts
+	}
+}
+
+// UseMigration serves the requests that no route handles with the Migration's legacy handler, and splits the routes
+// registered with Cutover between the two
+func UseMigration(m *Migration) OptionsModifier {
+	return func(o *Options) {
+		o.Migration = m
+	}
+}
+
+// UseDeadlinePropagation shares the time left to handle each request with the services it calls: a request declaring
+// its budget in the DeadlineHeader is given that deadline (unless it has an earlier one), and calls made with
+// Ctx.HTTPClient send the time they have left, less a network allowance. Requests without the header are unaffected
+func UseDeadlinePropagation(opts DeadlinePropagation) OptionsModifier {
+	return func(o *Options) {
+		o.DeadlinePropagation = &opts
+	}
+}
+
+// UseReadinessDegradation grades the server's readiness from the latency and error rate of its requests and the
+// number it is handling, see Server.Degradation. The in-flight signal's limit is the RateLimit's MaxConcurrent unless
+// opts sets one
+func UseReadinessDegradation(opts DegradationOptions) OptionsModifier {
+	return func(o *Options) {
+		o.Degradation = &opts
+	}
+}
+
+// UseRetirement sets how the routes registered with Retire are retired, such as the clock their retirement dates are
+// compared to and how often their callers are logged
+func UseRetirement(opts RetirementOptions) OptionsModifier {
+	return func(o *Options) {
+		o.Retirement = opts
+	}
+}
+
+// UseShutdownTimeout sets how long Stop and Shutdown wait for in-flight requests to complete before the connections
+// that remain are closed. Without a ShutdownPlan, it replaces the 20s budget of the default plan's HTTP drain
+func UseShutdownTimeout(timeout time.Duration) OptionsModifier {
+	return func(o *Options) {
+		o.ShutdownTimeout = timeout
+	}
+}
+
+// UseShutdownPlan sets the phases executed by Server.Shutdown, see DefaultShutdownPlan
+func UseShutdownPlan(plan ShutdownPlan) OptionsModifier {
+	return func(o *Options) {
+		o.ShutdownPlan = &plan
+	}
+}
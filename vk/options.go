@@ -4,7 +4,10 @@ import (
 	"context"
 	"crypto/tls"
 	"net/http"
+	"os"
+	"reflect"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/sethvargo/go-envconfig"
@@ -22,14 +25,85 @@ type Options struct {
 	Domain          string `env:"DOMAIN"`
 	HTTPPort        int    `env:"HTTP_PORT"`
 	TLSPort         int    `env:"TLS_PORT"`
+	AdminPort       int    `env:"ADMIN_PORT"`
 	TLSConfig       *tls.Config
 	EnvPrefix       string
+	CommonEnvPrefix string
+	StrictEnv       bool `env:"STRICT_ENV"`
+	DryRun          bool `env:"DRY_RUN"`
 	QuietRoutes     []string
 	Logger          *vlog.Logger
 	RouterWrapper   RouterWrapper
 	FallbackAddress string
+	FallbackProxy   ProxyOptions
+
+	HTTPSRedirect       bool     `env:"HTTPS_REDIRECT"`
+	RedirectExemptPaths []string `env:"REDIRECT_EXEMPT_PATHS"`
+	CanonicalHost       string   `env:"CANONICAL_HOST"`
+
+	CertDir            string        `env:"CERT_DIR"`
+	DefaultCertHost    string        `env:"DEFAULT_CERT_HOST"`
+	CertReloadInterval time.Duration `env:"CERT_RELOAD_INTERVAL"`
+	GetCertificate     func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	HostPolicy         func(host string) error
+	DisableAutocert    bool `env:"DISABLE_AUTOCERT"`
+
+	ResponseMeta     MetaProvider
+	Redaction        *RedactionOptions
+	MaxResponseBytes int64 `env:"MAX_RESPONSE_BYTES"`
+	TrustProxy       bool  `env:"TRUST_PROXY"`
+
+	StrictResponses       bool          `env:"STRICT_RESPONSES"`
+	TrackInFlight         bool          `env:"TRACK_IN_FLIGHT"`
+	StuckRequestThreshold time.Duration `env:"STUCK_REQUEST_THRESHOLD"`
+	SlowCleanupThreshold  time.Duration `env:"SLOW_CLEANUP_THRESHOLD"`
+	HandlerTimeout        time.Duration `env:"HANDLER_TIMEOUT"`
+	HandlerGrace          time.Duration `env:"HANDLER_GRACE"`
+	LearnTimeouts         bool          `env:"LEARN_TIMEOUTS"`
+	ExplainRoutes         bool          `env:"EXPLAIN_ROUTES"`
+	RouteDumpPath         string        `env:"ROUTE_DUMP_PATH"`
+
+	MaxWebSockets          int `env:"MAX_WEBSOCKETS"`
+	MaxWebSocketsPerClient int `env:"MAX_WEBSOCKETS_PER_CLIENT"`
+	WebSocketClientKey     func(ctx *Ctx) string
+	WebSocket              WSOptions
+
+	MaxConnections          int           `env:"MAX_CONNECTIONS"`
+	MaxConnectionsPerClient int           `env:"MAX_CONNECTIONS_PER_CLIENT"`
+	IdleReapThreshold       int           `env:"IDLE_REAP_THRESHOLD"`
+	IdleReapAfter           time.Duration `env:"IDLE_REAP_AFTER"`
+
+	Cache ValueCacheOptions
+
+	ShutdownTimeout  time.Duration `env:"SHUTDOWN_TIMEOUT"`
+	ShutdownPlan     *ShutdownPlan
+	Notifier         Notifier
+	CacheInvalidator CacheInvalidator
+	Migration        *Migration
+
+	CORS      CORSOptions      `env:",prefix=CORS_"`
+	RateLimit RateLimitOptions `env:",prefix=RATELIMIT_"`
+	Body      BodyOptions      `env:",prefix=BODY_"`
+	Ops       OpsOptions       `env:",prefix=OPS_"`
+	JWKS      JWKSOptions      `env:",prefix=JWKS_"`
+
+	DevMode bool `env:"DEV_MODE"`
+
+	// AllowChaos has no environment variable, so that fault injection can't be turned on by configuration alone
+	AllowChaos bool
+
+	HeaderChecks       HeaderChecks
+	ConsistencyCookie  ConsistencyCookieOptions
+	StateSealing       StateSealingOptions
+	CorrelationHeaders CorrelationHeaders
+	Retirement         RetirementOptions
+
+	DeadlinePropagation *DeadlinePropagation
+	Degradation         *DegradationOptions
 
 	PreRouterInspector func(http.Request)
+
+	problems []string // found while finalizing, see Validate
 }
 
 // defaultRouterWrapper is a default pass through option for a wrapper. This does not wrap the handler in anything.
@@ -61,7 +135,7 @@ func newOptsWithModifiers(mods ...OptionsModifier) *Options {
 
 // ShouldUseTLS returns true if domain is set and/or TLS is configured
 func (o *Options) ShouldUseTLS() bool {
-	return o.Domain != "" || o.TLSConfig != nil
+	return o.Domain != "" || o.TLSConfig != nil || o.CertDir != "" || o.GetCertificate != nil || o.HostPolicy != nil
 }
 
 // HTTPPortSet returns true if the HTTP port is set
@@ -74,15 +148,36 @@ func (o *Options) ShouldUseHTTP() bool {
 	return !o.ShouldUseTLS() && o.HTTPPortSet()
 }
 
-// finalize "locks in" the options by overriding any existing options with the version from the environment, and setting the default logger if needed
+// ShouldRedirectHTTPS returns true if the HTTP listener should redirect requests to HTTPS
+func (o *Options) ShouldRedirectHTTPS() bool {
+	return o.HTTPSRedirect && o.ShouldUseTLS() && o.HTTPPortSet()
+}
+
+// finalize "locks in" the options by overriding any existing options with the version from the environment, and setting the default logger if needed.
+// Variables with the common prefix (see UseCommonEnvPrefix) apply unless the same variable is set with prefix
 func (o *Options) finalize(prefix string) {
 	// Append trailing _ if prefix is missing one
 	if !strings.HasSuffix(prefix, "_") {
 		prefix = prefix + "_"
 	}
 
+	common := o.CommonEnvPrefix
+	if common != "" && !strings.HasSuffix(common, "_") {
+		common = common + "_"
+	}
+
+	registerEnvPrefix(prefix)
+
+	lookuper := envconfig.PrefixLookuper(prefix, envconfig.OsLookuper())
+	if common != "" {
+		registerEnvPrefix(common)
+
+		// the server's own variables take precedence over the common ones
+		lookuper = envconfig.MultiLookuper(lookuper, envconfig.PrefixLookuper(common, envconfig.OsLookuper()))
+	}
+
 	if o.Logger == nil {
-		o.Logger = vlog.Default(vlog.EnvPrefix(prefix))
+		o.Logger = vlog.Default(append(commonLogOptions(common), vlog.EnvPrefix(prefix))...)
 	}
 
 	// if no inspector was set, create an empty one
@@ -90,15 +185,48 @@ func (o *Options) finalize(prefix string) {
 		o.PreRouterInspector = func(_ http.Request) {}
 	}
 
+	o.problems = unknownSectionVars(prefix, os.Environ())
+	if common != "" {
+		o.problems = append(o.problems, unknownSectionVars(common, os.Environ())...)
+	}
+
 	envOpts := Options{}
-	if err := envconfig.ProcessWith(context.Background(), &envOpts, envconfig.PrefixLookuper(prefix, envconfig.OsLookuper())); err != nil {
-		o.Logger.Error(errors.Wrap(err, "[vk] failed to ProcessWith environment config"))
-		return
+	for _, err := range processEnv(&envOpts, lookuper) {
+		err = errors.Wrap(err, "failed to ProcessWith environment config")
+
+		o.Logger.Error(errors.Wrap(err, "[vk]"))
+		o.problems = append(o.problems, err.Error())
 	}
 
 	o.replaceFieldsIfNeeded(&envOpts)
 }
 
+// processEnv decodes each of the fields of dst that are set by the environment on its own, so that an invalid
+// variable is reported without discarding the other fields and sections. It returns an error for each field that
+// failed to decode, which is left unset
+func processEnv(dst *Options, lookuper envconfig.Lookuper) []error {
+	var errs []error
+
+	v := reflect.ValueOf(dst).Elem()
+
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if _, ok := field.Tag.Lookup("env"); !ok {
+			continue
+		}
+
+		single := reflect.New(reflect.StructOf([]reflect.StructField{field}))
+		if err := envconfig.ProcessWith(context.Background(), single.Interface(), lookuper); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		v.Field(i).Set(single.Elem().Field(0))
+	}
+
+	return errs
+}
+
 func (o *Options) replaceFieldsIfNeeded(replacement *Options) {
 	if replacement.AppName != "" {
 		o.AppName = replacement.AppName
@@ -115,4 +243,212 @@ func (o *Options) replaceFieldsIfNeeded(replacement *Options) {
 	if replacement.TLSPort != 0 {
 		o.TLSPort = replacement.TLSPort
 	}
+
+	if replacement.AdminPort != 0 {
+		o.AdminPort = replacement.AdminPort
+	}
+
+	if replacement.HTTPSRedirect {
+		o.HTTPSRedirect = replacement.HTTPSRedirect
+	}
+
+	if len(replacement.RedirectExemptPaths) > 0 {
+		o.RedirectExemptPaths = replacement.RedirectExemptPaths
+	}
+
+	if replacement.CanonicalHost != "" {
+		o.CanonicalHost = replacement.CanonicalHost
+	}
+
+	if replacement.MaxResponseBytes != 0 {
+		o.MaxResponseBytes = replacement.MaxResponseBytes
+	}
+
+	if replacement.TrustProxy {
+		o.TrustProxy = replacement.TrustProxy
+	}
+
+	if replacement.StrictResponses {
+		o.StrictResponses = replacement.StrictResponses
+	}
+
+	if replacement.TrackInFlight {
+		o.TrackInFlight = replacement.TrackInFlight
+	}
+
+	if replacement.StuckRequestThreshold != 0 {
+		o.StuckRequestThreshold = replacement.StuckRequestThreshold
+	}
+
+	if replacement.SlowCleanupThreshold != 0 {
+		o.SlowCleanupThreshold = replacement.SlowCleanupThreshold
+	}
+
+	if replacement.HandlerTimeout != 0 {
+		o.HandlerTimeout = replacement.HandlerTimeout
+	}
+
+	if replacement.HandlerGrace != 0 {
+		o.HandlerGrace = replacement.HandlerGrace
+	}
+
+	if replacement.LearnTimeouts {
+		o.LearnTimeouts = replacement.LearnTimeouts
+	}
+
+	if replacement.ExplainRoutes {
+		o.ExplainRoutes = replacement.ExplainRoutes
+	}
+
+	if replacement.DevMode {
+		o.DevMode = replacement.DevMode
+	}
+
+	if replacement.MaxWebSockets != 0 {
+		o.MaxWebSockets = replacement.MaxWebSockets
+	}
+
+	if replacement.MaxWebSocketsPerClient != 0 {
+		o.MaxWebSocketsPerClient = replacement.MaxWebSocketsPerClient
+	}
+
+	if replacement.MaxConnections != 0 {
+		o.MaxConnections = replacement.MaxConnections
+	}
+
+	if replacement.MaxConnectionsPerClient != 0 {
+		o.MaxConnectionsPerClient = replacement.MaxConnectionsPerClient
+	}
+
+	if replacement.IdleReapThreshold != 0 {
+		o.IdleReapThreshold = replacement.IdleReapThreshold
+	}
+
+	if replacement.IdleReapAfter != 0 {
+		o.IdleReapAfter = replacement.IdleReapAfter
+	}
+
+	if replacement.CertDir != "" {
+		o.CertDir = replacement.CertDir
+	}
+
+	if replacement.DefaultCertHost != "" {
+		o.DefaultCertHost = replacement.DefaultCertHost
+	}
+
+	if replacement.CertReloadInterval != 0 {
+		o.CertReloadInterval = replacement.CertReloadInterval
+	}
+
+	if replacement.StrictEnv {
+		o.StrictEnv = replacement.StrictEnv
+	}
+
+	if replacement.DryRun {
+		o.DryRun = replacement.DryRun
+	}
+
+	if replacement.DisableAutocert {
+		o.DisableAutocert = replacement.DisableAutocert
+	}
+
+	if replacement.RouteDumpPath != "" {
+		o.RouteDumpPath = replacement.RouteDumpPath
+	}
+
+	if replacement.ShutdownTimeout != 0 {
+		o.ShutdownTimeout = replacement.ShutdownTimeout
+	}
+
+	if len(replacement.CORS.AllowedOrigins) > 0 {
+		o.CORS.AllowedOrigins = replacement.CORS.AllowedOrigins
+	}
+
+	if len(replacement.CORS.AllowedMethods) > 0 {
+		o.CORS.AllowedMethods = replacement.CORS.AllowedMethods
+	}
+
+	if len(replacement.CORS.AllowedHeaders) > 0 {
+		o.CORS.AllowedHeaders = replacement.CORS.AllowedHeaders
+	}
+
+	if replacement.CORS.AllowCredentials {
+		o.CORS.AllowCredentials = replacement.CORS.AllowCredentials
+	}
+
+	if replacement.CORS.MaxAge != 0 {
+		o.CORS.MaxAge = replacement.CORS.MaxAge
+	}
+
+	if replacement.CORS.Preflight {
+		o.CORS.Preflight = replacement.CORS.Preflight
+	}
+
+	if replacement.RateLimit.RPS != 0 {
+		o.RateLimit.RPS = replacement.RateLimit.RPS
+	}
+
+	if replacement.RateLimit.Burst != 0 {
+		o.RateLimit.Burst = replacement.RateLimit.Burst
+	}
+
+	if replacement.RateLimit.MaxConcurrent != 0 {
+		o.RateLimit.MaxConcurrent = replacement.RateLimit.MaxConcurrent
+	}
+
+	if replacement.Body.MaxBytes != 0 {
+		o.Body.MaxBytes = replacement.Body.MaxBytes
+	}
+
+	if replacement.Ops.Prefix != "" {
+		o.Ops.Prefix = replacement.Ops.Prefix
+	}
+
+	if replacement.Ops.Release != "" {
+		o.Ops.Release = replacement.Ops.Release
+	}
+
+	if replacement.Ops.EnableHealth {
+		o.Ops.EnableHealth = replacement.Ops.EnableHealth
+	}
+
+	if replacement.Ops.EnableReady {
+		o.Ops.EnableReady = replacement.Ops.EnableReady
+	}
+
+	if replacement.Ops.EnableMetrics {
+		o.Ops.EnableMetrics = replacement.Ops.EnableMetrics
+	}
+
+	if replacement.Ops.EnableVersion {
+		o.Ops.EnableVersion = replacement.Ops.EnableVersion
+	}
+
+	if replacement.Ops.EnableVars {
+		o.Ops.EnableVars = replacement.Ops.EnableVars
+	}
+
+	if replacement.Ops.EnableRoutes {
+		o.Ops.EnableRoutes = replacement.Ops.EnableRoutes
+	}
+
+	if replacement.JWKS.URL != "" {
+		o.JWKS.URL = replacement.JWKS.URL
+	}
+
+	if replacement.JWKS.RefreshInterval != 0 {
+		o.JWKS.RefreshInterval = replacement.JWKS.RefreshInterval
+	}
+
+	if replacement.JWKS.MinRefreshInterval != 0 {
+		o.JWKS.MinRefreshInterval = replacement.JWKS.MinRefreshInterval
+	}
+
+	if replacement.JWKS.StaleIfError != 0 {
+		o.JWKS.StaleIfError = replacement.JWKS.StaleIfError
+	}
+
+	if replacement.JWKS.Timeout != 0 {
+		o.JWKS.Timeout = replacement.JWKS.Timeout
+	}
 }
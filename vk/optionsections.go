@@ -0,0 +1,355 @@
+package vk
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSOptions configures the middleware created by CORSFromOptions, and with Preflight, the server's router. From the
+// environment, it is set with VK_CORS_* variables, i.e. VK_CORS_ALLOWED_ORIGINS=https://a.example.com,https://b.example.com
+type CORSOptions struct {
+	AllowedOrigins   []string      `env:"ALLOWED_ORIGINS"` // origins allowed to make requests, or "*" for any
+	AllowedMethods   []string      `env:"ALLOWED_METHODS"` // methods allowed in preflight requests, any method requested if empty
+	AllowedHeaders   []string      `env:"ALLOWED_HEADERS"` // headers allowed in preflight requests, any header requested if empty
+	AllowCredentials bool          `env:"ALLOW_CREDENTIALS"`
+	MaxAge           time.Duration `env:"MAX_AGE"` // how long preflight responses can be cached
+
+	// Preflight makes the server's router answer the preflight requests of paths without an OPTIONS route, and allow
+	// the origin of routed responses, see Router.EnableCORS. Its preflight responses allow the routed methods that are
+	// in AllowedMethods, and AllowedHeaders, or the default headers if it is empty
+	Preflight bool `env:"PREFLIGHT"`
+}
+
+// RateLimitOptions configures the middleware created by RateLimitFromOptions, with VK_RATELIMIT_* variables
+type RateLimitOptions struct {
+	RPS           float64 `env:"RPS"`            // requests per second across the server, unlimited if 0
+	Burst         int     `env:"BURST"`          // requests allowed in a burst above RPS, defaults to 1
+	MaxConcurrent int     `env:"MAX_CONCURRENT"` // requests handled at once, unlimited if 0
+}
+
+// BodyOptions configures the middleware created by BodyLimitFromOptions, with VK_BODY_* variables
+type BodyOptions struct {
+	MaxBytes int64 `env:"MAX_BYTES"` // the largest request body accepted, unlimited if 0 (DefaultBodyMaxBytes for ctx.Bind)
+}
+
+// OpsOptions selects the endpoints of the group created by OpsGroup, with VK_OPS_* variables
+type OpsOptions struct {
+	Prefix        string `env:"PREFIX"`  // where the endpoints are mounted, /-/ by default
+	Release       string `env:"RELEASE"` // the version reported by the version endpoint, the module version by default
+	EnableHealth  bool   `env:"HEALTH"`
+	EnableReady   bool   `env:"READY"`
+	EnableMetrics bool   `env:"METRICS"`
+	EnableVersion bool   `env:"VERSION"`
+	EnableVars    bool   `env:"VARS"`
+	EnableRoutes  bool   `env:"ROUTES"`
+}
+
+// optionSections are the environment prefixes of the sections of Options, below the server's prefix
+var optionSections = map[string]reflect.Type{
+	"CORS_":      reflect.TypeOf(CORSOptions{}),
+	"RATELIMIT_": reflect.TypeOf(RateLimitOptions{}),
+	"BODY_":      reflect.TypeOf(BodyOptions{}),
+	"OPS_":       reflect.TypeOf(OpsOptions{}),
+	"JWKS_":      reflect.TypeOf(JWKSOptions{}),
+}
+
+// OptionsError lists everything wrong with a server's Options, such as invalid values in the environment.
+// It is returned by Options.Validate, and by Server.Start before the server starts
+type OptionsError struct {
+	Problems []string
+}
+
+func (o OptionsError) Error() string {
+	return "invalid options: " + strings.Join(o.Problems, "; ")
+}
+
+// Validate returns an OptionsError listing every problem with the options, or nil if there are none
+func (o *Options) Validate() error {
+	problems := append([]string{}, o.problems...)
+	problems = append(problems, o.CORS.problems()...)
+	problems = append(problems, o.RateLimit.problems()...)
+	problems = append(problems, o.Body.problems()...)
+	problems = append(problems, o.Ops.problems()...)
+	problems = append(problems, o.JWKS.problems()...)
+	problems = append(problems, o.StateSealing.problems()...)
+
+	if o.MaxWebSockets < 0 || o.MaxWebSocketsPerClient < 0 {
+		problems = append(problems, "websocket limits cannot be negative")
+	}
+
+	if o.MaxConnections < 0 || o.MaxConnectionsPerClient < 0 {
+		problems = append(problems, "connection limits cannot be negative")
+	}
+
+	if o.IdleReapThreshold < 0 || o.IdleReapAfter < 0 {
+		problems = append(problems, "idle reaping threshold and duration cannot be negative")
+	} else if (o.IdleReapThreshold > 0) != (o.IdleReapAfter > 0) {
+		problems = append(problems, "idle reaping requires both a threshold and a duration")
+	}
+
+	if o.DisableAutocert && o.TLSConfig == nil && o.CertDir == "" && o.GetCertificate == nil && (o.Domain != "" || o.HostPolicy != nil) {
+		problems = append(problems, "autocert is disabled, but no other source of certificates is configured")
+	}
+
+	if o.StrictEnv {
+		problems = append(problems, o.unknownEnv()...)
+	}
+
+	if o.ShutdownTimeout < 0 {
+		problems = append(problems, "shutdown timeout cannot be negative")
+	}
+
+	if len(problems) > 0 {
+		return OptionsError{Problems: problems}
+	}
+
+	return nil
+}
+
+// CORSFromOptions returns a Middleware that sets CORS headers as configured by o.CORS, or nil (which
+// WithMiddlewares and WrapHandler skip) if it allows no origins
+func CORSFromOptions(o *Options) Middleware {
+	if o == nil || len(o.CORS.AllowedOrigins) == 0 {
+		return nil
+	}
+
+	return CORSMiddleware(o.CORS)
+}
+
+// RateLimitFromOptions returns a Middleware limiting the rate and concurrency of all of the requests it
+// handles as configured by o.RateLimit (see QuotaMiddleware), or nil if it sets no limits
+func RateLimitFromOptions(o *Options) Middleware {
+	if o == nil || (o.RateLimit.RPS == 0 && o.RateLimit.MaxConcurrent == 0) {
+		return nil
+	}
+
+	quota := Quota{Key: "server", Rate: o.RateLimit.RPS, Burst: o.RateLimit.Burst, MaxConcurrent: o.RateLimit.MaxConcurrent}
+
+	return QuotaMiddleware(func(_ *Ctx) Quota {
+		return quota
+	})
+}
+
+// BodyLimitFromOptions returns BodyLimitMiddleware with o.Body.MaxBytes, or nil if it is 0
+func BodyLimitFromOptions(o *Options) Middleware {
+	if o == nil || o.Body.MaxBytes == 0 {
+		return nil
+	}
+
+	return BodyLimitMiddleware(o.Body.MaxBytes)
+}
+
+// CORSMiddleware allows cross-origin requests from the configured origins. Preflight requests are answered with
+// the allowed methods and headers by the route that handles OPTIONS, or if there isn't one, by the router with a 204
+// for the routes that the middleware wraps
+func CORSMiddleware(opts CORSOptions) Middleware {
+	return namedWithValue("cors", opts, func(inner HandlerFunc) HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request, ctx *Ctx) error {
+			if r.Header.Get("Origin") == "" {
+				return inner(w, r, ctx)
+			}
+
+			ctx.AddVary("Origin")
+
+			if opts.allowOrigin(ctx.RespHeaders, r) && r.Method == http.MethodOptions {
+				opts.allowPreflight(ctx.RespHeaders, r)
+			}
+
+			return inner(w, r, ctx)
+		}
+	})
+}
+
+// allowOrigin sets the headers allowing the origin of a cross-origin request, returning false if it isn't allowed
+func (c CORSOptions) allowOrigin(header http.Header, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	anyOrigin := containsFold(c.AllowedOrigins, "*")
+
+	if !anyOrigin && !containsFold(c.AllowedOrigins, origin) {
+		return false
+	}
+
+	// a wildcard can't be used with credentials, so the origin is echoed instead
+	if anyOrigin && !c.AllowCredentials {
+		header.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		header.Set("Access-Control-Allow-Origin", origin)
+	}
+
+	if c.AllowCredentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+
+	return true
+}
+
+// allowPreflight sets the headers answering a preflight request, if r is one
+func (c CORSOptions) allowPreflight(header http.Header, r *http.Request) {
+	method := r.Header.Get("Access-Control-Request-Method")
+	if method == "" {
+		return
+	}
+
+	methods := strings.Join(c.AllowedMethods, ", ")
+	if methods == "" {
+		methods = method
+	}
+
+	headers := strings.Join(c.AllowedHeaders, ", ")
+	if headers == "" {
+		headers = r.Header.Get("Access-Control-Request-Headers")
+	}
+
+	header.Set("Access-Control-Allow-Methods", methods)
+
+	if headers != "" {
+		header.Set("Access-Control-Allow-Headers", headers)
+	}
+
+	if c.MaxAge > 0 {
+		header.Set("Access-Control-Max-Age", strconv.Itoa(int(c.MaxAge.Seconds())))
+	}
+}
+
+func (c CORSOptions) problems() []string {
+	var problems []string
+
+	for _, o := range c.AllowedOrigins {
+		if o == "*" {
+			continue
+		}
+
+		if u, err := url.Parse(o); err != nil || u.Scheme == "" || u.Host == "" || strings.TrimSuffix(u.Path, "/") != "" {
+			problems = append(problems, fmt.Sprintf("CORS: invalid allowed origin %q, expected scheme://host[:port] or *", o))
+		}
+	}
+
+	for _, m := range c.AllowedMethods {
+		if !isKnownMethod(m) {
+			problems = append(problems, fmt.Sprintf("CORS: unknown allowed method %q", m))
+		}
+	}
+
+	if c.MaxAge < 0 {
+		problems = append(problems, "CORS: max age cannot be negative")
+	}
+
+	return problems
+}
+
+func (r RateLimitOptions) problems() []string {
+	var problems []string
+
+	if r.RPS < 0 {
+		problems = append(problems, "RateLimit: RPS cannot be negative")
+	}
+
+	if r.Burst < 0 {
+		problems = append(problems, "RateLimit: burst cannot be negative")
+	}
+
+	if r.MaxConcurrent < 0 {
+		problems = append(problems, "RateLimit: max concurrent cannot be negative")
+	}
+
+	return problems
+}
+
+func (b BodyOptions) problems() []string {
+	if b.MaxBytes < 0 {
+		return []string{"Body: max bytes cannot be negative"}
+	}
+
+	return nil
+}
+
+func (o OpsOptions) problems() []string {
+	if o.Prefix != "" && !strings.HasPrefix(o.Prefix, "/") {
+		return []string{fmt.Sprintf("Ops: prefix %q must start with /", o.Prefix)}
+	}
+
+	return nil
+}
+
+func (j JWKSOptions) problems() []string {
+	var problems []string
+
+	if j.URL != "" {
+		if u, err := url.Parse(j.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("JWKS: invalid URL %q", j.URL))
+		}
+	}
+
+	if j.RefreshInterval < 0 || j.MinRefreshInterval < 0 || j.StaleIfError < 0 {
+		problems = append(problems, "JWKS: intervals cannot be negative")
+	}
+
+	if j.Timeout < 0 {
+		problems = append(problems, "JWKS: timeout cannot be negative")
+	}
+
+	return problems
+}
+
+// unknownSectionVars returns a problem for each environment variable that has the prefix of one of
+// the sections of Options, but isn't one of its settings (such as a misspelled setting)
+func unknownSectionVars(prefix string, environ []string) []string {
+	var problems []string
+
+	for _, kv := range environ {
+		name, _, _ := strings.Cut(kv, "=")
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+
+		key := strings.TrimPrefix(name, prefix)
+
+		for sectionPrefix, section := range optionSections {
+			if !strings.HasPrefix(key, sectionPrefix) {
+				continue
+			}
+
+			if !hasEnvField(section, strings.TrimPrefix(key, sectionPrefix)) {
+				problems = append(problems, fmt.Sprintf("unknown setting %s", name))
+			}
+		}
+	}
+
+	return problems
+}
+
+// hasEnvField returns true if one of the fields of t has the env tag key
+func hasEnvField(t reflect.Type, key string) bool {
+	for i := 0; i < t.NumField(); i++ {
+		if name, _, _ := strings.Cut(t.Field(i).Tag.Get("env"), ","); name == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isKnownMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+
+	return false
+}
+
+func containsFold(values []string, s string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+
+	return false
+}
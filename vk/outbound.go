@@ -0,0 +1,300 @@
+package vk
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// RequestIDHeader carries the ID of a request in its response, and in the requests made on its behalf
+	RequestIDHeader = "X-Request-ID"
+
+	// TraceparentHeader carries the W3C trace context, see Ctx.HTTPClient
+	TraceparentHeader = "traceparent"
+)
+
+// OutboundOption configures a client returned by Ctx.HTTPClient
+type OutboundOption func(*outboundOptions)
+
+type outboundOptions struct {
+	timeout   time.Duration
+	transport http.RoundTripper
+}
+
+// OutboundTimeout limits each call made with the client, the request's remaining deadline is used if it is sooner
+func OutboundTimeout(timeout time.Duration) OutboundOption {
+	return func(o *outboundOptions) {
+		o.timeout = timeout
+	}
+}
+
+// OutboundTransport sets the RoundTripper that calls are made with, http.DefaultTransport by default
+func OutboundTransport(transport http.RoundTripper) OutboundOption {
+	return func(o *outboundOptions) {
+		o.transport = transport
+	}
+}
+
+// HTTPClient returns a client for calling downstream services on behalf of the request. Each call it makes:
+//
+//   - carries the request's Correlation (with the request as the call's cause), the claim headers set by
+//     ClaimsPropagation (see OutboundHeaders), and the request's traceparent, if it had one, with a new parent ID.
+//     The Correlation and claim headers aren't sent when the call is redirected to another host
+//   - is cancelled if the request is cancelled, such as when its client goes away or its handler times out
+//   - times out at the request's deadline, or earlier with OutboundTimeout
+//   - carries the time it has left in the DeadlineHeader, if UseDeadlinePropagation is set and it has a deadline
+//   - is recorded by host in the server's OutboundCalls
+//
+// The client is cheap to create, so a new one can be created for each request
+func (c *Ctx) HTTPClient(opts ...OutboundOption) *http.Client {
+	o := outboundOptions{transport: http.DefaultTransport}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	client := &http.Client{
+		Transport: &outboundTransport{ctx: c, opts: o},
+	}
+
+	return client
+}
+
+// outboundTransport decorates the calls made by a client returned by Ctx.HTTPClient
+type outboundTransport struct {
+	ctx  *Ctx
+	opts outboundOptions
+}
+
+func (t *outboundTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	callCtx, cancel := t.callContext(req.Context())
+
+	// a RoundTripper mustn't modify the request it is given
+	req = req.Clone(callCtx)
+
+	// a redirect to another host mustn't be told who the request is from
+	if sameHost(req, originalRequest(req)) {
+		t.ctx.applyOutboundHeaders(req.Header)
+		t.ctx.applyCorrelationHeaders(req.Header)
+	}
+
+	t.ctx.applyDeadlineHeader(req.Header, callCtx)
+
+	if traceparent := t.traceparent(); traceparent != "" {
+		req.Header.Set(TraceparentHeader, traceparent)
+	}
+
+	start := time.Now()
+	resp, err := t.opts.transport.RoundTrip(req)
+
+	t.ctx.outboundCalls.observe(req.URL.Host, time.Since(start), resp, err)
+
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	// the call's context must outlive the response body, which can't be read once it is cancelled
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+
+	return resp, nil
+}
+
+// originalRequest returns the first request of the redirects that led to req, or req itself if it wasn't redirected
+func originalRequest(req *http.Request) *http.Request {
+	for req.Response != nil && req.Response.Request != nil {
+		req = req.Response.Request
+	}
+
+	return req
+}
+
+// sameHost returns true if a and b are for the same host and port
+func sameHost(a, b *http.Request) bool {
+	return strings.EqualFold(a.URL.Host, b.URL.Host)
+}
+
+// callContext derives the context of a call from parent (the context of the outbound request), which is cancelled
+// along with the request being handled, and has the earliest of its deadline and the call's timeout
+func (t *outboundTransport) callContext(parent context.Context) (context.Context, context.CancelFunc) {
+	var handled []context.Context
+	if t.ctx != nil {
+		if t.ctx.Context != nil {
+			handled = append(handled, t.ctx.Context)
+		}
+
+		if t.ctx.request != nil {
+			handled = append(handled, t.ctx.request.Context())
+		}
+	}
+
+	var deadline time.Time
+
+	if t.opts.timeout > 0 {
+		deadline = time.Now().Add(t.opts.timeout)
+	}
+
+	for _, h := range handled {
+		if d, ok := h.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+			deadline = d
+		}
+	}
+
+	callCtx, cancel := context.WithCancel(parent)
+	if !deadline.IsZero() {
+		cancel()
+		callCtx, cancel = context.WithDeadline(parent, deadline)
+	}
+
+	for _, h := range handled {
+		if h.Done() == nil {
+			continue
+		}
+
+		go func(h context.Context) {
+			select {
+			case <-h.Done():
+				// h can be cancelled as its deadline passes, which the call's own deadline (no later than h's) reports
+				// as DeadlineExceeded instead
+				if d, ok := h.Deadline(); !ok || time.Now().Before(d) {
+					cancel()
+				}
+			case <-callCtx.Done():
+			}
+		}(h)
+	}
+
+	return callCtx, cancel
+}
+
+// traceparent returns the request's traceparent header with a new parent ID, or an empty string if it didn't have a
+// valid one
+func (t *outboundTransport) traceparent() string {
+	if t.ctx == nil || t.ctx.request == nil {
+		return ""
+	}
+
+	// version-traceid-parentid-flags, see https://www.w3.org/TR/trace-context/#traceparent-header
+	parts := strings.Split(t.ctx.request.Header.Get(TraceparentHeader), "-")
+	if len(parts) != 4 || len(parts[0]) != 2 || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return ""
+	}
+
+	for _, p := range parts {
+		if _, err := hex.DecodeString(p); err != nil {
+			return ""
+		}
+	}
+
+	parent := make([]byte, 8)
+	if _, err := rand.Read(parent); err != nil {
+		return ""
+	}
+
+	return strings.Join([]string{parts[0], parts[1], hex.EncodeToString(parent), parts[3]}, "-")
+}
+
+// cancelOnClose cancels the context of a call once its response body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+
+	return err
+}
+
+// OutboundHostStats reports the calls made to a downstream host
+type OutboundHostStats struct {
+	Host   string        `json:"host"`
+	Calls  uint64        `json:"calls"`
+	Errors uint64        `json:"errors"` // calls that failed or got a 5xx response
+	P50    time.Duration `json:"p50"`    // the time until the response's headers were received
+	P99    time.Duration `json:"p99"`
+}
+
+// OutboundCalls records the calls made with the clients returned by Ctx.HTTPClient, by host
+type OutboundCalls struct {
+	hosts sync.Map // host -> *outboundHost
+}
+
+type outboundHost struct {
+	hist   LatencyHistogram
+	errors uint64
+}
+
+func newOutboundCalls() *OutboundCalls {
+	return &OutboundCalls{}
+}
+
+// Stats returns the calls made to each host, sorted by host
+func (o *OutboundCalls) Stats() []OutboundHostStats {
+	stats := []OutboundHostStats{}
+	if o == nil {
+		return stats
+	}
+
+	o.hosts.Range(func(k, v interface{}) bool {
+		host := v.(*outboundHost)
+
+		stats = append(stats, OutboundHostStats{
+			Host:   k.(string),
+			Calls:  host.hist.Count(),
+			Errors: atomic.LoadUint64(&host.errors),
+			P50:    host.hist.Quantile(0.5),
+			P99:    host.hist.Quantile(0.99),
+		})
+
+		return true
+	})
+
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Host < stats[j].Host })
+
+	return stats
+}
+
+// RegisterAdmin mounts GET /outbound on the admin router, reporting the calls made to each host
+func (o *OutboundCalls) RegisterAdmin(r *Router) {
+	r.GET("/outbound", func(w http.ResponseWriter, _ *http.Request, ctx *Ctx) error {
+		return RespondJSON(ctx.Context, w, o.Stats(), http.StatusOK)
+	})
+}
+
+// observe records a call to host
+func (o *OutboundCalls) observe(host string, d time.Duration, resp *http.Response, err error) {
+	if o == nil {
+		return
+	}
+
+	v, ok := o.hosts.Load(host)
+	if !ok {
+		v, _ = o.hosts.LoadOrStore(host, &outboundHost{})
+	}
+
+	h := v.(*outboundHost)
+	h.hist.Observe(d)
+
+	if err != nil || resp.StatusCode >= http.StatusInternalServerError {
+		atomic.AddUint64(&h.errors, 1)
+	}
+}
+
+// useOutboundCalls sets the OutboundCalls that the router's Ctxs record their outbound calls in
+func (rt *Router) useOutboundCalls(calls *OutboundCalls) {
+	rt.outboundCalls = calls
+}
+
+// OutboundCalls returns the record of the calls made by handlers with Ctx.HTTPClient
+func (s *Server) OutboundCalls() *OutboundCalls {
+	return s.outbound
+}
@@ -0,0 +1,330 @@
+package vk
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxPanicFingerprints  = 256
+	panicFingerprintDepth = 5
+	vkPackagePrefix       = "github.com/suborbital/vektor/vk."
+)
+
+// PanicReport describes a panic recovered by the router. Panics with the same fingerprint (the type and message of
+// the panic value, and the top frames of the stack outside of vk and the standard library) are counted together
+type PanicReport struct {
+	Fingerprint string    `json:"fingerprint"`
+	Type        string    `json:"type"`
+	Message     string    `json:"message"`
+	Frames      []string  `json:"frames"`
+	Stack       string    `json:"-"`
+	Count       int       `json:"count"`
+	FirstSeen   time.Time `json:"first_seen"`
+	LastSeen    time.Time `json:"last_seen"`
+}
+
+// Panics tracks the panics recovered by a Router by fingerprint, keeping the most recently seen in a bounded LRU
+type Panics struct {
+	lock    sync.Mutex
+	order   *list.List // of *PanicReport, most recently seen first
+	reports map[string]*list.Element
+
+	onNew        func(PanicReport)
+	onSummary    func([]PanicReport)
+	summaryEvery time.Duration
+	summarizing  bool
+	closing      <-chan struct{}
+	sinceFlush   int
+}
+
+func newPanics() *Panics {
+	p := &Panics{
+		order:   list.New(),
+		reports: map[string]*list.Element{},
+	}
+
+	return p
+}
+
+// OnNewPanic sets a function that is called the first time a panic with a given fingerprint is recovered
+func (rt *Router) OnNewPanic(fn func(PanicReport)) {
+	rt.panics.lock.Lock()
+	defer rt.panics.lock.Unlock()
+
+	rt.panics.onNew = fn
+}
+
+// OnPanicSummary calls fn every interval with the reports of every tracked fingerprint, if any panics were
+// recovered during that interval. Summaries start once the router is served by a Server, and stop when it starts
+// shutting down
+func (rt *Router) OnPanicSummary(interval time.Duration, fn func([]PanicReport)) {
+	rt.panics.lock.Lock()
+	rt.panics.onSummary = fn
+	if !rt.panics.summarizing {
+		rt.panics.summaryEvery = interval
+	}
+	rt.panics.lock.Unlock()
+
+	rt.panics.startSummary(nil)
+}
+
+// OnNewPanic sets a function that is called the first time the server's router recovers a panic with a given fingerprint
+func (s *Server) OnNewPanic(fn func(PanicReport)) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	s.internalRouter.OnNewPanic(fn)
+}
+
+// Panics returns the router's panic tracker
+func (rt *Router) Panics() *Panics {
+	return rt.panics
+}
+
+// Panics returns the panic tracker of the server's router
+func (s *Server) Panics() *Panics {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.internalRouter.panics
+}
+
+// Reports returns the tracked panics, most recently seen first
+func (p *Panics) Reports() []PanicReport {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	reports := make([]PanicReport, 0, p.order.Len())
+	for e := p.order.Front(); e != nil; e = e.Next() {
+		reports = append(reports, *e.Value.(*PanicReport))
+	}
+
+	return reports
+}
+
+// RegisterAdmin mounts GET /panics on the admin router, reporting the tracked panic fingerprints
+func (p *Panics) RegisterAdmin(r *Router) {
+	r.GET("/panics", func(w http.ResponseWriter, _ *http.Request, ctx *Ctx) error {
+		return RespondJSON(ctx.Context, w, p.Reports(), http.StatusOK)
+	})
+}
+
+// record tracks a recovered panic, returning its report and whether its fingerprint is new
+func (p *Panics) record(value interface{}, stack []byte) (PanicReport, bool) {
+	frames := panicFrames()
+
+	typ := fmt.Sprintf("%T", value)
+	message := fmt.Sprint(value)
+	fingerprint := panicFingerprint(typ, message, frames)
+	now := time.Now()
+
+	p.lock.Lock()
+
+	p.sinceFlush++
+
+	if e, ok := p.reports[fingerprint]; ok {
+		report := e.Value.(*PanicReport)
+		report.Count++
+		report.LastSeen = now
+		report.Stack = string(stack)
+
+		p.order.MoveToFront(e)
+
+		copied := *report
+		p.lock.Unlock()
+
+		return copied, false
+	}
+
+	report := &PanicReport{
+		Fingerprint: fingerprint,
+		Type:        typ,
+		Message:     message,
+		Frames:      frames,
+		Stack:       string(stack),
+		Count:       1,
+		FirstSeen:   now,
+		LastSeen:    now,
+	}
+
+	p.reports[fingerprint] = p.order.PushFront(report)
+
+	if p.order.Len() > maxPanicFingerprints {
+		oldest := p.order.Back()
+		p.order.Remove(oldest)
+		delete(p.reports, oldest.Value.(*PanicReport).Fingerprint)
+	}
+
+	copied := *report
+	onNew := p.onNew
+
+	p.lock.Unlock()
+
+	// call the hook without holding the lock
+	if onNew != nil {
+		onNew(copied)
+	}
+
+	return copied, true
+}
+
+// summarize calls the summary function if any panics were recovered since the last summary
+// startSummary starts the summary ticker once both a summary function and the server's closing channel are set. A nil
+// closing keeps the channel already set
+func (p *Panics) startSummary(closing <-chan struct{}) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if closing != nil {
+		p.closing = closing
+	}
+
+	if p.summarizing || p.onSummary == nil || p.summaryEvery <= 0 || p.closing == nil {
+		return
+	}
+
+	p.summarizing = true
+
+	go p.summarizeEvery(p.summaryEvery, p.closing)
+}
+
+// summarizeEvery calls summarize every interval until closing is closed
+func (p *Panics) summarizeEvery(interval time.Duration, closing <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-closing:
+			return
+		case <-ticker.C:
+			p.summarize()
+		}
+	}
+}
+
+func (p *Panics) summarize() {
+	p.lock.Lock()
+	onSummary := p.onSummary
+	pending := p.sinceFlush
+	p.sinceFlush = 0
+	p.lock.Unlock()
+
+	if onSummary == nil || pending == 0 {
+		return
+	}
+
+	reports := p.Reports()
+	sort.SliceStable(reports, func(i, j int) bool { return reports[i].Count > reports[j].Count })
+
+	onSummary(reports)
+}
+
+// recoverPanic is deferred by the router's handlers. It records the panic and responds with a 500 unless the response
+// has already started, but http.ErrAbortHandler is re-panicked so that the server closes the connection as intended
+func (rt *Router) recoverPanic(w http.ResponseWriter, ctx *Ctx) {
+	value := recover()
+	if value == nil {
+		return
+	}
+
+	if value == http.ErrAbortHandler {
+		panic(value)
+	}
+
+	stack := debug.Stack()
+
+	var report PanicReport
+	var isNew bool
+
+	// the panics of a route in an isolation domain are only tracked by its domain
+	if ctx.domain != nil {
+		report, isNew = ctx.domain.recordPanic(value, stack)
+	} else {
+		report, isNew = rt.panics.record(value, stack)
+	}
+
+	ctx.devCapture.panicked(report)
+
+	if isNew {
+		ctx.Log.ErrorString(fmt.Sprintf("recovered panic [%s]: %s%s\n%s", report.Fingerprint, report.Message, ctx.domainLabel(), report.Stack))
+	} else {
+		ctx.Log.Debug(fmt.Sprintf("recovered panic [%s] (seen %d times): %s%s\n%s", report.Fingerprint, report.Count, report.Message, ctx.domainLabel(), report.Stack))
+	}
+
+	// the committed response is final, see CommitResponse
+	if ctx.commitAttempted() {
+		return
+	}
+
+	// a response that has started can't be replaced, the 500 would only be appended to it
+	if ctx.summary != nil && ctx.summary.responseStatus() != 0 {
+		return
+	}
+
+	respondError(w, ctx.request, ctx.errorFormatter, E(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError)))
+}
+
+// panicFrames returns the top frames of the panicking goroutine's stack that are outside of vk and the standard
+// library, formatted as function:line. It must be called while the panic is being recovered
+func panicFrames() []string {
+	pcs := make([]uintptr, 64)
+	n := runtime.Callers(1, pcs)
+
+	frames := runtime.CallersFrames(pcs[:n])
+	found := make([]string, 0, panicFingerprintDepth)
+
+	for len(found) < panicFingerprintDepth {
+		frame, more := frames.Next()
+
+		if frame.Function != "" && !isStdlibFunction(frame.Function) && !strings.HasPrefix(frame.Function, vkPackagePrefix) {
+			found = append(found, fmt.Sprintf("%s:%d", frame.Function, frame.Line))
+		}
+
+		if !more {
+			break
+		}
+	}
+
+	return found
+}
+
+// isStdlibFunction returns true if fn belongs to the standard library, whose import paths have no dot in their first element
+func isStdlibFunction(fn string) bool {
+	if strings.HasPrefix(fn, "main.") {
+		return false
+	}
+
+	first := fn
+	if i := strings.Index(fn, "/"); i >= 0 {
+		first = fn[:i]
+	} else if i := strings.Index(fn, "."); i >= 0 {
+		first = fn[:i]
+	}
+
+	return !strings.Contains(first, ".")
+}
+
+func panicFingerprint(typ, message string, frames []string) string {
+	h := sha256.New()
+	h.Write([]byte(typ))
+	h.Write([]byte{0})
+	h.Write([]byte(message))
+
+	for _, f := range frames {
+		h.Write([]byte{0})
+		h.Write([]byte(f))
+	}
+
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
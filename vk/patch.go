@@ -0,0 +1,731 @@
+package vk
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"mime"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// MergePatchContentType is the media type of JSON Merge Patch (RFC 7386) request bodies
+	MergePatchContentType = "application/merge-patch+json"
+	// JSONPatchContentType is the media type of JSON Patch (RFC 6902) request bodies
+	JSONPatchContentType = "application/json-patch+json"
+
+	// MaxPatchBytes is the largest patch body that ApplyMergePatch and ApplyJSONPatch accept
+	MaxPatchBytes = 1 << 20
+	// MaxJSONPatchOps is the most operations that ApplyJSONPatch accepts in one patch
+	MaxJSONPatchOps = 100
+)
+
+// MergePatch is the set of fields present in a merge patch, see Ctx.Patch
+type MergePatch struct {
+	fields map[string]bool // true if the field was set to null
+}
+
+// Has returns true if the field at path was present in the patch, including if it was set to null. Nested fields
+// are separated by dots, i.e. address.city
+func (p *MergePatch) Has(path string) bool {
+	if p == nil {
+		return false
+	}
+
+	_, ok := p.fields[path]
+
+	return ok
+}
+
+// IsNull returns true if the field at path was set to null (i.e. cleared) by the patch
+func (p *MergePatch) IsNull(path string) bool {
+	if p == nil {
+		return false
+	}
+
+	return p.fields[path]
+}
+
+// Fields returns the paths of the fields present in the patch, sorted
+func (p *MergePatch) Fields() []string {
+	if p == nil {
+		return nil
+	}
+
+	fields := make([]string, 0, len(p.fields))
+	for field := range p.fields {
+		fields = append(fields, field)
+	}
+
+	sort.Strings(fields)
+
+	return fields
+}
+
+// ApplyPatch applies the request body to target with ApplyMergePatch or ApplyJSONPatch, depending on its
+// Content-Type, returning a 415 vk.Error for any other type
+func (c *Ctx) ApplyPatch(target interface{}) error {
+	switch c.patchContentType() {
+	case MergePatchContentType:
+		return c.ApplyMergePatch(target)
+	case JSONPatchContentType:
+		return c.ApplyJSONPatch(target)
+	}
+
+	return c.unsupportedPatch(MergePatchContentType, JSONPatchContentType)
+}
+
+// ApplyMergePatch applies the request body to target (a pointer, usually to a struct) as a JSON Merge Patch
+// (RFC 7386): fields in the patch replace those in target, objects are merged recursively, and fields set to null
+// are cleared. The fields present in the patch are available from Ctx.Patch afterwards, so that handlers can tell a
+// field that was set to null from one that was absent. target is encoded and decoded with EncodeJSON and
+// DecodeJSON, so registered scalars apply. The request must have the Content-Type MergePatchContentType (415
+// otherwise), and the errors returned are vk.Errors that handlers can return as they are
+func (c *Ctx) ApplyMergePatch(target interface{}) error {
+	if c.patchContentType() != MergePatchContentType {
+		return c.unsupportedPatch(MergePatchContentType)
+	}
+
+	body, err := c.readPatch()
+	if err != nil {
+		return err
+	}
+
+	var patch interface{}
+	if err := decodeGeneric(body, &patch); err != nil {
+		return E(http.StatusBadRequest, "invalid merge patch: "+err.Error())
+	}
+
+	doc, original, err := genericDocument(target)
+	if err != nil {
+		return err
+	}
+
+	fields := map[string]bool{}
+	collectPatchFields(patch, "", fields)
+	c.patch = &MergePatch{fields: fields}
+
+	return setFromDocument(target, original, mergePatch(doc, patch))
+}
+
+// ApplyJSONPatch applies the request body to doc (a pointer) as a JSON Patch (RFC 6902), supporting the add,
+// remove, replace, move, copy and test operations. The patch is applied atomically: doc is only changed if every
+// operation succeeds. A failed test operation returns a 409 vk.Error, an operation that can't be applied returns
+// 422, and a patch of more than MaxJSONPatchOps operations returns 413. The request must have the Content-Type
+// JSONPatchContentType (415 otherwise)
+func (c *Ctx) ApplyJSONPatch(doc interface{}) error {
+	if c.patchContentType() != JSONPatchContentType {
+		return c.unsupportedPatch(JSONPatchContentType)
+	}
+
+	body, err := c.readPatch()
+	if err != nil {
+		return err
+	}
+
+	var ops []jsonPatchOp
+	if err := json.Unmarshal(body, &ops); err != nil {
+		return E(http.StatusBadRequest, "invalid JSON patch: "+err.Error())
+	}
+
+	if len(ops) > MaxJSONPatchOps {
+		return E(http.StatusRequestEntityTooLarge, fmt.Sprintf("JSON patch has %d operations, at most %d are allowed", len(ops), MaxJSONPatchOps))
+	}
+
+	generic, original, err := genericDocument(doc)
+	if err != nil {
+		return err
+	}
+
+	for i, op := range ops {
+		generic, err = op.apply(generic)
+		if err != nil {
+			if e, ok := err.(Error); ok {
+				return E(e.Status(), fmt.Sprintf("operation %d (%s %s): %s", i, op.Op, op.Path, e.Message()))
+			}
+
+			return err
+		}
+	}
+
+	return setFromDocument(doc, original, generic)
+}
+
+// Patch returns the fields present in the merge patch applied by ApplyMergePatch, or nil if none has been applied
+func (c *Ctx) Patch() *MergePatch {
+	if c == nil {
+		return nil
+	}
+
+	return c.patch
+}
+
+// patchContentType returns the media type of the request body, without parameters
+func (c *Ctx) patchContentType() string {
+	if c == nil || c.request == nil {
+		return ""
+	}
+
+	mediaType, _, err := mime.ParseMediaType(c.request.Header.Get(contentTypeHeaderKey))
+	if err != nil {
+		return ""
+	}
+
+	return mediaType
+}
+
+// unsupportedPatch returns a 415 vk.Error, advertising the patch types that are accepted (RFC 5789, section 3.1)
+func (c *Ctx) unsupportedPatch(accepted ...string) error {
+	if c != nil && c.RespHeaders != nil {
+		c.RespHeaders.Set("Accept-Patch", strings.Join(accepted, ", "))
+	}
+
+	return E(http.StatusUnsupportedMediaType, "patch content type must be "+strings.Join(accepted, " or "))
+}
+
+// readPatch reads the request body, up to MaxPatchBytes
+func (c *Ctx) readPatch() ([]byte, error) {
+	if c.request.Body == nil {
+		return nil, E(http.StatusBadRequest, "request body is empty")
+	}
+
+	body, err := io.ReadAll(io.LimitReader(c.request.Body, MaxPatchBytes+1))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, E(http.StatusRequestEntityTooLarge, http.StatusText(http.StatusRequestEntityTooLarge))
+		}
+
+		return nil, E(http.StatusBadRequest, "failed to read request body")
+	}
+
+	if len(body) > MaxPatchBytes {
+		return nil, E(http.StatusRequestEntityTooLarge, fmt.Sprintf("patch is larger than %d bytes", MaxPatchBytes))
+	}
+
+	return body, nil
+}
+
+// genericDocument encodes target and decodes it into maps, slices, and json.Numbers that can be patched. It returns
+// two copies, one to patch and the original to compare the patched document with
+func genericDocument(target interface{}) (interface{}, interface{}, error) {
+	rv := reflect.ValueOf(target)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return nil, nil, errors.New("patch target must be a non-nil pointer")
+	}
+
+	data, err := EncodeJSON(target)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to EncodeJSON patch target")
+	}
+
+	var doc, original interface{}
+	if err := decodeGeneric(data, &doc); err != nil {
+		return nil, nil, errors.Wrap(err, "failed to decodeGeneric patch target")
+	}
+
+	if err := decodeGeneric(data, &original); err != nil {
+		return nil, nil, errors.Wrap(err, "failed to decodeGeneric patch target")
+	}
+
+	return doc, original, nil
+}
+
+// setFromDocument decodes the patched document onto target, so that what the document can't carry (fields tagged
+// json:"-" and unexported fields) is kept, and then zeroes the fields that the patch removed or set to null, which
+// decoding leaves as they were. The document is decoded into a new value first, so that target is unchanged if it
+// is invalid
+func setFromDocument(target, original, doc interface{}) error {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return errors.Wrap(err, "failed to Marshal patched document")
+	}
+
+	rv := reflect.ValueOf(target)
+
+	if err := DecodeJSON(data, reflect.New(rv.Elem().Type()).Interface()); err != nil {
+		return E(http.StatusUnprocessableEntity, "patched document is invalid: "+err.Error())
+	}
+
+	if err := DecodeJSON(data, target); err != nil {
+		return E(http.StatusUnprocessableEntity, "patched document is invalid: "+err.Error())
+	}
+
+	clearRemoved(rv.Elem(), original, doc)
+
+	return nil
+}
+
+// clearRemoved zeroes the fields and map entries of v that are in the original document but were removed from (or
+// set to null in) the patched one
+func clearRemoved(v reflect.Value, original, doc interface{}) {
+	for v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return
+		}
+
+		v = v.Elem()
+	}
+
+	switch o := original.(type) {
+	case map[string]interface{}:
+		d, ok := doc.(map[string]interface{})
+		if !ok {
+			return
+		}
+
+		for key, value := range o {
+			patched, kept := d[key]
+			removed := !kept || patched == nil
+
+			switch v.Kind() {
+			case reflect.Struct:
+				field, ok := jsonField(v, key)
+				if !ok {
+					continue
+				}
+
+				if removed {
+					field.SetZero()
+				} else {
+					clearRemoved(field, value, patched)
+				}
+			case reflect.Map:
+				// the values of a map are decoded from scratch, so only the entries that were removed are left over
+				if k, ok := mapKey(v.Type().Key(), key); ok && removed {
+					v.SetMapIndex(k, reflect.Value{})
+				}
+			}
+		}
+	case []interface{}:
+		d, ok := doc.([]interface{})
+		if !ok || (v.Kind() != reflect.Slice && v.Kind() != reflect.Array) {
+			return
+		}
+
+		for i := 0; i < len(o) && i < len(d) && i < v.Len(); i++ {
+			clearRemoved(v.Index(i), o[i], d[i])
+		}
+	}
+}
+
+// jsonField returns the field of the struct v that is encoded as name, matching it case-insensitively if there is
+// no exact match as decoding does
+func jsonField(v reflect.Value, name string) (reflect.Value, bool) {
+	fields := planFor(v.Type()).fields
+
+	for _, f := range fields {
+		if f.name == name {
+			return fieldByIndex(v, f.index, false)
+		}
+	}
+
+	for _, f := range fields {
+		if strings.EqualFold(f.name, name) {
+			return fieldByIndex(v, f.index, false)
+		}
+	}
+
+	return reflect.Value{}, false
+}
+
+// mapKey converts a document's key to a map key of type t
+func mapKey(t reflect.Type, key string) (reflect.Value, bool) {
+	k := reflect.New(t).Elem()
+
+	switch t.Kind() {
+	case reflect.String:
+		k.SetString(key)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(key, 10, t.Bits())
+		if err != nil {
+			return reflect.Value{}, false
+		}
+
+		k.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(key, 10, t.Bits())
+		if err != nil {
+			return reflect.Value{}, false
+		}
+
+		k.SetUint(n)
+	default:
+		return reflect.Value{}, false
+	}
+
+	return k, true
+}
+
+// decodeGeneric decodes data into v, keeping numbers as json.Numbers so that they aren't rounded
+func decodeGeneric(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+
+	if dec.More() {
+		return errors.New("unexpected data after the JSON value")
+	}
+
+	return nil
+}
+
+// mergePatch applies patch to target as described by RFC 7386, section 2
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = map[string]interface{}{}
+	}
+
+	for key, value := range p {
+		if value == nil {
+			delete(t, key)
+		} else {
+			t[key] = mergePatch(t[key], value)
+		}
+	}
+
+	return t
+}
+
+// collectPatchFields records the dotted path of every field in patch, and whether it is null
+func collectPatchFields(patch interface{}, prefix string, fields map[string]bool) {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	for key, value := range p {
+		path := key
+		if prefix != "" {
+			path = prefix + "." + key
+		}
+
+		fields[path] = value == nil
+		collectPatchFields(value, path, fields)
+	}
+}
+
+// jsonPatchOp is an operation of a JSON Patch
+type jsonPatchOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+// apply applies the operation to doc, returning the new document
+func (op jsonPatchOp) apply(doc interface{}) (interface{}, error) {
+	path, err := parsePointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch op.Op {
+	case "add", "replace", "test":
+		if op.Value == nil {
+			return nil, E(http.StatusBadRequest, "value is required")
+		}
+
+		var value interface{}
+		if err := decodeGeneric(op.Value, &value); err != nil {
+			return nil, E(http.StatusBadRequest, "invalid value: "+err.Error())
+		}
+
+		switch op.Op {
+		case "add":
+			return addAt(doc, path, value)
+		case "replace":
+			if doc, _, err = removeAt(doc, path); err != nil {
+				return nil, err
+			}
+
+			return addAt(doc, path, value)
+		}
+
+		current, err := getAt(doc, path)
+		if err != nil {
+			return nil, err
+		}
+
+		if !jsonEqual(current, value) {
+			return nil, E(http.StatusConflict, "test failed")
+		}
+
+		return doc, nil
+
+	case "remove":
+		if len(path) == 0 {
+			return nil, E(http.StatusUnprocessableEntity, "the whole document cannot be removed")
+		}
+
+		doc, _, err = removeAt(doc, path)
+		return doc, err
+
+	case "move", "copy":
+		from, err := parsePointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+
+		var value interface{}
+
+		if op.Op == "move" {
+			if op.From == op.Path {
+				return doc, nil
+			}
+
+			if strings.HasPrefix(op.Path, op.From+"/") || len(from) == 0 {
+				return nil, E(http.StatusUnprocessableEntity, "a value cannot be moved into itself")
+			}
+
+			if doc, value, err = removeAt(doc, from); err != nil {
+				return nil, err
+			}
+		} else {
+			if value, err = getAt(doc, from); err != nil {
+				return nil, err
+			}
+
+			value = copyGeneric(value)
+		}
+
+		return addAt(doc, path, value)
+	}
+
+	return nil, E(http.StatusBadRequest, "unknown operation")
+}
+
+// parsePointer splits a JSON Pointer (RFC 6901) into its unescaped reference tokens
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, E(http.StatusBadRequest, fmt.Sprintf("invalid path %q", pointer))
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+
+	return tokens, nil
+}
+
+// getAt returns the value at path in doc
+func getAt(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch container := doc.(type) {
+		case map[string]interface{}:
+			value, ok := container[token]
+			if !ok {
+				return nil, E(http.StatusUnprocessableEntity, fmt.Sprintf("%q does not exist", token))
+			}
+
+			doc = value
+		case []interface{}:
+			i, err := arrayIndex(token, len(container)-1)
+			if err != nil {
+				return nil, err
+			}
+
+			doc = container[i]
+		default:
+			return nil, E(http.StatusUnprocessableEntity, fmt.Sprintf("%q does not exist", token))
+		}
+	}
+
+	return doc, nil
+}
+
+// addAt adds value at path in doc (inserting it into an array, or replacing a field of an object), returning the
+// new document
+func addAt(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	return updateParent(doc, path, func(parent interface{}, key string) (interface{}, error) {
+		switch container := parent.(type) {
+		case map[string]interface{}:
+			container[key] = value
+			return container, nil
+		case []interface{}:
+			i := len(container)
+			if key != "-" {
+				var err error
+				if i, err = arrayIndex(key, len(container)); err != nil {
+					return nil, err
+				}
+			}
+
+			container = append(container, nil)
+			copy(container[i+1:], container[i:])
+			container[i] = value
+
+			return container, nil
+		}
+
+		return nil, E(http.StatusUnprocessableEntity, fmt.Sprintf("cannot add %q to a value that isn't an object or array", key))
+	})
+}
+
+// removeAt removes the value at path in doc, returning the new document and the value that was removed
+func removeAt(doc interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, doc, nil
+	}
+
+	var removed interface{}
+
+	doc, err := updateParent(doc, path, func(parent interface{}, key string) (interface{}, error) {
+		switch container := parent.(type) {
+		case map[string]interface{}:
+			value, ok := container[key]
+			if !ok {
+				return nil, E(http.StatusUnprocessableEntity, fmt.Sprintf("%q does not exist", key))
+			}
+
+			removed = value
+			delete(container, key)
+
+			return container, nil
+		case []interface{}:
+			i, err := arrayIndex(key, len(container)-1)
+			if err != nil {
+				return nil, err
+			}
+
+			removed = container[i]
+
+			return append(container[:i:i], container[i+1:]...), nil
+		}
+
+		return nil, E(http.StatusUnprocessableEntity, fmt.Sprintf("%q does not exist", key))
+	})
+
+	return doc, removed, err
+}
+
+// updateParent replaces the container holding the last token of path with the result of update, returning the
+// new document
+func updateParent(doc interface{}, path []string, update func(parent interface{}, key string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return update(doc, path[0])
+	}
+
+	child, err := getAt(doc, path[:1])
+	if err != nil {
+		return nil, err
+	}
+
+	child, err = updateParent(child, path[1:], update)
+	if err != nil {
+		return nil, err
+	}
+
+	switch container := doc.(type) {
+	case map[string]interface{}:
+		container[path[0]] = child
+	case []interface{}:
+		i, _ := strconv.Atoi(path[0])
+		container[i] = child
+	}
+
+	return doc, nil
+}
+
+// arrayIndex parses an array index token, which must be between 0 and max
+func arrayIndex(token string, max int) (int, error) {
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || i > max || (len(token) > 1 && token[0] == '0') {
+		return 0, E(http.StatusUnprocessableEntity, fmt.Sprintf("index %q is out of range", token))
+	}
+
+	return i, nil
+}
+
+// copyGeneric returns a deep copy of a decoded JSON value
+func copyGeneric(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		c := make(map[string]interface{}, len(v))
+		for key, elem := range v {
+			c[key] = copyGeneric(elem)
+		}
+
+		return c
+	case []interface{}:
+		c := make([]interface{}, len(v))
+		for i, elem := range v {
+			c[i] = copyGeneric(elem)
+		}
+
+		return c
+	}
+
+	return value
+}
+
+// jsonEqual compares decoded JSON values as RFC 6902 section 4.6 describes, with numbers compared by value
+func jsonEqual(a, b interface{}) bool {
+	switch av := a.(type) {
+	case json.Number:
+		bv, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+
+		af, _, errA := big.ParseFloat(av.String(), 10, 256, big.ToNearestEven)
+		bf, _, errB := big.ParseFloat(bv.String(), 10, 256, big.ToNearestEven)
+
+		return errA == nil && errB == nil && af.Cmp(bf) == 0
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+
+		for key, elem := range av {
+			other, ok := bv[key]
+			if !ok || !jsonEqual(elem, other) {
+				return false
+			}
+		}
+
+		return true
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+
+		for i := range av {
+			if !jsonEqual(av[i], bv[i]) {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	return a == b
+}
@@ -0,0 +1,204 @@
+package vk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// PhaseOverrun is what a PhaseBudget does with a phase that runs past its budget
+type PhaseOverrun int
+
+const (
+	// PhaseTimeout fails the request with a 504 once a phase has overrun its budget (the default)
+	PhaseTimeout PhaseOverrun = iota
+
+	// PhaseWarn logs a warning and carries on with the rest of the chain
+	PhaseWarn
+)
+
+// PhaseOption configures a PhaseBudget
+type PhaseOption func(*phaseSpec)
+
+// OnPhaseOverrun sets what is done with a phase that overruns its budget, PhaseTimeout by default
+func OnPhaseOverrun(policy PhaseOverrun) PhaseOption {
+	return func(s *phaseSpec) {
+		s.overrun = policy
+	}
+}
+
+// PhaseTiming is how long a phase of a request's chain took, see Ctx.PhaseTimings
+type PhaseTiming struct {
+	Name    string        `json:"name"`
+	Budget  time.Duration `json:"budget"`
+	Elapsed time.Duration `json:"elapsed"`
+	Overrun bool          `json:"overrun"`
+}
+
+type phaseSpec struct {
+	name    string
+	budget  time.Duration
+	overrun PhaseOverrun
+}
+
+// runningPhase is the phase a request is in, with the contexts it started from so that their deadline can be
+// restored once it ends
+type runningPhase struct {
+	spec      *phaseSpec
+	start     time.Time
+	parent    context.Context // ctx.Context before the phase
+	reqParent context.Context // the request's context before the phase
+	ctx       context.Context // ctx.Context during the phase
+	reqCtx    context.Context // the request's context during the phase
+	cancel    func()
+}
+
+// PhaseBudget marks the start of a phase of the chain, which lasts until the next PhaseBudget or, for the last one,
+// until the handler returns. The phase's contexts (ctx.Context and the request's) get a deadline of d, never later
+// than the one the request already has, and the deadline they had is restored once the phase ends, so that a
+// phase can only take time from the request rather than give it more. A d of 0 only times the phase:
+//
+//	// the first middleware is closest to the handler, so the auth phase starts first
+//	api := vk.Group("/api").WithMiddlewares(
+//		vk.PhaseBudget("handler", 0), // the handler gets the rest of the request's deadline
+//		authMiddleware,
+//		vk.PhaseBudget("auth", 50*time.Millisecond),
+//	)
+//
+// A phase that takes longer than d fails the request with a 504 when the next phase would start, or when it returns
+// the error of its deadline, unless OnPhaseOverrun(PhaseWarn) is given, in which case it is logged and the request
+// carries on. How long each phase took is available from ctx.PhaseTimings
+func PhaseBudget(name string, d time.Duration, opts ...PhaseOption) Middleware {
+	spec := &phaseSpec{name: name, budget: d}
+
+	for _, opt := range opts {
+		opt(spec)
+	}
+
+	return Named("phase:"+name, func(inner HandlerFunc) HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request, ctx *Ctx) error {
+			// the phase before this one ends where this one starts
+			if previous := ctx.phase; previous != nil {
+				var overrun error
+				if r, overrun = ctx.endPhase(r); overrun != nil && previous.spec.overrun == PhaseTimeout {
+					return overrun
+				}
+			}
+
+			r = ctx.startPhase(spec, r)
+			running := ctx.phase
+
+			err := inner(w, r, ctx)
+
+			// a phase that returned before the next one started, such as an auth middleware rejecting the request,
+			// or the last phase, ends when it returns
+			if ctx.phase == running {
+				_, overrun := ctx.endPhase(r)
+
+				if overrun != nil && spec.overrun == PhaseTimeout && errors.Is(err, context.DeadlineExceeded) {
+					return overrun
+				}
+			}
+
+			return err
+		}
+	})
+}
+
+// startPhase starts a phase, returning the request with the phase's deadline
+func (c *Ctx) startPhase(spec *phaseSpec, r *http.Request) *http.Request {
+	p := &runningPhase{
+		spec:      spec,
+		start:     time.Now(),
+		parent:    c.Context,
+		reqParent: r.Context(),
+		ctx:       c.Context,
+		reqCtx:    r.Context(),
+		cancel:    func() {},
+	}
+
+	if spec.budget > 0 {
+		reqCtx, cancelReq := context.WithTimeout(p.reqParent, spec.budget)
+		handlerCtx, cancelHandler := context.WithTimeout(c.baseContext(), spec.budget)
+
+		p.ctx, p.reqCtx = handlerCtx, reqCtx
+		p.cancel = func() {
+			cancelReq()
+			cancelHandler()
+		}
+
+		c.Context = handlerCtx
+		r = r.WithContext(reqCtx)
+	}
+
+	c.phase = p
+
+	return r
+}
+
+// endPhase ends the running phase, recording how long it took and restoring the deadline the request had before it.
+// It returns the request with that deadline, and an error if the phase overran its budget
+func (c *Ctx) endPhase(r *http.Request) (*http.Request, error) {
+	p := c.phase
+	c.phase = nil
+
+	elapsed := time.Since(p.start)
+	overran := p.spec.budget > 0 && elapsed > p.spec.budget
+
+	c.phases = append(c.phases, PhaseTiming{Name: p.spec.name, Budget: p.spec.budget, Elapsed: elapsed, Overrun: overran})
+
+	p.cancel()
+
+	if p.spec.budget > 0 {
+		c.Context = restorePhaseDeadline(p.parent, p.ctx, c.Context)
+		r = r.WithContext(restorePhaseDeadline(p.reqParent, p.reqCtx, r.Context()))
+	}
+
+	if !overran {
+		return r, nil
+	}
+
+	msg := fmt.Sprintf("the %s phase took %dms, over its budget of %dms", p.spec.name, elapsed.Milliseconds(), p.spec.budget.Milliseconds())
+
+	if p.spec.overrun == PhaseWarn {
+		c.Log.Warn(msg)
+		return r, nil
+	}
+
+	c.Log.Debug(msg)
+
+	return r, E(http.StatusGatewayTimeout, fmt.Sprintf("the %s phase exceeded its budget", p.spec.name))
+}
+
+// restorePhaseDeadline returns the context to carry on with once a phase has ended: the one it started from, or if
+// values were added to the phase's context during it, a context with the values of current and the deadline of parent
+func restorePhaseDeadline(parent, phase, current context.Context) context.Context {
+	if current == phase {
+		return parent
+	}
+
+	return phaseValues{Context: parent, values: current}
+}
+
+// phaseValues has the deadline and cancellation of its Context and the values of another
+type phaseValues struct {
+	context.Context
+	values context.Context
+}
+
+func (p phaseValues) Value(key interface{}) interface{} {
+	return p.values.Value(key)
+}
+
+// PhaseTimings returns how long each phase of the request's chain took (see PhaseBudget), in the order they ended.
+// A phase is only listed once it has ended, so middleware outside all of the phases sees every one of them once
+// the rest of the chain has returned
+func (c *Ctx) PhaseTimings() []PhaseTiming {
+	if c == nil {
+		return nil
+	}
+
+	return c.phases
+}
@@ -0,0 +1,83 @@
+package vk
+
+import (
+	"net/http"
+	"strings"
+)
+
+// PreconditionMiddleware enables optimistic locking for a route's updates, which is checked by handlers using
+// Ctx.CheckPrecondition once they have loaded the resource. If required is true, PUT, PATCH and DELETE requests
+// without an If-Match header are rejected with 428 before the handler runs
+func PreconditionMiddleware(required bool) Middleware {
+	return Named("precondition", func(inner HandlerFunc) HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request, ctx *Ctx) error {
+			if required && isUpdateMethod(r.Method) && r.Header.Get("If-Match") == "" {
+				return E(http.StatusPreconditionRequired, "this request must be conditional, set the If-Match header")
+			}
+
+			return inner(w, r, ctx)
+		}
+	})
+}
+
+// CheckPrecondition compares the request's If-Match header with the current ETag of the resource being updated
+// (which is empty if the resource doesn't exist), returning a 412 error if it doesn't match. Matching uses strong
+// comparison, so weak ETags never match, and "*" matches any existing resource. The current ETag is set on the
+// response with the 412 so that the client can refetch and retry. Requests without an If-Match header pass
+func (c *Ctx) CheckPrecondition(currentETag string) error {
+	if c == nil || c.request == nil {
+		return nil
+	}
+
+	ifMatch := c.request.Header.Values("If-Match")
+	if len(ifMatch) == 0 {
+		return nil
+	}
+
+	if ifMatchSatisfied(ifMatch, currentETag) {
+		return nil
+	}
+
+	if currentETag != "" && c.RespHeaders != nil {
+		c.RespHeaders.Set("ETag", currentETag)
+	}
+
+	return E(http.StatusPreconditionFailed, "the resource has been modified, If-Match does not match its current ETag")
+}
+
+// ifMatchSatisfied evaluates If-Match header values against the current ETag (RFC 7232, section 3.1)
+func ifMatchSatisfied(values []string, current string) bool {
+	if current == "" {
+		return false
+	}
+
+	for _, v := range values {
+		for _, tag := range strings.Split(v, ",") {
+			tag = strings.TrimSpace(tag)
+
+			if tag == "*" {
+				return true
+			}
+
+			if strongETagMatch(tag, current) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// strongETagMatch returns true if neither ETag is weak and their opaque tags are equal. Unquoted ETags are
+// tolerated, since handlers commonly pass the bare version of a resource
+func strongETagMatch(a, b string) bool {
+	if strings.HasPrefix(a, "W/") || strings.HasPrefix(b, "W/") {
+		return false
+	}
+
+	return strings.Trim(a, `"`) == strings.Trim(b, `"`)
+}
+
+func isUpdateMethod(method string) bool {
+	return method == http.MethodPut || method == http.MethodPatch || method == http.MethodDelete
+}
@@ -0,0 +1,157 @@
+package vk
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// corsDefaultHeaders are the request headers allowed by CORSHandler and EnableCORS
+const corsDefaultHeaders = "Accept, Content-Type, Content-Length, Accept-Encoding, Authorization, cache-control"
+
+// CORSOption configures the CORS responses of a Router, see Router.EnableCORS
+type CORSOption func(*routerCORS)
+
+// CORSMaxAge sets how long browsers can cache preflight responses
+func CORSMaxAge(maxAge time.Duration) CORSOption {
+	return func(c *routerCORS) {
+		c.maxAge = maxAge
+	}
+}
+
+// CORSAllowCredentials allows cross-origin requests to include credentials, such as cookies. With a domain of "*",
+// the request's origin is echoed instead, since a wildcard can't be used with credentials
+func CORSAllowCredentials() CORSOption {
+	return func(c *routerCORS) {
+		c.credentials = true
+	}
+}
+
+// CORSAllowHeaders allows headers in cross-origin requests in addition to the default ones
+func CORSAllowHeaders(headers ...string) CORSOption {
+	return func(c *routerCORS) {
+		c.headers = append(c.headers, headers...)
+	}
+}
+
+// routerCORS is the CORS configuration of a Router
+type routerCORS struct {
+	origins     []string
+	methods     []string // the routed methods allowed in preflight responses, all of them if empty
+	maxAge      time.Duration
+	credentials bool
+	headers     []string
+}
+
+// EnableCORS makes the router answer CORS preflight requests itself: an OPTIONS request to a path that has routes
+// for other methods, but no OPTIONS route of its own, gets a 204 allowing the methods of those routes. Routed
+// responses to cross-origin requests are given the same Access-Control-Allow-Origin. Pass "*" to allow any origin,
+// or an empty domain to turn it off, which is the default. OPTIONS routes that are registered explicitly still handle
+// their requests, and should set CORS headers themselves, such as with CORSMiddleware. A Server's router is
+// configured with UseCORS instead
+func (rt *Router) EnableCORS(domain string, opts ...CORSOption) {
+	if domain == "" {
+		rt.cors = nil
+		return
+	}
+
+	c := &routerCORS{origins: []string{domain}, headers: []string{corsDefaultHeaders}}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	rt.cors = c
+}
+
+// useCORS makes the router answer preflight requests as configured by opts if its Preflight is set, see EnableCORS
+func (rt *Router) useCORS(opts CORSOptions) {
+	if !opts.Preflight || len(opts.AllowedOrigins) == 0 {
+		rt.cors = nil
+		return
+	}
+
+	headers := opts.AllowedHeaders
+	if len(headers) == 0 {
+		headers = []string{corsDefaultHeaders}
+	}
+
+	rt.cors = &routerCORS{
+		origins:     opts.AllowedOrigins,
+		methods:     opts.AllowedMethods,
+		maxAge:      opts.MaxAge,
+		credentials: opts.AllowCredentials,
+		headers:     headers,
+	}
+}
+
+// servePreflight answers an OPTIONS request that no route handles, if CORS is enabled and other methods are
+// routed for its path. It returns false if the request wasn't handled
+func (rt *Router) servePreflight(w http.ResponseWriter, r *http.Request) bool {
+	if rt.cors == nil || r.Method != http.MethodOptions {
+		return false
+	}
+
+	allow := rt.allowed(r.URL.Path, r.Method)
+	if allow == "" {
+		return false
+	}
+
+	header := w.Header()
+	header.Set("Allow", allow)
+	header.Set("Access-Control-Allow-Methods", rt.cors.allowedMethods(allow))
+	header.Set("Access-Control-Allow-Headers", strings.Join(rt.cors.headers, ", "))
+
+	if rt.cors.maxAge > 0 {
+		header.Set("Access-Control-Max-Age", strconv.Itoa(int(rt.cors.maxAge.Seconds())))
+	}
+
+	rt.cors.allowOrigin(header, r)
+
+	w.WriteHeader(http.StatusNoContent)
+
+	return true
+}
+
+// allowOrigin sets the headers allowing the origin of a cross-origin request, if it is one of the allowed origins
+func (c *routerCORS) allowOrigin(header http.Header, r *http.Request) {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return
+	}
+
+	header.Add("Vary", "Origin")
+
+	anyOrigin := containsFold(c.origins, "*")
+
+	switch {
+	case anyOrigin && !c.credentials:
+		header.Set("Access-Control-Allow-Origin", "*")
+	case anyOrigin || containsFold(c.origins, origin):
+		// a wildcard can't be used with credentials, so the origin is echoed instead
+		header.Set("Access-Control-Allow-Origin", origin)
+	default:
+		return
+	}
+
+	if c.credentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// allowedMethods returns the methods of allow that preflight responses allow
+func (c *routerCORS) allowedMethods(allow string) string {
+	if len(c.methods) == 0 {
+		return allow
+	}
+
+	var methods []string
+
+	for _, m := range strings.Split(allow, ", ") {
+		if m == http.MethodOptions || containsFold(c.methods, m) {
+			methods = append(methods, m)
+		}
+	}
+
+	return strings.Join(methods, ", ")
+}
@@ -0,0 +1,68 @@
+package vk
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+)
+
+// contextPropagation derives a value for the request's context from the Ctx
+type contextPropagation struct {
+	key  interface{}
+	from func(*Ctx) interface{}
+}
+
+// PropagateToContext makes the value returned by from available from the request's context under key, for code
+// that is only given a context.Context (such as an instrumented database layer). from is called each time the key
+// is looked up, so the value reflects what middleware has set on the Ctx by then. A later registration for the same
+// key replaces an earlier one, and the request ID is propagated under RequestIDKey by default
+func (rt *Router) PropagateToContext(key interface{}, from func(*Ctx) interface{}) {
+	if key == nil {
+		panic("nil key")
+	}
+
+	if !reflect.TypeOf(key).Comparable() {
+		panic("key is not comparable")
+	}
+
+	rt.propagations = append(rt.propagations, contextPropagation{key: key, from: from})
+}
+
+// propagateToContext returns r with the router's propagated values added to its context
+func (rt *Router) propagateToContext(r *http.Request, ctx *Ctx) *http.Request {
+	if len(rt.propagations) == 0 {
+		return r
+	}
+
+	return r.WithContext(propagatingContext{Context: r.Context(), ctx: ctx, propagations: rt.propagations})
+}
+
+// propagatingContext looks up propagated keys on the Ctx, and everything else in the request's context
+type propagatingContext struct {
+	context.Context
+	ctx          *Ctx
+	propagations []contextPropagation
+}
+
+func (p propagatingContext) Value(key interface{}) interface{} {
+	for i := len(p.propagations) - 1; i >= 0; i-- {
+		if p.propagations[i].key == key {
+			return p.propagations[i].from(p.ctx)
+		}
+	}
+
+	return p.Context.Value(key)
+}
+
+func propagateRequestID(ctx *Ctx) interface{} {
+	return ctx.RequestID()
+}
+
+// PropagateToContext propagates a value from the Ctx to the request's context, see Router.PropagateToContext
+func (s *Server) PropagateToContext(key interface{}, from func(*Ctx) interface{}) {
+	if s.started.Load().(bool) {
+		return
+	}
+
+	s.internalRouter.PropagateToContext(key, from)
+}
@@ -0,0 +1,134 @@
+package vk
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// dependencies holds the values provided to a server, by type
+type dependencies struct {
+	lock   sync.RWMutex
+	values map[reflect.Type]interface{}
+}
+
+// dependencyOverridesKey is the request context key of the dependencies overridden with OverrideDependency
+type dependencyOverridesKey struct{}
+
+func newDependencies() *dependencies {
+	d := &dependencies{
+		values: map[reflect.Type]interface{}{},
+	}
+
+	return d
+}
+
+// Provide makes value available to the server's handlers and middleware with Resolve, by its type T. T can be an
+// interface type, i.e. vk.Provide[Store](server, pgStore), so that handlers don't depend on the implementation.
+// Providing another value of the same type replaces the first
+func Provide[T any](s *Server, value T) {
+	s.dependencies.set(typeOf[T](), value)
+}
+
+// Resolve returns the value of type T provided to the server with Provide, or overridden for the request with
+// OverrideDependency. If there is none, Resolve panics in dev mode (see UseDevMode) so that the mistake can't be
+// missed, and otherwise returns an error naming the missing type, which handlers should return (the client gets a 500)
+func Resolve[T any](ctx *Ctx) (T, error) {
+	t := typeOf[T]()
+
+	if ctx != nil {
+		if ctx.request != nil {
+			if overrides, ok := ctx.request.Context().Value(dependencyOverridesKey{}).(map[reflect.Type]interface{}); ok {
+				if value, ok := overrides[t]; ok {
+					return value.(T), nil
+				}
+			}
+		}
+
+		if value, ok := ctx.dependencies.get(t); ok {
+			return value.(T), nil
+		}
+	}
+
+	err := errors.Errorf("no dependency of type %s has been provided, see vk.Provide", t)
+
+	if ctx != nil && ctx.devMode {
+		panic(err.Error())
+	}
+
+	var zero T
+
+	return zero, err
+}
+
+// dependencyRequirement is the value of the chain link added by Requires
+type dependencyRequirement struct {
+	t reflect.Type
+}
+
+// Requires is a Middleware declaring that a route's handler or middleware resolves a value of type T, so that
+// Server.DryRun reports the routes whose dependencies haven't been provided rather than their first requests
+func Requires[T any]() Middleware {
+	requirement := dependencyRequirement{t: typeOf[T]()}
+
+	return func(inner HandlerFunc) HandlerFunc {
+		l := &chainLink{name: "requires " + requirement.t.String(), next: inner, handler: inner, value: requirement}
+
+		return l.serve
+	}
+}
+
+// OverrideDependency returns a copy of r whose handlers resolve value for the type T instead of the value provided to
+// the server, such as to substitute a fake in a test (see also vtest.Override)
+func OverrideDependency[T any](r *http.Request, value T) *http.Request {
+	overrides := map[reflect.Type]interface{}{}
+
+	if existing, ok := r.Context().Value(dependencyOverridesKey{}).(map[reflect.Type]interface{}); ok {
+		for t, v := range existing {
+			overrides[t] = v
+		}
+	}
+
+	overrides[typeOf[T]()] = value
+
+	return r.WithContext(context.WithValue(r.Context(), dependencyOverridesKey{}, overrides))
+}
+
+func (d *dependencies) set(t reflect.Type, value interface{}) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.values[t] = value
+}
+
+func (d *dependencies) get(t reflect.Type) (interface{}, bool) {
+	if d == nil {
+		return nil, false
+	}
+
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	value, ok := d.values[t]
+
+	return value, ok
+}
+
+// useDependencies sets the container that the router's Ctxs resolve dependencies from
+func (rt *Router) useDependencies(deps *dependencies) {
+	rt.dependencies = deps
+}
+
+// useDevMode sets whether the router's Ctxs are in dev mode, see UseDevMode
+func (rt *Router) useDevMode(dev bool) {
+	rt.devMode = dev
+	rt.useDevCaptures(dev)
+}
+
+// typeOf returns the type T, which unlike reflect.TypeOf of a value works for interface types
+func typeOf[T any]() reflect.Type {
+	return reflect.TypeOf((*T)(nil)).Elem()
+}
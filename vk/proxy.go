@@ -0,0 +1,334 @@
+package vk
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/suborbital/vektor/vlog"
+)
+
+const viaPseudonym = "vk"
+
+// hopHeaders are the hop-by-hop headers defined by RFC 7230 section 6.1, which
+// are meaningful only for a single connection and must not be forwarded
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// errProxyBodyTooLarge is returned to the upstream transport when a request body exceeds ProxyOptions.MaxRequestBytes
+var errProxyBodyTooLarge = errors.New("request body too large")
+
+// ProxyOptions configures how a proxy streams requests to its upstream and responses back to the client
+type ProxyOptions struct {
+	// FlushInterval is how often a response body is flushed to the client while it is copied from the upstream.
+	// 0 flushes after every write, so that server-sent events and other streamed responses arrive promptly
+	FlushInterval time.Duration
+
+	// MaxRequestBytes is the largest request body passed to the upstream, larger ones are answered with a 413.
+	// Unlimited if 0
+	MaxRequestBytes int64
+
+	// BufferRequests reads each request body completely before contacting the upstream, for upstreams that require
+	// a Content-Length. By default, request bodies are streamed to the upstream as they arrive
+	BufferRequests bool
+
+	// Resolver spreads requests across the endpoints that the target's name resolves to, following changes to them
+	// and ejecting those that fail. By default, each connection resolves the name on its own
+	Resolver *EndpointResolver
+}
+
+// NewProxy creates a handler that proxies requests to target, such as to mount with Mount.
+// It handles hop-by-hop and forwarding headers the same way as the fallback proxy (see UseFallbackAddress)
+func NewProxy(logger *vlog.Logger, target string, opts ProxyOptions) (http.Handler, error) {
+	if logger == nil {
+		logger = vlog.Noop()
+	}
+
+	targetURL, err := url.Parse(target)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to url.Parse")
+	}
+
+	p := newProxy(logger, targetURL)
+	p.useOptions(opts)
+
+	return p, nil
+}
+
+// proxy is a reverse proxy to a single upstream that applies ProxyOptions to the requests it forwards
+type proxy struct {
+	reverse *httputil.ReverseProxy
+	opts    ProxyOptions
+	log     *vlog.Logger
+
+	correlationHeaders CorrelationHeaders // see UseCorrelationHeaders
+	claimHeaders       []string           // removed from the requests of the fallback proxy, see ClaimsPropagation
+}
+
+// newProxy creates a reverse proxy to target that strips hop-by-hop headers,
+// sets the Via and X-Forwarded-* headers, and logs the upstream status without treating
+// 3xx and 4xx responses (such as 304 Not Modified) as errors. Conditional and range
+// responses (304, 206) are passed through to the client untouched.
+func newProxy(log *vlog.Logger, target *url.URL) *proxy {
+	reverse := httputil.NewSingleHostReverseProxy(target)
+	reverse.FlushInterval = -1
+
+	p := &proxy{reverse: reverse, log: log}
+
+	director := reverse.Director
+	reverse.Director = func(r *http.Request) {
+		// capture what the client sent before the director rewrites the URL
+		host := r.Host
+		proto := "http"
+		if r.TLS != nil {
+			proto = "https"
+		}
+
+		// protocol upgrades (i.e. websockets) are hop-by-hop by nature, but
+		// the proxy needs them intact in order to tunnel the connection
+		upgrade := ""
+		if headerHasToken(r.Header, "Connection", "upgrade") {
+			upgrade = r.Header.Get("Upgrade")
+		}
+
+		director(r)
+
+		// connections are pooled by the URL's host, so one per endpoint
+		if address, ok := r.Context().Value(proxyEndpointKey{}).(string); ok {
+			r.URL.Host = address
+		}
+
+		removeHopHeaders(r.Header)
+
+		if upgrade != "" {
+			r.Header.Set("Connection", "Upgrade")
+			r.Header.Set("Upgrade", upgrade)
+		}
+
+		r.Header.Add("Via", viaValue(r.ProtoMajor, r.ProtoMinor))
+		r.Header.Set("X-Forwarded-Host", host)
+		r.Header.Set("X-Forwarded-Proto", proto)
+
+		// the claim headers of the fallback proxy's requests, which pass through no middleware, are the client's
+		for _, name := range p.claimHeaders {
+			r.Header.Del(name)
+		}
+
+		// routes proxied behind ClaimsPropagation forward the claims it selected
+		CtxFromContext(r.Context()).applyOutboundHeaders(r.Header)
+
+		p.applyCorrelation(r)
+	}
+
+	reverse.ModifyResponse = func(resp *http.Response) error {
+		resp.Header.Add("Via", viaValue(resp.ProtoMajor, resp.ProtoMinor))
+
+		logFn := proxyLogFn(log, resp.StatusCode)
+		logFn("proxied", resp.Request.Method, resp.Request.URL.String(), fmt.Sprintf("upstream responded (%d: %s)", resp.StatusCode, http.StatusText(resp.StatusCode)))
+
+		return nil
+	}
+
+	reverse.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		// the upstream transport wraps (or replaces) the body's error, so check the body itself
+		if body, ok := r.Context().Value(proxyBodyKey{}).(*limitedBody); ok && body.tooLarge() {
+			log.Warn("proxied", r.Method, r.URL.String(), "request body exceeded the limit")
+
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		log.ErrorString("proxied", r.Method, r.URL.String(), "upstream failed:", err.Error())
+
+		w.WriteHeader(http.StatusBadGateway)
+	}
+
+	return p
+}
+
+// useOptions sets the proxy's options
+func (p *proxy) useOptions(opts ProxyOptions) {
+	p.opts = opts
+
+	p.reverse.FlushInterval = opts.FlushInterval
+	if p.reverse.FlushInterval == 0 {
+		p.reverse.FlushInterval = -1
+	}
+
+	p.reverse.Transport = nil
+	if opts.Resolver != nil {
+		p.reverse.Transport = opts.Resolver.transport()
+	}
+}
+
+// ServeHTTP forwards the request to the upstream. Nothing in vk reads the body beforehand, so unless
+// BufferRequests is set, it is streamed to the upstream as the client sends it
+func (p *proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	limit := p.opts.MaxRequestBytes
+
+	if limit > 0 && r.Body != nil && r.Body != http.NoBody {
+		if r.ContentLength > limit {
+			p.log.Warn("proxied", r.Method, r.URL.String(), "request body exceeded the limit")
+
+			w.Header().Set("Connection", "close")
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		body := &limitedBody{ReadCloser: r.Body, remaining: limit}
+
+		r = r.WithContext(context.WithValue(r.Context(), proxyBodyKey{}, body))
+		r.Body = body
+	}
+
+	if p.opts.BufferRequests && r.Body != nil && r.Body != http.NoBody {
+		buf := &bytes.Buffer{}
+		if _, err := io.Copy(buf, r.Body); err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, errProxyBodyTooLarge) {
+				status = http.StatusRequestEntityTooLarge
+				w.Header().Set("Connection", "close")
+			}
+
+			p.log.Warn("proxied", r.Method, r.URL.String(), "failed to read request body:", err.Error())
+
+			w.WriteHeader(status)
+			return
+		}
+
+		r.Body.Close()
+
+		body := buf.Bytes()
+
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+		r.TransferEncoding = nil
+		r.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(body)), nil
+		}
+	}
+
+	if p.opts.Resolver != nil {
+		address, err := p.opts.Resolver.pick(r.Context())
+		if err != nil {
+			p.log.ErrorString("proxied", r.Method, r.URL.String(), "failed to resolve upstream:", err.Error())
+
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		r = r.WithContext(context.WithValue(r.Context(), proxyEndpointKey{}, address))
+	}
+
+	p.reverse.ServeHTTP(w, r)
+}
+
+// useFallbackProxy sets the options of the router's fallback proxy, if it has one
+func (rt *Router) useFallbackProxy(opts ProxyOptions) {
+	if rt.fallbackProxy != nil {
+		rt.fallbackProxy.useOptions(opts)
+	}
+}
+
+type proxyBodyKey struct{}
+
+type proxyEndpointKey struct{}
+
+// limitedBody is a request body that fails once more than remaining bytes are read from it
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	exceeded  int32 // read by the handler after the upstream transport reads the body on its own goroutine
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.tooLarge() {
+		return 0, errProxyBodyTooLarge
+	}
+
+	// read one byte more than allowed to detect a body that is too large
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining+1]
+	}
+
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) > b.remaining {
+		n = int(b.remaining)
+		b.remaining = 0
+		atomic.StoreInt32(&b.exceeded, 1)
+
+		return n, errProxyBodyTooLarge
+	}
+
+	b.remaining -= int64(n)
+
+	return n, err
+}
+
+func (b *limitedBody) tooLarge() bool {
+	return atomic.LoadInt32(&b.exceeded) == 1
+}
+
+// removeHopHeaders removes the hop-by-hop headers from h, including
+// any additional headers named by the Connection header
+func removeHopHeaders(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// headerHasToken returns true if the comma-separated header key contains token (case insensitive)
+func headerHasToken(h http.Header, key, token string) bool {
+	for _, v := range h.Values(key) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// proxyLogFn classifies an upstream status code, only server errors are logged as errors
+func proxyLogFn(log *vlog.Logger, status int) func(...interface{}) {
+	if status >= http.StatusInternalServerError {
+		return log.ErrorString
+	}
+
+	return log.Info
+}
+
+func viaValue(major, minor int) string {
+	if major == 0 && minor == 0 {
+		major, minor = 1, 1
+	}
+
+	return fmt.Sprintf("%d.%d %s", major, minor, viaPseudonym)
+}
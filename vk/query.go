@@ -0,0 +1,93 @@
+package vk
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// AllowedQuery returns a Middleware that rejects requests containing query parameters other than those listed,
+// responding with 400 and the names of the unexpected parameters. Array-style names are normalized, so allowing
+// "ids" also allows "ids[]" and vice versa
+func AllowedQuery(params ...string) Middleware {
+	return Named("allowedquery", allowedQuery(params, true))
+}
+
+// AllowedQueryWarn is like AllowedQuery, but only logs a warning for unexpected parameters rather than rejecting the request
+func AllowedQueryWarn(params ...string) Middleware {
+	return Named("allowedquery", allowedQuery(params, false))
+}
+
+func allowedQuery(params []string, strict bool) Middleware {
+	allowed := make(map[string]bool, len(params))
+	for _, p := range params {
+		allowed[normalizeQueryName(p)] = true
+	}
+
+	return func(inner HandlerFunc) HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request, ctx *Ctx) error {
+			unexpected := unexpectedQuery(r.URL.RawQuery, allowed)
+			if len(unexpected) == 0 {
+				return inner(w, r, ctx)
+			}
+
+			list := strings.Join(unexpected, ", ")
+
+			if strict {
+				return E(http.StatusBadRequest, fmt.Sprintf("unexpected query parameters: %s", list))
+			}
+
+			ctx.Log.Warn(r.Method, r.URL.Path, "has unexpected query parameters:", list)
+
+			return inner(w, r, ctx)
+		}
+	}
+}
+
+// unexpectedQuery returns the sorted, de-duplicated names in rawQuery that are not allowed. It walks the
+// raw query rather than parsing it into url.Values so that the cost depends only on the query's size
+func unexpectedQuery(rawQuery string, allowed map[string]bool) []string {
+	var unexpected []string
+
+	for rawQuery != "" {
+		var pair string
+		pair, rawQuery, _ = strings.Cut(rawQuery, "&")
+
+		name, _, _ := strings.Cut(pair, "=")
+		if name == "" {
+			continue
+		}
+
+		if decoded, err := url.QueryUnescape(name); err == nil {
+			name = decoded
+		}
+
+		name = normalizeQueryName(name)
+		if !allowed[name] {
+			unexpected = append(unexpected, name)
+		}
+	}
+
+	if len(unexpected) < 2 {
+		return unexpected
+	}
+
+	sort.Strings(unexpected)
+
+	// remove the duplicates of repeated parameters, which are now adjacent
+	deduped := unexpected[:1]
+	for _, name := range unexpected[1:] {
+		if name != deduped[len(deduped)-1] {
+			deduped = append(deduped, name)
+		}
+	}
+
+	return deduped
+}
+
+// normalizeQueryName strips the array suffix from names such as ids[]
+func normalizeQueryName(name string) string {
+	return strings.TrimSuffix(name, "[]")
+}
@@ -0,0 +1,333 @@
+package vk
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultQuotaTTL = time.Minute
+	quotaAdminTopN  = 10
+)
+
+// Quota describes the limits applied to a single key (such as a tenant ID)
+type Quota struct {
+	Key           string  // the identity the quota applies to, requests with an empty key are not limited
+	Rate          float64 // requests per second, zero for no rate limit
+	Burst         int     // requests allowed in a burst above Rate, defaults to 1
+	MaxConcurrent int     // maximum in-flight requests, zero for no concurrency limit
+}
+
+// QuotaStat reports the number of rejected requests for a key
+type QuotaStat struct {
+	Key        string `json:"key"`
+	Rejections uint64 `json:"rejections"`
+}
+
+// Quotas enforces per-key request rate and concurrency limits
+type Quotas struct {
+	quotaFor func(ctx *Ctx) Quota
+
+	// with NewKeyedQuotas, the key of each request and the cached quota of each key
+	keyFor      func(ctx *Ctx) string
+	quotaForKey func(key string) Quota
+
+	ttl time.Duration
+
+	entries    map[string]*quotaEntry
+	lastSweep  time.Time
+	generation uint64 // incremented by Invalidate
+	lock       sync.Mutex
+}
+
+type quotaEntry struct {
+	quota      Quota
+	bucket     *tokenBucket
+	sem        chan struct{}
+	resolved   time.Time
+	generation uint64 // of the Quotas when the quota was resolved
+	lastSeen   time.Time
+	inFlight   int64
+	rejections uint64
+}
+
+// QuotaMiddleware returns a Middleware that enforces the Quota returned by quotaFor for each request,
+// see NewQuotas for details. It must be placed after any middleware that populates the Ctx with the
+// identity used by quotaFor (i.e. closer to the handler)
+func QuotaMiddleware(quotaFor func(ctx *Ctx) Quota) Middleware {
+	return NewQuotas(quotaFor, defaultQuotaTTL).Middleware()
+}
+
+// NewQuotas creates a Quotas that uses quotaFor to resolve the quota for each request, which should be
+// cheap as it is called on every request (see NewKeyedQuotas to cache the quota of each key). The limits for a
+// key are cached for ttl, or until Invalidate, after which changes to the key's quota take effect. Keys that have
+// been idle for longer than ttl are forgotten (along with their stats). Requests that exceed their quota are rejected with 429 Too Many Requests
+func NewQuotas(quotaFor func(ctx *Ctx) Quota, ttl time.Duration) *Quotas {
+	if ttl <= 0 {
+		ttl = defaultQuotaTTL
+	}
+
+	q := &Quotas{
+		quotaFor:  quotaFor,
+		ttl:       ttl,
+		entries:   map[string]*quotaEntry{},
+		lastSweep: time.Now(),
+	}
+
+	return q
+}
+
+// NewKeyedQuotas creates a Quotas that identifies each request by the key returned by keyFor (requests with an empty
+// key are not limited), and resolves the quota of each key with quotaFor, such as from a tenant's plan. Unlike
+// NewQuotas, quotaFor is only called when a key is first seen, once ttl has passed since its quota was resolved,
+// or after Invalidate, so it can be as slow as a database query
+func NewKeyedQuotas(keyFor func(ctx *Ctx) string, quotaFor func(key string) Quota, ttl time.Duration) *Quotas {
+	q := NewQuotas(nil, ttl)
+	q.keyFor = keyFor
+	q.quotaForKey = quotaFor
+
+	return q
+}
+
+// Invalidate makes the quota of every key be resolved again on its next request, for when the configuration they
+// are resolved from has changed. A key's limits are only reset if its quota changed
+func (q *Quotas) Invalidate() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.generation++
+}
+
+// Middleware returns a Middleware that enforces the quotas
+func (q *Quotas) Middleware() Middleware {
+	return Named("quota", func(inner HandlerFunc) HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request, ctx *Ctx) error {
+			entry, bucket, sem := q.resolve(ctx)
+			if entry == nil {
+				return inner(w, r, ctx)
+			}
+
+			if ok, retryAfter := bucket.take(); !ok {
+				atomic.AddUint64(&entry.rejections, 1)
+				return TooManyRequests(ctx, retryAfter)
+			}
+
+			if sem != nil {
+				select {
+				case sem <- struct{}{}:
+					defer func() { <-sem }()
+				default:
+					atomic.AddUint64(&entry.rejections, 1)
+					return TooManyRequests(ctx, time.Second)
+				}
+			}
+
+			atomic.AddInt64(&entry.inFlight, 1)
+			defer atomic.AddInt64(&entry.inFlight, -1)
+
+			return inner(w, r, ctx)
+		}
+	})
+}
+
+// TopRejections returns up to n keys with the most rejected requests, in descending order
+func (q *Quotas) TopRejections(n int) []QuotaStat {
+	q.lock.Lock()
+
+	stats := make([]QuotaStat, 0, len(q.entries))
+	for key, e := range q.entries {
+		if r := atomic.LoadUint64(&e.rejections); r > 0 {
+			stats = append(stats, QuotaStat{Key: key, Rejections: r})
+		}
+	}
+
+	q.lock.Unlock()
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Rejections == stats[j].Rejections {
+			return stats[i].Key < stats[j].Key
+		}
+
+		return stats[i].Rejections > stats[j].Rejections
+	})
+
+	if n >= 0 && len(stats) > n {
+		stats = stats[:n]
+	}
+
+	return stats
+}
+
+// RegisterAdmin mounts GET /quotas on the admin router, reporting the keys with the most rejections
+func (q *Quotas) RegisterAdmin(r *Router) {
+	r.GET("/quotas", func(w http.ResponseWriter, _ *http.Request, ctx *Ctx) error {
+		return RespondJSON(ctx.Context, w, q.TopRejections(quotaAdminTopN), http.StatusOK)
+	})
+}
+
+// resolve returns the limits for the request's key, or a nil entry if the request isn't limited
+func (q *Quotas) resolve(ctx *Ctx) (*quotaEntry, *tokenBucket, chan struct{}) {
+	if q.keyFor == nil {
+		quota := q.quotaFor(ctx)
+		if quota.Key == "" {
+			return nil, nil, nil
+		}
+
+		return q.entry(quota)
+	}
+
+	key := q.keyFor(ctx)
+	if key == "" {
+		return nil, nil, nil
+	}
+
+	if e, bucket, sem := q.cached(key); e != nil {
+		return e, bucket, sem
+	}
+
+	// resolved without the lock, as it may be slow
+	quota := q.quotaForKey(key)
+	quota.Key = key
+
+	return q.entry(quota)
+}
+
+// cached returns the limits for key if its quota was resolved within the TTL and since the last Invalidate
+func (q *Quotas) cached(key string) (*quotaEntry, *tokenBucket, chan struct{}) {
+	now := time.Now()
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	e, ok := q.entries[key]
+	if !ok || q.stale(e, now) {
+		return nil, nil, nil
+	}
+
+	e.lastSeen = now
+
+	return e, e.bucket, e.sem
+}
+
+// stale returns true if the entry's quota must be resolved again, it must be called with the lock held
+func (q *Quotas) stale(e *quotaEntry, now time.Time) bool {
+	return now.Sub(e.resolved) > q.ttl || e.generation != q.generation
+}
+
+// entry returns the cached limits for the quota's key, creating or refreshing them as needed
+func (q *Quotas) entry(quota Quota) (*quotaEntry, *tokenBucket, chan struct{}) {
+	now := time.Now()
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if now.Sub(q.lastSweep) > q.ttl {
+		q.sweep(now)
+	}
+
+	e, ok := q.entries[quota.Key]
+	if !ok {
+		e = &quotaEntry{}
+		q.entries[quota.Key] = e
+	}
+
+	stale := !ok || q.stale(e, now)
+
+	if !ok || (stale && e.quota != quota) {
+		e.quota = quota
+		e.bucket = newTokenBucket(quota.Rate, quota.Burst)
+		e.sem = nil
+
+		// requests in flight release the semaphore they acquired, so replacing it is safe
+		if quota.MaxConcurrent > 0 {
+			e.sem = make(chan struct{}, quota.MaxConcurrent)
+		}
+	}
+
+	if stale {
+		e.resolved = now
+		e.generation = q.generation
+	}
+
+	e.lastSeen = now
+
+	return e, e.bucket, e.sem
+}
+
+// sweep removes entries that have been idle for longer than the TTL, it must be called with the lock held
+func (q *Quotas) sweep(now time.Time) {
+	for key, e := range q.entries {
+		if now.Sub(e.lastSeen) > q.ttl && atomic.LoadInt64(&e.inFlight) == 0 {
+			delete(q.entries, key)
+		}
+	}
+
+	q.lastSweep = now
+}
+
+// TooManyRequests sets the Retry-After header and returns a 429 error, which is the
+// convention for responding to requests that have been throttled
+func TooManyRequests(ctx *Ctx, retryAfter time.Duration) error {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	if ctx != nil && ctx.RespHeaders != nil {
+		ctx.RespHeaders.Set("Retry-After", fmt.Sprintf("%d", seconds))
+	}
+
+	return E(http.StatusTooManyRequests, http.StatusText(http.StatusTooManyRequests))
+}
+
+// tokenBucket is a simple token bucket rate limiter
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	lock   sync.Mutex
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+
+	t := &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+
+	return t
+}
+
+// take attempts to take a token from the bucket, returning the time until one is available if it fails
+func (t *tokenBucket) take() (bool, time.Duration) {
+	if t.rate <= 0 {
+		return true, 0
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := time.Now()
+
+	t.tokens = math.Min(t.burst, t.tokens+now.Sub(t.last).Seconds()*t.rate)
+	t.last = now
+
+	if t.tokens < 1 {
+		return false, time.Duration((1 - t.tokens) / t.rate * float64(time.Second))
+	}
+
+	t.tokens--
+
+	return true, 0
+}
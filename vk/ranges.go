@@ -0,0 +1,335 @@
+package vk
+
+import (
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RangedContent is content that RespondRanged serves in byte ranges, so that clients can resume interrupted downloads
+type RangedContent struct {
+	// Content is the content to serve. If it is nil, Open is called instead with the offset to read from each time
+	// that a range is read, and the reader it returns is closed once the range has been read
+	Content io.ReadSeeker
+	Open    func(offset int64) (io.ReadCloser, error)
+	Size    int64 // the size of the content, required with Open
+
+	ETag        string    // a strong ETag for the content's identity, which clients resume with in If-Range
+	ModTime     time.Time // sent as Last-Modified if it isn't zero
+	Name        string    // the Content-Type is detected from its extension, or from the content, if ContentType is empty
+	ContentType string
+
+	// SingleRange rejects requests for more than one range with a 416, rather than serving them as multipart/byteranges
+	SingleRange bool
+}
+
+// RespondRanged serves content with a 200, or the ranges of it requested with the Range header with a 206, so that
+// a client can resume a download that was interrupted. Resuming is only allowed from the same content: a request
+// whose If-Range doesn't match the content's ETag (or ModTime, for a date) fails with a 412, so that the client
+// starts over. Malformed and unsatisfiable ranges fail with a 416, as do multiple ranges if content.SingleRange is
+// set. Conditional requests (If-None-Match, If-Modified-Since, etc.) are handled as with http.ServeContent.
+//
+// Resumed downloads are logged with the offset they resume from and the client's IP address, as are those refused
+// because the content has changed
+func RespondRanged(ctx *Ctx, w http.ResponseWriter, content RangedContent) error {
+	seeker := content.Content
+
+	if seeker == nil {
+		if content.Open == nil {
+			return errors.New("RangedContent has neither Content nor Open")
+		}
+
+		opened := &openSeeker{open: content.Open, size: content.Size}
+		defer opened.close()
+
+		seeker = opened
+	}
+
+	etag := content.ETag
+	if etag != "" && !strings.HasPrefix(etag, `"`) && !strings.HasPrefix(etag, "W/") {
+		etag = `"` + etag + `"`
+	}
+
+	if etag != "" {
+		ctx.RespHeaders.Set("ETag", etag)
+	}
+
+	if content.ContentType != "" {
+		ctx.RespHeaders.Set(contentTypeHeaderKey, content.ContentType)
+	}
+
+	r := ctx.request
+	if r == nil {
+		return errors.New("RespondRanged called without a request")
+	}
+
+	if r.Header.Get("Range") != "" {
+		size, err := seeker.Seek(0, io.SeekEnd)
+		if err != nil {
+			return errors.Wrap(err, "failed to Seek content")
+		}
+
+		if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+			return errors.Wrap(err, "failed to Seek content")
+		}
+
+		if err := checkRanges(ctx, r, etag, content.ModTime, size, content.SingleRange); err != nil {
+			return err
+		}
+	}
+
+	http.ServeContent(w, r, content.Name, content.ModTime, seeker)
+
+	return nil
+}
+
+// checkRanges checks the Range and If-Range headers of a request for content of size bytes, logging a resumed download
+func checkRanges(ctx *Ctx, r *http.Request, etag string, modTime time.Time, size int64, single bool) error {
+	client := clientIP(r, ctx.trustProxy)
+
+	if ifRange := r.Header.Get("If-Range"); ifRange != "" && !ifRangeMatches(ifRange, etag, modTime) {
+		ctx.Log.Info("[vk] refused to resume download of", r.URL.Path, "for", client+": the content has changed")
+
+		return E(http.StatusPreconditionFailed, "the content has changed, If-Range does not match its current validator")
+	}
+
+	ranges, err := parseByteRanges(r.Header.Get("Range"), size)
+	if err == nil && single && len(ranges) > 1 {
+		err = E(http.StatusRequestedRangeNotSatisfiable, "multiple ranges are not supported")
+	}
+
+	if err != nil {
+		ctx.RespHeaders.Set("Content-Range", "bytes */"+strconv.FormatInt(size, 10))
+		return err
+	}
+
+	if ranges[0].start > 0 {
+		ctx.Log.Info("[vk] resuming download of", r.URL.Path, "at offset", strconv.FormatInt(ranges[0].start, 10), "for", client)
+	}
+
+	return nil
+}
+
+// ifRangeMatches evaluates an If-Range header against the content's validators (RFC 7233, section 3.2). ETags must
+// match strongly, and dates exactly
+func ifRangeMatches(ifRange, etag string, modTime time.Time) bool {
+	if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, "W/") {
+		return etag != "" && strongETagMatch(ifRange, etag)
+	}
+
+	t, err := http.ParseTime(ifRange)
+
+	return err == nil && !modTime.IsZero() && t.Unix() == modTime.Unix()
+}
+
+type byteRange struct {
+	start, length int64
+}
+
+// parseByteRanges parses a Range header (RFC 7233, section 2.1) for content of size bytes, returning a 416 if it is
+// malformed or none of its ranges can be satisfied
+func parseByteRanges(header string, size int64) ([]byteRange, error) {
+	const unit = "bytes="
+
+	malformed := E(http.StatusRequestedRangeNotSatisfiable, "invalid Range header")
+
+	if !strings.HasPrefix(header, unit) {
+		return nil, malformed
+	}
+
+	ranges := []byteRange{}
+	parsed := 0
+
+	for _, spec := range strings.Split(header[len(unit):], ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+
+		parsed++
+
+		first, last, ok := strings.Cut(spec, "-")
+		first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+
+		if !ok || (first == "" && last == "") {
+			return nil, malformed
+		}
+
+		if first == "" {
+			// the last n bytes
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, malformed
+			}
+
+			if n == 0 || size == 0 {
+				continue
+			}
+
+			if n > size {
+				n = size
+			}
+
+			ranges = append(ranges, byteRange{start: size - n, length: n})
+
+			continue
+		}
+
+		start, err := strconv.ParseInt(first, 10, 64)
+		if err != nil || start < 0 {
+			return nil, malformed
+		}
+
+		end := size - 1
+
+		if last != "" {
+			end, err = strconv.ParseInt(last, 10, 64)
+			if err != nil || end < start {
+				return nil, malformed
+			}
+
+			if end >= size {
+				end = size - 1
+			}
+		}
+
+		if start >= size {
+			continue
+		}
+
+		ranges = append(ranges, byteRange{start: start, length: end - start + 1})
+	}
+
+	if parsed == 0 {
+		return nil, malformed
+	}
+
+	if len(ranges) == 0 {
+		return nil, E(http.StatusRequestedRangeNotSatisfiable, "range not satisfiable")
+	}
+
+	return ranges, nil
+}
+
+// openSeeker is an io.ReadSeeker over content that is opened at the offset to read from, see RangedContent.Open
+type openSeeker struct {
+	open   func(offset int64) (io.ReadCloser, error)
+	size   int64
+	offset int64
+	reader io.ReadCloser
+}
+
+func (o *openSeeker) Read(p []byte) (int, error) {
+	if o.reader == nil {
+		if o.offset >= o.size {
+			return 0, io.EOF
+		}
+
+		reader, err := o.open(o.offset)
+		if err != nil {
+			return 0, err
+		}
+
+		o.reader = reader
+	}
+
+	n, err := o.reader.Read(p)
+	o.offset += int64(n)
+
+	return n, err
+}
+
+func (o *openSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += o.offset
+	case io.SeekEnd:
+		offset += o.size
+	}
+
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	if offset != o.offset {
+		o.close()
+	}
+
+	o.offset = offset
+
+	return offset, nil
+}
+
+func (o *openSeeker) close() {
+	if o.reader != nil {
+		o.reader.Close()
+		o.reader = nil
+	}
+}
+
+// WithSingleRanges rejects requests for more than one range of a Static mount's files with a 416, rather than
+// serving them as multipart/byteranges
+func WithSingleRanges() MountOption {
+	return func(o *mountOptions) {
+		o.singleRange = true
+	}
+}
+
+// fileServer serves the files of a Static mount with RespondRanged, with a strong ETag computed from each file's
+// content. Directories, and anything that isn't a file that can be opened, are left to http.FileServer
+type fileServer struct {
+	fs          http.FileSystem
+	etags       *assetStore
+	fallback    HandlerFunc
+	singleRange bool
+}
+
+func newFileServer(fs http.FileSystem, options mountOptions) *fileServer {
+	f := &fileServer{
+		fs:          fs,
+		etags:       newAssetStore(fs, true),
+		fallback:    WrapStdHandlerWithCtx(http.FileServer(fs)),
+		singleRange: options.singleRange,
+	}
+
+	return f
+}
+
+func (f *fileServer) serve(w http.ResponseWriter, r *http.Request, ctx *Ctx) error {
+	// http.FileServer redirects index.html to its directory
+	if strings.HasSuffix(r.URL.Path, "/index.html") {
+		return f.fallback(w, r, ctx)
+	}
+
+	name := path.Clean("/" + r.URL.Path)
+
+	file, err := f.fs.Open(name)
+	if err != nil {
+		return f.fallback(w, r, ctx)
+	}
+
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		return f.fallback(w, r, ctx)
+	}
+
+	sum, err := f.etags.hashFile(strings.TrimPrefix(name, "/"), file, info)
+	if err != nil {
+		return f.fallback(w, r, ctx)
+	}
+
+	return RespondRanged(ctx, w, RangedContent{
+		Content:     file,
+		ETag:        `"` + sum + `"`,
+		ModTime:     info.ModTime(),
+		Name:        info.Name(),
+		SingleRange: f.singleRange,
+	})
+}
@@ -0,0 +1,22 @@
+package vk
+
+import (
+	"io"
+	"net/http"
+)
+
+// writerOnly hides the ReadFrom method of a writer, so that io.Copy uses its Write method
+type writerOnly struct {
+	io.Writer
+}
+
+// readFrom copies src to w using w's ReadFrom if it has one. The ResponseWriters that vk wraps around the server's
+// implement io.ReaderFrom by delegating to it, so that net/http can send files using sendfile rather than copying
+// them through userspace
+func readFrom(w http.ResponseWriter, src io.Reader) (int64, error) {
+	if rf, ok := w.(io.ReaderFrom); ok {
+		return rf.ReadFrom(src)
+	}
+
+	return io.Copy(writerOnly{w}, src)
+}
@@ -0,0 +1,478 @@
+package vk
+
+import (
+	"bytes"
+	"context"
+	"encoding"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// RedactionOptions configures the redaction of the fields of JSON responses that the caller isn't permitted to see.
+// A struct field is restricted with a `vk` tag listing the scopes that permit it, any one of which is enough:
+//
+//	type User struct {
+//		Name  string `json:"name"`
+//		Email string `json:"email" vk:"scope=admin:read|support:read"`
+//	}
+type RedactionOptions struct {
+	// Scopes returns the scopes granted to the caller, ScopesFromClaims by default
+	Scopes func(ctx *Ctx) []string
+}
+
+type redactionKey struct{}
+
+// redaction is carried in the request context so that RespondJSON can redact the response for the caller
+type redaction struct {
+	ctx     *Ctx
+	scopes  func(ctx *Ctx) []string
+	granted map[string]bool // the caller's scopes, looked up on first use
+	bypass  bool
+}
+
+// allowed returns true if the caller has any of the scopes
+func (r *redaction) allowed(scopes []string) bool {
+	if r.granted == nil {
+		r.granted = map[string]bool{}
+
+		for _, scope := range r.scopes(r.ctx) {
+			r.granted[scope] = true
+		}
+	}
+
+	for _, scope := range scopes {
+		if r.granted[scope] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Redaction is a Middleware that redacts the JSON responses of a route for its caller, see RedactionOptions. It
+// replaces the server's redaction (see UseRedaction) for the route
+func Redaction(opts RedactionOptions) Middleware {
+	return Named("redaction", func(inner HandlerFunc) HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request, ctx *Ctx) error {
+			ctx.useRedaction(&opts)
+
+			return inner(w, r, ctx)
+		}
+	})
+}
+
+// BypassRedaction sends the request's JSON responses in full, whatever the caller's scopes, such as for a handler
+// that has checked the caller's permissions itself
+func (c *Ctx) BypassRedaction() {
+	if state := redactionFrom(c.Context); state != nil {
+		state.bypass = true
+	}
+}
+
+// useRedaction sets how the request's JSON responses are redacted
+func (c *Ctx) useRedaction(opts *RedactionOptions) {
+	scopes := opts.Scopes
+	if scopes == nil {
+		scopes = ScopesFromClaims
+	}
+
+	if state := redactionFrom(c.Context); state != nil {
+		state.scopes = scopes
+		state.granted = nil
+
+		return
+	}
+
+	c.Context = context.WithValue(c.Context, redactionKey{}, &redaction{ctx: c, scopes: scopes})
+}
+
+// useRedaction sets the redaction of the router's JSON responses, or nil for none
+func (rt *Router) useRedaction(opts *RedactionOptions) {
+	rt.redaction = opts
+}
+
+func redactionFrom(ctx context.Context) *redaction {
+	if ctx == nil {
+		return nil
+	}
+
+	state, _ := ctx.Value(redactionKey{}).(*redaction)
+
+	return state
+}
+
+// ScopesFromClaims returns the scopes in the scope or scp claim of the request's claims (see ClaimsKey), which can be
+// a space-separated string, as in OAuth 2.0, or a list of strings
+func ScopesFromClaims(ctx *Ctx) []string {
+	claims := ctx.Get(ClaimsKey)
+	if claims == nil {
+		return nil
+	}
+
+	for _, name := range []string{"scope", "scp"} {
+		value, ok := lookupClaim(claims, name)
+		if !ok {
+			continue
+		}
+
+		switch v := value.(type) {
+		case string:
+			return strings.Fields(v)
+		case []string:
+			return v
+		case []interface{}:
+			scopes := make([]string, 0, len(v))
+
+			for _, s := range v {
+				if str, ok := s.(string); ok {
+					scopes = append(scopes, str)
+				}
+			}
+
+			return scopes
+		}
+	}
+
+	return nil
+}
+
+// RedactJSON encodes v like EncodeJSON, leaving out the struct fields that none of the scopes permit
+func RedactJSON(v interface{}, scopes []string) ([]byte, error) {
+	granted := map[string]bool{}
+	for _, scope := range scopes {
+		granted[scope] = true
+	}
+
+	r := &redaction{granted: granted}
+
+	buf := &bytes.Buffer{}
+	if err := redactJSON(buf, v, r, nil); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// redactJSON encodes v into buf like encodeJSON, leaving out the fields that r doesn't allow and, unless sel is nil,
+// those that sel doesn't select
+func redactJSON(buf *bytes.Buffer, v interface{}, r *redaction, sel fieldSelection) error {
+	if v == nil {
+		buf.WriteString("null")
+		return nil
+	}
+
+	return redactPlanFor(reflect.TypeOf(v)).encode(buf, reflect.ValueOf(v), r, sel)
+}
+
+// permits returns true if the caller may see a field restricted to the scopes
+func (r *redaction) permits(scopes []string) bool {
+	return len(scopes) == 0 || r.bypass || r.allowed(scopes)
+}
+
+var (
+	redactLock  sync.RWMutex
+	redactPlans = map[reflect.Type]*redactPlan{}
+)
+
+// redactPlan is how values of a type are redacted, worked out once per type. Values of plain types, with no
+// restricted fields however deeply nested, are encoded by encodeJSON unless fields are selected from them
+type redactPlan struct {
+	kind   planKind
+	plain  bool
+	elem   *redactPlan   // of pointers, slices, arrays and maps
+	fields []redactField // of structs
+}
+
+type redactField struct {
+	planField
+	scopes []string // the scopes that permit the field, any of them if it is restricted
+	plan   *redactPlan
+}
+
+// redactPlanFor returns the redaction plan for t, working it out if it isn't cached
+func redactPlanFor(t reflect.Type) *redactPlan {
+	redactLock.RLock()
+	plan, ok := redactPlans[t]
+	redactLock.RUnlock()
+
+	if ok {
+		return plan
+	}
+
+	redactLock.Lock()
+	defer redactLock.Unlock()
+
+	return buildRedactPlan(t)
+}
+
+// buildRedactPlan works out the redaction plan for t, it must be called with redactLock held
+func buildRedactPlan(t reflect.Type) *redactPlan {
+	if plan, ok := redactPlans[t]; ok {
+		// possibly still being built, for recursive types
+		return plan
+	}
+
+	plan := &redactPlan{kind: planPlain}
+	redactPlans[t] = plan
+
+	// types that handle their own encoding are left to them
+	if t.Implements(jsonMarshalerType) || reflect.PointerTo(t).Implements(jsonMarshalerType) ||
+		t.Implements(textMarshalerType) || reflect.PointerTo(t).Implements(textMarshalerType) {
+		plan.plain = true
+		return plan
+	}
+
+	// until it is built, the plan isn't plain, so that recursive types referring to it are never encoded without
+	// redaction
+	switch t.Kind() {
+	case reflect.Pointer:
+		plan.kind = planPointer
+		plan.elem = buildRedactPlan(t.Elem())
+	case reflect.Slice:
+		plan.kind = planSlice
+		plan.elem = buildRedactPlan(t.Elem())
+	case reflect.Array:
+		plan.kind = planArray
+		plan.elem = buildRedactPlan(t.Elem())
+	case reflect.Map:
+		// whatever the type of its keys, so that their values are never encoded without redaction
+		plan.kind = planMap
+		plan.elem = buildRedactPlan(t.Elem())
+	case reflect.Interface:
+		plan.kind = planInterface
+		return plan
+	case reflect.Struct:
+		plan.kind = planStruct
+		plan.fields = redactFields(t)
+	default:
+		plan.plain = true
+		return plan
+	}
+
+	plain := true
+
+	if plan.elem != nil {
+		plain = plan.elem.plain
+	}
+
+	for _, f := range plan.fields {
+		plain = plain && len(f.scopes) == 0 && f.plan.plain
+	}
+
+	plan.plain = plain
+
+	return plan
+}
+
+// redactFields returns the encoded fields of t with the scopes that permit them
+func redactFields(t reflect.Type) []redactField {
+	scalarLock.Lock()
+	fields := structFields(t)
+	scalarLock.Unlock()
+
+	redacted := make([]redactField, len(fields))
+
+	for i, f := range fields {
+		sf := t.FieldByIndex(f.index)
+
+		redacted[i] = redactField{
+			planField: f,
+			scopes:    tagScopes(sf.Tag.Get("vk")),
+			plan:      buildRedactPlan(sf.Type),
+		}
+	}
+
+	return redacted
+}
+
+// tagScopes returns the scopes of a vk tag such as scope=admin:read|support:read
+func tagScopes(tag string) []string {
+	for tag != "" {
+		var opt string
+		opt, tag, _ = strings.Cut(tag, ",")
+
+		if strings.HasPrefix(opt, "scope=") {
+			return strings.Split(strings.TrimPrefix(opt, "scope="), "|")
+		}
+	}
+
+	return nil
+}
+
+func (p *redactPlan) encode(buf *bytes.Buffer, v reflect.Value, r *redaction, sel fieldSelection) error {
+	if sel == nil && (p.plain || r.bypass) {
+		return encodeJSON(buf, v.Interface())
+	}
+
+	switch p.kind {
+	case planPointer:
+		if v.IsNil() {
+			buf.WriteString("null")
+			return nil
+		}
+
+		return p.elem.encode(buf, v.Elem(), r, sel)
+	case planInterface:
+		if v.IsNil() {
+			buf.WriteString("null")
+			return nil
+		}
+
+		return redactPlanFor(v.Elem().Type()).encode(buf, v.Elem(), r, sel)
+	case planSlice, planArray:
+		if p.kind == planSlice && v.IsNil() {
+			buf.WriteString("null")
+			return nil
+		}
+
+		buf.WriteByte('[')
+
+		for i := 0; i < v.Len(); i++ {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+
+			if err := p.elem.encode(buf, v.Index(i), r, sel); err != nil {
+				return err
+			}
+		}
+
+		buf.WriteByte(']')
+	case planMap:
+		return p.encodeMap(buf, v, r, sel)
+	case planStruct:
+		return p.encodeStruct(buf, v, r, sel)
+	default:
+		return encodeJSON(buf, v.Interface())
+	}
+
+	return nil
+}
+
+func (p *redactPlan) encodeMap(buf *bytes.Buffer, v reflect.Value, r *redaction, sel fieldSelection) error {
+	if v.IsNil() {
+		buf.WriteString("null")
+		return nil
+	}
+
+	type entry struct {
+		key   string
+		value reflect.Value
+	}
+
+	entries := make([]entry, 0, v.Len())
+
+	iter := v.MapRange()
+	for iter.Next() {
+		key, err := jsonMapKey(iter.Key())
+		if err != nil {
+			return err
+		}
+
+		entries = append(entries, entry{key: key, value: iter.Value()})
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+
+	buf.WriteByte('{')
+
+	for i, e := range entries {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+
+		key, _ := json.Marshal(e.key)
+		buf.Write(key)
+		buf.WriteByte(':')
+
+		if err := p.elem.encode(buf, e.value, r, sel); err != nil {
+			return err
+		}
+	}
+
+	buf.WriteByte('}')
+
+	return nil
+}
+
+// jsonMapKey returns the key that encoding/json would encode for the map key k
+func jsonMapKey(k reflect.Value) (string, error) {
+	if k.Kind() == reflect.String {
+		return k.String(), nil
+	}
+
+	if tm, ok := k.Interface().(encoding.TextMarshaler); ok {
+		if k.Kind() == reflect.Pointer && k.IsNil() {
+			return "", nil
+		}
+
+		text, err := tm.MarshalText()
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to MarshalText map key of type %s", k.Type())
+		}
+
+		return string(text), nil
+	}
+
+	switch k.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(k.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(k.Uint(), 10), nil
+	}
+
+	return "", errors.Errorf("unsupported map key type %s", k.Type())
+}
+
+func (p *redactPlan) encodeStruct(buf *bytes.Buffer, v reflect.Value, r *redaction, sel fieldSelection) error {
+	buf.WriteByte('{')
+
+	first := true
+
+	for _, f := range p.fields {
+		sub, selected := sel.field(f.name)
+		if !selected || !r.permits(f.scopes) {
+			continue
+		}
+
+		fv, ok := fieldByIndex(v, f.index, false)
+		if !ok || (f.omitEmpty && isEmptyValue(fv)) {
+			continue
+		}
+
+		if !first {
+			buf.WriteByte(',')
+		}
+
+		first = false
+
+		buf.Write(f.key)
+
+		if f.quoted {
+			data, err := json.Marshal(fv.Interface())
+			if err != nil {
+				return err
+			}
+
+			quoted, _ := json.Marshal(string(data))
+			buf.Write(quoted)
+
+			continue
+		}
+
+		if err := f.plan.encode(buf, fv, r, sub); err != nil {
+			return err
+		}
+	}
+
+	buf.WriteByte('}')
+
+	return nil
+}
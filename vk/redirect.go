@@ -0,0 +1,60 @@
+package vk
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const acmeChallengePrefix = "/.well-known/acme-challenge/"
+
+// httpsRedirectHandler returns a handler that permanently redirects (308) requests to HTTPS, preserving
+// the path and query. ACME challenges and the configured exempt paths are passed to next instead
+func httpsRedirectHandler(options *Options, next http.Handler) http.Handler {
+	exempt := map[string]bool{}
+	for _, p := range options.RedirectExemptPaths {
+		exempt[p] = true
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, acmeChallengePrefix) || exempt[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		target := *r.URL
+		target.Scheme = "https"
+		target.Host = httpsHost(options, r.Host)
+
+		location := target.String()
+
+		options.Logger.Debug("redirecting", r.Method, r.URL.String(), "to", location)
+
+		http.Redirect(w, r, location, http.StatusPermanentRedirect)
+	})
+}
+
+// httpsHost returns the host to use when redirecting to HTTPS, which is the canonical host if
+// configured, or the request's host with its port replaced by the configured TLS port
+func httpsHost(options *Options, reqHost string) string {
+	if options.CanonicalHost != "" {
+		return options.CanonicalHost
+	}
+
+	host := reqHost
+	if h, _, err := net.SplitHostPort(reqHost); err == nil {
+		host = h
+	}
+
+	if options.TLSPort != 0 && options.TLSPort != 443 {
+		return net.JoinHostPort(host, fmt.Sprintf("%d", options.TLSPort))
+	}
+
+	if strings.Contains(host, ":") {
+		// IPv6 literal without a port
+		return "[" + host + "]"
+	}
+
+	return host
+}
@@ -0,0 +1,339 @@
+package vk
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultResolveInterval = 30 * time.Second
+	defaultMaxDialFailures = 3
+	defaultEjectFor        = 30 * time.Second
+	resolveTimeout         = 5 * time.Second
+)
+
+// EndpointLookup returns the addresses that a proxy target currently resolves to, as IPs or host:port pairs (the
+// target's port is used for those without one)
+type EndpointLookup func(ctx context.Context) ([]string, error)
+
+// ResolverOptions configures an EndpointResolver
+type ResolverOptions struct {
+	Interval    time.Duration  // how often the target is resolved again, 30s by default
+	MaxFailures int            // consecutive connection failures after which an endpoint is ejected, 3 by default
+	EjectFor    time.Duration  // how long an endpoint is ejected for, 30s by default
+	Lookup      EndpointLookup // supplies the endpoints, such as from service discovery. Defaults to a DNS lookup
+}
+
+// EndpointStats reports the health of one of a resolver's endpoints
+type EndpointStats struct {
+	Address             string    `json:"address"`
+	Healthy             bool      `json:"healthy"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	EjectedUntil        time.Time `json:"ejected_until,omitempty"`
+	Requests            uint64    `json:"requests"`
+	Failures            uint64    `json:"failures"`
+}
+
+// ResolverStats reports a resolver's endpoints and its last resolution
+type ResolverStats struct {
+	Endpoints    []EndpointStats `json:"endpoints"`
+	LastResolved time.Time       `json:"last_resolved"`
+	LastError    string          `json:"last_error,omitempty"`
+}
+
+// EndpointResolver resolves a proxy target's name to a pool of endpoints, which requests are spread across round-
+// robin. The name is resolved again every Interval, so that failovers that change its records are followed, and
+// endpoints that fail to accept MaxFailures connections in a row are ejected from the pool for EjectFor. If every
+// endpoint has been ejected, they are all used rather than failing every request. Set it as ProxyOptions.Resolver
+type EndpointResolver struct {
+	host    string
+	port    string
+	options ResolverOptions
+
+	lock         sync.Mutex
+	endpoints    []*endpoint
+	next         int
+	lastResolved time.Time
+	lastError    error
+	resolving    bool
+
+	// the transport that every proxy using the resolver dials through, created by the first of them, whose idle
+	// connections are closed when the endpoints change
+	httpTransport *http.Transport
+}
+
+type endpoint struct {
+	address             string
+	consecutiveFailures int
+	ejectedUntil        time.Time
+	requests            uint64
+	failures            uint64
+}
+
+// NewEndpointResolver creates a resolver for target, the host:port of the proxy target it is used with
+func NewEndpointResolver(target string, opts ResolverOptions) (*EndpointResolver, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to SplitHostPort")
+	}
+
+	if opts.Interval <= 0 {
+		opts.Interval = defaultResolveInterval
+	}
+
+	if opts.MaxFailures <= 0 {
+		opts.MaxFailures = defaultMaxDialFailures
+	}
+
+	if opts.EjectFor <= 0 {
+		opts.EjectFor = defaultEjectFor
+	}
+
+	if opts.Lookup == nil {
+		opts.Lookup = func(ctx context.Context) ([]string, error) {
+			return net.DefaultResolver.LookupHost(ctx, host)
+		}
+	}
+
+	r := &EndpointResolver{
+		host:    host,
+		port:    port,
+		options: opts,
+	}
+
+	return r, nil
+}
+
+// Warm resolves the target now, so that the first requests don't wait for it
+func (r *EndpointResolver) Warm(ctx context.Context) error {
+	return r.resolve(ctx)
+}
+
+// Stats returns the health of each endpoint, sorted by address
+func (r *EndpointResolver) Stats() ResolverStats {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := time.Now()
+
+	stats := ResolverStats{
+		Endpoints:    make([]EndpointStats, len(r.endpoints)),
+		LastResolved: r.lastResolved,
+	}
+
+	if r.lastError != nil {
+		stats.LastError = r.lastError.Error()
+	}
+
+	for i, e := range r.endpoints {
+		stats.Endpoints[i] = EndpointStats{
+			Address:             e.address,
+			Healthy:             !e.ejectedUntil.After(now),
+			ConsecutiveFailures: e.consecutiveFailures,
+			Requests:            e.requests,
+			Failures:            e.failures,
+		}
+
+		if e.ejectedUntil.After(now) {
+			stats.Endpoints[i].EjectedUntil = e.ejectedUntil
+		}
+	}
+
+	sort.Slice(stats.Endpoints, func(i, j int) bool {
+		return stats.Endpoints[i].Address < stats.Endpoints[j].Address
+	})
+
+	return stats
+}
+
+// RegisterAdmin mounts GET /endpoints on the admin router, reporting the resolver's stats
+func (r *EndpointResolver) RegisterAdmin(rt *Router) {
+	rt.GET("/endpoints", func(w http.ResponseWriter, _ *http.Request, ctx *Ctx) error {
+		return RespondJSON(ctx.Context, w, r.Stats(), http.StatusOK)
+	})
+}
+
+// pick returns the address of the next endpoint, resolving the target first if it never has been, and in the
+// background if the last resolution is older than the interval
+func (r *EndpointResolver) pick(ctx context.Context) (string, error) {
+	r.lock.Lock()
+	empty := len(r.endpoints) == 0
+	r.lock.Unlock()
+
+	if empty {
+		if err := r.resolve(ctx); err != nil {
+			return "", err
+		}
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if len(r.endpoints) == 0 {
+		return "", errors.Errorf("%s has no endpoints", r.host)
+	}
+
+	if !r.resolving && time.Since(r.lastResolved) >= r.options.Interval {
+		r.resolving = true
+
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+			defer cancel()
+
+			_ = r.resolve(ctx)
+		}()
+	}
+
+	now := time.Now()
+
+	var chosen *endpoint
+
+	for i := 0; i < len(r.endpoints); i++ {
+		e := r.endpoints[(r.next+i)%len(r.endpoints)]
+		if !e.ejectedUntil.After(now) {
+			chosen = e
+			r.next = (r.next + i + 1) % len(r.endpoints)
+
+			break
+		}
+	}
+
+	if chosen == nil {
+		// every endpoint is ejected, so the one that was ejected first is tried rather than failing outright
+		chosen = r.endpoints[0]
+		for _, e := range r.endpoints[1:] {
+			if e.ejectedUntil.Before(chosen.ejectedUntil) {
+				chosen = e
+			}
+		}
+	}
+
+	chosen.requests++
+
+	return chosen.address, nil
+}
+
+// resolve looks the target up and replaces the endpoints, keeping the health of those that remain. A failed lookup
+// keeps the endpoints as they were
+func (r *EndpointResolver) resolve(ctx context.Context) error {
+	addresses, err := r.options.Lookup(ctx)
+	if err == nil && len(addresses) == 0 {
+		err = errors.Errorf("%s resolved to no addresses", r.host)
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.resolving = false
+	r.lastResolved = time.Now()
+	r.lastError = err
+
+	if err != nil {
+		return errors.Wrap(err, "failed to Lookup")
+	}
+
+	existing := map[string]*endpoint{}
+	for _, e := range r.endpoints {
+		existing[e.address] = e
+	}
+
+	endpoints := make([]*endpoint, 0, len(addresses))
+	seen := map[string]bool{}
+
+	for _, address := range addresses {
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			address = net.JoinHostPort(address, r.port)
+		}
+
+		if seen[address] {
+			continue
+		}
+
+		seen[address] = true
+
+		if e, ok := existing[address]; ok {
+			endpoints = append(endpoints, e)
+			delete(existing, address)
+		} else {
+			endpoints = append(endpoints, &endpoint{address: address})
+		}
+	}
+
+	r.endpoints = endpoints
+
+	if len(existing) > 0 {
+		// idle connections to the endpoints that were removed would otherwise be kept around
+		if r.httpTransport != nil {
+			r.httpTransport.CloseIdleConnections()
+		}
+	}
+
+	return nil
+}
+
+// dialed records the outcome of a connection to address
+func (r *EndpointResolver) dialed(address string, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, e := range r.endpoints {
+		if e.address != address {
+			continue
+		}
+
+		if err == nil {
+			e.consecutiveFailures = 0
+			return
+		}
+
+		e.failures++
+		e.consecutiveFailures++
+
+		if e.consecutiveFailures >= r.options.MaxFailures {
+			e.ejectedUntil = time.Now().Add(r.options.EjectFor)
+			e.consecutiveFailures = 0
+		}
+
+		return
+	}
+}
+
+// transport returns the transport for proxies to the resolver's target, shared by all of them so that applying a
+// proxy's options again (such as to a swapped router) reuses its connections rather than leaving them behind.
+// Requests are sent to the endpoint's address (so connections are pooled per endpoint, and those to an endpoint
+// that has gone are never reused), and TLS connections verify the target's name
+func (r *EndpointResolver) transport() *http.Transport {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.httpTransport != nil {
+		return r.httpTransport
+	}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+
+	t.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, address)
+		if ctx.Err() == nil {
+			// a client that went away says nothing about the endpoint
+			r.dialed(address, err)
+		}
+
+		return conn, err
+	}
+
+	t.TLSClientConfig = &tls.Config{ServerName: r.host}
+
+	r.httpTransport = t
+
+	return t
+}
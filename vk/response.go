@@ -2,12 +2,12 @@ package vk
 
 import (
 	"context"
-	"encoding/json"
 	"net/http"
 )
 
 // RespondJSON converts a value to json, and sends it to the client. Ctx is a placeholder here, it is currently unused,
-// but will be used for tracing / logging help purposes later.
+// but will be used for tracing / logging help purposes later. Routes whose group has a ResponseEncoder encode the
+// value with it instead.
 func RespondJSON(ctx context.Context, w http.ResponseWriter, data any, statusCode int) error {
 	// If there is nothing to marshal then set status code and return.
 	if statusCode == http.StatusNoContent {
@@ -15,12 +15,23 @@ func RespondJSON(ctx context.Context, w http.ResponseWriter, data any, statusCod
 		return nil
 	}
 
-	// Convert the response value to JSON.
-	jsonData, err := json.Marshal(data)
-	if err != nil {
+	// Routes whose group has a ResponseEncoder use it instead of JSON.
+	if encoder := responseEncoderFrom(ctx); encoder != nil {
+		return respondEncoded(ctx, w, encoder, data, statusCode)
+	}
+
+	// Convert the response value to JSON, with any registered scalars, in a pooled buffer that is returned to the
+	// pool once the response is written.
+	buf := getBuffer()
+	defer putBuffer(buf)
+
+	if err := encodeResponseJSON(ctx, buf, data, statusCode); err != nil {
 		return err
 	}
 
+	// Add the `_meta` field to objects if the router is configured to do so.
+	jsonData := injectMeta(ctx, buf.Bytes(), statusCode)
+
 	// Set the content type and headers once we know marshaling has succeeded.
 	w.Header().Set("Content-Type", "application/json")
 
@@ -59,7 +70,12 @@ func RespondBytes(ctx context.Context, w http.ResponseWriter, data []byte, statu
 // respondBytes takes content as []byte and pipes it into the http.ResponseWriter. The assumption is that the content
 // type header has already been set. The only time this is not called is when the status code is http.StatusNoContent,
 // which would have broken early in the callers.
-func respondBytes(_ context.Context, w http.ResponseWriter, content []byte, statusCode int) error {
+func respondBytes(ctx context.Context, w http.ResponseWriter, content []byte, statusCode int) error {
+	// Refuse to send a body larger than the configured maximum, the error becomes a 500.
+	if err := checkResponseSize(ctx, len(content)); err != nil {
+		return err
+	}
+
 	// Write the status code to the response.
 	w.WriteHeader(statusCode)
 
@@ -0,0 +1,184 @@
+package vk
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// ErrResponseTooLarge is returned by writes that would take a response beyond its maximum size
+var ErrResponseTooLarge = errors.New("response exceeds the maximum size")
+
+type responseLimitKey struct{}
+
+// responseLimit is carried in the request context so that the Respond helpers can check a body before writing it
+type responseLimit struct {
+	max   int64
+	route string
+
+	// replacing is set once an oversized response has been rejected, so that the error response can be sent
+	replacing bool
+}
+
+// MaxResponseBytes is a Middleware that overrides the server's maximum response size (see UseMaxResponseBytes)
+// for a route, where maxBytes <= 0 means unlimited
+func MaxResponseBytes(maxBytes int64) Middleware {
+	return Named("maxresponse", func(inner HandlerFunc) HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request, ctx *Ctx) error {
+			lw := limitResponse(w, r, ctx, maxBytes)
+			if lw == nil {
+				return inner(w, r, ctx)
+			}
+
+			err := inner(lw, r, ctx)
+			lw.finish()
+
+			return err
+		}
+	})
+}
+
+// useMaxResponseBytes sets the maximum size of responses served by the router
+func (rt *Router) useMaxResponseBytes(maxBytes int64) {
+	rt.maxResponseBytes = maxBytes
+}
+
+// limitResponse sets the maximum response size for the request, returning a new limitWriter wrapping w
+// if the request doesn't already have one, or nil if it does and its limit has been updated
+func limitResponse(w http.ResponseWriter, r *http.Request, ctx *Ctx, maxBytes int64) *limitWriter {
+	if limit := responseLimitFrom(ctx.Context); limit != nil {
+		limit.max = maxBytes
+		return nil
+	}
+
+	limit := &responseLimit{max: maxBytes, route: fmt.Sprintf("%s %s", r.Method, r.URL.Path)}
+	ctx.Context = context.WithValue(ctx.Context, responseLimitKey{}, limit)
+
+	lw := &limitWriter{ResponseWriter: w, limit: limit, ctx: ctx}
+
+	return lw
+}
+
+func responseLimitFrom(ctx context.Context) *responseLimit {
+	if ctx == nil {
+		return nil
+	}
+
+	limit, _ := ctx.Value(responseLimitKey{}).(*responseLimit)
+
+	return limit
+}
+
+// checkResponseSize returns an error if a body of size bytes would exceed the request's maximum response size
+func checkResponseSize(ctx context.Context, size int) error {
+	limit := responseLimitFrom(ctx)
+	if limit == nil || limit.max <= 0 || int64(size) <= limit.max {
+		return nil
+	}
+
+	limit.replacing = true
+
+	return errors.Wrapf(ErrResponseTooLarge, "%s responded with %d bytes, the limit is %d", limit.route, size, limit.max)
+}
+
+// limitWriter refuses writes beyond the request's maximum response size, which catches handlers that stream their
+// responses. Once a response has been truncated it cannot be completed, so the connection is closed
+type limitWriter struct {
+	http.ResponseWriter
+	limit       *responseLimit
+	ctx         *Ctx
+	written     int64
+	wroteHeader bool
+	exceeded    bool
+	truncated   bool // the limit was exceeded after part of the response was sent
+}
+
+func (l *limitWriter) WriteHeader(status int) {
+	if l.exceeded && !l.wroteHeader {
+		l.limit.replacing = true
+	}
+
+	l.wroteHeader = true
+	l.ResponseWriter.WriteHeader(status)
+}
+
+func (l *limitWriter) Write(b []byte) (int, error) {
+	if l.limit.replacing {
+		l.wroteHeader = true
+		return l.ResponseWriter.Write(b)
+	}
+
+	if l.exceeded {
+		return 0, ErrResponseTooLarge
+	}
+
+	if l.limit.max > 0 && l.written+int64(len(b)) > l.limit.max {
+		l.exceeded = true
+		l.truncated = l.wroteHeader
+		l.ctx.Log.ErrorString(fmt.Sprintf("[vk] %s response exceeded the limit of %d bytes after %d bytes", l.limit.route, l.limit.max, l.written))
+
+		return 0, ErrResponseTooLarge
+	}
+
+	l.wroteHeader = true
+	l.written += int64(len(b))
+
+	return l.ResponseWriter.Write(b)
+}
+
+// ReadFrom copies from src, using the underlying ResponseWriter's ReadFrom when the copy can't exceed the limit.
+// That is the case for io.CopyN (which http.ServeContent uses) with a size below it; anything else must pass
+// through Write to be counted
+func (l *limitWriter) ReadFrom(src io.Reader) (int64, error) {
+	if l.limit.max > 0 && !l.limit.replacing {
+		lr, ok := src.(*io.LimitedReader)
+		if l.exceeded || !ok || l.written+lr.N > l.limit.max {
+			return io.Copy(writerOnly{l}, src)
+		}
+	}
+
+	l.wroteHeader = true
+
+	n, err := readFrom(l.ResponseWriter, src)
+	l.written += n
+
+	return n, err
+}
+
+// Flush flushes the underlying ResponseWriter if it supports flushing
+func (l *limitWriter) Flush() {
+	if f, ok := l.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack hijacks the underlying ResponseWriter's connection, so that websockets are unaffected by the limit
+func (l *limitWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := l.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("ResponseWriter does not implement http.Hijacker")
+	}
+
+	return h.Hijack()
+}
+
+// finish closes the connection if part of a response was sent before the limit was exceeded, rather than letting
+// the client believe the truncated response is complete. If nothing was sent, a 500 is sent instead
+func (l *limitWriter) finish() {
+	if !l.exceeded {
+		return
+	}
+
+	if l.truncated {
+		panic(http.ErrAbortHandler)
+	}
+
+	if !l.wroteHeader {
+		l.WriteHeader(http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,305 @@
+package vk
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/suborbital/vektor/vlog"
+)
+
+const (
+	defaultRetirementNotice  = 30 * 24 * time.Hour
+	defaultRetirementSummary = 7 * 24 * time.Hour
+	defaultRetirementCallers = 100
+)
+
+// RetirementOtherCallers is the caller that the requests of the callers beyond a route's MaxCallers are counted as
+const RetirementOtherCallers = "other"
+
+// RouteRetirement is when a route registered with Retire stops being served, and the route that replaces it
+type RouteRetirement struct {
+	At          time.Time `json:"at"`
+	Replacement string    `json:"replacement,omitempty"`
+}
+
+// Retire is a route Middleware that schedules the route's retirement. Until at, its responses carry a Sunset header
+// with the date and a Link header pointing to replacement (if it isn't empty) as the successor version. From at
+// onwards, the route responds with a 410 Gone through the route's error formatter, naming the replacement, and the
+// route's handler is no longer called. The server's clock and the callers of retiring routes are set by UseRetirement
+func Retire(at time.Time, replacement string) Middleware {
+	retirement := RouteRetirement{At: at, Replacement: replacement}
+
+	return func(inner HandlerFunc) HandlerFunc {
+		handler := func(w http.ResponseWriter, r *http.Request, ctx *Ctx) error {
+			now := ctx.retirements.now()
+
+			if replacement != "" {
+				ctx.RespHeaders.Add("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", replacement))
+			}
+
+			ctx.retirements.observe(r.Method, ctx.route, retirement, retirementCaller(r, ctx), now)
+
+			if !now.Before(at) {
+				msg := fmt.Sprintf("this route was retired on %s", at.UTC().Format(time.RFC3339))
+				if replacement != "" {
+					msg += ", use " + replacement + " instead"
+				}
+
+				return E(http.StatusGone, msg)
+			}
+
+			ctx.RespHeaders.Set("Sunset", at.UTC().Format(http.TimeFormat))
+
+			return inner(w, r, ctx)
+		}
+
+		l := &chainLink{name: "retire", next: inner, handler: handler, value: retirement}
+
+		return l.serve
+	}
+}
+
+// retirementOf returns the retirement of a route registered with Retire
+func retirementOf(handler HandlerFunc) *RouteRetirement {
+	for _, v := range chainValues(handler) {
+		if r, ok := v.(RouteRetirement); ok {
+			return &r
+		}
+	}
+
+	return nil
+}
+
+// retirementCaller identifies the client calling a retiring route by its client ID, or its IP if it didn't send one
+func retirementCaller(r *http.Request, ctx *Ctx) string {
+	if id := ctx.Correlation().ClientID(); id != "" {
+		return id
+	}
+
+	return clientIP(r, ctx.trustProxy)
+}
+
+// RetirementOptions configures how routes registered with Retire are retired
+type RetirementOptions struct {
+	Notice          time.Duration // how long before its retirement a route's callers are tracked, 30 days by default
+	SummaryInterval time.Duration // how often the callers of retiring routes are logged, weekly by default
+
+	// MaxCallers is how many distinct callers of each route are counted between summaries, 100 by default. The
+	// requests of any others are counted as RetirementOtherCallers
+	MaxCallers int
+
+	// Now returns the current time that retirement dates are compared to, time.Now by default
+	Now func() time.Time
+}
+
+// RetirementCaller counts the requests a client made to a retiring route
+type RetirementCaller struct {
+	Caller   string `json:"caller"` // the client's ID or IP, see Correlation
+	Requests uint64 `json:"requests"`
+}
+
+// RetiringRoute reports the clients that called a route since the last summary, within its notice period or after
+// it was retired
+type RetiringRoute struct {
+	Method     string             `json:"method"`
+	Route      string             `json:"route"`
+	Retirement RouteRetirement    `json:"retirement"`
+	Callers    []RetirementCaller `json:"callers"` // most requests first
+}
+
+// retiringRoute counts the callers of a route
+type retiringRoute struct {
+	method     string
+	route      string
+	retirement RouteRetirement
+	callers    map[string]uint64
+}
+
+// Retirements tracks the clients still calling the routes registered with Retire, and logs them every
+// SummaryInterval so that they can be chased before (or after) the routes are retired. A summary is logged by the
+// first request to a retiring route after the interval has passed, so none are logged while the routes are idle
+type Retirements struct {
+	opts RetirementOptions
+	log  *vlog.Logger
+
+	lock        sync.Mutex
+	routes      map[string]*retiringRoute // keyed by method and route
+	lastSummary time.Time
+}
+
+func newRetirements(opts RetirementOptions, log *vlog.Logger) *Retirements {
+	if opts.Notice <= 0 {
+		opts.Notice = defaultRetirementNotice
+	}
+
+	if opts.SummaryInterval <= 0 {
+		opts.SummaryInterval = defaultRetirementSummary
+	}
+
+	if opts.MaxCallers <= 0 {
+		opts.MaxCallers = defaultRetirementCallers
+	}
+
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+
+	if log == nil {
+		log = vlog.Noop()
+	}
+
+	r := &Retirements{
+		opts:   opts,
+		log:    log,
+		routes: map[string]*retiringRoute{},
+	}
+
+	return r
+}
+
+// Callers returns the callers of each retiring route since the last summary, sorted by route
+func (r *Retirements) Callers() []RetiringRoute {
+	if r == nil {
+		return []RetiringRoute{}
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.callers()
+}
+
+// RegisterAdmin mounts GET /retirements on the admin router, reporting the callers of each retiring route
+func (r *Retirements) RegisterAdmin(admin *Router) {
+	admin.GET("/retirements", func(w http.ResponseWriter, _ *http.Request, ctx *Ctx) error {
+		return RespondJSON(ctx.Context, w, r.Callers(), http.StatusOK)
+	})
+}
+
+// now returns the current time of the Retirements' clock
+func (r *Retirements) now() time.Time {
+	if r == nil {
+		return time.Now()
+	}
+
+	return r.opts.Now()
+}
+
+// observe counts a request from caller to a retiring route if it is within its notice period, first logging the
+// summary if one is due
+func (r *Retirements) observe(method, route string, retirement RouteRetirement, caller string, now time.Time) {
+	if r == nil || now.Before(retirement.At.Add(-r.opts.Notice)) {
+		return
+	}
+
+	var summary []string
+
+	r.lock.Lock()
+
+	if r.lastSummary.IsZero() {
+		r.lastSummary = now
+	} else if now.Sub(r.lastSummary) >= r.opts.SummaryInterval {
+		summary = r.summarize(now)
+	}
+
+	key := method + " " + route
+
+	rr, ok := r.routes[key]
+	if !ok {
+		rr = &retiringRoute{method: method, route: route, retirement: retirement, callers: map[string]uint64{}}
+		r.routes[key] = rr
+	}
+
+	// the callers are client-sent, so the first MaxCallers are counted and the rest are folded together
+	if _, ok := rr.callers[caller]; !ok && len(rr.callers) >= r.opts.MaxCallers {
+		caller = RetirementOtherCallers
+	}
+
+	rr.callers[caller]++
+
+	r.lock.Unlock()
+
+	for _, line := range summary {
+		r.log.Warn(line)
+	}
+}
+
+// summarize returns the lines logging the callers of each retiring route since the last summary, and starts counting
+// again. It must be called with the lock held
+func (r *Retirements) summarize(now time.Time) []string {
+	routes := r.callers()
+	lines := make([]string, len(routes))
+
+	for i, route := range routes {
+		status := "retires"
+		if !now.Before(route.Retirement.At) {
+			status = "was retired"
+		}
+
+		callers := make([]string, len(route.Callers))
+		for j, c := range route.Callers {
+			callers[j] = fmt.Sprintf("%s (%d)", c.Caller, c.Requests)
+		}
+
+		lines[i] = fmt.Sprintf("retirement: %s %s %s on %s, and was called by %d clients since %s: %s",
+			route.Method, route.Route, status, route.Retirement.At.UTC().Format(time.RFC3339), len(callers),
+			r.lastSummary.UTC().Format(time.RFC3339), strings.Join(callers, ", "))
+	}
+
+	r.routes = map[string]*retiringRoute{}
+	r.lastSummary = now
+
+	return lines
+}
+
+// callers must be called with the lock held
+func (r *Retirements) callers() []RetiringRoute {
+	routes := make([]RetiringRoute, 0, len(r.routes))
+
+	for _, rr := range r.routes {
+		route := RetiringRoute{
+			Method:     rr.method,
+			Route:      rr.route,
+			Retirement: rr.retirement,
+			Callers:    make([]RetirementCaller, 0, len(rr.callers)),
+		}
+
+		for caller, requests := range rr.callers {
+			route.Callers = append(route.Callers, RetirementCaller{Caller: caller, Requests: requests})
+		}
+
+		sort.Slice(route.Callers, func(i, j int) bool {
+			if route.Callers[i].Requests != route.Callers[j].Requests {
+				return route.Callers[i].Requests > route.Callers[j].Requests
+			}
+
+			return route.Callers[i].Caller < route.Callers[j].Caller
+		})
+
+		routes = append(routes, route)
+	}
+
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].Route != routes[j].Route {
+			return routes[i].Route < routes[j].Route
+		}
+
+		return routes[i].Method < routes[j].Method
+	})
+
+	return routes
+}
+
+// useRetirements sets the Retirements that the router's retiring routes use
+func (rt *Router) useRetirements(r *Retirements) {
+	rt.retirements = r
+}
+
+// Retirements returns the tracker of the callers of the server's retiring routes
+func (s *Server) Retirements() *Retirements {
+	return s.retirements
+}
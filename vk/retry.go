@@ -0,0 +1,208 @@
+package vk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// RetryPolicy controls how Ctx.Retry retries a failing function. Use NewRetryPolicy
+// to get a policy with sensible defaults, and the With* methods to adjust it
+type RetryPolicy struct {
+	MaxAttempts    int           // maximum number of attempts for a single call, including the first
+	Budget         int           // maximum number of retries shared by every Retry call for a single request
+	InitialBackoff time.Duration // the delay before the first retry
+	MaxBackoff     time.Duration // the maximum delay between attempts
+	Multiplier     float64       // the factor by which the delay grows after each attempt
+	Jitter         float64       // the fraction (0-1) of each delay that is randomized
+
+	// Retryable determines if an error should be retried, by default all errors other than
+	// context cancellation are retried
+	Retryable func(error) bool
+
+	// Now and Sleep can be replaced for testing, Sleep must return early with
+	// an error if the context is done
+	Now   func() time.Time
+	Sleep func(ctx context.Context, d time.Duration) error
+}
+
+// RetryError is returned by Ctx.Retry when every attempt failed
+type RetryError struct {
+	Attempts int
+	Err      error
+}
+
+// Error returns the final error along with the number of attempts
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("failed after %d attempts: %s", e.Attempts, e.Err.Error())
+}
+
+// Unwrap returns the final error
+func (e *RetryError) Unwrap() error {
+	return e.Err
+}
+
+// NewRetryPolicy returns a policy of 3 attempts per call, a budget of 5 retries per request,
+// and exponential backoff from 50ms to 1s with 20% jitter
+func NewRetryPolicy() RetryPolicy {
+	p := RetryPolicy{
+		MaxAttempts:    3,
+		Budget:         5,
+		InitialBackoff: 50 * time.Millisecond,
+		MaxBackoff:     time.Second,
+		Multiplier:     2,
+		Jitter:         0.2,
+	}
+
+	return p
+}
+
+// WithMaxAttempts returns a copy of the policy with the max attempts per call set
+func (p RetryPolicy) WithMaxAttempts(attempts int) RetryPolicy {
+	p.MaxAttempts = attempts
+	return p
+}
+
+// WithBudget returns a copy of the policy with the per-request retry budget set
+func (p RetryPolicy) WithBudget(retries int) RetryPolicy {
+	p.Budget = retries
+	return p
+}
+
+// WithBackoff returns a copy of the policy with the initial and max backoff set
+func (p RetryPolicy) WithBackoff(initial, maxBackoff time.Duration) RetryPolicy {
+	p.InitialBackoff = initial
+	p.MaxBackoff = maxBackoff
+	return p
+}
+
+// WithJitter returns a copy of the policy with the jitter fraction set
+func (p RetryPolicy) WithJitter(jitter float64) RetryPolicy {
+	p.Jitter = jitter
+	return p
+}
+
+// WithRetryable returns a copy of the policy that only retries errors for which retryable returns true
+func (p RetryPolicy) WithRetryable(retryable func(error) bool) RetryPolicy {
+	p.Retryable = retryable
+	return p
+}
+
+// Retry calls fn with the request's context until it succeeds, the policy's attempts or the request's shared
+// retry budget are exhausted, the error is not retryable, or the request's deadline would pass before the next
+// attempt. Backoff never sleeps past the deadline. If every attempt fails, a *RetryError is returned
+func (c *Ctx) Retry(policy RetryPolicy, fn func(context.Context) error) error {
+	reqCtx := context.Background()
+	if c != nil && c.Context != nil {
+		reqCtx = c.Context
+	}
+
+	now := policy.Now
+	if now == nil {
+		now = time.Now
+	}
+
+	sleep := policy.Sleep
+	if sleep == nil {
+		sleep = sleepCtx
+	}
+
+	retryable := policy.Retryable
+	if retryable == nil {
+		retryable = defaultRetryable
+	}
+
+	backoff := policy.InitialBackoff
+	attempts := 0
+
+	for {
+		attempts++
+
+		err := fn(reqCtx)
+		if err == nil {
+			return nil
+		}
+
+		if attempts >= policy.MaxAttempts || !retryable(err) || reqCtx.Err() != nil {
+			return &RetryError{Attempts: attempts, Err: err}
+		}
+
+		delay := jitter(backoff, policy.Jitter)
+
+		if deadline, ok := reqCtx.Deadline(); ok && !now().Add(delay).Before(deadline) {
+			return &RetryError{Attempts: attempts, Err: err}
+		}
+
+		if !c.takeRetry(policy.Budget) {
+			return &RetryError{Attempts: attempts, Err: err}
+		}
+
+		if sleepErr := sleep(reqCtx, delay); sleepErr != nil {
+			return &RetryError{Attempts: attempts, Err: err}
+		}
+
+		backoff = nextBackoff(backoff, policy)
+	}
+}
+
+// takeRetry takes a retry from the request's budget, returning false if none remain
+func (c *Ctx) takeRetry(budget int) bool {
+	if c == nil {
+		return budget > 0
+	}
+
+	if atomic.AddInt32(&c.retriesUsed, 1) > int32(budget) {
+		atomic.AddInt32(&c.retriesUsed, -1)
+		return false
+	}
+
+	return true
+}
+
+func nextBackoff(backoff time.Duration, policy RetryPolicy) time.Duration {
+	multiplier := policy.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+
+	next := time.Duration(float64(backoff) * multiplier)
+	if policy.MaxBackoff > 0 && next > policy.MaxBackoff {
+		next = policy.MaxBackoff
+	}
+
+	return next
+}
+
+// jitter randomizes the given fraction of d, i.e. 100ms with 0.2 jitter is between 80ms and 120ms
+func jitter(d time.Duration, fraction float64) time.Duration {
+	if fraction <= 0 {
+		return d
+	}
+
+	if fraction > 1 {
+		fraction = 1
+	}
+
+	delta := float64(d) * fraction
+
+	return time.Duration(float64(d) - delta + rand.Float64()*2*delta)
+}
+
+func defaultRetryable(err error) bool {
+	return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
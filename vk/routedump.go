@@ -0,0 +1,125 @@
+package vk
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// routeInfoMetric is the name of the info metric written by WriteRouteInfo
+	routeInfoMetric = "vk_route_info"
+
+	// routeInfoContentType is the content type of the Prometheus text format
+	routeInfoContentType = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+// SnapshotWithBuild returns a snapshot of the server's routes that includes the build information of the running
+// binary, as written by UseRouteDump
+func (s *Server) SnapshotWithBuild() RouteSnapshot {
+	snapshot := s.Snapshot()
+
+	build := opsVersion(s.options.AppName, s.options.Ops.Release)
+	snapshot.Build = &build
+
+	return snapshot
+}
+
+// RouteInfoHandler serves an info metric describing the server's routes in the Prometheus text format, see
+// WriteRouteInfo. OpsGroup's metrics endpoint includes it
+func (s *Server) RouteInfoHandler() http.Handler {
+	return routeInfoHandler(s.Snapshot, s.options.AppName)
+}
+
+// WriteRouteInfo writes a vk_route_info gauge with a value of 1 for each of the snapshot's routes, labelled with
+// its method, path, isolation domain and the name of the application, in the Prometheus text format. Ops routes
+// are left out, as they aren't part of the application's API
+func WriteRouteInfo(w io.Writer, snapshot RouteSnapshot, appName string) error {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "# HELP %s The routes served by the application.\n", routeInfoMetric)
+	fmt.Fprintf(&b, "# TYPE %s gauge\n", routeInfoMetric)
+
+	for _, r := range snapshot.Routes {
+		if r.Ops {
+			continue
+		}
+
+		domain := r.Domain
+		if domain == "" {
+			domain = DefaultDomain
+		}
+
+		fmt.Fprintf(&b, "%s{method=\"%s\",path=\"%s\",name=\"%s\",domain=\"%s\"} 1\n", routeInfoMetric, escapeLabel(r.Method), escapeLabel(r.Path), escapeLabel(appName), escapeLabel(domain))
+	}
+
+	_, err := io.WriteString(w, b.String())
+
+	return err
+}
+
+// routeInfoHandler serves the route info metric for the snapshots returned by snapshot
+func routeInfoHandler(snapshot func() RouteSnapshot, appName string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set(contentTypeHeaderKey, routeInfoContentType)
+
+		_ = WriteRouteInfo(w, snapshot(), appName)
+	})
+}
+
+// escapeLabel escapes a label value for the Prometheus text format
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// dumpRoutes writes the route snapshot to the file set with UseRouteDump, once the routes have been finalized.
+// Failing to write it is only logged, since the server can serve without it
+func (s *Server) dumpRoutes() {
+	path := s.options.RouteDumpPath
+	if path == "" {
+		return
+	}
+
+	if err := writeRouteDump(path, s.SnapshotWithBuild()); err != nil {
+		s.options.Logger.Warn(errors.Wrap(err, "[vk] failed to writeRouteDump").Error())
+		return
+	}
+
+	s.options.Logger.Debug("wrote route snapshot to", path)
+}
+
+// writeRouteDump writes the snapshot to path through a temporary file, so that readers never see a partial dump
+func writeRouteDump(path string, snapshot RouteSnapshot) error {
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to MarshalIndent")
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return errors.Wrap(err, "failed to CreateTemp")
+	}
+
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "failed to Write")
+	}
+
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "failed to Close")
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return errors.Wrap(err, "failed to Rename")
+	}
+
+	return nil
+}
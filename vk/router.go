@@ -1,15 +1,16 @@
 package vk
 
 import (
+	"context"
 	"fmt"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
 	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
 
 	"github.com/suborbital/vektor/vlog"
 )
@@ -34,62 +35,213 @@ type Router struct {
 	*RouteGroup                    // the "root" RouteGroup that is mounted at server start
 	hrouter     *httprouter.Router // the internal 'actual' router
 
-	fallbackProxy *httputil.ReverseProxy
-	quietRoutes   map[string]bool
-	finalizeOnce  sync.Once // ensure that the root only gets mounted once
+	fallbackProxy    *proxy
+	quietRoutes      map[string]bool
+	livenessRoutes   map[string]bool // keyed by method and path, see liveness
+	quiet            bool            // log every route quietly
+	state            *routeState
+	metaProvider     MetaProvider
+	redaction        *RedactionOptions
+	maxResponseBytes int64
+	bindMaxBytes     int64
+	trustProxy       bool
+	panics           *Panics
+	domains          *isolationDomains
+	inFlight         *InFlightRequests
+	strictResponses  bool
+	propagations     []contextPropagation
+	formatters       []prefixFormatter // the error formatters of groups, for requests that match no route
+	notifier         Notifier
+	cleanups         cleanupCounter
+	slowCleanup      time.Duration
+	webSockets       *WebSocketLimiter
+	wsOptions        WSOptions
+	sockets          *ConnRegistry
+	handlerTimeout   time.Duration
+	handlerGrace     time.Duration
+	abandoned        uint64
+	doubles          *doubleResponses
+	dependencies     *dependencies
+	devMode          bool
+	devCaptures      *devCaptures
+	headerChecks     HeaderChecks
+
+	consistencyCookie  *consistencyCookie
+	stateSealer        *StateSealer
+	latencies          *RouteLatencies
+	degradation        *Degradation
+	explainRoutes      bool
+	migration          *Migration
+	outboundCalls      *OutboundCalls
+	chaosAllowed       bool
+	correlationHeaders CorrelationHeaders
+	retirements        *Retirements
+	cache              *Cache
+	invalidation       *cacheInvalidation
+	cors               *routerCORS
+	closing            <-chan struct{}
+	snapshot           func() RouteSnapshot // Snapshot, bound once so that requests don't allocate it
+	deadlines          *DeadlinePropagation
+	finalizeOnce       sync.Once // ensure that the root only gets mounted once
 
 	log *vlog.Logger
 }
 
-type defaultScope struct {
-	RequestID string `json:"request_id"`
+// RouteInfo describes a route mounted on a Router
+type RouteInfo struct {
+	Method string    `json:"method"`
+	Path   string    `json:"path"`
+	Chain  []string  `json:"chain"`            // the layers a request passes through, outermost first
+	Ops    bool      `json:"ops,omitempty"`    // the route is an operational endpoint, see OpsGroup
+	Body   *BodySpec `json:"body,omitempty"`   // the body the route accepts, if it declares one with Body
+	Domain string    `json:"domain,omitempty"` // the route's isolation domain, if it isn't DefaultDomain
+
+	Retirement *RouteRetirement `json:"retirement,omitempty"` // when the route retires, if it is registered with Retire
 }
 
-// NewRouter creates a new Router
+// NewRouter creates a new Router. If logger is nil, a no-op logger is used
 func NewRouter(logger *vlog.Logger, fallback string) *Router {
-	var proxy *httputil.ReverseProxy
+	if logger == nil {
+		logger = vlog.Noop()
+	}
+
+	var fallbackProxy *proxy
 
 	if fallback != "" {
 		proxyURL, _ := url.Parse(fallback)
 		if proxyURL != nil {
-			proxy = httputil.NewSingleHostReverseProxy(proxyURL)
+			fallbackProxy = newProxy(logger, proxyURL)
 		}
 	}
 
 	r := &Router{
-		RouteGroup:    Group(""),
-		hrouter:       httprouter.New(),
-		fallbackProxy: proxy,
-		quietRoutes:   map[string]bool{},
-		finalizeOnce:  sync.Once{},
-		log:           logger,
+		RouteGroup:     Group(""),
+		hrouter:        httprouter.New(),
+		fallbackProxy:  fallbackProxy,
+		quietRoutes:    map[string]bool{},
+		livenessRoutes: map[string]bool{},
+		state:          newRouteState(),
+		panics:         newPanics(),
+		doubles:        newDoubleResponses(),
+		sockets:        NewConnRegistry(),
+		slowCleanup:    defaultSlowCleanupThreshold,
+		handlerGrace:   defaultHandlerGrace,
+		finalizeOnce:   sync.Once{},
+		log:            logger,
 	}
 
+	r.domains = newIsolationDomains(r.panics)
+	r.snapshot = r.Snapshot
+
+	// OPTIONS and 405 responses are computed by vk rather than httprouter
+	// so that they reflect the current state of groups and flags
+	r.hrouter.HandleOPTIONS = false
+	r.hrouter.HandleMethodNotAllowed = false
+	r.hrouter.NotFound = http.HandlerFunc(r.serveUnmatched)
+
+	r.PropagateToContext(RequestIDKey, propagateRequestID)
+
 	return r
 }
 
-// HandleHTTP handles a classic Go HTTP handlerFunc
+// HandleHTTP handles a classic Go HTTP handlerFunc like any other route: it gets a Ctx and request ID, which are
+// available from its request's context (see WrapStdHandlerWithCtx), it runs behind the router's middleware, and
+// its panics are recovered. See HandleHTTPRaw to serve a handler without any of that
 func (rt *Router) HandleHTTP(method, path string, handler http.HandlerFunc) {
-	rt.hrouter.Handle(method, path, func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	route := httpRouteHandler{Method: method, Path: path, Handler: WrapStdHandlerWithCtx(handler)}
+
+	// the router's middleware are resolved on the first request, as they would be for routes mounted by Finalize
+	var once sync.Once
+	var wrapped HandlerFunc
+
+	inner := func(w http.ResponseWriter, r *http.Request, ctx *Ctx) error {
+		once.Do(func() {
+			wrapped = WrapHandler(route.Handler, rt.RouteGroup.middleware...)
+		})
+
+		return wrapped(w, r, ctx)
+	}
+
+	rt.hrouter.Handle(method, path, rt.addEntry(route, rt.httpHandlerWrap(path, rt.RouteGroup.errorFormatter, withDomain(rt.domains.get(rt.RouteGroup.domain), inner))))
+}
+
+// HandleHTTPRaw handles a classic Go HTTP handlerFunc directly, with no Ctx, middleware, or panic recovery
+func (rt *Router) HandleHTTPRaw(method, path string, handler http.HandlerFunc) {
+	route := httpRouteHandler{Method: method, Path: path}
+
+	rt.hrouter.Handle(method, path, rt.addEntry(route, func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 		handler(w, r)
-	})
+	}))
 }
 
 // Finalize mounts the root group to prepare the Router to handle requests
 func (rt *Router) Finalize() {
 	rt.finalizeOnce.Do(func() {
+		if err := rt.Validate(); err != nil {
+			rt.log.Error(errors.Wrap(err, "failed to Validate, no routes were mounted"))
+			return
+		}
+
 		rt.mountGroup(rt.RouteGroup)
+
+		if rt.fallbackProxy != nil {
+			rt.fallbackProxy.claimHeaders = claimHeadersOf(rt.RouteGroup.httpRouteHandlers())
+		}
 	})
 }
 
+// Routes returns metadata for each of the routes handled by the Router's groups
+func (rt *Router) Routes() []RouteInfo {
+	handlers := rt.RouteGroup.httpRouteHandlers()
+
+	routes := make([]RouteInfo, len(handlers))
+	for i, r := range handlers {
+		handler := r.wrapped()
+		if rt.fastRouteFor(r) != nil {
+			// fast-path routes skip their error handling
+			handler = r.Handler
+		}
+		body, _ := bodySpecOf(handler)
+
+		routes[i] = RouteInfo{
+			Method: r.Method,
+			Path:   r.Path,
+			Chain:  TraceChain(handler),
+			Ops:    r.inGroup(func(g *RouteGroup) bool { return g.ops }),
+			Body:   body,
+			Domain: snapshotDomain(r),
+
+			Retirement: retirementOf(handler),
+		}
+	}
+
+	return routes
+}
+
 // ServeHTTP serves HTTP requests
 func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !rt.checkHeaders(w, r) {
+		return
+	}
+
 	// check to see if the router has a handler for this path
 	handler, params, _ := rt.hrouter.Lookup(r.Method, r.URL.Path)
 
 	if handler != nil {
 		handler(w, r, params)
 	} else {
+		if rt.serveDevReplay(w, r) {
+			return
+		}
+
+		if rt.servePreflight(w, r) {
+			return
+		}
+
+		if rt.serveLegacy(w, r) {
+			return
+		}
+
 		if rt.fallbackProxy != nil {
 			rt.fallbackProxy.ServeHTTP(w, r)
 			return
@@ -104,9 +256,33 @@ func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 // mountGroup adds a group of handlers to the httprouter
 func (rt *Router) mountGroup(group *RouteGroup) {
-	for _, r := range group.httpRouteHandlers() {
+	routes := group.httpRouteHandlers()
+
+	if rt.explainRoutes {
+		rt.logExplained(routes)
+	}
+
+	entries := make([]routeEntry, len(rt.state.entries), len(rt.state.entries)+len(routes))
+	copy(entries, rt.state.entries)
+	rt.state.entries = entries
+
+	for _, r := range routes {
 		rt.log.Debug("mounting route", r.Method, r.Path)
-		rt.hrouter.Handle(r.Method, r.Path, rt.httpHandlerWrap(r.Handler))
+
+		if r.inGroup(func(g *RouteGroup) bool { return g.quiet }) {
+			rt.quietRoutes[r.Path] = true
+		}
+
+		if isLiveness(r.Handler) {
+			rt.livenessRoutes[r.Method+" "+r.Path] = true
+		}
+
+		if fast := rt.fastRouteFor(r); fast != nil {
+			rt.hrouter.Handle(r.Method, r.Path, rt.addEntry(r, rt.fastHandle(r.Path, fast)))
+			continue
+		}
+
+		rt.hrouter.Handle(r.Method, r.Path, rt.addEntry(r, rt.splitCutover(r, rt.httpHandlerWrap(r.Path, rt.errorFormatter(r), withDomain(rt.domains.get(routeDomain(r)), withResponseEncoder(responseEncoder(r), r.lazy()))))))
 	}
 }
 
@@ -121,23 +297,145 @@ func (rt *Router) mountGroup(group *RouteGroup) {
 // the error can be:
 // - a vk.Error type (status and message are written to w)
 // - any other error object (status 500 and error.Error() are written to w)
-//
-func (rt *Router) httpHandlerWrap(inner HandlerFunc) httprouter.Handle {
+func (rt *Router) httpHandlerWrap(route string, formatter ErrorFormatter, inner HandlerFunc) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 		// create a context handleWrap the configured logger
 		// (and use the ctx.Log for all remaining logging
 		// in case a scope was set on it)
 		ctx := NewCtx(rt.log, params, w.Header())
-		ctx.UseScope(defaultScope{ctx.RequestID()})
-
-		// There is (should be) an error handling middleware there which should not return an error itself. If there IS
-		// an error here, something went very wrong, and it's a stop the world event.
-		err := inner(w, r, ctx)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			_, _ = w.Write([]byte(http.StatusText(http.StatusInternalServerError)))
+		ctx.Context = r.Context()
+		r = rt.propagateToContext(r, ctx)
+		if rt.devMode {
+			r = rt.useDevCapture(r, ctx)
+		}
+		ctx.useRequest(r)
+		ctx.route = route
+		ctx.trustProxy = rt.trustProxy
+		ctx.errorFormatter = formatter
+		ctx.notifier = rt.notifier
+		ctx.cleanupCounter = &rt.cleanups
+		ctx.webSockets = rt.webSockets
+		ctx.wsOptions = rt.wsOptions
+		ctx.sockets = rt.sockets
+		ctx.dependencies = rt.dependencies
+		ctx.devMode = rt.devMode
+		ctx.outboundCalls = rt.outboundCalls
+		ctx.chaosAllowed = rt.chaosAllowed
+		ctx.retirements = rt.retirements
+		ctx.cache = rt.cache
+		ctx.invalidation = rt.invalidation
+		ctx.bindMaxBytes = rt.bindMaxBytes
+		if rt.cors != nil {
+			rt.cors.allowOrigin(ctx.RespHeaders, r)
+		}
+		ctx.closing = rt.closing
+		ctx.snapshot = rt.snapshot
+		ctx.deadlines = rt.deadlines
+		if rt.devMode {
+			ctx.Context = context.WithValue(ctx.Context, devModeKey{}, ctx)
+		}
+		ctx.consistencyCookie = rt.consistencyCookie
+		ctx.consistencyToken = consistencyTokenFrom(r, rt.consistencyCookie)
+		ctx.stateSealer = rt.stateSealer
+		ctx.useCorrelation(r, rt.correlationHeaders)
+		rt.withMeta(ctx)
+		if rt.redaction != nil {
+			ctx.useRedaction(rt.redaction)
+		}
+
+		if budget, ok := rt.deadlines.inbound(r); ok {
+			var done func()
+			r, done = ctx.useDeadlineBudget(r, budget)
+			ctx.useRequest(r)
+
+			defer done()
+		}
+
+		entry := rt.inFlight.add(route, r, ctx)
+
+		if rt.latencies != nil {
+			start := time.Now()
+			defer rt.latencies.observeRequest(r.Method, route, start, w, ctx)
+		}
+
+		if rt.handlerTimeout > 0 && !ctx.IsWebSocketUpgrade() {
+			rt.serveWithDeadline(route, w, r, ctx, entry, inner)
 			return
 		}
+
+		defer entry.done()
+
+		rt.serve(w, r, ctx, inner)
+	}
+}
+
+// serve calls inner to handle the request, with the router's response writers, panic recovery, and cleanups
+func (rt *Router) serve(w http.ResponseWriter, r *http.Request, ctx *Ctx, inner HandlerFunc) {
+	// deferred first so that they run after a panic's response has been written
+	defer ctx.releaseBuffer()
+	defer rt.runCleanups(ctx)
+
+	// outermost, so that afterware sees the responses written for errors and panics. serveWithDeadline creates it
+	// beforehand, to record the 504 of a handler that times out
+	sw := ctx.summary
+	if sw == nil {
+		sw = &summaryWriter{ResponseWriter: w}
+		ctx.summary = sw
+	}
+
+	w = sw
+
+	logDone := rt.logRequest(r, ctx)
+	defer func() { logDone(sw.responseStatus()) }()
+
+	defer rt.runAfterware(r, ctx)
+
+	if rt.degradation != nil {
+		defer rt.degradation.observeRequest(rt.degradation.begin(), w, ctx)
+	}
+
+	defer rt.recoverPanic(w, ctx)
+
+	vw := &varyWriter{ResponseWriter: w, ctx: ctx}
+	defer vw.finish()
+
+	w = vw
+
+	if rt.maxResponseBytes > 0 {
+		lw := limitResponse(w, r, ctx, rt.maxResponseBytes)
+		defer lw.finish()
+
+		w = lw
+	}
+
+	var rw *respondedWriter
+	if rt.strictResponses {
+		rw = &respondedWriter{ResponseWriter: w}
+		w = rw
+	}
+
+	// innermost, so that it sees every response attempted by the handler and its middleware
+	guard := &responseGuard{ResponseWriter: w, rt: rt, r: r, ctx: ctx}
+	ctx.guard = guard
+	w = guard
+
+	// There is (should be) an error handling middleware there which should not return an error itself. If there IS
+	// an error here, something went very wrong, and it's a stop the world event.
+	err := inner(w, r, ctx)
+	if err != nil {
+		ctx.domain.failed(ctx, r, err)
+
+		// the committed response is final
+		if ctx.commitAttempted() {
+			return
+		}
+
+		respondError(w, r, ctx.errorFormatter, E(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError)))
+		return
+	}
+
+	if rw != nil {
+		rw.checkResponded(r, ctx)
 	}
 }
 
@@ -145,7 +443,21 @@ func (rt *Router) httpHandlerWrap(inner HandlerFunc) httprouter.Handle {
 // handle the method and path provided or not
 func (rt *Router) canHandle(method, path string) bool {
 	handler, _, _ := rt.hrouter.Lookup(method, path)
-	return handler != nil
+	if handler == nil {
+		return false
+	}
+
+	if method == http.MethodOptions {
+		return true
+	}
+
+	for _, m := range rt.allowedMethods(path) {
+		if m == method {
+			return true
+		}
+	}
+
+	return false
 }
 
 // useQuietRoutes sets the 'quiet' routes for the router's logging
@@ -160,15 +472,28 @@ func (rt *Router) useQuietRoutes(routes []string) {
 func (rt *Router) logRequest(r *http.Request, ctx *Ctx) func(int) {
 	start := time.Now()
 
+	// the routes of quiet groups are recorded by their pattern, those of UseQuietRoutes may be either
 	logFn := ctx.Log.Info
-	if _, beQuiet := rt.quietRoutes[r.URL.Path]; beQuiet {
+	if rt.quiet || rt.quietRoutes[r.URL.Path] || rt.quietRoutes[ctx.route] {
 		logFn = ctx.Log.Debug
 	}
 
 	logFn(r.Method, r.URL.String())
 
 	logDone := func(status int) {
-		logFn(r.Method, r.URL.String(), fmt.Sprintf("completed (%d: %s) in %dms", status, http.StatusText(status), time.Since(start).Milliseconds()))
+		// a response without a body or an explicit status is sent as a 200
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		completed := fmt.Sprintf("completed (%d: %s) in %dms", status, http.StatusText(status), time.Since(start).Milliseconds())
+
+		if details := tlsLogDetails(ctx); details != "" {
+			logFn(r.Method, r.URL.String(), completed, details)
+			return
+		}
+
+		logFn(r.Method, r.URL.String(), completed)
 	}
 
 	return logDone
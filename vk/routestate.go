@@ -0,0 +1,381 @@
+package vk
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// maxAllowCacheSize bounds the number of paths whose Allow value is cached
+const maxAllowCacheSize = 1024
+
+// routeEntry is a mounted route along with everything needed to determine if it is enabled
+type routeEntry struct {
+	method   string
+	segments []string
+	groups   []*RouteGroup
+	cors     *entryCORS
+}
+
+// entryCORS finds the options of the CORSMiddleware wrapping a route, when the first preflight request for it arrives
+type entryCORS struct {
+	once  sync.Once
+	route httpRouteHandler
+	opts  *CORSOptions
+}
+
+// routeState tracks the mounted routes and feature flags for a Router
+type routeState struct {
+	entries []routeEntry
+
+	flags     map[string]bool
+	flagsLock sync.RWMutex
+
+	// version is incremented whenever one of the router's groups is enabled/disabled or a flag is changed,
+	// invalidating any computed Allow values
+	version uint64
+
+	allowCache   map[string][]string
+	allowVersion uint64
+	allowLock    sync.RWMutex
+}
+
+func newRouteState() *routeState {
+	rs := &routeState{
+		entries:    []routeEntry{},
+		flags:      map[string]bool{},
+		allowCache: map[string][]string{},
+	}
+
+	return rs
+}
+
+// bump invalidates the computed Allow values
+func (rs *routeState) bump() {
+	atomic.AddUint64(&rs.version, 1)
+}
+
+// Disable disables every route in the group (including subgroups), causing them to be handled as if
+// they were not mounted at all. Disabled routes are omitted from automatic OPTIONS and 405 responses
+func (g *RouteGroup) Disable() {
+	atomic.StoreInt32(&g.disabled, 1)
+	g.bumpStates()
+}
+
+// Enable re-enables a group that was disabled
+func (g *RouteGroup) Enable() {
+	atomic.StoreInt32(&g.disabled, 0)
+	g.bumpStates()
+}
+
+// mountedOn records that the group has routes on the router with state rs, for Disable and Enable to bump it
+func (g *RouteGroup) mountedOn(rs *routeState) {
+	g.statesLock.Lock()
+	defer g.statesLock.Unlock()
+
+	for _, s := range g.states {
+		if s == rs {
+			return
+		}
+	}
+
+	g.states = append(g.states, rs)
+}
+
+// bumpStates invalidates the computed Allow values of the routers the group is mounted on
+func (g *RouteGroup) bumpStates() {
+	g.statesLock.Lock()
+	defer g.statesLock.Unlock()
+
+	for _, s := range g.states {
+		s.bump()
+	}
+}
+
+// Enabled returns true if the group has not been disabled
+func (g *RouteGroup) Enabled() bool {
+	return atomic.LoadInt32(&g.disabled) == 0
+}
+
+// WithFlag gates every route in the group behind a feature flag, which must be
+// turned on using SetFlag for the routes to be handled. Flags are off by default
+func (g *RouteGroup) WithFlag(name string) *RouteGroup {
+	g.flags = append(g.flags, name)
+
+	return g
+}
+
+// SetFlag turns a feature flag on or off, enabling or disabling any groups that were gated with WithFlag
+func (rt *Router) SetFlag(name string, on bool) {
+	rt.state.flagsLock.Lock()
+	rt.state.flags[name] = on
+	rt.state.flagsLock.Unlock()
+
+	rt.state.bump()
+}
+
+// Flag returns the current value of a feature flag
+func (rt *Router) Flag(name string) bool {
+	rt.state.flagsLock.RLock()
+	defer rt.state.flagsLock.RUnlock()
+
+	return rt.state.flags[name]
+}
+
+// addEntry records a mounted route and returns a Handle that serves it only while it is enabled
+func (rt *Router) addEntry(r httpRouteHandler, handle httprouter.Handle) httprouter.Handle {
+	entry := routeEntry{
+		method:   r.Method,
+		segments: splitPath(r.Path),
+		groups:   r.groups,
+		cors:     &entryCORS{route: r},
+	}
+
+	rt.state.entries = append(rt.state.entries, entry)
+
+	for _, g := range r.groups {
+		g.mountedOn(rt.state)
+	}
+
+	return func(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		if !rt.entryEnabled(entry) {
+			rt.serveUnrouted(w, req)
+			return
+		}
+
+		handle(w, req, params)
+	}
+}
+
+// entryEnabled returns true if all of the entry's groups are enabled and all of their flags are on
+func (rt *Router) entryEnabled(entry routeEntry) bool {
+	for _, g := range entry.groups {
+		if !g.Enabled() {
+			return false
+		}
+
+		for _, f := range g.flags {
+			if !rt.Flag(f) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// serveUnrouted handles requests that did not match an enabled route
+func (rt *Router) serveUnrouted(w http.ResponseWriter, r *http.Request) {
+	if rt.servePreflight(w, r) {
+		return
+	}
+
+	if rt.serveLegacy(w, r) {
+		return
+	}
+
+	if rt.fallbackProxy != nil {
+		rt.fallbackProxy.ServeHTTP(w, r)
+		return
+	}
+
+	rt.serveUnmatched(w, r)
+}
+
+// serveUnmatched responds to OPTIONS requests with the allowed methods for the path (or for the
+// whole server with `OPTIONS *`), to requests with the wrong method with 405, and otherwise 404
+func (rt *Router) serveUnmatched(w http.ResponseWriter, r *http.Request) {
+	formatter := rt.unmatchedFormatter(r.URL.Path)
+
+	if allow := rt.allowed(r.URL.Path, r.Method); allow != "" {
+		w.Header().Set("Allow", allow)
+
+		if r.Method == http.MethodOptions {
+			rt.answerOptions(w, r)
+		} else if formatter != nil {
+			formatter(w, r, E(http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed)))
+		} else {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		}
+
+		return
+	}
+
+	if formatter != nil {
+		formatter(w, r, E(http.StatusNotFound, http.StatusText(http.StatusNotFound)))
+		return
+	}
+
+	http.NotFound(w, r)
+}
+
+// answerOptions answers an OPTIONS request for a path that has routes for other methods. A preflight request is
+// answered with a 204 allowing its origin if the route for its method is wrapped by CORSMiddleware
+func (rt *Router) answerOptions(w http.ResponseWriter, r *http.Request) {
+	if opts := rt.preflightCORS(r); opts != nil {
+		w.Header().Add("Vary", "Origin")
+
+		if opts.allowOrigin(w.Header(), r) {
+			opts.allowPreflight(w.Header(), r)
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// preflightCORS returns the options of the CORSMiddleware wrapping the enabled route for the method requested by a
+// preflight request, or nil if r isn't one or the route isn't wrapped
+func (rt *Router) preflightCORS(r *http.Request) *CORSOptions {
+	method := r.Header.Get("Access-Control-Request-Method")
+	if method == "" || r.Header.Get("Origin") == "" {
+		return nil
+	}
+
+	segments := splitPath(r.URL.Path)
+
+	for _, e := range rt.state.entries {
+		if e.method == method && matchSegments(e.segments, segments) && rt.entryEnabled(e) {
+			return e.cors.options()
+		}
+	}
+
+	return nil
+}
+
+// options returns the options of the CORSMiddleware in the route's chain, building the chain the first time
+func (c *entryCORS) options() *CORSOptions {
+	c.once.Do(func() {
+		// a middleware that panics while it is built does so again for the route's first request, where it's recovered
+		defer func() {
+			_ = recover()
+		}()
+
+		for _, v := range chainValues(c.route.wrapped()) {
+			if opts, ok := v.(CORSOptions); ok {
+				c.opts = &opts
+				return
+			}
+		}
+	})
+
+	return c.opts
+}
+
+// allowed computes the value of the Allow header for path, excluding reqMethod (which
+// is known not to be handled) and including OPTIONS if any other method is allowed
+func (rt *Router) allowed(path, reqMethod string) string {
+	methods := rt.allowedMethods(path)
+
+	allowed := make([]string, 0, len(methods)+1)
+	for _, m := range methods {
+		if m != reqMethod || path == "*" {
+			allowed = append(allowed, m)
+		}
+	}
+
+	if len(allowed) == 0 {
+		return ""
+	}
+
+	allowed = append(allowed, http.MethodOptions)
+	sort.Strings(allowed)
+
+	return strings.Join(allowed, ", ")
+}
+
+// allowedMethods returns the sorted methods that have an enabled route matching path,
+// caching the result until the route state changes
+func (rt *Router) allowedMethods(path string) []string {
+	version := atomic.LoadUint64(&rt.state.version)
+
+	rt.state.allowLock.RLock()
+	methods, ok := rt.state.allowCache[path]
+	current := rt.state.allowVersion == version
+	rt.state.allowLock.RUnlock()
+
+	if ok && current {
+		return methods
+	}
+
+	methods = rt.computeAllowedMethods(path)
+
+	rt.state.allowLock.Lock()
+	defer rt.state.allowLock.Unlock()
+
+	if rt.state.allowVersion != version || len(rt.state.allowCache) >= maxAllowCacheSize {
+		rt.state.allowCache = map[string][]string{}
+		rt.state.allowVersion = version
+	}
+
+	rt.state.allowCache[path] = methods
+
+	return methods
+}
+
+func (rt *Router) computeAllowedMethods(path string) []string {
+	seen := map[string]bool{}
+	segments := splitPath(path)
+
+	for _, e := range rt.state.entries {
+		if e.method == http.MethodOptions || seen[e.method] {
+			continue
+		}
+
+		if path != "*" && !matchSegments(e.segments, segments) {
+			continue
+		}
+
+		if rt.entryEnabled(e) {
+			seen[e.method] = true
+		}
+	}
+
+	methods := make([]string, 0, len(seen))
+	for m := range seen {
+		methods = append(methods, m)
+	}
+
+	sort.Strings(methods)
+
+	return methods
+}
+
+func splitPath(path string) []string {
+	return strings.Split(strings.Trim(path, "/"), "/")
+}
+
+// matchSegments matches a request path against a route pattern using httprouter's
+// semantics, where :name matches a single segment and *name matches the remainder
+func matchSegments(pattern, path []string) bool {
+	for i, p := range pattern {
+		if strings.HasPrefix(p, "*") {
+			return true
+		}
+
+		if i >= len(path) {
+			return false
+		}
+
+		if strings.HasPrefix(p, ":") {
+			if path[i] == "" {
+				return false
+			}
+
+			continue
+		}
+
+		if p != path[i] {
+			return false
+		}
+	}
+
+	return len(pattern) == len(path)
+}
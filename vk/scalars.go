@@ -0,0 +1,843 @@
+package vk
+
+import (
+	"bytes"
+	"context"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// TimeLayoutRFC3339Milli is RFC 3339 with exactly three fractional digits, as used by EncodeTimeRFC3339Milli
+const TimeLayoutRFC3339Milli = "2006-01-02T15:04:05.000Z07:00"
+
+// ScalarEncoder converts a value of a registered type to the value that is encoded in its place, such as a string
+type ScalarEncoder func(value interface{}) (interface{}, error)
+
+// ScalarDecoder converts the JSON of a registered type to a value of that type
+type ScalarDecoder func(data []byte) (interface{}, error)
+
+type scalar struct {
+	encode ScalarEncoder
+	decode ScalarDecoder
+}
+
+var (
+	scalarLock  sync.RWMutex
+	scalarTypes = map[reflect.Type]scalar{}
+	jsonPlans   = map[reflect.Type]*jsonPlan{}
+
+	timeType          = reflect.TypeOf(time.Time{})
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	jsonUnmarshalType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// RegisterScalar changes how values of type t are encoded by EncodeJSON (and so RespondJSON and NDJSON) and decoded
+// by DecodeJSON (and ReadJSON), wherever they appear: as a response itself, or in struct fields, slices, maps and
+// pointers, without the type needing MarshalJSON. Either function can be nil to leave that direction unchanged.
+// Scalars are usually registered once at startup, i.e. vk.RegisterScalar(reflect.TypeOf(time.Time{}),
+// vk.EncodeTimeRFC3339Milli, vk.DecodeTimeRFC3339)
+func RegisterScalar(t reflect.Type, encode ScalarEncoder, decode ScalarDecoder) {
+	scalarLock.Lock()
+	defer scalarLock.Unlock()
+
+	scalarTypes[t] = scalar{encode: encode, decode: decode}
+	jsonPlans = map[reflect.Type]*jsonPlan{}
+}
+
+// UnregisterScalar restores the default encoding of t
+func UnregisterScalar(t reflect.Type) {
+	scalarLock.Lock()
+	defer scalarLock.Unlock()
+
+	delete(scalarTypes, t)
+	jsonPlans = map[reflect.Type]*jsonPlan{}
+}
+
+// EncodeTimeRFC3339Milli encodes a time.Time in UTC with millisecond precision, i.e. "2022-06-01T12:30:00.000Z"
+func EncodeTimeRFC3339Milli(value interface{}) (interface{}, error) {
+	t, ok := value.(time.Time)
+	if !ok {
+		return nil, fmt.Errorf("expected time.Time, got %T", value)
+	}
+
+	return t.UTC().Format(TimeLayoutRFC3339Milli), nil
+}
+
+// DecodeTimeRFC3339 decodes a time.Time from an RFC 3339 string with any precision, converted to UTC
+func DecodeTimeRFC3339(data []byte) (interface{}, error) {
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return nil, errors.Wrap(err, "timestamps must be RFC 3339 strings")
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, str)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.UTC(), nil
+}
+
+// EncodeJSON encodes v like json.Marshal, but with the scalars registered with RegisterScalar. Values whose types
+// can't contain a scalar are handed to json.Marshal as they are
+func EncodeJSON(v interface{}) ([]byte, error) {
+	if v == nil {
+		return []byte("null"), nil
+	}
+
+	plan := planFor(reflect.TypeOf(v))
+	if plan.kind == planPlain {
+		return json.Marshal(v)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := plan.encode(buf, reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// encodeJSON encodes v into buf like EncodeJSON
+func encodeJSON(buf *bytes.Buffer, v interface{}) error {
+	if v == nil {
+		buf.WriteString("null")
+		return nil
+	}
+
+	plan := planFor(reflect.TypeOf(v))
+	if plan.kind == planPlain {
+		return encodeJSONTo(buf, v)
+	}
+
+	return plan.encode(buf, reflect.ValueOf(v))
+}
+
+// DecodeJSON decodes data into v like json.Unmarshal, but with the scalars registered with RegisterScalar
+func DecodeJSON(data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return json.Unmarshal(data, v)
+	}
+
+	plan := planFor(rv.Elem().Type())
+	if plan.kind == planPlain {
+		return json.Unmarshal(data, v)
+	}
+
+	if !json.Valid(data) {
+		// let json report the syntax error
+		return json.Unmarshal(data, v)
+	}
+
+	return plan.decode(data, rv.Elem())
+}
+
+// ReadJSON decodes the request's body into v with DecodeJSON, returning a vk.Error (400, or 413 if the body is larger
+// than BodyLimitMiddleware allows) that handlers can return as it is
+func ReadJSON(r *http.Request, v interface{}) error {
+	if r.Body == nil {
+		return E(http.StatusBadRequest, "request body is empty")
+	}
+
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return E(http.StatusRequestEntityTooLarge, http.StatusText(http.StatusRequestEntityTooLarge))
+		}
+
+		return E(http.StatusBadRequest, "failed to read request body")
+	}
+
+	if err := DecodeJSON(data, v); err != nil {
+		return E(http.StatusBadRequest, "invalid JSON: "+err.Error())
+	}
+
+	return nil
+}
+
+// encodeResponseJSON encodes a response into buf like EncodeJSON, redacting it for the caller if the request has a
+// redaction (see RedactionOptions) and selecting the requested fields of successful responses (see
+// AllowFieldSelection), and warning once per type in dev mode about time.Time fields that are encoded without a
+// registered scalar
+func encodeResponseJSON(ctx context.Context, buf *bytes.Buffer, v interface{}, statusCode int) error {
+	if c, ok := ctx.Value(devModeKey{}).(*Ctx); ok && v != nil {
+		if plan := planFor(reflect.TypeOf(v)); plan.naiveTime && atomic.CompareAndSwapUint32(&plan.warned, 0, 1) {
+			c.Log.Warn(fmt.Sprintf("[vk] %s contains time.Time, which is encoded without a registered scalar, see vk.RegisterScalar", reflect.TypeOf(v)))
+		}
+	}
+
+	state := redactionFrom(ctx)
+
+	if sel := fieldSelectionFrom(ctx); sel != nil && statusCode >= 200 && statusCode < 300 {
+		if state == nil {
+			state = &redaction{bypass: true}
+		}
+
+		return selectJSON(buf, v, state, sel)
+	}
+
+	if state != nil && !state.bypass {
+		return redactJSON(buf, v, state, nil)
+	}
+
+	return encodeJSON(buf, v)
+}
+
+// devModeKey is the context key of the Ctx of requests handled in dev mode
+type devModeKey struct{}
+
+type planKind int
+
+const (
+	planPlain planKind = iota // can't contain a scalar, so json handles it
+	planScalar
+	planStruct
+	planPointer
+	planSlice
+	planArray
+	planMap
+	planInterface // the plan depends on the value
+)
+
+// jsonPlan is how values of a type are encoded and decoded, worked out once per type
+type jsonPlan struct {
+	kind      planKind
+	typ       reflect.Type
+	scalar    scalar
+	elem      *jsonPlan   // of pointers, slices, arrays and maps
+	fields    []planField // of structs
+	naiveTime bool        // the type contains time.Time, which isn't a registered scalar
+	warned    uint32
+}
+
+// planField is a field of a struct, which may be promoted from an embedded struct
+type planField struct {
+	index     []int
+	name      string
+	key       []byte // the quoted name and a colon
+	omitEmpty bool
+	quoted    bool // the ,string option
+	plan      *jsonPlan
+}
+
+// planFor returns the plan for t, working it out if it isn't cached
+func planFor(t reflect.Type) *jsonPlan {
+	scalarLock.RLock()
+	plan, ok := jsonPlans[t]
+	scalarLock.RUnlock()
+
+	if ok {
+		return plan
+	}
+
+	scalarLock.Lock()
+	defer scalarLock.Unlock()
+
+	return buildPlan(t)
+}
+
+// buildPlan works out the plan for t, it must be called with scalarLock held
+func buildPlan(t reflect.Type) *jsonPlan {
+	if plan, ok := jsonPlans[t]; ok {
+		// possibly still being built, for recursive types
+		return plan
+	}
+
+	plan := &jsonPlan{typ: t}
+	jsonPlans[t] = plan
+
+	if s, ok := scalarTypes[t]; ok {
+		plan.kind = planScalar
+		plan.scalar = s
+
+		return plan
+	}
+
+	// types that handle their own encoding are left to them
+	if t.Implements(jsonMarshalerType) || reflect.PointerTo(t).Implements(jsonMarshalerType) ||
+		t.Implements(textMarshalerType) || reflect.PointerTo(t).Implements(textMarshalerType) ||
+		reflect.PointerTo(t).Implements(jsonUnmarshalType) {
+		plan.kind = planPlain
+		plan.naiveTime = t == timeType
+
+		return plan
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		plan.kind = planPointer
+		plan.elem = buildPlan(t.Elem())
+	case reflect.Slice:
+		plan.kind = planSlice
+		plan.elem = buildPlan(t.Elem())
+	case reflect.Array:
+		plan.kind = planArray
+		plan.elem = buildPlan(t.Elem())
+	case reflect.Map:
+		if !isPlannedMapKey(t.Key()) {
+			plan.kind = planPlain
+			return plan
+		}
+
+		plan.kind = planMap
+		plan.elem = buildPlan(t.Elem())
+	case reflect.Interface:
+		plan.kind = planInterface
+		return plan
+	case reflect.Struct:
+		plan.kind = planStruct
+		plan.fields = structFields(t)
+	default:
+		plan.kind = planPlain
+		return plan
+	}
+
+	// a type whose parts are all plain is plain too
+	plain := true
+
+	if plan.elem != nil {
+		plain = plan.elem.kind == planPlain
+		plan.naiveTime = plan.elem.naiveTime
+	}
+
+	for _, f := range plan.fields {
+		plain = plain && f.plan.kind == planPlain
+		plan.naiveTime = plan.naiveTime || f.plan.naiveTime
+	}
+
+	if plain {
+		plan.kind = planPlain
+	}
+
+	return plan
+}
+
+func isPlannedMapKey(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.String, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return !t.Implements(textMarshalerType)
+	}
+
+	return false
+}
+
+// structFields returns the fields of t that are encoded, following encoding/json's rules for names and embedding
+func structFields(t reflect.Type) []planField {
+	type candidate struct {
+		planField
+		depth  int
+		tagged bool
+	}
+
+	var candidates []candidate
+
+	var walk func(t reflect.Type, index []int, depth int)
+	walk = func(t reflect.Type, index []int, depth int) {
+		for i := 0; i < t.NumField(); i++ {
+			sf := t.Field(i)
+
+			tag := sf.Tag.Get("json")
+			if tag == "-" {
+				continue
+			}
+
+			name, opts, _ := strings.Cut(tag, ",")
+
+			fieldIndex := append(append([]int{}, index...), i)
+
+			ft := sf.Type
+			if sf.Anonymous && name == "" {
+				if ft.Kind() == reflect.Pointer {
+					ft = ft.Elem()
+				}
+
+				if ft.Kind() == reflect.Struct {
+					walk(ft, fieldIndex, depth+1)
+					continue
+				}
+			}
+
+			if !sf.IsExported() {
+				continue
+			}
+
+			tagged := name != ""
+			if !tagged {
+				name = sf.Name
+			}
+
+			key, _ := json.Marshal(name)
+
+			candidates = append(candidates, candidate{
+				planField: planField{
+					index:     fieldIndex,
+					name:      name,
+					key:       append(key, ':'),
+					omitEmpty: hasTagOption(opts, "omitempty"),
+					quoted:    hasTagOption(opts, "string") && isQuotable(sf.Type),
+					plan:      buildPlan(sf.Type),
+				},
+				depth:  depth,
+				tagged: tagged,
+			})
+		}
+	}
+
+	walk(t, nil, 0)
+
+	// the shallowest field of each name wins, preferring tagged fields, and a tie hides the name entirely
+	byName := map[string][]candidate{}
+	for _, c := range candidates {
+		byName[c.name] = append(byName[c.name], c)
+	}
+
+	fields := make([]planField, 0, len(candidates))
+
+	for _, c := range candidates {
+		dominant := c
+		tie := false
+
+		for _, other := range byName[c.name] {
+			if other.depth < dominant.depth || (other.depth == dominant.depth && other.tagged && !dominant.tagged) {
+				dominant, tie = other, false
+			} else if other.depth == dominant.depth && other.tagged == dominant.tagged && !sameIndex(other.index, dominant.index) {
+				tie = true
+			}
+		}
+
+		if !tie && sameIndex(dominant.index, c.index) {
+			fields = append(fields, c.planField)
+		}
+	}
+
+	return fields
+}
+
+func hasTagOption(opts, option string) bool {
+	for opts != "" {
+		var opt string
+		opt, opts, _ = strings.Cut(opts, ",")
+
+		if opt == option {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isQuotable returns true if the ,string option applies to t
+func isQuotable(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64, reflect.String:
+		return true
+	}
+
+	return false
+}
+
+func sameIndex(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (p *jsonPlan) encode(buf *bytes.Buffer, v reflect.Value) error {
+	switch p.kind {
+	case planScalar:
+		if p.scalar.encode == nil {
+			return encodePlain(buf, v)
+		}
+
+		out, err := p.scalar.encode(v.Interface())
+		if err != nil {
+			return errors.Wrapf(err, "failed to encode %s", p.typ)
+		}
+
+		data, err := json.Marshal(out)
+		if err != nil {
+			return err
+		}
+
+		buf.Write(data)
+	case planPointer:
+		if v.IsNil() {
+			buf.WriteString("null")
+			return nil
+		}
+
+		return p.elem.encode(buf, v.Elem())
+	case planInterface:
+		if v.IsNil() {
+			buf.WriteString("null")
+			return nil
+		}
+
+		return planFor(v.Elem().Type()).encode(buf, v.Elem())
+	case planSlice, planArray:
+		if p.kind == planSlice && v.IsNil() {
+			buf.WriteString("null")
+			return nil
+		}
+
+		buf.WriteByte('[')
+
+		for i := 0; i < v.Len(); i++ {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+
+			if err := p.elem.encode(buf, v.Index(i)); err != nil {
+				return err
+			}
+		}
+
+		buf.WriteByte(']')
+	case planMap:
+		return p.encodeMap(buf, v)
+	case planStruct:
+		return p.encodeStruct(buf, v)
+	default:
+		return encodePlain(buf, v)
+	}
+
+	return nil
+}
+
+func (p *jsonPlan) encodeMap(buf *bytes.Buffer, v reflect.Value) error {
+	if v.IsNil() {
+		buf.WriteString("null")
+		return nil
+	}
+
+	type entry struct {
+		key   string
+		value reflect.Value
+	}
+
+	entries := make([]entry, 0, v.Len())
+
+	iter := v.MapRange()
+	for iter.Next() {
+		k := iter.Key()
+
+		var key string
+
+		switch k.Kind() {
+		case reflect.String:
+			key = k.String()
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			key = strconv.FormatInt(k.Int(), 10)
+		default:
+			key = strconv.FormatUint(k.Uint(), 10)
+		}
+
+		entries = append(entries, entry{key: key, value: iter.Value()})
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+
+	buf.WriteByte('{')
+
+	for i, e := range entries {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+
+		key, _ := json.Marshal(e.key)
+		buf.Write(key)
+		buf.WriteByte(':')
+
+		if err := p.elem.encode(buf, e.value); err != nil {
+			return err
+		}
+	}
+
+	buf.WriteByte('}')
+
+	return nil
+}
+
+func (p *jsonPlan) encodeStruct(buf *bytes.Buffer, v reflect.Value) error {
+	buf.WriteByte('{')
+
+	first := true
+
+	for _, f := range p.fields {
+		fv, ok := fieldByIndex(v, f.index, false)
+		if !ok || (f.omitEmpty && isEmptyValue(fv)) {
+			continue
+		}
+
+		if !first {
+			buf.WriteByte(',')
+		}
+
+		first = false
+
+		buf.Write(f.key)
+
+		if f.quoted {
+			data, err := json.Marshal(fv.Interface())
+			if err != nil {
+				return err
+			}
+
+			quoted, _ := json.Marshal(string(data))
+			buf.Write(quoted)
+
+			continue
+		}
+
+		if err := f.plan.encode(buf, fv); err != nil {
+			return err
+		}
+	}
+
+	buf.WriteByte('}')
+
+	return nil
+}
+
+func encodePlain(buf *bytes.Buffer, v reflect.Value) error {
+	data, err := json.Marshal(v.Interface())
+	if err != nil {
+		return err
+	}
+
+	buf.Write(data)
+
+	return nil
+}
+
+func (p *jsonPlan) decode(data []byte, v reflect.Value) error {
+	null := bytes.Equal(bytes.TrimSpace(data), []byte("null"))
+
+	switch p.kind {
+	case planScalar:
+		if p.scalar.decode == nil {
+			return json.Unmarshal(data, v.Addr().Interface())
+		}
+
+		if null {
+			return nil
+		}
+
+		out, err := p.scalar.decode(data)
+		if err != nil {
+			return errors.Wrapf(err, "failed to decode %s", p.typ)
+		}
+
+		rv := reflect.ValueOf(out)
+		if !rv.IsValid() || !rv.Type().AssignableTo(p.typ) {
+			return fmt.Errorf("decoder for %s returned %T", p.typ, out)
+		}
+
+		v.Set(rv)
+	case planPointer:
+		if null {
+			v.Set(reflect.Zero(p.typ))
+			return nil
+		}
+
+		if v.IsNil() {
+			v.Set(reflect.New(p.typ.Elem()))
+		}
+
+		return p.elem.decode(data, v.Elem())
+	case planSlice, planArray:
+		if null {
+			if p.kind == planSlice {
+				v.Set(reflect.Zero(p.typ))
+			}
+
+			return nil
+		}
+
+		var raws []json.RawMessage
+		if err := json.Unmarshal(data, &raws); err != nil {
+			return err
+		}
+
+		if p.kind == planSlice {
+			v.Set(reflect.MakeSlice(p.typ, len(raws), len(raws)))
+		}
+
+		for i := 0; i < len(raws) && i < v.Len(); i++ {
+			if err := p.elem.decode(raws[i], v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case planMap:
+		return p.decodeMap(data, v, null)
+	case planStruct:
+		return p.decodeStruct(data, v, null)
+	default:
+		return json.Unmarshal(data, v.Addr().Interface())
+	}
+
+	return nil
+}
+
+func (p *jsonPlan) decodeMap(data []byte, v reflect.Value, null bool) error {
+	if null {
+		v.Set(reflect.Zero(p.typ))
+		return nil
+	}
+
+	var raws map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raws); err != nil {
+		return err
+	}
+
+	if v.IsNil() {
+		v.Set(reflect.MakeMapWithSize(p.typ, len(raws)))
+	}
+
+	keyType := p.typ.Key()
+
+	for k, raw := range raws {
+		key := reflect.New(keyType).Elem()
+
+		switch keyType.Kind() {
+		case reflect.String:
+			key.SetString(k)
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			n, err := strconv.ParseInt(k, 10, keyType.Bits())
+			if err != nil {
+				return errors.Wrapf(err, "invalid map key %q", k)
+			}
+
+			key.SetInt(n)
+		default:
+			n, err := strconv.ParseUint(k, 10, keyType.Bits())
+			if err != nil {
+				return errors.Wrapf(err, "invalid map key %q", k)
+			}
+
+			key.SetUint(n)
+		}
+
+		elem := reflect.New(p.typ.Elem()).Elem()
+		if err := p.elem.decode(raw, elem); err != nil {
+			return err
+		}
+
+		v.SetMapIndex(key, elem)
+	}
+
+	return nil
+}
+
+func (p *jsonPlan) decodeStruct(data []byte, v reflect.Value, null bool) error {
+	if null {
+		return nil
+	}
+
+	var raws map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raws); err != nil {
+		return err
+	}
+
+	for _, f := range p.fields {
+		raw, ok := raws[f.name]
+		if !ok {
+			// like json, names are matched case-insensitively if there is no exact match
+			for key, r := range raws {
+				if strings.EqualFold(key, f.name) {
+					raw, ok = r, true
+					break
+				}
+			}
+		}
+
+		if !ok {
+			continue
+		}
+
+		fv, _ := fieldByIndex(v, f.index, true)
+
+		if f.quoted {
+			var str string
+			if err := json.Unmarshal(raw, &str); err != nil {
+				return errors.Wrapf(err, "field %s", f.name)
+			}
+
+			raw = json.RawMessage(str)
+		}
+
+		if err := f.plan.decode(raw, fv); err != nil {
+			return errors.Wrapf(err, "field %s", f.name)
+		}
+	}
+
+	return nil
+}
+
+// fieldByIndex returns the (possibly promoted) field of v at index. Embedded pointers that are nil are allocated if
+// alloc is set, and otherwise the field is reported as missing
+func fieldByIndex(v reflect.Value, index []int, alloc bool) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				if !alloc {
+					return reflect.Value{}, false
+				}
+
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+
+			v = v.Elem()
+		}
+
+		v = v.Field(x)
+	}
+
+	return v, true
+}
+
+// isEmptyValue reports whether v is empty for the omitempty option, as json does
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Pointer:
+		return v.IsNil()
+	}
+
+	return false
+}
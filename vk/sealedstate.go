@@ -0,0 +1,287 @@
+package vk
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	// StateKeySize is the size of the keys that seal state, see StateSealingOptions
+	StateKeySize = chacha20poly1305.KeySize
+
+	defaultStateMaxBytes = 4096
+
+	// stateVersion is the first byte of every token, so that the format can change
+	stateVersion  = 1
+	stateKeyIDLen = 4
+
+	// a token is the version, the key's ID and the nonce, followed by the sealed issue time, TTL and value
+	stateHeaderLen = 1 + stateKeyIDLen + chacha20poly1305.NonceSizeX
+	stateTimesLen  = 16
+)
+
+// The codes of the errors of OpenState and SealState, see StateError
+const (
+	StateInvalid  = "STATE_INVALID"   // the token was tampered with, is malformed, or wasn't sealed with any of the keys
+	StateExpired  = "STATE_EXPIRED"   // the token's TTL has passed
+	StateTooLarge = "STATE_TOO_LARGE" // the token is longer than MaxBytes
+)
+
+// StateError is the error of a state token that couldn't be sealed or opened, with a code that clients can act
+// on. It is a vk.Error with a 400 status, so that a handler can return it as it is
+type StateError struct {
+	StatusCode  int    `json:"status"`
+	MessageText string `json:"message"`
+	ErrorCode   string `json:"code"`
+}
+
+var (
+	// ErrStateInvalid is returned by OpenState for a token that was tampered with or can't be opened by any key
+	ErrStateInvalid = &StateError{StatusCode: http.StatusBadRequest, MessageText: "invalid state", ErrorCode: StateInvalid}
+
+	// ErrStateExpired is returned by OpenState for a token whose TTL has passed
+	ErrStateExpired = &StateError{StatusCode: http.StatusBadRequest, MessageText: "expired state", ErrorCode: StateExpired}
+
+	// ErrStateTooLarge is returned by SealState and OpenState for a token longer than the options' MaxBytes
+	ErrStateTooLarge = &StateError{StatusCode: http.StatusBadRequest, MessageText: "state too large", ErrorCode: StateTooLarge}
+
+	// errStateUnavailable is returned for a Ctx whose router has no keys, see UseStateSealing
+	errStateUnavailable = errors.New("state sealing is not configured, see UseStateSealing")
+)
+
+func (e *StateError) Error() string {
+	return fmt.Sprintf("%d: %s (%s)", e.StatusCode, e.MessageText, e.ErrorCode)
+}
+
+// Status returns the error's status code
+func (e *StateError) Status() int {
+	return e.StatusCode
+}
+
+// Message returns the error's message
+func (e *StateError) Message() string {
+	return e.MessageText
+}
+
+// Code returns the error's code, i.e. STATE_EXPIRED
+func (e *StateError) Code() string {
+	return e.ErrorCode
+}
+
+// StateSealingOptions configures the sealing of the state that handlers round-trip through clients, see
+// UseStateSealing
+type StateSealingOptions struct {
+	// Keys are StateKeySize bytes long. The first seals new tokens, and every one of them opens tokens, so that a
+	// key can be rotated by adding a new one in front and removing the old one once its tokens have expired
+	Keys [][]byte
+
+	// MaxBytes is the longest token that is sealed or opened, 4KB by default
+	MaxBytes int
+
+	// Now can be replaced for testing, it timestamps the tokens and checks their expiry
+	Now func() time.Time
+}
+
+// problems returns the problems with the options
+func (s StateSealingOptions) problems() []string {
+	var problems []string
+
+	for i, key := range s.Keys {
+		if len(key) != StateKeySize {
+			problems = append(problems, fmt.Sprintf("StateSealing: key %d is %d bytes, expected %d", i, len(key), StateKeySize))
+		}
+	}
+
+	if s.MaxBytes < 0 {
+		problems = append(problems, "StateSealing: max bytes cannot be negative")
+	}
+
+	return problems
+}
+
+// stateKey is a key of a StateSealer, with the ID that tokens sealed with it carry
+type stateKey struct {
+	id   [stateKeyIDLen]byte
+	aead cipher.AEAD
+}
+
+// StateSealer seals values into URL-safe tokens with XChaCha20-Poly1305, so that a stateless flow can round-trip its
+// state through the client in a query parameter, form field or cookie, without the client being able to read or
+// alter it. Tokens carry the time they were issued and their TTL, and the ID of the key that sealed them
+type StateSealer struct {
+	opts StateSealingOptions
+	keys []stateKey
+}
+
+// NewStateSealer creates a StateSealer, returning an error if it has no keys or any key has the wrong size
+func NewStateSealer(opts StateSealingOptions) (*StateSealer, error) {
+	if len(opts.Keys) == 0 {
+		return nil, errors.New("state sealing requires at least one key")
+	}
+
+	if problems := opts.problems(); len(problems) > 0 {
+		return nil, OptionsError{Problems: problems}
+	}
+
+	if opts.MaxBytes == 0 {
+		opts.MaxBytes = defaultStateMaxBytes
+	}
+
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+
+	s := &StateSealer{opts: opts}
+
+	for _, key := range opts.Keys {
+		aead, err := chacha20poly1305.NewX(key)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create cipher")
+		}
+
+		k := stateKey{aead: aead}
+
+		sum := sha256.Sum256(key)
+		copy(k.id[:], sum[:])
+
+		s.keys = append(s.keys, k)
+	}
+
+	return s, nil
+}
+
+// Seal returns a token holding v as JSON, which Open accepts until ttl has passed
+func (s *StateSealer) Seal(v interface{}, ttl time.Duration) (string, error) {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to Marshal state")
+	}
+
+	key := s.keys[0]
+
+	// a token that can't fit is rejected before anything is encrypted
+	sealedLen := stateHeaderLen + stateTimesLen + len(value) + chacha20poly1305.Overhead
+	if base64.RawURLEncoding.EncodedLen(sealedLen) > s.opts.MaxBytes {
+		return "", ErrStateTooLarge
+	}
+
+	token := make([]byte, stateHeaderLen, sealedLen)
+	token[0] = stateVersion
+	copy(token[1:], key.id[:])
+
+	nonce := token[1+stateKeyIDLen : stateHeaderLen]
+	if _, err := rand.Read(nonce); err != nil {
+		return "", errors.Wrap(err, "failed to generate nonce")
+	}
+
+	plaintext := make([]byte, stateTimesLen, stateTimesLen+len(value))
+	binary.BigEndian.PutUint64(plaintext, uint64(s.opts.Now().UnixMilli()))
+	binary.BigEndian.PutUint64(plaintext[8:], uint64(ttl.Milliseconds()))
+	plaintext = append(plaintext, value...)
+
+	// the header is authenticated along with the value, so that a token's key ID can't be swapped
+	token = key.aead.Seal(token, nonce, plaintext, token[:1+stateKeyIDLen])
+
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+// Open unmarshals the value sealed in token into dest. It returns ErrStateTooLarge for a token longer than
+// MaxBytes, ErrStateInvalid for one that was altered or sealed with an unknown key, and ErrStateExpired for one
+// whose TTL has passed
+func (s *StateSealer) Open(token string, dest interface{}) error {
+	if len(token) > s.opts.MaxBytes {
+		return ErrStateTooLarge
+	}
+
+	sealed, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(sealed) < stateHeaderLen+stateTimesLen+chacha20poly1305.Overhead || sealed[0] != stateVersion {
+		return ErrStateInvalid
+	}
+
+	nonce := sealed[1+stateKeyIDLen : stateHeaderLen]
+
+	var plaintext []byte
+
+	opened := false
+
+	for _, key := range s.keys {
+		if !bytes.Equal(key.id[:], sealed[1:1+stateKeyIDLen]) {
+			continue
+		}
+
+		if plaintext, err = key.aead.Open(nil, nonce, sealed[stateHeaderLen:], sealed[:1+stateKeyIDLen]); err == nil {
+			opened = true
+			break
+		}
+	}
+
+	if !opened {
+		return ErrStateInvalid
+	}
+
+	issued := time.UnixMilli(int64(binary.BigEndian.Uint64(plaintext)))
+	ttl := time.Duration(binary.BigEndian.Uint64(plaintext[8:])) * time.Millisecond
+
+	if !s.opts.Now().Before(issued.Add(ttl)) {
+		return ErrStateExpired
+	}
+
+	if err := json.Unmarshal(plaintext[stateTimesLen:], dest); err != nil {
+		return errors.Wrap(err, "failed to Unmarshal state")
+	}
+
+	return nil
+}
+
+// SealState returns a URL-safe token holding v, sealed with the server's current key (see UseStateSealing), for a
+// multi-step flow to send to the client and get back in a later request, in a query parameter, form field or cookie.
+// The token can't be read or altered by the client, and is accepted by OpenState until ttl has passed. A token
+// longer than the MaxBytes option returns ErrStateTooLarge
+func (c *Ctx) SealState(v interface{}, ttl time.Duration) (string, error) {
+	if c == nil || c.stateSealer == nil {
+		return "", errStateUnavailable
+	}
+
+	return c.stateSealer.Seal(v, ttl)
+}
+
+// OpenState unmarshals the value sealed in a token returned by SealState into dest. The errors for a token that is
+// invalid (ErrStateInvalid), expired (ErrStateExpired) or too large (ErrStateTooLarge) are StateErrors with a 400
+// status, which a handler can return as they are
+func (c *Ctx) OpenState(token string, dest interface{}) error {
+	if c == nil || c.stateSealer == nil {
+		return errStateUnavailable
+	}
+
+	return c.stateSealer.Open(token, dest)
+}
+
+// useStateSealing sets the keys that seal the state of the router's requests, which can't be sealed without any
+func (rt *Router) useStateSealing(opts StateSealingOptions) {
+	if len(opts.Keys) == 0 {
+		rt.stateSealer = nil
+		return
+	}
+
+	sealer, err := NewStateSealer(opts)
+	if err != nil {
+		// Validate reports the options' problems
+		rt.log.Error(errors.Wrap(err, "state sealing is disabled"))
+		rt.stateSealer = nil
+
+		return
+	}
+
+	rt.stateSealer = sealer
+}
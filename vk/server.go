@@ -3,12 +3,13 @@ package vk
 import (
 	"context"
 	"crypto/tls"
-	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"sync"
 	"sync/atomic"
 
+	"github.com/pkg/errors"
 	"golang.org/x/crypto/acme/autocert"
 )
 
@@ -23,14 +24,102 @@ type Server struct {
 
 	server  *http.Server
 	options *Options
+
+	adminRouter *Router
+	adminServer *http.Server
+
+	lifecycle   *lifecycle
+	inFlight    *InFlightRequests
+	latencies   *RouteLatencies
+	degradation *Degradation
+	webSockets  *WebSocketLimiter
+	connections *ConnLimiter
+	sockets     *ConnRegistry
+	outbound    *OutboundCalls
+
+	retirements  *Retirements
+	cache        *Cache
+	invalidation *cacheInvalidation
+
+	closing      context.Context // cancelled when the server starts shutting down
+	closeSockets context.CancelFunc
+
+	dependencies *dependencies
+	gates        *gates
+	keys         *KeyMaterial
+	dryRunChecks dryRunChecks
 }
 
 // New creates a new vektor API server
 func New(opts ...OptionsModifier) *Server {
 	options := newOptsWithModifiers(opts...)
 
+	var inFlight *InFlightRequests
+	if options.TrackInFlight {
+		inFlight = newInFlightRequests()
+	}
+
+	var latencies *RouteLatencies
+	if options.LearnTimeouts {
+		latencies = newRouteLatencies()
+	}
+
+	var degradation *Degradation
+	if options.Degradation != nil {
+		degradation = newServerDegradation(options)
+	}
+
+	outbound := newOutboundCalls()
+
+	retirements := newRetirements(options.Retirement, options.Logger)
+
+	cache := NewCache(options.Cache)
+	invalidation := newCacheInvalidation(options.CacheInvalidator)
+
+	closing, closeSockets := context.WithCancel(context.Background())
+
+	deps := newDependencies()
+
+	webSockets := NewWebSocketLimiter(options.MaxWebSockets, options.MaxWebSocketsPerClient, options.WebSocketClientKey)
+
+	connections := newConnLimiter(options)
+
+	sockets := NewConnRegistry()
+
 	internalRouter := NewRouter(options.Logger, options.FallbackAddress)
 	internalRouter.useQuietRoutes(options.QuietRoutes)
+	internalRouter.useResponseMeta(options.ResponseMeta)
+	internalRouter.useRedaction(options.Redaction)
+	internalRouter.useMaxResponseBytes(options.MaxResponseBytes)
+	internalRouter.useBindMaxBytes(options.Body.MaxBytes)
+	internalRouter.useTrustProxy(options.TrustProxy)
+	internalRouter.useInFlight(inFlight)
+	internalRouter.useStrictResponses(options.StrictResponses)
+	internalRouter.useNotifier(options.Notifier)
+	internalRouter.useFallbackProxy(options.FallbackProxy)
+	internalRouter.useSlowCleanupThreshold(options.SlowCleanupThreshold)
+	internalRouter.useWebSocketLimiter(webSockets)
+	internalRouter.useWebSocketOptions(options.WebSocket)
+	internalRouter.useSockets(sockets)
+	internalRouter.useHandlerTimeout(options.HandlerTimeout, options.HandlerGrace)
+	internalRouter.useDependencies(deps)
+	internalRouter.useDevMode(options.DevMode)
+	internalRouter.useHeaderHygiene(options.HeaderChecks)
+	internalRouter.useConsistencyCookie(options.ConsistencyCookie)
+	internalRouter.useStateSealing(options.StateSealing)
+	internalRouter.useRouteLatencies(latencies)
+	internalRouter.useDegradation(degradation)
+	internalRouter.useExplainRoutes(options.ExplainRoutes)
+	internalRouter.useMigration(options.Migration)
+	internalRouter.useOutboundCalls(outbound)
+	internalRouter.useRetirements(retirements)
+	internalRouter.useCache(cache)
+	internalRouter.useCacheInvalidation(invalidation)
+	internalRouter.useClosing(closing.Done())
+	internalRouter.useDeadlinePropagation(options.DeadlinePropagation)
+	internalRouter.useChaos(options.AllowChaos)
+	internalRouter.useCorrelationHeaders(options.CorrelationHeaders)
+	internalRouter.useCORS(options.CORS)
 	internalRouter.WithMiddlewares(ErrorMiddleware())
 
 	s := &Server{
@@ -38,19 +127,52 @@ func New(opts ...OptionsModifier) *Server {
 		lock:           sync.RWMutex{},
 		started:        atomic.Value{},
 		options:        options,
+		adminRouter:    newAdminRouter(options),
+		lifecycle:      newLifecycle(),
+		inFlight:       inFlight,
+		latencies:      latencies,
+		degradation:    degradation,
+		webSockets:     webSockets,
+		connections:    connections,
+		sockets:        sockets,
+		outbound:       outbound,
+		retirements:    retirements,
+		cache:          cache,
+		invalidation:   invalidation,
+		closing:        closing,
+		closeSockets:   closeSockets,
+		dependencies:   deps,
+		gates:          newGates(),
+		keys:           newKeyMaterial(options),
 	}
 
 	s.started.Store(false)
 
+	if degradation != nil {
+		degradation.OnChange(func(change DegradationChanged) { s.lifecycle.emit(change) })
+	}
+
+	s.adminServer = goAdminServer(options, s.adminRouter)
+
 	// yes this creates a circular reference,
 	// but the VK server and HTTP server are
 	// extremely tightly wound together so
 	// we have to make this compromise
-	s.server = createGoServer(options, s)
+	s.server = createGoServer(options, s, s.keys)
+	s.server.ConnState = func(conn net.Conn, state http.ConnState) {
+		s.lifecycle.trackConn(conn, state)
+		s.connections.trackConn(conn, state)
+	}
+	s.server.RegisterOnShutdown(s.closeSockets)
 
 	return s
 }
 
+// Options returns the server's options, after the environment has been applied to them. They must not be modified
+func (s *Server) Options() *Options {
+	return s.options
+}
+
 // Start starts the server listening
 func (s *Server) Start() error {
 	if s.started.Load().(bool) {
@@ -59,27 +181,110 @@ func (s *Server) Start() error {
 		return err
 	}
 
+	if s.options.DryRun {
+		s.exitDryRun()
+	}
+
+	if err := s.options.Validate(); err != nil {
+		s.options.Logger.Error(err)
+		s.lifecycle.stop(err)
+		return err
+	}
+
+	s.warnUnknownEnv()
+
+	if err := s.internalRouter.Validate(); err != nil {
+		s.options.Logger.Error(err)
+		s.lifecycle.stop(err)
+		return err
+	}
+
 	// lock the router modifiers (GET, POST etc.)
 	s.started.Store(true)
 
 	// mount the root set of routes before starting
 	s.internalRouter.Finalize()
+	s.dumpRoutes()
 
 	s.router = s.options.RouterWrapper(s.internalRouter)
 
+	s.startAdmin()
+
+	if s.inFlight != nil && s.options.StuckRequestThreshold > 0 {
+		go s.inFlight.watch(s.closing.Done(), s.options.Logger, s.options.StuckRequestThreshold)
+	}
+
 	if s.options.AppName != "" {
 		s.options.Logger.Info("starting", s.options.AppName, "...")
 	}
 
 	s.options.Logger.Debug("serving on", s.server.Addr)
 
+	useTLS := true
 	if !s.options.HTTPPortSet() && !s.options.ShouldUseTLS() {
 		s.options.Logger.ErrorString("domain and HTTP port options are both unset, server will start up but fail to acquire a certificate. reconfigure and restart")
 	} else if s.options.ShouldUseHTTP() {
-		return s.server.ListenAndServe()
+		useTLS = false
+	}
+
+	listener, err := net.Listen("tcp", s.server.Addr)
+	if err != nil {
+		s.lifecycle.stop(err)
+		return err
+	}
+
+	listener = s.connections.listener(listener, s.options.Logger)
+	go s.connections.reapIdle(s.closing.Done(), s.options.Logger)
+
+	s.keys.run(s.closing.Done())
+
+	s.lifecycle.emit(ListenerBound{Addr: listener.Addr().String()})
+
+	// requests are answered with a 503 until the gates pass
+	go s.passGates()
+
+	if useTLS {
+		err = s.server.ServeTLS(listener, "", "")
+	} else {
+		err = s.server.Serve(listener)
+	}
+
+	if gateErr := s.gates.failed(); gateErr != nil {
+		err = gateErr
+	}
+
+	// a closed server is reported once shutdown has finished draining, see StopCtx
+	if err != http.ErrServerClosed {
+		s.lifecycle.stop(err)
+	}
+
+	return err
+}
+
+// StartCtx starts the server like Start, and shuts it down gracefully with Shutdown once ctx is done, such as when
+// the context from signal.NotifyContext receives SIGTERM. It returns once the shutdown has finished, with nil if the
+// in-flight requests completed in time
+func (s *Server) StartCtx(ctx context.Context) error {
+	started := make(chan struct{})
+	shutdownErr := make(chan error, 1)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			shutdownErr <- s.Shutdown(context.Background())
+		case <-started:
+			shutdownErr <- nil
+		}
+	}()
+
+	err := s.Start()
+	close(started)
+
+	if err != http.ErrServerClosed {
+		return err
 	}
 
-	return s.server.ListenAndServeTLS("", "")
+	return <-shutdownErr
 }
 
 // Stop shuts down the server and returns any associated errors
@@ -87,9 +292,66 @@ func (s *Server) Stop() error {
 	return s.StopCtx(context.Background())
 }
 
-// StopCtx shuts down the server (with a context) and returns any associated errors
+// StopCtx shuts down the server (with a context) and returns any associated errors.
+// The admin server (if any) is shut down last so that it remains available while draining.
+// Connections still active when ctx is done or the ShutdownTimeout passes are closed
 func (s *Server) StopCtx(ctx context.Context) error {
-	return s.server.Shutdown(ctx)
+	return s.StopWithReason(ctx, "stop requested")
+}
+
+// StopWithReason is StopCtx with a reason that is included in the ShutdownStarted event
+func (s *Server) StopWithReason(ctx context.Context, reason string) error {
+	s.lifecycle.emit(ShutdownStarted{Reason: reason})
+
+	if s.options.ShutdownTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.options.ShutdownTimeout)
+
+		defer cancel()
+	}
+
+	err := s.drain(ctx)
+
+	s.lifecycle.stop(err)
+
+	return err
+}
+
+// useClosing sets the channel that is closed when the server starts shutting down, which cancels the contexts of the
+// router's websocket handlers. http.Server.Shutdown doesn't wait for or close hijacked connections, so this is how
+// they learn to close. It also stops the router's panic summaries
+func (rt *Router) useClosing(closing <-chan struct{}) {
+	rt.closing = closing
+	rt.panics.startSummary(closing)
+}
+
+// drain shuts down the server and then the admin server, reporting progress while connections complete. If ctx is
+// done first, the remaining connections are closed
+func (s *Server) drain(ctx context.Context) error {
+	drained := make(chan struct{})
+	reported := make(chan struct{})
+
+	go func() {
+		defer close(reported)
+		s.lifecycle.reportDrain(drained)
+	}()
+
+	err := s.server.Shutdown(ctx)
+	if err != nil {
+		s.options.Logger.Warn("closing connections that did not complete in time")
+		s.server.Close()
+	}
+
+	close(drained)
+	<-reported
+
+	if s.adminServer != nil {
+		if adminErr := s.adminServer.Shutdown(ctx); adminErr != nil && err == nil {
+			err = adminErr
+		}
+	}
+
+	return err
 }
 
 // TestStart "starts" the server for automated testing with vtest
@@ -100,11 +362,25 @@ func (s *Server) TestStart() error {
 		return err
 	}
 
+	if err := s.options.Validate(); err != nil {
+		s.options.Logger.Error(err)
+		return err
+	}
+
+	s.warnUnknownEnv()
+
+	if err := s.internalRouter.Validate(); err != nil {
+		s.options.Logger.Error(err)
+		return err
+	}
+
 	// lock the router modifiers (GET, POST etc.)
 	s.started.Store(true)
 
 	// mount the root set of routes before starting
 	s.internalRouter.Finalize()
+	s.finalizeAdmin()
+	s.dumpRoutes()
 
 	if s.options.AppName != "" {
 		s.options.Logger.Debug("starting", s.options.AppName, "in Test Mode...")
@@ -112,12 +388,22 @@ func (s *Server) TestStart() error {
 
 	s.router = s.options.RouterWrapper(s.internalRouter)
 
+	if err := s.gates.run(context.Background(), s.options.Logger, s.lifecycle.emit); err != nil {
+		s.options.Logger.Error(err)
+		return err
+	}
+
 	return nil
 }
 
 // ServeHTTP serves HTTP requests using the internal router while allowing
 // said router to be swapped out underneath at any time in a thread-safe way
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.gates.open() && !s.servesLiveness(r) {
+		respondGating(w)
+		return
+	}
+
 	// run the inspector with a dereferenced pointer
 	// so that it can view but not change said request
 	//
@@ -135,10 +421,48 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 // SwapRouter allows swapping VK's router out in realtime while
-// continuing to serve requests in the background
+// continuing to serve requests in the background. A router that fails
+// Validate is logged and not swapped in
 func (s *Server) SwapRouter(router *Router) {
+	if err := router.Validate(); err != nil {
+		s.options.Logger.Error(errors.Wrap(err, "failed to Validate, the router was not swapped"))
+		return
+	}
+
+	router.useExplainRoutes(s.options.ExplainRoutes)
+	router.useMigration(s.options.Migration)
 	router.Finalize()
 	router.useQuietRoutes(s.options.QuietRoutes)
+	router.useResponseMeta(s.options.ResponseMeta)
+	router.useRedaction(s.options.Redaction)
+	router.useMaxResponseBytes(s.options.MaxResponseBytes)
+	router.useBindMaxBytes(s.options.Body.MaxBytes)
+	router.useTrustProxy(s.options.TrustProxy)
+	router.useInFlight(s.inFlight)
+	router.useStrictResponses(s.options.StrictResponses)
+	router.useNotifier(s.options.Notifier)
+	router.useFallbackProxy(s.options.FallbackProxy)
+	router.useSlowCleanupThreshold(s.options.SlowCleanupThreshold)
+	router.useWebSocketLimiter(s.webSockets)
+	router.useWebSocketOptions(s.options.WebSocket)
+	router.useSockets(s.sockets)
+	router.useHandlerTimeout(s.options.HandlerTimeout, s.options.HandlerGrace)
+	router.useDependencies(s.dependencies)
+	router.useDevMode(s.options.DevMode)
+	router.useHeaderHygiene(s.options.HeaderChecks)
+	router.useConsistencyCookie(s.options.ConsistencyCookie)
+	router.useStateSealing(s.options.StateSealing)
+	router.useRouteLatencies(s.latencies)
+	router.useDegradation(s.degradation)
+	router.useOutboundCalls(s.outbound)
+	router.useRetirements(s.retirements)
+	router.useCache(s.cache)
+	router.useCacheInvalidation(s.invalidation)
+	router.useClosing(s.closing.Done())
+	router.useDeadlinePropagation(s.options.DeadlinePropagation)
+	router.useChaos(s.options.AllowChaos)
+	router.useCorrelationHeaders(s.options.CorrelationHeaders)
+	router.useCORS(s.options.CORS)
 
 	// lock after Finalizing the router so
 	// the lock is released as quickly as possible
@@ -157,6 +481,57 @@ func (s *Server) CanHandle(method, path string) bool {
 	return s.internalRouter.canHandle(method, path)
 }
 
+// Routes returns metadata for each of the routes handled by the server's router, see Router.Routes
+func (s *Server) Routes() []RouteInfo {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.internalRouter.Routes()
+}
+
+// Snapshot returns a RouteSnapshot of the server's routes, see Router.Snapshot
+func (s *Server) Snapshot() RouteSnapshot {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.internalRouter.Snapshot()
+}
+
+// SetFlag turns a feature flag on or off for the server's router, see RouteGroup.WithFlag
+func (s *Server) SetFlag(name string, on bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	s.internalRouter.SetFlag(name, on)
+}
+
+// EnableCORS makes the server's router answer CORS preflight requests, see Router.EnableCORS. It sets the server's
+// CORS options, as UseCORS with Preflight does, so that they are kept by SwapRouter
+func (s *Server) EnableCORS(domain string, opts ...CORSOption) {
+	if s.started.Load().(bool) {
+		return
+	}
+
+	if domain == "" {
+		s.options.CORS.Preflight = false
+	} else {
+		c := &routerCORS{headers: []string{corsDefaultHeaders}}
+		for _, opt := range opts {
+			opt(c)
+		}
+
+		s.options.CORS = CORSOptions{
+			AllowedOrigins:   []string{domain},
+			AllowedHeaders:   c.headers,
+			AllowCredentials: c.credentials,
+			MaxAge:           c.maxAge,
+			Preflight:        true,
+		}
+	}
+
+	s.internalRouter.useCORS(s.options.CORS)
+}
+
 // GET is a shortcut for router.Handle(http.MethodGet, path, handle)
 func (s *Server) GET(path string, handler HandlerFunc) {
 	if s.started.Load().(bool) {
@@ -247,7 +622,25 @@ func (s *Server) AddGroup(group *RouteGroup) {
 	s.internalRouter.AddGroup(group)
 }
 
-// HandleHTTP allows vk to handle a standard http.HandlerFunc
+// Mount serves a subtree of paths with a standard http.Handler, see RouteGroup.Mount
+func (s *Server) Mount(prefix string, handler http.Handler, opts ...MountOption) {
+	if s.started.Load().(bool) {
+		return
+	}
+
+	s.internalRouter.Mount(prefix, handler, opts...)
+}
+
+// Static serves the files in fs below prefix, see RouteGroup.Static
+func (s *Server) Static(prefix string, fs http.FileSystem, opts ...MountOption) {
+	if s.started.Load().(bool) {
+		return
+	}
+
+	s.internalRouter.Static(prefix, fs, opts...)
+}
+
+// HandleHTTP allows vk to handle a standard http.HandlerFunc, see Router.HandleHTTP
 func (s *Server) HandleHTTP(method, path string, handler http.HandlerFunc) {
 	if s.started.Load().(bool) {
 		return
@@ -256,15 +649,24 @@ func (s *Server) HandleHTTP(method, path string, handler http.HandlerFunc) {
 	s.internalRouter.HandleHTTP(method, path, handler)
 }
 
-func createGoServer(options *Options, handler http.Handler) *http.Server {
+// HandleHTTPRaw handles a standard http.HandlerFunc outside of vk's pipeline, see Router.HandleHTTPRaw
+func (s *Server) HandleHTTPRaw(method, path string, handler http.HandlerFunc) {
+	if s.started.Load().(bool) {
+		return
+	}
+
+	s.internalRouter.HandleHTTPRaw(method, path, handler)
+}
+
+func createGoServer(options *Options, handler http.Handler, keys *KeyMaterial) *http.Server {
 	if useHTTP := options.ShouldUseHTTP(); useHTTP {
 		return goHTTPServerWithPort(options, handler)
 	}
 
-	return goTLSServerWithDomain(options, handler)
+	return goTLSServerWithDomain(options, handler, keys)
 }
 
-func goTLSServerWithDomain(options *Options, handler http.Handler) *http.Server {
+func goTLSServerWithDomain(options *Options, handler http.Handler, keys *KeyMaterial) *http.Server {
 	if options.TLSConfig != nil {
 		options.Logger.Info("configured for HTTPS with custom configuration")
 	} else if options.Domain != "" {
@@ -273,13 +675,21 @@ func goTLSServerWithDomain(options *Options, handler http.Handler) *http.Server
 
 	tlsConfig := options.TLSConfig
 
+	var manager *autocert.Manager
+
 	if tlsConfig == nil {
-		m := &autocert.Manager{
-			Cache:      autocert.DirCache("~/.autocert"),
-			Prompt:     autocert.AcceptTOS,
-			HostPolicy: autocert.HostWhitelist(options.Domain),
+		selector, err := newCertSelector(options)
+		if err != nil {
+			options.Logger.Error(errors.Wrap(err, "[vk] failed to newCertSelector"))
+			selector = &certSelector{hook: options.GetCertificate}
 		}
 
+		manager = selector.manager
+		keys.certs = selector.store
+		tlsConfig = &tls.Config{GetCertificate: selector.GetCertificate}
+	}
+
+	if manager != nil {
 		addr := fmt.Sprintf(":%d", options.HTTPPort)
 		if options.HTTPPort == 0 {
 			addr = ":8080"
@@ -287,9 +697,18 @@ func goTLSServerWithDomain(options *Options, handler http.Handler) *http.Server
 
 		options.Logger.Info("serving TLS challenges on", addr)
 
-		go http.ListenAndServe(addr, m.HTTPHandler(nil))
+		var fallback http.Handler
+		if options.ShouldRedirectHTTPS() {
+			fallback = httpsRedirectHandler(options, handler)
+		}
+
+		go http.ListenAndServe(addr, manager.HTTPHandler(fallback))
+	} else if options.ShouldRedirectHTTPS() {
+		addr := fmt.Sprintf(":%d", options.HTTPPort)
+
+		options.Logger.Info("redirecting HTTP to HTTPS on", addr)
 
-		tlsConfig = &tls.Config{GetCertificate: m.GetCertificate}
+		go http.ListenAndServe(addr, httpsRedirectHandler(options, handler))
 	}
 
 	addr := fmt.Sprintf(":%d", options.TLSPort)
@@ -0,0 +1,208 @@
+package vk
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// PriorityClass is the importance of a route's traffic when the server is overloaded, see Priority and Shedder
+type PriorityClass int
+
+const (
+	Low PriorityClass = iota
+	Normal
+	High
+)
+
+const defaultSheddingHysteresis = 0.1
+
+var priorityNames = [...]string{Low: "low", Normal: "normal", High: "high"}
+
+// String returns the name of the class
+func (p PriorityClass) String() string {
+	if p < Low || p > High {
+		return fmt.Sprintf("priority(%d)", int(p))
+	}
+
+	return priorityNames[p]
+}
+
+type priorityContextKey struct{}
+
+// Priority is a Middleware that sets the priority class of a route's requests, which is Normal by default
+func Priority(class PriorityClass) Middleware {
+	return func(inner HandlerFunc) HandlerFunc {
+		handler := func(w http.ResponseWriter, r *http.Request, ctx *Ctx) error {
+			ctx.Context = context.WithValue(ctx.Context, priorityContextKey{}, class)
+			return inner(w, r, ctx)
+		}
+
+		// attach the class to the chain so that a Shedder wrapping this route can find it without any per-request work
+		l := &chainLink{name: "priority", next: inner, handler: handler, value: class}
+
+		return l.serve
+	}
+}
+
+// priorityOf returns the class set by the Priority middleware for the request, or Normal
+func priorityOf(ctx *Ctx) PriorityClass {
+	if ctx.Context != nil {
+		if class, ok := ctx.Context.Value(priorityContextKey{}).(PriorityClass); ok {
+			return class
+		}
+	}
+
+	return Normal
+}
+
+// SheddingOptions configures a Shedder
+type SheddingOptions struct {
+	// Signal reports the current load, by default the number of requests in flight through the Shedder is used
+	Signal func() float64
+
+	// Low priority requests are shed once the signal reaches LowWatermark, and Normal ones once it reaches
+	// HighWatermark. High priority requests are never shed. A watermark of 0 disables shedding for its class
+	LowWatermark  float64
+	HighWatermark float64
+
+	// Hysteresis is the fraction the signal must fall below a watermark before shedding stops, which avoids
+	// flapping when the signal hovers around it. It defaults to 0.1
+	Hysteresis float64
+}
+
+// ShedStats reports the state of a Shedder
+type ShedStats struct {
+	Shedding []string          `json:"shedding"` // the classes currently being shed
+	InFlight int64             `json:"in_flight"`
+	Shed     map[string]uint64 `json:"shed"` // the number of requests shed for each class
+}
+
+// Shedder rejects requests with 503 by priority class when a load signal crosses its watermarks. Routes
+// declare their class with the Priority middleware, see SheddingOptions for the thresholds
+type Shedder struct {
+	opts SheddingOptions
+
+	level    int32 // the number of classes being shed, starting with Low
+	inFlight int64
+	shed     [High + 1]uint64
+}
+
+// NewShedder creates a Shedder
+func NewShedder(opts SheddingOptions) *Shedder {
+	if opts.Hysteresis <= 0 || opts.Hysteresis >= 1 {
+		opts.Hysteresis = defaultSheddingHysteresis
+	}
+
+	s := &Shedder{opts: opts}
+
+	return s
+}
+
+// Middleware returns a Middleware that sheds requests according to their priority
+func (s *Shedder) Middleware() Middleware {
+	return Named("shedding", func(inner HandlerFunc) HandlerFunc {
+		// routes registered with Priority have their class resolved once, up front
+		routeClass, hasRouteClass := Normal, false
+
+		for _, v := range chainValues(inner) {
+			if class, ok := v.(PriorityClass); ok {
+				routeClass, hasRouteClass = class, true
+				break
+			}
+		}
+
+		return func(w http.ResponseWriter, r *http.Request, ctx *Ctx) error {
+			class := routeClass
+			if !hasRouteClass {
+				class = priorityOf(ctx)
+			}
+
+			if s.shouldShed(class) {
+				atomic.AddUint64(&s.shed[class], 1)
+				ctx.Log.Debug("shedding", class.String(), "priority request", r.Method, r.URL.Path)
+
+				return E(http.StatusServiceUnavailable, "server overloaded, try again later")
+			}
+
+			atomic.AddInt64(&s.inFlight, 1)
+			defer atomic.AddInt64(&s.inFlight, -1)
+
+			return inner(w, r, ctx)
+		}
+	})
+}
+
+// Stats returns the shedder's current state and the number of requests it has shed
+func (s *Shedder) Stats() ShedStats {
+	stats := ShedStats{
+		Shedding: []string{},
+		InFlight: atomic.LoadInt64(&s.inFlight),
+		Shed:     map[string]uint64{},
+	}
+
+	level := PriorityClass(atomic.LoadInt32(&s.level))
+
+	for class := Low; class <= High; class++ {
+		stats.Shed[class.String()] = atomic.LoadUint64(&s.shed[class])
+
+		if class < level {
+			stats.Shedding = append(stats.Shedding, class.String())
+		}
+	}
+
+	return stats
+}
+
+// RegisterAdmin mounts GET /shedding on the admin router, reporting the shedder's stats
+func (s *Shedder) RegisterAdmin(r *Router) {
+	r.GET("/shedding", func(w http.ResponseWriter, _ *http.Request, ctx *Ctx) error {
+		return RespondJSON(ctx.Context, w, s.Stats(), http.StatusOK)
+	})
+}
+
+// shouldShed updates the shedding level from the load signal and returns true if class is being shed
+func (s *Shedder) shouldShed(class PriorityClass) bool {
+	if class >= High {
+		return false
+	}
+
+	var signal float64
+	if s.opts.Signal != nil {
+		signal = s.opts.Signal()
+	} else {
+		signal = float64(atomic.LoadInt64(&s.inFlight))
+	}
+
+	current := atomic.LoadInt32(&s.level)
+
+	next := s.levelFor(signal)
+	if next < current {
+		// only step down once the signal is clearly below the watermark
+		relaxed := s.levelFor(signal / (1 - s.opts.Hysteresis))
+		if relaxed < current {
+			next = relaxed
+		} else {
+			next = current
+		}
+	}
+
+	if next != current {
+		atomic.CompareAndSwapInt32(&s.level, current, next)
+	}
+
+	return int32(class) < next
+}
+
+// levelFor returns the number of classes that should be shed for the signal, ignoring hysteresis
+func (s *Shedder) levelFor(signal float64) int32 {
+	switch {
+	case s.opts.HighWatermark > 0 && signal >= s.opts.HighWatermark:
+		return 2
+	case s.opts.LowWatermark > 0 && signal >= s.opts.LowWatermark:
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,215 @@
+package vk
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ShutdownPhaseHTTPDrain is the name of the built-in phase that stops accepting connections and waits for in-flight
+// requests to complete. Include a phase with this name and a nil Run function to position it within a ShutdownPlan
+const ShutdownPhaseHTTPDrain = "http-drain"
+
+const (
+	defaultHTTPDrainTimeout = 20 * time.Second
+	defaultShutdownDeadline = 30 * time.Second
+)
+
+// ShutdownPhase is a step of a ShutdownPlan. Run is given a context that is done once the phase's Timeout has
+// passed, after which the phase is abandoned and the next one begins
+type ShutdownPhase struct {
+	Name    string
+	Timeout time.Duration
+	Run     func(ctx context.Context) error
+}
+
+// ShutdownPlan is the ordered list of phases executed by Server.Shutdown. If the overall Deadline passes, any
+// remaining phases are abandoned
+type ShutdownPlan struct {
+	Phases   []ShutdownPhase
+	Deadline time.Duration
+
+	// Now can be replaced for testing, it is used to measure the duration of each phase
+	Now func() time.Time
+}
+
+// DefaultShutdownPlan returns a plan that drains HTTP connections for up to 20s, with an overall deadline of 30s
+func DefaultShutdownPlan() ShutdownPlan {
+	p := ShutdownPlan{
+		Phases: []ShutdownPhase{
+			{Name: ShutdownPhaseHTTPDrain, Timeout: defaultHTTPDrainTimeout},
+		},
+		Deadline: defaultShutdownDeadline,
+	}
+
+	return p
+}
+
+// Then returns a copy of the plan with a phase appended
+func (p ShutdownPlan) Then(name string, timeout time.Duration, run func(ctx context.Context) error) ShutdownPlan {
+	phases := make([]ShutdownPhase, 0, len(p.Phases)+1)
+	phases = append(phases, p.Phases...)
+
+	p.Phases = append(phases, ShutdownPhase{Name: name, Timeout: timeout, Run: run})
+
+	return p
+}
+
+// WithDeadline returns a copy of the plan with the overall deadline set
+func (p ShutdownPlan) WithDeadline(deadline time.Duration) ShutdownPlan {
+	p.Deadline = deadline
+	return p
+}
+
+// phaseResult records the outcome of a phase for the shutdown summary
+type phaseResult struct {
+	name     string
+	duration time.Duration
+	exceeded bool
+	skipped  bool
+	err      error
+}
+
+func (r phaseResult) String() string {
+	switch {
+	case r.skipped:
+		return fmt.Sprintf("%s skipped", r.name)
+	case r.exceeded:
+		return fmt.Sprintf("%s %dms (exceeded budget)", r.name, r.duration.Milliseconds())
+	case r.err != nil:
+		return fmt.Sprintf("%s %dms (failed: %s)", r.name, r.duration.Milliseconds(), r.err.Error())
+	}
+
+	return fmt.Sprintf("%s %dms", r.name, r.duration.Milliseconds())
+}
+
+// Shutdown gracefully shuts the server down by executing its ShutdownPlan (see UseShutdownPlan), logging the
+// duration of each phase and a final summary. It returns the first error from any phase, including a phase
+// exceeding its budget. The server is stopped once every phase has completed or been abandoned
+func (s *Server) Shutdown(ctx context.Context) error {
+	plan := s.shutdownPlan()
+
+	now := plan.Now
+	if now == nil {
+		now = time.Now
+	}
+
+	if plan.Deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, plan.Deadline)
+
+		defer cancel()
+	}
+
+	s.lifecycle.emit(ShutdownStarted{Reason: "shutdown"})
+
+	start := now()
+	results := make([]phaseResult, 0, len(plan.Phases))
+
+	var firstErr error
+
+	for _, phase := range plan.Phases {
+		if ctx.Err() != nil {
+			results = append(results, phaseResult{name: phase.Name, skipped: true})
+			continue
+		}
+
+		result := s.runPhase(ctx, phase, now)
+		results = append(results, result)
+
+		if result.err != nil && firstErr == nil {
+			firstErr = errors.Wrapf(result.err, "shutdown phase %s failed", phase.Name)
+		}
+	}
+
+	if ctx.Err() != nil && firstErr == nil {
+		firstErr = errors.Wrap(ctx.Err(), "shutdown deadline exceeded")
+	}
+
+	summary := make([]string, len(results))
+	for i, r := range results {
+		summary[i] = r.String()
+	}
+
+	logFn := s.options.Logger.Info
+	if firstErr != nil {
+		logFn = s.options.Logger.Warn
+	}
+
+	logFn(fmt.Sprintf("shutdown completed in %dms:", now().Sub(start).Milliseconds()), strings.Join(summary, ", "))
+
+	s.lifecycle.stop(firstErr)
+
+	return firstErr
+}
+
+// shutdownPlan returns the configured plan, or the default plan with its HTTP drain budget set by ShutdownTimeout
+func (s *Server) shutdownPlan() ShutdownPlan {
+	if s.options.ShutdownPlan != nil {
+		return *s.options.ShutdownPlan
+	}
+
+	plan := DefaultShutdownPlan()
+
+	if timeout := s.options.ShutdownTimeout; timeout > 0 {
+		plan.Phases[0].Timeout = timeout
+
+		if plan.Deadline < timeout {
+			plan.Deadline = timeout
+		}
+	}
+
+	return plan
+}
+
+// runPhase runs a phase until it completes or its budget is exceeded, in which case it is abandoned
+func (s *Server) runPhase(ctx context.Context, phase ShutdownPhase, now func() time.Time) phaseResult {
+	run := phase.Run
+	if run == nil && phase.Name == ShutdownPhaseHTTPDrain {
+		run = s.drain
+	}
+
+	result := phaseResult{name: phase.Name}
+
+	if run == nil {
+		s.options.Logger.Warn("shutdown phase", phase.Name, "has nothing to run, skipping")
+		result.skipped = true
+
+		return result
+	}
+
+	phaseCtx := ctx
+	if phase.Timeout > 0 {
+		var cancel context.CancelFunc
+		phaseCtx, cancel = context.WithTimeout(ctx, phase.Timeout)
+
+		defer cancel()
+	}
+
+	start := now()
+	done := make(chan error, 1)
+
+	go func() {
+		done <- run(phaseCtx)
+	}()
+
+	select {
+	case result.err = <-done:
+	case <-phaseCtx.Done():
+		result.exceeded = true
+		result.err = errors.Wrapf(phaseCtx.Err(), "exceeded budget of %s", phase.Timeout)
+	}
+
+	result.duration = now().Sub(start)
+
+	if result.exceeded {
+		s.options.Logger.Warn("shutdown phase", phase.Name, fmt.Sprintf("abandoned after %dms", result.duration.Milliseconds()))
+	} else {
+		s.options.Logger.Debug("shutdown phase", phase.Name, fmt.Sprintf("completed in %dms", result.duration.Milliseconds()))
+	}
+
+	return result
+}
@@ -0,0 +1,692 @@
+package vk
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// SigningAlgorithm names the signatures of SigningScheme in the Authorization header
+	SigningAlgorithm = "VK-HMAC-SHA256"
+
+	// AccessKeyIDKey is the Ctx key under which SignedRequestMiddleware sets the access key ID of a verified request
+	AccessKeyIDKey = "vk.accesskeyid"
+
+	signingTimeFormat = "20060102T150405Z"
+
+	defaultSigningDateHeader  = "X-Vk-Date"
+	defaultSigningNonceHeader = "X-Vk-Nonce"
+	defaultSigningMaxSkew     = 5 * time.Minute
+	defaultSigningMaxBody     = 10 << 20
+	defaultSigningMaxNonces   = 100000
+	maxSigningNonceLength     = 128
+	maxCachedKeys             = 10000
+)
+
+// The codes of the errors of SignedRequestMiddleware, see SignatureError
+const (
+	SignatureMissing    = "SIGNATURE_MISSING"    // the request has no Authorization header of the scheme
+	SignatureMalformed  = "SIGNATURE_MALFORMED"  // the header, timestamp or nonce is invalid, or a required header is unsigned
+	SignatureExpired    = "SIGNATURE_EXPIRED"    // the timestamp is outside of the clock skew window
+	SignatureUnknownKey = "UNKNOWN_ACCESS_KEY"   // the access key ID isn't known
+	SignatureMismatch   = "SIGNATURE_MISMATCH"   // the signature isn't that of the request
+	SignatureReplayed   = "SIGNATURE_REPLAYED"   // the nonce has already been used with the access key
+	SignatureTooMany    = "SIGNATURE_TOO_MANY"   // the access key has MaxNonces unexpired nonces, see SigningScheme
+	signatureUnverified = "SIGNATURE_UNVERIFIED" // the key couldn't be resolved
+)
+
+// ErrUnknownAccessKey is returned by a KeyResolver that has no secret for an access key ID
+var ErrUnknownAccessKey = errors.New("unknown access key")
+
+// SignatureError is the error of a request that failed the verification of SignedRequestMiddleware, with a code
+// that clients can act on. Its message is the same for every request with the same code, so that it never says
+// which part of the request didn't match
+type SignatureError struct {
+	StatusCode  int    `json:"status"`
+	MessageText string `json:"message"`
+	ErrorCode   string `json:"code"`
+}
+
+func (e *SignatureError) Error() string {
+	return fmt.Sprintf("%d: %s (%s)", e.StatusCode, e.MessageText, e.ErrorCode)
+}
+
+// Status returns the error's status code
+func (e *SignatureError) Status() int {
+	return e.StatusCode
+}
+
+// Message returns the error's message
+func (e *SignatureError) Message() string {
+	return e.MessageText
+}
+
+// Code returns the error's code, i.e. SIGNATURE_EXPIRED
+func (e *SignatureError) Code() string {
+	return e.ErrorCode
+}
+
+var signatureMessages = map[string]string{
+	SignatureMissing:    "the request is not signed",
+	SignatureMalformed:  "the request's signature is malformed",
+	SignatureExpired:    "the request's signature has expired",
+	SignatureUnknownKey: "the request's access key is unknown",
+	SignatureMismatch:   "the request's signature does not match",
+	SignatureReplayed:   "the request has already been received",
+	SignatureTooMany:    "too many requests have been signed with the access key",
+	signatureUnverified: "unable to verify the request's signature",
+}
+
+func signatureError(code string) *SignatureError {
+	status := http.StatusUnauthorized
+
+	switch code {
+	case SignatureTooMany:
+		status = http.StatusTooManyRequests
+	case signatureUnverified:
+		status = http.StatusServiceUnavailable
+	}
+
+	return &SignatureError{StatusCode: status, MessageText: signatureMessages[code], ErrorCode: code}
+}
+
+// KeyResolver looks up the secret of an access key ID, returning ErrUnknownAccessKey if there is none. Other errors
+// fail the request with a 503, as its signature can't be verified
+type KeyResolver interface {
+	ResolveKey(ctx context.Context, accessKeyID string) ([]byte, error)
+}
+
+// KeyResolverFunc is a function that is a KeyResolver
+type KeyResolverFunc func(ctx context.Context, accessKeyID string) ([]byte, error)
+
+// ResolveKey calls f
+func (f KeyResolverFunc) ResolveKey(ctx context.Context, accessKeyID string) ([]byte, error) {
+	return f(ctx, accessKeyID)
+}
+
+// cachedKeyResolver caches the secrets, and the unknown access key IDs, of a KeyResolver. It holds at most
+// maxCachedKeys of them, evicting the one stored longest ago, since the IDs come from requests that haven't been
+// verified yet
+type cachedKeyResolver struct {
+	resolver KeyResolver
+	ttl      time.Duration
+
+	lock  sync.Mutex
+	keys  map[string]*list.Element
+	order *list.List // of *cachedKey, most recently stored first
+}
+
+type cachedKey struct {
+	accessKeyID string
+	secret      []byte // nil for an unknown key
+	expires     time.Time
+}
+
+// CachedKeyResolver returns a KeyResolver that caches the secrets resolved by resolver for ttl, such as to look
+// them up in a database once a minute rather than for every request. Unknown access key IDs are cached too, so that
+// requests with made up ones don't reach resolver either, but its errors aren't. At most 10000 access key IDs are
+// cached, and the oldest are evicted to make room for new ones
+func CachedKeyResolver(resolver KeyResolver, ttl time.Duration) KeyResolver {
+	c := &cachedKeyResolver{
+		resolver: resolver,
+		ttl:      ttl,
+		keys:     map[string]*list.Element{},
+		order:    list.New(),
+	}
+
+	return c
+}
+
+func (c *cachedKeyResolver) ResolveKey(ctx context.Context, accessKeyID string) ([]byte, error) {
+	now := time.Now()
+
+	c.lock.Lock()
+	var cached cachedKey
+	elem, ok := c.keys[accessKeyID]
+	if ok {
+		cached = *elem.Value.(*cachedKey)
+	}
+	c.lock.Unlock()
+
+	if ok && now.Before(cached.expires) {
+		if cached.secret == nil {
+			return nil, ErrUnknownAccessKey
+		}
+
+		return cached.secret, nil
+	}
+
+	secret, err := c.resolver.ResolveKey(ctx, accessKeyID)
+	if err != nil && !errors.Is(err, ErrUnknownAccessKey) {
+		return nil, err
+	}
+
+	c.store(&cachedKey{accessKeyID: accessKeyID, secret: secret, expires: now.Add(c.ttl)})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return secret, nil
+}
+
+// store caches key, replacing any entry for its access key ID and evicting the oldest entry if the cache is full.
+// Every entry has the same ttl, so the oldest is also the first to expire
+func (c *cachedKeyResolver) store(key *cachedKey) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if elem, ok := c.keys[key.accessKeyID]; ok {
+		elem.Value = key
+		c.order.MoveToFront(elem)
+
+		return
+	}
+
+	for c.order.Len() >= maxCachedKeys {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.keys, oldest.Value.(*cachedKey).accessKeyID)
+	}
+
+	c.keys[key.accessKeyID] = c.order.PushFront(key)
+}
+
+// SigningScheme describes how requests are signed, and is the reference implementation of their canonicalization.
+// A request is signed with the secret of an access key by:
+//
+// 1. Setting the DateHeader to the time in UTC as 20261016T120000Z, and the NonceHeader to a value (of up to 128
+// characters) that is never used again with the access key.
+//
+// 2. Building the canonical request, the following lines joined by \n, with no trailing newline:
+//
+//	the method, in upper case
+//	the decoded path, encoded as below leaving / as it is, or / if it is empty
+//	the query: each name and value decoded (with + as a space), then encoded as below, written as name=value,
+//	    sorted by encoded name and then encoded value, as bytes, and joined by &, or an empty line if there is none
+//	for each signed header, sorted: its name in lower case, a colon, and its values with their leading and trailing
+//	    spaces removed and their inner runs of spaces collapsed to one, joined by a comma. The Host header is the
+//	    request's host, and a header that isn't sent has an empty value
+//	the names of the signed headers, in lower case, sorted, and joined by ;
+//	the SHA-256 hash of the body, in lower case hex
+//
+// Encoding leaves the characters A-Z, a-z, 0-9, -, ., _ and ~ as they are, and replaces every other byte with %XY,
+// XY being its value in upper case hex. The signed headers must include host, the DateHeader, the NonceHeader and
+// every one of SignedHeaders, and can include others.
+//
+// 3. Building the string to sign, the following lines joined by \n:
+//
+//	VK-HMAC-SHA256
+//	the value of the DateHeader
+//	the SHA-256 hash of the canonical request, in lower case hex
+//
+// 4. Signing it with HMAC-SHA256 keyed with the secret, and sending the signature, in lower case hex, as:
+//
+//	Authorization: VK-HMAC-SHA256 Credential=<access key ID>, SignedHeaders=<signed headers>, Signature=<signature>
+//
+// Sign does all of this for Go clients
+type SigningScheme struct {
+	// SignedHeaders are the headers that must be signed, in addition to host, DateHeader and NonceHeader, such as
+	// Content-Type
+	SignedHeaders []string
+
+	DateHeader  string        // the header carrying the time the request was signed, X-Vk-Date by default
+	NonceHeader string        // the header carrying the request's nonce, X-Vk-Nonce by default
+	MaxSkew     time.Duration // how far the signing time can be from the server's time, 5 minutes by default
+
+	// MaxBodyBytes is the largest body that is hashed, larger ones are rejected with a 413. 10MB by default
+	MaxBodyBytes int64
+
+	// MaxNonces is the number of nonces remembered for each access key to reject replayed requests, 100000 by
+	// default. Nonces are remembered until their request's signature expires, and the requests of an access key that
+	// already has MaxNonces are rejected with a 429 until some expire, since forgetting them would allow replays
+	MaxNonces int
+
+	Now func() time.Time // the server's clock, time.Now by default
+}
+
+// withDefaults returns the scheme with the empty settings set to their defaults
+func (s SigningScheme) withDefaults() SigningScheme {
+	if s.DateHeader == "" {
+		s.DateHeader = defaultSigningDateHeader
+	}
+
+	if s.NonceHeader == "" {
+		s.NonceHeader = defaultSigningNonceHeader
+	}
+
+	if s.MaxSkew <= 0 {
+		s.MaxSkew = defaultSigningMaxSkew
+	}
+
+	if s.MaxBodyBytes <= 0 {
+		s.MaxBodyBytes = defaultSigningMaxBody
+	}
+
+	if s.MaxNonces <= 0 {
+		s.MaxNonces = defaultSigningMaxNonces
+	}
+
+	if s.Now == nil {
+		s.Now = time.Now
+	}
+
+	return s
+}
+
+// requiredHeaders returns the names of the headers that every request must sign, in lower case
+func (s SigningScheme) requiredHeaders() []string {
+	required := []string{"host", strings.ToLower(s.DateHeader), strings.ToLower(s.NonceHeader)}
+
+	for _, h := range s.SignedHeaders {
+		required = append(required, strings.ToLower(h))
+	}
+
+	return canonicalHeaderNames(required)
+}
+
+// Sign signs r with the secret of accessKeyID, setting its DateHeader and NonceHeader unless they are already set,
+// and its Authorization header. The headers signed are those the scheme requires. The body is read to be hashed,
+// and replaced with a copy
+func (s SigningScheme) Sign(r *http.Request, accessKeyID string, secret []byte) error {
+	s = s.withDefaults()
+
+	if r.Header.Get(s.DateHeader) == "" {
+		r.Header.Set(s.DateHeader, s.Now().UTC().Format(signingTimeFormat))
+	}
+
+	if r.Header.Get(s.NonceHeader) == "" {
+		nonce := make([]byte, 16)
+		if _, err := rand.Read(nonce); err != nil {
+			return errors.Wrap(err, "failed to generate nonce")
+		}
+
+		r.Header.Set(s.NonceHeader, hex.EncodeToString(nonce))
+	}
+
+	body, err := readSignedBody(r, -1)
+	if err != nil {
+		return err
+	}
+
+	signed := s.requiredHeaders()
+	signature := s.signature(secret, r.Header.Get(s.DateHeader), s.CanonicalRequest(r, signed, body))
+
+	r.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s, SignedHeaders=%s, Signature=%s", SigningAlgorithm, accessKeyID, strings.Join(signed, ";"), signature))
+
+	return nil
+}
+
+// CanonicalRequest returns the canonical form of r that is hashed into the string to sign, see SigningScheme
+func (s SigningScheme) CanonicalRequest(r *http.Request, signedHeaders []string, body []byte) string {
+	signedHeaders = canonicalHeaderNames(signedHeaders)
+
+	lines := make([]string, 0, len(signedHeaders)+5)
+	lines = append(lines, strings.ToUpper(r.Method), canonicalPath(r.URL), canonicalQuery(r.URL))
+
+	for _, name := range signedHeaders {
+		lines = append(lines, name+":"+canonicalHeaderValue(r, name))
+	}
+
+	bodyHash := sha256.Sum256(body)
+
+	lines = append(lines, strings.Join(signedHeaders, ";"), hex.EncodeToString(bodyHash[:]))
+
+	return strings.Join(lines, "\n")
+}
+
+// StringToSign returns the string that is signed for a request signed at timestamp, see SigningScheme
+func (s SigningScheme) StringToSign(timestamp, canonicalRequest string) string {
+	hash := sha256.Sum256([]byte(canonicalRequest))
+
+	return SigningAlgorithm + "\n" + timestamp + "\n" + hex.EncodeToString(hash[:])
+}
+
+// signature returns the signature of a canonical request in lower case hex
+func (s SigningScheme) signature(secret []byte, timestamp, canonicalRequest string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(s.StringToSign(timestamp, canonicalRequest)))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignedRequestMiddleware is a Middleware that authenticates machine clients by the signatures of their requests
+// (see SigningScheme for how requests are signed), with the secrets of their access keys resolved by keys. A
+// verified request's access key ID is set on the Ctx under AccessKeyIDKey. Other requests fail with a 401 and a
+// SignatureError, whose code says whether the signature is missing or malformed, has expired, is for an unknown
+// access key, doesn't match, or has been replayed. If keys fails, requests fail with a 503
+func SignedRequestMiddleware(scheme SigningScheme, keys KeyResolver) Middleware {
+	scheme = scheme.withDefaults()
+	nonces := newNonceCache(scheme.MaxNonces)
+
+	return Named("signature", func(inner HandlerFunc) HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request, ctx *Ctx) error {
+			accessKeyID, err := scheme.verify(ctx, r, keys, nonces)
+			if err != nil {
+				ctx.Log.Debug("[vk] rejected signed request:", err.Error())
+				ctx.RespHeaders.Set("WWW-Authenticate", SigningAlgorithm)
+
+				return err
+			}
+
+			ctx.Set(AccessKeyIDKey, accessKeyID)
+
+			return inner(w, r, ctx)
+		}
+	})
+}
+
+// verify returns the access key ID of a request whose signature is valid
+func (s SigningScheme) verify(ctx context.Context, r *http.Request, keys KeyResolver, nonces *nonceCache) (string, error) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, SigningAlgorithm+" ") {
+		return "", signatureError(SignatureMissing)
+	}
+
+	accessKeyID, signedHeaders, signature, ok := parseSignedAuthorization(strings.TrimPrefix(auth, SigningAlgorithm+" "))
+	if !ok || !containsAll(signedHeaders, s.requiredHeaders()) {
+		return "", signatureError(SignatureMalformed)
+	}
+
+	timestamp := r.Header.Get(s.DateHeader)
+
+	signedAt, err := time.Parse(signingTimeFormat, timestamp)
+	if err != nil {
+		return "", signatureError(SignatureMalformed)
+	}
+
+	nonce := r.Header.Get(s.NonceHeader)
+	if nonce == "" || len(nonce) > maxSigningNonceLength {
+		return "", signatureError(SignatureMalformed)
+	}
+
+	now := s.Now()
+	if skew := now.Sub(signedAt); skew > s.MaxSkew || skew < -s.MaxSkew {
+		return "", signatureError(SignatureExpired)
+	}
+
+	secret, err := keys.ResolveKey(ctx, accessKeyID)
+	if errors.Is(err, ErrUnknownAccessKey) {
+		return "", signatureError(SignatureUnknownKey)
+	} else if err != nil {
+		return "", signatureError(signatureUnverified)
+	}
+
+	body, err := readSignedBody(r, s.MaxBodyBytes)
+	if err != nil {
+		return "", err
+	}
+
+	expected := s.signature(secret, timestamp, s.CanonicalRequest(r, signedHeaders, body))
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(signature))) {
+		return "", signatureError(SignatureMismatch)
+	}
+
+	// nonces are only recorded for valid signatures, so that unsigned requests can't use them up
+	if code := nonces.use(accessKeyID, nonce, signedAt.Add(s.MaxSkew), now); code != "" {
+		return "", signatureError(code)
+	}
+
+	return accessKeyID, nil
+}
+
+// parseSignedAuthorization parses the parameters of the Authorization header after the algorithm
+func parseSignedAuthorization(params string) (accessKeyID string, signedHeaders []string, signature string, ok bool) {
+	for _, param := range strings.Split(params, ",") {
+		name, value, found := strings.Cut(strings.TrimSpace(param), "=")
+		if !found {
+			return "", nil, "", false
+		}
+
+		switch name {
+		case "Credential":
+			accessKeyID = value
+		case "SignedHeaders":
+			signedHeaders = strings.Split(value, ";")
+		case "Signature":
+			signature = value
+		}
+	}
+
+	if accessKeyID == "" || len(signedHeaders) == 0 || signature == "" {
+		return "", nil, "", false
+	}
+
+	return accessKeyID, canonicalHeaderNames(signedHeaders), signature, true
+}
+
+// readSignedBody reads the body of r to hash it, replacing it with a copy, and fails with a 413 if it is longer
+// than maxBytes, unless maxBytes is negative
+func readSignedBody(r *http.Request, maxBytes int64) ([]byte, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+
+	reader := io.Reader(r.Body)
+	if maxBytes >= 0 {
+		reader = io.LimitReader(r.Body, maxBytes+1)
+	}
+
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, E(http.StatusBadRequest, "failed to read request body")
+	}
+
+	_ = r.Body.Close()
+
+	if maxBytes >= 0 && int64(len(body)) > maxBytes {
+		return nil, E(http.StatusRequestEntityTooLarge, fmt.Sprintf("request body exceeds %d bytes", maxBytes))
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	return body, nil
+}
+
+// canonicalHeaderNames returns the names in lower case, sorted and without duplicates or empty names
+func canonicalHeaderNames(names []string) []string {
+	canonical := make([]string, 0, len(names))
+
+	for _, name := range names {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			canonical = append(canonical, name)
+		}
+	}
+
+	sort.Strings(canonical)
+
+	unique := canonical[:0]
+	for i, name := range canonical {
+		if i == 0 || name != canonical[i-1] {
+			unique = append(unique, name)
+		}
+	}
+
+	return unique
+}
+
+func canonicalPath(u *url.URL) string {
+	if u.Path == "" {
+		return "/"
+	}
+
+	return signingEncode(u.Path, true)
+}
+
+func canonicalQuery(u *url.URL) string {
+	if u.RawQuery == "" {
+		return ""
+	}
+
+	type pair struct{ name, value string }
+
+	pairs := []pair{}
+
+	for _, part := range strings.Split(u.RawQuery, "&") {
+		if part == "" {
+			continue
+		}
+
+		name, value, _ := strings.Cut(part, "=")
+
+		pairs = append(pairs, pair{name: signingEncode(queryUnescape(name), false), value: signingEncode(queryUnescape(value), false)})
+	}
+
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].name != pairs[j].name {
+			return pairs[i].name < pairs[j].name
+		}
+
+		return pairs[i].value < pairs[j].value
+	})
+
+	encoded := make([]string, len(pairs))
+	for i, p := range pairs {
+		encoded[i] = p.name + "=" + p.value
+	}
+
+	return strings.Join(encoded, "&")
+}
+
+// queryUnescape decodes a query name or value, keeping it as it is if it isn't valid
+func queryUnescape(s string) string {
+	if unescaped, err := url.QueryUnescape(s); err == nil {
+		return unescaped
+	}
+
+	return s
+}
+
+func canonicalHeaderValue(r *http.Request, name string) string {
+	if name == "host" {
+		return strings.TrimSpace(r.Host)
+	}
+
+	values := r.Header.Values(name)
+
+	canonical := make([]string, len(values))
+	for i, v := range values {
+		canonical[i] = strings.Join(strings.Fields(v), " ")
+	}
+
+	return strings.Join(canonical, ",")
+}
+
+// signingEncode percent-encodes every byte of s but the unreserved characters of RFC 3986, and / if keepSlash is set
+func signingEncode(s string, keepSlash bool) string {
+	const hexDigits = "0123456789ABCDEF"
+
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '.', c == '_', c == '~':
+			b.WriteByte(c)
+		case c == '/' && keepSlash:
+			b.WriteByte(c)
+		default:
+			b.WriteByte('%')
+			b.WriteByte(hexDigits[c>>4])
+			b.WriteByte(hexDigits[c&15])
+		}
+	}
+
+	return b.String()
+}
+
+// containsAll returns true if every one of required is in names
+func containsAll(names, required []string) bool {
+	for _, r := range required {
+		found := false
+
+		for _, n := range names {
+			if n == r {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// nonceCache remembers the nonces of signed requests by access key until their signatures expire, so that the
+// requests of one access key can't make another's be forgotten
+type nonceCache struct {
+	lock sync.Mutex
+	max  int
+	keys map[string]*keyNonces
+}
+
+// keyNonces are the nonces of one access key
+type keyNonces struct {
+	seen  map[string]bool
+	order []nonceEntry // in the order they were used, to forget the oldest first
+}
+
+type nonceEntry struct {
+	nonce   string
+	expires time.Time
+}
+
+func newNonceCache(max int) *nonceCache {
+	n := &nonceCache{
+		max:  max,
+		keys: map[string]*keyNonces{},
+	}
+
+	return n
+}
+
+// use records the nonce of accessKeyID until expires. It returns SignatureReplayed if the nonce was already
+// recorded, SignatureTooMany if the access key has max unexpired nonces, and an empty string otherwise
+func (n *nonceCache) use(accessKeyID, nonce string, expires, now time.Time) string {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	key := n.keys[accessKeyID]
+	if key == nil {
+		key = &keyNonces{seen: map[string]bool{}}
+		n.keys[accessKeyID] = key
+	}
+
+	// signatures expire in about the order they're received, so the expired nonces are at the front
+	for len(key.order) > 0 && key.order[0].expires.Before(now) {
+		delete(key.seen, key.order[0].nonce)
+		key.order = key.order[1:]
+	}
+
+	if key.seen[nonce] {
+		return SignatureReplayed
+	}
+
+	if len(key.seen) >= n.max {
+		return SignatureTooMany
+	}
+
+	key.seen[nonce] = true
+	key.order = append(key.order, nonceEntry{nonce: nonce, expires: expires})
+
+	return ""
+}
@@ -0,0 +1,229 @@
+package vk
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// RouteSnapshotVersion is the version of the RouteSnapshot format, which changes whenever snapshots of the same
+// route table would be serialized differently
+const RouteSnapshotVersion = 1
+
+// RouteSnapshot is a deterministic description of a route table, for detecting changes to it (i.e. in CI). It holds
+// the public contract of each route, and none of the configuration of its middleware, so it only changes when the
+// routes do
+type RouteSnapshot struct {
+	Version int             `json:"version"`
+	Routes  []SnapshotRoute `json:"routes"`
+
+	// Build describes the binary that served the routes. It is only set in dumps written at startup (see
+	// UseRouteDump), and isn't compared by DiffSnapshots
+	Build *OpsVersion `json:"build,omitempty"`
+}
+
+// SnapshotRoute describes a route in a RouteSnapshot
+type SnapshotRoute struct {
+	Method     string   `json:"method"`
+	Path       string   `json:"path"`
+	Middleware []string `json:"middleware"`       // the names of the route's middleware, outermost first
+	Flags      []string `json:"flags,omitempty"`  // the feature flags that gate the route, sorted
+	Ops        bool     `json:"ops,omitempty"`    // the route is an operational endpoint, see OpsGroup
+	Domain     string   `json:"domain,omitempty"` // the route's isolation domain, if it isn't DefaultDomain
+}
+
+func (r SnapshotRoute) String() string {
+	return r.Method + " " + r.Path
+}
+
+// RouteChange describes a route that is in both snapshots given to DiffSnapshots, but differs between them
+type RouteChange struct {
+	Method string        `json:"method"`
+	Path   string        `json:"path"`
+	Fields []string      `json:"fields"` // the names of the fields that changed, i.e. middleware
+	Old    SnapshotRoute `json:"old"`
+	New    SnapshotRoute `json:"new"`
+}
+
+// RouteDiff lists the differences between two RouteSnapshots, each sorted by path and then method
+type RouteDiff struct {
+	Added    []SnapshotRoute `json:"added"`
+	Removed  []SnapshotRoute `json:"removed"`
+	Modified []RouteChange   `json:"modified"`
+}
+
+// Empty returns true if the snapshots that were compared describe the same routes
+func (d RouteDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Modified) == 0
+}
+
+// String lists the differences one per line, prefixed with + for additions, - for removals and ~ for modifications
+func (d RouteDiff) String() string {
+	lines := []string{}
+
+	for _, r := range d.Removed {
+		lines = append(lines, "- "+r.String())
+	}
+
+	for _, r := range d.Added {
+		lines = append(lines, "+ "+r.String())
+	}
+
+	for _, c := range d.Modified {
+		lines = append(lines, fmt.Sprintf("~ %s %s (%s)", c.Method, c.Path, strings.Join(c.Fields, ", ")))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// Snapshot returns a RouteSnapshot of the Router's routes. Routes are sorted by path and then method, so snapshots
+// don't depend on the order that routes and groups were added in
+func (rt *Router) Snapshot() RouteSnapshot {
+	handlers := rt.RouteGroup.httpRouteHandlers()
+
+	snapshot := RouteSnapshot{
+		Version: RouteSnapshotVersion,
+		Routes:  make([]SnapshotRoute, len(handlers)),
+	}
+
+	for i, r := range handlers {
+		middleware := TraceChain(r.wrapped())
+
+		snapshot.Routes[i] = SnapshotRoute{
+			Method:     r.Method,
+			Path:       r.Path,
+			Middleware: middleware[:len(middleware)-1],
+			Flags:      routeFlags(r),
+			Ops:        r.inGroup(func(g *RouteGroup) bool { return g.ops }),
+			Domain:     snapshotDomain(r),
+		}
+	}
+
+	sortSnapshotRoutes(snapshot.Routes)
+
+	return snapshot
+}
+
+// DiffSnapshots compares two snapshots of a route table. Routes are matched by method and path, so a route whose
+// path changes (even only the name of a parameter) is removed and another added
+func DiffSnapshots(old, new RouteSnapshot) RouteDiff {
+	diff := RouteDiff{
+		Added:    []SnapshotRoute{},
+		Removed:  []SnapshotRoute{},
+		Modified: []RouteChange{},
+	}
+
+	before := map[string]SnapshotRoute{}
+	for _, r := range old.Routes {
+		before[r.String()] = r
+	}
+
+	after := map[string]SnapshotRoute{}
+	for _, r := range new.Routes {
+		after[r.String()] = r
+	}
+
+	for key, r := range after {
+		prev, existed := before[key]
+		if !existed {
+			diff.Added = append(diff.Added, r)
+			continue
+		}
+
+		if fields := changedFields(prev, r); len(fields) > 0 {
+			diff.Modified = append(diff.Modified, RouteChange{Method: r.Method, Path: r.Path, Fields: fields, Old: prev, New: r})
+		}
+	}
+
+	for key, r := range before {
+		if _, exists := after[key]; !exists {
+			diff.Removed = append(diff.Removed, r)
+		}
+	}
+
+	sortSnapshotRoutes(diff.Added)
+	sortSnapshotRoutes(diff.Removed)
+
+	sort.Slice(diff.Modified, func(i, j int) bool {
+		return routeLess(diff.Modified[i].New, diff.Modified[j].New)
+	})
+
+	return diff
+}
+
+// changedFields returns the names of the fields that differ between the two versions of a route
+func changedFields(old, new SnapshotRoute) []string {
+	var fields []string
+
+	if !reflect.DeepEqual(nonNil(old.Middleware), nonNil(new.Middleware)) {
+		fields = append(fields, "middleware")
+	}
+
+	if !reflect.DeepEqual(nonNil(old.Flags), nonNil(new.Flags)) {
+		fields = append(fields, "flags")
+	}
+
+	if old.Ops != new.Ops {
+		fields = append(fields, "ops")
+	}
+
+	if old.Domain != new.Domain {
+		fields = append(fields, "domain")
+	}
+
+	return fields
+}
+
+// nonNil returns s, or an empty slice if it is nil, so that routes decoded from JSON compare equal to fresh ones
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+
+	return s
+}
+
+// snapshotDomain returns the route's isolation domain, or nothing for DefaultDomain so that the snapshots of routes
+// without one are unchanged
+func snapshotDomain(r httpRouteHandler) string {
+	if domain := routeDomain(r); domain != DefaultDomain {
+		return domain
+	}
+
+	return ""
+}
+
+// routeFlags returns the sorted, distinct flags of every group of the route
+func routeFlags(r httpRouteHandler) []string {
+	seen := map[string]bool{}
+
+	var flags []string
+
+	for _, g := range r.groups {
+		for _, f := range g.flags {
+			if !seen[f] {
+				seen[f] = true
+				flags = append(flags, f)
+			}
+		}
+	}
+
+	sort.Strings(flags)
+
+	return flags
+}
+
+func sortSnapshotRoutes(routes []SnapshotRoute) {
+	sort.SliceStable(routes, func(i, j int) bool {
+		return routeLess(routes[i], routes[j])
+	})
+}
+
+func routeLess(a, b SnapshotRoute) bool {
+	if a.Path != b.Path {
+		return a.Path < b.Path
+	}
+
+	return a.Method < b.Method
+}
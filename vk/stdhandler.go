@@ -0,0 +1,83 @@
+package vk
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/suborbital/vektor/vlog"
+)
+
+// stdContextKey is the type of the keys under which WrapStdHandlerWithCtx stores request details
+type stdContextKey string
+
+const (
+	// CtxKey is the request context key of the vk Ctx for handlers wrapped with WrapStdHandlerWithCtx
+	CtxKey = stdContextKey("vk.ctx")
+
+	// RequestIDKey is the request context key of the request ID (a string), see also Router.PropagateToContext
+	RequestIDKey = stdContextKey("vk.request-id")
+
+	// LoggerKey is the request context key of the request's scoped *vlog.Logger
+	LoggerKey = stdContextKey("vk.logger")
+)
+
+// WrapStdHandlerWithCtx adapts a standard http.Handler (such as a GraphQL server) into a HandlerFunc, so that it
+// runs behind vk middleware and its panics are recovered and tracked by the router like any other handler.
+//
+// The Ctx, request ID and logger are added to the request's context under CtxKey, RequestIDKey and LoggerKey, and
+// values set on the Ctx by middleware (such as auth claims) can be looked up from the request's context too
+func WrapStdHandlerWithCtx(h http.Handler) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, ctx *Ctx) error {
+		h.ServeHTTP(w, r.WithContext(stdHandlerContext(r.Context(), ctx)))
+
+		return nil
+	}
+}
+
+// CtxFromContext returns the vk Ctx stored by WrapStdHandlerWithCtx, or nil
+func CtxFromContext(c context.Context) *Ctx {
+	ctx, _ := c.Value(CtxKey).(*Ctx)
+	return ctx
+}
+
+// RequestIDFromContext returns the request ID from a request's context, or an empty string
+func RequestIDFromContext(c context.Context) string {
+	id, _ := c.Value(RequestIDKey).(string)
+	return id
+}
+
+// LoggerFromContext returns the logger stored by WrapStdHandlerWithCtx, or a no-op logger
+func LoggerFromContext(c context.Context) *vlog.Logger {
+	if log, ok := c.Value(LoggerKey).(*vlog.Logger); ok && log != nil {
+		return log
+	}
+
+	return vlog.Noop()
+}
+
+// valuesContext is the request's context, falling back to the Ctx's context for any values it doesn't hold
+type valuesContext struct {
+	context.Context
+	fallback context.Context
+}
+
+func (v valuesContext) Value(key interface{}) interface{} {
+	if val := v.Context.Value(key); val != nil {
+		return val
+	}
+
+	return v.fallback.Value(key)
+}
+
+func stdHandlerContext(parent context.Context, ctx *Ctx) context.Context {
+	c := parent
+	if ctx.Context != nil {
+		c = valuesContext{Context: parent, fallback: ctx.Context}
+	}
+
+	c = context.WithValue(c, CtxKey, ctx)
+	c = context.WithValue(c, RequestIDKey, ctx.RequestID())
+	c = context.WithValue(c, LoggerKey, ctx.Log)
+
+	return c
+}
@@ -0,0 +1,189 @@
+package vk
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	eventStreamContentType = "text/event-stream"
+	streamContentType      = "application/octet-stream"
+	streamChunkSize        = 32 << 10
+)
+
+// RespondStream copies src to the client as it is read, flushing after each chunk, rather than buffering the whole
+// body, such as to send a large file or relay a long response. The response is sent with statusCode and contentType
+// (application/octet-stream if empty), which is never detected from the body. Headers set by middleware before the
+// handler runs are sent with it.
+//
+// If src fails before anything is read from it, the error is returned as usual. Once the response has started its
+// status can't be changed, so a failure is logged and the connection is closed, so that the client can tell that
+// the response is incomplete. A client disconnecting ends the stream and is not an error. src isn't closed
+func RespondStream(ctx *Ctx, w http.ResponseWriter, src io.Reader, contentType string, statusCode int) error {
+	if contentType == "" {
+		contentType = streamContentType
+	}
+
+	buf := make([]byte, streamChunkSize)
+	started := false
+
+	for {
+		n, readErr := src.Read(buf)
+
+		if readErr != nil && readErr != io.EOF {
+			if !started {
+				return errors.Wrap(readErr, "failed to Read stream")
+			}
+
+			ctx.Log.Error(errors.Wrap(readErr, "[vk] stream aborted"))
+			panic(http.ErrAbortHandler)
+		}
+
+		if !started && (n > 0 || readErr == io.EOF) {
+			started = true
+
+			w.Header().Set(contentTypeHeaderKey, contentType)
+			w.Header().Del("Content-Length")
+			w.WriteHeader(statusCode)
+		}
+
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				ctx.Log.Debug("stream stopped:", err.Error())
+				return nil
+			}
+
+			flushStream(w)
+		}
+
+		if readErr == io.EOF {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			ctx.Log.Debug("stream stopped: the client went away")
+			return nil
+		default:
+		}
+	}
+}
+
+// Event is a Server-Sent Event, see SSE
+type Event struct {
+	ID    string        // sets the client's last event ID, sent back when it reconnects
+	Event string        // the type of the event, "message" if empty
+	Data  string        // sent as one data line per line
+	Retry time.Duration // how long the client waits before reconnecting, unchanged if 0
+}
+
+// SSE returns a HandlerFunc that streams the events sent by produce to the client as Server-Sent Events
+// (text/event-stream), flushing each one as soon as it is written:
+//
+//	server.GET("/events", vk.SSE(func(ctx *vk.Ctx, events chan<- vk.Event) error {
+//		for {
+//			select {
+//			case job := <-jobs:
+//				events <- vk.Event{Event: "job", Data: job.JSON()}
+//			case <-ctx.Done(): // the client went away
+//				return nil
+//			}
+//		}
+//	}))
+//
+// The response starts straight away, with any headers set by middleware. The stream ends once produce returns,
+// which it must do once ctx is done, and it must not send events after returning. An error it returns is logged,
+// since the status has already been sent, and a panic is recovered like a handler's. If the client goes away, events
+// are discarded until produce returns
+func SSE(produce func(ctx *Ctx, events chan<- Event) error) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, ctx *Ctx) error {
+		w.Header().Set(contentTypeHeaderKey, eventStreamContentType)
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no") // stops reverse proxies such as nginx buffering the stream
+		w.Header().Del("Content-Length")
+		w.WriteHeader(http.StatusOK)
+		flushStream(w)
+
+		events := make(chan Event)
+		done := make(chan error, 1)
+
+		var panicked interface{}
+
+		go func() {
+			defer close(events)
+
+			// a panic is re-raised from the request's goroutine, where the router recovers it
+			defer func() {
+				if panicked = recover(); panicked != nil {
+					done <- nil
+				}
+			}()
+
+			done <- produce(ctx, events)
+		}()
+
+		var b strings.Builder
+
+		for event := range events {
+			b.Reset()
+			writeEvent(&b, event)
+
+			if _, err := io.WriteString(w, b.String()); err != nil {
+				ctx.Log.Debug("event stream stopped:", err.Error())
+				break
+			}
+
+			flushStream(w)
+		}
+
+		// if the client went away, the producer is unblocked until it notices
+		for range events {
+		}
+
+		if err := <-done; err != nil {
+			ctx.Log.Error(errors.Wrap(err, "[vk] event stream failed"))
+		}
+
+		repanic(panicked)
+
+		return nil
+	}
+}
+
+// writeEvent writes the event in the text/event-stream format. Line breaks can't be escaped, so they are removed
+// from the single line fields, and split the data into several lines
+func writeEvent(b *strings.Builder, event Event) {
+	singleLine := strings.NewReplacer("\r", "", "\n", "")
+
+	if event.ID != "" {
+		b.WriteString("id: " + singleLine.Replace(event.ID) + "\n")
+	}
+
+	if event.Event != "" {
+		b.WriteString("event: " + singleLine.Replace(event.Event) + "\n")
+	}
+
+	if event.Retry > 0 {
+		b.WriteString("retry: " + strconv.FormatInt(event.Retry.Milliseconds(), 10) + "\n")
+	}
+
+	data := strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(event.Data)
+
+	for _, line := range strings.Split(data, "\n") {
+		b.WriteString("data: " + line + "\n")
+	}
+
+	b.WriteString("\n")
+}
+
+// flushStream sends what has been written to the client, if w supports flushing
+func flushStream(w http.ResponseWriter) {
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
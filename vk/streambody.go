@@ -0,0 +1,340 @@
+package vk
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const streamBufferSize = 32 * 1024
+
+// ChecksumAlgorithm is a checksum that StreamBodyTo can compute
+type ChecksumAlgorithm string
+
+const (
+	ChecksumMD5    ChecksumAlgorithm = "md5"
+	ChecksumSHA1   ChecksumAlgorithm = "sha1"
+	ChecksumSHA256 ChecksumAlgorithm = "sha256"
+	ChecksumCRC32  ChecksumAlgorithm = "crc32"
+	ChecksumCRC32C ChecksumAlgorithm = "crc32c"
+)
+
+// checksumHeaders are the request headers with client-supplied checksums, and their algorithms
+var checksumHeaders = []struct {
+	header    string
+	algorithm ChecksumAlgorithm
+}{
+	{"Content-MD5", ChecksumMD5},
+	{"X-Amz-Checksum-Sha1", ChecksumSHA1},
+	{"X-Amz-Checksum-Sha256", ChecksumSHA256},
+	{"X-Amz-Checksum-Crc32", ChecksumCRC32},
+	{"X-Amz-Checksum-Crc32c", ChecksumCRC32C},
+}
+
+// StreamResult is the outcome of StreamBodyTo
+type StreamResult struct {
+	Bytes     int64                        // the bytes written to the destination
+	WireBytes int64                        // the bytes read from the request, which differ if it was decompressed
+	Digests   map[ChecksumAlgorithm][]byte // the checksums of the bytes written to the destination, see WithChecksums
+}
+
+// Digest returns the base64-encoded checksum computed with algorithm (the form storage APIs such as S3 expect), or
+// an empty string if it wasn't computed
+func (s StreamResult) Digest(algorithm ChecksumAlgorithm) string {
+	sum, ok := s.Digests[algorithm]
+	if !ok {
+		return ""
+	}
+
+	return base64.StdEncoding.EncodeToString(sum)
+}
+
+// StreamOption configures StreamBodyTo
+type StreamOption func(*streamOptions)
+
+type streamOptions struct {
+	checksums  []ChecksumAlgorithm
+	maxBytes   int64
+	progress   func(copied int64)
+	decompress bool
+}
+
+// WithChecksums computes the checksums of the body with algorithms, see StreamResult.Digests. The checksums the
+// client sent are also included, unless the body was decompressed
+func WithChecksums(algorithms ...ChecksumAlgorithm) StreamOption {
+	return func(o *streamOptions) {
+		o.checksums = append(o.checksums, algorithms...)
+	}
+}
+
+// WithMaxBytes limits the body to maxBytes (after decompression), larger bodies are rejected with 413
+func WithMaxBytes(maxBytes int64) StreamOption {
+	return func(o *streamOptions) {
+		o.maxBytes = maxBytes
+	}
+}
+
+// WithProgress calls progress with the number of bytes written to the destination so far, after each write
+func WithProgress(progress func(copied int64)) StreamOption {
+	return func(o *streamOptions) {
+		o.progress = progress
+	}
+}
+
+// WithDecompression decompresses bodies sent with Content-Encoding: gzip, so that the destination receives (and the
+// size limit and checksums apply to) the decompressed bytes. Client-supplied checksums are still verified against
+// the body as it was sent. Bodies with any other Content-Encoding are rejected with 415
+func WithDecompression() StreamOption {
+	return func(o *streamOptions) {
+		o.decompress = true
+	}
+}
+
+// StreamBodyTo copies the request body to w as it arrives, without buffering it, returning the number of bytes
+// copied and the checksums requested with WithChecksums. Checksums sent by the client in Content-MD5 or
+// x-amz-checksum-* headers are always verified, and a mismatch returns a 400 vk.Error. Because verification happens
+// once the body has been read, w has received the whole body by then, and the handler must discard what was
+// written when an error is returned. Bodies larger than WithMaxBytes return a 413 vk.Error, bodies that end before
+// their Content-Length (i.e. the client went away) return a 400 vk.Error, and errors from w are returned as they
+// are. The result is valid whether or not an error is returned
+func (c *Ctx) StreamBodyTo(w io.Writer, opts ...StreamOption) (StreamResult, error) {
+	options := streamOptions{}
+	for _, o := range opts {
+		o(&options)
+	}
+
+	result := StreamResult{Digests: map[ChecksumAlgorithm][]byte{}}
+
+	if c == nil || c.request == nil || c.request.Body == nil {
+		return result, E(http.StatusBadRequest, "request body is empty")
+	}
+
+	r := c.request
+
+	if options.maxBytes > 0 && r.ContentLength > options.maxBytes && !options.decompress {
+		return result, E(http.StatusRequestEntityTooLarge, http.StatusText(http.StatusRequestEntityTooLarge))
+	}
+
+	expected, err := clientChecksums(r.Header)
+	if err != nil {
+		return result, err
+	}
+
+	encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+	decompress := options.decompress && encoding != "" && encoding != "identity"
+
+	if decompress && encoding != "gzip" {
+		return result, E(http.StatusUnsupportedMediaType, fmt.Sprintf("unsupported Content-Encoding %q", encoding))
+	}
+
+	// the body's checksums are computed from the bytes written to w, unless the client's checksums are of the
+	// compressed body, which then needs its own
+	digests := newHashes(options.checksums)
+	wireHashes := digests
+
+	if decompress {
+		wireHashes = newHashes(nil)
+	}
+
+	for algorithm := range expected {
+		wireHashes.add(algorithm)
+	}
+
+	wire := &countingReader{r: r.Body}
+
+	var src io.Reader = io.TeeReader(wire, wireHashes)
+
+	if decompress {
+		gz, err := gzip.NewReader(src)
+		if err != nil {
+			result.WireBytes = wire.n
+			return result, c.streamReadError(err)
+		}
+
+		defer gz.Close()
+
+		src = gz
+	}
+
+	buf := make([]byte, streamBufferSize)
+
+	for {
+		n, readErr := src.Read(buf)
+		if n > 0 {
+			if options.maxBytes > 0 && result.Bytes+int64(n) > options.maxBytes {
+				result.WireBytes = wire.n
+				return result, E(http.StatusRequestEntityTooLarge, http.StatusText(http.StatusRequestEntityTooLarge))
+			}
+
+			if decompress {
+				_, _ = digests.Write(buf[:n])
+			}
+
+			written, err := w.Write(buf[:n])
+			result.Bytes += int64(written)
+
+			if err != nil {
+				result.WireBytes = wire.n
+				return result, errors.Wrap(err, "failed to Write")
+			}
+
+			if options.progress != nil {
+				options.progress(result.Bytes)
+			}
+		}
+
+		if readErr == io.EOF {
+			break
+		}
+
+		if readErr != nil {
+			result.WireBytes = wire.n
+			return result, c.streamReadError(readErr)
+		}
+	}
+
+	if decompress {
+		// the gzip stream can end before the body does, whose remaining bytes are still covered by the checksums
+		if _, err := io.Copy(io.Discard, src); err != nil {
+			result.WireBytes = wire.n
+			return result, c.streamReadError(err)
+		}
+
+		_, _ = io.Copy(io.Discard, io.TeeReader(wire, wireHashes))
+	}
+
+	result.WireBytes = wire.n
+	result.Digests = digests.sums()
+
+	actual := wireHashes.sums()
+
+	for _, h := range checksumHeaders {
+		want, ok := expected[h.algorithm]
+		if !ok {
+			continue
+		}
+
+		if !bytes.Equal(want, actual[h.algorithm]) {
+			return result, E(http.StatusBadRequest, fmt.Sprintf("the body does not match the checksum in %s", h.header))
+		}
+	}
+
+	return result, nil
+}
+
+// streamReadError converts an error reading the body to a vk.Error
+func (c *Ctx) streamReadError(err error) error {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return E(http.StatusRequestEntityTooLarge, http.StatusText(http.StatusRequestEntityTooLarge))
+	}
+
+	if err == io.ErrUnexpectedEOF {
+		return E(http.StatusBadRequest, "the request body ended early")
+	}
+
+	c.Log.Debug("failed to read request body:", err.Error())
+
+	return E(http.StatusBadRequest, "failed to read request body")
+}
+
+// clientChecksums decodes the checksums sent in the request's headers
+func clientChecksums(header http.Header) (map[ChecksumAlgorithm][]byte, error) {
+	expected := map[ChecksumAlgorithm][]byte{}
+
+	for _, h := range checksumHeaders {
+		value := header.Get(h.header)
+		if value == "" {
+			continue
+		}
+
+		sum, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+		if err != nil || len(sum) != newHash(h.algorithm).Size() {
+			return nil, E(http.StatusBadRequest, fmt.Sprintf("invalid %s header", h.header))
+		}
+
+		expected[h.algorithm] = sum
+	}
+
+	return expected, nil
+}
+
+// hashes computes several checksums of the same bytes
+type hashes map[ChecksumAlgorithm]hash.Hash
+
+func newHashes(algorithms []ChecksumAlgorithm) hashes {
+	h := hashes{}
+	for _, algorithm := range algorithms {
+		h.add(algorithm)
+	}
+
+	return h
+}
+
+func (h hashes) add(algorithm ChecksumAlgorithm) {
+	if _, ok := h[algorithm]; !ok {
+		if hash := newHash(algorithm); hash != nil {
+			h[algorithm] = hash
+		}
+	}
+}
+
+func (h hashes) Write(p []byte) (int, error) {
+	for _, hash := range h {
+		hash.Write(p)
+	}
+
+	return len(p), nil
+}
+
+func (h hashes) sums() map[ChecksumAlgorithm][]byte {
+	sums := map[ChecksumAlgorithm][]byte{}
+
+	for algorithm, hash := range h {
+		sums[algorithm] = hash.Sum(nil)
+	}
+
+	return sums
+}
+
+// newHash returns a hash for algorithm, or nil if it isn't known
+func newHash(algorithm ChecksumAlgorithm) hash.Hash {
+	switch algorithm {
+	case ChecksumMD5:
+		return md5.New()
+	case ChecksumSHA1:
+		return sha1.New()
+	case ChecksumSHA256:
+		return sha256.New()
+	case ChecksumCRC32:
+		return crc32.NewIEEE()
+	case ChecksumCRC32C:
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	}
+
+	return nil
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+
+	return n, err
+}
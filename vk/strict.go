@@ -0,0 +1,71 @@
+package vk
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// useStrictResponses sets whether handlers that neither respond nor return an error are treated as failures
+func (rt *Router) useStrictResponses(strict bool) {
+	rt.strictResponses = strict
+}
+
+// respondedWriter records whether a handler has started its response
+type respondedWriter struct {
+	http.ResponseWriter
+	responded bool
+}
+
+func (rw *respondedWriter) WriteHeader(status int) {
+	rw.responded = true
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *respondedWriter) Write(b []byte) (int, error) {
+	rw.responded = true
+	return rw.ResponseWriter.Write(b)
+}
+
+// ReadFrom copies from src using the underlying ResponseWriter's ReadFrom if it has one, see readFrom
+func (rw *respondedWriter) ReadFrom(src io.Reader) (int64, error) {
+	rw.responded = true
+	return readFrom(rw.ResponseWriter, src)
+}
+
+// Flush flushes the underlying ResponseWriter if it supports flushing
+func (rw *respondedWriter) Flush() {
+	rw.responded = true
+
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack hijacks the underlying ResponseWriter's connection, after which the handler is responsible for the response
+func (rw *respondedWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("ResponseWriter does not implement http.Hijacker")
+	}
+
+	rw.responded = true
+
+	return h.Hijack()
+}
+
+// checkResponded responds with a 500 if the handler returned without writing a response, which in
+// permissive mode would be sent as an empty 200
+func (rw *respondedWriter) checkResponded(r *http.Request, ctx *Ctx) {
+	if rw.responded {
+		return
+	}
+
+	ctx.Log.ErrorString(fmt.Sprintf("[vk] %s %s returned without writing a response or returning an error", r.Method, r.URL.Path))
+
+	respondError(rw, r, ctx.errorFormatter, E(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError)))
+}
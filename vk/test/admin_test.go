@@ -0,0 +1,118 @@
+package test_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+)
+
+func adminTokenMiddleware(inner vk.HandlerFunc) vk.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		if r.Header.Get("X-Admin-Token") != "secret" {
+			return vk.E(http.StatusUnauthorized, "unauthorized")
+		}
+
+		return inner(w, r, ctx)
+	}
+}
+
+func TestAdminRouter(t *testing.T) {
+	publicPort, adminPort := freePort(t), freePort(t)
+	logs := &logCapture{}
+
+	server := vk.New(
+		vk.UseLogger(vlog.Default(vlog.Level(vlog.LogLevelDebug), vlog.WithWriter(logs))),
+		vk.UseHTTPPort(publicPort),
+		vk.UseAdminPort(adminPort),
+	)
+
+	server.GET("/public", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.RespondString(ctx.Context, w, "public", http.StatusOK)
+	})
+
+	quotas := vk.NewQuotas(func(ctx *vk.Ctx) vk.Quota { return vk.Quota{} }, time.Minute)
+
+	server.AdminRouter().WithMiddlewares(adminTokenMiddleware)
+	server.RegisterAdmin(quotas)
+
+	go server.Start()
+
+	defer func() {
+		// pooled connections would otherwise hold up the shutdown
+		http.DefaultClient.CloseIdleConnections()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		assert.NoError(t, server.StopCtx(ctx))
+	}()
+
+	public := fmt.Sprintf("http://127.0.0.1:%d", publicPort)
+	admin := fmt.Sprintf("http://127.0.0.1:%d", adminPort)
+
+	resp := getNoFollow(t, public+"/public")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	t.Run("absent from public port", func(t *testing.T) {
+		resp := getNoFollow(t, public+"/quotas")
+		resp.Body.Close()
+
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("admin middleware", func(t *testing.T) {
+		resp := getNoFollow(t, admin+"/quotas")
+		resp.Body.Close()
+
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+
+	t.Run("admin endpoint", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, admin+"/quotas", nil)
+		require.NoError(t, err)
+
+		req.Header.Set("X-Admin-Token", "secret")
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "[]", string(body))
+	})
+	t.Run("logged quietly", func(t *testing.T) {
+		var public, admin []string
+
+		for _, m := range logs.messages() {
+			switch {
+			case strings.Contains(m, "GET /public completed"):
+				public = append(public, m)
+			case strings.Contains(m, "GET /quotas completed"):
+				admin = append(admin, m)
+			}
+		}
+
+		require.Len(t, public, 1)
+		assert.True(t, strings.HasPrefix(public[0], "(I) "), public[0])
+
+		require.Len(t, admin, 2)
+		for _, m := range admin {
+			assert.True(t, strings.HasPrefix(m, "(D) "), m)
+		}
+	})
+}
@@ -0,0 +1,198 @@
+package test_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+)
+
+// fakePeers is a PeerDirectory whose membership is changed by the test
+type fakePeers struct {
+	lock  sync.Mutex
+	peers []vk.Peer
+}
+
+func (f *fakePeers) Peers() []vk.Peer {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.peers
+}
+
+func (f *fakePeers) set(peers ...vk.Peer) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.peers = peers
+}
+
+func replicas(ids ...string) []vk.Peer {
+	peers := make([]vk.Peer, len(ids))
+	for i, id := range ids {
+		peers[i] = vk.Peer{ID: id, URL: "http://" + id + ".example.com"}
+	}
+
+	return peers
+}
+
+// owners returns the owner of each of n keys
+func owners(n int, peers []vk.Peer) map[string]string {
+	owned := map[string]string{}
+
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("room-%d", i)
+
+		owner, ok := vk.AffinityOwner(key, peers)
+		if ok {
+			owned[key] = owner.ID
+		}
+	}
+
+	return owned
+}
+
+func TestAffinityOwner(t *testing.T) {
+	three := owners(3000, replicas("a", "b", "c"))
+
+	t.Run("balanced", func(t *testing.T) {
+		counts := map[string]int{}
+		for _, owner := range three {
+			counts[owner]++
+		}
+
+		for _, id := range []string{"a", "b", "c"} {
+			assert.InDelta(t, 1000, counts[id], 150, "replica %s owns %d keys", id, counts[id])
+		}
+	})
+
+	t.Run("stable", func(t *testing.T) {
+		reordered := replicas("c", "a", "b")
+		assert.Equal(t, three, owners(3000, reordered), "the order of the list doesn't matter")
+	})
+
+	t.Run("joining", func(t *testing.T) {
+		four := owners(3000, replicas("a", "b", "c", "d"))
+
+		moved := 0
+		for key, owner := range four {
+			if owner != three[key] {
+				assert.Equal(t, "d", owner, "keys only move to the replica that joined")
+				moved++
+			}
+		}
+
+		assert.InDelta(t, 750, moved, 150)
+	})
+
+	t.Run("leaving", func(t *testing.T) {
+		two := owners(3000, replicas("a", "c"))
+
+		for key, owner := range three {
+			if owner != "b" {
+				assert.Equal(t, owner, two[key], "only the keys of the replica that left move")
+			}
+		}
+	})
+
+	_, ok := vk.AffinityOwner("room-1", nil)
+	assert.False(t, ok)
+}
+
+func TestAffinityRedirect(t *testing.T) {
+	peers := &fakePeers{}
+	peers.set(replicas("a", "b", "c")...)
+
+	// find a room owned by each replica once d has joined, which the others also own before it has
+	rooms := map[string]string{}
+	for key, owner := range owners(100, replicas("a", "b", "c", "d")) {
+		rooms[owner] = key
+	}
+
+	require.Len(t, rooms, 4)
+
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+
+	affinity := vk.AffinityRedirectMiddleware("a", peers, func(ctx *vk.Ctx) string {
+		return ctx.Params.ByName("room")
+	})
+
+	g := vk.Group("/rooms").WithMiddlewares(affinity)
+	g.GET("/:room/history", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.RespondString(ctx.Context, w, "history of "+ctx.Params.ByName("room"), http.StatusOK)
+	})
+
+	g.WebSocket("/:room", func(r *http.Request, ctx *vk.Ctx, conn *websocket.Conn) error {
+		return conn.WriteMessage(websocket.TextMessage, []byte("joined"))
+	})
+
+	server.AddGroup(g)
+	require.NoError(t, server.TestStart())
+
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+	get := func(room string) *http.Response {
+		resp, err := client.Get(ts.URL + "/rooms/" + room + "/history?since=10")
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		return resp
+	}
+
+	dial := func(room string) (string, error) {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/rooms/"+room, nil)
+		require.NoError(t, err)
+
+		defer conn.Close()
+
+		_, msg, err := conn.ReadMessage()
+
+		return string(msg), err
+	}
+
+	t.Run("owned", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, get(rooms["a"]).StatusCode)
+
+		msg, err := dial(rooms["a"])
+		require.NoError(t, err)
+		assert.Equal(t, "joined", msg)
+	})
+
+	t.Run("redirected", func(t *testing.T) {
+		resp := get(rooms["b"])
+		assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+		assert.Equal(t, "http://b.example.com/rooms/"+rooms["b"]+"/history?since=10", resp.Header.Get("Location"))
+
+		_, err := dial(rooms["c"])
+
+		closeErr := &websocket.CloseError{}
+		require.ErrorAs(t, err, &closeErr)
+		assert.Equal(t, vk.AffinityCloseCode, closeErr.Code)
+		assert.Equal(t, "http://c.example.com", closeErr.Text)
+	})
+
+	t.Run("membership", func(t *testing.T) {
+		peers.set(replicas("a", "b", "c", "d")...)
+
+		assert.Equal(t, "http://d.example.com/rooms/"+rooms["d"]+"/history?since=10", get(rooms["d"]).Header.Get("Location"))
+		assert.Equal(t, http.StatusOK, get(rooms["a"]).StatusCode, "a replica joining only takes the keys it now owns")
+
+		peers.set(replicas("a")...)
+		assert.Equal(t, http.StatusOK, get(rooms["b"]).StatusCode, "the keys of replicas that left are taken over")
+
+		peers.set()
+		assert.Equal(t, http.StatusOK, get(rooms["c"]).StatusCode, "with no replicas listed, requests are served")
+	})
+}
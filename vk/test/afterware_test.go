@@ -0,0 +1,173 @@
+package test_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+	"github.com/suborbital/vektor/vtest"
+)
+
+// responseLog records the summaries seen by an Afterware
+type responseLog struct {
+	lock      sync.Mutex
+	summaries map[string]vk.ResponseSummary
+	statuses  map[int]int
+}
+
+func newResponseLog() *responseLog {
+	return &responseLog{summaries: map[string]vk.ResponseSummary{}, statuses: map[int]int{}}
+}
+
+func (l *responseLog) afterware(r *http.Request, ctx *vk.Ctx, resp vk.ResponseSummary) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.summaries[r.URL.Path] = resp
+	l.statuses[resp.Status]++
+}
+
+func (l *responseLog) summary(path string) vk.ResponseSummary {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.summaries[path]
+}
+
+func TestAfterware(t *testing.T) {
+	log := newResponseLog()
+
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+
+	g := vk.Group("/api").After(log.afterware)
+
+	g.GET("/json", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.RespondJSON(ctx.Context, w, map[string]string{"hello": "world"}, http.StatusCreated)
+	})
+
+	g.GET("/raw", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		_, err := w.Write([]byte("<html><body>hi</body></html>"))
+		return err
+	})
+
+	g.GET("/error", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.E(http.StatusTeapot, "short and stout")
+	})
+
+	g.GET("/panic", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		panic("oops")
+	})
+
+	g.GET("/empty", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return nil
+	})
+
+	server.AddGroup(g)
+
+	vt := vtest.New(server)
+
+	for _, path := range []string{"/api/json", "/api/json", "/api/raw", "/api/error", "/api/panic", "/api/empty"} {
+		r, _ := http.NewRequest(http.MethodGet, path, nil)
+		vt.Do(r, t)
+	}
+
+	assert.Equal(t, map[int]int{
+		http.StatusCreated:             2,
+		http.StatusOK:                  2,
+		http.StatusTeapot:              1,
+		http.StatusInternalServerError: 1,
+	}, log.statuses)
+
+	jsonResp := log.summary("/api/json")
+	assert.Equal(t, "application/json", jsonResp.ContentType)
+	assert.Equal(t, int64(len(`{"hello":"world"}`)), jsonResp.Bytes)
+	assert.Nil(t, jsonResp.Body, "the body should only be captured by AfterWithBody")
+
+	raw := log.summary("/api/raw")
+	assert.Equal(t, "text/html; charset=utf-8", raw.ContentType, "the content type should be detected")
+
+	errResp := log.summary("/api/error")
+	assert.Equal(t, http.StatusTeapot, errResp.Status)
+	assert.NotZero(t, errResp.Bytes)
+
+	assert.Zero(t, log.summary("/api/empty").Bytes)
+}
+
+func TestAfterwareWithBody(t *testing.T) {
+	outer, inner := newResponseLog(), newResponseLog()
+
+	var order []string
+
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+
+	g := vk.Group("/api").WithMiddlewares(vk.AfterWithBody(1024, func(r *http.Request, ctx *vk.Ctx, resp vk.ResponseSummary) {
+		order = append(order, "group")
+		outer.afterware(r, ctx, resp)
+	}))
+
+	g.GET("/error", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.E(http.StatusBadRequest, "missing name")
+	}, vk.AfterWithBody(8, func(r *http.Request, ctx *vk.Ctx, resp vk.ResponseSummary) {
+		order = append(order, "route")
+		inner.afterware(r, ctx, resp)
+	}))
+
+	server.AddGroup(g)
+
+	vt := vtest.New(server)
+
+	r, _ := http.NewRequest(http.MethodGet, "/api/error", nil)
+	vt.Do(r, t).AssertStatus(http.StatusBadRequest)
+
+	assert.Equal(t, []string{"route", "group"}, order, "afterware should run innermost first")
+
+	full := outer.summary("/api/error")
+	assert.Contains(t, string(full.Body), "missing name")
+	assert.False(t, full.Truncated)
+	assert.Equal(t, int64(len(full.Body)), full.Bytes)
+
+	truncated := inner.summary("/api/error")
+	assert.Len(t, truncated.Body, 8)
+	assert.True(t, truncated.Truncated)
+}
+
+func TestAfterwareWebSocket(t *testing.T) {
+	log := newResponseLog()
+	done := make(chan struct{})
+
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+
+	g := vk.Group("").After(log.afterware, func(*http.Request, *vk.Ctx, vk.ResponseSummary) { close(done) })
+	g.WebSocket("/sock", func(r *http.Request, ctx *vk.Ctx, conn *websocket.Conn) error {
+		return nil
+	})
+
+	server.AddGroup(g)
+
+	require.NoError(t, server.TestStart())
+
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/sock", nil)
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the afterware did not run")
+	}
+
+	assert.Equal(t, http.StatusSwitchingProtocols, log.summary("/sock").Status)
+}
@@ -0,0 +1,108 @@
+package test_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"html/template"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+	"github.com/suborbital/vektor/vtest"
+)
+
+func assetHash(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func writeAsset(t *testing.T, dir, name, content string) {
+	path := filepath.Join(dir, name)
+
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0700))
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+}
+
+func TestAssetFingerprints(t *testing.T) {
+	dir := t.TempDir()
+	writeAsset(t, dir, "app.js", "console.log(1)")
+	writeAsset(t, dir, "css/site.css", "body{}")
+	writeAsset(t, dir, "LICENSE", "MIT")
+
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+
+	g := vk.Group("/static")
+	g.Static("/", http.Dir(dir), vk.WithFingerprints())
+	server.AddGroup(g)
+
+	vt := vtest.New(server)
+
+	appJS := "/static/app-" + assetHash("console.log(1)") + ".js"
+
+	assert.Equal(t, map[string]string{
+		"/static/app.js":       appJS,
+		"/static/css/site.css": "/static/css/site-" + assetHash("body{}") + ".css",
+		"/static/LICENSE":      "/static/LICENSE-" + assetHash("MIT"),
+	}, server.AssetManifest())
+
+	t.Run("hashed path", func(t *testing.T) {
+		r, _ := http.NewRequest(http.MethodGet, appJS, nil)
+		vt.Do(r, t).
+			AssertStatus(http.StatusOK).
+			AssertHeader("Cache-Control", "public, max-age=31536000, immutable").
+			AssertBodyString("console.log(1)")
+	})
+
+	t.Run("logical path", func(t *testing.T) {
+		r, _ := http.NewRequest(http.MethodGet, "/static/app.js", nil)
+		resp := vt.Do(r, t).AssertStatus(http.StatusOK).AssertBodyString("console.log(1)")
+
+		assert.Empty(t, resp.Headers.Get("Cache-Control"))
+	})
+
+	t.Run("unknown hash", func(t *testing.T) {
+		r, _ := http.NewRequest(http.MethodGet, "/static/app-000000000000.js", nil)
+		resp := vt.Do(r, t).AssertStatus(http.StatusOK).AssertBodyString("console.log(1)")
+
+		assert.Empty(t, resp.Headers.Get("Cache-Control"))
+	})
+
+	t.Run("template helper", func(t *testing.T) {
+		tmpl := template.Must(template.New("page").Funcs(server.TemplateFuncs()).Parse(`<script src="{{ asset "/static/app.js" }}"></script>{{ asset "/other.js" }}`))
+
+		var out bytes.Buffer
+		require.NoError(t, tmpl.Execute(&out, nil))
+
+		assert.Equal(t, `<script src="`+appJS+`"></script>/other.js`, out.String())
+	})
+}
+
+func TestAssetFingerprintRevalidation(t *testing.T) {
+	for name, opt := range map[string]vk.MountOption{"cached": vk.WithFingerprints(), "revalidated": vk.WithFingerprintRevalidation()} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeAsset(t, dir, "app.js", "v1")
+
+			router := vk.NewRouter(vlog.Noop(), "")
+			router.Static("/static", http.Dir(dir), opt)
+
+			assert.Equal(t, "/static/app-"+assetHash("v1")+".js", router.AssetPath("/static/app.js"))
+
+			writeAsset(t, dir, "app.js", "version 2")
+
+			expected := assetHash("v1")
+			if name == "revalidated" {
+				expected = assetHash("version 2")
+			}
+
+			assert.Equal(t, "/static/app-"+expected+".js", router.AssetPath("/static/app.js"))
+		})
+	}
+}
@@ -0,0 +1,289 @@
+package test_test
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+)
+
+// readJournal returns the records in a journal file
+func readJournal(t *testing.T, path string) []vk.AuditRecord {
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+
+	var records []vk.AuditRecord
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record vk.AuditRecord
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &record), scanner.Text())
+
+		records = append(records, record)
+	}
+
+	return records
+}
+
+func auditServer(t *testing.T, auditor *vk.Auditor) *vk.Server {
+	logs := &logCapture{}
+
+	server := vk.New(vk.UseLogger(vlog.Default(vlog.Level(vlog.LogLevelInfo), vlog.WithWriter(logs))))
+
+	// stands in for the auth middleware
+	auth := vk.Named("auth", func(inner vk.HandlerFunc) vk.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+			ctx.Set(vk.ClaimsKey, map[string]interface{}{"sub": "user-1", "email": "alice@example.com"})
+
+			return inner(w, r, ctx)
+		}
+	})
+
+	g := vk.Group("/api").WithMiddlewares(auditor.Middleware(), auth)
+
+	g.GET("/users/:id", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.RespondString(ctx.Context, w, "user", http.StatusOK)
+	})
+
+	// doesn't read the body, which is hashed anyway
+	g.PUT("/users/:id", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		ctx.RespHeaders.Set("Location", "/api/users/"+ctx.Params.ByName("id"))
+
+		return vk.RespondString(ctx.Context, w, "updated", http.StatusCreated)
+	})
+
+	g.DELETE("/users/:id", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.E(http.StatusConflict, "the user is already deleted")
+	})
+
+	server.AddGroup(g)
+	require.NoError(t, server.TestStart())
+
+	return server
+}
+
+func TestAuditMiddleware(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	journal, err := vk.NewFileJournal(vk.FileJournalConfig{Path: path})
+	require.NoError(t, err)
+	defer journal.Close()
+
+	auditor := vk.NewAuditor(journal, vk.AuditFailClosed)
+	server := auditServer(t, auditor)
+
+	body := `{"email":"alice@example.com"}`
+
+	for _, r := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/api/users/1", nil),
+		httptest.NewRequest(http.MethodPut, "/api/users/1", strings.NewReader(body)),
+		httptest.NewRequest(http.MethodDelete, "/api/users/1", nil),
+	} {
+		server.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	records := readJournal(t, path)
+	require.Len(t, records, 2)
+
+	hash := sha256.Sum256([]byte(body))
+
+	assert.Equal(t, http.MethodPut, records[0].Method)
+	assert.Equal(t, "/api/users/1", records[0].Path)
+	assert.Equal(t, "/api/users/:id", records[0].Route)
+	assert.Equal(t, "user-1", records[0].Actor)
+	assert.Equal(t, hex.EncodeToString(hash[:]), records[0].BodyHash)
+	assert.Equal(t, http.StatusCreated, records[0].Status)
+	assert.NotEmpty(t, records[0].RequestID)
+
+	assert.Equal(t, http.MethodDelete, records[1].Method)
+	assert.Equal(t, http.StatusConflict, records[1].Status)
+
+	data, _ := os.ReadFile(path)
+	assert.NotContains(t, string(data), "alice@example.com")
+
+	assert.Equal(t, vk.AuditStats{Records: 2}, auditor.Stats())
+
+	stats := journal.Stats()
+	assert.Equal(t, uint64(2), stats.Records)
+	assert.Equal(t, uint64(2), stats.Syncs)
+}
+
+func TestAuditBodyLimit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	journal, err := vk.NewFileJournal(vk.FileJournalConfig{Path: path})
+	require.NoError(t, err)
+	defer journal.Close()
+
+	auditor := vk.NewAuditor(journal, vk.AuditFailClosed)
+	auditor.SetBodyMaxBytes(8)
+
+	server := auditServer(t, auditor)
+
+	for _, body := range []string{"12345678", "123456789abcdef"} {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/api/users/1", strings.NewReader(body)))
+		assert.Equal(t, http.StatusCreated, w.Code)
+	}
+
+	records := readJournal(t, path)
+	require.Len(t, records, 2)
+
+	hash := sha256.Sum256([]byte("12345678"))
+
+	assert.Equal(t, hex.EncodeToString(hash[:]), records[0].BodyHash)
+	assert.False(t, records[0].Truncated)
+
+	// only the first 8 bytes are hashed
+	assert.Equal(t, hex.EncodeToString(hash[:]), records[1].BodyHash)
+	assert.True(t, records[1].Truncated)
+}
+
+func TestAuditWriteFailure(t *testing.T) {
+	if _, err := os.Stat("/dev/full"); err != nil {
+		t.Skip("needs /dev/full")
+	}
+
+	do := func(policy vk.AuditFailurePolicy) (*httptest.ResponseRecorder, *vk.Auditor) {
+		// every write to /dev/full fails with ENOSPC, as a full disk would
+		journal, err := vk.NewFileJournal(vk.FileJournalConfig{Path: "/dev/full"})
+		require.NoError(t, err)
+		defer journal.Close()
+
+		auditor := vk.NewAuditor(journal, policy)
+		server := auditServer(t, auditor)
+
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/api/users/1", strings.NewReader("{}")))
+
+		return w, auditor
+	}
+
+	t.Run("fail closed", func(t *testing.T) {
+		w, auditor := do(vk.AuditFailClosed)
+
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		assert.NotContains(t, w.Body.String(), "updated")
+		assert.Empty(t, w.Header().Get("Location"))
+		assert.Equal(t, vk.AuditStats{Failures: 1}, auditor.Stats())
+	})
+
+	t.Run("degrade", func(t *testing.T) {
+		w, auditor := do(vk.AuditDegrade)
+
+		assert.Equal(t, http.StatusCreated, w.Code)
+		assert.Equal(t, "updated", w.Body.String())
+		assert.Equal(t, vk.AuditStats{Failures: 1}, auditor.Stats())
+	})
+}
+
+func TestFileJournal(t *testing.T) {
+	record := vk.AuditRecord{Method: http.MethodPost, Path: "/things", Route: "/things", Status: http.StatusCreated}
+
+	t.Run("rotation", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "audit.log")
+
+		journal, err := vk.NewFileJournal(vk.FileJournalConfig{Path: path, MaxBytes: 400})
+		require.NoError(t, err)
+
+		for i := 0; i < 10; i++ {
+			require.NoError(t, journal.Append(record))
+		}
+
+		require.NoError(t, journal.Close())
+
+		rotated, _ := filepath.Glob(path + ".*")
+		require.NotEmpty(t, rotated)
+		assert.Equal(t, uint64(len(rotated)), journal.Stats().Rotations)
+
+		total := 0
+		for _, p := range append(rotated, path) {
+			info, err := os.Stat(p)
+			require.NoError(t, err)
+			assert.LessOrEqual(t, info.Size(), int64(400))
+
+			total += len(readJournal(t, p))
+		}
+
+		assert.Equal(t, 10, total)
+	})
+
+	t.Run("failed rotation", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "audit.log")
+
+		journal, err := vk.NewFileJournal(vk.FileJournalConfig{Path: path, MaxBytes: 100})
+		require.NoError(t, err)
+		defer journal.Close()
+
+		require.NoError(t, journal.Append(record))
+
+		// the rename fails while the file is missing
+		require.NoError(t, os.Remove(path))
+		assert.Error(t, journal.Append(record))
+
+		// and the journal carries on once it can rotate again
+		require.NoError(t, os.WriteFile(path, nil, 0600))
+		require.NoError(t, journal.Append(record))
+		require.NoError(t, journal.Close())
+
+		assert.Len(t, readJournal(t, path), 1)
+		assert.Equal(t, uint64(1), journal.Stats().Rotations)
+	})
+
+	t.Run("sync interval", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "audit.log")
+
+		journal, err := vk.NewFileJournal(vk.FileJournalConfig{Path: path, SyncInterval: time.Hour})
+		require.NoError(t, err)
+
+		for i := 0; i < 3; i++ {
+			require.NoError(t, journal.Append(record))
+		}
+
+		// buffered until the next sync
+		assert.Empty(t, readJournal(t, path))
+		assert.Equal(t, uint64(0), journal.Stats().Syncs)
+
+		require.NoError(t, journal.Sync())
+		assert.Len(t, readJournal(t, path), 3)
+		assert.Equal(t, uint64(1), journal.Stats().Syncs)
+
+		require.NoError(t, journal.Close())
+		assert.Error(t, journal.Append(record))
+	})
+
+	t.Run("partial line", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "audit.log")
+
+		// what a crash in the middle of a write leaves behind
+		require.NoError(t, os.WriteFile(path, []byte(`{"time":"2022-06-01T12:00:00Z","method":"PO`), 0600))
+
+		journal, err := vk.NewFileJournal(vk.FileJournalConfig{Path: path})
+		require.NoError(t, err)
+
+		require.NoError(t, journal.Append(record))
+		require.NoError(t, journal.Close())
+
+		data, _ := os.ReadFile(path)
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		require.Len(t, lines, 2)
+
+		var appended vk.AuditRecord
+		require.NoError(t, json.Unmarshal([]byte(lines[1]), &appended))
+		assert.Equal(t, "/things", appended.Path)
+	})
+}
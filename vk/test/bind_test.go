@@ -0,0 +1,185 @@
+package test_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+)
+
+type signupAddress struct {
+	City string `json:"city"`
+	Zip  int    `json:"zip"`
+}
+
+type signupRequest struct {
+	Name    string         `json:"name"`
+	Tags    []string       `json:"tags" form:"tag"`
+	Admin   bool           `json:"admin"`
+	Address signupAddress  `json:"address"`
+	Billing *signupAddress `json:"billing,omitempty"`
+}
+
+func (s *signupRequest) Validate() error {
+	if s.Name == "" {
+		return errors.New("name is required")
+	}
+
+	return nil
+}
+
+func (s *signupRequest) String() string {
+	billing := "none"
+	if s.Billing != nil {
+		billing = s.Billing.City
+	}
+
+	return fmt.Sprintf("%s %v %t %s %d %s", s.Name, s.Tags, s.Admin, s.Address.City, s.Address.Zip, billing)
+}
+
+func bindServer(t *testing.T) *vk.Server {
+	server := vk.New(vk.UseLogger(vlog.Noop()), vk.UseBodyLimit(vk.BodyOptions{MaxBytes: 512}))
+
+	signup := func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		var req signupRequest
+		if err := ctx.Bind(r, &req); err != nil {
+			return err
+		}
+
+		// the body can still be read once it has been bound
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			return err
+		}
+
+		return vk.RespondString(ctx.Context, w, fmt.Sprintf("%s (%d bytes)", req.String(), len(data)), http.StatusOK)
+	}
+
+	server.POST("/signup", signup)
+
+	g := vk.Group("/strict").WithMiddlewares(vk.Binding(vk.MaxBytes(32), vk.Strict()))
+	g.POST("/signup", signup)
+	server.AddGroup(g)
+
+	// binds in a middleware, leaving the body for the handler
+	peek := vk.Named("peek", func(inner vk.HandlerFunc) vk.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+			var req signupRequest
+			if err := ctx.Bind(r, &req); err != nil {
+				return err
+			}
+
+			w.Header().Set("X-Name", req.Name)
+
+			return inner(w, r, ctx)
+		}
+	})
+
+	server.POST("/peek", peek(signup))
+
+	require.NoError(t, server.TestStart())
+
+	return server
+}
+
+func bindRequest(server http.Handler, path, contentType, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+
+	return w
+}
+
+func TestBind(t *testing.T) {
+	server := bindServer(t)
+
+	t.Run("nested JSON", func(t *testing.T) {
+		body := `{"name":"ada","tags":["a","b"],"address":{"city":"London","zip":1},"billing":{"city":"Paris"}}`
+
+		w := bindRequest(server, "/signup", "application/json; charset=utf-8", body)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, fmt.Sprintf("ada [a b] false London 1 Paris (%d bytes)", len(body)), w.Body.String())
+	})
+
+	t.Run("form", func(t *testing.T) {
+		body := "name=ada&tag=a&tag=b&admin=true&address.city=London&address.zip=1"
+
+		w := bindRequest(server, "/signup", "application/x-www-form-urlencoded", body)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, fmt.Sprintf("ada [a b] true London 1 none (%d bytes)", len(body)), w.Body.String())
+	})
+
+	t.Run("multipart form", func(t *testing.T) {
+		var buf bytes.Buffer
+
+		mw := multipart.NewWriter(&buf)
+		require.NoError(t, mw.WriteField("name", "ada"))
+		require.NoError(t, mw.WriteField("billing.city", "Paris"))
+		require.NoError(t, mw.Close())
+
+		w := bindRequest(server, "/signup", mw.FormDataContentType(), buf.String())
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, fmt.Sprintf("ada [] false  0 Paris (%d bytes)", buf.Len()), w.Body.String())
+	})
+
+	t.Run("bound by middleware", func(t *testing.T) {
+		body := `{"name":"ada"}`
+
+		w := bindRequest(server, "/peek", "application/json", body)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "ada", w.Header().Get("X-Name"))
+		assert.Equal(t, fmt.Sprintf("ada [] false  0 none (%d bytes)", len(body)), w.Body.String())
+	})
+
+	cases := map[string]struct {
+		path        string
+		contentType string
+		body        string
+		status      int
+		message     string
+	}{
+		"empty":               {"/signup", "application/json", "", http.StatusBadRequest, "request body is empty"},
+		"oversized":           {"/signup", "application/json", `{"name":"` + strings.Repeat("a", 600) + `"}`, http.StatusRequestEntityTooLarge, ""},
+		"oversized for group": {"/strict/signup", "application/json", `{"name":"` + strings.Repeat("a", 40) + `"}`, http.StatusRequestEntityTooLarge, ""},
+		"wrong content type":  {"/signup", "text/plain", "name=ada", http.StatusUnsupportedMediaType, "content type must be"},
+		"no content type":     {"/signup", "", `{"name":"ada"}`, http.StatusUnsupportedMediaType, "content type must be"},
+		"malformed":           {"/signup", "application/json", `{"name":`, http.StatusBadRequest, "invalid JSON"},
+		"unknown field":       {"/strict/signup", "application/json", `{"name":"ada","x":1}`, http.StatusBadRequest, "unknown field"},
+		"bad form value":      {"/signup", "application/x-www-form-urlencoded", "name=ada&admin=maybe", http.StatusBadRequest, "field admin"},
+		"invalid":             {"/signup", "application/json", `{"tags":["a"]}`, http.StatusUnprocessableEntity, "name is required"},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			w := bindRequest(server, c.path, c.contentType, c.body)
+
+			assert.Equal(t, c.status, w.Code)
+			assert.Contains(t, w.Body.String(), c.message)
+		})
+	}
+
+	t.Run("lenient by default", func(t *testing.T) {
+		w := bindRequest(server, "/signup", "application/json", `{"name":"ada","x":1}`)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+}
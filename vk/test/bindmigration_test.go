@@ -0,0 +1,131 @@
+package test_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+	"github.com/suborbital/vektor/vtest"
+)
+
+// profileRequest is at version 2 of its schema, which renamed fullname to name and made age a number
+type profileRequest struct {
+	Version int    `json:"version"`
+	Name    string `json:"name"`
+	Age     int    `json:"age"`
+}
+
+func init() {
+	vk.BindVersions[profileRequest](vk.BindVersioning{Current: 2, Header: "X-Schema-Version", Field: "version", Default: 1})
+
+	vk.BindMigration[profileRequest](func(raw map[string]json.RawMessage) error {
+		raw["name"] = raw["fullname"]
+		delete(raw, "fullname")
+
+		var age string
+		if err := json.Unmarshal(raw["age"], &age); err != nil {
+			return err
+		}
+
+		raw["age"] = json.RawMessage(age)
+
+		return nil
+	})
+}
+
+func bindMigrationServer() *vk.Server {
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+
+	server.POST("/bind", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		var req profileRequest
+		if err := ctx.Bind(r, &req); err != nil {
+			return err
+		}
+
+		return vk.RespondJSON(ctx.Context, w, req, http.StatusOK)
+	})
+
+	api := vk.Group("").WithMiddlewares(vk.Body(vk.JSON(vk.Strict()), vk.BindTo[profileRequest]()))
+	api.POST("/preset", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.RespondJSON(ctx.Context, w, ctx.Bound(), http.StatusOK)
+	})
+
+	server.AddGroup(api)
+
+	return server
+}
+
+func TestBindMigration(t *testing.T) {
+	vt := vtest.New(bindMigrationServer())
+
+	expected := profileRequest{Version: 2, Name: "Ada", Age: 36}
+
+	cases := map[string]struct {
+		body    string
+		version string
+	}{
+		"v2":               {body: `{"version": 2, "name": "Ada", "age": 36}`},
+		"v2 header":        {body: `{"name": "Ada", "age": 36, "version": 2}`, version: "2"},
+		"v1 field":         {body: `{"version": 1, "fullname": "Ada", "age": "36"}`},
+		"v1 string field":  {body: `{"version": "1", "fullname": "Ada", "age": "36"}`},
+		"v1 header":        {body: `{"fullname": "Ada", "age": "36"}`, version: "1"},
+		"v1 by default":    {body: `{"fullname": "Ada", "age": "36"}`},
+		"header over body": {body: `{"version": 1, "fullname": "Ada", "age": "36"}`, version: "1"},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			for _, path := range []string{"/bind", "/preset"} {
+				r, _ := http.NewRequest(http.MethodPost, path, strings.NewReader(c.body))
+				r.Header.Set("Content-Type", "application/json")
+
+				if c.version != "" {
+					r.Header.Set("X-Schema-Version", c.version)
+				}
+
+				got := profileRequest{}
+				resp := vt.Do(r, t).AssertStatus(http.StatusOK)
+
+				assert.NoError(t, json.Unmarshal(resp.Body, &got), path)
+				assert.Equal(t, expected, got, path)
+			}
+		})
+	}
+}
+
+func TestBindMigrationUnsupported(t *testing.T) {
+	vt := vtest.New(bindMigrationServer())
+
+	cases := map[string]struct {
+		body    string
+		version string
+		message string
+	}{
+		"v0":          {body: `{"version": 0, "fullname": "Ada"}`, message: "unsupported schema version 0, the supported versions are 1 to 2"},
+		"v0 header":   {body: `{"fullname": "Ada"}`, version: "0", message: "unsupported schema version 0, the supported versions are 1 to 2"},
+		"v3":          {body: `{"version": 3, "name": "Ada"}`, message: "unsupported schema version 3, the supported versions are 1 to 2"},
+		"not numeric": {body: `{"name": "Ada"}`, version: "two", message: "the supported versions are 1 to 2"},
+		"failed step": {body: `{"version": 1, "fullname": "Ada", "age": 36}`, message: "failed to migrate body from schema version 1"},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			for _, path := range []string{"/bind", "/preset"} {
+				r, _ := http.NewRequest(http.MethodPost, path, strings.NewReader(c.body))
+				r.Header.Set("Content-Type", "application/json")
+
+				if c.version != "" {
+					r.Header.Set("X-Schema-Version", c.version)
+				}
+
+				resp := vt.Do(r, t).AssertStatus(http.StatusBadRequest)
+				assert.Contains(t, string(resp.Body), c.message, path)
+			}
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package test_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+)
+
+type importRequest struct {
+	Source string   `json:"source"`
+	Rows   []string `json:"rows"`
+}
+
+func (i *importRequest) Validate() error {
+	if i.Source == "" {
+		return errors.New("source is required")
+	}
+
+	return nil
+}
+
+func TestBodyPreset(t *testing.T) {
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+
+	g := vk.Group("")
+
+	g.POST("/import", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		req := ctx.Bound().(*importRequest)
+
+		return vk.RespondString(ctx.Context, w, req.Source+":"+strings.Join(req.Rows, ","), http.StatusOK)
+	}, vk.Body(vk.JSON(vk.MaxBytes(64), vk.Strict()), vk.AllowGzip(), vk.BindTo[importRequest]()))
+
+	g.POST("/raw", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			return vk.E(http.StatusRequestEntityTooLarge, "too large")
+		}
+
+		return vk.RespondString(ctx.Context, w, string(data), http.StatusOK)
+	}, vk.Body(vk.JSON(vk.MaxBytes(64)), vk.AllowGzip()))
+
+	server.AddGroup(g)
+	require.NoError(t, server.TestStart())
+
+	post := func(path, body string, header http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+
+		for key, values := range header {
+			r.Header[key] = values
+		}
+
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+
+		return w
+	}
+
+	gzipped := func(body string) string {
+		buf := &bytes.Buffer{}
+		gz := gzip.NewWriter(buf)
+		gz.Write([]byte(body))
+		gz.Close()
+
+		return buf.String()
+	}
+
+	gzipHeader := http.Header{"Content-Encoding": {"gzip"}}
+
+	t.Run("happy path", func(t *testing.T) {
+		w := post("/import", `{"source":"s3","rows":["a","b"]}`, nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "s3:a,b", w.Body.String())
+
+		w = post("/import", `{"source":"s3"}`, http.Header{"Content-Type": {"application/vnd.import+json; charset=utf-8"}})
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("oversized", func(t *testing.T) {
+		big := `{"source":"s3","rows":["` + strings.Repeat("a", 100) + `"]}`
+
+		assert.Equal(t, http.StatusRequestEntityTooLarge, post("/import", big, nil).Code)
+
+		// bodies without a Content-Length are cut off at the limit
+		r := httptest.NewRequest(http.MethodPost, "/import", io.MultiReader(strings.NewReader(big)))
+		r.Header.Set("Content-Type", "application/json")
+		r.ContentLength = -1
+
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	})
+
+	t.Run("malformed", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, post("/import", `{"source":`, nil).Code)
+		assert.Equal(t, http.StatusBadRequest, post("/import", `{"source":"s3","extra":true}`, nil).Code, "strict rejects unknown fields")
+		assert.Equal(t, http.StatusBadRequest, post("/import", "", nil).Code)
+		assert.Equal(t, http.StatusUnprocessableEntity, post("/import", `{"rows":[]}`, nil).Code)
+		assert.Equal(t, http.StatusUnsupportedMediaType, post("/import", `{"source":"s3"}`, http.Header{"Content-Type": {"text/plain"}}).Code)
+		assert.Equal(t, http.StatusUnsupportedMediaType, post("/import", `{"source":"s3"}`, http.Header{"Content-Encoding": {"br"}}).Code)
+	})
+
+	t.Run("gzip", func(t *testing.T) {
+		w := post("/import", gzipped(`{"source":"gz","rows":["c"]}`), gzipHeader)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "gz:c", w.Body.String())
+
+		w = post("/raw", gzipped(`{"raw":true}`), gzipHeader)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, `{"raw":true}`, w.Body.String(), "handlers without a bound type read the decompressed body")
+
+		// the limit applies to the decompressed body, which compresses far below it
+		bomb := gzipped(`{"source":"` + strings.Repeat("a", 10000) + `"}`)
+		require.Less(t, len(bomb), 64)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, post("/import", bomb, gzipHeader).Code)
+
+		assert.Equal(t, http.StatusBadRequest, post("/import", "not gzip", gzipHeader).Code)
+	})
+
+	t.Run("route metadata", func(t *testing.T) {
+		router := vk.NewRouter(vlog.Noop(), "")
+		router.AddGroup(g)
+
+		var body *vk.BodySpec
+		for _, route := range router.Routes() {
+			if route.Path == "/import" {
+				body = route.Body
+			}
+		}
+
+		require.NotNil(t, body)
+		assert.Equal(t, "application/json", body.ContentType)
+		assert.EqualValues(t, 64, body.MaxBytes)
+		assert.True(t, body.Strict)
+		assert.True(t, body.AllowGzip)
+		assert.Equal(t, reflect.TypeOf(importRequest{}), body.Type)
+	})
+}
+
+func TestBodyPresetConflicts(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return nil
+	}
+
+	t.Run("route and group", func(t *testing.T) {
+		g := vk.Group("/api").WithMiddlewares(vk.Body(vk.JSON()))
+		g.POST("/import", handler, vk.Body(vk.JSON(vk.MaxBytes(10<<20))))
+
+		router := vk.NewRouter(vlog.Noop(), "")
+		router.AddGroup(g)
+
+		err := router.Validate()
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "route POST /api/import: more than one body preset is declared")
+	})
+
+	t.Run("within a preset", func(t *testing.T) {
+		g := vk.Group("")
+		g.POST("/import", handler, vk.Body(vk.BindTo[importRequest](), vk.BindTo[map[string]string]()))
+
+		router := vk.NewRouter(vlog.Noop(), "")
+		router.AddGroup(g)
+
+		err := router.Validate()
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "the body is bound to more than one type")
+	})
+
+	t.Run("server", func(t *testing.T) {
+		server := vk.New(vk.UseLogger(vlog.Noop()))
+
+		g := vk.Group("")
+		g.POST("/import", handler, vk.Body(vk.JSON()), vk.Body(vk.JSON()))
+		server.AddGroup(g)
+
+		err := server.TestStart()
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "route POST /import")
+	})
+}
@@ -0,0 +1,143 @@
+package test_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+)
+
+// hopReport is what each server in the chain saw of the request's budget
+type hopReport struct {
+	Declared  string     `json:"declared"`  // the inbound header
+	Budget    int64      `json:"budget"`    // Ctx.DeadlineBudget, in ms
+	Remaining int64      `json:"remaining"` // the time left before the Ctx's deadline, in ms, or -1 without one
+	Next      *hopReport `json:"next,omitempty"`
+}
+
+// budgetServer reports the budget of its requests, calling next with the ctx-bound client first if it is set
+func budgetServer(t *testing.T, next string, work time.Duration, logs *logCapture) *httptest.Server {
+	server := vk.New(
+		vk.UseLogger(vlog.Default(vlog.Level(vlog.LogLevelDebug), vlog.WithWriter(logs))),
+		vk.UseDeadlinePropagation(vk.DeadlinePropagation{Allowance: 5 * time.Millisecond}),
+	)
+
+	server.GET("/hop", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		report := hopReport{Declared: r.Header.Get(vk.DeadlineHeader), Budget: ctx.DeadlineBudget().Milliseconds(), Remaining: -1}
+		if deadline, ok := ctx.Deadline(); ok {
+			report.Remaining = time.Until(deadline).Milliseconds()
+		}
+
+		time.Sleep(work)
+
+		if next != "" {
+			resp, err := ctx.HTTPClient().Get(next + "/hop")
+			if err != nil {
+				return err
+			}
+
+			defer resp.Body.Close()
+
+			report.Next = &hopReport{}
+			if err := json.NewDecoder(resp.Body).Decode(report.Next); err != nil {
+				return err
+			}
+		}
+
+		return vk.RespondJSON(ctx.Context, w, report, http.StatusOK)
+	})
+
+	require.NoError(t, server.TestStart())
+
+	ts := httptest.NewServer(server)
+	t.Cleanup(ts.Close)
+
+	return ts
+}
+
+func TestDeadlinePropagation(t *testing.T) {
+	logs := &logCapture{}
+
+	second := budgetServer(t, "", 0, logs)
+	first := budgetServer(t, second.URL, 100*time.Millisecond, logs)
+
+	hop := func(server *httptest.Server, declared string) hopReport {
+		r, _ := http.NewRequest(http.MethodGet, server.URL+"/hop", nil)
+		if declared != "" {
+			r.Header.Set(vk.DeadlineHeader, declared)
+		}
+
+		resp, err := http.DefaultClient.Do(r)
+		require.NoError(t, err)
+
+		defer resp.Body.Close()
+
+		body, _ := io.ReadAll(resp.Body)
+		require.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+
+		report := hopReport{}
+		require.NoError(t, json.Unmarshal(body, &report))
+
+		return report
+	}
+
+	t.Run("shrinks", func(t *testing.T) {
+		report := hop(first, "2000")
+		require.NotNil(t, report.Next)
+
+		assert.Equal(t, int64(2000), report.Budget)
+		assert.InDelta(t, 2000, report.Remaining, 50)
+
+		// the second hop gets what was left after the first's work, less the network allowance
+		declared, err := strconv.ParseInt(report.Next.Declared, 10, 64)
+		require.NoError(t, err)
+
+		assert.Less(t, declared, int64(2000-100-5+1))
+		assert.Greater(t, declared, int64(2000-100-5-200))
+		assert.Equal(t, declared, report.Next.Budget)
+		assert.LessOrEqual(t, report.Next.Remaining, declared)
+	})
+
+	t.Run("absent", func(t *testing.T) {
+		report := hop(first, "")
+		require.NotNil(t, report.Next)
+
+		assert.Equal(t, int64(0), report.Budget)
+		assert.Equal(t, int64(-1), report.Remaining, "requests without the header get no deadline")
+		assert.Empty(t, report.Next.Declared, "calls without a deadline don't send the header")
+	})
+
+	t.Run("clamped", func(t *testing.T) {
+		report := hop(second, "99999999999999999")
+		assert.Equal(t, (5 * time.Minute).Milliseconds(), report.Budget)
+
+		report = hop(second, "0")
+		assert.Equal(t, int64(1), report.Budget)
+
+		report = hop(second, "soon")
+		assert.Equal(t, int64(0), report.Budget, "invalid values are ignored")
+	})
+
+	t.Run("logged", func(t *testing.T) {
+		hop(second, "2000")
+
+		found := false
+		for _, msg := range logs.messages() {
+			if strings.HasPrefix(msg, "(D) deadline budget: declared 2000ms, took ") {
+				found = true
+			}
+		}
+
+		assert.True(t, found, "the declared budget and duration are logged")
+	})
+}
@@ -0,0 +1,152 @@
+package test_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+)
+
+type pooledOrder struct {
+	ID    int      `json:"id"`
+	Owner string   `json:"owner"`
+	Lines []string `json:"lines"`
+}
+
+// pooledServer serves orders of n lines at /orders/:n, errors at /fail/:n, and a CSV built in Ctx.Buffer at /csv/:n
+func pooledServer(tb testing.TB, log *vlog.Logger) *vk.Server {
+	server := vk.New(vk.UseLogger(log))
+
+	lines := func(ctx *vk.Ctx) []string {
+		n, _ := strconv.Atoi(ctx.Params.ByName("n"))
+
+		lines := make([]string, n)
+		for i := range lines {
+			lines[i] = fmt.Sprintf("line-%d-%d", n, i)
+		}
+
+		return lines
+	}
+
+	server.GET("/orders/:n", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		ctx.Log.Info("listing order")
+
+		return vk.RespondJSON(ctx.Context, w, pooledOrder{ID: len(lines(ctx)), Owner: "vektor", Lines: lines(ctx)}, http.StatusOK)
+	})
+
+	server.GET("/fail/:n", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.E(http.StatusConflict, strings.Join(lines(ctx), ","))
+	})
+
+	server.GET("/csv/:n", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		buf := ctx.Buffer()
+		for _, line := range lines(ctx) {
+			buf.WriteString(line + "\n")
+		}
+
+		return vk.RespondBytes(ctx.Context, w, buf.Bytes(), http.StatusOK)
+	})
+
+	require.NoError(tb, server.TestStart())
+
+	return server
+}
+
+func TestPooledBuffers(t *testing.T) {
+	logs := &logCapture{}
+
+	hooked := make(chan []byte, 4000)
+	log := vlog.Default(vlog.Level(vlog.LogLevelInfo), vlog.WithWriter(logs), vlog.PreLogHook(func(line []byte) {
+		hooked <- append([]byte{}, line...)
+	}))
+
+	server := pooledServer(t, log)
+
+	// concurrent requests of very different sizes, so that buffers are shared and some are too large to be pooled
+	sizes := []int{0, 1, 3, 50, 8000}
+
+	var wg sync.WaitGroup
+
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+
+		go func(worker int) {
+			defer wg.Done()
+
+			for i := 0; i < 20; i++ {
+				n := sizes[(worker+i)%len(sizes)]
+
+				w := httptest.NewRecorder()
+				server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/orders/%d", n), nil))
+
+				var order pooledOrder
+				if !assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &order), "body: %s", w.Body.String()) {
+					return
+				}
+
+				assert.Equal(t, n, order.ID)
+				assert.Len(t, order.Lines, n)
+
+				for j, line := range order.Lines {
+					assert.Equal(t, fmt.Sprintf("line-%d-%d", n, j), line)
+				}
+
+				w = httptest.NewRecorder()
+				server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/fail/%d", n), nil))
+
+				var failure struct {
+					Status  int    `json:"status"`
+					Message string `json:"message"`
+				}
+
+				assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &failure))
+				assert.Equal(t, http.StatusConflict, failure.Status)
+
+				w = httptest.NewRecorder()
+				server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/csv/%d", n), nil))
+
+				assert.Equal(t, n, strings.Count(w.Body.String(), "\n"))
+			}
+		}(worker)
+	}
+
+	wg.Wait()
+	close(hooked)
+
+	// the lines kept by the hook, and those written, are intact
+	for line := range hooked {
+		assert.True(t, json.Valid(line), "hooked line: %s", line)
+	}
+
+	for _, m := range logs.messages() {
+		assert.NotEmpty(t, m)
+	}
+}
+
+func BenchmarkPooledBuffers(b *testing.B) {
+	server := pooledServer(b, vlog.Default(vlog.Level(vlog.LogLevelInfo), vlog.WithWriter(io.Discard)))
+
+	for _, path := range []string{"/orders/20", "/fail/20"} {
+		b.Run(path, func(b *testing.B) {
+			req := httptest.NewRequest(http.MethodGet, path, nil)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				server.ServeHTTP(httptest.NewRecorder(), req)
+			}
+		})
+	}
+}
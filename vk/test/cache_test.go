@@ -0,0 +1,215 @@
+package test_test
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+	"github.com/suborbital/vektor/vtest"
+)
+
+// cacheClock is a clock that only moves when it is advanced, and is safe for concurrent use
+type cacheClock struct {
+	lock sync.Mutex
+	now  time.Time
+}
+
+func (f *cacheClock) Now() time.Time {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.now
+}
+
+func (f *cacheClock) Advance(d time.Duration) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.now = f.now.Add(d)
+}
+
+// cachedHandler returns a handler that responds with its call count, or fails while failing is set
+func cachedHandler(calls, failing *int32) vk.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		n := atomic.AddInt32(calls, 1)
+
+		if atomic.LoadInt32(failing) == 1 {
+			return vk.E(http.StatusBadGateway, "upstream is down")
+		}
+
+		return vk.RespondString(ctx.Context, w, fmt.Sprintf("v%d", n), http.StatusOK)
+	}
+}
+
+func TestResponseCache(t *testing.T) {
+	clock := &cacheClock{now: time.Unix(1700000000, 0)}
+
+	var calls, failing int32
+
+	cache := vk.NewResponseCache(vk.CacheOptions{
+		TTL:                  time.Minute,
+		StaleWhileRevalidate: time.Minute,
+		StaleIfError:         10 * time.Minute,
+		Now:                  clock.Now,
+	})
+
+	reports := vk.Group("").WithMiddlewares(cache.Middleware())
+	reports.GET("/report", cachedHandler(&calls, &failing))
+
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+	server.AddGroup(reports)
+
+	vt := vtest.New(server)
+
+	get := func() *vtest.Response {
+		r, _ := http.NewRequest(http.MethodGet, "/report", nil)
+		return vt.Do(r, t)
+	}
+
+	t.Run("fresh", func(t *testing.T) {
+		get().AssertStatus(http.StatusOK).AssertBodyString("v1").AssertHeader("X-Cache", "MISS")
+
+		clock.Advance(30 * time.Second)
+
+		get().AssertStatus(http.StatusOK).AssertBodyString("v1").AssertHeader("X-Cache", "HIT").AssertHeader("Age", "30")
+		assert.EqualValues(t, 1, atomic.LoadInt32(&calls))
+	})
+
+	t.Run("stale while revalidating", func(t *testing.T) {
+		clock.Advance(time.Minute)
+
+		get().AssertStatus(http.StatusOK).
+			AssertBodyString("v1").
+			AssertHeader("X-Cache", "STALE").
+			AssertHeader("Warning", `110 - "Response is Stale"`)
+
+		require.Eventually(t, func() bool { return cache.Stats().Refreshes == 1 }, time.Second, time.Millisecond)
+
+		get().AssertStatus(http.StatusOK).AssertBodyString("v2").AssertHeader("X-Cache", "HIT").AssertHeader("Age", "0")
+	})
+
+	t.Run("stale if error", func(t *testing.T) {
+		atomic.StoreInt32(&failing, 1)
+		clock.Advance(5 * time.Minute)
+
+		get().AssertStatus(http.StatusOK).
+			AssertBodyString("v2").
+			AssertHeader("X-Cache", "STALE").
+			AssertHeader("Warning", `111 - "Revalidation Failed"`).
+			AssertHeader("Age", "300")
+
+		assert.EqualValues(t, 1, cache.Stats().StaleIfError)
+	})
+
+	t.Run("hard expired", func(t *testing.T) {
+		clock.Advance(10 * time.Minute)
+
+		get().AssertStatus(http.StatusBadGateway)
+
+		atomic.StoreInt32(&failing, 0)
+
+		get().AssertStatus(http.StatusOK).AssertHeader("X-Cache", "MISS")
+	})
+
+	t.Run("uncached methods", func(t *testing.T) {
+		before := atomic.LoadInt32(&calls)
+
+		reports := vk.Group("").WithMiddlewares(cache.Middleware())
+		reports.POST("/report", cachedHandler(&calls, &failing))
+
+		server := vk.New(vk.UseLogger(vlog.Noop()))
+		server.AddGroup(reports)
+
+		r, _ := http.NewRequest(http.MethodPost, "/report", nil)
+		vtest.New(server).Do(r, t).AssertStatus(http.StatusOK)
+
+		assert.Equal(t, before+1, atomic.LoadInt32(&calls))
+	})
+}
+
+func TestResponseCacheSingleFlight(t *testing.T) {
+	clock := &cacheClock{now: time.Unix(1700000000, 0)}
+
+	var calls int32
+	release := make(chan struct{})
+
+	cache := vk.NewResponseCache(vk.CacheOptions{TTL: time.Minute, StaleWhileRevalidate: time.Hour, Now: clock.Now})
+
+	slow := vk.Group("").WithMiddlewares(cache.Middleware())
+	slow.GET("/slow", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		n := atomic.AddInt32(&calls, 1)
+		<-release
+
+		return vk.RespondString(ctx.Context, w, fmt.Sprintf("v%d", n), http.StatusOK)
+	})
+
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+	server.AddGroup(slow)
+
+	vt := vtest.New(server)
+
+	getAll := func(n int) []string {
+		bodies := make([]string, n)
+
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+
+			go func(i int) {
+				defer wg.Done()
+
+				r, _ := http.NewRequest(http.MethodGet, "/slow", nil)
+				bodies[i] = string(vt.Do(r, t).Body)
+			}(i)
+		}
+
+		wg.Wait()
+
+		return bodies
+	}
+
+	t.Run("cold key", func(t *testing.T) {
+		go func() {
+			require.Eventually(t, func() bool { return atomic.LoadInt32(&calls) == 1 }, time.Second, time.Millisecond)
+
+			// give the other requests time to start waiting for the first
+			time.Sleep(20 * time.Millisecond)
+			release <- struct{}{}
+		}()
+
+		for _, body := range getAll(10) {
+			assert.Equal(t, "v1", body)
+		}
+
+		assert.EqualValues(t, 1, atomic.LoadInt32(&calls))
+	})
+
+	t.Run("one refresh per key", func(t *testing.T) {
+		clock.Advance(2 * time.Minute)
+
+		// the refresh blocks until released, while every request is served stale without starting another
+		for _, body := range getAll(10) {
+			assert.Equal(t, "v1", body)
+		}
+
+		require.Eventually(t, func() bool { return atomic.LoadInt32(&calls) == 2 }, time.Second, time.Millisecond)
+		assert.EqualValues(t, 1, cache.Stats().Refreshing)
+		assert.EqualValues(t, 10, cache.Stats().Stale)
+
+		release <- struct{}{}
+
+		require.Eventually(t, func() bool { return cache.Stats().Refreshing == 0 }, time.Second, time.Millisecond)
+
+		for _, body := range getAll(3) {
+			assert.Equal(t, "v2", body)
+		}
+	})
+}
@@ -0,0 +1,167 @@
+package test_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+)
+
+// writeCert generates a self-signed certificate for host and writes it to dir as <host>.crt/.key
+func writeCert(t *testing.T, dir, host, org string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: host, Organization: []string{org}},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	// write the key first so that the pair is complete once the certificate appears
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	require.NoError(t, os.WriteFile(filepath.Join(dir, host+".key"), keyPEM, 0600))
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	require.NoError(t, os.WriteFile(filepath.Join(dir, host+".crt"), certPEM, 0600))
+}
+
+// dialCert returns the certificate the server presents for serverName
+func dialCert(port int, serverName string) (*x509.Certificate, error) {
+	conn, err := tls.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port), &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+	if err != nil {
+		return nil, err
+	}
+
+	defer conn.Close()
+
+	return conn.ConnectionState().PeerCertificates[0], nil
+}
+
+// startTLS starts a TLS server and waits for it to accept connections
+func startTLS(t *testing.T, opts ...vk.OptionsModifier) int {
+	port := freePort(t)
+
+	server := vk.New(append([]vk.OptionsModifier{vk.UseLogger(vlog.Noop()), vk.UseTLSPort(port)}, opts...)...)
+
+	go server.Start()
+
+	t.Cleanup(func() { server.Stop() })
+
+	for event := range server.Events() {
+		if _, ok := event.(vk.Ready); ok {
+			break
+		}
+	}
+
+	return port
+}
+
+func TestCertDir(t *testing.T) {
+	dir := t.TempDir()
+
+	writeCert(t, dir, "a.test", "one")
+	writeCert(t, dir, "b.test", "one")
+	writeCert(t, dir, "default.test", "one")
+
+	t.Run("sni", func(t *testing.T) {
+		port := startTLS(t, vk.UseCertDir(dir, "default.test"))
+
+		for serverName, expected := range map[string]string{
+			"a.test":       "a.test",
+			"B.TEST":       "b.test",
+			"unknown.test": "default.test",
+			"":             "default.test",
+		} {
+			cert, err := dialCert(port, serverName)
+			if assert.NoError(t, err, serverName) {
+				assert.Equal(t, expected, cert.Subject.CommonName, serverName)
+			}
+		}
+	})
+
+	t.Run("no default", func(t *testing.T) {
+		port := startTLS(t, vk.UseCertDir(dir, ""))
+
+		cert, err := dialCert(port, "a.test")
+		if assert.NoError(t, err) {
+			assert.Equal(t, "a.test", cert.Subject.CommonName)
+		}
+
+		_, err = dialCert(port, "unknown.test")
+		assert.Error(t, err)
+	})
+
+	t.Run("hook", func(t *testing.T) {
+		hookDir := t.TempDir()
+		writeCert(t, hookDir, "hook.test", "hook")
+
+		hookCert, err := tls.LoadX509KeyPair(filepath.Join(hookDir, "hook.test.crt"), filepath.Join(hookDir, "hook.test.key"))
+		require.NoError(t, err)
+
+		port := startTLS(t,
+			vk.UseCertDir(dir, "default.test"),
+			vk.UseGetCertificate(func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+				if hello.ServerName == "hook.test" {
+					return &hookCert, nil
+				}
+
+				return nil, nil
+			}),
+		)
+
+		for serverName, expected := range map[string]string{"hook.test": "hook.test", "a.test": "a.test"} {
+			cert, err := dialCert(port, serverName)
+			if assert.NoError(t, err) {
+				assert.Equal(t, expected, cert.Subject.CommonName)
+			}
+		}
+	})
+
+	t.Run("reload", func(t *testing.T) {
+		reloadDir := t.TempDir()
+		writeCert(t, reloadDir, "a.test", "before")
+
+		port := startTLS(t, vk.UseCertDir(reloadDir, ""), vk.UseCertReloadInterval(10*time.Millisecond))
+
+		cert, err := dialCert(port, "a.test")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"before"}, cert.Subject.Organization)
+
+		// ensure the new files have a different modification time
+		time.Sleep(20 * time.Millisecond)
+
+		writeCert(t, reloadDir, "a.test", "after")
+		writeCert(t, reloadDir, "new.test", "after")
+
+		assert.Eventually(t, func() bool {
+			a, errA := dialCert(port, "a.test")
+			n, errN := dialCert(port, "new.test")
+
+			return errA == nil && errN == nil && a.Subject.Organization[0] == "after" && n.Subject.CommonName == "new.test"
+		}, 2*time.Second, 20*time.Millisecond)
+	})
+}
@@ -0,0 +1,219 @@
+package test_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+)
+
+// chaosServer serves /users/:id and /orders through chaos, which can only inject faults if allowed
+func chaosServer(t *testing.T, chaos *vk.Chaos, allowed bool, logs *logCapture) *httptest.Server {
+	opts := []vk.OptionsModifier{vk.UseLogger(vlog.Default(vlog.Level(vlog.LogLevelInfo), vlog.WithWriter(logs)))}
+	if allowed {
+		opts = append(opts, vk.UseChaos())
+	}
+
+	server := vk.New(opts...)
+
+	g := vk.Group("").WithMiddlewares(chaos.Middleware())
+
+	g.GET("/users/:id", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.RespondString(ctx.Context, w, strings.Repeat("u", 100), http.StatusOK)
+	})
+
+	g.GET("/orders", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.RespondString(ctx.Context, w, "orders", http.StatusOK)
+	})
+
+	server.AddGroup(g)
+	server.RegisterAdmin(chaos)
+
+	require.NoError(t, server.TestStart())
+
+	ts := httptest.NewServer(server)
+	t.Cleanup(ts.Close)
+
+	return ts
+}
+
+func TestChaosFaults(t *testing.T) {
+	get := func(ts *httptest.Server, path string) (int, string, error) {
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			return 0, "", err
+		}
+
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+
+		return resp.StatusCode, string(body), err
+	}
+
+	t.Run("latency", func(t *testing.T) {
+		chaos := vk.NewChaos(vk.ChaosConfig{Enabled: true, Rules: []vk.ChaosRule{
+			{Route: "/users/:id", Probability: 1, Fault: vk.ChaosLatency, Latency: 100 * time.Millisecond, Jitter: 50 * time.Millisecond},
+		}})
+
+		ts := chaosServer(t, chaos, true, &logCapture{})
+
+		start := time.Now()
+		status, _, err := get(ts, "/users/1")
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, status)
+		assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+
+		start = time.Now()
+		_, _, err = get(ts, "/orders")
+		require.NoError(t, err)
+		assert.Less(t, time.Since(start), 100*time.Millisecond, "routes that match no rule are untouched")
+	})
+
+	t.Run("error", func(t *testing.T) {
+		logs := &logCapture{}
+
+		chaos := vk.NewChaos(vk.ChaosConfig{Enabled: true, Rules: []vk.ChaosRule{
+			{Method: http.MethodGet, Route: "/orders", Probability: 1, Fault: vk.ChaosError, Status: http.StatusBadGateway},
+		}})
+
+		ts := chaosServer(t, chaos, true, logs)
+
+		status, _, err := get(ts, "/orders")
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusBadGateway, status)
+
+		labeled := false
+		for _, m := range logs.messages() {
+			if strings.Contains(m, "/orders") && strings.Contains(m, "chaos=error") {
+				labeled = true
+			}
+		}
+
+		assert.True(t, labeled, "injected faults should be labeled in the log")
+
+		assert.Equal(t, []vk.ChaosInjection{{Method: http.MethodGet, Route: "/orders", Fault: vk.ChaosError, Count: 1}}, chaos.Stats().Injected)
+	})
+
+	t.Run("truncate", func(t *testing.T) {
+		chaos := vk.NewChaos(vk.ChaosConfig{Enabled: true, Rules: []vk.ChaosRule{
+			{Route: "/users/:id", Probability: 1, Fault: vk.ChaosTruncate, TruncateAfter: 10},
+		}})
+
+		ts := chaosServer(t, chaos, true, &logCapture{})
+
+		status, body, err := get(ts, "/users/1")
+		assert.Error(t, err, "the client should see that the body is incomplete")
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, strings.Repeat("u", 10), body)
+	})
+
+	t.Run("drop", func(t *testing.T) {
+		chaos := vk.NewChaos(vk.ChaosConfig{Enabled: true, Rules: []vk.ChaosRule{
+			{Route: "/users/:id", Probability: 1, Fault: vk.ChaosDrop},
+		}})
+
+		ts := chaosServer(t, chaos, true, &logCapture{})
+
+		_, _, err := get(ts, "/users/1")
+		assert.Error(t, err)
+	})
+}
+
+func TestChaosProbability(t *testing.T) {
+	rules := []vk.ChaosRule{{Route: "/orders", Probability: 0.3, Fault: vk.ChaosError}}
+
+	// faults returns which of n requests got a fault
+	faults := func(chaos *vk.Chaos, n int) []bool {
+		ts := chaosServer(t, chaos, true, &logCapture{})
+
+		got := make([]bool, n)
+
+		for i := range got {
+			resp, err := http.Get(ts.URL + "/orders")
+			require.NoError(t, err)
+			resp.Body.Close()
+
+			got[i] = resp.StatusCode == http.StatusServiceUnavailable
+		}
+
+		return got
+	}
+
+	first := faults(vk.NewChaos(vk.ChaosConfig{Enabled: true, Rules: rules, Seed: 42}), 500)
+
+	count := 0
+	for _, f := range first {
+		if f {
+			count++
+		}
+	}
+
+	assert.InDelta(t, 150, count, 50)
+
+	second := faults(vk.NewChaos(vk.ChaosConfig{Enabled: true, Rules: rules, Seed: 42}), 500)
+	assert.Equal(t, first, second, "the same seed should inject the same faults")
+}
+
+func TestChaosSwitches(t *testing.T) {
+	rules := []vk.ChaosRule{{Probability: 1, Fault: vk.ChaosError}}
+
+	t.Run("not allowed", func(t *testing.T) {
+		chaos := vk.NewChaos(vk.ChaosConfig{Enabled: true, Rules: rules})
+		ts := chaosServer(t, chaos, false, &logCapture{})
+
+		resp, err := http.Get(ts.URL + "/orders")
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "servers without UseChaos never inject faults")
+		assert.Empty(t, chaos.Stats().Injected)
+	})
+
+	t.Run("admin", func(t *testing.T) {
+		chaos := vk.NewChaos(vk.ChaosConfig{Rules: rules})
+		ts := chaosServer(t, chaos, true, &logCapture{})
+
+		status := func() int {
+			resp, err := http.Get(ts.URL + "/orders")
+			require.NoError(t, err)
+			resp.Body.Close()
+
+			return resp.StatusCode
+		}
+
+		assert.Equal(t, http.StatusOK, status(), "chaos is disabled until it is enabled")
+
+		server := vk.New(vk.UseLogger(vlog.Noop()))
+		server.RegisterAdmin(chaos)
+		require.NoError(t, server.TestStart())
+
+		admin := func(method, body string) int {
+			w := httptest.NewRecorder()
+			server.AdminRouter().ServeHTTP(w, httptest.NewRequest(method, "/chaos", strings.NewReader(body)))
+
+			return w.Code
+		}
+
+		assert.Equal(t, http.StatusOK, admin(http.MethodPut, `{"enabled":true}`))
+		assert.Equal(t, http.StatusServiceUnavailable, status())
+
+		assert.Equal(t, http.StatusOK, admin(http.MethodPut, `{"rules":[{"route":"/users/:id","probability":1,"fault":"error","status":500}]}`))
+		assert.Equal(t, http.StatusOK, status())
+
+		assert.Equal(t, http.StatusBadRequest, admin(http.MethodPut, `{"rules":[{"probability":2,"fault":"error"}]}`))
+		assert.Equal(t, http.StatusBadRequest, admin(http.MethodPut, `{"rules":[{"probability":1,"fault":"explode"}]}`))
+
+		assert.Equal(t, http.StatusOK, admin(http.MethodPut, `{"enabled":false}`))
+		assert.False(t, chaos.Stats().Enabled)
+		assert.Equal(t, http.StatusOK, admin(http.MethodGet, ""))
+	})
+}
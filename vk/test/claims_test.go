@@ -0,0 +1,133 @@
+package test_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+)
+
+func TestClaimsPropagation(t *testing.T) {
+	var upstreamHeaders http.Header
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHeaders = r.Header.Clone()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	proxy, err := vk.NewProxy(vlog.Noop(), upstream.URL, vk.ProxyOptions{})
+	require.NoError(t, err)
+
+	logs := &logCapture{}
+
+	server := vk.New(
+		vk.UseLogger(vlog.Default(vlog.Level(vlog.LogLevelInfo), vlog.WithWriter(logs))),
+		vk.UseFallbackAddress(upstream.URL),
+	)
+
+	// stands in for the auth middleware, which would have verified a token to get these
+	auth := vk.Named("auth", func(inner vk.HandlerFunc) vk.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+			if r.Header.Get("Authorization") != "" {
+				ctx.Set(vk.ClaimsKey, map[string]interface{}{
+					"sub":   "user-1\r\nX-Admin: true",
+					"email": "alice@example.com",
+					"token": "secret-token",
+					"org":   map[string]interface{}{"id": float64(4200), "name": strings.Repeat("a", 300)},
+				})
+			}
+
+			return inner(w, r, ctx)
+		}
+	})
+
+	claims := vk.ClaimsPropagation([]vk.ClaimRule{
+		{Claim: "sub", ScopeField: "user_id", Header: "X-User-ID"},
+		{Claim: "org.id", ScopeField: "org_id", Header: "X-Org-ID"},
+		{Claim: "org.name", ScopeField: "org_name", MaxLength: 8},
+	})
+
+	g := vk.Group("/api").WithMiddlewares(claims, auth)
+
+	g.GET("/orders", vk.WrapStdHandlerWithCtx(proxy))
+
+	g.GET("/me", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		ctx.Log.Info("handled")
+
+		return vk.RespondJSON(ctx.Context, w, ctx.OutboundHeaders(), http.StatusOK)
+	})
+
+	server.AddGroup(g)
+	require.NoError(t, server.TestStart())
+
+	do := func(path string, header http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.Header = header
+
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+
+		return w
+	}
+
+	t.Run("scope", func(t *testing.T) {
+		w := do("/api/me", http.Header{"Authorization": {"Bearer secret-token"}})
+		require.Equal(t, http.StatusOK, w.Code)
+
+		assert.JSONEq(t, `{"X-User-Id":["user-1X-Admin: true"],"X-Org-Id":["4200"]}`, w.Body.String())
+
+		logs.lock.Lock()
+		line := logs.buf.String()
+		logs.lock.Unlock()
+
+		assert.Contains(t, line, `"user_id":"user-1X-Admin: true"`)
+		assert.Contains(t, line, `"org_id":"4200"`)
+		assert.Contains(t, line, `"org_name":"aaaaaaaa"`)
+		assert.Contains(t, line, `"request_id":`)
+		assert.NotContains(t, line, "alice@example.com")
+		assert.NotContains(t, line, "secret-token")
+	})
+
+	t.Run("proxied", func(t *testing.T) {
+		w := do("/api/orders", http.Header{"Authorization": {"Bearer secret-token"}, "X-Org-Id": {"spoofed"}})
+		require.Equal(t, http.StatusOK, w.Code)
+
+		assert.Equal(t, "user-1X-Admin: true", upstreamHeaders.Get("X-User-ID"))
+		assert.Equal(t, "4200", upstreamHeaders.Get("X-Org-ID"))
+		assert.Empty(t, upstreamHeaders.Get("X-Admin"))
+
+		for key, values := range upstreamHeaders {
+			if key == "Authorization" {
+				continue
+			}
+
+			for _, v := range values {
+				assert.NotContains(t, v, "alice@example.com")
+				assert.NotContains(t, v, "secret-token")
+			}
+		}
+	})
+
+	t.Run("spoofed without claims", func(t *testing.T) {
+		w := do("/api/orders", http.Header{"X-User-Id": {"admin"}})
+		require.Equal(t, http.StatusOK, w.Code)
+
+		assert.Empty(t, upstreamHeaders.Get("X-User-ID"))
+	})
+
+	t.Run("spoofed to the fallback proxy", func(t *testing.T) {
+		w := do("/unrouted", http.Header{"X-User-Id": {"admin"}, "X-Org-Id": {"1"}, "X-Other": {"kept"}})
+		require.Equal(t, http.StatusOK, w.Code)
+
+		assert.Empty(t, upstreamHeaders.Get("X-User-ID"))
+		assert.Empty(t, upstreamHeaders.Get("X-Org-ID"))
+		assert.Equal(t, "kept", upstreamHeaders.Get("X-Other"))
+	})
+}
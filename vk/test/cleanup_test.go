@@ -0,0 +1,121 @@
+package test_test
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+	"github.com/suborbital/vektor/vtest"
+)
+
+func TestCleanups(t *testing.T) {
+	logs := &logCapture{}
+
+	server := vk.New(
+		vk.UseLogger(vlog.Default(vlog.Level(vlog.LogLevelInfo), vlog.WithWriter(logs))),
+		vk.UseSlowCleanupThreshold(20*time.Millisecond),
+	)
+
+	var lock sync.Mutex
+	var order []string
+
+	record := func(name string) func() {
+		return func() {
+			lock.Lock()
+			order = append(order, name)
+			lock.Unlock()
+		}
+	}
+
+	// acquires a resource before the handler, which must be released even if the handler panics
+	acquire := vk.Named("acquire", func(inner vk.HandlerFunc) vk.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+			ctx.OnCleanup(record("middleware"))
+			return inner(w, r, ctx)
+		}
+	})
+
+	g := vk.Group("").WithMiddlewares(acquire)
+
+	g.GET("/ok", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		ctx.OnCleanup(record("first"))
+		ctx.OnCleanup(record("second"))
+
+		return vk.RespondString(ctx.Context, w, "ok", http.StatusOK)
+	})
+
+	g.GET("/panic", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		ctx.OnCleanup(record("handler"))
+		panic("boom")
+	})
+
+	g.GET("/cleanup-panic", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		ctx.OnCleanup(record("after"))
+		ctx.OnCleanup(func() { panic("cleanup failed") })
+		ctx.OnCleanup(record("before"))
+
+		return vk.RespondString(ctx.Context, w, "ok", http.StatusOK)
+	})
+
+	g.GET("/slow", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		ctx.OnCleanup(func() { time.Sleep(30 * time.Millisecond) })
+
+		return vk.RespondString(ctx.Context, w, "ok", http.StatusOK)
+	})
+
+	server.AddGroup(g)
+
+	vt := vtest.New(server)
+
+	do := func(path string) *vtest.Response {
+		lock.Lock()
+		order = nil
+		lock.Unlock()
+
+		r, _ := http.NewRequest(http.MethodGet, path, nil)
+
+		return vt.Do(r, t)
+	}
+
+	t.Run("ordering", func(t *testing.T) {
+		do("/ok").AssertStatus(http.StatusOK)
+
+		assert.Equal(t, []string{"second", "first", "middleware"}, order)
+	})
+
+	t.Run("panic in handler", func(t *testing.T) {
+		do("/panic").AssertStatus(http.StatusInternalServerError)
+
+		assert.Equal(t, []string{"handler", "middleware"}, order)
+	})
+
+	t.Run("panic in cleanup", func(t *testing.T) {
+		do("/cleanup-panic").AssertStatus(http.StatusOK).AssertBodyString("ok")
+
+		assert.Equal(t, []string{"before", "after", "middleware"}, order)
+		assert.Contains(t, strings.Join(logs.messages(), "\n"), "recovered panic in cleanup")
+	})
+
+	t.Run("slow", func(t *testing.T) {
+		do("/slow").AssertStatus(http.StatusOK)
+
+		var warning string
+		for _, m := range logs.messages() {
+			if strings.Contains(m, "cleanups took longer than 20ms") {
+				warning = m
+			}
+		}
+
+		assert.Contains(t, warning, "TestCleanups")
+		assert.NotContains(t, warning, "record")
+	})
+
+	vt.AssertCleanups(t)
+	assert.Equal(t, vk.CleanupStats{Registered: 11, Run: 11}, server.Cleanups())
+}
@@ -0,0 +1,282 @@
+package test_test
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+	"github.com/suborbital/vektor/vtest"
+)
+
+type receipt struct {
+	ID     string `json:"id"`
+	Amount int    `json:"amount"`
+}
+
+// commitServer has a route that commits its response and then waits for release before charging, failing, or
+// panicking as the request's query says, and records what its afterware and the charge saw
+type commitServer struct {
+	*vk.Server
+
+	committed chan struct{}
+	release   chan struct{}
+
+	lock     sync.Mutex
+	statuses []int
+	charges  []string
+	errs     []error
+}
+
+func newCommitServer() *commitServer {
+	cs := &commitServer{
+		Server:    vk.New(vk.UseLogger(vlog.Noop())),
+		committed: make(chan struct{}, 1),
+		release:   make(chan struct{}, 1),
+	}
+
+	afterDone := func(r *http.Request, ctx *vk.Ctx, resp vk.ResponseSummary) {
+		cs.lock.Lock()
+		defer cs.lock.Unlock()
+
+		cs.statuses = append(cs.statuses, resp.Status)
+	}
+
+	g := vk.Group("").After(afterDone)
+
+	g.POST("/charges", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		if err := ctx.CommitResponse(http.StatusCreated, receipt{ID: "ch_1", Amount: 100}); err != nil {
+			cs.record(err)
+			return err
+		}
+
+		if !ctx.Committed() {
+			cs.record(errors.New("the response isn't committed"))
+		}
+
+		cs.record(ctx.CommitResponse(http.StatusOK, receipt{ID: "ch_2"}))
+
+		cs.committed <- struct{}{}
+		<-cs.release
+
+		switch r.URL.Query().Get("then") {
+		case "fail":
+			return vk.E(http.StatusBadGateway, "the charge failed")
+		case "panic":
+			panic("the charge panicked")
+		case "respond":
+			return vk.RespondString(ctx.Context, w, "again", http.StatusOK)
+		}
+
+		cs.lock.Lock()
+		cs.charges = append(cs.charges, "ch_1")
+		cs.lock.Unlock()
+
+		return nil
+	})
+
+	g.POST("/started", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		w.WriteHeader(http.StatusAccepted)
+
+		cs.record(ctx.CommitResponse(http.StatusCreated, "late"))
+
+		return nil
+	})
+
+	cs.AddGroup(g)
+
+	return cs
+}
+
+func (cs *commitServer) record(err error) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	cs.errs = append(cs.errs, err)
+}
+
+func TestCommitResponseOnTheWire(t *testing.T) {
+	for _, then := range []string{"charge", "fail", "panic", "respond"} {
+		t.Run(then, func(t *testing.T) {
+			cs := newCommitServer()
+			require.NoError(t, cs.TestStart())
+
+			ts := httptest.NewServer(cs)
+			defer ts.Close()
+
+			conn, err := net.Dial("tcp", strings.TrimPrefix(ts.URL, "http://"))
+			require.NoError(t, err)
+
+			defer conn.Close()
+
+			_, err = fmt.Fprintf(conn, "POST /charges?then=%s HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\nContent-Length: 0\r\n\r\n", then)
+			require.NoError(t, err)
+
+			select {
+			case <-cs.committed:
+			case <-time.After(2 * time.Second):
+				t.Fatal("the handler didn't commit its response")
+			}
+
+			// the whole response is on the wire while the handler is still running
+			require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			require.NoError(t, err)
+
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+
+			assert.Equal(t, http.StatusCreated, resp.StatusCode)
+			assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+			assert.JSONEq(t, `{"id": "ch_1", "amount": 100}`, string(body))
+
+			cs.release <- struct{}{}
+
+			// the connection is closed once the handler returns, without anything else written to it
+			rest, _ := io.ReadAll(conn)
+			assert.Empty(t, rest)
+
+			cs.lock.Lock()
+			defer cs.lock.Unlock()
+
+			require.Len(t, cs.errs, 1)
+			assert.Equal(t, vk.ErrAlreadyCommitted, cs.errs[0])
+
+			assert.Equal(t, []int{http.StatusCreated}, cs.statuses, "the afterware should see the committed status")
+
+			switch then {
+			case "charge":
+				assert.Equal(t, []string{"ch_1"}, cs.charges)
+				assert.Equal(t, uint64(0), cs.DoubleResponses())
+			case "respond":
+				assert.Equal(t, uint64(1), cs.DoubleResponses(), "a response after the commit is a double response")
+			default:
+				assert.Equal(t, uint64(0), cs.DoubleResponses(), "the error response shouldn't be attempted")
+			}
+		})
+	}
+}
+
+func TestCommitResponseWrapper(t *testing.T) {
+	cs := newCommitServer()
+	vt := vtest.New(cs.Server)
+
+	cs.release <- struct{}{}
+
+	req, _ := http.NewRequest(http.MethodPost, "/charges?then=fail", nil)
+	resp := vt.Do(req, t).AssertStatus(http.StatusCreated)
+
+	assert.JSONEq(t, `{"id": "ch_1", "amount": 100}`, string(resp.Body), "the error shouldn't be written after the committed response")
+	assert.Equal(t, uint64(0), cs.DoubleResponses())
+	assert.Equal(t, []int{http.StatusCreated}, cs.statuses)
+}
+
+func TestCommitResponseErrors(t *testing.T) {
+	t.Run("started", func(t *testing.T) {
+		cs := newCommitServer()
+		vt := vtest.New(cs.Server)
+
+		req, _ := http.NewRequest(http.MethodPost, "/started", nil)
+		vt.Do(req, t).AssertStatus(http.StatusAccepted)
+
+		require.Len(t, cs.errs, 1)
+		assert.Equal(t, vk.ErrResponseStarted, cs.errs[0])
+	})
+
+	t.Run("client gone", func(t *testing.T) {
+		cs := newCommitServer()
+		vt := vtest.New(cs.Server)
+
+		gone, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		req, _ := http.NewRequestWithContext(gone, http.MethodPost, "/charges", nil)
+		vt.Do(req, t)
+
+		require.Len(t, cs.errs, 1)
+		assert.True(t, errors.Is(cs.errs[0], vk.ErrClientGone))
+		assert.Empty(t, cs.charges, "the side effect shouldn't happen for a client that went away")
+	})
+
+	t.Run("outside a router", func(t *testing.T) {
+		ctx := vk.NewCtx(nil, nil, nil)
+
+		assert.Error(t, ctx.CommitResponse(http.StatusOK, "nope"))
+		assert.False(t, ctx.Committed())
+	})
+}
+
+func TestCommitResponseCacheAndInvalidation(t *testing.T) {
+	published := &publishedInvalidations{}
+	cache := vk.NewResponseCache(vk.CacheOptions{TTL: time.Hour, Tags: vk.CacheTags("item:{id}")})
+
+	items := vk.Group("/items").WithMiddlewares(cache.Middleware())
+
+	var gets, commits int
+	var purgedAtCommit int
+
+	items.GET("/:id", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		gets++
+		return vk.RespondString(ctx.Context, w, fmt.Sprintf("item %d", gets), http.StatusOK)
+	})
+
+	items.GET("/:id/committed", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		commits++
+		ctx.RespHeaders.Set("X-Item", "committed")
+
+		return ctx.CommitResponse(http.StatusOK, fmt.Sprintf("body %d", commits))
+	})
+
+	items.POST("/:id", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		if err := ctx.CommitResponse(http.StatusAccepted, "updated"); err != nil {
+			return err
+		}
+
+		// the side effect after the response, which must not be read from the cache as it was before
+		purgedAtCommit = len(published.published())
+
+		return nil
+	}, vk.Invalidates("item:{id}"))
+
+	server := vk.New(vk.UseLogger(vlog.Noop()), vk.UseCacheInvalidator(published))
+	server.AddGroup(items)
+
+	vt := vtest.New(server)
+
+	get := func(path string) *vtest.Response {
+		r, _ := http.NewRequest(http.MethodGet, path, nil)
+		return vt.Do(r, t)
+	}
+
+	t.Run("committed responses aren't cached", func(t *testing.T) {
+		get("/items/1/committed").AssertStatus(http.StatusOK).AssertBodyString("body 1").AssertHeader("X-Item", "committed")
+		get("/items/1/committed").AssertStatus(http.StatusOK).AssertBodyString("body 2").AssertHeader("X-Cache", "MISS")
+	})
+
+	t.Run("tags are purged before the committed response", func(t *testing.T) {
+		get("/items/1").AssertBodyString("item 1").AssertHeader("X-Cache", "MISS")
+		get("/items/1").AssertHeader("X-Cache", "HIT")
+
+		r, _ := http.NewRequest(http.MethodPost, "/items/1", nil)
+		vt.Do(r, t).AssertStatus(http.StatusAccepted).AssertBodyString("updated")
+
+		assert.Equal(t, 1, purgedAtCommit)
+		assert.Equal(t, [][]string{{"item:1"}}, published.published())
+
+		get("/items/1").AssertBodyString("item 2").AssertHeader("X-Cache", "MISS")
+	})
+}
@@ -0,0 +1,255 @@
+package test_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+)
+
+// levelRecorder records the level of each encoder created by its encodings
+type levelRecorder struct {
+	lock   sync.Mutex
+	levels []int
+}
+
+// recordingEncoder is a gzip writer that records its level each time it is used for a response
+type recordingEncoder struct {
+	*gzip.Writer
+	level    int
+	recorder *levelRecorder
+}
+
+func (r recordingEncoder) Reset(w io.Writer) {
+	if w != io.Discard {
+		r.recorder.lock.Lock()
+		r.recorder.levels = append(r.recorder.levels, r.level)
+		r.recorder.lock.Unlock()
+	}
+
+	r.Writer.Reset(w)
+}
+
+// encoding returns a gzip-based Encoding named name whose encoders record their level
+func (l *levelRecorder) encoding(name string, smallLevel, largeLevel int) vk.Encoding {
+	return vk.Encoding{
+		Name:       name,
+		SmallLevel: smallLevel,
+		LargeLevel: largeLevel,
+		NewEncoder: func(w io.Writer, level int) (vk.Encoder, error) {
+			gz, err := gzip.NewWriterLevel(w, level)
+			if err != nil {
+				return nil, err
+			}
+
+			return recordingEncoder{Writer: gz, level: level, recorder: l}, nil
+		},
+	}
+}
+
+func compressionServer(t testing.TB, mw vk.Middleware, body []byte, contentType string) *vk.Server {
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+
+	g := vk.Group("").WithMiddlewares(mw)
+	g.GET("/body", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		if contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+		}
+
+		// written in pieces, like a handler streaming its response
+		for rest := body; len(rest) > 0; {
+			n := 4096
+			if n > len(rest) {
+				n = len(rest)
+			}
+
+			if _, err := w.Write(rest[:n]); err != nil {
+				return err
+			}
+
+			rest = rest[n:]
+		}
+
+		return nil
+	})
+
+	server.AddGroup(g)
+	require.NoError(t, server.TestStart())
+
+	return server
+}
+
+func TestAdaptiveCompression(t *testing.T) {
+	cases := map[string]struct {
+		size        int
+		contentType string
+		encoding    string
+		level       int
+	}{
+		"tiny":       {100, "application/json", "", 0},
+		"small":      {8 << 10, "application/json", "gzip", gzip.BestSpeed},
+		"large":      {256 << 10, "text/csv", "gzip", gzip.BestCompression},
+		"sniffed":    {8 << 10, "", "gzip", gzip.BestSpeed},
+		"skipped":    {256 << 10, "image/png", "", 0},
+		"skip-param": {256 << 10, "font/woff2; charset=binary", "", 0},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			recorder := &levelRecorder{}
+
+			policy := vk.DefaultCompressionPolicy()
+			policy.Encodings = []vk.Encoding{recorder.encoding("gzip", gzip.BestSpeed, gzip.BestCompression)}
+
+			body := []byte(strings.Repeat("vektor,", c.size/7+1)[:c.size])
+			server := compressionServer(t, vk.AdaptiveCompressionMiddleware(policy), body, c.contentType)
+
+			r := httptest.NewRequest(http.MethodGet, "/body", nil)
+			r.Header.Set("Accept-Encoding", "gzip")
+
+			w := httptest.NewRecorder()
+			server.ServeHTTP(w, r)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, c.encoding, w.Header().Get("Content-Encoding"))
+			assert.NotEmpty(t, w.Header().Get("Content-Type"))
+
+			received := w.Body.Bytes()
+
+			if c.encoding == "" {
+				assert.Empty(t, recorder.levels)
+
+				// a response that was buffered in full is sent with its length
+				if c.size < policy.MinSize {
+					assert.Equal(t, fmt.Sprint(c.size), w.Header().Get("Content-Length"))
+				}
+			} else {
+				assert.Equal(t, []int{c.level}, recorder.levels)
+				assert.Empty(t, w.Header().Get("Content-Length"))
+
+				gz, err := gzip.NewReader(bytes.NewReader(received))
+				require.NoError(t, err)
+
+				received, err = io.ReadAll(gz)
+				require.NoError(t, err)
+			}
+
+			assert.Equal(t, body, received)
+		})
+	}
+}
+
+func TestCompressionNegotiation(t *testing.T) {
+	recorder := &levelRecorder{}
+
+	policy := vk.DefaultCompressionPolicy()
+	policy.MinSize = 0
+	policy.Encodings = []vk.Encoding{
+		recorder.encoding("br", 4, 9),
+		recorder.encoding("gzip", gzip.BestSpeed, gzip.DefaultCompression),
+	}
+
+	server := compressionServer(t, vk.AdaptiveCompressionMiddleware(policy), []byte("hello"), "text/plain")
+
+	cases := map[string]string{
+		"gzip, br":              "br",
+		"br;q=0.5, gzip":        "gzip",
+		"gzip, br;q=0":          "gzip",
+		"*":                     "br",
+		"*;q=0.1, gzip;q=0.5":   "gzip",
+		"identity":              "",
+		"":                      "",
+		"deflate, gzip;q=0.001": "gzip",
+	}
+
+	for accept, expected := range cases {
+		t.Run(accept, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/body", nil)
+			r.Header.Set("Accept-Encoding", accept)
+
+			w := httptest.NewRecorder()
+			server.ServeHTTP(w, r)
+
+			assert.Equal(t, expected, w.Header().Get("Content-Encoding"))
+			assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+		})
+	}
+
+	t.Run("invalid level", func(t *testing.T) {
+		policy := vk.DefaultCompressionPolicy()
+		policy.Encodings = []vk.Encoding{vk.GzipEncoding(gzip.BestSpeed, 42)}
+
+		assert.Panics(t, func() {
+			vk.AdaptiveCompressionMiddleware(policy)
+		})
+	})
+}
+
+// BenchmarkCompression compares compressing every response at gzip's default level with the default adaptive
+// policy, for payloads ranging from tiny JSON to a large text export and an already-compressed image
+func BenchmarkCompression(b *testing.B) {
+	random := make([]byte, 256<<10)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	var csv strings.Builder
+	for i := 0; csv.Len() < 4<<20; i++ {
+		fmt.Fprintf(&csv, "%d,user-%d,user%d@example.com,%d,active\n", i, i, i%977, i*37%10000)
+	}
+
+	payloads := []struct {
+		name        string
+		contentType string
+		body        []byte
+	}{
+		{"json-200B", "application/json", []byte(`{"id":"f3b1c2d4","name":"vektor","status":"ok","tags":["api","http"],"count":42}`)},
+		{"json-16KB", "application/json", []byte(strings.Repeat(`{"id":"f3b1c2d4","name":"vektor","status":"ok","count":42},`, 16<<10/60))},
+		{"csv-4MB", "text/csv", []byte(csv.String())},
+		{"png-256KB", "image/png", random},
+	}
+
+	policies := []struct {
+		name string
+		mw   vk.Middleware
+	}{
+		{"fixed", vk.CompressionMiddleware()},
+		{"adaptive", vk.AdaptiveCompressionMiddleware(vk.DefaultCompressionPolicy())},
+	}
+
+	for _, p := range payloads {
+		for _, policy := range policies {
+			b.Run(p.name+"/"+policy.name, func(b *testing.B) {
+				server := compressionServer(b, policy.mw, p.body, p.contentType)
+
+				var out int
+
+				b.SetBytes(int64(len(p.body)))
+				b.ReportAllocs()
+				b.ResetTimer()
+
+				for i := 0; i < b.N; i++ {
+					r := httptest.NewRequest(http.MethodGet, "/body", nil)
+					r.Header.Set("Accept-Encoding", "gzip")
+
+					w := httptest.NewRecorder()
+					server.ServeHTTP(w, r)
+
+					out = w.Body.Len()
+				}
+
+				b.ReportMetric(float64(out), "out-B/op")
+			})
+		}
+	}
+}
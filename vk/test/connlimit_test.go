@@ -0,0 +1,173 @@
+package test_test
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+)
+
+// connLimitServer starts a server with the options on a free port, returning its address
+func connLimitServer(t *testing.T, opts ...vk.OptionsModifier) (*vk.Server, string) {
+	port := freePort(t)
+
+	server := vk.New(append([]vk.OptionsModifier{vk.UseLogger(vlog.Noop()), vk.UseHTTPPort(port)}, opts...)...)
+
+	server.GET("/ping", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.RespondString(ctx.Context, w, "pong", http.StatusOK)
+	})
+
+	events := server.Events()
+
+	go server.Start()
+
+	for {
+		if _, ok := nextEvent(t, events).(vk.Ready); ok {
+			break
+		}
+	}
+
+	t.Cleanup(func() { server.Stop() })
+
+	return server, fmt.Sprintf("127.0.0.1:%d", port)
+}
+
+// dialIdle opens n connections to addr without sending anything on them
+func dialIdle(t *testing.T, addr string, n int) []net.Conn {
+	conns := make([]net.Conn, n)
+
+	for i := range conns {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+
+		t.Cleanup(func() { conn.Close() })
+
+		conns[i] = conn
+	}
+
+	return conns
+}
+
+// ping sends a request on the connection and reads its response, leaving the connection idle
+func ping(t *testing.T, conn net.Conn) {
+	_, err := fmt.Fprint(conn, "GET /ping HTTP/1.1\r\nHost: test\r\n\r\n")
+	require.NoError(t, err)
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+// isClosed returns true if the server has closed the connection
+func isClosed(conn net.Conn) bool {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+
+	_, err := conn.Read(make([]byte, 1))
+
+	netErr, ok := err.(net.Error)
+
+	return err != nil && !(ok && netErr.Timeout())
+}
+
+func TestConnectionLimits(t *testing.T) {
+	t.Run("per client", func(t *testing.T) {
+		server, addr := connLimitServer(t, vk.UseConnectionLimits(0, 3))
+
+		conns := dialIdle(t, addr, 3)
+
+		assert.Eventually(t, func() bool { return server.Connections().Stats().Open == 3 }, time.Second, 10*time.Millisecond)
+
+		rejected := dialIdle(t, addr, 1)[0]
+		assert.True(t, isClosed(rejected))
+
+		ping(t, conns[0])
+
+		stats := server.Connections().Stats()
+		assert.Equal(t, 3, stats.Open)
+		assert.Equal(t, 1, stats.Clients)
+		assert.Equal(t, uint64(1), stats.RejectedClient)
+		assert.Equal(t, uint64(0), stats.RejectedGlobal)
+		assert.Equal(t, map[string]int{"new": 2, "idle": 1}, stats.States)
+
+		// closed connections release their slot
+		conns[1].Close()
+
+		assert.Eventually(t, func() bool { return server.Connections().Stats().Open == 2 }, time.Second, 10*time.Millisecond)
+
+		ping(t, dialIdle(t, addr, 1)[0])
+	})
+
+	t.Run("global", func(t *testing.T) {
+		server, addr := connLimitServer(t, vk.UseConnectionLimits(2, 0))
+
+		dialIdle(t, addr, 2)
+
+		assert.Eventually(t, func() bool { return server.Connections().Stats().Open == 2 }, time.Second, 10*time.Millisecond)
+
+		assert.True(t, isClosed(dialIdle(t, addr, 1)[0]))
+
+		// raising the limit takes effect for the next connection
+		server.Connections().SetLimits(3, 0)
+
+		ping(t, dialIdle(t, addr, 1)[0])
+
+		stats := server.Connections().Stats()
+		assert.Equal(t, 3, stats.Open)
+		assert.Equal(t, uint64(1), stats.RejectedGlobal)
+	})
+}
+
+func TestIdleReaping(t *testing.T) {
+	server, addr := connLimitServer(t, vk.UseIdleReaping(2, 100*time.Millisecond))
+
+	conns := dialIdle(t, addr, 5)
+	for _, conn := range conns {
+		ping(t, conn)
+	}
+
+	assert.Eventually(t, func() bool { return server.Connections().Stats().Reaped == 3 }, 2*time.Second, 10*time.Millisecond)
+
+	// the longest idle connections are the ones reaped
+	for i, conn := range conns {
+		assert.Equal(t, i < 3, isClosed(conn), "connection %d", i)
+	}
+
+	stats := server.Connections().Stats()
+	assert.Equal(t, 2, stats.Open)
+	assert.Equal(t, map[string]int{"idle": 2}, stats.States)
+
+	// a client at the threshold keeps its idle connections
+	time.Sleep(300 * time.Millisecond)
+
+	ping(t, conns[3])
+	ping(t, conns[4])
+}
+
+func TestConnectionLimitOptions(t *testing.T) {
+	t.Setenv("VK_MAX_CONNECTIONS_PER_CLIENT", "-1")
+	t.Setenv("VK_IDLE_REAP_THRESHOLD", "10")
+
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+
+	err := server.TestStart()
+	require.Error(t, err)
+
+	var optsErr vk.OptionsError
+	require.ErrorAs(t, err, &optsErr)
+	assert.Equal(t, []string{
+		"connection limits cannot be negative",
+		"idle reaping requires both a threshold and a duration",
+	}, optsErr.Problems)
+}
@@ -0,0 +1,144 @@
+package test_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+)
+
+func consistencyServer(t *testing.T, logs *logCapture, mods ...vk.OptionsModifier) *vk.Server {
+	mods = append([]vk.OptionsModifier{vk.UseLogger(vlog.Default(vlog.Level(vlog.LogLevelInfo), vlog.WithWriter(logs)))}, mods...)
+
+	server := vk.New(mods...)
+
+	server.POST("/orders", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		ctx.SetConsistencyToken("stale")
+		ctx.SetConsistencyToken("lsn:42")
+
+		return vk.RespondString(ctx.Context, w, "created", http.StatusCreated)
+	})
+
+	server.GET("/orders", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		ctx.Log.Info("reading orders")
+
+		return vk.RespondString(ctx.Context, w, ctx.ConsistencyToken(), http.StatusOK)
+	})
+
+	require.NoError(t, server.TestStart())
+
+	return server
+}
+
+func TestConsistencyTokenHeader(t *testing.T) {
+	logs := &logCapture{}
+	server := consistencyServer(t, logs)
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/orders", nil))
+
+	assert.Equal(t, "lsn:42", w.Header().Get(vk.ConsistencyTokenHeader))
+
+	// without the cookie option, no cookie is set
+	assert.Empty(t, w.Header().Values("Set-Cookie"))
+
+	r := httptest.NewRequest(http.MethodGet, "/orders", nil)
+	r.Header.Set(vk.ConsistencyTokenHeader, w.Header().Get(vk.ConsistencyTokenHeader))
+
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+
+	assert.Equal(t, "lsn:42", w.Body.String())
+	assert.Contains(t, logs.buf.String(), `"consistency_token":"lsn:42"`)
+
+	t.Run("invalid", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/orders", nil)
+		r.Header.Set(vk.ConsistencyTokenHeader, strings.Repeat("x", 1000))
+
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+
+		assert.Empty(t, w.Body.String())
+	})
+}
+
+func TestConsistencyTokenCookie(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	clock := &cacheClock{now: time.Unix(1700000000, 0)}
+
+	server := consistencyServer(t, &logCapture{}, vk.UseConsistencyCookie(vk.ConsistencyCookieOptions{Secret: secret, TTL: time.Second, Now: clock.Now}))
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/orders", nil))
+
+	assert.Equal(t, "lsn:42", w.Header().Get(vk.ConsistencyTokenHeader))
+
+	// the token set first was replaced
+	cookies := w.Result().Cookies()
+	require.Len(t, cookies, 1)
+
+	cookie := cookies[0]
+	assert.Equal(t, "vk_consistency", cookie.Name)
+	assert.True(t, cookie.HttpOnly)
+	assert.Equal(t, 1, cookie.MaxAge)
+	assert.NotContains(t, cookie.Value, "lsn:42")
+
+	read := func(modify func(r *http.Request)) string {
+		r := httptest.NewRequest(http.MethodGet, "/orders", nil)
+		modify(r)
+
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+
+		return w.Body.String()
+	}
+
+	t.Run("cookie", func(t *testing.T) {
+		assert.Equal(t, "lsn:42", read(func(r *http.Request) { r.AddCookie(cookie) }))
+	})
+
+	t.Run("header takes precedence", func(t *testing.T) {
+		token := read(func(r *http.Request) {
+			r.AddCookie(cookie)
+			r.Header.Set(vk.ConsistencyTokenHeader, "lsn:43")
+		})
+
+		assert.Equal(t, "lsn:43", token)
+	})
+
+	t.Run("tampered", func(t *testing.T) {
+		// a token from another writer, with the original signature
+		forged := *cookie
+		parts := strings.SplitN(forged.Value, ".", 2)
+		forged.Value = "bHNuOjk5" + "." + parts[1]
+
+		assert.Empty(t, read(func(r *http.Request) { r.AddCookie(&forged) }))
+	})
+
+	t.Run("other secret", func(t *testing.T) {
+		other := consistencyServer(t, &logCapture{}, vk.UseConsistencyCookie(vk.ConsistencyCookieOptions{Secret: []byte("another secret")}))
+
+		r := httptest.NewRequest(http.MethodGet, "/orders", nil)
+		r.AddCookie(cookie)
+
+		w := httptest.NewRecorder()
+		other.ServeHTTP(w, r)
+
+		assert.Empty(t, w.Body.String())
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		clock.Advance(999 * time.Millisecond)
+		assert.Equal(t, "lsn:42", read(func(r *http.Request) { r.AddCookie(cookie) }), "the expiry is checked to the millisecond")
+
+		clock.Advance(time.Millisecond)
+		assert.Empty(t, read(func(r *http.Request) { r.AddCookie(cookie) }))
+	})
+}
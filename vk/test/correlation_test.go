@@ -0,0 +1,190 @@
+package test_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+)
+
+func TestCorrelation(t *testing.T) {
+	forwarded := make(chan http.Header, 1)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded <- r.Header.Clone()
+	}))
+	defer upstream.Close()
+
+	logs := &logCapture{}
+
+	server := vk.New(
+		vk.UseLogger(vlog.Default(vlog.Level(vlog.LogLevelInfo), vlog.WithWriter(logs))),
+		vk.UseFallbackAddress(upstream.URL),
+	)
+
+	server.GET("/orders", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		ctx.Log.Info("listing orders")
+
+		return vk.RespondJSON(ctx.Context, w, map[string]string{
+			"request":     ctx.Correlation().RequestID(),
+			"correlation": ctx.Correlation().CorrelationID(),
+			"causation":   ctx.Correlation().CausationID(),
+			"client":      ctx.Correlation().ClientID(),
+			"session":     ctx.Correlation().SessionID(),
+		}, http.StatusOK)
+	})
+
+	server.GET("/downstream", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		resp, err := ctx.HTTPClient().Get(upstream.URL)
+		if err != nil {
+			return err
+		}
+
+		resp.Body.Close()
+
+		return vk.RespondString(ctx.Context, w, ctx.RequestID(), http.StatusOK)
+	})
+
+	require.NoError(t, server.TestStart())
+
+	get := func(path string, header http.Header) (*httptest.ResponseRecorder, map[string]string) {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		for key, values := range header {
+			r.Header[key] = values
+		}
+
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+
+		block := map[string]string{}
+		_ = json.Unmarshal(w.Body.Bytes(), &block)
+
+		return w, block
+	}
+
+	t.Run("inherited", func(t *testing.T) {
+		w, block := get("/orders", http.Header{
+			"X-Request-Id":     {"upstream-req"},
+			"X-Correlation-Id": {"chain-1"},
+			"X-Causation-Id":   {"upstream-req"},
+			"X-Client-Id":      {"mobile-app"},
+			"X-Session-Id":     {"sess-9"},
+		})
+
+		assert.NotEqual(t, "upstream-req", block["request"], "each request gets its own ID")
+		assert.Equal(t, "chain-1", block["correlation"])
+		assert.Equal(t, "upstream-req", block["causation"])
+		assert.Equal(t, "mobile-app", block["client"])
+		assert.Equal(t, "sess-9", block["session"])
+
+		assert.Equal(t, block["request"], w.Header().Get(vk.RequestIDHeader))
+		assert.Equal(t, "chain-1", w.Header().Get(vk.CorrelationIDHeader))
+
+		// the log scope carries the block, and keeps the request_id field
+		logs.lock.Lock()
+		lines := strings.Split(strings.TrimSpace(logs.buf.String()), "\n")
+		logs.lock.Unlock()
+
+		var scope map[string]string
+		for _, line := range lines {
+			var entry struct {
+				Message string            `json:"log_message"`
+				Scope   map[string]string `json:"scope"`
+			}
+
+			if json.Unmarshal([]byte(line), &entry) == nil && strings.Contains(entry.Message, "listing orders") {
+				scope = entry.Scope
+			}
+		}
+
+		assert.Equal(t, map[string]string{
+			"request_id":     block["request"],
+			"correlation_id": "chain-1",
+			"causation_id":   "upstream-req",
+			"client_id":      "mobile-app",
+			"session_id":     "sess-9",
+		}, scope)
+	})
+
+	t.Run("caller request ID only", func(t *testing.T) {
+		_, block := get("/orders", http.Header{"X-Request-Id": {"upstream-req"}})
+
+		assert.Equal(t, "upstream-req", block["correlation"])
+		assert.Equal(t, "upstream-req", block["causation"])
+	})
+
+	t.Run("generated", func(t *testing.T) {
+		w, block := get("/orders", nil)
+
+		assert.NotEmpty(t, block["request"])
+		assert.Equal(t, block["request"], block["correlation"], "a request that starts the chain is its own correlation")
+		assert.Equal(t, block["request"], block["causation"])
+		assert.Empty(t, block["client"])
+		assert.Equal(t, block["request"], w.Header().Get(vk.CorrelationIDHeader))
+	})
+
+	t.Run("outbound", func(t *testing.T) {
+		w, _ := get("/downstream", http.Header{"X-Correlation-Id": {"chain-2"}, "X-Client-Id": {"mobile-app"}})
+		require.Equal(t, http.StatusOK, w.Code)
+
+		headers := <-forwarded
+		assert.Equal(t, w.Body.String(), headers.Get(vk.RequestIDHeader))
+		assert.Equal(t, "chain-2", headers.Get(vk.CorrelationIDHeader))
+		assert.Equal(t, w.Body.String(), headers.Get(vk.CausationIDHeader), "the handled request caused the call")
+		assert.Equal(t, "mobile-app", headers.Get(vk.ClientIDHeader))
+		assert.Empty(t, headers.Get(vk.SessionIDHeader))
+	})
+
+	t.Run("fallback proxy", func(t *testing.T) {
+		get("/unrouted", http.Header{
+			"X-Request-Id":     {"upstream-req"},
+			"X-Correlation-Id": {"chain-3"},
+			"X-Session-Id":     {"sess-9"},
+		})
+
+		headers := <-forwarded
+		assert.Equal(t, "chain-3", headers.Get(vk.CorrelationIDHeader))
+		assert.Equal(t, "sess-9", headers.Get(vk.SessionIDHeader))
+		assert.NotEqual(t, "upstream-req", headers.Get(vk.RequestIDHeader), "the proxied request gets its own ID")
+		assert.Equal(t, headers.Get(vk.RequestIDHeader), headers.Get(vk.CausationIDHeader))
+
+		get("/unrouted", nil)
+
+		headers = <-forwarded
+		assert.NotEmpty(t, headers.Get(vk.RequestIDHeader))
+		assert.Equal(t, headers.Get(vk.RequestIDHeader), headers.Get(vk.CorrelationIDHeader))
+	})
+}
+
+func TestCorrelationHeaderNames(t *testing.T) {
+	server := vk.New(
+		vk.UseLogger(vlog.Noop()),
+		vk.UseCorrelationHeaders(vk.CorrelationHeaders{CorrelationID: "X-Trace-Chain", ClientID: "X-App"}),
+	)
+
+	server.GET("/whoami", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.RespondString(ctx.Context, w, ctx.Correlation().ClientID(), http.StatusOK)
+	})
+
+	require.NoError(t, server.TestStart())
+
+	r := httptest.NewRequest(http.MethodGet, "/whoami", nil)
+	r.Header.Set("X-Trace-Chain", "chain-4")
+	r.Header.Set("X-App", "cli")
+	r.Header.Set(vk.CorrelationIDHeader, "ignored")
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+
+	assert.Equal(t, "cli", w.Body.String())
+	assert.Equal(t, "chain-4", w.Header().Get("X-Trace-Chain"))
+	assert.Empty(t, w.Header().Get(vk.CorrelationIDHeader))
+	assert.NotEmpty(t, w.Header().Get(vk.RequestIDHeader), "names left empty keep their defaults")
+}
@@ -0,0 +1,223 @@
+package test_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+)
+
+func TestHandlerTimeout(t *testing.T) {
+	logs := &logCapture{}
+
+	server := vk.New(
+		vk.UseLogger(vlog.Default(vlog.Level(vlog.LogLevelInfo), vlog.WithWriter(logs))),
+		vk.UseHandlerTimeout(50*time.Millisecond, 100*time.Millisecond),
+		vk.UseInFlightTracking(0),
+	)
+
+	release := make(chan struct{})
+	lateWrite := make(chan error, 1)
+
+	server.GET("/stubborn", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		// ignores the cancellation of its context entirely
+		<-release
+
+		ctx.RespHeaders.Set("X-Late", "true")
+		_, err := w.Write([]byte("too late"))
+		lateWrite <- err
+
+		return nil
+	})
+
+	server.GET("/streaming", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("started,"))
+
+		// the response has started, so it can finish after the soft deadline
+		time.Sleep(80 * time.Millisecond)
+
+		_, err := w.Write([]byte("finished"))
+		return err
+	})
+
+	require.NoError(t, server.TestStart())
+
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	t.Run("soft deadline", func(t *testing.T) {
+		start := time.Now()
+
+		resp, err := http.Get(ts.URL + "/stubborn")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		body, _ := io.ReadAll(resp.Body)
+
+		assert.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+		assert.Equal(t, http.StatusText(http.StatusGatewayTimeout), string(body))
+		assert.Empty(t, resp.Header.Get("X-Late"))
+		assert.Less(t, time.Since(start), time.Second)
+	})
+
+	t.Run("hard deadline", func(t *testing.T) {
+		assert.Eventually(t, func() bool {
+			return server.AbandonedHandlers() == 1
+		}, 2*time.Second, 10*time.Millisecond)
+
+		requests := server.InFlight().Requests()
+		require.Len(t, requests, 1)
+		assert.Equal(t, "/stubborn", requests[0].Route)
+		assert.True(t, requests[0].Abandoned)
+
+		var warning string
+		for _, m := range logs.messages() {
+			if strings.Contains(m, "abandoned handler") {
+				warning = m
+			}
+		}
+
+		assert.Contains(t, warning, "GET /stubborn")
+		assert.Contains(t, warning, requests[0].RequestID)
+	})
+
+	t.Run("late return", func(t *testing.T) {
+		close(release)
+
+		select {
+		case err := <-lateWrite:
+			assert.Equal(t, http.ErrHandlerTimeout, err)
+		case <-time.After(time.Second):
+			t.Fatal("handler did not return")
+		}
+
+		assert.Eventually(t, func() bool {
+			return len(server.InFlight().Requests()) == 0
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("started response", func(t *testing.T) {
+		resp, err := http.Get(ts.URL + "/streaming")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		body, _ := io.ReadAll(resp.Body)
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "started,finished", string(body))
+		assert.Equal(t, uint64(1), server.AbandonedHandlers())
+	})
+}
+
+func TestHandlerTimeoutAbort(t *testing.T) {
+	server := vk.New(vk.UseLogger(vlog.Noop()), vk.UseHandlerTimeout(time.Second, time.Second))
+
+	server.GET("/abort", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("partial"))
+
+		panic(http.ErrAbortHandler)
+	})
+
+	server.GET("/hijack", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return err
+		}
+
+		defer conn.Close()
+
+		_, _ = buf.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 8\r\nConnection: close\r\n\r\nhijacked")
+
+		return buf.Flush()
+	})
+
+	require.NoError(t, server.TestStart())
+
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	t.Run("abort", func(t *testing.T) {
+		// the abort closes the connection rather than crashing the process
+		resp, err := http.Get(ts.URL + "/abort")
+		if err == nil {
+			_, err = io.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+
+		assert.Error(t, err)
+	})
+
+	t.Run("hijack", func(t *testing.T) {
+		resp, err := http.Get(ts.URL + "/hijack")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		body, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, "hijacked", string(body))
+	})
+}
+
+func TestHandlerTimeoutRecorded(t *testing.T) {
+	logs := &logCapture{}
+
+	server := vk.New(
+		vk.UseLogger(vlog.Default(vlog.Level(vlog.LogLevelInfo), vlog.WithWriter(logs))),
+		vk.UseHandlerTimeout(50*time.Millisecond, time.Second),
+	)
+
+	observed := make(chan vk.ResponseSummary, 1)
+
+	afterware := func(r *http.Request, ctx *vk.Ctx, resp vk.ResponseSummary) {
+		observed <- resp
+	}
+
+	slow := vk.Group("").After(afterware)
+	slow.GET("/slow", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		time.Sleep(100 * time.Millisecond)
+
+		return vk.RespondString(ctx.Context, w, "created", http.StatusCreated)
+	})
+
+	server.AddGroup(slow)
+
+	require.NoError(t, server.TestStart())
+
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/slow")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+
+	// the abandoned handler's 201 is dropped, and the 504 is what the request reports
+	select {
+	case summary := <-observed:
+		assert.Equal(t, http.StatusGatewayTimeout, summary.Status)
+		assert.Equal(t, int64(len(body)), summary.Bytes)
+	case <-time.After(2 * time.Second):
+		t.Fatal("afterware was not called")
+	}
+
+	assert.Eventually(t, func() bool {
+		for _, m := range logs.messages() {
+			if strings.Contains(m, "GET /slow completed") {
+				return strings.Contains(m, "completed (504: Gateway Timeout)")
+			}
+		}
+
+		return false
+	}, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,215 @@
+package test_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+)
+
+// webhookFixture is a delivery as a provider would send it, and send again
+type webhookFixture struct {
+	id   string
+	body string
+}
+
+var webhookFixtures = []webhookFixture{
+	{"evt_1", `{"id":"evt_1","type":"invoice.paid","amount":1200}`},
+	{"evt_2", `{"id":"evt_2","type":"invoice.paid","amount":800}`},
+	{"evt_3", `{"id":"evt_3","type":"customer.deleted"}`},
+}
+
+func deliver(server *vk.Server, f webhookFixture) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/webhooks", strings.NewReader(f.body))
+	if f.id != "" {
+		r.Header.Set("X-Event-ID", f.id)
+	}
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+
+	return w
+}
+
+func dedupServer(t *testing.T, dedup *vk.Deduplicator, handler vk.HandlerFunc) *vk.Server {
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+
+	g := vk.Group("").WithMiddlewares(dedup.Middleware())
+	g.POST("/webhooks", handler)
+
+	server.AddGroup(g)
+	require.NoError(t, server.TestStart())
+
+	return server
+}
+
+func TestDedupReplayedWebhooks(t *testing.T) {
+	dedup := vk.NewDeduplicator(vk.DedupByHeader("X-Event-ID"), vk.NewMemoryDedupStore(), time.Hour)
+
+	var processed int32
+	failNext := int32(1)
+
+	server := dedupServer(t, dedup, func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		body, _ := io.ReadAll(r.Body)
+
+		// the first delivery of evt_3 fails, so the provider's retry must be handled
+		if strings.Contains(string(body), "evt_3") && atomic.CompareAndSwapInt32(&failNext, 1, 0) {
+			return vk.E(http.StatusServiceUnavailable, "try again")
+		}
+
+		atomic.AddInt32(&processed, 1)
+
+		return vk.RespondString(ctx.Context, w, "processed", http.StatusOK)
+	})
+
+	for _, f := range webhookFixtures {
+		deliver(server, f)
+	}
+
+	assert.EqualValues(t, 2, atomic.LoadInt32(&processed))
+
+	// the provider redelivers everything
+	for _, f := range webhookFixtures {
+		w := deliver(server, f)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		if f.id == "evt_3" {
+			assert.Equal(t, "processed", w.Body.String())
+			continue
+		}
+
+		var resp struct {
+			Duplicate bool      `json:"duplicate"`
+			FirstSeen time.Time `json:"first_seen"`
+		}
+
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.True(t, resp.Duplicate)
+		assert.False(t, resp.FirstSeen.IsZero())
+	}
+
+	assert.EqualValues(t, 3, atomic.LoadInt32(&processed))
+
+	// without an event ID, the delivery is handled as usual
+	w := deliver(server, webhookFixture{body: `{"type":"ping"}`})
+	assert.Equal(t, "processed", w.Body.String())
+
+	assert.Equal(t, vk.DedupStats{Handled: 4, Duplicates: 2, KeyErrors: 1}, dedup.Stats())
+}
+
+func TestDedupConcurrentDelivery(t *testing.T) {
+	dedup := vk.NewDeduplicator(vk.DedupByHeader("X-Event-ID"), vk.NewMemoryDedupStore(), time.Hour)
+	dedup.SetDuplicateStatus(http.StatusAccepted)
+
+	var processed int32
+	release := make(chan struct{})
+
+	server := dedupServer(t, dedup, func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		atomic.AddInt32(&processed, 1)
+		<-release
+
+		return vk.RespondString(ctx.Context, w, "processed", http.StatusOK)
+	})
+
+	const deliveries = 8
+
+	codes := make(chan int, deliveries)
+
+	var wg sync.WaitGroup
+	for i := 0; i < deliveries; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			codes <- deliver(server, webhookFixtures[0]).Code
+		}()
+	}
+
+	// every delivery but the one being handled is turned away
+	conflicts := 0
+	for i := 0; i < deliveries-1; i++ {
+		code := <-codes
+		assert.Equal(t, http.StatusConflict, code)
+		conflicts++
+	}
+
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, http.StatusOK, <-codes)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&processed))
+
+	// once it has been handled, redeliveries are duplicates
+	assert.Equal(t, http.StatusAccepted, deliver(server, webhookFixtures[0]).Code)
+
+	stats := dedup.Stats()
+	assert.EqualValues(t, 1, stats.Handled)
+	assert.EqualValues(t, conflicts, stats.InProgress)
+	assert.EqualValues(t, 1, stats.Duplicates)
+}
+
+func TestDedupByBodyHash(t *testing.T) {
+	store := vk.NewMemoryDedupStore()
+	dedup := vk.NewDeduplicator(vk.DedupByBodyHash(1024), store, time.Hour)
+
+	var bodies []string
+
+	server := dedupServer(t, dedup, func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		bodies = append(bodies, string(body))
+
+		return vk.RespondString(ctx.Context, w, "processed", http.StatusOK)
+	})
+
+	// the event ID isn't used, only the body
+	deliver(server, webhookFixture{"a", webhookFixtures[0].body})
+	deliver(server, webhookFixture{"b", webhookFixtures[0].body})
+	deliver(server, webhookFixture{"c", webhookFixtures[1].body})
+
+	// too large to hash, so it is handled every time
+	large := webhookFixture{body: strings.Repeat("x", 2048)}
+	deliver(server, large)
+	deliver(server, large)
+
+	// the handler reads the whole body, even when it was too large to hash
+	assert.Equal(t, []string{webhookFixtures[0].body, webhookFixtures[1].body, large.body, large.body}, bodies)
+	assert.Equal(t, 2, store.Len())
+	assert.Equal(t, vk.DedupStats{Handled: 2, Duplicates: 1, KeyErrors: 2}, dedup.Stats())
+}
+
+func TestMemoryDedupStoreExpiry(t *testing.T) {
+	store := vk.NewMemoryDedupStore()
+
+	state, _, err := store.Begin("evt", 20*time.Millisecond)
+	require.NoError(t, err)
+	assert.Equal(t, vk.DedupNew, state)
+
+	// a claim that is still held doesn't expire
+	time.Sleep(30 * time.Millisecond)
+
+	state, _, _ = store.Begin("evt", 20*time.Millisecond)
+	assert.Equal(t, vk.DedupInProgress, state)
+
+	require.NoError(t, store.Finish("evt", true))
+
+	state, _, _ = store.Begin("evt", 20*time.Millisecond)
+	assert.Equal(t, vk.DedupNew, state)
+	require.NoError(t, store.Finish("evt", true))
+
+	state, first, _ := store.Begin("evt", 20*time.Millisecond)
+	assert.Equal(t, vk.DedupSeen, state)
+	assert.False(t, first.IsZero())
+}
@@ -0,0 +1,230 @@
+package test_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+	"github.com/suborbital/vektor/vtest"
+)
+
+func observeMany(d *vk.Degradation, n int, latency time.Duration, failed bool) {
+	for i := 0; i < n; i++ {
+		d.Observe(latency, failed)
+	}
+}
+
+func TestDegradationLatency(t *testing.T) {
+	clock := &healthClock{now: time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)}
+
+	d := vk.NewDegradation(vk.DegradationOptions{
+		Latency: vk.LatencySignal{Enabled: true, Degraded: 100 * time.Millisecond, Unhealthy: 500 * time.Millisecond, MinRequests: 10},
+		Window:  10 * time.Second,
+		Now:     clock.Now,
+	}, nil)
+
+	var changes []vk.DegradationChanged
+	d.OnChange(func(change vk.DegradationChanged) {
+		changes = append(changes, change)
+	})
+
+	// too few requests to grade
+	observeMany(d, 5, 2*time.Second, false)
+
+	report := d.Evaluate()
+	assert.Equal(t, vk.ReadinessHealthy, report.State)
+	assert.Equal(t, 1.0, report.Score)
+	assert.Equal(t, http.StatusOK, report.Status)
+
+	clock.advance(10 * time.Second)
+
+	observeMany(d, 20, 50*time.Millisecond, false)
+	observeMany(d, 100, 300*time.Millisecond, false)
+
+	report = d.Evaluate()
+	require.Len(t, report.Signals, 1)
+	assert.Equal(t, vk.LatencySignalName, report.Signals[0].Name)
+	assert.Equal(t, vk.ReadinessDegraded, report.State)
+	assert.Equal(t, http.StatusNonAuthoritativeInfo, report.Status)
+	assert.InDelta(t, 0.5, report.Score, 0.1)
+	assert.InDelta(t, 300, report.Signals[0].Value, 30)
+
+	observeMany(d, 100, 700*time.Millisecond, false)
+
+	report = d.Evaluate()
+	assert.Equal(t, vk.ReadinessUnhealthy, report.State)
+	assert.Equal(t, 0.0, report.Score)
+	assert.Equal(t, http.StatusServiceUnavailable, report.Status)
+
+	// the slow requests leave the window
+	clock.advance(11 * time.Second)
+	observeMany(d, 20, 10*time.Millisecond, false)
+
+	report = d.Evaluate()
+	assert.Equal(t, vk.ReadinessHealthy, report.State)
+	assert.Equal(t, 1.0, report.Score)
+
+	require.Len(t, changes, 3)
+	assert.Equal(t, vk.ReadinessHealthy, changes[0].From)
+	assert.Equal(t, vk.ReadinessDegraded, changes[0].To)
+	assert.Equal(t, vk.ReadinessUnhealthy, changes[1].To)
+	assert.Equal(t, 0.0, changes[2].PreviousScore)
+	assert.Equal(t, vk.ReadinessHealthy, changes[2].To)
+}
+
+func TestDegradationHysteresis(t *testing.T) {
+	t.Run("in flight", func(t *testing.T) {
+		var current int64
+
+		d := vk.NewDegradation(vk.DegradationOptions{
+			InFlight: vk.InFlightSignal{Enabled: true, Limit: 10, Current: func() int64 { return current }},
+		}, nil)
+
+		steps := []struct {
+			current int64
+			state   vk.ReadinessState
+			score   float64
+		}{
+			{7, vk.ReadinessHealthy, 1},
+			{8, vk.ReadinessDegraded, 0.99},
+			{9, vk.ReadinessDegraded, 0.5},
+			{10, vk.ReadinessUnhealthy, 0},
+			{9, vk.ReadinessUnhealthy, 0},   // still above 90% of the unhealthy threshold
+			{8, vk.ReadinessDegraded, 0.99}, // below it
+			{7, vk.ReadinessHealthy, 1},     // below 90% of the degraded threshold
+			{8, vk.ReadinessDegraded, 0.99},
+		}
+
+		for i, step := range steps {
+			current = step.current
+
+			report := d.Evaluate()
+			assert.Equal(t, step.state, report.State, "step %d", i)
+			assert.Equal(t, step.score, report.Score, "step %d", i)
+		}
+	})
+
+	t.Run("error rate", func(t *testing.T) {
+		clock := &healthClock{now: time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)}
+
+		d := vk.NewDegradation(vk.DegradationOptions{
+			ErrorRate: vk.ErrorRateSignal{Enabled: true, Degraded: 0.1, Unhealthy: 0.5},
+			Window:    10 * time.Second,
+			Now:       clock.Now,
+		}, nil)
+
+		// each step replaces the window's requests with 200 requests, failures of which fail
+		steps := []struct {
+			failures int
+			state    vk.ReadinessState
+		}{
+			{19, vk.ReadinessHealthy},
+			{20, vk.ReadinessDegraded},
+			{19, vk.ReadinessDegraded}, // 9.5% is within the hysteresis
+			{17, vk.ReadinessHealthy},  // 8.5% isn't
+			{19, vk.ReadinessHealthy},
+			{100, vk.ReadinessUnhealthy},
+			{92, vk.ReadinessUnhealthy},
+			{80, vk.ReadinessDegraded},
+		}
+
+		for i, step := range steps {
+			clock.advance(10 * time.Second)
+
+			observeMany(d, step.failures, time.Millisecond, true)
+			observeMany(d, 200-step.failures, time.Millisecond, false)
+
+			report := d.Evaluate()
+			assert.Equal(t, step.state, report.State, "step %d", i)
+			require.Len(t, report.Signals, 1)
+			assert.Equal(t, float64(step.failures)/200, report.Signals[0].Value, "step %d", i)
+		}
+	})
+}
+
+func TestReadinessDegradation(t *testing.T) {
+	clock := &healthClock{now: time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)}
+
+	server := vk.New(
+		vk.UseLogger(vlog.Noop()),
+		vk.UseReadinessDegradation(vk.DegradationOptions{
+			ErrorRate: vk.ErrorRateSignal{Enabled: true, MinRequests: 10},
+			InFlight:  vk.InFlightSignal{Enabled: true},
+			Now:       clock.Now,
+		}),
+	)
+
+	health := vk.NewHealth(vk.HealthOptions{Degradation: server.Degradation()})
+
+	server.GET("/ready", health.Handler())
+	server.GET("/work", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		if r.URL.Query().Get("fail") != "" {
+			return vk.E(http.StatusBadGateway, "upstream failed")
+		}
+
+		return vk.RespondString(ctx.Context, w, "done", http.StatusOK)
+	})
+
+	vt := vtest.New(server)
+
+	get := func(path string) *vtest.Response {
+		req, _ := http.NewRequest(http.MethodGet, path, nil)
+		return vt.Do(req, t)
+	}
+
+	report := func(resp *vtest.Response) vk.HealthReport {
+		var r vk.HealthReport
+		require.NoError(t, json.Unmarshal(resp.Body, &r))
+		require.NotNil(t, r.Degradation)
+
+		return r
+	}
+
+	ready := report(get("/ready").AssertStatus(http.StatusOK))
+	assert.True(t, ready.Ready)
+	assert.Equal(t, vk.ReadinessHealthy, ready.Degradation.State)
+	require.Len(t, ready.Degradation.Signals, 1, "the in-flight signal is off without a concurrency cap")
+
+	for i := 0; i < 8; i++ {
+		get("/work").AssertStatus(http.StatusOK)
+	}
+
+	get("/work?fail=1").AssertStatus(http.StatusBadGateway)
+
+	// 1 failure out of the 10 requests so far, including the readiness probe
+	ready = report(get("/ready").AssertStatus(http.StatusNonAuthoritativeInfo))
+	assert.True(t, ready.Ready, "a degraded server is still ready")
+	assert.Equal(t, vk.ReadinessDegraded, ready.Degradation.State)
+	assert.Equal(t, 0.89, ready.Degradation.Score)
+
+	for i := 0; i < 10; i++ {
+		get("/work?fail=1")
+	}
+
+	ready = report(get("/ready").AssertStatus(http.StatusServiceUnavailable))
+	assert.False(t, ready.Ready)
+	assert.Equal(t, vk.ReadinessUnhealthy, ready.Degradation.State)
+
+	var changes []vk.DegradationChanged
+
+	for len(changes) < 2 {
+		select {
+		case event := <-server.Events():
+			if change, ok := event.(vk.DegradationChanged); ok {
+				changes = append(changes, change)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("the changes weren't emitted")
+		}
+	}
+
+	assert.Equal(t, vk.ReadinessDegraded, changes[0].To)
+	assert.Equal(t, 0.89, changes[0].Score)
+	assert.Equal(t, vk.ReadinessUnhealthy, changes[1].To)
+}
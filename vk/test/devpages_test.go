@@ -0,0 +1,132 @@
+package test_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+	"github.com/suborbital/vektor/vtest"
+)
+
+const browserAccept = "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"
+
+var replayAction = regexp.MustCompile(`action="(/__vk/replay/[^"]+)"`)
+
+func devPageServer(dev bool, calls *int32) *vk.Server {
+	server := vk.New(vk.UseLogger(vlog.Noop()), vk.UseDevMode(dev))
+
+	timed := vk.Named("timed", func(inner vk.HandlerFunc) vk.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+			return inner(w, r, ctx)
+		}
+	})
+
+	server.POST("/panic", timed(func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		atomic.AddInt32(calls, 1)
+
+		var body map[string]string
+		_ = json.NewDecoder(r.Body).Decode(&body)
+
+		panic("exploded on " + body["name"])
+	}))
+
+	server.GET("/error", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.E(http.StatusInternalServerError, "database unavailable")
+	})
+
+	return server
+}
+
+func TestDevErrorPage(t *testing.T) {
+	var calls int32
+	vt := vtest.New(devPageServer(true, &calls))
+
+	r, _ := http.NewRequest(http.MethodPost, "/panic", strings.NewReader(`{"name": "widget", "password": "hunter2"}`))
+	r.Header.Set("Accept", browserAccept)
+	r.Header.Set("Authorization", "Bearer s3cr3t")
+	r.Header.Set("X-Custom", "visible")
+
+	resp := vt.Do(r, t).AssertStatus(http.StatusInternalServerError)
+	body := string(resp.Body)
+
+	assert.Equal(t, "text/html; charset=utf-8", resp.Headers.Get("Content-Type"))
+	assert.Equal(t, "no-store", resp.Headers.Get("Cache-Control"))
+	assert.Contains(t, body, "exploded on widget")
+	assert.Contains(t, body, "devpages_test.go", "the stack should be shown")
+	assert.Contains(t, body, "timed", "the chain should be shown")
+	assert.Contains(t, body, "visible")
+	assert.Contains(t, body, "widget")
+	assert.NotContains(t, body, "s3cr3t")
+	assert.NotContains(t, body, "hunter2")
+	assert.NotContains(t, body, "<script src", "the page should embed everything it needs")
+
+	r, _ = http.NewRequest(http.MethodGet, "/error", nil)
+	r.Header.Set("Accept", browserAccept)
+
+	body = string(vt.Do(r, t).AssertStatus(http.StatusInternalServerError).Body)
+	assert.Contains(t, body, "database unavailable")
+}
+
+func TestDevErrorPageAPIClients(t *testing.T) {
+	var calls int32
+	vt := vtest.New(devPageServer(true, &calls))
+
+	r, _ := http.NewRequest(http.MethodPost, "/panic", strings.NewReader(`{}`))
+	r.Header.Set("Accept", "application/json")
+
+	resp := vt.Do(r, t).AssertStatus(http.StatusInternalServerError).AssertBodyString("Internal Server Error")
+	assert.NotContains(t, resp.Headers.Get("Content-Type"), "text/html")
+
+	r, _ = http.NewRequest(http.MethodGet, "/error", nil)
+
+	resp = vt.Do(r, t).AssertStatus(http.StatusInternalServerError)
+	assert.JSONEq(t, `{"status": 500, "message": "database unavailable"}`, string(resp.Body))
+}
+
+func TestDevErrorPageOutsideDevMode(t *testing.T) {
+	var calls int32
+	vt := vtest.New(devPageServer(false, &calls))
+
+	r, _ := http.NewRequest(http.MethodPost, "/panic", strings.NewReader(`{}`))
+	r.Header.Set("Accept", browserAccept)
+
+	resp := vt.Do(r, t).AssertStatus(http.StatusInternalServerError).AssertBodyString("Internal Server Error")
+	assert.NotContains(t, resp.Headers.Get("Content-Type"), "text/html")
+
+	r, _ = http.NewRequest(http.MethodPost, "/__vk/replay/anything", nil)
+	vt.Do(r, t).AssertStatus(http.StatusNotFound)
+}
+
+func TestDevErrorPageReplay(t *testing.T) {
+	var calls int32
+	vt := vtest.New(devPageServer(true, &calls))
+
+	r, _ := http.NewRequest(http.MethodPost, "/panic", strings.NewReader(`{"name": "gadget"}`))
+	r.Header.Set("Accept", browserAccept)
+
+	body := string(vt.Do(r, t).AssertStatus(http.StatusInternalServerError).Body)
+
+	match := replayAction.FindStringSubmatch(body)
+	require.Len(t, match, 2, "the page should have a replay button")
+
+	r, _ = http.NewRequest(http.MethodPost, match[1], nil)
+	body = string(vt.Do(r, t).AssertStatus(http.StatusInternalServerError).Body)
+
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls), "the replay should invoke the handler again")
+	assert.Contains(t, body, "exploded on gadget", "the replay should have the captured body")
+	assert.Contains(t, body, "replay of")
+
+	r, _ = http.NewRequest(http.MethodGet, match[1], nil)
+	vt.Do(r, t).AssertStatus(http.StatusMethodNotAllowed)
+
+	r, _ = http.NewRequest(http.MethodPost, "/__vk/replay/unknown", nil)
+	vt.Do(r, t).AssertStatus(http.StatusNotFound)
+}
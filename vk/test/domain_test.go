@@ -0,0 +1,171 @@
+package test_test
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+	"github.com/suborbital/vektor/vtest"
+)
+
+// domainObserver records the errors and panics reported by an isolation domain
+type domainObserver struct {
+	lock   sync.Mutex
+	errors []vk.DomainError
+	panics []vk.PanicReport
+}
+
+func observeDomain(d *vk.IsolationDomain) *domainObserver {
+	o := &domainObserver{}
+
+	d.OnError(func(e vk.DomainError) {
+		o.lock.Lock()
+		defer o.lock.Unlock()
+
+		o.errors = append(o.errors, e)
+	})
+
+	d.OnPanic(func(report vk.PanicReport) {
+		o.lock.Lock()
+		defer o.lock.Unlock()
+
+		o.panics = append(o.panics, report)
+	})
+
+	return o
+}
+
+func domainServer() *vk.Server {
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+
+	failing := func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.E(http.StatusConflict, "failed in "+ctx.Domain())
+	}
+
+	panicking := func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		panic("panicked in " + ctx.Domain())
+	}
+
+	ok := func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.RespondString(ctx.Context, w, ctx.Domain(), http.StatusOK)
+	}
+
+	server.GET("/public/fail", failing)
+	server.GET("/public/ok", ok)
+
+	partner := vk.Group("/partner").Domain("partner-x")
+	partner.GET("/fail", failing)
+	partner.GET("/panic", panicking)
+
+	// a nested group is in its parent's domain unless it sets its own
+	plugin := vk.Group("/plugin")
+	plugin.GET("/ok", ok)
+	plugin.GET("/opaque", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return errors.New("not a vk.Error")
+	})
+	partner.AddGroup(plugin)
+
+	billing := vk.Group("/billing").Domain("billing")
+	billing.GET("/fail", failing)
+	billing.GET("/panic", panicking)
+
+	server.AddGroup(partner)
+	server.AddGroup(billing)
+
+	return server
+}
+
+func TestIsolationDomains(t *testing.T) {
+	server := domainServer()
+
+	partner := observeDomain(server.IsolationDomain("partner-x"))
+	billing := observeDomain(server.IsolationDomain("billing"))
+	public := observeDomain(server.IsolationDomain(vk.DefaultDomain))
+
+	var globalPanics []vk.PanicReport
+	server.OnNewPanic(func(report vk.PanicReport) {
+		globalPanics = append(globalPanics, report)
+	})
+
+	vt := vtest.New(server)
+
+	get := func(path string) *vtest.Response {
+		req, _ := http.NewRequest(http.MethodGet, path, nil)
+		return vt.Do(req, t)
+	}
+
+	get("/public/ok").AssertStatus(http.StatusOK).AssertBodyString(vk.DefaultDomain)
+	get("/partner/plugin/ok").AssertStatus(http.StatusOK).AssertBodyString("partner-x")
+
+	get("/public/fail").AssertStatus(http.StatusConflict)
+	get("/partner/fail").AssertStatus(http.StatusConflict)
+	get("/partner/plugin/opaque").AssertStatus(http.StatusInternalServerError)
+	for i := 0; i < 2; i++ {
+		get("/partner/panic").AssertStatus(http.StatusInternalServerError)
+	}
+	get("/billing/fail").AssertStatus(http.StatusConflict)
+	get("/billing/panic").AssertStatus(http.StatusInternalServerError)
+
+	t.Run("errors", func(t *testing.T) {
+		require.Len(t, partner.errors, 2)
+		assert.Equal(t, "partner-x", partner.errors[0].Domain)
+		assert.Equal(t, "/partner/fail", partner.errors[0].Route)
+		assert.Equal(t, http.StatusConflict, partner.errors[0].Status)
+		assert.EqualError(t, partner.errors[0].Err, "409: failed in partner-x")
+		assert.Equal(t, "/partner/plugin/opaque", partner.errors[1].Route)
+		assert.Equal(t, http.StatusInternalServerError, partner.errors[1].Status)
+
+		require.Len(t, billing.errors, 1)
+		assert.Equal(t, "/billing/fail", billing.errors[0].Route)
+		assert.EqualError(t, billing.errors[0].Err, "409: failed in billing")
+
+		require.Len(t, public.errors, 1)
+		assert.Equal(t, "/public/fail", public.errors[0].Route)
+		assert.Equal(t, vk.DefaultDomain, public.errors[0].Domain)
+	})
+
+	t.Run("panics", func(t *testing.T) {
+		require.Len(t, partner.panics, 2)
+		assert.Equal(t, "panicked in partner-x", partner.panics[0].Message)
+		assert.Equal(t, 2, partner.panics[1].Count)
+
+		require.Len(t, billing.panics, 1)
+		assert.Equal(t, "panicked in billing", billing.panics[0].Message)
+
+		assert.Empty(t, public.panics)
+		assert.Empty(t, globalPanics, "the panics of other domains shouldn't reach the router's hooks")
+		assert.Empty(t, server.Panics().Reports())
+
+		require.Len(t, server.IsolationDomain("partner-x").Panics().Reports(), 1)
+	})
+
+	t.Run("stats", func(t *testing.T) {
+		stats := server.DomainStats()
+
+		assert.Equal(t, vk.DomainStats{Requests: 2, Errors: 1}, stats[vk.DefaultDomain])
+		assert.Equal(t, vk.DomainStats{Requests: 5, Errors: 2, Panics: 2}, stats["partner-x"])
+		assert.Equal(t, vk.DomainStats{Requests: 2, Errors: 1, Panics: 1}, stats["billing"])
+	})
+
+	t.Run("routes", func(t *testing.T) {
+		domains := map[string]string{}
+		for _, r := range server.Routes() {
+			domains[r.Path] = r.Domain
+		}
+
+		assert.Equal(t, "", domains["/public/ok"])
+		assert.Equal(t, "partner-x", domains["/partner/plugin/ok"])
+		assert.Equal(t, "billing", domains["/billing/fail"])
+	})
+}
+
+func TestCtxDomainDefault(t *testing.T) {
+	assert.Equal(t, vk.DefaultDomain, (&vk.Ctx{}).Domain())
+	assert.Equal(t, vk.DefaultDomain, (*vk.Ctx)(nil).Domain())
+}
@@ -0,0 +1,126 @@
+package test_test
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+	"github.com/suborbital/vektor/vtest"
+)
+
+// doubleResponseServer has a handler that writes its response and then returns another, and a middleware that
+// responds and then continues to the handler anyway
+func doubleResponseServer(logs *logCapture, opts ...vk.OptionsModifier) *vk.Server {
+	server := vk.New(append([]vk.OptionsModifier{vk.UseLogger(vlog.Default(vlog.Level(vlog.LogLevelInfo), vlog.WithWriter(logs)))}, opts...)...)
+
+	server.GET("/handler", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		_, _ = w.Write([]byte("written"))
+
+		return vk.RespondJSON(ctx.Context, w, map[string]string{"returned": "too"}, http.StatusOK)
+	})
+
+	unauthorized := vk.Named("unauthorized", func(inner vk.HandlerFunc) vk.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+			_ = vk.RespondString(ctx.Context, w, "go away", http.StatusUnauthorized)
+
+			return inner(w, r, ctx)
+		}
+	})
+
+	server.GET("/middleware", unauthorized(func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.RespondString(ctx.Context, w, "secret", http.StatusOK)
+	}))
+
+	server.GET("/fine", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		_, _ = w.Write([]byte("one, "))
+		_, _ = w.Write([]byte("two"))
+
+		return nil
+	})
+
+	return server
+}
+
+// doubleResponseLogs returns the logged double responses, leaving out the panics they cause in dev mode
+func doubleResponseLogs(logs *logCapture) []string {
+	var found []string
+
+	for _, m := range logs.messages() {
+		if strings.Contains(m, "double response") && !strings.Contains(m, "recovered panic") {
+			found = append(found, m)
+		}
+	}
+
+	return found
+}
+
+func TestDoubleResponse(t *testing.T) {
+	logs := &logCapture{}
+	server := doubleResponseServer(logs)
+
+	vt := vtest.New(server)
+
+	for i := 0; i < 2; i++ {
+		r, _ := http.NewRequest(http.MethodGet, "/handler", nil)
+		vt.Do(r, t).AssertBodyString("written")
+
+		r, _ = http.NewRequest(http.MethodGet, "/middleware", nil)
+		vt.Do(r, t).AssertStatus(http.StatusUnauthorized).AssertBodyString("go away")
+	}
+
+	r, _ := http.NewRequest(http.MethodGet, "/fine", nil)
+	vt.Do(r, t).AssertBodyString("one, two")
+
+	assert.Equal(t, uint64(4), server.DoubleResponses())
+
+	logged := doubleResponseLogs(logs)
+	require.Len(t, logged, 2, "each route should only be logged once an hour")
+
+	assert.Contains(t, logged[0], "double response for GET /handler")
+	assert.Contains(t, logged[0], "first response: unknown")
+	assert.Contains(t, logged[0], "TestDoubleResponse", "the second call site should be logged")
+
+	assert.Contains(t, logged[1], "double response for GET /middleware")
+}
+
+func TestDoubleResponseDevMode(t *testing.T) {
+	logs := &logCapture{}
+	server := doubleResponseServer(logs, vk.UseDevMode(true))
+
+	vt := vtest.New(server)
+
+	// the panics don't add 500s to the responses that had started
+	for _, path := range []string{"/handler", "/handler"} {
+		r, _ := http.NewRequest(http.MethodGet, path, nil)
+		vt.Do(r, t).AssertBodyString("written")
+	}
+
+	r, _ := http.NewRequest(http.MethodGet, "/middleware", nil)
+	vt.Do(r, t).AssertStatus(http.StatusUnauthorized).AssertBodyString("go away")
+
+	assert.Equal(t, uint64(3), server.DoubleResponses())
+	assert.Len(t, server.Panics().Reports(), 2, "double responses should panic in dev mode")
+
+	logged := doubleResponseLogs(logs)
+	require.Len(t, logged, 3, "every double response should be logged in dev mode")
+
+	first, second, ok := strings.Cut(logged[0], "second response:")
+	require.True(t, ok)
+
+	// the handler's write and its RespondJSON are both in doubleResponseServer's first handler
+	assert.Contains(t, first, "first response:")
+	assert.Contains(t, first, "doubleResponseServer.func1", "the first call site should be recorded in dev mode")
+	assert.Contains(t, second, "doubleResponseServer.func1")
+
+	// the middleware responds first, and then the handler it calls
+	middlewareFirst, middlewareSecond, ok := strings.Cut(logged[2], "second response:")
+	require.True(t, ok)
+
+	assert.Contains(t, middlewareFirst, "doubleResponseServer.func2.func1")
+	assert.Contains(t, middlewareSecond, "doubleResponseServer.func3")
+}
@@ -0,0 +1,141 @@
+package test_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+	"github.com/suborbital/vektor/vtest"
+)
+
+type dryRunStore struct{}
+
+type dryRunMailer struct{}
+
+func okHandler(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+	return vk.RespondString(ctx.Context, w, "ok", http.StatusOK)
+}
+
+func TestDryRun(t *testing.T) {
+	dir := t.TempDir()
+	writeCert(t, dir, "api.test", "vk")
+
+	// a certificate without its key
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "broken.test.crt"), []byte("not a certificate"), 0600))
+
+	server := vk.New(
+		vk.UseLogger(vlog.Noop()),
+		vk.UseTLSPort(freePort(t)),
+		vk.UseCertDir(dir, "api.test"),
+		vk.UseStateSealing(vk.StateSealingOptions{Keys: [][]byte{[]byte("short")}}),
+	)
+
+	vk.Provide(server, &dryRunStore{})
+
+	api := vk.Group("")
+	api.GET("/users/:id", okHandler, vk.Requires[*dryRunStore]())
+	api.GET("/users/:name/posts", okHandler)
+	api.POST("/mail", okHandler, vk.Requires[*dryRunMailer]())
+
+	// group middleware is otherwise only built on a route's first request
+	broken := vk.Group("/broken").WithMiddlewares(func(inner vk.HandlerFunc) vk.HandlerFunc {
+		panic("missing configuration")
+	})
+	broken.GET("", okHandler)
+
+	server.AddGroup(api)
+	server.AddGroup(broken)
+
+	server.Static("/static", http.Dir(filepath.Join(dir, "missing")), vk.WithFingerprints())
+
+	var gateDryRun bool
+
+	server.Gate("database", func(ctx context.Context) error {
+		gateDryRun = vk.IsDryRun(ctx)
+		return errors.New("connection refused")
+	}, vk.GateDryRun())
+
+	server.Gate("migrations", func(ctx context.Context) error {
+		t.Error("a gate without GateDryRun shouldn't be run")
+		return nil
+	})
+
+	server.DryRunCheck("templates", func() error {
+		return errors.New("index.html: unexpected EOF")
+	})
+
+	err := server.DryRun()
+	require.Error(t, err)
+
+	var dryRunErr *vk.DryRunError
+	require.True(t, errors.As(err, &dryRunErr))
+
+	report := dryRunErr.Report
+	assert.False(t, report.Passed)
+	assert.Equal(t, 8, report.Routes, "the Static mount has 4 routes")
+	assert.Equal(t, []string{"database"}, report.GatesRun)
+	assert.Equal(t, []string{"migrations"}, report.GatesSkipped)
+	assert.True(t, gateDryRun)
+
+	assert.Equal(t, []string{"StateSealing: key 0 is 5 bytes, expected 32"}, dryRunErr.Problems(vk.DryRunOptions))
+
+	routes := dryRunErr.Problems(vk.DryRunRoutes)
+	require.Len(t, routes, 1)
+	assert.Contains(t, routes[0], "GET /users/:name/posts")
+
+	middleware := dryRunErr.Problems(vk.DryRunMiddleware)
+	require.Len(t, middleware, 2)
+	assert.Contains(t, middleware[0], "POST /mail: requires a dependency of type *test_test.dryRunMailer")
+	assert.Equal(t, "GET /broken: panicked: missing configuration", middleware[1])
+
+	assets := dryRunErr.Problems(vk.DryRunAssets)
+	require.Len(t, assets, 1)
+	assert.Contains(t, assets[0], "/static")
+
+	certs := dryRunErr.Problems(vk.DryRunTLS)
+	require.Len(t, certs, 1)
+	assert.Contains(t, certs[0], "broken.test.crt")
+
+	assert.Equal(t, []string{"database: connection refused"}, dryRunErr.Problems(vk.DryRunGates))
+	assert.Equal(t, []string{"templates: index.html: unexpected EOF"}, dryRunErr.Problems(vk.DryRunChecks))
+
+	assert.Len(t, report.Problems, 8)
+	assert.Contains(t, err.Error(), "dry run found 8 problems")
+}
+
+func TestDryRunPasses(t *testing.T) {
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+
+	vk.Provide(server, &dryRunStore{})
+
+	api := vk.Group("")
+	api.GET("/users/:id", okHandler, vk.Requires[*dryRunStore]())
+
+	server.AddGroup(api)
+
+	gated := false
+
+	server.Gate("database", func(ctx context.Context) error {
+		gated = true
+		return nil
+	}, vk.GateDryRun())
+
+	server.DryRunCheck("templates", func() error { return nil })
+
+	assert.NoError(t, server.DryRun())
+	assert.True(t, gated)
+
+	// the dry run doesn't prevent the server from serving
+	vt := vtest.New(server)
+
+	req, _ := http.NewRequest(http.MethodGet, "/users/1", nil)
+	vt.Do(req, t).AssertStatus(http.StatusOK)
+}
@@ -0,0 +1,151 @@
+package test_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+	"github.com/suborbital/vektor/vtest"
+)
+
+type deviceReading struct {
+	Device string  `json:"device"`
+	Temp   float64 `json:"temp"`
+}
+
+const legacyContentType = "text/plain; charset=us-ascii"
+
+// encodeLegacy renders readings as the KEY=VALUE lines that old devices parse
+func encodeLegacy(v interface{}) ([]byte, string, error) {
+	reading, ok := v.(deviceReading)
+	if !ok {
+		return nil, "", fmt.Errorf("can't encode %T for legacy devices", v)
+	}
+
+	return []byte(fmt.Sprintf("DEVICE=%s\nTEMP=%.1f\n", reading.Device, reading.Temp)), legacyContentType, nil
+}
+
+func encodeLegacyError(err vk.Error) ([]byte, string) {
+	return []byte(fmt.Sprintf("ERR=%d\n", err.Status())), legacyContentType
+}
+
+func encoderServer() *vk.Server {
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+
+	reading := func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		if ctx.Params.ByName("device") == "missing" {
+			return vk.E(http.StatusNotFound, "no such device")
+		}
+
+		return vk.RespondJSON(ctx.Context, w, deviceReading{Device: ctx.Params.ByName("device"), Temp: 21.5}, http.StatusOK)
+	}
+
+	legacy := vk.Group("/legacy").ResponseEncoder(encodeLegacy, encodeLegacyError)
+	legacy.GET("/readings/:device", reading)
+	legacy.GET("/other", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.RespondJSON(ctx.Context, w, map[string]string{"not": "a reading"}, http.StatusOK)
+	})
+	legacy.GET("/explicit", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		w.Header().Set("Content-Type", "text/x-device")
+		return vk.RespondJSON(ctx.Context, w, deviceReading{Device: "x", Temp: 1}, http.StatusOK)
+	})
+
+	nested := vk.Group("/nested")
+	nested.GET("/readings/:device", reading)
+	legacy.AddGroup(nested)
+
+	modern := vk.Group("/modern")
+	modern.GET("/readings/:device", reading)
+
+	server.AddGroup(legacy)
+	server.AddGroup(modern)
+
+	return server
+}
+
+func TestResponseEncoder(t *testing.T) {
+	vt := vtest.New(encoderServer())
+
+	for _, path := range []string{"/legacy/readings/boiler", "/legacy/nested/readings/boiler"} {
+		r, _ := http.NewRequest(http.MethodGet, path, nil)
+		vt.Do(r, t).
+			AssertStatus(http.StatusOK).
+			AssertHeader("Content-Type", legacyContentType).
+			AssertBodyString("DEVICE=boiler\nTEMP=21.5\n")
+
+		r, _ = http.NewRequest(http.MethodGet, path[:len(path)-len("boiler")]+"missing", nil)
+		vt.Do(r, t).
+			AssertStatus(http.StatusNotFound).
+			AssertHeader("Content-Type", legacyContentType).
+			AssertBodyString("ERR=404\n")
+	}
+
+	t.Run("encoding failures use the error encoder", func(t *testing.T) {
+		r, _ := http.NewRequest(http.MethodGet, "/legacy/other", nil)
+		vt.Do(r, t).AssertStatus(http.StatusInternalServerError).AssertBodyString("ERR=500\n")
+	})
+
+	t.Run("unmatched requests use the error encoder", func(t *testing.T) {
+		r, _ := http.NewRequest(http.MethodGet, "/legacy/nothing", nil)
+		vt.Do(r, t).AssertStatus(http.StatusNotFound).AssertBodyString("ERR=404\n")
+	})
+
+	t.Run("a Content-Type set by the handler wins", func(t *testing.T) {
+		r, _ := http.NewRequest(http.MethodGet, "/legacy/explicit", nil)
+		vt.Do(r, t).AssertHeader("Content-Type", "text/x-device").AssertBodyString("DEVICE=x\nTEMP=1.0\n")
+	})
+}
+
+func TestResponseEncoderLeavesSiblingGroups(t *testing.T) {
+	vt := vtest.New(encoderServer())
+
+	r, _ := http.NewRequest(http.MethodGet, "/modern/readings/boiler", nil)
+	vt.Do(r, t).
+		AssertStatus(http.StatusOK).
+		AssertHeader("Content-Type", "application/json").
+		AssertJSON(deviceReading{Device: "boiler", Temp: 21.5})
+
+	r, _ = http.NewRequest(http.MethodGet, "/modern/readings/missing", nil)
+	resp := vt.Do(r, t).AssertStatus(http.StatusNotFound)
+	assert.JSONEq(t, `{"status": 404, "message": "no such device"}`, string(resp.Body))
+}
+
+type deviceOwner struct {
+	Device string `json:"device"`
+	Owner  string `json:"owner" vk:"scope=devices:admin"`
+	Serial string `json:"serial"`
+}
+
+func TestResponseEncoderRedacts(t *testing.T) {
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+
+	// encodes what it is given, so that the test can see it
+	seen := vk.Group("/seen").ResponseEncoder(func(v interface{}) ([]byte, string, error) {
+		body, err := json.Marshal(v)
+		return body, legacyContentType, err
+	}, nil).WithMiddlewares(vk.Redaction(vk.RedactionOptions{}), vk.AllowFieldSelection())
+
+	seen.GET("/owner", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.RespondJSON(ctx.Context, w, deviceOwner{Device: "boiler", Owner: "alice", Serial: "B-1"}, http.StatusOK)
+	})
+
+	server.AddGroup(seen)
+
+	vt := vtest.New(server)
+
+	r, _ := http.NewRequest(http.MethodGet, "/seen/owner", nil)
+	resp := vt.Do(r, t).AssertStatus(http.StatusOK).AssertHeader("Content-Type", legacyContentType)
+	assert.JSONEq(t, `{"device": "boiler", "serial": "B-1"}`, string(resp.Body))
+
+	r, _ = http.NewRequest(http.MethodGet, "/seen/owner?fields=serial", nil)
+	resp = vt.Do(r, t).AssertStatus(http.StatusOK)
+	assert.JSONEq(t, `{"serial": "B-1"}`, string(resp.Body))
+
+	r, _ = http.NewRequest(http.MethodGet, "/seen/owner?fields=owner", nil)
+	vt.Do(r, t).AssertStatus(http.StatusBadRequest)
+}
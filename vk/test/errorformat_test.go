@@ -0,0 +1,72 @@
+package test_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+	"github.com/suborbital/vektor/vtest"
+)
+
+func TestGroupErrorFormatters(t *testing.T) {
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+
+	conflict := func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.E(http.StatusConflict, "order already exists")
+	}
+
+	panics := func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		panic("boom")
+	}
+
+	v1 := vk.Group("/v1").WithErrorFormatter(vk.LegacyErrorFormatter(nil))
+	v1.POST("/orders", conflict)
+	v1.GET("/panic", panics)
+
+	// nested groups inherit the formatter of the group they are added to
+	v1.AddGroup(func() *vk.RouteGroup {
+		admin := vk.Group("/admin")
+		admin.POST("/orders", conflict)
+
+		return admin
+	}())
+
+	v2 := vk.Group("/v2").WithErrorFormatter(vk.DefaultErrorFormatter)
+	v2.POST("/orders", conflict)
+	v2.GET("/panic", panics)
+
+	server.AddGroup(v1)
+	server.AddGroup(v2)
+	server.GET("/other", conflict)
+
+	vt := vtest.New(server)
+
+	cases := []struct {
+		method string
+		path   string
+		status int
+		body   string
+	}{
+		{http.MethodPost, "/v1/orders", http.StatusConflict, `{"error":{"code":"CONFLICT","msg":"order already exists"}}`},
+		{http.MethodPost, "/v1/admin/orders", http.StatusConflict, `{"error":{"code":"CONFLICT","msg":"order already exists"}}`},
+		{http.MethodGet, "/v1/missing", http.StatusNotFound, `{"error":{"code":"NOT_FOUND","msg":"Not Found"}}`},
+		{http.MethodGet, "/v1/orders", http.StatusMethodNotAllowed, `{"error":{"code":"METHOD_NOT_ALLOWED","msg":"Method Not Allowed"}}`},
+		{http.MethodGet, "/v1/panic", http.StatusInternalServerError, `{"error":{"code":"INTERNAL_SERVER_ERROR","msg":"Internal Server Error"}}`},
+
+		{http.MethodPost, "/v2/orders", http.StatusConflict, `{"status":409,"message":"order already exists"}`},
+		{http.MethodGet, "/v2/missing", http.StatusNotFound, `{"status":404,"message":"Not Found"}`},
+		{http.MethodGet, "/v2/panic", http.StatusInternalServerError, `{"status":500,"message":"Internal Server Error"}`},
+
+		// routes outside of both groups are unchanged
+		{http.MethodGet, "/other", http.StatusConflict, `{"status":409,"message":"order already exists"}`},
+		{http.MethodGet, "/missing", http.StatusNotFound, "404 page not found\n"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.method+" "+c.path, func(t *testing.T) {
+			r, _ := http.NewRequest(c.method, c.path, nil)
+			vt.Do(r, t).AssertStatus(c.status).AssertBodyString(c.body)
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package test_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+)
+
+// nextEvent returns the next lifecycle event, failing if none arrives in time
+func nextEvent(t *testing.T, events <-chan vk.ServerEvent) vk.ServerEvent {
+	select {
+	case event, ok := <-events:
+		require.True(t, ok, "events channel closed")
+		return event
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+
+	return nil
+}
+
+func TestServerEvents(t *testing.T) {
+	port := freePort(t)
+
+	server := vk.New(vk.UseLogger(vlog.Noop()), vk.UseHTTPPort(port))
+
+	entered := make(chan struct{})
+	release := make(chan struct{})
+
+	server.GET("/slow", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		close(entered)
+		<-release
+
+		return vk.RespondString(ctx.Context, w, "done", http.StatusOK)
+	})
+
+	events := server.Events()
+
+	startErr := make(chan error, 1)
+	go func() {
+		startErr <- server.Start()
+	}()
+
+	bound, ok := nextEvent(t, events).(vk.ListenerBound)
+	if assert.True(t, ok) {
+		_, boundPort, _ := net.SplitHostPort(bound.Addr)
+		assert.Equal(t, fmt.Sprint(port), boundPort)
+	}
+
+	assert.Equal(t, vk.Ready{}, nextEvent(t, events))
+
+	respErr := make(chan error, 1)
+	go func() {
+		resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/slow", port))
+		if err == nil {
+			resp.Body.Close()
+		}
+
+		respErr <- err
+	}()
+
+	<-entered
+
+	stopErr := make(chan error, 1)
+	go func() {
+		stopErr <- server.StopWithReason(context.Background(), "test")
+	}()
+
+	assert.Equal(t, vk.ShutdownStarted{Reason: "test"}, nextEvent(t, events))
+	assert.Equal(t, vk.DrainProgress{Active: 1}, nextEvent(t, events))
+
+	close(release)
+
+	assert.NoError(t, <-respErr)
+	assert.Equal(t, vk.DrainProgress{Active: 0}, nextEvent(t, events))
+	assert.Equal(t, vk.Stopped{}, nextEvent(t, events))
+
+	_, open := <-events
+	assert.False(t, open, "events channel should be closed after Stopped")
+
+	assert.NoError(t, <-stopErr)
+	assert.Equal(t, http.ErrServerClosed, <-startErr)
+	assert.NoError(t, server.Err())
+	assert.Zero(t, server.DroppedEvents())
+}
+
+func TestServerEventsListenFailure(t *testing.T) {
+	taken, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+
+	defer taken.Close()
+
+	server := vk.New(vk.UseLogger(vlog.Noop()), vk.UseHTTPPort(taken.Addr().(*net.TCPAddr).Port))
+
+	startErr := server.Start()
+	require.Error(t, startErr)
+
+	stopped, ok := nextEvent(t, server.Events()).(vk.Stopped)
+	if assert.True(t, ok) {
+		assert.Equal(t, startErr, stopped.Err)
+	}
+
+	assert.Equal(t, startErr, server.Err())
+}
@@ -0,0 +1,179 @@
+package test_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+	"github.com/suborbital/vektor/vtest"
+)
+
+// recordingMiddleware returns a Middleware named name that appends its name to calls when it runs
+func recordingMiddleware(name string, calls *[]string) vk.Middleware {
+	return vk.Named(name, func(inner vk.HandlerFunc) vk.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+			*calls = append(*calls, name)
+			return inner(w, r, ctx)
+		}
+	})
+}
+
+// TestMiddlewareOrder locks the documented order of middleware: the router's, then each group's from the outermost
+// group inwards, then the route's, with each layer's middleware running in the reverse of the order they were added
+func TestMiddlewareOrder(t *testing.T) {
+	var calls []string
+
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+
+	v1 := vk.Group("/v1").WithMiddlewares(recordingMiddleware("v1-inner", &calls), recordingMiddleware("v1-outer", &calls))
+	v1.GET("/users/:id", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		calls = append(calls, "handler")
+		return vk.RespondString(ctx.Context, w, "user", http.StatusOK)
+	}, recordingMiddleware("route", &calls))
+
+	api := vk.Group("/api").WithMiddlewares(recordingMiddleware("api", &calls))
+	api.AddGroup(v1)
+
+	server.AddGroup(api)
+
+	vt := vtest.New(server)
+
+	r, _ := http.NewRequest(http.MethodGet, "/api/v1/users/42", nil)
+	vt.Do(r, t).AssertStatus(http.StatusOK)
+
+	assert.Equal(t, []string{"api", "v1-outer", "v1-inner", "route", "handler"}, calls)
+
+	router := vk.NewRouter(vlog.Noop(), "")
+	router.WithMiddlewares(vk.ErrorMiddleware(), recordingMiddleware("router", &calls))
+	router.AddGroup(api)
+
+	calls = nil
+
+	r, _ = http.NewRequest(http.MethodGet, "/api/v1/users/42", nil)
+	router.Finalize()
+	router.ServeHTTP(httptest.NewRecorder(), r)
+
+	assert.Equal(t, []string{"router", "api", "v1-outer", "v1-inner", "route", "handler"}, calls)
+
+	expected := []string{
+		"router: router",
+		"router: error",
+		"group /api: api",
+		"group /v1: v1-outer",
+		"group /v1: v1-inner",
+		"route: route",
+		"handler",
+	}
+
+	t.Run("explain pattern", func(t *testing.T) {
+		chain, err := router.ExplainRoute(http.MethodGet, "/api/v1/users/:id")
+		require.NoError(t, err)
+		assert.Equal(t, expected, chain)
+	})
+
+	t.Run("explain path", func(t *testing.T) {
+		chain, err := router.ExplainRoute(http.MethodGet, "/api/v1/users/42")
+		require.NoError(t, err)
+		assert.Equal(t, expected, chain)
+	})
+
+	t.Run("no route", func(t *testing.T) {
+		_, err := router.ExplainRoute(http.MethodPost, "/api/v1/users/42")
+		assert.Error(t, err)
+	})
+}
+
+func TestGroupGraphValidation(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.RespondString(ctx.Context, w, "ok", http.StatusOK)
+	}
+
+	t.Run("two parents", func(t *testing.T) {
+		shared := vk.Group("/shared")
+		shared.GET("/ping", handler)
+
+		v1, v2 := vk.Group("/v1"), vk.Group("/v2")
+		v1.AddGroup(shared)
+		v2.AddGroup(shared)
+
+		server := vk.New(vk.UseLogger(vlog.Noop()))
+		server.AddGroup(v1)
+		server.AddGroup(v2)
+
+		err := server.TestStart()
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "route group /shared is added to both /v1 and /v2")
+	})
+
+	t.Run("added to itself", func(t *testing.T) {
+		g := vk.Group("/loop")
+		g.GET("/ping", handler)
+		g.AddGroup(g)
+
+		router := vk.NewRouter(vlog.Noop(), "")
+		router.AddGroup(g)
+
+		err := router.Validate()
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "route group /loop is added to itself through / -> /loop -> /loop")
+
+		_, err = router.ExplainRoute(http.MethodGet, "/loop/ping")
+		assert.Error(t, err)
+	})
+
+	t.Run("cycle", func(t *testing.T) {
+		a, b := vk.Group("/a"), vk.Group("/b")
+		a.AddGroup(b)
+		b.AddGroup(a)
+
+		router := vk.NewRouter(vlog.Noop(), "")
+		router.AddGroup(a)
+
+		err := router.Validate()
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "route group /a is added to itself through / -> /a -> /b -> /a")
+	})
+
+	t.Run("swapped routers", func(t *testing.T) {
+		// a group can be mounted by more than one router, such as when a router is swapped for a new one
+		g := vk.Group("/v1")
+		g.GET("/ping", handler)
+
+		first, second := vk.NewRouter(vlog.Noop(), ""), vk.NewRouter(vlog.Noop(), "")
+		first.AddGroup(g)
+		second.AddGroup(g)
+
+		assert.NoError(t, first.Validate())
+		assert.NoError(t, second.Validate())
+	})
+}
+
+func TestExplainRoutesLogged(t *testing.T) {
+	logs := &logCapture{}
+
+	server := vk.New(
+		vk.UseLogger(vlog.Default(vlog.Level(vlog.LogLevelDebug), vlog.WithWriter(logs))),
+		vk.UseExplainRoutes(),
+	)
+
+	server.GET("/ping", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.RespondString(ctx.Context, w, "pong", http.StatusOK)
+	})
+
+	require.NoError(t, server.TestStart())
+
+	found := false
+	for _, m := range logs.messages() {
+		if strings.Contains(m, "/ping") && strings.Contains(m, "router: error -> handler") {
+			found = true
+		}
+	}
+
+	assert.True(t, found, "the route's chain should be logged")
+}
@@ -0,0 +1,214 @@
+package test_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+	"github.com/suborbital/vektor/vtest"
+)
+
+const (
+	ingestAccepted vk.FastResult = iota
+	ingestRejected
+)
+
+func fastPathServer(middlewareCalls *int32, logs *logCapture) *vk.Server {
+	server := vk.New(vk.UseLogger(vlog.Default(vlog.Level(vlog.LogLevelDebug), vlog.WithWriter(logs))))
+
+	ingest := func(r *http.Request, ctx *vk.FastCtx) vk.FastResult {
+		if ctx.Params.ByName("stream") == "closed" {
+			return ingestRejected
+		}
+
+		return ingestAccepted
+	}
+
+	// the server's root group only has its ErrorMiddleware, which fast-path routes skip
+	server.POST("/ingest/:stream", vk.FastPath(ingest,
+		vk.FastResponse{Status: http.StatusAccepted},
+		vk.FastResponse{Status: http.StatusConflict, Header: http.Header{"x-reason": {"closed"}}, Body: []byte(`{"closed":true}`)},
+	))
+
+	server.POST("/invalid", vk.FastPath(func(r *http.Request, ctx *vk.FastCtx) vk.FastResult {
+		return 7
+	}))
+
+	server.POST("/panic", vk.FastPath(func(r *http.Request, ctx *vk.FastCtx) vk.FastResult {
+		panic("fast panic")
+	}))
+
+	api := vk.Group("/api").WithMiddlewares(func(inner vk.HandlerFunc) vk.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+			atomic.AddInt32(middlewareCalls, 1)
+			ctx.RespHeaders.Set("X-Standard", "yes")
+
+			if r.Header.Get("Authorization") == "" {
+				return vk.E(http.StatusUnauthorized, "unauthorized")
+			}
+
+			return inner(w, r, ctx)
+		}
+	})
+
+	api.POST("/fast", vk.FastPath(ingest))
+
+	api.POST("/standard", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.RespondJSON(ctx.Context, w, map[string]bool{"ok": true}, http.StatusAccepted)
+	})
+
+	server.AddGroup(api)
+
+	wrapped := vk.Group("/wrapped")
+	wrapped.POST("", vk.FastPath(ingest), vk.Named("route", func(inner vk.HandlerFunc) vk.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+			atomic.AddInt32(middlewareCalls, 1)
+			return inner(w, r, ctx)
+		}
+	}))
+
+	server.AddGroup(wrapped)
+
+	return server
+}
+
+// servedFast returns true if the fast path has logged serving route
+func servedFast(logs *logCapture, route string) bool {
+	for _, m := range logs.messages() {
+		if strings.Contains(m, "fast path POST "+route+" served") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestFastPath(t *testing.T) {
+	var middlewareCalls int32
+	logs := &logCapture{}
+	vt := vtest.New(fastPathServer(&middlewareCalls, logs))
+
+	r, _ := http.NewRequest(http.MethodPost, "/ingest/metrics", nil)
+	resp := vt.Do(r, t).AssertStatus(http.StatusAccepted).AssertBodyString("")
+	assert.Equal(t, "0", resp.Headers.Get("Content-Length"))
+	assert.True(t, servedFast(logs, "/ingest/:stream"))
+
+	r, _ = http.NewRequest(http.MethodPost, "/ingest/closed", nil)
+	vt.Do(r, t).
+		AssertStatus(http.StatusConflict).
+		AssertHeader("X-Reason", "closed").
+		AssertHeader("Content-Type", "text/plain; charset=utf-8").
+		AssertBodyString(`{"closed":true}`)
+
+	r, _ = http.NewRequest(http.MethodPost, "/invalid", nil)
+	vt.Do(r, t).AssertStatus(http.StatusInternalServerError)
+
+	r, _ = http.NewRequest(http.MethodPost, "/panic", nil)
+	vt.Do(r, t).AssertStatus(http.StatusInternalServerError)
+
+	assert.Equal(t, int32(0), atomic.LoadInt32(&middlewareCalls))
+
+	r, _ = http.NewRequest(http.MethodPost, "/wrapped", nil)
+	vt.Do(r, t).AssertStatus(http.StatusAccepted)
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&middlewareCalls), "routes with their own middleware should use the standard path")
+	assert.False(t, servedFast(logs, "/wrapped"))
+}
+
+func TestFastPathKeepsGroupMiddleware(t *testing.T) {
+	var middlewareCalls int32
+	logs := &logCapture{}
+	vt := vtest.New(fastPathServer(&middlewareCalls, logs))
+
+	// a fast-path route in a group with middleware must not skip it, such as its authentication
+	r, _ := http.NewRequest(http.MethodPost, "/api/fast", nil)
+	vt.Do(r, t).AssertStatus(http.StatusUnauthorized)
+
+	r, _ = http.NewRequest(http.MethodPost, "/api/fast", nil)
+	r.Header.Set("Authorization", "Bearer token")
+	vt.Do(r, t).AssertStatus(http.StatusAccepted).AssertHeader("X-Standard", "yes")
+
+	assert.Equal(t, int32(2), atomic.LoadInt32(&middlewareCalls))
+	assert.False(t, servedFast(logs, "/api/fast"))
+}
+
+func TestFastPathRouterFeatures(t *testing.T) {
+	logs := &logCapture{}
+
+	server := vk.New(
+		vk.UseLogger(vlog.Default(vlog.Level(vlog.LogLevelDebug), vlog.WithWriter(logs))),
+		vk.UseHandlerTimeout(time.Second, time.Second),
+	)
+
+	server.POST("/fast", vk.FastPath(func(r *http.Request, ctx *vk.FastCtx) vk.FastResult {
+		return ingestAccepted
+	}))
+
+	vt := vtest.New(server)
+
+	r, _ := http.NewRequest(http.MethodPost, "/fast", nil)
+	vt.Do(r, t).AssertStatus(http.StatusAccepted)
+
+	assert.False(t, servedFast(logs, "/fast"), "a handler timeout should use the standard path")
+}
+
+func TestFastPathLeavesStandardRoutes(t *testing.T) {
+	var middlewareCalls int32
+	vt := vtest.New(fastPathServer(&middlewareCalls, &logCapture{}))
+
+	r, _ := http.NewRequest(http.MethodPost, "/api/standard", nil)
+	r.Header.Set("Authorization", "Bearer token")
+	vt.Do(r, t).
+		AssertStatus(http.StatusAccepted).
+		AssertHeader("X-Standard", "yes").
+		AssertJSON(map[string]bool{"ok": true})
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&middlewareCalls))
+
+	r, _ = http.NewRequest(http.MethodGet, "/ingest/metrics", nil)
+	vt.Do(r, t).AssertStatus(http.StatusMethodNotAllowed)
+}
+
+// discardWriter is a ResponseWriter that keeps only the last header map, so that benchmarks measure the router
+type discardWriter struct {
+	header http.Header
+}
+
+func (d *discardWriter) Header() http.Header         { return d.header }
+func (d *discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (d *discardWriter) WriteHeader(int)             {}
+
+func BenchmarkFastPath(b *testing.B) {
+	router := vk.NewRouter(vlog.Noop(), "")
+	router.WithMiddlewares(vk.ErrorMiddleware())
+
+	router.POST("/standard", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		w.WriteHeader(http.StatusAccepted)
+		return nil
+	})
+
+	router.POST("/fast", vk.FastPath(func(r *http.Request, ctx *vk.FastCtx) vk.FastResult {
+		return ingestAccepted
+	}))
+
+	router.Finalize()
+
+	for _, path := range []string{"/standard", "/fast"} {
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+
+		b.Run(path[1:], func(b *testing.B) {
+			b.ReportAllocs()
+
+			for i := 0; i < b.N; i++ {
+				router.ServeHTTP(&discardWriter{header: http.Header{}}, req)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package test_test
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+	"github.com/suborbital/vektor/vtest"
+)
+
+func TestFieldSelection(t *testing.T) {
+	server := vk.New(vk.UseLogger(vlog.Noop()), vk.UseRedaction(vk.RedactionOptions{}))
+
+	g := vk.Group("").WithMiddlewares(vk.AllowFieldSelection(), scopesFromHeader)
+
+	g.GET("/account", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.RespondJSON(ctx.Context, w, testAccount(), http.StatusOK)
+	})
+
+	g.GET("/accounts", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.RespondJSON(ctx.Context, w, []account{testAccount(), testAccount()}, http.StatusOK)
+	})
+
+	g.GET("/full", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		ctx.BypassRedaction()
+
+		return vk.RespondJSON(ctx.Context, w, testAccount(), http.StatusOK)
+	})
+
+	g.GET("/missing", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.RespondJSON(ctx.Context, w, map[string]string{"error": "no such account"}, http.StatusNotFound)
+	})
+
+	server.AddGroup(g)
+
+	server.GET("/plain", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		ctx.BypassRedaction()
+
+		return vk.RespondJSON(ctx.Context, w, accountNote{Text: "vip"}, http.StatusOK)
+	})
+
+	vt := vtest.New(server)
+
+	cases := map[string]struct {
+		path   string
+		fields string
+		scopes string
+		status int
+		body   string
+	}{
+		"nested": {"/account", "id,billing.plan,contacts.name", "", http.StatusOK,
+			`{"id":"a-1","billing":{"plan":"pro"},"contacts":{"owner":{"name":"Grace"}}}`},
+		"whole field wins": {"/account", "billing.plan,billing", "admin:read billing:read", http.StatusOK,
+			`{"billing":{"plan":"pro","card":"4242"}}`},
+		"list": {"/accounts", "id,notes.text", "", http.StatusOK,
+			`[{"id":"a-1","notes":[{"text":"vip"}]},{"id":"a-1","notes":[{"text":"vip"}]}]`},
+		"interface": {"/account", "extra.text", "admin:read", http.StatusOK, `{"extra":{"text":"extra"}}`},
+		"no selection": {"/account", "", "", http.StatusOK, `{"id":"a-1","name":"Ada","billing":{"plan":"pro"},` +
+			`"notes":[{"text":"vip"}],"contacts":{"owner":{"name":"Grace"}},"extra":{"text":"extra"}}`},
+		"unknown": {"/account", "id,nope,billing.cvv,name.first", "", http.StatusBadRequest,
+			`{"status":400,"message":"unknown fields: billing.cvv, name.first, nope"}`},
+		"invalid": {"/account", "id,,name", "", http.StatusBadRequest,
+			`{"status":400,"message":"invalid fields: empty field name in id,,name"}`},
+		"redacted field": {"/account", "id,email", "", http.StatusBadRequest,
+			`{"status":400,"message":"unknown fields: email"}`},
+		"permitted field": {"/account", "id,email", "support:read", http.StatusOK,
+			`{"id":"a-1","email":"ada@example.com"}`},
+		"narrowed by redaction": {"/account", "billing", "", http.StatusOK, `{"billing":{"plan":"pro"}}`},
+		"bypassed":              {"/full", "email,billing.card", "", http.StatusOK, `{"email":"ada@example.com","billing":{"card":"4242"}}`},
+		"errors are whole":      {"/missing", "id", "", http.StatusNotFound, `{"error":"no such account"}`},
+		"not allowed":           {"/plain", "text", "", http.StatusOK, `{"text":"vip"}`},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			path := c.path
+			if c.fields != "" {
+				path += "?fields=" + url.QueryEscape(c.fields)
+			}
+
+			r, _ := http.NewRequest(http.MethodGet, path, nil)
+			r.Header.Set("X-Scopes", c.scopes)
+
+			vt.Do(r, t).
+				AssertStatus(c.status).
+				AssertBodyString(c.body)
+		})
+	}
+}
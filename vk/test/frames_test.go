@@ -0,0 +1,194 @@
+package test_test
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+)
+
+type position struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+func positionCodecs() *vk.FrameCodecs {
+	codecs := vk.NewFrameCodecs()
+
+	codecs.Register(7, reflect.TypeOf(position{}),
+		func(value interface{}) ([]byte, error) {
+			return json.Marshal(value)
+		},
+		func(payload []byte) (interface{}, error) {
+			var p position
+			err := json.Unmarshal(payload, &p)
+			return p, err
+		},
+	)
+
+	return codecs
+}
+
+func TestFrameProtocol(t *testing.T) {
+	proto := &vk.FrameProtocol{Name: "rt", Versions: []uint8{1, 2}, MaxFrameBytes: 64, Codecs: positionCodecs()}
+
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+
+	serverErrs := make(chan error, 8)
+
+	g := vk.Group("").WithMiddlewares(proto.Negotiate())
+
+	// echoes every frame, and decoded positions moved by one
+	g.WebSocket("/ws", func(r *http.Request, ctx *vk.Ctx, conn *websocket.Conn) error {
+		frames, err := proto.Conn(conn)
+		if err != nil {
+			return err
+		}
+
+		for {
+			msgType, payload, err := frames.ReadFrame()
+			if err != nil {
+				// report protocol errors, not clients going away
+				var frameErr *vk.FrameError
+				if errors.As(err, &frameErr) {
+					serverErrs <- err
+				}
+
+				return nil
+			}
+
+			if msgType != 7 {
+				if err := frames.WriteFrame(msgType, payload); err != nil {
+					return err
+				}
+
+				continue
+			}
+
+			var p position
+			if err := json.Unmarshal(payload, &p); err != nil {
+				return err
+			}
+
+			if err := frames.Send(position{X: p.X + 1, Y: p.Y + 1}); err != nil {
+				return err
+			}
+		}
+	})
+
+	server.AddGroup(g)
+
+	require.NoError(t, server.TestStart())
+
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws"
+
+	dial := func(t *testing.T, subprotocols []string) (*websocket.Conn, *http.Response, error) {
+		dialer := websocket.Dialer{Subprotocols: subprotocols}
+
+		conn, resp, err := dialer.Dial(wsURL, nil)
+		if err == nil {
+			t.Cleanup(func() { conn.Close() })
+		}
+
+		return conn, resp, err
+	}
+
+	serverErr := func(t *testing.T) error {
+		select {
+		case err := <-serverErrs:
+			return err
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out waiting for the server")
+		}
+
+		return nil
+	}
+
+	t.Run("round trip", func(t *testing.T) {
+		conn, _, err := dial(t, []string{"v3.rt", "v2.rt", "v1.rt"})
+		require.NoError(t, err)
+
+		assert.Equal(t, "v2.rt", conn.Subprotocol(), "the highest supported version should be chosen")
+
+		frames, err := proto.Conn(conn)
+		require.NoError(t, err)
+		assert.Equal(t, uint8(2), frames.Version())
+
+		require.NoError(t, frames.WriteFrame(3, []byte("hello")))
+
+		msgType, payload, err := frames.ReadFrame()
+		require.NoError(t, err)
+		assert.Equal(t, uint8(3), msgType)
+		assert.Equal(t, "hello", string(payload))
+
+		require.NoError(t, frames.Send(position{X: 1, Y: 2}))
+
+		value, err := frames.Receive()
+		require.NoError(t, err)
+		assert.Equal(t, position{X: 2, Y: 3}, value)
+	})
+
+	t.Run("oversized", func(t *testing.T) {
+		conn, _, err := dial(t, proto.Subprotocols())
+		require.NoError(t, err)
+
+		frames, err := proto.Conn(conn)
+		require.NoError(t, err)
+
+		err = frames.WriteFrame(3, make([]byte, 65))
+		assert.ErrorIs(t, err, vk.ErrFrameTooLarge, "oversized frames should not be written")
+
+		// bypass the client's check
+		frame := make([]byte, 6+100)
+		frame[0] = 2
+		binary.BigEndian.PutUint32(frame[2:6], 100)
+		require.NoError(t, conn.WriteMessage(websocket.BinaryMessage, frame))
+
+		assert.ErrorIs(t, serverErr(t), vk.ErrFrameTooLarge)
+
+		_, _, err = conn.ReadMessage()
+		assert.True(t, websocket.IsCloseError(err, websocket.CloseMessageTooBig), err)
+	})
+
+	t.Run("version mismatch", func(t *testing.T) {
+		conn, _, err := dial(t, []string{"v1.rt"})
+		require.NoError(t, err)
+
+		frame := []byte{2, 3, 0, 0, 0, 0}
+		require.NoError(t, conn.WriteMessage(websocket.BinaryMessage, frame))
+
+		var frameErr *vk.FrameError
+		require.True(t, errors.As(serverErr(t), &frameErr))
+		assert.ErrorIs(t, frameErr, vk.ErrFrameVersion)
+		assert.Equal(t, websocket.CloseProtocolError, frameErr.CloseCode)
+
+		_, _, err = conn.ReadMessage()
+		assert.True(t, websocket.IsCloseError(err, websocket.CloseProtocolError), err)
+	})
+
+	t.Run("negotiation failure", func(t *testing.T) {
+		_, resp, err := dial(t, []string{"v3.rt", "v1.other"})
+		require.Error(t, err)
+		require.NotNil(t, resp)
+
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+		_, _, err = dial(t, nil)
+		require.Error(t, err)
+	})
+}
@@ -0,0 +1,211 @@
+package test_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+)
+
+func TestStartupGates(t *testing.T) {
+	port := freePort(t)
+
+	server := vk.New(vk.UseLogger(vlog.Noop()), vk.UseHTTPPort(port))
+
+	server.GET("/hello", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.RespondString(ctx.Context, w, "hello", http.StatusOK)
+	})
+
+	server.AddGroup(vk.OpsGroup(vk.OpsConfig{OpsOptions: vk.OpsOptions{EnableHealth: true, EnableReady: true}}))
+
+	var lock sync.Mutex
+	var order []string
+
+	record := func(name string) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		order = append(order, name)
+	}
+
+	release := make(chan struct{})
+
+	server.Gate("migrations", func(ctx context.Context) error {
+		<-release
+		record("migrations")
+
+		return nil
+	})
+
+	// the flags and cache gates run together, after migrations
+	parallel := make(chan struct{})
+
+	server.Gate("flags", func(ctx context.Context) error {
+		<-parallel
+		record("flags")
+
+		return nil
+	}, vk.GateGroup("warmup"))
+
+	server.Gate("audit", func(ctx context.Context) error {
+		record("audit")
+		return nil
+	})
+
+	server.Gate("cache", func(ctx context.Context) error {
+		close(parallel)
+		record("cache")
+
+		return nil
+	}, vk.GateGroup("warmup"))
+
+	events := server.Events()
+
+	startErr := make(chan error, 1)
+	go func() {
+		startErr <- server.Start()
+	}()
+
+	_, ok := nextEvent(t, events).(vk.ListenerBound)
+	require.True(t, ok)
+
+	assert.Equal(t, vk.GateStarted{Name: "migrations"}, nextEvent(t, events))
+
+	url := fmt.Sprintf("http://127.0.0.1:%d/hello", port)
+
+	t.Run("503 while gating", func(t *testing.T) {
+		resp, err := http.Get(url)
+		require.NoError(t, err)
+
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+		assert.Equal(t, "5", resp.Header.Get("Retry-After"))
+	})
+
+	t.Run("liveness while gating", func(t *testing.T) {
+		resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/-/health", port))
+		require.NoError(t, err)
+
+		resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		resp, err = http.Get(fmt.Sprintf("http://127.0.0.1:%d/-/ready", port))
+		require.NoError(t, err)
+
+		resp.Body.Close()
+
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode, "readiness isn't exempt")
+	})
+
+	close(release)
+
+	finished := map[string]bool{}
+
+	for len(finished) < 4 {
+		switch event := nextEvent(t, events).(type) {
+		case vk.GateFinished:
+			assert.NoError(t, event.Err)
+			finished[event.Name] = true
+		case vk.GateStarted:
+		default:
+			t.Fatalf("unexpected event %#v", event)
+		}
+	}
+
+	assert.Equal(t, vk.Ready{}, nextEvent(t, events))
+
+	t.Run("order", func(t *testing.T) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		assert.Equal(t, []string{"migrations", "cache", "flags", "audit"}, order)
+	})
+
+	t.Run("serving", func(t *testing.T) {
+		resp, err := http.Get(url)
+		require.NoError(t, err)
+
+		defer resp.Body.Close()
+
+		body, _ := io.ReadAll(resp.Body)
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "hello", string(body))
+	})
+
+	require.NoError(t, server.Stop())
+	assert.ErrorIs(t, <-startErr, http.ErrServerClosed)
+}
+
+func TestStartupGateFailure(t *testing.T) {
+	server := vk.New(vk.UseLogger(vlog.Noop()), vk.UseHTTPPort(freePort(t)))
+
+	ran := false
+
+	server.Gate("migrations", func(ctx context.Context) error {
+		return errors.New("relation already exists")
+	}, vk.GateGroup("first"))
+
+	server.Gate("flags", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}, vk.GateGroup("first"), vk.GateTimeout(50*time.Millisecond))
+
+	server.Gate("cache", func(ctx context.Context) error {
+		panic("nil map")
+	}, vk.GateGroup("first"))
+
+	server.Gate("never", func(ctx context.Context) error {
+		ran = true
+		return nil
+	})
+
+	events := server.Events()
+
+	startErr := make(chan error, 1)
+	go func() {
+		startErr <- server.Start()
+	}()
+
+	var err error
+
+	select {
+	case err = <-startErr:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for Start to fail")
+	}
+
+	var gateErr *vk.GateError
+	require.True(t, errors.As(err, &gateErr), err)
+
+	assert.Len(t, gateErr.Failed, 3)
+	assert.EqualError(t, gateErr.Failed["migrations"], "relation already exists")
+	assert.EqualError(t, gateErr.Failed["cache"], "panicked: nil map")
+	assert.ErrorIs(t, gateErr.Failed["flags"], context.DeadlineExceeded)
+	assert.False(t, ran, "later gates should not run")
+
+	var stopped vk.Stopped
+
+	for event := range events {
+		assert.NotEqual(t, vk.Ready{}, event)
+
+		if s, ok := event.(vk.Stopped); ok {
+			stopped = s
+		}
+	}
+
+	assert.Equal(t, err, stopped.Err)
+	assert.Equal(t, err, server.Err())
+}
@@ -0,0 +1,113 @@
+package test_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+)
+
+func TestHandleHTTPPipeline(t *testing.T) {
+	logs := &logCapture{}
+	router := vk.NewRouter(vlog.Default(vlog.Level(vlog.LogLevelInfo), vlog.WithWriter(logs)), "")
+
+	router.WithMiddlewares(vk.ErrorMiddleware(), vk.Named("requestid", func(inner vk.HandlerFunc) vk.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+			ctx.RespHeaders.Set("X-Request-ID", ctx.RequestID())
+			ctx.Log.Info("handling", r.URL.Path)
+
+			return inner(w, r, ctx)
+		}
+	}))
+
+	router.GET("/vk", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		ctx.Log.Info("handled")
+		return vk.RespondString(ctx.Context, w, "ok", http.StatusOK)
+	})
+
+	std := func(w http.ResponseWriter, r *http.Request) {
+		vk.LoggerFromContext(r.Context()).Info("handled")
+
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok"))
+	}
+
+	router.HandleHTTP(http.MethodGet, "/std", std)
+	router.HandleHTTPRaw(http.MethodGet, "/raw", std)
+	router.HandleHTTP(http.MethodGet, "/panic", func(w http.ResponseWriter, r *http.Request) {
+		panic("third party bug")
+	})
+
+	router.Finalize()
+
+	type logLine struct {
+		Message string `json:"log_message"`
+		Scope   struct {
+			RequestID string `json:"request_id"`
+		} `json:"scope"`
+	}
+
+	// serve returns the response and the lines logged while handling it
+	serve := func(path string) (*httptest.ResponseRecorder, []logLine) {
+		logs.lock.Lock()
+		logs.buf.Reset()
+		logs.lock.Unlock()
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+
+		logs.lock.Lock()
+		defer logs.lock.Unlock()
+
+		var lines []logLine
+
+		for _, raw := range strings.Split(strings.TrimSpace(logs.buf.String()), "\n") {
+			var line logLine
+			if json.Unmarshal([]byte(raw), &line) == nil {
+				lines = append(lines, line)
+			}
+		}
+
+		return w, lines
+	}
+
+	vkResp, vkLogs := serve("/vk")
+	stdResp, stdLogs := serve("/std")
+
+	require.Len(t, stdLogs, len(vkLogs))
+
+	for i := range vkLogs {
+		assert.Equal(t, strings.Replace(vkLogs[i].Message, "/vk", "/std", 1), stdLogs[i].Message)
+
+		// every line is scoped to the request, with the ID sent in the response
+		assert.Equal(t, stdResp.Header().Get("X-Request-ID"), stdLogs[i].Scope.RequestID)
+		assert.NotEmpty(t, stdLogs[i].Scope.RequestID)
+	}
+
+	assert.Equal(t, vkResp.Code, stdResp.Code)
+	assert.Equal(t, vkResp.Body.String(), stdResp.Body.String())
+	assert.NotEmpty(t, vkResp.Header().Get("X-Request-ID"))
+	assert.NotEqual(t, vkResp.Header().Get("X-Request-ID"), stdResp.Header().Get("X-Request-ID"))
+
+	t.Run("panic", func(t *testing.T) {
+		w, _ := serve("/panic")
+
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		assert.NotEmpty(t, w.Header().Get("X-Request-ID"))
+	})
+
+	t.Run("raw", func(t *testing.T) {
+		w, lines := serve("/raw")
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Empty(t, w.Header().Get("X-Request-ID"))
+		assert.Empty(t, lines, "raw handlers have no Ctx logger")
+	})
+}
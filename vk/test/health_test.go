@@ -0,0 +1,216 @@
+package test_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+)
+
+// healthClock is a fake clock for health checks
+type healthClock struct {
+	lock sync.Mutex
+	now  time.Time
+}
+
+func (c *healthClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.now
+}
+
+func (c *healthClock) advance(d time.Duration) {
+	c.lock.Lock()
+	c.now = c.now.Add(d)
+	c.lock.Unlock()
+}
+
+// countingCheck is a check that counts its probes, returning err and blocking while block is non-nil
+type countingCheck struct {
+	probes int64
+	err    atomic.Value
+	block  chan struct{}
+}
+
+func (c *countingCheck) check(ctx context.Context) error {
+	atomic.AddInt64(&c.probes, 1)
+
+	if c.block != nil {
+		<-c.block
+	}
+
+	if err, ok := c.err.Load().(error); ok && err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func statusOf(report vk.HealthReport, name string) vk.HealthStatus {
+	for _, c := range report.Checks {
+		if c.Name == name {
+			return c.Status
+		}
+	}
+
+	return ""
+}
+
+func TestHealthCaching(t *testing.T) {
+	clock := &healthClock{now: time.Now()}
+	db := &countingCheck{}
+
+	health := vk.NewHealth(vk.HealthOptions{Now: clock.Now}, vk.HealthCheck{
+		Name:     "db",
+		Check:    db.check,
+		Interval: 10 * time.Second,
+		Critical: true,
+	})
+
+	// nothing has been probed yet
+	report := health.Report()
+	assert.False(t, report.Ready)
+	assert.Equal(t, vk.HealthUnknown, statusOf(report, "db"))
+
+	assert.Eventually(t, func() bool { return health.Report().Ready }, time.Second, time.Millisecond)
+	assert.EqualValues(t, 1, atomic.LoadInt64(&db.probes))
+
+	// within the TTL, the cached result is served
+	clock.advance(9 * time.Second)
+
+	for i := 0; i < 100; i++ {
+		report = health.Report()
+	}
+
+	assert.True(t, report.Ready)
+	assert.EqualValues(t, 9000, report.Checks[0].AgeMs)
+	assert.EqualValues(t, 1, atomic.LoadInt64(&db.probes))
+
+	// once it expires, a single refresh is triggered however many reports are requested
+	db.block = make(chan struct{})
+	clock.advance(2 * time.Second)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			assert.True(t, health.Report().Ready)
+		}()
+	}
+
+	wg.Wait()
+
+	assert.Eventually(t, func() bool { return atomic.LoadInt64(&db.probes) == 2 }, time.Second, time.Millisecond)
+
+	close(db.block)
+
+	assert.Eventually(t, func() bool { return health.Report().Checks[0].AgeMs == 0 }, time.Second, time.Millisecond)
+	assert.EqualValues(t, 2, atomic.LoadInt64(&db.probes))
+}
+
+func TestHealthStaleness(t *testing.T) {
+	clock := &healthClock{now: time.Now()}
+	upstream := &countingCheck{}
+
+	health := vk.NewHealth(vk.HealthOptions{Now: clock.Now}, vk.HealthCheck{
+		Name:      "upstream",
+		Check:     upstream.check,
+		Interval:  5 * time.Second,
+		Staleness: 30 * time.Second,
+		Timeout:   time.Minute,
+		Critical:  true,
+	})
+
+	health.Refresh(context.Background())
+	assert.True(t, health.Report().Ready)
+
+	// the next probe hangs, so the last result ages until it is no longer trusted
+	upstream.block = make(chan struct{})
+	defer close(upstream.block)
+
+	clock.advance(20 * time.Second)
+
+	report := health.Report()
+	assert.True(t, report.Ready)
+	assert.Equal(t, vk.HealthOK, statusOf(report, "upstream"))
+
+	clock.advance(11 * time.Second)
+
+	report = health.Report()
+	assert.False(t, report.Ready)
+	assert.Equal(t, vk.HealthUnknown, statusOf(report, "upstream"))
+	assert.EqualValues(t, 31000, report.Checks[0].AgeMs)
+
+	// the hung probe is never duplicated
+	assert.Eventually(t, func() bool { return atomic.LoadInt64(&upstream.probes) == 2 }, time.Second, time.Millisecond)
+	health.Report()
+	assert.EqualValues(t, 2, atomic.LoadInt64(&upstream.probes))
+}
+
+func TestHealthCriticality(t *testing.T) {
+	clock := &healthClock{now: time.Now()}
+	db, cache := &countingCheck{}, &countingCheck{}
+
+	health := vk.NewHealth(vk.HealthOptions{Now: clock.Now},
+		vk.HealthCheck{Name: "db", Check: db.check, Critical: true},
+		vk.HealthCheck{Name: "cache", Check: cache.check},
+		vk.HealthCheck{Name: "slow", Check: func(ctx context.Context) error {
+			// ignores its context for a while, as a hung dependency's client might
+			<-ctx.Done()
+			time.Sleep(50 * time.Millisecond)
+
+			return nil
+		}, Timeout: time.Millisecond},
+	)
+
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+	server.RegisterAdmin(health)
+	require.NoError(t, server.TestStart())
+
+	ready := func() (int, vk.HealthReport) {
+		w := httptest.NewRecorder()
+		server.AdminRouter().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ready", nil))
+
+		var report vk.HealthReport
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+
+		return w.Code, report
+	}
+
+	// a failing non-critical check only annotates the report
+	cache.err.Store(errors.New("connection refused"))
+	health.Refresh(context.Background())
+
+	status, report := ready()
+	assert.Equal(t, http.StatusOK, status)
+	assert.True(t, report.Ready)
+	assert.Equal(t, vk.HealthFailing, statusOf(report, "cache"))
+	assert.Equal(t, vk.HealthFailing, statusOf(report, "slow"))
+	assert.Equal(t, "connection refused", report.Checks[1].Error)
+	assert.Contains(t, report.Checks[2].Error, "timed out")
+
+	// a failing critical check flips readiness
+	db.err.Store(errors.New("too many connections"))
+	clock.advance(time.Minute)
+	health.Refresh(context.Background())
+
+	status, report = ready()
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.False(t, report.Ready)
+	assert.Equal(t, vk.HealthFailing, statusOf(report, "db"))
+	assert.Equal(t, "too many connections", report.Checks[0].Error)
+}
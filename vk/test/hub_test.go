@@ -0,0 +1,365 @@
+package test_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+)
+
+type orderUpdated struct {
+	ID  string `json:"id"`
+	Seq int    `json:"seq"`
+}
+
+// hubServer serves websocket subscriptions to rooms at /rooms/:room, and publishes order updates with POST /orders/:id
+func hubServer(t *testing.T, hub *vk.Hub) *httptest.Server {
+	server := vk.New(vk.UseLogger(vlog.Noop()), vk.UseNotifier(hub))
+
+	server.WebSocket("/rooms/:room", func(r *http.Request, ctx *vk.Ctx, conn *websocket.Conn) error {
+		leave := hub.Join(ctx.Params.ByName("room"), conn)
+		defer leave()
+
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return nil
+			}
+		}
+	})
+
+	server.POST("/orders/:id", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		for seq := 1; seq <= 5; seq++ {
+			if err := ctx.Notify("orders", orderUpdated{ID: ctx.Params.ByName("id"), Seq: seq}); err != nil {
+				return vk.E(http.StatusServiceUnavailable, err.Error())
+			}
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+
+		return nil
+	})
+
+	require.NoError(t, server.TestStart())
+
+	ts := httptest.NewServer(server)
+	t.Cleanup(ts.Close)
+
+	return ts
+}
+
+func subscribe(t *testing.T, ts *httptest.Server, room string) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/rooms/"+room, nil)
+	require.NoError(t, err)
+
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+func TestHubNotify(t *testing.T) {
+	hub := vk.NewHub(vk.HubOptions{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go hub.Run(ctx)
+
+	ts := hubServer(t, hub)
+
+	subscribers := make([]*websocket.Conn, 3)
+	for i := range subscribers {
+		subscribers[i] = subscribe(t, ts, "orders")
+	}
+
+	other := subscribe(t, ts, "invoices")
+
+	require.Eventually(t, func() bool { return hub.Subscribers("orders") == 3 && hub.Subscribers("invoices") == 1 }, time.Second, time.Millisecond)
+
+	resp, err := http.Post(ts.URL+"/orders/123", "application/json", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	// every subscriber in the room receives every update, in the order they were published
+	for i, conn := range subscribers {
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+
+		for seq := 1; seq <= 5; seq++ {
+			_, data, err := conn.ReadMessage()
+			require.NoError(t, err, "subscriber %d", i)
+
+			var update orderUpdated
+			require.NoError(t, json.Unmarshal(data, &update))
+			assert.Equal(t, orderUpdated{ID: "123", Seq: seq}, update, "subscriber %d", i)
+		}
+	}
+
+	// and subscribers of other rooms receive nothing
+	require.NoError(t, other.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+	_, _, err = other.ReadMessage()
+	assert.Error(t, err)
+
+	stats := hub.Stats()
+	assert.EqualValues(t, 5, stats.Published)
+	assert.EqualValues(t, 0, stats.Dropped)
+}
+
+func TestHubBackPressure(t *testing.T) {
+	hub := vk.NewHub(vk.HubOptions{QueueSize: 3})
+	ts := hubServer(t, hub)
+
+	conn := subscribe(t, ts, "orders")
+	require.Eventually(t, func() bool { return hub.Subscribers("orders") == 1 }, time.Second, time.Millisecond)
+
+	// the hub isn't running yet, so the queue fills up and further notifications are dropped without blocking
+	for i := 1; i <= 3; i++ {
+		assert.NoError(t, hub.Notify("orders", []byte(fmt.Sprint(i))))
+	}
+
+	assert.ErrorIs(t, hub.Notify("orders", []byte("4")), vk.ErrNotifyQueueFull)
+
+	resp, err := http.Post(ts.URL+"/orders/123", "application/json", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.EqualValues(t, 2, hub.Stats().Dropped)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go hub.Run(ctx)
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+
+	for i := 1; i <= 3; i++ {
+		_, data, err := conn.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprint(i), string(data))
+	}
+}
+
+func TestNotifyWithoutNotifier(t *testing.T) {
+	assert.ErrorIs(t, vk.NewCtx(nil, nil, nil).Notify("orders", "updated"), vk.ErrNoNotifier)
+}
+
+// fakeHubConn is an in-memory vk.HubConn that counts the messages written to it, and blocks writes while blocked is
+// open
+type fakeHubConn struct {
+	subprotocol string
+	blocked     chan struct{}
+	attempted   uint64
+	written     uint64
+	closed      int32
+}
+
+func (f *fakeHubConn) Subprotocol() string              { return f.subprotocol }
+func (f *fakeHubConn) SetWriteDeadline(time.Time) error { return nil }
+func (f *fakeHubConn) Close() error                     { atomic.StoreInt32(&f.closed, 1); return nil }
+func (f *fakeHubConn) isClosed() bool                   { return atomic.LoadInt32(&f.closed) == 1 }
+func (f *fakeHubConn) writes() uint64                   { return atomic.LoadUint64(&f.written) }
+func (f *fakeHubConn) WritePreparedMessage(*websocket.PreparedMessage) error {
+	atomic.AddUint64(&f.attempted, 1)
+
+	if f.blocked != nil {
+		<-f.blocked
+	}
+
+	atomic.AddUint64(&f.written, 1)
+
+	return nil
+}
+
+// textEncoder stands in for an encoder such as msgpack, counting how many times it is called
+func textEncoder(calls *int32) vk.HubEncoder {
+	return func(payload interface{}) ([]byte, int, error) {
+		atomic.AddInt32(calls, 1)
+		return []byte(fmt.Sprintf("%v", payload)), websocket.BinaryMessage, nil
+	}
+}
+
+func TestHubMixedEncodings(t *testing.T) {
+	var textCalls int32
+
+	hub := vk.NewHub(vk.HubOptions{Encoders: map[string]vk.HubEncoder{"text": textEncoder(&textCalls)}})
+
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+
+	// accepts the text subprotocol when the client asks for it
+	subprotocols := func(inner vk.HandlerFunc) vk.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+			if websocket.Subprotocols(r) != nil && websocket.Subprotocols(r)[0] == "text" {
+				ctx.RespHeaders.Set("Sec-WebSocket-Protocol", "text")
+			}
+
+			return inner(w, r, ctx)
+		}
+	}
+
+	rooms := vk.Group("/rooms").WithMiddlewares(subprotocols)
+	rooms.WebSocket("/:room", func(r *http.Request, ctx *vk.Ctx, conn *websocket.Conn) error {
+		leave := hub.Join(ctx.Params.ByName("room"), conn)
+		defer leave()
+
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return nil
+			}
+		}
+	})
+
+	server.AddGroup(rooms)
+
+	require.NoError(t, server.TestStart())
+
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	dial := func(subprotocols ...string) *websocket.Conn {
+		dialer := websocket.Dialer{Subprotocols: subprotocols}
+
+		conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/rooms/orders", nil)
+		require.NoError(t, err)
+
+		t.Cleanup(func() { conn.Close() })
+
+		return conn
+	}
+
+	jsonConns := []*websocket.Conn{dial(), dial(), dial()}
+	textConns := []*websocket.Conn{dial("text"), dial("text"), dial("text")}
+
+	require.Eventually(t, func() bool { return hub.Subscribers("orders") == 6 }, time.Second, time.Millisecond)
+
+	update := orderUpdated{ID: "123", Seq: 1}
+	require.NoError(t, hub.Broadcast("orders", update))
+
+	for _, conn := range jsonConns {
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+
+		messageType, data, err := conn.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, websocket.TextMessage, messageType)
+		assert.JSONEq(t, `{"id":"123","seq":1}`, string(data))
+	}
+
+	for _, conn := range textConns {
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+
+		messageType, data, err := conn.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, websocket.BinaryMessage, messageType)
+		assert.Equal(t, "{123 1}", string(data))
+	}
+
+	// each encoding is serialized once, however many connections use it
+	assert.EqualValues(t, 1, atomic.LoadInt32(&textCalls))
+	assert.EqualValues(t, 2, hub.Stats().Encoded)
+
+	t.Run("unknown subprotocol", func(t *testing.T) {
+		conn := &fakeHubConn{subprotocol: "unknown"}
+		leave := hub.JoinConn("invoices", conn)
+		defer leave()
+
+		require.NoError(t, hub.Broadcast("invoices", update))
+		require.Eventually(t, func() bool { return conn.writes() == 1 }, time.Second, time.Millisecond)
+
+		assert.EqualValues(t, 1, atomic.LoadInt32(&textCalls), "connections without an encoder receive JSON")
+	})
+}
+
+func TestHubSlowConsumers(t *testing.T) {
+	for _, disconnect := range []bool{false, true} {
+		t.Run(fmt.Sprintf("disconnect=%t", disconnect), func(t *testing.T) {
+			hub := vk.NewHub(vk.HubOptions{SendBuffer: 2, DisconnectSlow: disconnect})
+
+			fast := &fakeHubConn{}
+			slow := &fakeHubConn{blocked: make(chan struct{})}
+
+			defer hub.JoinConn("orders", fast)()
+			defer hub.JoinConn("orders", slow)()
+
+			// the slow connection's writer takes the first message and blocks, then its buffer fills up
+			require.NoError(t, hub.Broadcast("orders", []byte("0")))
+			require.Eventually(t, func() bool { return atomic.LoadUint64(&slow.attempted) == 1 }, time.Second, time.Millisecond)
+
+			// the fast connection keeps up with every message
+			for i := 1; i < 5; i++ {
+				require.NoError(t, hub.Broadcast("orders", []byte(fmt.Sprint(i))))
+				require.Eventually(t, func() bool { return fast.writes() == uint64(i+1) }, time.Second, time.Millisecond)
+			}
+
+			stats := hub.Stats()
+
+			close(slow.blocked)
+
+			if disconnect {
+				// the connection is removed by the first message it can't take
+				assert.EqualValues(t, 1, stats.DroppedSlow)
+				assert.EqualValues(t, 1, stats.DisconnectedSlow)
+				assert.Equal(t, 1, hub.Subscribers("orders"))
+				require.Eventually(t, slow.isClosed, time.Second, time.Millisecond)
+				assert.EqualValues(t, 1, slow.writes(), "buffered messages aren't written to a disconnected connection")
+
+				return
+			}
+
+			assert.EqualValues(t, 2, stats.DroppedSlow)
+			assert.EqualValues(t, 0, stats.DisconnectedSlow)
+			assert.Equal(t, 2, hub.Subscribers("orders"))
+			require.Eventually(t, func() bool { return slow.writes() == 3 }, time.Second, time.Millisecond)
+			assert.False(t, slow.isClosed())
+		})
+	}
+}
+
+// BenchmarkHubBroadcast broadcasts to 10k in-memory connections, a tenth of which negotiated the text encoding.
+// Each broadcast serializes its payload once per encoding, so encodes/op is 2 however many connections there are
+func BenchmarkHubBroadcast(b *testing.B) {
+	const connections = 10000
+
+	var textCalls int32
+
+	hub := vk.NewHub(vk.HubOptions{
+		SendBuffer: 1024,
+		Encoders:   map[string]vk.HubEncoder{"text": textEncoder(&textCalls)},
+	})
+
+	for i := 0; i < connections; i++ {
+		conn := &fakeHubConn{}
+		if i%10 == 0 {
+			conn.subprotocol = "text"
+		}
+
+		defer hub.JoinConn("orders", conn)()
+	}
+
+	update := orderUpdated{ID: "123", Seq: 1}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := hub.Broadcast("orders", update); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.StopTimer()
+
+	b.ReportMetric(float64(hub.Stats().Encoded)/float64(b.N), "encodes/op")
+	b.ReportMetric(float64(hub.Stats().DroppedSlow)/float64(b.N), "dropped/op")
+}
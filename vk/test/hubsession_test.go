@@ -0,0 +1,291 @@
+package test_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+)
+
+// sessionServer serves resumable subscriptions to rooms at /rooms/:room, taking the resume token from the query, and
+// at /first/:room, taking it from the client's first message
+func sessionServer(t *testing.T, hub *vk.Hub) *httptest.Server {
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+
+	readUntilClosed := func(conn *websocket.Conn) error {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return nil
+			}
+		}
+	}
+
+	server.WebSocket("/rooms/:room", func(r *http.Request, ctx *vk.Ctx, conn *websocket.Conn) error {
+		leave := hub.JoinSession(ctx.Params.ByName("room"), conn, vk.ResumeToken(r))
+		defer leave()
+
+		return readUntilClosed(conn)
+	})
+
+	server.WebSocket("/first/:room", func(r *http.Request, ctx *vk.Ctx, conn *websocket.Conn) error {
+		var hello struct {
+			Resume string `json:"resume"`
+		}
+
+		if err := conn.ReadJSON(&hello); err != nil {
+			return nil
+		}
+
+		leave := hub.JoinSession(ctx.Params.ByName("room"), conn, hello.Resume)
+		defer leave()
+
+		return readUntilClosed(conn)
+	})
+
+	require.NoError(t, server.TestStart())
+
+	ts := httptest.NewServer(server)
+	t.Cleanup(ts.Close)
+
+	return ts
+}
+
+// sessionClient is a client of a sessionServer
+type sessionClient struct {
+	t    *testing.T
+	ts   *httptest.Server
+	conn *websocket.Conn
+}
+
+// connect dials the room, presenting token if it is set, and returns the session message
+func (c *sessionClient) connect(room, token string) vk.HubSessionMessage {
+	path := "/rooms/" + room
+	if token != "" {
+		path += "?" + vk.HubResumeParam + "=" + url.QueryEscape(token)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(c.ts.URL, "http")+path, nil)
+	require.NoError(c.t, err)
+
+	c.conn = conn
+	c.t.Cleanup(func() { conn.Close() })
+
+	var session vk.HubSessionMessage
+	require.NoError(c.t, json.Unmarshal(c.read(), &session))
+
+	return session
+}
+
+func (c *sessionClient) read() []byte {
+	require.NoError(c.t, c.conn.SetReadDeadline(time.Now().Add(time.Second)))
+
+	_, data, err := c.conn.ReadMessage()
+	require.NoError(c.t, err)
+
+	return data
+}
+
+func (c *sessionClient) readUpdates(n int) []int {
+	seqs := make([]int, n)
+
+	for i := range seqs {
+		var update orderUpdated
+		require.NoError(c.t, json.Unmarshal(c.read(), &update))
+
+		seqs[i] = update.Seq
+	}
+
+	return seqs
+}
+
+func TestHubResume(t *testing.T) {
+	clock := &cacheClock{now: time.Unix(1700000000, 0)}
+
+	hub := vk.NewHub(vk.HubOptions{Resume: vk.HubResumeOptions{
+		Secret:      []byte("secret"),
+		TTL:         time.Minute,
+		MaxMessages: 5,
+		Now:         clock.Now,
+	}})
+
+	ts := sessionServer(t, hub)
+
+	publish := func(seqs ...int) {
+		for _, seq := range seqs {
+			require.NoError(t, hub.Broadcast("orders", orderUpdated{ID: "123", Seq: seq}))
+		}
+	}
+
+	disconnect := func(c *sessionClient) {
+		c.conn.Close()
+		require.Eventually(t, func() bool { return hub.Subscribers("orders") == 0 }, time.Second, time.Millisecond)
+	}
+
+	client := &sessionClient{t: t, ts: ts}
+
+	session := client.connect("orders", "")
+	assert.Equal(t, vk.HubSessionStarted, session.Type)
+	require.NotEmpty(t, session.Token)
+
+	require.Eventually(t, func() bool { return hub.Subscribers("orders") == 1 }, time.Second, time.Millisecond)
+
+	publish(1, 2)
+	assert.Equal(t, []int{1, 2}, client.readUpdates(2))
+
+	t.Run("within the window", func(t *testing.T) {
+		disconnect(client)
+
+		// published while the client is away
+		publish(3, 4, 5)
+		clock.Advance(30 * time.Second)
+
+		resumed := client.connect("orders", session.Token)
+		assert.Equal(t, vk.HubSessionResumed, resumed.Type)
+		assert.Equal(t, 3, resumed.Replayed)
+
+		publish(6)
+
+		// the missed messages come first, in order, and then live messages
+		assert.Equal(t, []int{3, 4, 5, 6}, client.readUpdates(4))
+
+		stats := hub.Stats()
+		assert.EqualValues(t, 1, stats.Resumed)
+		assert.EqualValues(t, 1, stats.Sessions)
+
+		// delivered messages aren't kept
+		require.Eventually(t, func() bool { return hub.Stats().ReplayBytes == 0 }, time.Second, time.Millisecond)
+	})
+
+	t.Run("too many missed messages", func(t *testing.T) {
+		disconnect(client)
+
+		publish(7, 8, 9, 10, 11, 12)
+
+		expired := client.connect("orders", session.Token)
+		assert.Equal(t, vk.HubResumeExpired, expired.Type)
+		assert.NotEqual(t, session.Token, expired.Token, "a new session is started")
+
+		session = expired
+	})
+
+	t.Run("beyond the window", func(t *testing.T) {
+		disconnect(client)
+
+		publish(13)
+		clock.Advance(2 * time.Minute)
+
+		expired := client.connect("orders", session.Token)
+		assert.Equal(t, vk.HubResumeExpired, expired.Type)
+
+		publish(14)
+		assert.Equal(t, []int{14}, client.readUpdates(1))
+
+		session = expired
+	})
+
+	t.Run("forged token", func(t *testing.T) {
+		disconnect(client)
+
+		id, _, _ := strings.Cut(session.Token, ".")
+
+		forged := client.connect("orders", id+".AAAA")
+		assert.Equal(t, vk.HubResumeExpired, forged.Type)
+
+		other := client.connect("invoices", session.Token)
+		assert.Equal(t, vk.HubResumeExpired, other.Type, "a session can only be resumed in its room")
+	})
+
+	t.Run("token in the first message", func(t *testing.T) {
+		c := &sessionClient{t: t, ts: ts}
+		first := c.connect("payments", "")
+
+		c.conn.Close()
+		require.Eventually(t, func() bool { return hub.Subscribers("payments") == 0 }, time.Second, time.Millisecond)
+
+		require.NoError(t, hub.Broadcast("payments", []byte("missed")))
+
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/first/payments", nil)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		require.NoError(t, conn.WriteJSON(map[string]string{"resume": first.Token}))
+
+		c.conn = conn
+
+		var resumed vk.HubSessionMessage
+		require.NoError(t, json.Unmarshal(c.read(), &resumed))
+		assert.Equal(t, vk.HubSessionResumed, resumed.Type)
+		assert.Equal(t, "missed", string(c.read()))
+	})
+
+	assert.EqualValues(t, 4, hub.Stats().ResumeExpired)
+}
+
+func TestHubSessionLimits(t *testing.T) {
+	// detached creates a session in each room and disconnects it, returning their tokens
+	detached := func(t *testing.T, hub *vk.Hub, ts *httptest.Server, clock *cacheClock, rooms ...string) []string {
+		tokens := make([]string, len(rooms))
+
+		for i, room := range rooms {
+			c := &sessionClient{t: t, ts: ts}
+			tokens[i] = c.connect(room, "").Token
+
+			c.conn.Close()
+			require.Eventually(t, func() bool { return hub.Subscribers(room) == 0 }, time.Second, time.Millisecond)
+
+			clock.Advance(time.Second)
+		}
+
+		return tokens
+	}
+
+	t.Run("sessions", func(t *testing.T) {
+		clock := &cacheClock{now: time.Unix(1700000000, 0)}
+		hub := vk.NewHub(vk.HubOptions{Resume: vk.HubResumeOptions{Secret: []byte("secret"), MaxSessions: 2, Now: clock.Now}})
+		ts := sessionServer(t, hub)
+
+		tokens := detached(t, hub, ts, clock, "room0", "room1", "room2")
+
+		// the session that disconnected first was evicted for the third
+		stats := hub.Stats()
+		assert.EqualValues(t, 2, stats.Sessions)
+		assert.EqualValues(t, 1, stats.SessionsEvicted)
+
+		c := &sessionClient{t: t, ts: ts}
+		assert.Equal(t, vk.HubResumeExpired, c.connect("room0", tokens[0]).Type)
+		assert.Equal(t, vk.HubSessionResumed, c.connect("room2", tokens[2]).Type)
+	})
+
+	t.Run("bytes", func(t *testing.T) {
+		clock := &cacheClock{now: time.Unix(1700000000, 0)}
+		hub := vk.NewHub(vk.HubOptions{Resume: vk.HubResumeOptions{Secret: []byte("secret"), MaxBytes: 100, Now: clock.Now}})
+		ts := sessionServer(t, hub)
+
+		tokens := detached(t, hub, ts, clock, "room0", "room1")
+
+		// the messages kept for room1's session take the total over the limit, evicting room0's
+		require.NoError(t, hub.Broadcast("room0", []byte(strings.Repeat("a", 60))))
+		require.NoError(t, hub.Broadcast("room1", []byte(strings.Repeat("b", 60))))
+
+		stats := hub.Stats()
+		assert.EqualValues(t, 60, stats.ReplayBytes)
+		assert.EqualValues(t, 1, stats.SessionsEvicted)
+
+		c := &sessionClient{t: t, ts: ts}
+		resumed := c.connect("room1", tokens[1])
+		require.Equal(t, vk.HubSessionResumed, resumed.Type)
+		assert.Equal(t, strings.Repeat("b", 60), string(c.read()))
+
+		assert.Equal(t, vk.HubResumeExpired, c.connect("room0", tokens[0]).Type)
+	})
+}
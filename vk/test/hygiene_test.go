@@ -0,0 +1,194 @@
+package test_test
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+)
+
+// rawRequest sends raw over a new connection to addr, returning the status line of the response
+func rawRequest(t *testing.T, addr, raw string) string {
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	_, err = conn.Write([]byte(raw))
+	require.NoError(t, err)
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+
+	return strings.TrimSpace(line)
+}
+
+func hygieneServer(logs *logCapture, checks vk.HeaderChecks) *vk.Server {
+	server := vk.New(
+		vk.UseLogger(vlog.Default(vlog.Level(vlog.LogLevelInfo), vlog.WithWriter(logs))),
+		vk.UseHeaderHygiene(checks),
+	)
+
+	handle := func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.RespondString(ctx.Context, w, "ok", http.StatusOK)
+	}
+
+	server.GET("/", handle)
+	server.POST("/", handle)
+
+	return server
+}
+
+func TestHeaderHygieneRaw(t *testing.T) {
+	logs := &logCapture{}
+
+	server := hygieneServer(logs, vk.AllHeaderChecks())
+	require.NoError(t, server.TestStart())
+
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	addr := ts.Listener.Addr().String()
+
+	// the first four are rejected by Go's HTTP server before reaching vk, see HeaderChecks
+	tests := []struct {
+		name string
+		raw  string
+	}{
+		{"conflicting Content-Length", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 3\r\nContent-Length: 4\r\n\r\nabcd"},
+		{"Content-Length list", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 3, 4\r\n\r\nabcd"},
+		{"duplicate Host", "GET / HTTP/1.1\r\nHost: a\r\nHost: b\r\n\r\n"},
+		{"invalid header name", "GET / HTTP/1.1\r\nHost: a\r\nX Bad: 1\r\n\r\n"},
+		{"duplicate Content-Type", "POST / HTTP/1.1\r\nHost: a\r\nContent-Type: text/plain\r\nContent-Type: application/json\r\nContent-Length: 2\r\n\r\n{}"},
+		{"duplicate Authorization", "GET / HTTP/1.1\r\nHost: a\r\nAuthorization: Bearer one\r\nAuthorization: Bearer two\r\n\r\n"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.True(t, strings.HasPrefix(rawRequest(t, addr, tc.raw), "HTTP/1.1 400"))
+		})
+	}
+
+	t.Run("well formed", func(t *testing.T) {
+		status := rawRequest(t, addr, "POST / HTTP/1.1\r\nHost: a\r\nContent-Type: text/plain\r\nContent-Length: 2\r\nX-Dup: 1\r\nX-Dup: 2\r\n\r\nhi")
+		assert.Equal(t, "HTTP/1.1 200 OK", status)
+	})
+
+	t.Run("obs-fold", func(t *testing.T) {
+		// Go's HTTP server joins the continuation onto the value as "Bearer one Bearer two", a single Authorization
+		// header that vk can't tell apart from one sent unfolded
+		status := rawRequest(t, addr, "GET / HTTP/1.1\r\nHost: a\r\nAuthorization: Bearer one\r\n\tBearer two\r\n\r\n")
+		assert.Equal(t, "HTTP/1.1 200 OK", status)
+	})
+
+	t.Run("security events", func(t *testing.T) {
+		events := []string{}
+		for _, m := range logs.messages() {
+			if strings.Contains(m, "security:") {
+				events = append(events, m)
+			}
+		}
+
+		// only the duplicated singletons reach vk
+		require.Len(t, events, 2)
+		assert.Contains(t, events[0], "Content-Type")
+		assert.Contains(t, events[1], "Authorization")
+
+		for _, e := range events {
+			assert.NotContains(t, e, "application/json")
+			assert.NotContains(t, e, "Bearer")
+		}
+	})
+}
+
+// TestHeaderHygiene builds requests in process, as those that reach the handler without Go's HTTP server parsing
+// them can have headers it would reject
+func TestHeaderHygiene(t *testing.T) {
+	request := func(modify func(r *http.Request)) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("hi"))
+		modify(r)
+
+		return r
+	}
+
+	tests := []struct {
+		name    string
+		check   vk.HeaderChecks
+		request *http.Request
+	}{
+		{
+			"conflicting Content-Length",
+			vk.HeaderChecks{ConflictingContentLength: true},
+			request(func(r *http.Request) { r.Header["Content-Length"] = []string{"2", "3"} }),
+		},
+		{
+			"Content-Length with Transfer-Encoding",
+			vk.HeaderChecks{ContentLengthWithTransferEncoding: true},
+			request(func(r *http.Request) {
+				r.Header.Set("Content-Length", "2")
+				r.TransferEncoding = []string{"chunked"}
+			}),
+		},
+		{
+			"duplicate Host",
+			vk.HeaderChecks{DuplicateHost: true},
+			request(func(r *http.Request) { r.Header["Host"] = []string{"example.com", "internal.example.com"} }),
+		},
+		{
+			"invalid header names",
+			vk.HeaderChecks{InvalidHeaderNames: true},
+			request(func(r *http.Request) { r.Header["X-Smuggle:"] = []string{"1"} }),
+		},
+		{
+			"duplicate headers",
+			vk.HeaderChecks{DuplicateSingletons: true},
+			request(func(r *http.Request) { r.Header["Expect"] = []string{"100-continue", "100-continue"} }),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			logs := &logCapture{}
+
+			server := hygieneServer(logs, tc.check)
+			require.NoError(t, server.TestStart())
+
+			w := httptest.NewRecorder()
+			server.ServeHTTP(w, tc.request)
+
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+			assert.Equal(t, "close", w.Header().Get("Connection"))
+			assert.Contains(t, strings.Join(logs.messages(), "\n"), "failed the "+tc.name+" header check")
+
+			// with the check toggled off, the same request is handled
+			w = httptest.NewRecorder()
+			server = hygieneServer(logs, vk.HeaderChecks{})
+			require.NoError(t, server.TestStart())
+
+			server.ServeHTTP(w, tc.request)
+			assert.Equal(t, http.StatusOK, w.Code)
+		})
+	}
+
+	t.Run("matching duplicates", func(t *testing.T) {
+		server := hygieneServer(&logCapture{}, vk.AllHeaderChecks())
+		require.NoError(t, server.TestStart())
+
+		// identical Content-Length values can't be read differently
+		r := request(func(r *http.Request) { r.Header["Content-Length"] = []string{"2", "2"} })
+
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+}
@@ -0,0 +1,138 @@
+package test_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+	"github.com/suborbital/vektor/vtest"
+)
+
+func TestInFlightRegistry(t *testing.T) {
+	server := vk.New(vk.UseLogger(vlog.Noop()), vk.UseInFlightTracking(0), vk.UseTrustProxy())
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	server.GET("/export/:id", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		started <- struct{}{}
+		<-release
+
+		return vk.RespondString(ctx.Context, w, "done", http.StatusOK)
+	})
+
+	vt := vtest.New(server)
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		r, _ := http.NewRequest(http.MethodGet, "/export/42", nil)
+		r.RemoteAddr = "10.0.0.1:5000"
+		r.Header.Set("X-Forwarded-For", "203.0.113.7, 10.0.0.1")
+
+		vt.Do(r, t)
+	}()
+
+	<-started
+
+	requests := server.InFlight().Requests()
+	require.Len(t, requests, 1)
+
+	req := requests[0]
+	assert.NotEmpty(t, req.RequestID)
+	assert.Equal(t, http.MethodGet, req.Method)
+	assert.Equal(t, "/export/:id", req.Route)
+	assert.Equal(t, "/export/42", req.Path)
+	assert.Equal(t, "203.0.113.7", req.ClientIP)
+	assert.False(t, req.Start.IsZero())
+
+	close(release)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("request did not complete")
+	}
+
+	assert.Empty(t, server.InFlight().Requests())
+}
+
+func TestInFlightDisabled(t *testing.T) {
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+
+	assert.Nil(t, server.InFlight())
+	assert.Empty(t, vk.NewRouter(nil, "").InFlight())
+}
+
+func TestStuckRequestsLogged(t *testing.T) {
+	logs := &logCapture{}
+	port := freePort(t)
+
+	server := vk.New(
+		vk.UseLogger(vlog.Default(vlog.Level(vlog.LogLevelInfo), vlog.WithWriter(logs))),
+		vk.UseHTTPPort(port),
+		vk.UseInFlightTracking(50*time.Millisecond),
+	)
+
+	release := make(chan struct{})
+
+	server.GET("/export", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		<-release
+		return vk.RespondString(ctx.Context, w, "done", http.StatusOK)
+	})
+
+	events := server.Events()
+
+	go server.Start()
+
+	nextEvent(t, events) // ListenerBound
+	nextEvent(t, events) // Ready
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/export", port))
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+
+	assert.Eventually(t, func() bool {
+		for _, m := range logs.messages() {
+			if strings.HasPrefix(m, "(W) request ") && strings.HasSuffix(m, "s on GET /export") {
+				return true
+			}
+		}
+
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+
+	close(release)
+	<-done
+
+	http.DefaultClient.CloseIdleConnections()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	require.NoError(t, server.StopCtx(ctx))
+
+	// the watcher exits with the server
+	assert.Eventually(t, func() bool {
+		stacks := make([]byte, 1<<20)
+		return !strings.Contains(string(stacks[:runtime.Stack(stacks, true)]), "(*InFlightRequests).watch")
+	}, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,149 @@
+package test_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+	"github.com/suborbital/vektor/vtest"
+)
+
+// publishedInvalidations records the purges given to it, like one publishing them to other instances would
+type publishedInvalidations struct {
+	lock sync.Mutex
+	tags [][]string
+	fail bool
+}
+
+func (p *publishedInvalidations) Invalidate(_ context.Context, tags []string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.tags = append(p.tags, tags)
+
+	if p.fail {
+		return errors.New("broker unavailable")
+	}
+
+	return nil
+}
+
+func (p *publishedInvalidations) published() [][]string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.tags
+}
+
+func invalidationServer(published *publishedInvalidations, userCalls, listCalls *int32) *vk.Server {
+	cache := vk.NewResponseCache(vk.CacheOptions{TTL: time.Hour, Tags: vk.CacheTags("user:{id}")})
+
+	users := vk.Group("/users").WithMiddlewares(cache.Middleware())
+
+	users.GET("/:id", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		n := atomic.AddInt32(userCalls, 1)
+
+		return vk.RespondString(ctx.Context, w, fmt.Sprintf("%s v%d", ctx.Params.ByName("id"), n), http.StatusOK)
+	})
+
+	users.GET("", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		n := atomic.AddInt32(listCalls, 1)
+		w.Header().Set("Surrogate-Key", "user-list")
+
+		return vk.RespondString(ctx.Context, w, fmt.Sprintf("list v%d", n), http.StatusOK)
+	})
+
+	users.POST("/:id", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		if r.URL.Query().Get("fail") != "" {
+			return vk.E(http.StatusConflict, "conflict")
+		}
+
+		return vk.RespondString(ctx.Context, w, "updated", http.StatusOK)
+	}, vk.Invalidates("user:{id}", "user-list"))
+
+	users.DELETE("/:id", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}, vk.Invalidates("user:{missing}", "user-list"))
+
+	server := vk.New(vk.UseLogger(vlog.Noop()), vk.UseCacheInvalidator(published))
+	server.AddGroup(users)
+
+	return server
+}
+
+func TestCacheInvalidation(t *testing.T) {
+	published := &publishedInvalidations{}
+
+	var userCalls, listCalls int32
+	vt := vtest.New(invalidationServer(published, &userCalls, &listCalls))
+
+	get := func(path string) *vtest.Response {
+		r, _ := http.NewRequest(http.MethodGet, path, nil)
+		return vt.Do(r, t)
+	}
+
+	get("/users/1").AssertBodyString("1 v1").AssertHeader("X-Cache", "MISS")
+	get("/users/1").AssertBodyString("1 v1").AssertHeader("X-Cache", "HIT")
+	get("/users/2").AssertBodyString("2 v2").AssertHeader("X-Cache", "MISS")
+	get("/users").AssertBodyString("list v1").AssertHeader("X-Cache", "MISS")
+	get("/users").AssertHeader("X-Cache", "HIT")
+
+	t.Run("failed mutations don't purge", func(t *testing.T) {
+		r, _ := http.NewRequest(http.MethodPost, "/users/1?fail=1", nil)
+		vt.Do(r, t).AssertStatus(http.StatusConflict)
+
+		get("/users/1").AssertHeader("X-Cache", "HIT")
+		assert.Empty(t, published.published())
+	})
+
+	t.Run("successful mutations purge their tags", func(t *testing.T) {
+		r, _ := http.NewRequest(http.MethodPost, "/users/1", nil)
+		vt.Do(r, t).AssertStatus(http.StatusOK).AssertBodyString("updated")
+
+		get("/users/1").AssertBodyString("1 v3").AssertHeader("X-Cache", "MISS")
+		get("/users/2").AssertBodyString("2 v2").AssertHeader("X-Cache", "HIT")
+		get("/users").AssertBodyString("list v2").AssertHeader("X-Cache", "MISS")
+
+		assert.Equal(t, [][]string{{"user:1", "user-list"}}, published.published())
+	})
+
+	t.Run("tags that can't be interpolated are skipped", func(t *testing.T) {
+		published.fail = true
+
+		r, _ := http.NewRequest(http.MethodDelete, "/users/2", nil)
+		vt.Do(r, t).AssertStatus(http.StatusNoContent)
+
+		get("/users/2").AssertHeader("X-Cache", "HIT")
+		get("/users").AssertBodyString("list v3").AssertHeader("X-Cache", "MISS")
+
+		assert.Equal(t, []string{"user-list"}, published.published()[1])
+	})
+}
+
+func TestCacheInvalidatorFromOtherInstances(t *testing.T) {
+	var userCalls, listCalls int32
+	server := invalidationServer(&publishedInvalidations{}, &userCalls, &listCalls)
+	vt := vtest.New(server)
+
+	get := func(path string) *vtest.Response {
+		r, _ := http.NewRequest(http.MethodGet, path, nil)
+		return vt.Do(r, t)
+	}
+
+	get("/users/7").AssertHeader("X-Cache", "MISS")
+	get("/users/7").AssertHeader("X-Cache", "HIT")
+
+	assert.NoError(t, server.CacheInvalidator().Invalidate(context.Background(), []string{"user:7"}))
+
+	get("/users/7").AssertBodyString("7 v2").AssertHeader("X-Cache", "MISS")
+}
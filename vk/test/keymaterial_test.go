@@ -0,0 +1,401 @@
+package test_test
+
+import (
+	"bufio"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+	"github.com/suborbital/vektor/vtest"
+)
+
+func TestCertRotation(t *testing.T) {
+	dir := t.TempDir()
+	writeCert(t, dir, "a.test", "before")
+
+	port := freePort(t)
+
+	server := vk.New(
+		vk.UseLogger(vlog.Noop()),
+		vk.UseTLSPort(port),
+		vk.UseCertDir(dir, ""),
+		vk.UseCertReloadInterval(time.Hour),
+	)
+
+	server.GET("/hello", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.RespondString(ctx.Context, w, "hello", http.StatusOK)
+	})
+
+	server.RegisterAdmin(server.KeyMaterial())
+
+	go server.Start()
+
+	t.Cleanup(func() { server.Stop() })
+
+	for event := range server.Events() {
+		if _, ok := event.(vk.Ready); ok {
+			break
+		}
+	}
+
+	existing, err := tls.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port), &tls.Config{ServerName: "a.test", InsecureSkipVerify: true})
+	require.NoError(t, err)
+
+	defer existing.Close()
+
+	reader := bufio.NewReader(existing)
+
+	// sends a request over the existing connection, which is kept alive
+	get := func(t *testing.T) {
+		_, err := fmt.Fprint(existing, "GET /hello HTTP/1.1\r\nHost: a.test\r\n\r\n")
+		require.NoError(t, err)
+
+		resp, err := http.ReadResponse(reader, nil)
+		require.NoError(t, err)
+
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "hello", string(body))
+	}
+
+	get(t)
+
+	// ensure the new files have a different modification time
+	time.Sleep(20 * time.Millisecond)
+
+	writeCert(t, dir, "a.test", "after")
+
+	// the directory isn't due to be checked for an hour, so the reload is forced
+	w := httptest.NewRecorder()
+	server.AdminRouter().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/keys/refresh", nil))
+
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var stats vk.KeyMaterialStats
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &stats))
+
+	assert.Equal(t, 1, stats.Certificates)
+	assert.Equal(t, uint64(1), stats.CertReloads)
+	assert.Nil(t, stats.JWKS)
+
+	cert, err := dialCert(port, "a.test")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"after"}, cert.Subject.Organization, "new handshakes should use the new certificate")
+
+	get(t)
+	assert.Equal(t, []string{"before"}, existing.ConnectionState().PeerCertificates[0].Subject.Organization,
+		"the existing connection should continue with its certificate")
+}
+
+// jwksServer serves a key set that can be rotated, or made to fail
+type jwksServer struct {
+	*httptest.Server
+
+	lock    sync.Mutex
+	keys    []map[string]string
+	failing bool
+	fetches int
+}
+
+func newJWKSServer(t *testing.T, cacheControl string) *jwksServer {
+	s := &jwksServer{}
+
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+
+		s.fetches++
+
+		if s.failing {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Cache-Control", cacheControl)
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": s.keys})
+	}))
+
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func (s *jwksServer) serve(keys ...map[string]string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.keys = keys
+}
+
+func (s *jwksServer) fail(failing bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.failing = failing
+}
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func ecJWK(kid string, key *ecdsa.PrivateKey) map[string]string {
+	return map[string]string{"kty": "EC", "kid": kid, "crv": "P-256", "x": b64(key.X.FillBytes(make([]byte, 32))), "y": b64(key.Y.FillBytes(make([]byte, 32)))}
+}
+
+func rsaJWK(kid string, key *rsa.PrivateKey) map[string]string {
+	return map[string]string{"kty": "RSA", "kid": kid, "use": "sig", "n": b64(key.N.Bytes()), "e": b64(big.NewInt(int64(key.E)).Bytes())}
+}
+
+// signToken signs the claims with an ES256 or RS256 key
+func signToken(t *testing.T, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	alg := "RS256"
+	if _, ok := key.(*ecdsa.PrivateKey); ok {
+		alg = "ES256"
+	}
+
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+
+	input := b64(header) + "." + b64(payload)
+	digest := sha256.Sum256([]byte(input))
+
+	var sig []byte
+
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		require.NoError(t, err)
+
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	case *rsa.PrivateKey:
+		var err error
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+		require.NoError(t, err)
+	}
+
+	return input + "." + b64(sig)
+}
+
+func TestJWTKeyRotation(t *testing.T) {
+	keyA, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	keyB, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	keyC, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	jwks := newJWKSServer(t, "public, max-age=120, stale-if-error=60")
+	jwks.serve(ecJWK("a", keyA))
+
+	server := vk.New(vk.UseLogger(vlog.Noop()), vk.UseJWKS(vk.JWKSOptions{URL: jwks.URL, MinRefreshInterval: 10 * time.Millisecond}))
+
+	g := vk.Group("").WithMiddlewares(vk.JWT(server.KeyMaterial().JWKS(), vk.JWTOptions{Issuer: "idp", Audience: "api"}))
+	g.GET("/me", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		claims := ctx.Get(vk.ClaimsKey).(map[string]interface{})
+
+		return vk.RespondString(ctx.Context, w, claims["sub"].(string), http.StatusOK)
+	})
+	server.AddGroup(g)
+
+	server.RegisterAdmin(server.KeyMaterial())
+
+	vt := vtest.New(server)
+
+	claims := func(sub string) map[string]interface{} {
+		return map[string]interface{}{"sub": sub, "iss": "idp", "aud": []string{"api"}, "exp": time.Now().Add(time.Hour).Unix()}
+	}
+
+	tokenA := signToken(t, "a", keyA, claims("alice"))
+	tokenB := signToken(t, "b", keyB, claims("bob"))
+	tokenC := signToken(t, "c", keyC, claims("carol"))
+
+	me := func(t *testing.T, token string) *vtest.Response {
+		r, _ := http.NewRequest(http.MethodGet, "/me", nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		return vt.Do(r, t)
+	}
+
+	refresh := func(t *testing.T) int {
+		w := httptest.NewRecorder()
+		server.AdminRouter().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/keys/refresh", nil))
+
+		return w.Code
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		me(t, tokenA).AssertStatus(http.StatusOK).AssertBodyString("alice")
+
+		stats := server.KeyMaterial().Stats().JWKS
+		require.NotNil(t, stats)
+
+		assert.Equal(t, 120*time.Second, stats.ExpiresAt.Sub(stats.FetchedAt), "max-age should be honored")
+		assert.Equal(t, 60*time.Second, stats.StaleUntil.Sub(stats.ExpiresAt), "stale-if-error should be honored")
+	})
+
+	t.Run("rotated", func(t *testing.T) {
+		jwks.serve(rsaJWK("b", keyB))
+
+		time.Sleep(20 * time.Millisecond)
+
+		// the unknown kid refreshes the key set
+		me(t, tokenB).AssertStatus(http.StatusOK).AssertBodyString("bob")
+
+		// and tokens signed with the previous key still verify
+		me(t, tokenA).AssertStatus(http.StatusOK).AssertBodyString("alice")
+
+		stats := server.KeyMaterial().Stats().JWKS
+		assert.Equal(t, 1, stats.Keys)
+		assert.Equal(t, 1, stats.PreviousKeys)
+		assert.Equal(t, uint64(2), stats.Refreshes)
+	})
+
+	t.Run("forced", func(t *testing.T) {
+		jwks.serve(ecJWK("c", keyC))
+
+		assert.Equal(t, http.StatusOK, refresh(t))
+
+		me(t, tokenC).AssertStatus(http.StatusOK).AssertBodyString("carol")
+		me(t, tokenB).AssertStatus(http.StatusOK).AssertBodyString("bob")
+		me(t, tokenA).AssertStatus(http.StatusUnauthorized)
+	})
+
+	t.Run("stale if error", func(t *testing.T) {
+		jwks.fail(true)
+		defer jwks.fail(false)
+
+		assert.Equal(t, http.StatusBadGateway, refresh(t))
+
+		me(t, tokenC).AssertStatus(http.StatusOK).AssertBodyString("carol")
+
+		stats := server.KeyMaterial().Stats().JWKS
+		assert.Equal(t, uint64(1), stats.RefreshFailures)
+		assert.NotEmpty(t, stats.LastError)
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		wrongAudience := claims("carol")
+		wrongAudience["aud"] = "other"
+
+		expired := claims("carol")
+		expired["exp"] = time.Now().Add(-time.Hour).Unix()
+
+		for name, token := range map[string]string{
+			"wrong audience": signToken(t, "c", keyC, wrongAudience),
+			"expired":        signToken(t, "c", keyC, expired),
+			"wrong key":      signToken(t, "c", keyA, claims("mallory")),
+			"malformed":      "not.a.token",
+			"none":           b64([]byte(`{"alg":"none","kid":"c"}`)) + "." + b64([]byte(`{"sub":"mallory"}`)) + ".",
+		} {
+			t.Run(name, func(t *testing.T) {
+				me(t, token).
+					AssertStatus(http.StatusUnauthorized).
+					AssertHeader("WWW-Authenticate", `Bearer error="invalid_token"`)
+			})
+		}
+
+		me(t, "").
+			AssertStatus(http.StatusUnauthorized).
+			AssertHeader("WWW-Authenticate", "Bearer")
+	})
+}
+
+func TestJWKSUnavailable(t *testing.T) {
+	jwks := newJWKSServer(t, "")
+	jwks.fail(true)
+
+	keys := vk.NewJWKS(vlog.Noop(), vk.JWKSOptions{URL: jwks.URL})
+
+	_, err := keys.Key(context.Background(), "a")
+	assert.ErrorIs(t, err, vk.ErrJWKSUnavailable)
+
+	// failures aren't retried before MinRefreshInterval
+	_, err = keys.Key(context.Background(), "a")
+	assert.ErrorIs(t, err, vk.ErrJWKSUnavailable)
+
+	jwks.lock.Lock()
+	assert.Equal(t, 1, jwks.fetches)
+	jwks.lock.Unlock()
+
+	assert.Equal(t, uint64(1), keys.Stats().RefreshFailures)
+}
+
+func TestJWKSHangingEndpoint(t *testing.T) {
+	var fetches int32
+
+	release := make(chan struct{})
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+
+	defer upstream.Close()
+	defer close(release)
+
+	keys := vk.NewJWKS(vlog.Noop(), vk.JWKSOptions{URL: upstream.URL, Timeout: 200 * time.Millisecond})
+
+	t.Run("request context", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+
+		started := time.Now()
+
+		_, err := keys.Key(ctx, "a")
+		assert.ErrorIs(t, err, vk.ErrJWKSUnavailable)
+		assert.Contains(t, err.Error(), context.DeadlineExceeded.Error())
+		assert.Less(t, time.Since(started), 150*time.Millisecond)
+	})
+
+	t.Run("single fetch", func(t *testing.T) {
+		var wg sync.WaitGroup
+
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+
+				_, err := keys.Key(context.Background(), "a")
+				assert.ErrorIs(t, err, vk.ErrJWKSUnavailable)
+			}()
+		}
+
+		wg.Wait()
+
+		// the fetch started by the first request is joined, and abandoned after the timeout
+		assert.Equal(t, int32(1), atomic.LoadInt32(&fetches))
+		assert.Equal(t, uint64(1), keys.Stats().RefreshFailures)
+	})
+}
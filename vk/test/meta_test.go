@@ -0,0 +1,96 @@
+package test_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+	"github.com/suborbital/vektor/vtest"
+)
+
+type testMeta struct {
+	Region string `json:"region"`
+	Status int    `json:"status"`
+}
+
+func metaProvider(ctx *vk.Ctx, status int) interface{} {
+	return testMeta{Region: "us-east", Status: status}
+}
+
+func respondWith(data interface{}, status int) vk.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.RespondJSON(ctx.Context, w, data, status)
+	}
+}
+
+func TestResponseMeta(t *testing.T) {
+	server := vk.New(
+		vk.UseLogger(vlog.Default(vlog.Level(vlog.LogLevelError))),
+		vk.UseResponseMeta(metaProvider),
+	)
+
+	server.GET("/object", respondWith(struct {
+		Name string `json:"name"`
+	}{Name: "vk"}, http.StatusCreated))
+	server.GET("/empty", respondWith(map[string]string{}, http.StatusOK))
+	server.GET("/braces", respondWith(map[string]interface{}{"text": "}{\"}", "nested": map[string]string{"a": "}"}}, http.StatusOK))
+	server.GET("/array", respondWith([]string{"a", "b"}, http.StatusOK))
+	server.GET("/string", respondWith("hello", http.StatusOK))
+
+	g := vk.Group("/quiet").WithMiddlewares(vk.SkipResponseMeta())
+	g.GET("/object", respondWith(map[string]string{"name": "vk"}, http.StatusOK))
+	server.AddGroup(g)
+
+	vt := vtest.New(server)
+
+	cases := map[string]string{
+		"/object":       `{"name":"vk","_meta":{"region":"us-east","status":201}}`,
+		"/empty":        `{"_meta":{"region":"us-east","status":200}}`,
+		"/braces":       `{"nested":{"a":"}"},"text":"}{\"}","_meta":{"region":"us-east","status":200}}`,
+		"/array":        `["a","b"]`,
+		"/string":       `"hello"`,
+		"/quiet/object": `{"name":"vk"}`,
+	}
+
+	for path, expected := range cases {
+		t.Run(path, func(t *testing.T) {
+			r, err := http.NewRequest(http.MethodGet, path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp := vt.Do(r, t).AssertBodyString(expected)
+
+			if !json.Valid(resp.Body) {
+				t.Errorf("invalid JSON: %s", string(resp.Body))
+			}
+		})
+	}
+}
+
+func BenchmarkResponseMeta(b *testing.B) {
+	payload := map[string]interface{}{"id": 123, "name": "vektor", "tags": []string{"a", "b", "c"}}
+
+	for name, provider := range map[string]vk.MetaProvider{"without": nil, "with": metaProvider} {
+		b.Run(name, func(b *testing.B) {
+			server := vk.New(vk.UseLogger(vlog.Noop()), vk.UseResponseMeta(provider))
+			server.GET("/bench", respondWith(payload, http.StatusOK))
+
+			if err := server.TestStart(); err != nil {
+				b.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/bench", nil)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				server.ServeHTTP(httptest.NewRecorder(), req)
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package test_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+	"github.com/suborbital/vektor/vtest"
+)
+
+// legacyMux stands in for the application being migrated from
+func legacyMux() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/users/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("legacy user"))
+	})
+
+	mux.HandleFunc("/orders", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("legacy orders"))
+	})
+
+	mux.HandleFunc("/reports", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "legacy failed", http.StatusInternalServerError)
+	})
+
+	return mux
+}
+
+func TestMigrationCutover(t *testing.T) {
+	logs := &logCapture{}
+	migration := vk.MigrationRouter(legacyMux())
+
+	server := vk.New(
+		vk.UseLogger(vlog.Default(vlog.Level(vlog.LogLevelInfo), vlog.WithWriter(logs))),
+		vk.UseMigration(migration),
+	)
+
+	routes := vk.Group("")
+
+	routes.GET("/users/:id", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.RespondString(ctx.Context, w, "vk user", http.StatusOK)
+	}, vk.Cutover(25))
+
+	routes.GET("/reports", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.RespondString(ctx.Context, w, "vk reports", http.StatusOK)
+	}, vk.Cutover(0))
+
+	routes.GET("/health", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.RespondString(ctx.Context, w, "ok", http.StatusOK)
+	})
+
+	server.AddGroup(routes)
+
+	server.RegisterAdmin(migration)
+
+	vt := vtest.New(server)
+
+	get := func(path, client string) string {
+		r, _ := http.NewRequest(http.MethodGet, path, nil)
+		r.RemoteAddr = client + ":1234"
+
+		return string(vt.Do(r, t).Body)
+	}
+
+	clients := make([]string, 1000)
+	for i := range clients {
+		clients[i] = fmt.Sprintf("10.0.%d.%d", i/250, i%250)
+	}
+
+	t.Run("distribution and stickiness", func(t *testing.T) {
+		sides := map[string]string{}
+		vkCount := 0
+
+		for _, client := range clients {
+			body := get("/users/1", client)
+			sides[client] = body
+
+			if body == "vk user" {
+				vkCount++
+			} else {
+				require.Equal(t, "legacy user", body)
+			}
+		}
+
+		assert.InDelta(t, 250, vkCount, 50, "about a quarter of clients should be served by vk")
+
+		for _, client := range clients[:100] {
+			assert.Equal(t, sides[client], get("/users/2", client), "a client should stay on the same side")
+		}
+
+		stats := migration.Stats()
+		require.Len(t, stats.Routes, 2)
+
+		users := stats.Routes[1]
+		assert.Equal(t, "/users/:id", users.Route)
+		assert.Equal(t, 25, users.Percent)
+		assert.Equal(t, uint64(1100), users.VK.Requests+users.Legacy.Requests)
+	})
+
+	t.Run("raising the percentage keeps vk clients", func(t *testing.T) {
+		before := map[string]bool{}
+		for _, client := range clients[:200] {
+			before[client] = get("/users/1", client) == "vk user"
+		}
+
+		require.NoError(t, migration.SetCutover(http.MethodGet, "/users/:id", 60))
+
+		for _, client := range clients[:200] {
+			if before[client] {
+				assert.Equal(t, "vk user", get("/users/1", client))
+			}
+		}
+
+		require.NoError(t, migration.SetCutover(http.MethodGet, "/users/:id", 100))
+
+		for _, client := range clients[:50] {
+			assert.Equal(t, "vk user", get("/users/1", client))
+		}
+
+		assert.Error(t, migration.SetCutover(http.MethodGet, "/users/:id", 101))
+		assert.Error(t, migration.SetCutover(http.MethodGet, "/health", 50))
+	})
+
+	t.Run("unmatched and cut over routes", func(t *testing.T) {
+		assert.Equal(t, "legacy orders", get("/orders", "10.1.0.1"))
+		assert.Equal(t, "ok", get("/health", "10.1.0.1"))
+
+		assert.EqualValues(t, 1, migration.Stats().Unmatched)
+	})
+
+	t.Run("error rates", func(t *testing.T) {
+		for _, client := range clients[:10] {
+			get("/reports", client)
+		}
+
+		reports := migration.Stats().Routes[0]
+		assert.Equal(t, "/reports", reports.Route)
+		assert.EqualValues(t, 10, reports.Legacy.Errors)
+		assert.Equal(t, 1.0, reports.Legacy.ErrorRate)
+		assert.EqualValues(t, 0, reports.VK.Requests)
+	})
+
+	t.Run("variant logged", func(t *testing.T) {
+		var vkLogged, legacyLogged bool
+
+		for _, m := range logs.messages() {
+			if strings.Contains(m, "/users/1") && strings.Contains(m, "variant=vk") {
+				vkLogged = true
+			}
+
+			if strings.Contains(m, "/reports") && strings.Contains(m, "completed (500") && strings.Contains(m, "variant=legacy") {
+				legacyLogged = true
+			}
+		}
+
+		assert.True(t, vkLogged, "requests served by vk should be logged with their variant")
+		assert.True(t, legacyLogged, "requests served by the legacy handler should be logged with their variant")
+	})
+
+	t.Run("admin", func(t *testing.T) {
+		admin := func(method, path, body string) int {
+			w := httptest.NewRecorder()
+			server.AdminRouter().ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+
+			return w.Code
+		}
+
+		assert.Equal(t, http.StatusOK, admin(http.MethodPut, "/migration/cutover", `{"method":"GET","route":"/reports","percent":100}`))
+		assert.Equal(t, "vk reports", get("/reports", "10.1.0.1"))
+
+		assert.Equal(t, http.StatusBadRequest, admin(http.MethodPut, "/migration/cutover", `{"method":"GET","route":"/reports","percent":-1}`))
+		assert.Equal(t, http.StatusOK, admin(http.MethodGet, "/migration", ""))
+	})
+}
@@ -0,0 +1,214 @@
+package test_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+	"github.com/suborbital/vektor/vtest"
+)
+
+const benchRouteCount = 10000
+
+func TestNestedGroupMiddleware(t *testing.T) {
+	var lock sync.Mutex
+	var ran []string
+
+	record := func(name string) vk.Middleware {
+		return vk.Named(name, func(inner vk.HandlerFunc) vk.HandlerFunc {
+			return func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+				lock.Lock()
+				ran = append(ran, name)
+				lock.Unlock()
+
+				return inner(w, r, ctx)
+			}
+		})
+	}
+
+	handler := func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.RespondString(ctx.Context, w, "ok", http.StatusOK)
+	}
+
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+
+	outer := vk.Group("/v1").WithMiddlewares(record("outer1"), record("outer2"))
+
+	users := vk.Group("/users").WithMiddlewares(record("users"))
+	users.GET("/:id", handler, record("route"))
+	users.GET("/", handler)
+
+	orgs := vk.Group("/orgs").WithMiddlewares(record("orgs"))
+	orgs.GET("/:id", handler)
+
+	outer.AddGroup(users)
+	outer.AddGroup(orgs)
+
+	// middleware added to a group after it has been added to another is not applied
+	users.WithMiddlewares(record("late"))
+
+	server.AddGroup(outer)
+
+	vt := vtest.New(server)
+
+	cases := map[string]string{
+		"/v1/users/1": "outer2,outer1,users,route",
+		"/v1/users/":  "outer2,outer1,users",
+		"/v1/orgs/1":  "outer2,outer1,orgs",
+	}
+
+	for path, expected := range cases {
+		t.Run(path, func(t *testing.T) {
+			// the second request uses the chain built by the first
+			for i := 0; i < 2; i++ {
+				lock.Lock()
+				ran = nil
+				lock.Unlock()
+
+				r, _ := http.NewRequest(http.MethodGet, path, nil)
+				vt.Do(r, t).AssertStatus(http.StatusOK)
+
+				lock.Lock()
+				assert.Equal(t, expected, strings.Join(ran, ","))
+				lock.Unlock()
+			}
+		})
+	}
+}
+
+// generatedAPI registers benchRouteCount routes across 100 groups, each nested in a versioned group with its own middleware
+func generatedAPI() *vk.Router {
+	router := vk.NewRouter(vlog.Noop(), "")
+	router.WithMiddlewares(vk.ErrorMiddleware(), passthrough)
+
+	v1 := vk.Group("/v1").WithMiddlewares(passthrough, passthrough)
+
+	handler := func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.RespondString(ctx.Context, w, "ok", http.StatusOK)
+	}
+
+	for g := 0; g < 100; g++ {
+		group := vk.Group(fmt.Sprintf("/resource%d", g)).WithMiddlewares(passthrough)
+
+		for r := 0; r < benchRouteCount/100; r++ {
+			group.GET(fmt.Sprintf("/item%d/:id", r), handler)
+		}
+
+		v1.AddGroup(group)
+	}
+
+	router.AddGroup(v1)
+
+	return router
+}
+
+func BenchmarkFinalize(b *testing.B) {
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		router := generatedAPI()
+		b.StartTimer()
+
+		router.Finalize()
+	}
+}
+
+func BenchmarkRegisterAndFinalize(b *testing.B) {
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		generatedAPI().Finalize()
+	}
+}
+
+func BenchmarkMountedRoute(b *testing.B) {
+	router := generatedAPI()
+	router.Finalize()
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/resource42/item7/123", nil)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+}
+
+func TestMountSubtree(t *testing.T) {
+	type seen struct {
+		Wildcard string `json:"wildcard"`
+		Path     string `json:"path"`
+		Escaped  string `json:"escaped"`
+	}
+
+	sub := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := vk.CtxFromContext(r.Context())
+
+		_ = vk.RespondJSON(r.Context(), w, seen{ctx.Params.ByName(vk.MountWildcard), r.URL.Path, r.URL.EscapedPath()}, http.StatusOK)
+	})
+
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+	server.Mount("/files", sub)
+	server.Mount("/docs/", sub, vk.WithBarePrefix(vk.BarePrefixRedirect))
+
+	vt := vtest.New(server)
+
+	cases := map[string]struct {
+		path     string
+		expected seen
+	}{
+		"bare prefix":    {"/files", seen{"", "/", "/"}},
+		"trailing slash": {"/files/", seen{"", "/", "/"}},
+		"single segment": {"/files/a.txt", seen{"a.txt", "/a.txt", "/a.txt"}},
+		"deep path":      {"/files/a/b/c.txt", seen{"a/b/c.txt", "/a/b/c.txt", "/a/b/c.txt"}},
+		"encoded slash":  {"/files/a%2Fb.txt", seen{"a/b.txt", "/a/b.txt", "/a%2Fb.txt"}},
+		"redirect mode":  {"/docs/guide", seen{"guide", "/guide", "/guide"}},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			r, _ := http.NewRequest(http.MethodGet, c.path, nil)
+			vt.Do(r, t).AssertStatus(http.StatusOK).AssertJSON(c.expected)
+		})
+	}
+
+	t.Run("bare prefix redirect", func(t *testing.T) {
+		r, _ := http.NewRequest(http.MethodGet, "/docs?page=2", nil)
+		vt.Do(r, t).AssertStatus(http.StatusMovedPermanently).AssertHeader("Location", "/docs/?page=2")
+
+		r, _ = http.NewRequest(http.MethodPost, "/docs", nil)
+		vt.Do(r, t).AssertStatus(http.StatusPermanentRedirect).AssertHeader("Location", "/docs/")
+	})
+}
+
+func TestStatic(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "index.html"), []byte("home"), 0600))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "css"), 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "css", "site.css"), []byte("body{}"), 0600))
+
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+	server.Static("/assets", http.Dir(dir))
+
+	vt := vtest.New(server)
+
+	for path, body := range map[string]string{"/assets": "home", "/assets/": "home", "/assets/css/site.css": "body{}"} {
+		r, _ := http.NewRequest(http.MethodGet, path, nil)
+		vt.Do(r, t).AssertStatus(http.StatusOK).AssertBodyString(body)
+	}
+
+	r, _ := http.NewRequest(http.MethodGet, "/assets/missing.txt", nil)
+	vt.Do(r, t).AssertStatus(http.StatusNotFound)
+}
@@ -0,0 +1,230 @@
+package test_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+)
+
+// multipartReader returns a reader of a multipart/mixed response
+func multipartReader(t *testing.T, resp *http.Response) *multipart.Reader {
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	require.NoError(t, err)
+	require.Equal(t, "multipart/mixed", mediaType)
+
+	return multipart.NewReader(resp.Body, params["boundary"])
+}
+
+func jsonPart(id, body string) vk.Part {
+	return vk.Part{
+		Header: textproto.MIMEHeader{"Content-Type": {"application/json"}, "Content-Id": {id}},
+		Status: http.StatusOK,
+		Body:   []byte(body),
+	}
+}
+
+func TestMultipart(t *testing.T) {
+	release := make(chan struct{})
+	stopped := make(chan struct{})
+	sentAll := make(chan struct{})
+	hold := make(chan struct{})
+	defer close(hold)
+
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+
+	server.GET("/batch", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		parts := make(chan vk.Part)
+
+		go func() {
+			defer close(parts)
+
+			parts <- jsonPart("<user-1>", `{"id":1}`)
+
+			// the first part reaches the client before the rest are ready
+			<-release
+
+			parts <- vk.ErrorPart("<user-2>", vk.E(http.StatusNotFound, "user 2 not found"))
+			parts <- vk.Part{
+				Header: textproto.MIMEHeader{"Content-Type": {"text/csv"}, "Content-Id": {"<report>"}},
+				Reader: io.NopCloser(strings.NewReader("id,name\n1,alice\n")),
+			}
+		}()
+
+		return vk.Multipart(parts).Respond(w, r, ctx)
+	})
+
+	server.GET("/endless", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		parts := make(chan vk.Part)
+
+		go func() {
+			defer close(stopped)
+
+			for {
+				select {
+				case parts <- jsonPart("<row>", `{"row":true}`):
+				case <-r.Context().Done():
+					return
+				}
+			}
+		}()
+
+		return vk.Multipart(parts).Respond(w, r, ctx)
+	})
+
+	server.GET("/careless", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		parts := make(chan vk.Part)
+
+		// a producer that ignores the request's context, and then stops sending without closing parts
+		go func() {
+			for i := 0; i < 100; i++ {
+				parts <- jsonPart("<row>", `{"row":true}`)
+			}
+
+			close(sentAll)
+			<-hold
+		}()
+
+		return vk.Multipart(parts).Respond(w, r, ctx)
+	})
+
+	server.GET("/failing", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		sent := false
+
+		return vk.MultipartFunc(func(ctx context.Context) (vk.Part, error) {
+			if sent {
+				return vk.Part{}, errors.New("database went away")
+			}
+
+			sent = true
+
+			return jsonPart("<user-1>", `{"id":1}`), nil
+		}).Respond(w, r, ctx)
+	})
+
+	require.NoError(t, server.TestStart())
+
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	t.Run("parts in order", func(t *testing.T) {
+		start := time.Now()
+
+		resp, err := http.Get(ts.URL + "/batch")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		reader := multipartReader(t, resp)
+
+		part, err := reader.NextPart()
+		require.NoError(t, err)
+
+		// the part only ends at the next boundary, which isn't written until the rest are released
+		body := make([]byte, len(`{"id":1}`))
+		_, err = io.ReadFull(part, body)
+		require.NoError(t, err)
+
+		assert.Less(t, time.Since(start), time.Second)
+		assert.Equal(t, "<user-1>", part.Header.Get("Content-ID"))
+		assert.Equal(t, "application/json", part.Header.Get("Content-Type"))
+		assert.Equal(t, "200 OK", part.Header.Get("Status"))
+		assert.Equal(t, `{"id":1}`, string(body))
+
+		close(release)
+
+		part, err = reader.NextPart()
+		require.NoError(t, err)
+
+		body, err = io.ReadAll(part)
+		require.NoError(t, err)
+
+		assert.Equal(t, "<user-2>", part.Header.Get("Content-ID"))
+		assert.Equal(t, vk.MultipartErrorContentType, part.Header.Get("Content-Type"))
+		assert.Equal(t, "404 Not Found", part.Header.Get("Status"))
+		assert.JSONEq(t, `{"status":404,"message":"user 2 not found"}`, string(body))
+
+		part, err = reader.NextPart()
+		require.NoError(t, err)
+
+		body, err = io.ReadAll(part)
+		require.NoError(t, err)
+
+		assert.Equal(t, "<report>", part.Header.Get("Content-ID"))
+		assert.Empty(t, part.Header.Get("Status"))
+		assert.Equal(t, "id,name\n1,alice\n", string(body))
+
+		_, err = reader.NextPart()
+		assert.Equal(t, io.EOF, err)
+	})
+
+	t.Run("client disconnects", func(t *testing.T) {
+		resp, err := http.Get(ts.URL + "/endless")
+		require.NoError(t, err)
+
+		_, err = multipartReader(t, resp).NextPart()
+		require.NoError(t, err)
+
+		resp.Body.Close()
+
+		select {
+		case <-stopped:
+		case <-time.After(2 * time.Second):
+			t.Fatal("producer was not cancelled")
+		}
+	})
+
+	t.Run("producer ignores the disconnect", func(t *testing.T) {
+		resp, err := http.Get(ts.URL + "/careless")
+		require.NoError(t, err)
+
+		_, err = multipartReader(t, resp).NextPart()
+		require.NoError(t, err)
+
+		resp.Body.Close()
+
+		select {
+		case <-sentAll:
+		case <-time.After(2 * time.Second):
+			t.Fatal("producer was blocked")
+		}
+
+		// the drain gives up once the producer has gone quiet
+		assert.Eventually(t, func() bool {
+			stacks := make([]byte, 1<<20)
+			return !strings.Contains(string(stacks[:runtime.Stack(stacks, true)]), "vk.Multipart.")
+		}, 3*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("producer fails", func(t *testing.T) {
+		resp, err := http.Get(ts.URL + "/failing")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		reader := multipartReader(t, resp)
+
+		part, err := reader.NextPart()
+		require.NoError(t, err)
+		assert.Equal(t, "<user-1>", part.Header.Get("Content-ID"))
+
+		// the stream ends without its closing boundary, so the client can tell it was cut short
+		_, err = reader.NextPart()
+		assert.Error(t, err)
+		assert.NotEqual(t, io.EOF, err)
+	})
+}
@@ -0,0 +1,198 @@
+package test_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+	"github.com/suborbital/vektor/vtest"
+)
+
+type ndjsonRow struct {
+	ID int `json:"id"`
+}
+
+// rowsFunc returns an iterator over the given rows
+func rowsFunc(rows ...interface{}) func(context.Context) (interface{}, error) {
+	return func(ctx context.Context) (interface{}, error) {
+		if len(rows) == 0 {
+			return nil, io.EOF
+		}
+
+		row := rows[0]
+		rows = rows[1:]
+
+		return row, nil
+	}
+}
+
+func TestNDJSON(t *testing.T) {
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+
+	server.GET("/rows", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.NDJSONFunc(rowsFunc(ndjsonRow{1}, make(chan int), ndjsonRow{2})).Respond(w, r, ctx)
+	})
+	server.GET("/abort", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.NDJSONFunc(rowsFunc(ndjsonRow{1}, make(chan int), ndjsonRow{2})).AbortOnError().Respond(w, r, ctx)
+	})
+	server.GET("/abort-first", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.NDJSONFunc(rowsFunc(make(chan int))).AbortOnError().Respond(w, r, ctx)
+	})
+	server.GET("/empty", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.NDJSONFunc(rowsFunc()).Respond(w, r, ctx)
+	})
+
+	vt := vtest.New(server)
+
+	t.Run("skip marshal errors", func(t *testing.T) {
+		r, _ := http.NewRequest(http.MethodGet, "/rows", nil)
+
+		vt.Do(r, t).
+			AssertStatus(http.StatusOK).
+			AssertHeader("Content-Type", "application/x-ndjson").
+			AssertBodyString("{\"id\":1}\n{\"id\":2}\n")
+	})
+
+	t.Run("abort on marshal error", func(t *testing.T) {
+		r, _ := http.NewRequest(http.MethodGet, "/abort", nil)
+
+		vt.Do(r, t).
+			AssertStatus(http.StatusOK).
+			AssertBodyString("{\"id\":1}\n")
+	})
+
+	t.Run("abort before first row", func(t *testing.T) {
+		r, _ := http.NewRequest(http.MethodGet, "/abort-first", nil)
+
+		vt.Do(r, t).AssertStatus(http.StatusInternalServerError)
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		r, _ := http.NewRequest(http.MethodGet, "/empty", nil)
+
+		vt.Do(r, t).
+			AssertStatus(http.StatusOK).
+			AssertHeader("Content-Type", "application/x-ndjson").
+			AssertBodyString("")
+	})
+}
+
+func TestNDJSONSlowConsumer(t *testing.T) {
+	const total = 50
+
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+
+	server.GET("/export", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		rows := make(chan interface{})
+
+		go func() {
+			defer close(rows)
+
+			for i := 0; i < total; i++ {
+				select {
+				case rows <- ndjsonRow{i}:
+				case <-r.Context().Done():
+					return
+				}
+			}
+		}()
+
+		return vk.NDJSON(rows).FlushEvery(1, 0).Respond(w, r, ctx)
+	})
+
+	require.NoError(t, server.TestStart())
+
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/export")
+	require.NoError(t, err)
+
+	defer resp.Body.Close()
+
+	assert.Equal(t, "application/x-ndjson", resp.Header.Get("Content-Type"))
+
+	scanner := bufio.NewScanner(resp.Body)
+
+	i := 0
+	for scanner.Scan() {
+		if i%10 == 0 {
+			time.Sleep(5 * time.Millisecond)
+		}
+
+		var row ndjsonRow
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &row))
+		assert.Equal(t, i, row.ID)
+
+		i++
+	}
+
+	assert.NoError(t, scanner.Err())
+	assert.Equal(t, total, i)
+}
+
+func TestNDJSONClientDisconnect(t *testing.T) {
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+
+	producerDone := make(chan struct{})
+	handlerDone := make(chan struct{})
+
+	server.GET("/export", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		defer close(handlerDone)
+
+		rows := make(chan interface{})
+
+		// an endless producer that must be stopped by the client going away
+		go func() {
+			defer close(producerDone)
+			defer close(rows)
+
+			for i := 0; ; i++ {
+				select {
+				case rows <- ndjsonRow{i}:
+				case <-r.Context().Done():
+					return
+				}
+			}
+		}()
+
+		return vk.NDJSON(rows).FlushEvery(1, 0).Respond(w, r, ctx)
+	})
+
+	require.NoError(t, server.TestStart())
+
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/export")
+	require.NoError(t, err)
+
+	reader := bufio.NewReader(resp.Body)
+	for i := 0; i < 5; i++ {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("{\"id\":%d}", i), strings.TrimSpace(line))
+	}
+
+	resp.Body.Close()
+
+	for name, done := range map[string]chan struct{}{"handler": handlerDone, "producer": producerDone} {
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s did not stop after the client disconnected", name)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package test_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+)
+
+func TestNilLogger(t *testing.T) {
+	for _, logger := range []*vlog.Logger{nil, vlog.Noop()} {
+		assert.NotPanics(t, func() {
+			logger.ErrorString("error")
+			logger.Error(errors.New("error"))
+			logger.Warn("warn")
+			logger.Info("info")
+			logger.Debug("debug")
+			logger.Trace("trace")()
+			logger.CreateScoped("scope").Info("scoped")
+		})
+	}
+}
+
+func TestNilRouterLogger(t *testing.T) {
+	router := vk.NewRouter(nil, "")
+	router.WithMiddlewares(vk.ErrorMiddleware())
+	router.GET("/ok", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		ctx.Log.Info("handling")
+		return vk.RespondString(ctx.Context, w, ctx.RequestID(), http.StatusOK)
+	})
+	router.GET("/fail", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.E(http.StatusTeapot, "short and stout")
+	})
+	router.Finalize()
+
+	for path, status := range map[string]int{"/ok": http.StatusOK, "/fail": http.StatusTeapot, "/missing": http.StatusNotFound} {
+		w := httptest.NewRecorder()
+
+		assert.NotPanics(t, func() {
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		}, path)
+
+		assert.Equal(t, status, w.Code, path)
+	}
+}
+
+func TestNilCtx(t *testing.T) {
+	ctxs := map[string]*vk.Ctx{
+		"nil":        nil,
+		"zero":       {},
+		"nil args":   vk.NewCtx(nil, nil, nil),
+		"nil params": vk.NewCtx(vlog.Noop(), nil, http.Header{}),
+		"nil header": vk.NewCtx(vlog.Noop(), httprouter.Params{}, nil),
+	}
+
+	for name, ctx := range ctxs {
+		t.Run(name, func(t *testing.T) {
+			assert.NotPanics(t, func() {
+				ctx.Set("key", "val")
+				ctx.Get("key")
+				ctx.UseScope("scope")
+				ctx.Scope()
+				ctx.UseRequestID("id")
+				ctx.RequestID()
+			})
+
+			if ctx == nil {
+				assert.Nil(t, ctx.Get("key"))
+				assert.Equal(t, "", ctx.RequestID())
+				return
+			}
+
+			assert.Equal(t, "val", ctx.Get("key"))
+			assert.Equal(t, "scope", ctx.Scope())
+			assert.Equal(t, "id", ctx.RequestID())
+
+			assert.NotPanics(t, func() {
+				ctx.Log.Info("logging")
+				ctx.Params.ByName("id")
+			})
+		})
+	}
+
+	t.Run("headers", func(t *testing.T) {
+		ctx := vk.NewCtx(nil, nil, nil)
+
+		assert.NotPanics(t, func() {
+			ctx.RespHeaders.Set("X-Test", "set")
+		})
+	})
+}
@@ -0,0 +1,183 @@
+package test_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+)
+
+func TestOpsGroup(t *testing.T) {
+	t.Setenv("VK_OPS_PREFIX", "/_ops/")
+	t.Setenv("VK_OPS_RELEASE", "v1.2.3")
+	t.Setenv("VK_OPS_HEALTH", "true")
+	t.Setenv("VK_OPS_READY", "true")
+	t.Setenv("VK_OPS_METRICS", "true")
+	t.Setenv("VK_OPS_VERSION", "true")
+	t.Setenv("VK_OPS_ROUTES", "true")
+
+	logs := &logCapture{}
+
+	server := vk.New(vk.UseAppName("orders"), vk.UseLogger(vlog.Default(vlog.Level(vlog.LogLevelDebug), vlog.WithWriter(logs))))
+
+	server.GET("/orders", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.RespondString(ctx.Context, w, "orders", http.StatusOK)
+	})
+
+	cfg := vk.OpsConfigFromOptions(server.Options())
+	cfg.Metrics = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the route info can only be appended to uncompressed text
+		if r.Header.Get("Accept-Encoding") != "" || r.Header.Get("Accept") != "text/plain" {
+			w.WriteHeader(http.StatusNotAcceptable)
+			return
+		}
+
+		_, _ = w.Write([]byte("requests_total 1\n"))
+	})
+	cfg.Routes = server.Routes
+	cfg.Guard = vk.Named("ops-token", func(inner vk.HandlerFunc) vk.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+			if r.Header.Get("X-Ops-Token") != "secret" {
+				return vk.E(http.StatusForbidden, "forbidden")
+			}
+
+			return inner(w, r, ctx)
+		}
+	})
+
+	server.AddGroup(vk.OpsGroup(cfg))
+	require.NoError(t, server.TestStart())
+
+	do := func(path string, token bool) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		if token {
+			r.Header.Set("X-Ops-Token", "secret")
+		}
+
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+
+		return w
+	}
+
+	t.Run("enabled endpoints only", func(t *testing.T) {
+		var ops []string
+		for _, r := range server.Routes() {
+			if r.Ops {
+				ops = append(ops, r.Method+" "+r.Path)
+			}
+		}
+
+		sort.Strings(ops)
+
+		// vars wasn't enabled
+		assert.Equal(t, []string{
+			"GET /_ops/health",
+			"GET /_ops/metrics",
+			"GET /_ops/ready",
+			"GET /_ops/routes",
+			"GET /_ops/version",
+		}, ops)
+
+		for _, path := range []string{"/_ops/vars", "/-/health", "/health", "/ready", "/metrics", "/version", "/routes"} {
+			assert.Equal(t, http.StatusNotFound, do(path, true).Code, path)
+		}
+	})
+
+	t.Run("guarded", func(t *testing.T) {
+		assert.Equal(t, http.StatusForbidden, do("/_ops/health", false).Code)
+		assert.Equal(t, http.StatusOK, do("/orders", false).Code)
+	})
+
+	t.Run("responses", func(t *testing.T) {
+		w := do("/_ops/health", true)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		w = do("/_ops/ready", true)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `"ready":true`)
+
+		r := httptest.NewRequest(http.MethodGet, "/_ops/metrics", nil)
+		r.Header.Set("X-Ops-Token", "secret")
+		r.Header.Set("Accept-Encoding", "gzip")
+
+		w = httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, `requests_total 1
+# HELP vk_route_info The routes served by the application.
+# TYPE vk_route_info gauge
+vk_route_info{method="GET",path="/orders",name="orders",domain="default"} 1
+`, w.Body.String(), "the route info of the serving router follows the metrics")
+
+		var version vk.OpsVersion
+		require.NoError(t, json.Unmarshal(do("/_ops/version", true).Body.Bytes(), &version))
+		assert.Equal(t, "orders", version.App)
+		assert.Equal(t, "v1.2.3", version.Version)
+		assert.True(t, strings.HasPrefix(version.Go, "go"))
+
+		var routes []vk.RouteInfo
+		require.NoError(t, json.Unmarshal(do("/_ops/routes", true).Body.Bytes(), &routes))
+		assert.Len(t, routes, 6)
+	})
+
+	t.Run("logged quietly", func(t *testing.T) {
+		levels := map[string]string{}
+
+		for _, m := range logs.messages() {
+			if level, line, ok := strings.Cut(m, " "); ok && strings.Contains(line, " completed ") {
+				levels[strings.Fields(line)[1]] = level
+			}
+		}
+
+		assert.Equal(t, "(I)", levels["/orders"])
+		assert.Equal(t, "(D)", levels["/_ops/health"])
+		assert.Equal(t, "(D)", levels["/_ops/metrics"])
+	})
+}
+
+func TestOpsGroupDefaults(t *testing.T) {
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+
+	server.AddGroup(vk.OpsGroup(vk.OpsConfig{OpsOptions: vk.OpsOptions{EnableVars: true, EnableMetrics: true, EnableRoutes: true}}))
+	require.NoError(t, server.TestStart())
+
+	// routes has nothing to serve, and metrics only the route info
+	routes := server.Routes()
+	require.Len(t, routes, 2)
+	assert.Equal(t, "/-/metrics", routes[0].Path)
+	assert.Equal(t, "/-/vars", routes[1].Path)
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/-/vars", nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "memstats")
+
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/-/metrics", nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "# HELP vk_route_info The routes served by the application.\n# TYPE vk_route_info gauge\n", w.Body.String(), "ops routes are left out")
+}
+
+func TestOpsOptionsValidate(t *testing.T) {
+	t.Setenv("VK_OPS_PREFIX", "ops")
+	t.Setenv("VK_OPS_HEALTHZ", "true")
+
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+
+	err := server.Options().Validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "unknown setting VK_OPS_HEALTHZ")
+	assert.Contains(t, err.Error(), `Ops: prefix "ops" must start with /`)
+}
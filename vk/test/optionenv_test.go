@@ -0,0 +1,104 @@
+package test_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+)
+
+func TestCommonEnvPrefix(t *testing.T) {
+	dir := t.TempDir()
+
+	t.Setenv("VKT_COMMON_APP_NAME", "shop")
+	t.Setenv("VKT_COMMON_HTTP_PORT", "8080")
+	t.Setenv("VKT_COMMON_LOG_LEVEL", "error")
+	t.Setenv("VKT_COMMON_LOG_FILE", filepath.Join(dir, "common.log"))
+	t.Setenv("VKT_COMMON_BODY_MAX_BYTES", "1024")
+
+	t.Setenv("VKT_PUBLIC_LOG_LEVEL", "debug")
+	t.Setenv("VKT_PUBLIC_LOG_FILE", filepath.Join(dir, "public.log"))
+	t.Setenv("VKT_ADMIN_HTTP_PORT", "9090")
+
+	public := vk.New(vk.UseEnvPrefix("VKT_PUBLIC"), vk.UseCommonEnvPrefix("VKT_COMMON"), vk.UseStrictEnv())
+	admin := vk.New(vk.UseEnvPrefix("VKT_ADMIN"), vk.UseCommonEnvPrefix("VKT_COMMON"), vk.UseStrictEnv())
+
+	t.Run("layering", func(t *testing.T) {
+		assert.Equal(t, "shop", public.Options().AppName)
+		assert.Equal(t, "shop", admin.Options().AppName)
+
+		assert.Equal(t, 8080, public.Options().HTTPPort, "common variables should apply")
+		assert.Equal(t, 9090, admin.Options().HTTPPort, "the server's own variables should take precedence")
+
+		assert.Equal(t, int64(1024), admin.Options().Body.MaxBytes, "common sections should apply")
+	})
+
+	t.Run("logging", func(t *testing.T) {
+		public.Options().Logger.Debug("public debug")
+		admin.Options().Logger.Debug("admin debug")
+		admin.Options().Logger.ErrorString("admin error")
+
+		publicLog, err := os.ReadFile(filepath.Join(dir, "public.log"))
+		require.NoError(t, err)
+		assert.Contains(t, string(publicLog), "public debug")
+
+		commonLog, err := os.ReadFile(filepath.Join(dir, "common.log"))
+		require.NoError(t, err)
+		assert.Contains(t, string(commonLog), "admin error")
+		assert.NotContains(t, string(commonLog), "admin debug", "the common log level should apply")
+	})
+
+	t.Run("no cross-wiring", func(t *testing.T) {
+		assert.NoError(t, public.Options().Validate())
+		assert.NoError(t, admin.Options().Validate())
+	})
+}
+
+func TestUnknownEnv(t *testing.T) {
+	t.Setenv("VKU_HTTP_PRT", "8080")
+	t.Setenv("VKU_SOMETHING_ELSE", "true")
+	t.Setenv("VKU_INTERNAL_HTTP_PORT", "9000")
+
+	// a server with a longer prefix claims its own variables
+	internal := vk.New(vk.UseLogger(vlog.Noop()), vk.UseEnvPrefix("VKU_INTERNAL"), vk.UseStrictEnv())
+	assert.Equal(t, 9000, internal.Options().HTTPPort)
+
+	t.Run("warning by default", func(t *testing.T) {
+		logs := &logCapture{}
+
+		server := vk.New(vk.UseEnvPrefix("VKU"), vk.UseLogger(vlog.Default(vlog.Level(vlog.LogLevelWarn), vlog.WithWriter(logs))))
+		require.NoError(t, server.TestStart())
+
+		warnings := strings.Join(logs.messages(), "\n")
+		assert.Contains(t, warnings, "unknown setting VKU_HTTP_PRT (did you mean VKU_HTTP_PORT?)")
+		assert.Contains(t, warnings, "unknown setting VKU_SOMETHING_ELSE")
+		assert.NotContains(t, warnings, "VKU_INTERNAL_HTTP_PORT")
+	})
+
+	t.Run("error in strict mode", func(t *testing.T) {
+		server := vk.New(vk.UseEnvPrefix("VKU"), vk.UseLogger(vlog.Noop()), vk.UseStrictEnv())
+
+		err := server.TestStart()
+		require.Error(t, err)
+
+		var optsErr vk.OptionsError
+		require.ErrorAs(t, err, &optsErr)
+		assert.Equal(t, []string{
+			"unknown setting VKU_HTTP_PRT (did you mean VKU_HTTP_PORT?)",
+			"unknown setting VKU_SOMETHING_ELSE",
+		}, optsErr.Problems)
+	})
+
+	t.Run("strict from the environment", func(t *testing.T) {
+		t.Setenv("VKU_STRICT_ENV", "true")
+
+		server := vk.New(vk.UseEnvPrefix("VKU"), vk.UseLogger(vlog.Noop()))
+		assert.Error(t, server.TestStart())
+	})
+}
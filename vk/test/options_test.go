@@ -0,0 +1,172 @@
+package test_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+	"github.com/suborbital/vektor/vtest"
+)
+
+func TestAllowRespectsRouteState(t *testing.T) {
+	logger := vlog.Default(vlog.Level(vlog.LogLevelError))
+
+	server := vk.New(vk.UseLogger(logger))
+
+	handler := func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.RespondString(ctx.Context, w, r.Method, http.StatusOK)
+	}
+
+	public := vk.Group("")
+	public.GET("/items/:id", handler)
+
+	beta := vk.Group("").WithFlag("beta")
+	beta.PUT("/items/:id", handler)
+
+	admin := vk.Group("")
+	admin.DELETE("/items/:id", handler)
+
+	server.AddGroup(public)
+	server.AddGroup(beta)
+	server.AddGroup(admin)
+
+	vt := vtest.New(server)
+
+	do := func(t *testing.T, method, path string) *vtest.Response {
+		r, err := http.NewRequest(method, path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return vt.Do(r, t)
+	}
+
+	t.Run("flag off", func(t *testing.T) {
+		do(t, http.MethodOptions, "/items/1").
+			AssertStatus(http.StatusOK).
+			AssertHeader("Allow", "DELETE, GET, OPTIONS")
+
+		do(t, http.MethodPut, "/items/1").
+			AssertStatus(http.StatusMethodNotAllowed).
+			AssertHeader("Allow", "DELETE, GET, OPTIONS")
+
+		do(t, http.MethodOptions, "*").
+			AssertHeader("Allow", "DELETE, GET, OPTIONS")
+	})
+
+	server.SetFlag("beta", true)
+
+	t.Run("flag on", func(t *testing.T) {
+		do(t, http.MethodOptions, "/items/1").
+			AssertHeader("Allow", "DELETE, GET, OPTIONS, PUT")
+
+		do(t, http.MethodPut, "/items/1").
+			AssertStatus(http.StatusOK).
+			AssertBodyString(http.MethodPut)
+
+		do(t, http.MethodOptions, "*").
+			AssertHeader("Allow", "DELETE, GET, OPTIONS, PUT")
+	})
+
+	admin.Disable()
+
+	t.Run("group disabled", func(t *testing.T) {
+		do(t, http.MethodOptions, "/items/1").
+			AssertHeader("Allow", "GET, OPTIONS, PUT")
+
+		do(t, http.MethodDelete, "/items/1").
+			AssertStatus(http.StatusMethodNotAllowed).
+			AssertHeader("Allow", "GET, OPTIONS, PUT")
+
+		if server.CanHandle(http.MethodDelete, "/items/1") {
+			t.Error("CanHandle should be false for a disabled route")
+		}
+	})
+
+	admin.Enable()
+	public.Disable()
+	server.SetFlag("beta", false)
+
+	t.Run("all disabled but one", func(t *testing.T) {
+		do(t, http.MethodOptions, "/items/1").
+			AssertHeader("Allow", "DELETE, OPTIONS")
+
+		do(t, http.MethodDelete, "/items/1").
+			AssertStatus(http.StatusOK)
+	})
+
+	admin.Disable()
+
+	t.Run("all disabled", func(t *testing.T) {
+		do(t, http.MethodGet, "/items/1").
+			AssertStatus(http.StatusNotFound)
+	})
+}
+
+func TestAllowRouteStatePerServer(t *testing.T) {
+	logger := vlog.Default(vlog.Level(vlog.LogLevelError))
+
+	handler := func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.RespondString(ctx.Context, w, r.Method, http.StatusOK)
+	}
+
+	public := vk.Group("")
+	public.GET("/items/:id", handler)
+
+	beta := vk.Group("").WithFlag("beta")
+	beta.PUT("/items/:id", handler)
+
+	first := vk.New(vk.UseLogger(logger))
+	first.AddGroup(public)
+	first.AddGroup(beta)
+
+	admin := vk.Group("")
+	admin.DELETE("/items/:id", handler)
+
+	second := vk.New(vk.UseLogger(logger))
+	second.AddGroup(admin)
+	second.AddGroup(beta)
+
+	firstVT, secondVT := vtest.New(first), vtest.New(second)
+
+	allow := func(t *testing.T, vt *vtest.VTest, expected string) {
+		r, err := http.NewRequest(http.MethodOptions, "/items/1", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		vt.Do(r, t).AssertHeader("Allow", expected)
+	}
+
+	// compute and cache the Allow values of both servers
+	allow(t, firstVT, "GET, OPTIONS")
+	allow(t, secondVT, "DELETE, OPTIONS")
+
+	t.Run("flag set on one server", func(t *testing.T) {
+		second.SetFlag("beta", true)
+
+		allow(t, firstVT, "GET, OPTIONS")
+		allow(t, secondVT, "DELETE, OPTIONS, PUT")
+	})
+
+	t.Run("group disabled on one server", func(t *testing.T) {
+		admin.Disable()
+
+		allow(t, firstVT, "GET, OPTIONS")
+		allow(t, secondVT, "OPTIONS, PUT")
+	})
+
+	t.Run("shared group disabled", func(t *testing.T) {
+		first.SetFlag("beta", true)
+		allow(t, firstVT, "GET, OPTIONS, PUT")
+
+		admin.Enable()
+		allow(t, secondVT, "DELETE, OPTIONS, PUT")
+
+		beta.Disable()
+
+		allow(t, firstVT, "GET, OPTIONS")
+		allow(t, secondVT, "DELETE, OPTIONS")
+	})
+}
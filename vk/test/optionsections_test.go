@@ -0,0 +1,262 @@
+package test_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+)
+
+func TestOptionSectionsFromEnv(t *testing.T) {
+	cases := []struct {
+		name      string
+		env       map[string]string
+		cors      vk.CORSOptions
+		rateLimit vk.RateLimitOptions
+		body      vk.BodyOptions
+		problems  []string
+	}{
+		{
+			name: "unset",
+		},
+		{
+			name: "valid",
+			env: map[string]string{
+				"VK_CORS_ALLOWED_ORIGINS":   "https://a.example.com,https://b.example.com:8443",
+				"VK_CORS_ALLOWED_METHODS":   "GET,POST",
+				"VK_CORS_ALLOW_CREDENTIALS": "true",
+				"VK_CORS_MAX_AGE":           "10m",
+				"VK_RATELIMIT_RPS":          "2.5",
+				"VK_RATELIMIT_BURST":        "3",
+				"VK_BODY_MAX_BYTES":         "1024",
+			},
+			cors: vk.CORSOptions{
+				AllowedOrigins:   []string{"https://a.example.com", "https://b.example.com:8443"},
+				AllowedMethods:   []string{"GET", "POST"},
+				AllowCredentials: true,
+				MaxAge:           10 * time.Minute,
+			},
+			rateLimit: vk.RateLimitOptions{RPS: 2.5, Burst: 3},
+			body:      vk.BodyOptions{MaxBytes: 1024},
+		},
+		{
+			name: "invalid values",
+			env: map[string]string{
+				"VK_CORS_ALLOWED_ORIGINS":    "a.example.com,https://b.example.com/app",
+				"VK_CORS_ALLOWED_METHODS":    "GET,FETCH",
+				"VK_RATELIMIT_BURST":         "-1",
+				"VK_RATELIMIT_MAXCONCURRENT": "2",
+				"VK_BODY_MAX_BYTES":          "-5",
+			},
+			cors: vk.CORSOptions{
+				AllowedOrigins: []string{"a.example.com", "https://b.example.com/app"},
+				AllowedMethods: []string{"GET", "FETCH"},
+			},
+			rateLimit: vk.RateLimitOptions{Burst: -1},
+			body:      vk.BodyOptions{MaxBytes: -5},
+			problems: []string{
+				"unknown setting VK_RATELIMIT_MAXCONCURRENT",
+				`CORS: invalid allowed origin "a.example.com"`,
+				`CORS: invalid allowed origin "https://b.example.com/app"`,
+				`CORS: unknown allowed method "FETCH"`,
+				"RateLimit: burst cannot be negative",
+				"Body: max bytes cannot be negative",
+			},
+		},
+		{
+			name: "autocert disabled without certificates",
+			env: map[string]string{
+				"VK_DOMAIN":           "example.com",
+				"VK_DISABLE_AUTOCERT": "true",
+			},
+			problems: []string{"autocert is disabled"},
+		},
+		{
+			name: "unparseable",
+			env: map[string]string{
+				"VK_RATELIMIT_RPS": "fast",
+			},
+			problems: []string{"RPS"},
+		},
+		{
+			name: "unparseable sections",
+			env: map[string]string{
+				"VK_CORS_ALLOWED_ORIGINS": "https://a.example.com",
+				"VK_HTTP_PORT":            "eighty",
+				"VK_RATELIMIT_RPS":        "fast",
+				"VK_BODY_MAX_BYTES":       "1KB",
+			},
+			cors:     vk.CORSOptions{AllowedOrigins: []string{"https://a.example.com"}},
+			problems: []string{"HTTPPort", "RPS", "MaxBytes"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			for k, v := range c.env {
+				t.Setenv(k, v)
+			}
+
+			server := vk.New(vk.UseLogger(vlog.Noop()))
+
+			opts := server.Options()
+			assert.Equal(t, c.cors, opts.CORS)
+			assert.Equal(t, c.rateLimit, opts.RateLimit)
+			assert.Equal(t, c.body, opts.Body)
+
+			err := server.TestStart()
+			if len(c.problems) == 0 {
+				assert.NoError(t, err)
+				return
+			}
+
+			require.Error(t, err)
+
+			var optsErr vk.OptionsError
+			require.ErrorAs(t, err, &optsErr)
+			require.Len(t, optsErr.Problems, len(c.problems))
+
+			for i, p := range c.problems {
+				assert.Contains(t, optsErr.Problems[i], p)
+			}
+		})
+	}
+}
+
+func TestMiddlewareFromOptions(t *testing.T) {
+	t.Setenv("VK_CORS_ALLOWED_ORIGINS", "https://app.example.com")
+	t.Setenv("VK_CORS_ALLOWED_HEADERS", "Authorization,Content-Type")
+	t.Setenv("VK_CORS_MAX_AGE", "1h")
+	t.Setenv("VK_RATELIMIT_RPS", "0.001")
+	t.Setenv("VK_RATELIMIT_BURST", "4")
+	t.Setenv("VK_BODY_MAX_BYTES", "8")
+
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+	opts := server.Options()
+
+	// the first middleware is innermost, so oversized bodies are rejected before they use up the rate limit
+	g := vk.Group("/api").WithMiddlewares(vk.RateLimitFromOptions(opts), vk.CORSFromOptions(opts), vk.BodyLimitFromOptions(opts))
+
+	ok := func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.RespondString(ctx.Context, w, "ok", http.StatusOK)
+	}
+
+	g.POST("/orders", ok)
+	g.OPTIONS("/orders", ok)
+
+	server.AddGroup(g)
+	require.NoError(t, server.TestStart())
+
+	do := func(method, origin, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/api/orders", strings.NewReader(body))
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+
+		if method == http.MethodOptions {
+			r.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		}
+
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+
+		return w
+	}
+
+	w := do(http.MethodPost, "https://app.example.com", "{}")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "https://app.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+
+	w = do(http.MethodOptions, "https://app.example.com", "")
+	assert.Equal(t, "POST", w.Header().Get("Access-Control-Allow-Methods"))
+	assert.Equal(t, "Authorization, Content-Type", w.Header().Get("Access-Control-Allow-Headers"))
+	assert.Equal(t, "3600", w.Header().Get("Access-Control-Max-Age"))
+
+	w = do(http.MethodPost, "https://evil.example.com", "{}")
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+
+	w = do(http.MethodPost, "", `{"too":"large"}`)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+	w = do(http.MethodPost, "", "{}")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = do(http.MethodPost, "", "{}")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+}
+
+func TestCORSMiddlewarePreflight(t *testing.T) {
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+
+	ok := func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.RespondString(ctx.Context, w, "ok", http.StatusOK)
+	}
+
+	api := vk.Group("/api").WithMiddlewares(vk.CORSMiddleware(vk.CORSOptions{
+		AllowedOrigins: []string{"https://app.example.com"},
+		AllowedHeaders: []string{"Authorization"},
+		MaxAge:         time.Hour,
+	}))
+	api.POST("/orders/:id", ok)
+
+	internal := vk.Group("/internal")
+	internal.POST("/orders", ok)
+
+	server.AddGroup(api)
+	server.AddGroup(internal)
+	require.NoError(t, server.TestStart())
+
+	preflight := func(path, origin string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodOptions, path, nil)
+		r.Header.Set("Origin", origin)
+		r.Header.Set("Access-Control-Request-Method", http.MethodPost)
+
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+
+		return w
+	}
+
+	t.Run("allowed origin", func(t *testing.T) {
+		w := preflight("/api/orders/1", "https://app.example.com")
+
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.Equal(t, "OPTIONS, POST", w.Header().Get("Allow"))
+		assert.Equal(t, "https://app.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+		assert.Equal(t, "POST", w.Header().Get("Access-Control-Allow-Methods"))
+		assert.Equal(t, "Authorization", w.Header().Get("Access-Control-Allow-Headers"))
+		assert.Equal(t, "3600", w.Header().Get("Access-Control-Max-Age"))
+		assert.Equal(t, "Origin", w.Header().Get("Vary"))
+	})
+
+	t.Run("other origin", func(t *testing.T) {
+		w := preflight("/api/orders/1", "https://evil.example.com")
+
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+		assert.Empty(t, w.Header().Get("Access-Control-Allow-Methods"))
+	})
+
+	t.Run("route without CORS", func(t *testing.T) {
+		w := preflight("/internal/orders", "https://app.example.com")
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "OPTIONS, POST", w.Header().Get("Allow"))
+		assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+	})
+}
+
+func TestMiddlewareFromUnsetOptions(t *testing.T) {
+	opts := vk.New(vk.UseLogger(vlog.Noop())).Options()
+
+	assert.Nil(t, vk.CORSFromOptions(opts))
+	assert.Nil(t, vk.RateLimitFromOptions(opts))
+	assert.Nil(t, vk.BodyLimitFromOptions(opts))
+}
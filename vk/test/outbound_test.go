@@ -0,0 +1,220 @@
+package test_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+)
+
+func TestOutboundClient(t *testing.T) {
+	downstreamHeaders := make(chan http.Header, 1)
+	otherHeaders := make(chan http.Header, 1)
+
+	// other is a host that downstream redirects to
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		otherHeaders <- r.Header.Clone()
+		w.Write([]byte("other"))
+	}))
+	defer other.Close()
+
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/redirect":
+			http.Redirect(w, r, "/echo", http.StatusFound)
+		case "/away":
+			http.Redirect(w, r, other.URL+"/echo", http.StatusFound)
+		case "/slow":
+			// holds the call open until it is cancelled
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+		case "/fail":
+			w.WriteHeader(http.StatusBadGateway)
+		default:
+			downstreamHeaders <- r.Header.Clone()
+			w.Write([]byte("downstream"))
+		}
+	}))
+	defer downstream.Close()
+
+	downstreamURL, _ := url.Parse(downstream.URL)
+
+	server := vk.New(
+		vk.UseLogger(vlog.Noop()),
+		vk.UseHandlerTimeout(200*time.Millisecond, time.Second),
+	)
+
+	auth := vk.Named("auth", func(inner vk.HandlerFunc) vk.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+			ctx.Set(vk.ClaimsKey, map[string]interface{}{"sub": "user-1", "email": "alice@example.com"})
+
+			return inner(w, r, ctx)
+		}
+	})
+
+	claims := vk.ClaimsPropagation([]vk.ClaimRule{{Claim: "sub", Header: "X-User-ID"}})
+
+	type failure struct {
+		deadline bool
+		elapsed  time.Duration
+	}
+
+	// failures receives the calls that failed, since the handler's own deadline may have passed by then
+	failures := make(chan failure, 1)
+
+	// call proxies to the downstream path in the query, timing out after the duration in the query if set
+	call := func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		var opts []vk.OutboundOption
+		if timeout, err := time.ParseDuration(r.URL.Query().Get("timeout")); err == nil {
+			opts = append(opts, vk.OutboundTimeout(timeout))
+		}
+
+		req, _ := http.NewRequest(http.MethodGet, downstream.URL+r.URL.Query().Get("path"), nil)
+
+		ctx.RespHeaders.Set(vk.RequestIDHeader, ctx.RequestID())
+
+		start := time.Now()
+
+		resp, err := ctx.HTTPClient(opts...).Do(req)
+		if err != nil {
+			failures <- failure{errors.Is(err, context.DeadlineExceeded), time.Since(start)}
+			return err
+		}
+
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+
+		return vk.RespondString(ctx.Context, w, string(body), resp.StatusCode)
+	}
+
+	g := vk.Group("/api").WithMiddlewares(claims, auth)
+	g.GET("/call", call)
+
+	server.AddGroup(g)
+	server.RegisterAdmin(server.OutboundCalls())
+
+	require.NoError(t, server.TestStart())
+
+	do := func(query string, header http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/api/call?"+query, nil)
+		for key, values := range header {
+			r.Header[key] = values
+		}
+
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+
+		return w
+	}
+
+	t.Run("headers", func(t *testing.T) {
+		w := do("path=/echo", http.Header{
+			"Traceparent": {"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+			"X-User-Id":   {"spoofed"},
+		})
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "downstream", w.Body.String())
+
+		headers := <-downstreamHeaders
+		assert.Equal(t, w.Header().Get(vk.RequestIDHeader), headers.Get(vk.RequestIDHeader))
+		assert.Equal(t, []string{"user-1"}, headers.Values("X-User-ID"), "the client's header is replaced by the claim")
+		assert.Empty(t, headers.Get("X-Email"))
+
+		traceparent := strings.Split(headers.Get(vk.TraceparentHeader), "-")
+		require.Len(t, traceparent, 4)
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", traceparent[1], "the trace is continued")
+		assert.NotEqual(t, "00f067aa0ba902b7", traceparent[2], "the call has its own parent ID")
+	})
+
+	t.Run("no traceparent", func(t *testing.T) {
+		do("path=/echo", http.Header{"Traceparent": {"not-a-traceparent"}})
+
+		headers := <-downstreamHeaders
+		assert.Empty(t, headers.Get(vk.TraceparentHeader))
+		assert.NotEmpty(t, headers.Get(vk.RequestIDHeader), "a request ID is generated")
+	})
+
+	t.Run("capped by the request's deadline", func(t *testing.T) {
+		do("path=/slow&timeout=5s", nil)
+
+		f := <-failures
+		assert.True(t, f.deadline)
+		assert.Less(t, f.elapsed, time.Second, "the call shouldn't outlive the handler's timeout")
+	})
+
+	t.Run("per-call timeout", func(t *testing.T) {
+		do("path=/slow&timeout=20ms", nil)
+
+		f := <-failures
+		assert.True(t, f.deadline)
+		assert.Less(t, f.elapsed, 150*time.Millisecond)
+	})
+
+	t.Run("cancelled with the request", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		r := httptest.NewRequest(http.MethodGet, "/api/call?path=/slow", nil).WithContext(ctx)
+		w := httptest.NewRecorder()
+
+		time.AfterFunc(20*time.Millisecond, cancel)
+
+		server.ServeHTTP(w, r)
+
+		f := <-failures
+		assert.False(t, f.deadline)
+		assert.Less(t, f.elapsed, 150*time.Millisecond)
+	})
+
+	t.Run("stats", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadGateway, do("path=/fail", nil).Code)
+
+		stats := server.OutboundCalls().Stats()
+		require.Len(t, stats, 1)
+		assert.Equal(t, downstreamURL.Host, stats[0].Host)
+		assert.EqualValues(t, 6, stats[0].Calls)
+		assert.EqualValues(t, 4, stats[0].Errors, "three calls timed out or were cancelled, and one got a 5xx")
+		assert.Greater(t, stats[0].P99, time.Duration(0))
+
+		w := httptest.NewRecorder()
+		server.AdminRouter().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/outbound", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), downstreamURL.Host)
+	})
+
+	t.Run("redirected on the same host", func(t *testing.T) {
+		w := do("path=/redirect", nil)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		headers := <-downstreamHeaders
+		assert.Equal(t, w.Header().Get(vk.RequestIDHeader), headers.Get(vk.RequestIDHeader))
+		assert.Equal(t, "user-1", headers.Get("X-User-ID"))
+	})
+
+	t.Run("redirected to another host", func(t *testing.T) {
+		w := do("path=/away", http.Header{"Traceparent": {"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}})
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "other", w.Body.String())
+
+		headers := <-otherHeaders
+		assert.Empty(t, headers.Get(vk.RequestIDHeader))
+		assert.Empty(t, headers.Get("X-User-ID"))
+		assert.NotEmpty(t, headers.Get(vk.TraceparentHeader))
+	})
+}
@@ -0,0 +1,139 @@
+package test_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+	"github.com/suborbital/vektor/vtest"
+)
+
+func TestPanicFingerprints(t *testing.T) {
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+
+	server.GET("/nil", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		var m map[string]int
+		m["boom"] = 1
+
+		return nil
+	})
+	server.GET("/value", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		panic(errors.New("bad state"))
+	})
+
+	var lock sync.Mutex
+	var newPanics []vk.PanicReport
+
+	server.OnNewPanic(func(report vk.PanicReport) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		newPanics = append(newPanics, report)
+	})
+
+	vt := vtest.New(server)
+
+	for i := 0; i < 5; i++ {
+		r, _ := http.NewRequest(http.MethodGet, "/nil", nil)
+		vt.Do(r, t).AssertStatus(http.StatusInternalServerError)
+	}
+
+	r, _ := http.NewRequest(http.MethodGet, "/value", nil)
+	vt.Do(r, t).AssertStatus(http.StatusInternalServerError)
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	require.Len(t, newPanics, 2, "the hook should be called once per fingerprint")
+	assert.Equal(t, "runtime.plainError", newPanics[0].Type)
+	assert.Equal(t, "*errors.errorString", newPanics[1].Type)
+	assert.Equal(t, "bad state", newPanics[1].Message)
+	assert.NotEqual(t, newPanics[0].Fingerprint, newPanics[1].Fingerprint)
+	assert.NotEmpty(t, newPanics[0].Frames)
+
+	reports := server.Panics().Reports()
+	require.Len(t, reports, 2)
+
+	counts := map[string]int{}
+	for _, report := range reports {
+		counts[report.Fingerprint] = report.Count
+	}
+
+	assert.Equal(t, 5, counts[newPanics[0].Fingerprint])
+	assert.Equal(t, 1, counts[newPanics[1].Fingerprint])
+
+	// the most recently seen panic is first
+	assert.Equal(t, newPanics[1].Fingerprint, reports[0].Fingerprint)
+}
+
+func TestPanicSummary(t *testing.T) {
+	router := vk.NewRouter(vlog.Noop(), "")
+	router.GET("/panic", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		panic("again")
+	})
+
+	summaries := make(chan []vk.PanicReport, 10)
+	router.OnPanicSummary(10*time.Millisecond, func(reports []vk.PanicReport) {
+		summaries <- reports
+	})
+
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+	server.SwapRouter(router)
+
+	vt := vtest.New(server)
+	for i := 0; i < 3; i++ {
+		r, _ := http.NewRequest(http.MethodGet, "/panic", nil)
+		vt.Do(r, t).AssertStatus(http.StatusInternalServerError)
+	}
+
+	select {
+	case reports := <-summaries:
+		require.Len(t, reports, 1)
+		assert.Equal(t, 3, reports[0].Count)
+		assert.Equal(t, "again", reports[0].Message)
+	case <-time.After(time.Second):
+		t.Fatal("no summary")
+	}
+
+	// no further summaries without new panics
+	select {
+	case <-summaries:
+		t.Fatal("unexpected summary")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	admin := vk.NewRouter(vlog.Noop(), "")
+	server.Panics().RegisterAdmin(admin)
+
+	adminServer := vk.New(vk.UseLogger(vlog.Noop()))
+	adminServer.SwapRouter(admin)
+
+	r, _ := http.NewRequest(http.MethodGet, "/panics", nil)
+	resp := vtest.New(adminServer).Do(r, t).AssertStatus(http.StatusOK)
+
+	var reports []vk.PanicReport
+	require.NoError(t, json.Unmarshal(resp.Body, &reports))
+	require.Len(t, reports, 1)
+	assert.Equal(t, 3, reports[0].Count)
+
+	// summaries stop once the server shuts down
+	require.NoError(t, server.Stop())
+	time.Sleep(30 * time.Millisecond)
+
+	r, _ = http.NewRequest(http.MethodGet, "/panic", nil)
+	vt.Do(r, t).AssertStatus(http.StatusInternalServerError)
+
+	select {
+	case <-summaries:
+		t.Fatal("summary after shutdown")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
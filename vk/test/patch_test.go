@@ -0,0 +1,245 @@
+package test_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vtest"
+)
+
+type patchAddress struct {
+	City string `json:"city"`
+	Zip  string `json:"zip"`
+}
+
+type patchUser struct {
+	Name    string       `json:"name"`
+	Email   *string      `json:"email"`
+	Age     int          `json:"age"`
+	Tags    []string     `json:"tags"`
+	Address patchAddress `json:"address"`
+}
+
+type patchResult struct {
+	User    patchUser `json:"user"`
+	Fields  []string  `json:"fields"`
+	HasName bool      `json:"has_name"`
+	Cleared bool      `json:"cleared"`
+}
+
+func testPatchUser() patchUser {
+	email := "alice@example.com"
+
+	return patchUser{
+		Name:    "Alice",
+		Email:   &email,
+		Age:     30,
+		Tags:    []string{"a", "b"},
+		Address: patchAddress{City: "Paris", Zip: "75001"},
+	}
+}
+
+func patchServer() *vtest.VTest {
+	server := vk.New()
+
+	server.PATCH("/user", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		user := testPatchUser()
+
+		if err := ctx.ApplyPatch(&user); err != nil {
+			return err
+		}
+
+		result := patchResult{
+			User:    user,
+			Fields:  ctx.Patch().Fields(),
+			HasName: ctx.Patch().Has("name"),
+			Cleared: ctx.Patch().IsNull("email"),
+		}
+
+		return vk.RespondJSON(ctx.Context, w, result, http.StatusOK)
+	})
+
+	return vtest.New(server)
+}
+
+func doPatch(t *testing.T, vt *vtest.VTest, contentType, body string) *vtest.Response {
+	r, _ := http.NewRequest(http.MethodPatch, "/user", strings.NewReader(body))
+	r.Header.Set("Content-Type", contentType)
+
+	return vt.Do(r, t)
+}
+
+func TestApplyMergePatch(t *testing.T) {
+	vt := patchServer()
+
+	t.Run("null and absent", func(t *testing.T) {
+		resp := doPatch(t, vt, vk.MergePatchContentType, `{"email":null,"address":{"city":"Berlin"}}`)
+		resp.AssertStatus(http.StatusOK)
+
+		var result patchResult
+		require.NoError(t, json.Unmarshal(resp.Body, &result))
+
+		assert.Nil(t, result.User.Email)
+		assert.Equal(t, "Alice", result.User.Name)
+		assert.Equal(t, patchAddress{City: "Berlin", Zip: "75001"}, result.User.Address)
+		assert.Equal(t, []string{"address", "address.city", "email"}, result.Fields)
+		assert.False(t, result.HasName)
+		assert.True(t, result.Cleared)
+	})
+
+	t.Run("set", func(t *testing.T) {
+		resp := doPatch(t, vt, vk.MergePatchContentType+"; charset=utf-8", `{"name":"Bob","tags":["c"]}`)
+		resp.AssertStatus(http.StatusOK)
+
+		var result patchResult
+		require.NoError(t, json.Unmarshal(resp.Body, &result))
+
+		assert.Equal(t, "Bob", result.User.Name)
+		assert.Equal(t, []string{"c"}, result.User.Tags)
+		require.NotNil(t, result.User.Email)
+		assert.True(t, result.HasName)
+		assert.False(t, result.Cleared)
+	})
+
+	t.Run("wrong type", func(t *testing.T) {
+		resp := doPatch(t, vt, vk.MergePatchContentType, `{"age":"thirty"}`)
+		resp.AssertStatus(http.StatusUnprocessableEntity)
+	})
+
+	t.Run("unsupported content type", func(t *testing.T) {
+		resp := doPatch(t, vt, "application/json", `{"name":"Bob"}`)
+		resp.AssertStatus(http.StatusUnsupportedMediaType)
+
+		assert.Contains(t, resp.Headers.Get("Accept-Patch"), vk.MergePatchContentType)
+		assert.Contains(t, resp.Headers.Get("Accept-Patch"), vk.JSONPatchContentType)
+	})
+}
+
+func TestApplyJSONPatch(t *testing.T) {
+	vt := patchServer()
+
+	t.Run("arrays", func(t *testing.T) {
+		resp := doPatch(t, vt, vk.JSONPatchContentType, `[
+			{"op": "test", "path": "/age", "value": 30.0},
+			{"op": "add", "path": "/tags/1", "value": "x"},
+			{"op": "remove", "path": "/tags/0"},
+			{"op": "add", "path": "/tags/-", "value": "z"},
+			{"op": "move", "from": "/tags/0", "path": "/tags/-"},
+			{"op": "copy", "from": "/address/city", "path": "/name"},
+			{"op": "replace", "path": "/email", "value": null}
+		]`)
+		resp.AssertStatus(http.StatusOK)
+
+		var result patchResult
+		require.NoError(t, json.Unmarshal(resp.Body, &result))
+
+		assert.Equal(t, []string{"b", "z", "x"}, result.User.Tags)
+		assert.Equal(t, "Paris", result.User.Name)
+		assert.Nil(t, result.User.Email)
+		assert.Empty(t, result.Fields)
+	})
+
+	t.Run("escaped paths", func(t *testing.T) {
+		resp := doPatch(t, vt, vk.JSONPatchContentType, `[{"op": "test", "path": "/address/a~1b", "value": 1}]`)
+		resp.AssertStatus(http.StatusUnprocessableEntity)
+	})
+
+	t.Run("failed test is atomic", func(t *testing.T) {
+		resp := doPatch(t, vt, vk.JSONPatchContentType, `[
+			{"op": "replace", "path": "/name", "value": "Mallory"},
+			{"op": "test", "path": "/age", "value": 31}
+		]`)
+		resp.AssertStatus(http.StatusConflict)
+
+		assert.Contains(t, string(resp.Body), "operation 1")
+	})
+
+	t.Run("out of range", func(t *testing.T) {
+		resp := doPatch(t, vt, vk.JSONPatchContentType, `[{"op": "add", "path": "/tags/5", "value": "x"}]`)
+		resp.AssertStatus(http.StatusUnprocessableEntity)
+	})
+
+	t.Run("op limit", func(t *testing.T) {
+		ops := make([]string, vk.MaxJSONPatchOps+1)
+		for i := range ops {
+			ops[i] = fmt.Sprintf(`{"op": "add", "path": "/tags/-", "value": "%d"}`, i)
+		}
+
+		resp := doPatch(t, vt, vk.JSONPatchContentType, "["+strings.Join(ops, ",")+"]")
+		resp.AssertStatus(http.StatusRequestEntityTooLarge)
+
+		resp = doPatch(t, vt, vk.JSONPatchContentType, "["+strings.Join(ops[1:], ",")+"]")
+		resp.AssertStatus(http.StatusOK)
+	})
+}
+
+type patchAccount struct {
+	Name         string            `json:"name"`
+	Email        string            `json:"email"`
+	Labels       map[string]string `json:"labels"`
+	PasswordHash string            `json:"-"`
+	internal     int
+}
+
+func TestPatchKeepsHiddenFields(t *testing.T) {
+	server := vk.New()
+
+	server.PATCH("/account", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		account := patchAccount{
+			Name:         "a",
+			Email:        "a@x",
+			Labels:       map[string]string{"team": "core", "tier": "gold"},
+			PasswordHash: "secret",
+			internal:     7,
+		}
+
+		if err := ctx.ApplyPatch(&account); err != nil {
+			return err
+		}
+
+		return vk.RespondString(ctx.Context, w, fmt.Sprintf("%+v", account), http.StatusOK)
+	})
+
+	vt := vtest.New(server)
+
+	do := func(t *testing.T, contentType, body string) *vtest.Response {
+		r, _ := http.NewRequest(http.MethodPatch, "/account", strings.NewReader(body))
+		r.Header.Set("Content-Type", contentType)
+
+		return vt.Do(r, t)
+	}
+
+	t.Run("merge patch", func(t *testing.T) {
+		do(t, vk.MergePatchContentType, `{"name":"b"}`).
+			AssertStatus(http.StatusOK).
+			AssertBodyString("{Name:b Email:a@x Labels:map[team:core tier:gold] PasswordHash:secret internal:7}")
+	})
+
+	t.Run("merge patch removing fields", func(t *testing.T) {
+		do(t, vk.MergePatchContentType, `{"email":null,"labels":{"tier":null}}`).
+			AssertStatus(http.StatusOK).
+			AssertBodyString("{Name:a Email: Labels:map[team:core] PasswordHash:secret internal:7}")
+	})
+
+	t.Run("JSON patch", func(t *testing.T) {
+		do(t, vk.JSONPatchContentType, `[
+			{"op": "replace", "path": "/name", "value": "b"},
+			{"op": "remove", "path": "/labels/team"},
+			{"op": "remove", "path": "/email"}
+		]`).
+			AssertStatus(http.StatusOK).
+			AssertBodyString("{Name:b Email: Labels:map[tier:gold] PasswordHash:secret internal:7}")
+	})
+
+	t.Run("invalid patched document", func(t *testing.T) {
+		do(t, vk.JSONPatchContentType, `[{"op": "replace", "path": "/name", "value": 1}]`).
+			AssertStatus(http.StatusUnprocessableEntity)
+	})
+}
@@ -0,0 +1,130 @@
+package test_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+	"github.com/suborbital/vektor/vtest"
+)
+
+// slowAuth takes longer than its phase's budget, returning the error of its context if it is cancelled first
+func slowAuth(delay time.Duration) vk.Middleware {
+	return func(inner vk.HandlerFunc) vk.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+			if _, ok := ctx.Deadline(); !ok {
+				return vk.E(http.StatusInternalServerError, "the auth phase should have a deadline")
+			}
+
+			time.Sleep(delay)
+
+			return inner(w, r.WithContext(context.WithValue(r.Context(), ctxKeyUser{}, "ada")), ctx)
+		}
+	}
+}
+
+type ctxKeyUser struct{}
+
+func phasesServer(timings *[]vk.PhaseTiming, overrun vk.PhaseOverrun) *vk.Server {
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+
+	api := vk.Group("").WithMiddlewares(
+		vk.PhaseBudget("handler", 0),
+		slowAuth(40*time.Millisecond),
+		vk.PhaseBudget("auth", 20*time.Millisecond, vk.OnPhaseOverrun(overrun)),
+		func(inner vk.HandlerFunc) vk.HandlerFunc {
+			return func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+				err := inner(w, r, ctx)
+				*timings = ctx.PhaseTimings()
+
+				return err
+			}
+		},
+	)
+
+	api.GET("/users/me", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		if _, ok := ctx.Deadline(); ok {
+			return vk.E(http.StatusInternalServerError, "the handler shouldn't have the auth phase's deadline")
+		}
+
+		if _, ok := r.Context().Deadline(); ok {
+			return vk.E(http.StatusInternalServerError, "the request shouldn't have the auth phase's deadline")
+		}
+
+		return vk.RespondString(ctx.Context, w, r.Context().Value(ctxKeyUser{}).(string), http.StatusOK)
+	})
+
+	server.AddGroup(api)
+
+	return server
+}
+
+func TestPhaseBudgetTimeout(t *testing.T) {
+	var timings []vk.PhaseTiming
+	vt := vtest.New(phasesServer(&timings, vk.PhaseTimeout))
+
+	r, _ := http.NewRequest(http.MethodGet, "/users/me", nil)
+	vt.Do(r, t).AssertStatus(http.StatusGatewayTimeout)
+
+	if assert.Len(t, timings, 1) {
+		assert.Equal(t, "auth", timings[0].Name)
+		assert.Equal(t, 20*time.Millisecond, timings[0].Budget)
+		assert.GreaterOrEqual(t, timings[0].Elapsed, 40*time.Millisecond)
+		assert.True(t, timings[0].Overrun)
+	}
+}
+
+func TestPhaseBudgetWarn(t *testing.T) {
+	var timings []vk.PhaseTiming
+	vt := vtest.New(phasesServer(&timings, vk.PhaseWarn))
+
+	r, _ := http.NewRequest(http.MethodGet, "/users/me", nil)
+	vt.Do(r, t).AssertStatus(http.StatusOK).AssertBodyString("ada")
+
+	if assert.Len(t, timings, 2) {
+		assert.Equal(t, "auth", timings[0].Name)
+		assert.GreaterOrEqual(t, timings[0].Elapsed, 40*time.Millisecond)
+		assert.True(t, timings[0].Overrun)
+
+		assert.Equal(t, "handler", timings[1].Name)
+		assert.Equal(t, time.Duration(0), timings[1].Budget)
+		assert.False(t, timings[1].Overrun)
+	}
+}
+
+func TestPhaseBudgetNeverExtendsDeadline(t *testing.T) {
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+
+	api := vk.Group("").WithMiddlewares(
+		vk.PhaseBudget("slow", time.Hour),
+		func(inner vk.HandlerFunc) vk.HandlerFunc {
+			return func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+				reqCtx, cancel := context.WithTimeout(r.Context(), time.Second)
+				defer cancel()
+
+				return inner(w, r.WithContext(reqCtx), ctx)
+			}
+		},
+	)
+
+	api.GET("/deadline", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		deadline, ok := r.Context().Deadline()
+		if !ok || time.Until(deadline) > time.Second {
+			return vk.E(http.StatusInternalServerError, "the phase extended the request's deadline")
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+
+		return nil
+	})
+
+	server.AddGroup(api)
+
+	r, _ := http.NewRequest(http.MethodGet, "/deadline", nil)
+	vtest.New(server).Do(r, t).AssertStatus(http.StatusNoContent)
+}
@@ -0,0 +1,72 @@
+package test_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+	"github.com/suborbital/vektor/vtest"
+)
+
+func TestPreconditions(t *testing.T) {
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+
+	// the stored resource is at version "v2", and /missing doesn't exist
+	update := func(current string) vk.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+			if err := ctx.CheckPrecondition(current); err != nil {
+				return err
+			}
+
+			return vk.RespondString(ctx.Context, w, "updated", http.StatusOK)
+		}
+	}
+
+	g := vk.Group("")
+	g.PUT("/required", update(`"v2"`), vk.PreconditionMiddleware(true))
+	g.GET("/required", update(`"v2"`), vk.PreconditionMiddleware(true))
+	g.PATCH("/optional", update(`"v2"`), vk.PreconditionMiddleware(false))
+	g.PUT("/missing", update(""), vk.PreconditionMiddleware(false))
+	server.AddGroup(g)
+
+	vt := vtest.New(server)
+
+	cases := map[string]struct {
+		method  string
+		path    string
+		ifMatch []string
+		status  int
+		etag    string
+	}{
+		"required missing":    {http.MethodPut, "/required", nil, http.StatusPreconditionRequired, ""},
+		"required read":       {http.MethodGet, "/required", nil, http.StatusOK, ""},
+		"optional missing":    {http.MethodPatch, "/optional", nil, http.StatusOK, ""},
+		"match":               {http.MethodPut, "/required", []string{`"v2"`}, http.StatusOK, ""},
+		"mismatch":            {http.MethodPut, "/required", []string{`"v1"`}, http.StatusPreconditionFailed, `"v2"`},
+		"list":                {http.MethodPatch, "/optional", []string{`"v1", "v2"`}, http.StatusOK, ""},
+		"repeated headers":    {http.MethodPatch, "/optional", []string{`"v1"`, `"v2"`}, http.StatusOK, ""},
+		"star":                {http.MethodPut, "/required", []string{"*"}, http.StatusOK, ""},
+		"star without entity": {http.MethodPut, "/missing", []string{"*"}, http.StatusPreconditionFailed, ""},
+		"weak":                {http.MethodPut, "/required", []string{`W/"v2"`}, http.StatusPreconditionFailed, `"v2"`},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			r, err := http.NewRequest(c.method, c.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, v := range c.ifMatch {
+				r.Header.Add("If-Match", v)
+			}
+
+			resp := vt.Do(r, t).AssertStatus(c.status)
+
+			if c.etag != "" {
+				resp.AssertHeader("ETag", c.etag)
+			}
+		})
+	}
+}
@@ -0,0 +1,209 @@
+package test_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+)
+
+func preflightServer(opts ...vk.OptionsModifier) *vk.Server {
+	server := vk.New(append([]vk.OptionsModifier{vk.UseLogger(vlog.Noop())}, opts...)...)
+
+	ok := func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.RespondString(ctx.Context, w, "ok", http.StatusOK)
+	}
+
+	server.GET("/users/:id", ok)
+	server.PUT("/users/:id", ok)
+	server.POST("/users", ok)
+
+	server.OPTIONS("/custom", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.RespondString(ctx.Context, w, "custom", http.StatusOK)
+	})
+	server.DELETE("/custom", ok)
+
+	return server
+}
+
+func preflight(server http.Handler, path string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodOptions, path, nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Access-Control-Request-Method", http.MethodPut)
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, req)
+
+	return w
+}
+
+func TestPreflightDisabled(t *testing.T) {
+	server := preflightServer()
+	require.NoError(t, server.TestStart())
+
+	w := preflight(server, "/users/42")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"), "preflight requests should not be answered by default")
+}
+
+func TestPreflight(t *testing.T) {
+	server := preflightServer()
+	server.EnableCORS("*", vk.CORSMaxAge(10*time.Minute), vk.CORSAllowHeaders("X-Tenant"))
+
+	require.NoError(t, server.TestStart())
+
+	t.Run("route with params", func(t *testing.T) {
+		w := preflight(server, "/users/42")
+
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.Equal(t, "GET, OPTIONS, PUT", w.Header().Get("Access-Control-Allow-Methods"))
+		assert.Equal(t, "*", w.Header().Get("Access-Control-Allow-Origin"))
+		assert.Equal(t, "600", w.Header().Get("Access-Control-Max-Age"))
+		assert.Contains(t, w.Header().Get("Access-Control-Allow-Headers"), "Authorization")
+		assert.Contains(t, w.Header().Get("Access-Control-Allow-Headers"), "X-Tenant")
+		assert.Empty(t, w.Header().Get("Access-Control-Allow-Credentials"))
+	})
+
+	t.Run("other path", func(t *testing.T) {
+		w := preflight(server, "/users")
+
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.Equal(t, "OPTIONS, POST", w.Header().Get("Access-Control-Allow-Methods"))
+	})
+
+	t.Run("explicit handler", func(t *testing.T) {
+		w := preflight(server, "/custom")
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "custom", w.Body.String())
+	})
+
+	t.Run("unknown path", func(t *testing.T) {
+		w := preflight(server, "/nothing/here")
+
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("routed response", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/users/42", nil)
+		req.Header.Set("Origin", "https://app.example.com")
+
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "*", w.Header().Get("Access-Control-Allow-Origin"))
+		assert.Equal(t, "Origin", w.Header().Get("Vary"))
+	})
+}
+
+func TestPreflightCredentials(t *testing.T) {
+	server := preflightServer()
+	server.EnableCORS("*", vk.CORSAllowCredentials())
+
+	require.NoError(t, server.TestStart())
+
+	w := preflight(server, "/users/42")
+
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "https://app.example.com", w.Header().Get("Access-Control-Allow-Origin"), "the origin should be echoed with credentials")
+	assert.Equal(t, "true", w.Header().Get("Access-Control-Allow-Credentials"))
+}
+
+func TestPreflightBeforeFallback(t *testing.T) {
+	var proxied int32
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&proxied, 1)
+	}))
+	defer upstream.Close()
+
+	server := preflightServer(vk.UseFallbackAddress(upstream.URL))
+	server.EnableCORS("https://app.example.com")
+
+	require.NoError(t, server.TestStart())
+
+	w := preflight(server, "/users/42")
+
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "https://app.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Zero(t, atomic.LoadInt32(&proxied), "preflight requests for routed paths should not be proxied")
+
+	preflight(server, "/legacy")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&proxied), "other paths should still be proxied")
+}
+
+func TestPreflightFromOptions(t *testing.T) {
+	server := preflightServer(vk.UseCORS(vk.CORSOptions{
+		AllowedOrigins: []string{"https://app.example.com"},
+		AllowedMethods: []string{http.MethodGet, http.MethodPost},
+		MaxAge:         time.Hour,
+		Preflight:      true,
+	}))
+
+	require.NoError(t, server.TestStart())
+
+	t.Run("allowed methods", func(t *testing.T) {
+		w := preflight(server, "/users/42")
+
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.Equal(t, "GET, OPTIONS, PUT", w.Header().Get("Allow"))
+		assert.Equal(t, "GET, OPTIONS", w.Header().Get("Access-Control-Allow-Methods"), "PUT isn't an allowed method")
+		assert.Equal(t, "https://app.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+		assert.Equal(t, "3600", w.Header().Get("Access-Control-Max-Age"))
+		assert.Contains(t, w.Header().Get("Access-Control-Allow-Headers"), "Authorization")
+	})
+
+	t.Run("other origin", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/users/42", nil)
+		req.Header.Set("Origin", "https://evil.example.com")
+
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+	})
+
+	t.Run("swapped router", func(t *testing.T) {
+		router := vk.NewRouter(vlog.Noop(), "")
+		router.GET("/orders/:id", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+			return vk.RespondString(ctx.Context, w, "ok", http.StatusOK)
+		})
+
+		server.SwapRouter(router)
+
+		w := preflight(server, "/orders/1")
+
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.Equal(t, "GET, OPTIONS", w.Header().Get("Access-Control-Allow-Methods"))
+		assert.Equal(t, "https://app.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	})
+}
+
+func TestPreflightEnabledSwapRouter(t *testing.T) {
+	server := preflightServer()
+	server.EnableCORS("*")
+
+	require.NoError(t, server.TestStart())
+
+	router := vk.NewRouter(vlog.Noop(), "")
+	router.PUT("/orders/:id", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.RespondString(ctx.Context, w, "ok", http.StatusOK)
+	})
+
+	server.SwapRouter(router)
+
+	w := preflight(server, "/orders/1")
+
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "OPTIONS, PUT", w.Header().Get("Access-Control-Allow-Methods"))
+	assert.Equal(t, "*", w.Header().Get("Access-Control-Allow-Origin"))
+}
@@ -0,0 +1,76 @@
+package test_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+	"github.com/suborbital/vektor/vtest"
+)
+
+type tenantKey struct{}
+
+// tenantOf stands in for a database layer that only has the context
+func tenantOf(c context.Context) string {
+	tenant, _ := c.Value(tenantKey{}).(string)
+	return tenant
+}
+
+func TestPropagateToContext(t *testing.T) {
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+	server.PropagateToContext(tenantKey{}, func(ctx *vk.Ctx) interface{} {
+		return ctx.Get("tenant")
+	})
+
+	tenantMiddleware := vk.Named("tenant", func(inner vk.HandlerFunc) vk.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+			ctx.Set("tenant", r.Header.Get("X-Tenant"))
+			return inner(w, r, ctx)
+		}
+	})
+
+	g := vk.Group("").WithMiddlewares(tenantMiddleware)
+	g.GET("/orders", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		if vk.RequestIDFromContext(r.Context()) != ctx.RequestID() {
+			return vk.E(http.StatusInternalServerError, "request ID was not propagated")
+		}
+
+		return vk.RespondString(ctx.Context, w, tenantOf(r.Context()), http.StatusOK)
+	})
+
+	server.AddGroup(g)
+
+	vt := vtest.New(server)
+
+	r, _ := http.NewRequest(http.MethodGet, "/orders", nil)
+	r.Header.Set("X-Tenant", "acme")
+	vt.Do(r, t).AssertStatus(http.StatusOK).AssertBodyString("acme")
+
+	r, _ = http.NewRequest(http.MethodGet, "/orders", nil)
+	r.Header.Set("X-Tenant", "globex")
+	vt.Do(r, t).AssertStatus(http.StatusOK).AssertBodyString("globex")
+}
+
+func TestPropagateToContextReplaces(t *testing.T) {
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+	server.PropagateToContext(vk.RequestIDKey, func(ctx *vk.Ctx) interface{} {
+		return "fixed"
+	})
+
+	assert.Panics(t, func() {
+		server.PropagateToContext([]string{"not comparable"}, nil)
+	})
+
+	server.GET("/id", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.RespondString(ctx.Context, w, vk.RequestIDFromContext(r.Context()), http.StatusOK)
+	})
+
+	vt := vtest.New(server)
+
+	r, _ := http.NewRequest(http.MethodGet, "/id", nil)
+	vt.Do(r, t).AssertStatus(http.StatusOK).AssertBodyString("fixed")
+}
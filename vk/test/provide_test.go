@@ -0,0 +1,119 @@
+package test_test
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+	"github.com/suborbital/vektor/vtest"
+)
+
+type greeter interface {
+	Greet(name string) string
+}
+
+type englishGreeter struct{}
+
+func (englishGreeter) Greet(name string) string { return "hello " + name }
+
+type fakeGreeter struct{}
+
+func (fakeGreeter) Greet(name string) string { return "fake " + name }
+
+type dbPool struct {
+	name string
+}
+
+type missingClient struct{}
+
+func dependencyServer(logs *logCapture, mods ...vk.OptionsModifier) *vk.Server {
+	server := vk.New(append([]vk.OptionsModifier{vk.UseLogger(vlog.Default(vlog.Level(vlog.LogLevelInfo), vlog.WithWriter(logs)))}, mods...)...)
+
+	vk.Provide[greeter](server, englishGreeter{})
+	vk.Provide(server, &dbPool{name: "primary"})
+
+	server.GET("/greet/:name", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		g, err := vk.Resolve[greeter](ctx)
+		if err != nil {
+			return err
+		}
+
+		pool, err := vk.Resolve[*dbPool](ctx)
+		if err != nil {
+			return err
+		}
+
+		return vk.RespondString(ctx.Context, w, g.Greet(ctx.Params.ByName("name"))+" from "+pool.name, http.StatusOK)
+	})
+
+	server.GET("/missing", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		if _, err := vk.Resolve[*missingClient](ctx); err != nil {
+			return err
+		}
+
+		return vk.RespondString(ctx.Context, w, "unreachable", http.StatusOK)
+	})
+
+	return server
+}
+
+func TestResolve(t *testing.T) {
+	logs := &logCapture{}
+	vt := vtest.New(dependencyServer(logs))
+
+	t.Run("typed", func(t *testing.T) {
+		r, _ := http.NewRequest(http.MethodGet, "/greet/ada", nil)
+
+		vt.Do(r, t).AssertStatus(http.StatusOK).AssertBodyString("hello ada from primary")
+	})
+
+	t.Run("overridden", func(t *testing.T) {
+		r, _ := http.NewRequest(http.MethodGet, "/greet/ada", nil)
+		r = vtest.Override[greeter](r, fakeGreeter{})
+
+		vt.Do(r, t).AssertStatus(http.StatusOK).AssertBodyString("fake ada from primary")
+
+		// the override only applies to the request it was made for
+		r, _ = http.NewRequest(http.MethodGet, "/greet/ada", nil)
+
+		vt.Do(r, t).AssertStatus(http.StatusOK).AssertBodyString("hello ada from primary")
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		r, _ := http.NewRequest(http.MethodGet, "/missing", nil)
+
+		resp := vt.Do(r, t).AssertStatus(http.StatusInternalServerError)
+		assert.NotContains(t, string(resp.Body), "missingClient")
+
+		assert.Contains(t, strings.Join(logs.messages(), "\n"), "no dependency of type *test_test.missingClient has been provided")
+	})
+
+	t.Run("missing in dev mode", func(t *testing.T) {
+		devLogs := &logCapture{}
+		devVT := vtest.New(dependencyServer(devLogs, vk.UseDevMode(true)))
+
+		r, _ := http.NewRequest(http.MethodGet, "/missing", nil)
+
+		devVT.Do(r, t).AssertStatus(http.StatusInternalServerError)
+
+		var panicked string
+		for _, m := range devLogs.messages() {
+			if strings.Contains(m, "recovered panic") {
+				panicked = m
+			}
+		}
+
+		require.NotEmpty(t, panicked)
+		assert.Contains(t, panicked, "*test_test.missingClient")
+	})
+
+	t.Run("outside a router", func(t *testing.T) {
+		_, err := vk.Resolve[greeter](vk.NewCtx(nil, nil, nil))
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,121 @@
+package test_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+	"github.com/suborbital/vektor/vtest"
+)
+
+func TestFallbackProxy(t *testing.T) {
+	var forwarded http.Header
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header.Clone()
+
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Age", "12")
+
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		if r.Header.Get("Range") != "" {
+			w.Header().Set("Content-Range", "bytes 0-3/10")
+			w.WriteHeader(http.StatusPartialContent)
+			_, _ = w.Write([]byte("upst"))
+			return
+		}
+
+		_, _ = w.Write([]byte("upstream"))
+	}))
+	defer upstream.Close()
+
+	logger := vlog.Default(vlog.Level(vlog.LogLevelError))
+
+	server := vk.New(
+		vk.UseLogger(logger),
+		vk.UseFallbackAddress(upstream.URL),
+	)
+
+	vt := vtest.New(server)
+
+	t.Run("not modified", func(t *testing.T) {
+		r, err := http.NewRequest(http.MethodGet, "/cached", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r.Host = "vk.example.com"
+		r.Header.Set("If-None-Match", `"v1"`)
+		r.Header.Set("Connection", "keep-alive, X-Hop")
+		r.Header.Set("X-Hop", "secret")
+		r.Header.Set("Keep-Alive", "timeout=5")
+		r.Header.Set("Proxy-Authorization", "Basic abc")
+
+		vt.Do(r, t).
+			AssertStatus(http.StatusNotModified).
+			AssertBodyString("").
+			AssertHeader("ETag", `"v1"`).
+			AssertHeader("Cache-Control", "max-age=60").
+			AssertHeader("Age", "12").
+			AssertHeader("Via", "1.1 vk")
+
+		for _, h := range []string{"Connection", "X-Hop", "Keep-Alive", "Proxy-Authorization"} {
+			if v := forwarded.Get(h); v != "" {
+				t.Errorf("hop-by-hop header %s was forwarded: %s", h, v)
+			}
+		}
+
+		if v := forwarded.Get("If-None-Match"); v != `"v1"` {
+			t.Errorf("If-None-Match: got %q, want %q", v, `"v1"`)
+		}
+
+		if v := forwarded.Get("Via"); v != "1.1 vk" {
+			t.Errorf("Via: got %q, want %q", v, "1.1 vk")
+		}
+
+		if v := forwarded.Get("X-Forwarded-Host"); v != "vk.example.com" {
+			t.Errorf("X-Forwarded-Host: got %q, want %q", v, "vk.example.com")
+		}
+
+		if v := forwarded.Get("X-Forwarded-Proto"); v != "http" {
+			t.Errorf("X-Forwarded-Proto: got %q, want %q", v, "http")
+		}
+	})
+
+	t.Run("partial content", func(t *testing.T) {
+		r, err := http.NewRequest(http.MethodGet, "/cached", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r.Header.Set("Range", "bytes=0-3")
+
+		vt.Do(r, t).
+			AssertStatus(http.StatusPartialContent).
+			AssertBodyString("upst").
+			AssertHeader("Content-Range", "bytes 0-3/10").
+			AssertHeader("Via", "1.1 vk")
+
+		if v := forwarded.Get("Range"); v != "bytes=0-3" {
+			t.Errorf("Range: got %q, want %q", v, "bytes=0-3")
+		}
+	})
+
+	t.Run("HEAD", func(t *testing.T) {
+		r, err := http.NewRequest(http.MethodHead, "/cached", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		vt.Do(r, t).
+			AssertStatus(http.StatusOK).
+			AssertHeader("ETag", `"v1"`)
+	})
+}
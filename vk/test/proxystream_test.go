@@ -0,0 +1,190 @@
+package test_test
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+)
+
+const streamedBytes = 8 << 20
+
+// proxyServer serves a vk server with no routes, so that every request falls back to upstream
+func proxyServer(t *testing.T, upstream *httptest.Server, opts vk.ProxyOptions) *httptest.Server {
+	server := vk.New(
+		vk.UseLogger(vlog.Noop()),
+		vk.UseFallbackAddress(upstream.URL),
+		vk.UseFallbackProxyOptions(opts),
+	)
+
+	require.NoError(t, server.TestStart())
+
+	ts := httptest.NewServer(server)
+	t.Cleanup(ts.Close)
+
+	return ts
+}
+
+func TestProxyStreamsRequests(t *testing.T) {
+	firstByte := make(chan struct{})
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf := make([]byte, 1)
+		if _, err := io.ReadFull(r.Body, buf); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		close(firstByte)
+
+		n, _ := io.Copy(io.Discard, r.Body)
+		_, _ = w.Write([]byte(strconv.FormatInt(n+1, 10)))
+	}))
+	defer upstream.Close()
+
+	ts := proxyServer(t, upstream, vk.ProxyOptions{})
+
+	body, pw := io.Pipe()
+
+	go func() {
+		chunk := bytes.Repeat([]byte("a"), 1<<20)
+
+		_, _ = pw.Write(chunk)
+
+		// the rest of the body is only sent once the upstream has started receiving it, so a proxy
+		// that buffers the request deadlocks here until the client gives up
+		select {
+		case <-firstByte:
+		case <-time.After(2 * time.Second):
+			pw.CloseWithError(io.ErrUnexpectedEOF)
+			return
+		}
+
+		for written := len(chunk); written < streamedBytes; written += len(chunk) {
+			_, _ = pw.Write(chunk)
+		}
+
+		pw.Close()
+	}()
+
+	start := time.Now()
+
+	resp, err := http.Post(ts.URL+"/upload", "application/octet-stream", body)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	reply, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, strconv.Itoa(streamedBytes), string(reply))
+	assert.Less(t, time.Since(start), 2*time.Second)
+}
+
+func TestProxyStreamsResponses(t *testing.T) {
+	release := make(chan struct{})
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = w.Write([]byte("data: started\n\n"))
+		w.(http.Flusher).Flush()
+
+		<-release
+
+		chunk := bytes.Repeat([]byte("b"), 1<<20)
+		for written := 0; written < streamedBytes; written += len(chunk) {
+			_, _ = w.Write(chunk)
+		}
+	}))
+	defer upstream.Close()
+
+	ts := proxyServer(t, upstream, vk.ProxyOptions{})
+
+	start := time.Now()
+
+	resp, err := http.Get(ts.URL + "/events")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	// the first event arrives while the upstream is still writing the response
+	reader := bufio.NewReader(resp.Body)
+
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err)
+
+	assert.Equal(t, "data: started\n", line)
+	assert.Less(t, time.Since(start), time.Second)
+
+	close(release)
+
+	n, err := io.Copy(io.Discard, reader)
+	require.NoError(t, err)
+	assert.EqualValues(t, streamedBytes+1, n) // the rest includes the event's trailing newline
+}
+
+func TestProxyMaxRequestBytes(t *testing.T) {
+	var calls, contentLength int64
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&calls, 1)
+		atomic.StoreInt64(&contentLength, r.ContentLength)
+
+		if _, err := io.Copy(io.Discard, r.Body); err != nil {
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer upstream.Close()
+
+	streaming := proxyServer(t, upstream, vk.ProxyOptions{MaxRequestBytes: 1 << 20})
+	buffering := proxyServer(t, upstream, vk.ProxyOptions{MaxRequestBytes: 1 << 20, BufferRequests: true})
+
+	post := func(ts *httptest.Server, size int, chunked bool) int {
+		var body io.Reader = bytes.NewReader(bytes.Repeat([]byte("c"), size))
+		if chunked {
+			// hide the length so the request is sent without a Content-Length
+			body = io.MultiReader(body)
+		}
+
+		resp, err := http.Post(ts.URL+"/upload", "application/octet-stream", body)
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		return resp.StatusCode
+	}
+
+	t.Run("declared length", func(t *testing.T) {
+		atomic.StoreInt64(&calls, 0)
+
+		assert.Equal(t, http.StatusRequestEntityTooLarge, post(streaming, 2<<20, false))
+		assert.EqualValues(t, 0, atomic.LoadInt64(&calls), "the upstream should not be contacted")
+	})
+
+	t.Run("chunked", func(t *testing.T) {
+		assert.Equal(t, http.StatusRequestEntityTooLarge, post(streaming, 2<<20, true))
+		assert.Equal(t, http.StatusCreated, post(streaming, 1<<20, true))
+	})
+
+	t.Run("buffered", func(t *testing.T) {
+		atomic.StoreInt64(&calls, 0)
+
+		assert.Equal(t, http.StatusRequestEntityTooLarge, post(buffering, 2<<20, true))
+		assert.EqualValues(t, 0, atomic.LoadInt64(&calls), "the upstream should not be contacted")
+
+		// buffered requests are sent to the upstream with their length
+		assert.Equal(t, http.StatusCreated, post(buffering, 1<<20, true))
+		assert.EqualValues(t, 1<<20, atomic.LoadInt64(&contentLength))
+	})
+}
@@ -0,0 +1,59 @@
+package test_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+	"github.com/suborbital/vektor/vtest"
+)
+
+func TestAllowedQuery(t *testing.T) {
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+
+	ok := func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.RespondString(ctx.Context, w, "ok", http.StatusOK)
+	}
+
+	g := vk.Group("")
+	g.GET("/strict", ok, vk.AllowedQuery("page", "per_page", "ids[]", "filter"))
+	g.GET("/warn", ok, vk.AllowedQueryWarn("page"))
+	server.AddGroup(g)
+
+	vt := vtest.New(server)
+
+	cases := map[string]struct {
+		path    string
+		status  int
+		message string
+	}{
+		"no query":        {"/strict", http.StatusOK, ""},
+		"allowed":         {"/strict?page=1&per_page=10", http.StatusOK, ""},
+		"typo":            {"/strict?page=1&limt=10", http.StatusBadRequest, "unexpected query parameters: limt"},
+		"sorted":          {"/strict?zed=1&page=1&abc=2", http.StatusBadRequest, "unexpected query parameters: abc, zed"},
+		"repeated":        {"/strict?sort=a&sort=b", http.StatusBadRequest, "unexpected query parameters: sort"},
+		"array":           {"/strict?ids[]=1&ids[]=2&ids=3", http.StatusOK, ""},
+		"array allowed":   {"/strict?filter[]=a", http.StatusOK, ""},
+		"array unknown":   {"/strict?tags[]=a&tags[]=b", http.StatusBadRequest, "unexpected query parameters: tags"},
+		"encoded":         {"/strict?ids%5B%5D=1&per%5Fpage=2", http.StatusOK, ""},
+		"encoded unknown": {"/strict?so%72t=a", http.StatusBadRequest, "unexpected query parameters: sort"},
+		"empty pairs":     {"/strict?&page=1&&", http.StatusOK, ""},
+		"warn":            {"/warn?page=1&limt=10", http.StatusOK, ""},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			r, err := http.NewRequest(http.MethodGet, c.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp := vt.Do(r, t).AssertStatus(c.status)
+
+			if c.message != "" {
+				resp.AssertBodyString(`{"status":400,"message":"` + c.message + `"}`)
+			}
+		})
+	}
+}
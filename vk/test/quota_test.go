@@ -0,0 +1,188 @@
+package test_test
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+	"github.com/suborbital/vektor/vtest"
+)
+
+func tenantFromHeader(inner vk.HandlerFunc) vk.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		ctx.Set("tenant", r.Header.Get("X-Tenant"))
+
+		return inner(w, r, ctx)
+	}
+}
+
+func TestQuotaMiddleware(t *testing.T) {
+	logger := vlog.Default(vlog.Level(vlog.LogLevelNull))
+
+	quotas := vk.NewQuotas(func(ctx *vk.Ctx) vk.Quota {
+		tenant, _ := ctx.Get("tenant").(string)
+
+		switch tenant {
+		case "small":
+			return vk.Quota{Key: tenant, MaxConcurrent: 1}
+		case "large":
+			return vk.Quota{Key: tenant, MaxConcurrent: 5}
+		case "slow":
+			return vk.Quota{Key: tenant, Rate: 1, Burst: 2}
+		}
+
+		return vk.Quota{}
+	}, time.Minute)
+
+	release := make(chan struct{})
+	var inFlight int64
+
+	server := vk.New(vk.UseLogger(logger))
+
+	g := vk.Group("").WithMiddlewares(quotas.Middleware(), tenantFromHeader)
+	g.GET("/work", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		atomic.AddInt64(&inFlight, 1)
+		<-release
+
+		return vk.RespondString(ctx.Context, w, "done", http.StatusOK)
+	})
+	g.GET("/quick", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.RespondString(ctx.Context, w, "done", http.StatusOK)
+	})
+
+	server.AddGroup(g)
+
+	vt := vtest.New(server)
+
+	request := func(tenant, path string) *http.Request {
+		r, _ := http.NewRequest(http.MethodGet, path, nil)
+		r.Header.Set("X-Tenant", tenant)
+
+		return r
+	}
+
+	t.Run("concurrency isolation", func(t *testing.T) {
+		statuses := map[string][]int{}
+		lock := sync.Mutex{}
+		wg := sync.WaitGroup{}
+
+		for _, tenant := range []string{"small", "large"} {
+			for i := 0; i < 5; i++ {
+				wg.Add(1)
+
+				go func(tenant string) {
+					defer wg.Done()
+
+					resp := vt.Do(request(tenant, "/work"), t)
+
+					lock.Lock()
+					statuses[tenant] = append(statuses[tenant], resp.Status)
+					lock.Unlock()
+				}(tenant)
+			}
+		}
+
+		// wait until every admitted request is in the handler and every rejected request has returned
+		assert.Eventually(t, func() bool {
+			lock.Lock()
+			defer lock.Unlock()
+
+			return atomic.LoadInt64(&inFlight) == 6 && len(statuses["small"]) == 4
+		}, 2*time.Second, 5*time.Millisecond)
+
+		close(release)
+		wg.Wait()
+
+		assert.ElementsMatch(t, []int{200, 429, 429, 429, 429}, statuses["small"])
+		assert.ElementsMatch(t, []int{200, 200, 200, 200, 200}, statuses["large"])
+	})
+
+	t.Run("rate", func(t *testing.T) {
+		vt.Do(request("slow", "/quick"), t).AssertStatus(http.StatusOK)
+		vt.Do(request("slow", "/quick"), t).AssertStatus(http.StatusOK)
+		vt.Do(request("slow", "/quick"), t).
+			AssertStatus(http.StatusTooManyRequests).
+			AssertHeader("Retry-After", "1")
+
+		// other tenants are unaffected
+		vt.Do(request("large", "/quick"), t).AssertStatus(http.StatusOK)
+	})
+
+	t.Run("unidentified", func(t *testing.T) {
+		for i := 0; i < 5; i++ {
+			vt.Do(request("", "/quick"), t).AssertStatus(http.StatusOK)
+		}
+	})
+
+	t.Run("stats", func(t *testing.T) {
+		assert.Equal(t, []vk.QuotaStat{{Key: "small", Rejections: 4}, {Key: "slow", Rejections: 1}}, quotas.TopRejections(5))
+		assert.Equal(t, []vk.QuotaStat{{Key: "small", Rejections: 4}}, quotas.TopRejections(1))
+	})
+}
+
+func TestKeyedQuotas(t *testing.T) {
+	var lock sync.Mutex
+	resolved := map[string]int{}
+	plans := map[string]vk.Quota{"acme": {Rate: 0.001, Burst: 2}}
+
+	quotas := vk.NewKeyedQuotas(func(ctx *vk.Ctx) string {
+		tenant, _ := ctx.Get("tenant").(string)
+		return tenant
+	}, func(key string) vk.Quota {
+		lock.Lock()
+		defer lock.Unlock()
+
+		resolved[key]++
+
+		return plans[key]
+	}, time.Minute)
+
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+
+	g := vk.Group("").WithMiddlewares(quotas.Middleware(), tenantFromHeader)
+	g.GET("/quick", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.RespondString(ctx.Context, w, "done", http.StatusOK)
+	})
+
+	server.AddGroup(g)
+
+	vt := vtest.New(server)
+
+	request := func(tenant string) *http.Request {
+		r, _ := http.NewRequest(http.MethodGet, "/quick", nil)
+		r.Header.Set("X-Tenant", tenant)
+
+		return r
+	}
+
+	vt.Do(request("acme"), t).AssertStatus(http.StatusOK)
+	vt.Do(request("acme"), t).AssertStatus(http.StatusOK)
+	vt.Do(request("acme"), t).AssertStatus(http.StatusTooManyRequests)
+	vt.Do(request(""), t).AssertStatus(http.StatusOK)
+
+	lock.Lock()
+	assert.Equal(t, map[string]int{"acme": 1}, resolved, "the quota is resolved once per key")
+	plans["acme"] = vk.Quota{Rate: 0.001, Burst: 4}
+	lock.Unlock()
+
+	// the new plan only applies once the cached quotas are invalidated
+	vt.Do(request("acme"), t).AssertStatus(http.StatusTooManyRequests)
+
+	quotas.Invalidate()
+
+	for i := 0; i < 4; i++ {
+		vt.Do(request("acme"), t).AssertStatus(http.StatusOK)
+	}
+
+	vt.Do(request("acme"), t).AssertStatus(http.StatusTooManyRequests)
+
+	lock.Lock()
+	assert.Equal(t, map[string]int{"acme": 2}, resolved)
+	lock.Unlock()
+}
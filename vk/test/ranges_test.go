@@ -0,0 +1,190 @@
+package test_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+)
+
+func TestRangedDownloads(t *testing.T) {
+	content := strings.Repeat("0123456789", 100)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "export.bin")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+
+	sum := sha256.Sum256([]byte(content))
+	etag := `"` + hex.EncodeToString(sum[:]) + `"`
+
+	logs := &logCapture{}
+
+	server := vk.New(vk.UseLogger(vlog.Default(vlog.Level(vlog.LogLevelInfo), vlog.WithWriter(logs))))
+	server.Static("/files", http.Dir(dir))
+	server.Static("/single", http.Dir(dir), vk.WithSingleRanges())
+
+	require.NoError(t, server.TestStart())
+
+	get := func(path string, headers map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		for k, v := range headers {
+			r.Header.Set(k, v)
+		}
+
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+
+		return w
+	}
+
+	t.Run("full", func(t *testing.T) {
+		w := get("/files/export.bin", nil)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, etag, w.Header().Get("ETag"))
+		assert.Equal(t, "bytes", w.Header().Get("Accept-Ranges"))
+		assert.Equal(t, content, w.Body.String())
+	})
+
+	t.Run("single range", func(t *testing.T) {
+		w := get("/files/export.bin", map[string]string{"Range": "bytes=100-199", "If-Range": etag})
+
+		assert.Equal(t, http.StatusPartialContent, w.Code)
+		assert.Equal(t, "bytes 100-199/1000", w.Header().Get("Content-Range"))
+		assert.Equal(t, content[100:200], w.Body.String())
+
+		w = get("/files/export.bin", map[string]string{"Range": "bytes=-10"})
+
+		assert.Equal(t, http.StatusPartialContent, w.Code)
+		assert.Equal(t, content[990:], w.Body.String())
+
+		assert.Contains(t, logs.messages(), "(I) [vk] resuming download of /files/export.bin at offset 100 for 192.0.2.1")
+	})
+
+	t.Run("if-range mismatch", func(t *testing.T) {
+		for name, ifRange := range map[string]string{
+			"other etag": `"abc"`,
+			"weak etag":  "W/" + etag,
+			"date":       time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat),
+		} {
+			t.Run(name, func(t *testing.T) {
+				w := get("/files/export.bin", map[string]string{"Range": "bytes=100-", "If-Range": ifRange})
+
+				assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+				assert.Equal(t, etag, w.Header().Get("ETag"))
+			})
+		}
+	})
+
+	t.Run("malformed", func(t *testing.T) {
+		for _, header := range []string{"bytes=abc", "items=0-10", "bytes=20-10", "bytes=", "bytes=-", "bytes=1-2-3"} {
+			t.Run(header, func(t *testing.T) {
+				w := get("/files/export.bin", map[string]string{"Range": header})
+
+				assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, w.Code)
+				assert.Equal(t, "bytes */1000", w.Header().Get("Content-Range"))
+			})
+		}
+	})
+
+	t.Run("not satisfiable", func(t *testing.T) {
+		w := get("/files/export.bin", map[string]string{"Range": "bytes=1000-"})
+
+		assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, w.Code)
+		assert.Equal(t, "bytes */1000", w.Header().Get("Content-Range"))
+		assert.Equal(t, `{"status":416,"message":"range not satisfiable"}`, w.Body.String())
+	})
+
+	t.Run("multiple ranges", func(t *testing.T) {
+		w := get("/files/export.bin", map[string]string{"Range": "bytes=0-4,10-14"})
+
+		assert.Equal(t, http.StatusPartialContent, w.Code)
+
+		mediaType, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+		require.NoError(t, err)
+		assert.Equal(t, "multipart/byteranges", mediaType)
+
+		reader := multipart.NewReader(w.Body, params["boundary"])
+
+		for _, want := range []string{content[0:5], content[10:15]} {
+			part, err := reader.NextPart()
+			require.NoError(t, err)
+
+			body, _ := io.ReadAll(part)
+			assert.Equal(t, want, string(body))
+		}
+
+		w = get("/single/export.bin", map[string]string{"Range": "bytes=0-4,10-14"})
+
+		assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, w.Code)
+		assert.Equal(t, `{"status":416,"message":"multiple ranges are not supported"}`, w.Body.String())
+	})
+
+	t.Run("content identity", func(t *testing.T) {
+		// touching the file doesn't change its ETag
+		later := time.Now().Add(time.Minute)
+		require.NoError(t, os.Chtimes(path, later, later))
+
+		w := get("/files/export.bin", map[string]string{"Range": "bytes=500-", "If-Range": etag})
+		assert.Equal(t, http.StatusPartialContent, w.Code)
+
+		// but changing its content does
+		require.NoError(t, os.WriteFile(path, []byte(strings.ToUpper(strings.Repeat("abcdefghij", 100))), 0600))
+		require.NoError(t, os.Chtimes(path, later.Add(time.Minute), later.Add(time.Minute)))
+
+		w = get("/files/export.bin", map[string]string{"Range": "bytes=500-", "If-Range": etag})
+		assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+		assert.NotEqual(t, etag, w.Header().Get("ETag"))
+
+		assert.Contains(t, logs.messages(), "(I) [vk] refused to resume download of /files/export.bin for 192.0.2.1: the content has changed")
+	})
+}
+
+func TestRespondRanged(t *testing.T) {
+	content := strings.Repeat("vektor", 100)
+	opens := []int64{}
+
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+
+	server.GET("/generated", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.RespondRanged(ctx, w, vk.RangedContent{
+			Open: func(offset int64) (io.ReadCloser, error) {
+				opens = append(opens, offset)
+				return io.NopCloser(strings.NewReader(content[offset:])), nil
+			},
+			Size:        int64(len(content)),
+			ETag:        "report-7",
+			ContentType: "text/csv",
+		})
+	})
+
+	require.NoError(t, server.TestStart())
+
+	r := httptest.NewRequest(http.MethodGet, "/generated", nil)
+	r.Header.Set("Range", "bytes=594-")
+	r.Header.Set("If-Range", `"report-7"`)
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, "bytes 594-599/600", w.Header().Get("Content-Range"))
+	assert.Equal(t, "text/csv", w.Header().Get("Content-Type"))
+	assert.Equal(t, `"report-7"`, w.Header().Get("ETag"))
+	assert.Equal(t, "vektor", w.Body.String())
+	assert.Equal(t, []int64{594}, opens, "the content should only be opened at the range's offset")
+}
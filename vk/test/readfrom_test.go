@@ -0,0 +1,214 @@
+package test_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+)
+
+// readFromRecorder is a ResponseRecorder that, like net/http's own ResponseWriter, implements io.ReaderFrom
+type readFromRecorder struct {
+	*httptest.ResponseRecorder
+	readFroms int
+}
+
+func (r *readFromRecorder) ReadFrom(src io.Reader) (int64, error) {
+	r.readFroms++
+	return io.Copy(r.ResponseRecorder, src)
+}
+
+// writeCounter counts the bytes written to the ResponseWriter with Write, and optionally hides its ReadFrom
+type writeCounter struct {
+	written     int64
+	hideReaders bool
+}
+
+type countingWriter struct {
+	http.ResponseWriter
+	counter *writeCounter
+}
+
+func (c countingWriter) Write(b []byte) (int, error) {
+	atomic.AddInt64(&c.counter.written, int64(len(b)))
+	return c.ResponseWriter.Write(b)
+}
+
+type countingReaderFrom struct {
+	countingWriter
+}
+
+func (c countingReaderFrom) ReadFrom(src io.Reader) (int64, error) {
+	return c.ResponseWriter.(io.ReaderFrom).ReadFrom(src)
+}
+
+func (c *writeCounter) middleware() vk.Middleware {
+	return func(inner vk.HandlerFunc) vk.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+			cw := countingWriter{ResponseWriter: w, counter: c}
+
+			if _, ok := w.(io.ReaderFrom); ok && !c.hideReaders {
+				return inner(countingReaderFrom{cw}, r, ctx)
+			}
+
+			return inner(cw, r, ctx)
+		}
+	}
+}
+
+func TestReadFromPassthrough(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "large.txt"), []byte(strings.Repeat("vektor", 1000)), 0600))
+
+	cases := map[string][]vk.OptionsModifier{
+		"default":     nil,
+		"strict":      {vk.UseStrictResponses()},
+		"under-limit": {vk.UseStrictResponses(), vk.UseMaxResponseBytes(10000)},
+	}
+
+	for name, opts := range cases {
+		t.Run(name, func(t *testing.T) {
+			server := vk.New(append(opts, vk.UseLogger(vlog.Noop()))...)
+
+			var sawReaderFrom bool
+
+			g := vk.Group("").WithMiddlewares(vk.CompressionMiddleware())
+			g.GET("/check", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+				_, sawReaderFrom = w.(io.ReaderFrom)
+				w.WriteHeader(http.StatusOK)
+				return nil
+			})
+			g.Static("/files", http.Dir(dir))
+
+			server.AddGroup(g)
+			require.NoError(t, server.TestStart())
+
+			w := &readFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+			server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/check", nil))
+
+			assert.True(t, sawReaderFrom)
+
+			w = &readFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+			server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/files/large.txt", nil))
+
+			assert.Equal(t, 1, w.readFroms)
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, 6000, w.Body.Len())
+		})
+	}
+
+	t.Run("beyond-limit", func(t *testing.T) {
+		server := vk.New(vk.UseLogger(vlog.Noop()), vk.UseMaxResponseBytes(100))
+		server.Static("/files", http.Dir(dir))
+		require.NoError(t, server.TestStart())
+
+		w := &readFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+
+		// the file is copied through Write to be counted, and the connection is aborted once the limit is reached
+		assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+			server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/files/large.txt", nil))
+		})
+
+		assert.Equal(t, 0, w.readFroms)
+	})
+
+	t.Run("compressed", func(t *testing.T) {
+		server := vk.New(vk.UseLogger(vlog.Noop()), vk.UseStrictResponses())
+
+		g := vk.Group("").WithMiddlewares(vk.CompressionMiddleware())
+		g.Static("/files", http.Dir(dir))
+
+		server.AddGroup(g)
+		require.NoError(t, server.TestStart())
+
+		w := &readFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+		r := httptest.NewRequest(http.MethodGet, "/files/large.txt", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		server.ServeHTTP(w, r)
+
+		// compressed bodies have to be copied through the gzip writer
+		assert.Equal(t, 0, w.readFroms)
+		assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	})
+
+	t.Run("without-readerfrom", func(t *testing.T) {
+		server := vk.New(vk.UseLogger(vlog.Noop()), vk.UseStrictResponses(), vk.UseMaxResponseBytes(10000))
+		server.Static("/files", http.Dir(dir))
+		require.NoError(t, server.TestStart())
+
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/files/large.txt", nil))
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, 6000, w.Body.Len())
+	})
+}
+
+// BenchmarkStaticLargeFile serves a 100MB file over a real connection, through the writers that vk wraps around
+// net/http's when strict responses and a response limit are used. The copied metric is the number of bytes written
+// with Write rather than being handed to net/http's ReadFrom, which uses sendfile for files
+func BenchmarkStaticLargeFile(b *testing.B) {
+	const size = 100 << 20
+
+	dir := b.TempDir()
+
+	f, err := os.Create(filepath.Join(dir, "large.bin"))
+	require.NoError(b, err)
+	require.NoError(b, f.Truncate(size))
+	require.NoError(b, f.Close())
+
+	for _, hide := range []bool{false, true} {
+		name := "passthrough"
+		if hide {
+			name = "write-only"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			counter := &writeCounter{hideReaders: hide}
+
+			server := vk.New(vk.UseLogger(vlog.Noop()), vk.UseStrictResponses(), vk.UseMaxResponseBytes(2*size))
+
+			g := vk.Group("").WithMiddlewares(vk.CompressionMiddleware(), counter.middleware())
+			g.Static("/files", http.Dir(dir))
+
+			server.AddGroup(g)
+			require.NoError(b, server.TestStart())
+
+			ts := httptest.NewServer(server)
+			defer ts.Close()
+
+			b.SetBytes(size)
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				r, _ := http.NewRequest(http.MethodGet, ts.URL+"/files/large.bin", nil)
+				r.Header.Set("Accept-Encoding", "identity")
+
+				resp, err := http.DefaultClient.Do(r)
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				n, _ := io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+
+				if n != size {
+					b.Fatalf("read %d bytes, expected %d", n, size)
+				}
+			}
+
+			b.ReportMetric(float64(atomic.LoadInt64(&counter.written))/float64(b.N), "copied-B/op")
+		})
+	}
+}
@@ -0,0 +1,187 @@
+package test_test
+
+import (
+	"net/http"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+	"github.com/suborbital/vektor/vtest"
+)
+
+type accountNote struct {
+	Text     string `json:"text"`
+	Internal bool   `json:"internal,omitempty" vk:"scope=admin:read"`
+}
+
+type accountBilling struct {
+	Plan string `json:"plan"`
+	Card string `json:"card" vk:"scope=billing:read"`
+}
+
+type accountContact struct {
+	Name  string `json:"name"`
+	Phone string `json:"phone" vk:"scope=admin:read"`
+}
+
+type account struct {
+	ID       string                    `json:"id"`
+	Name     string                    `json:"name"`
+	Email    string                    `json:"email" vk:"scope=admin:read|support:read"`
+	Billing  *accountBilling           `json:"billing,omitempty"`
+	Notes    []accountNote             `json:"notes"`
+	Contacts map[string]accountContact `json:"contacts"`
+	Extra    interface{}               `json:"extra"`
+}
+
+func testAccount() account {
+	return account{
+		ID:      "a-1",
+		Name:    "Ada",
+		Email:   "ada@example.com",
+		Billing: &accountBilling{Plan: "pro", Card: "4242"},
+		Notes:   []accountNote{{Text: "vip", Internal: true}},
+		Contacts: map[string]accountContact{
+			"owner": {Name: "Grace", Phone: "555-0100"},
+		},
+		Extra: accountNote{Text: "extra", Internal: true},
+	}
+}
+
+// scopesFromHeader stands in for authentication, setting claims with the scopes in X-Scopes
+func scopesFromHeader(inner vk.HandlerFunc) vk.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		ctx.Set(vk.ClaimsKey, map[string]interface{}{"scope": r.Header.Get("X-Scopes")})
+
+		return inner(w, r, ctx)
+	}
+}
+
+func TestRedaction(t *testing.T) {
+	server := vk.New(vk.UseLogger(vlog.Noop()), vk.UseRedaction(vk.RedactionOptions{}))
+
+	server.GET("/account", scopesFromHeader(func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.RespondJSON(ctx.Context, w, testAccount(), http.StatusOK)
+	}))
+
+	server.GET("/full", scopesFromHeader(func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		ctx.BypassRedaction()
+
+		return vk.RespondJSON(ctx.Context, w, testAccount(), http.StatusOK)
+	}))
+
+	g := vk.Group("/support").WithMiddlewares(vk.Redaction(vk.RedactionOptions{
+		Scopes: func(ctx *vk.Ctx) []string {
+			return []string{"support:read"}
+		},
+	}))
+	g.GET("/account", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.RespondJSON(ctx.Context, w, testAccount(), http.StatusOK)
+	})
+	server.AddGroup(g)
+
+	require.NoError(t, server.TestStart())
+
+	vt := vtest.New(server)
+
+	full := `{"id":"a-1","name":"Ada","email":"ada@example.com","billing":{"plan":"pro","card":"4242"},` +
+		`"notes":[{"text":"vip","internal":true}],"contacts":{"owner":{"name":"Grace","phone":"555-0100"}},` +
+		`"extra":{"text":"extra","internal":true}}`
+
+	cases := map[string]struct {
+		path   string
+		scopes string
+		body   string
+	}{
+		"no scopes": {"/account", "", `{"id":"a-1","name":"Ada","billing":{"plan":"pro"},"notes":[{"text":"vip"}],` +
+			`"contacts":{"owner":{"name":"Grace"}},"extra":{"text":"extra"}}`},
+		"support": {"/account", "support:read", `{"id":"a-1","name":"Ada","email":"ada@example.com","billing":{"plan":"pro"},` +
+			`"notes":[{"text":"vip"}],"contacts":{"owner":{"name":"Grace"}},"extra":{"text":"extra"}}`},
+		"admin and billing": {"/account", "admin:read billing:read", full},
+		"bypassed":          {"/full", "", full},
+		"route scopes": {"/support/account", "admin:read", `{"id":"a-1","name":"Ada","email":"ada@example.com",` +
+			`"billing":{"plan":"pro"},"notes":[{"text":"vip"}],"contacts":{"owner":{"name":"Grace"}},"extra":{"text":"extra"}}`},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			r, _ := http.NewRequest(http.MethodGet, c.path, nil)
+			r.Header.Set("X-Scopes", c.scopes)
+
+			vt.Do(r, t).
+				AssertStatus(http.StatusOK).
+				AssertBodyString(c.body)
+		})
+	}
+}
+
+type orgNode struct {
+	Name     string    `json:"name"`
+	Budget   int       `json:"budget" vk:"scope=finance:read"`
+	Children []orgNode `json:"children,omitempty"`
+}
+
+func TestRedactJSON(t *testing.T) {
+	t.Run("recursive types", func(t *testing.T) {
+		org := orgNode{Name: "root", Budget: 10, Children: []orgNode{{Name: "child", Budget: 5}}}
+
+		data, err := vk.RedactJSON(org, nil)
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"name":"root","children":[{"name":"child"}]}`, string(data))
+
+		data, err = vk.RedactJSON(org, []string{"finance:read"})
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"name":"root","budget":10,"children":[{"name":"child","budget":5}]}`, string(data))
+	})
+
+	t.Run("map keys", func(t *testing.T) {
+		contact := accountContact{Name: "Grace", Phone: "555-0100"}
+
+		// keys encoded with MarshalText, like encoding/json does
+		data, err := vk.RedactJSON(map[netip.Addr]accountContact{netip.MustParseAddr("10.0.0.1"): contact}, nil)
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"10.0.0.1":{"name":"Grace"}}`, string(data))
+
+		data, err = vk.RedactJSON(map[uint16]accountContact{8080: contact}, nil)
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"8080":{"name":"Grace"}}`, string(data))
+
+		// keys that can't be encoded fail rather than being encoded without redaction
+		_, err = vk.RedactJSON(map[[2]int]accountContact{{1, 2}: contact}, nil)
+		assert.Error(t, err)
+	})
+
+	t.Run("unrestricted types", func(t *testing.T) {
+		data, err := vk.RedactJSON([]lineItem{{SKU: "a-1"}}, nil)
+		require.NoError(t, err)
+
+		expected, err := vk.EncodeJSON([]lineItem{{SKU: "a-1"}})
+		require.NoError(t, err)
+
+		assert.Equal(t, string(expected), string(data))
+	})
+}
+
+func BenchmarkRedactJSON(b *testing.B) {
+	acct := testAccount()
+
+	b.Run("EncodeJSON", func(b *testing.B) {
+		b.ReportAllocs()
+
+		for i := 0; i < b.N; i++ {
+			_, _ = vk.EncodeJSON(acct)
+		}
+	})
+
+	b.Run("RedactJSON", func(b *testing.B) {
+		b.ReportAllocs()
+
+		for i := 0; i < b.N; i++ {
+			_, _ = vk.RedactJSON(acct, []string{"support:read"})
+		}
+	})
+}
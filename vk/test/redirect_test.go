@@ -0,0 +1,110 @@
+package test_test
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+)
+
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	defer l.Close()
+
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// getNoFollow performs a GET without following redirects, retrying while the listener starts up
+func getNoFollow(t *testing.T, url string) *http.Response {
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	var resp *http.Response
+	var err error
+
+	for i := 0; i < 50; i++ {
+		if resp, err = client.Get(url); err == nil {
+			return resp
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	require.NoError(t, err)
+
+	return nil
+}
+
+func TestHTTPSRedirect(t *testing.T) {
+	logger := vlog.Default(vlog.Level(vlog.LogLevelError))
+
+	health := func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.RespondString(ctx.Context, w, "ok", http.StatusOK)
+	}
+
+	t.Run("request host", func(t *testing.T) {
+		port := freePort(t)
+
+		server := vk.New(
+			vk.UseLogger(logger),
+			vk.UseDomain("vk.example.com"),
+			vk.UseHTTPPort(port),
+			vk.UseTLSPort(8443),
+			vk.UseHTTPSRedirect("/healthz"),
+		)
+
+		server.GET("/healthz", health)
+		require.NoError(t, server.TestStart())
+
+		base := fmt.Sprintf("http://127.0.0.1:%d", port)
+
+		resp := getNoFollow(t, base+"/api/items?page=2&sort=name")
+		resp.Body.Close()
+
+		assert.Equal(t, http.StatusPermanentRedirect, resp.StatusCode)
+		assert.Equal(t, "https://127.0.0.1:8443/api/items?page=2&sort=name", resp.Header.Get("Location"))
+
+		resp = getNoFollow(t, base+"/healthz")
+		resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		resp = getNoFollow(t, base+"/.well-known/acme-challenge/token")
+		resp.Body.Close()
+
+		assert.NotEqual(t, http.StatusPermanentRedirect, resp.StatusCode)
+		assert.Empty(t, resp.Header.Get("Location"))
+	})
+
+	t.Run("canonical host", func(t *testing.T) {
+		port := freePort(t)
+
+		server := vk.New(
+			vk.UseLogger(logger),
+			vk.UseDomain("vk.example.com"),
+			vk.UseHTTPPort(port),
+			vk.UseHTTPSRedirect(),
+			vk.UseCanonicalHost("api.example.com"),
+		)
+
+		require.NoError(t, server.TestStart())
+
+		resp := getNoFollow(t, fmt.Sprintf("http://127.0.0.1:%d/healthz?full=true", port))
+		resp.Body.Close()
+
+		assert.Equal(t, http.StatusPermanentRedirect, resp.StatusCode)
+		assert.Equal(t, "https://api.example.com/healthz?full=true", resp.Header.Get("Location"))
+	})
+}
@@ -0,0 +1,264 @@
+package test_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+)
+
+// fakeRecords stands in for DNS, returning whichever addresses were set last
+type fakeRecords struct {
+	lock      sync.Mutex
+	addresses []string
+}
+
+func (f *fakeRecords) set(addresses ...string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.addresses = addresses
+}
+
+func (f *fakeRecords) lookup(_ context.Context) ([]string, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return append([]string{}, f.addresses...), nil
+}
+
+// namedUpstream responds with name, checking that the request was addressed to the proxy target rather than an IP
+func namedUpstream(t *testing.T, name string) *httptest.Server {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "backend.internal:8080", r.Header.Get("X-Forwarded-Host"))
+
+		_, _ = w.Write([]byte(name))
+	}))
+
+	t.Cleanup(upstream.Close)
+
+	return upstream
+}
+
+func resolvedProxy(t *testing.T, resolver *vk.EndpointResolver) *httptest.Server {
+	server := vk.New(
+		vk.UseLogger(vlog.Noop()),
+		vk.UseFallbackAddress("http://backend.internal:8080"),
+		vk.UseFallbackProxyOptions(vk.ProxyOptions{Resolver: resolver}),
+	)
+
+	require.NoError(t, server.TestStart())
+
+	ts := httptest.NewServer(server)
+	t.Cleanup(ts.Close)
+
+	return ts
+}
+
+// proxiedBy returns the name of the upstream that handled a request, or its status if it failed
+func proxiedBy(t *testing.T, ts *httptest.Server) string {
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/", nil)
+	require.NoError(t, err)
+
+	req.Host = "backend.internal:8080"
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	if resp.StatusCode != http.StatusOK {
+		return resp.Status
+	}
+
+	return string(body)
+}
+
+func TestResolverFollowsRecords(t *testing.T) {
+	a, b := namedUpstream(t, "a"), namedUpstream(t, "b")
+
+	records := &fakeRecords{}
+	records.set(a.Listener.Addr().String())
+
+	resolver, err := vk.NewEndpointResolver("backend.internal:8080", vk.ResolverOptions{
+		Interval: 10 * time.Millisecond,
+		Lookup:   records.lookup,
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, resolver.Warm(context.Background()))
+
+	ts := resolvedProxy(t, resolver)
+
+	assert.Equal(t, "a", proxiedBy(t, ts))
+
+	records.set(b.Listener.Addr().String())
+
+	assert.Eventually(t, func() bool {
+		return proxiedBy(t, ts) == "b"
+	}, 2*time.Second, 20*time.Millisecond)
+
+	stats := resolver.Stats()
+	require.Len(t, stats.Endpoints, 1)
+	assert.Equal(t, b.Listener.Addr().String(), stats.Endpoints[0].Address)
+
+	// both records round-robin once they are both returned
+	records.set(a.Listener.Addr().String(), b.Listener.Addr().String())
+
+	// re-resolution is triggered by requests
+	assert.Eventually(t, func() bool {
+		proxiedBy(t, ts)
+		return len(resolver.Stats().Endpoints) == 2
+	}, 2*time.Second, 20*time.Millisecond)
+
+	seen := map[string]bool{}
+	for i := 0; i < 4; i++ {
+		seen[proxiedBy(t, ts)] = true
+	}
+
+	assert.Equal(t, map[string]bool{"a": true, "b": true}, seen)
+}
+
+func TestResolverEjectsFailingEndpoints(t *testing.T) {
+	a, b := namedUpstream(t, "a"), namedUpstream(t, "b")
+	addrA, addrB := a.Listener.Addr().String(), b.Listener.Addr().String()
+
+	records := &fakeRecords{}
+	records.set(addrA, addrB)
+
+	resolver, err := vk.NewEndpointResolver("backend.internal:8080", vk.ResolverOptions{
+		MaxFailures: 2,
+		EjectFor:    time.Minute,
+		Lookup:      records.lookup,
+	})
+	require.NoError(t, err)
+
+	ts := resolvedProxy(t, resolver)
+
+	assert.Equal(t, "a", proxiedBy(t, ts))
+	assert.Equal(t, "b", proxiedBy(t, ts))
+
+	// a stops accepting connections
+	a.Close()
+
+	results := []string{}
+	for i := 0; i < 10; i++ {
+		results = append(results, proxiedBy(t, ts))
+	}
+
+	failed := 0
+	for _, r := range results {
+		if r != "b" {
+			assert.Equal(t, "502 Bad Gateway", r)
+			failed++
+		}
+	}
+
+	// once a has failed twice in a row, every request goes to b
+	assert.Equal(t, 2, failed)
+	assert.Equal(t, []string{"b", "b", "b", "b", "b"}, results[5:])
+
+	stats := resolver.Stats()
+	require.Len(t, stats.Endpoints, 2)
+
+	byAddress := map[string]vk.EndpointStats{}
+	for _, e := range stats.Endpoints {
+		byAddress[e.Address] = e
+	}
+
+	assert.False(t, byAddress[addrA].Healthy)
+	assert.EqualValues(t, 2, byAddress[addrA].Failures)
+	assert.False(t, byAddress[addrA].EjectedUntil.IsZero())
+
+	assert.True(t, byAddress[addrB].Healthy)
+	assert.Zero(t, byAddress[addrB].Failures)
+}
+
+func TestResolverAddresses(t *testing.T) {
+	records := &fakeRecords{}
+	records.set("10.0.0.2", "10.0.0.1", "10.0.0.1:9090", "10.0.0.2")
+
+	resolver, err := vk.NewEndpointResolver("backend.internal:8080", vk.ResolverOptions{Lookup: records.lookup})
+	require.NoError(t, err)
+
+	require.NoError(t, resolver.Warm(context.Background()))
+
+	// addresses without a port get the target's, and duplicates are dropped
+	addresses := []string{}
+	for _, e := range resolver.Stats().Endpoints {
+		addresses = append(addresses, e.Address)
+		assert.True(t, e.Healthy)
+	}
+
+	assert.Equal(t, []string{"10.0.0.1:8080", "10.0.0.1:9090", "10.0.0.2:8080"}, addresses)
+
+	records.set()
+
+	// a failed lookup keeps the endpoints it had
+	assert.Error(t, resolver.Warm(context.Background()))
+	assert.Len(t, resolver.Stats().Endpoints, 3)
+	assert.Contains(t, resolver.Stats().LastError, "no addresses")
+
+	_, err = vk.NewEndpointResolver("backend.internal", vk.ResolverOptions{})
+	assert.Error(t, err)
+}
+
+func TestResolverSharedAcrossRouters(t *testing.T) {
+	var conns int32
+
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("a"))
+	}))
+
+	upstream.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+
+	upstream.Start()
+	defer upstream.Close()
+
+	records := &fakeRecords{}
+	records.set(upstream.Listener.Addr().String())
+
+	resolver, err := vk.NewEndpointResolver("backend.internal:8080", vk.ResolverOptions{Lookup: records.lookup})
+	require.NoError(t, err)
+
+	require.NoError(t, resolver.Warm(context.Background()))
+
+	server := vk.New(
+		vk.UseLogger(vlog.Noop()),
+		vk.UseFallbackAddress("http://backend.internal:8080"),
+		vk.UseFallbackProxyOptions(vk.ProxyOptions{Resolver: resolver}),
+	)
+
+	require.NoError(t, server.TestStart())
+
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	assert.Equal(t, "a", proxiedBy(t, ts))
+
+	// the swapped in routers' proxies use the resolver's transport, and so the connection it already has
+	for i := 0; i < 3; i++ {
+		server.SwapRouter(vk.NewRouter(vlog.Noop(), "http://backend.internal:8080"))
+
+		assert.Equal(t, "a", proxiedBy(t, ts))
+	}
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&conns))
+}
@@ -0,0 +1,113 @@
+package test_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+	"github.com/suborbital/vektor/vtest"
+)
+
+func bytesHandler(size int) vk.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.RespondBytes(ctx.Context, w, bytes.Repeat([]byte("a"), size), http.StatusOK)
+	}
+}
+
+func TestMaxResponseBytes(t *testing.T) {
+	server := vk.New(vk.UseLogger(vlog.Noop()), vk.UseMaxResponseBytes(64))
+
+	server.GET("/small", bytesHandler(64))
+	server.GET("/large", bytesHandler(1024))
+	server.GET("/write", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		_, err := w.Write(bytes.Repeat([]byte("a"), 1024))
+		return err
+	})
+
+	g := vk.Group("/override")
+	g.GET("/larger", bytesHandler(1024), vk.MaxResponseBytes(2048))
+	g.GET("/smaller", bytesHandler(64), vk.MaxResponseBytes(16))
+	g.GET("/unlimited", bytesHandler(4096), vk.MaxResponseBytes(0))
+	server.AddGroup(g)
+
+	vt := vtest.New(server)
+
+	cases := map[string]struct {
+		status int
+		size   int
+	}{
+		"/small":              {http.StatusOK, 64},
+		"/large":              {http.StatusInternalServerError, len("Internal Server Error")},
+		"/write":              {http.StatusInternalServerError, len("Internal Server Error")},
+		"/override/larger":    {http.StatusOK, 1024},
+		"/override/smaller":   {http.StatusInternalServerError, len("Internal Server Error")},
+		"/override/unlimited": {http.StatusOK, 4096},
+	}
+
+	for path, c := range cases {
+		t.Run(path, func(t *testing.T) {
+			r, _ := http.NewRequest(http.MethodGet, path, nil)
+
+			resp := vt.Do(r, t).AssertStatus(c.status)
+			assert.Len(t, resp.Body, c.size)
+		})
+	}
+}
+
+func TestMaxResponseBytesUnlimitedByDefault(t *testing.T) {
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+	server.GET("/large", bytesHandler(1<<20))
+
+	r, _ := http.NewRequest(http.MethodGet, "/large", nil)
+
+	resp := vtest.New(server).Do(r, t).AssertStatus(http.StatusOK)
+	assert.Len(t, resp.Body, 1<<20)
+}
+
+func TestMaxResponseBytesStream(t *testing.T) {
+	server := vk.New(vk.UseLogger(vlog.Noop()), vk.UseMaxResponseBytes(100))
+
+	produced := make(chan int, 1)
+
+	server.GET("/export", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		rows := 0
+
+		err := vk.NDJSONFunc(func(ctx context.Context) (interface{}, error) {
+			rows++
+			if rows > 100 {
+				return nil, io.EOF
+			}
+
+			return ndjsonRow{rows}, nil
+		}).FlushEvery(1, 0).Respond(w, r, ctx)
+
+		produced <- rows
+
+		return err
+	})
+
+	require.NoError(t, server.TestStart())
+
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/export")
+	require.NoError(t, err)
+
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	body, err := io.ReadAll(resp.Body)
+	assert.Error(t, err, "the connection should be closed rather than the stream completing")
+	assert.LessOrEqual(t, len(body), 100)
+	assert.Less(t, <-produced, 100, "the stream should stop once the cap is crossed")
+}
@@ -0,0 +1,161 @@
+package test_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+)
+
+func TestRetire(t *testing.T) {
+	at := time.Date(2026, time.March, 1, 0, 0, 0, 0, time.UTC)
+	clock := &cacheClock{now: at.Add(-time.Hour)}
+	logs := &logCapture{}
+
+	server := vk.New(
+		vk.UseLogger(vlog.Default(vlog.Level(vlog.LogLevelInfo), vlog.WithWriter(logs))),
+		vk.UseRetirement(vk.RetirementOptions{Now: clock.Now}),
+	)
+
+	var calls int
+
+	users := vk.Group("/v1")
+	users.GET("/users/:id", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		calls++
+		return vk.RespondJSON(ctx.Context, w, map[string]string{"id": ctx.Params.ByName("id")}, http.StatusOK)
+	}, vk.Retire(at, "/v2/users/:id"))
+
+	server.AddGroup(users)
+	require.NoError(t, server.TestStart())
+
+	get := func(clientID string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/v1/users/1", nil)
+		if clientID != "" {
+			r.Header.Set(vk.ClientIDHeader, clientID)
+		}
+
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+
+		return w
+	}
+
+	t.Run("before", func(t *testing.T) {
+		w := get("billing")
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "Sun, 01 Mar 2026 00:00:00 GMT", w.Header().Get("Sunset"))
+		assert.Equal(t, `</v2/users/:id>; rel="successor-version"`, w.Header().Get("Link"))
+		assert.Equal(t, 1, calls)
+	})
+
+	t.Run("cutover", func(t *testing.T) {
+		clock.Advance(time.Hour - time.Nanosecond)
+		assert.Equal(t, http.StatusOK, get("").Code, "the route is served until the instant it retires")
+
+		clock.Advance(time.Nanosecond)
+		w := get("")
+
+		assert.Equal(t, http.StatusGone, w.Code)
+		assert.Equal(t, 2, calls, "the handler isn't called once the route is retired")
+		assert.Empty(t, w.Header().Get("Sunset"))
+		assert.Equal(t, `</v2/users/:id>; rel="successor-version"`, w.Header().Get("Link"))
+
+		body := map[string]interface{}{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		assert.Equal(t, map[string]interface{}{
+			"status":  float64(http.StatusGone),
+			"message": "this route was retired on 2026-03-01T00:00:00Z, use /v2/users/:id instead",
+		}, body)
+	})
+
+	t.Run("callers", func(t *testing.T) {
+		callers := server.Retirements().Callers()
+		require.Len(t, callers, 1)
+
+		assert.Equal(t, "/v1/users/:id", callers[0].Route)
+		assert.Equal(t, at, callers[0].Retirement.At)
+		assert.Equal(t, []vk.RetirementCaller{{Caller: "192.0.2.1", Requests: 2}, {Caller: "billing", Requests: 1}}, callers[0].Callers)
+
+		// the summary is logged by the first request a week after the first was counted
+		clock.Advance(7 * 24 * time.Hour)
+		get("billing")
+
+		var summary string
+		for _, msg := range logs.messages() {
+			if strings.HasPrefix(msg, "(W) retirement:") {
+				summary = msg
+			}
+		}
+
+		assert.Equal(t, "(W) retirement: GET /v1/users/:id was retired on 2026-03-01T00:00:00Z, and was called by 2 clients since "+
+			"2026-02-28T23:00:00Z: 192.0.2.1 (2), billing (1)", summary)
+
+		callers = server.Retirements().Callers()
+		require.Len(t, callers, 1)
+		assert.Equal(t, []vk.RetirementCaller{{Caller: "billing", Requests: 1}}, callers[0].Callers, "counting starts again")
+	})
+
+	t.Run("routes", func(t *testing.T) {
+		routes := server.Routes()
+		require.Len(t, routes, 1)
+
+		assert.Equal(t, &vk.RouteRetirement{At: at, Replacement: "/v2/users/:id"}, routes[0].Retirement)
+		assert.Equal(t, []string{"error", "retire", "handler"}, routes[0].Chain)
+	})
+}
+
+func TestRetireFormatter(t *testing.T) {
+	at := time.Now().Add(-time.Minute)
+
+	legacy := vk.Group("/legacy").WithErrorFormatter(vk.LegacyErrorFormatter(nil))
+	legacy.GET("/report", snapshotHandler, vk.Retire(at, ""))
+
+	router := vk.NewRouter(vlog.Noop(), "")
+	router.WithMiddlewares(vk.ErrorMiddleware())
+	router.AddGroup(legacy)
+	router.Finalize()
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/legacy/report", nil))
+
+	assert.Equal(t, http.StatusGone, w.Code)
+	assert.Empty(t, w.Header().Get("Link"), "there is no successor to link to")
+	assert.Contains(t, w.Body.String(), `"msg":"this route was retired on `+at.UTC().Format(time.RFC3339)+`"`)
+}
+
+func TestRetireMaxCallers(t *testing.T) {
+	at := time.Now().Add(time.Hour)
+
+	server := vk.New(vk.UseLogger(vlog.Noop()), vk.UseRetirement(vk.RetirementOptions{MaxCallers: 2}))
+
+	users := vk.Group("/v1")
+	users.GET("/users/:id", snapshotHandler, vk.Retire(at, ""))
+
+	server.AddGroup(users)
+	require.NoError(t, server.TestStart())
+
+	for _, clientID := range []string{"billing", "billing", "search", "spoofed-1", "spoofed-2", "search"} {
+		r := httptest.NewRequest(http.MethodGet, "/v1/users/1", nil)
+		r.Header.Set(vk.ClientIDHeader, clientID)
+
+		server.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	callers := server.Retirements().Callers()
+	require.Len(t, callers, 1)
+
+	assert.Equal(t, []vk.RetirementCaller{
+		{Caller: "billing", Requests: 2},
+		{Caller: "other", Requests: 2},
+		{Caller: "search", Requests: 2},
+	}, callers[0].Callers)
+}
@@ -0,0 +1,125 @@
+package test_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/suborbital/vektor/vk"
+)
+
+// fakeClock records sleeps and advances time instantly
+type fakeClock struct {
+	now    time.Time
+	sleeps []time.Duration
+}
+
+func (f *fakeClock) policy() vk.RetryPolicy {
+	p := vk.NewRetryPolicy().WithJitter(0)
+	p.Now = func() time.Time { return f.now }
+	p.Sleep = func(_ context.Context, d time.Duration) error {
+		f.sleeps = append(f.sleeps, d)
+		f.now = f.now.Add(d)
+		return nil
+	}
+
+	return p
+}
+
+var errFlaky = errors.New("flaky")
+
+// failing returns a function that fails n times before succeeding, counting its calls
+func failing(n int, calls *int) func(context.Context) error {
+	return func(context.Context) error {
+		*calls++
+		if *calls <= n {
+			return errFlaky
+		}
+
+		return nil
+	}
+}
+
+func TestRetry(t *testing.T) {
+	t.Run("backoff", func(t *testing.T) {
+		clock := &fakeClock{now: time.Now()}
+		policy := clock.policy().WithMaxAttempts(5).WithBackoff(10*time.Millisecond, 25*time.Millisecond)
+
+		calls := 0
+		err := vk.NewCtx(nil, nil, nil).Retry(policy, failing(3, &calls))
+
+		assert.NoError(t, err)
+		assert.Equal(t, 4, calls)
+		assert.Equal(t, []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 25 * time.Millisecond}, clock.sleeps)
+	})
+
+	t.Run("max attempts", func(t *testing.T) {
+		clock := &fakeClock{now: time.Now()}
+
+		calls := 0
+		err := vk.NewCtx(nil, nil, nil).Retry(clock.policy().WithMaxAttempts(2), failing(5, &calls))
+
+		var retryErr *vk.RetryError
+		if assert.True(t, errors.As(err, &retryErr)) {
+			assert.Equal(t, 2, retryErr.Attempts)
+		}
+
+		assert.ErrorIs(t, err, errFlaky)
+		assert.Equal(t, 2, calls)
+	})
+
+	t.Run("not retryable", func(t *testing.T) {
+		clock := &fakeClock{now: time.Now()}
+		policy := clock.policy().WithRetryable(func(err error) bool { return !errors.Is(err, errFlaky) })
+
+		calls := 0
+		err := vk.NewCtx(nil, nil, nil).Retry(policy, failing(5, &calls))
+
+		assert.ErrorIs(t, err, errFlaky)
+		assert.Equal(t, 1, calls)
+		assert.Empty(t, clock.sleeps)
+	})
+
+	t.Run("deadline", func(t *testing.T) {
+		clock := &fakeClock{now: time.Now()}
+		policy := clock.policy().WithMaxAttempts(10).WithBackoff(40*time.Millisecond, time.Second)
+
+		ctx := vk.NewCtx(nil, nil, nil)
+
+		var cancel context.CancelFunc
+		ctx.Context, cancel = context.WithDeadline(ctx.Context, clock.now.Add(100*time.Millisecond))
+		defer cancel()
+
+		calls := 0
+		err := ctx.Retry(policy, failing(10, &calls))
+
+		var retryErr *vk.RetryError
+		if assert.True(t, errors.As(err, &retryErr)) {
+			assert.Equal(t, 2, retryErr.Attempts)
+		}
+
+		// the second backoff (80ms) would have slept past the deadline
+		assert.Equal(t, []time.Duration{40 * time.Millisecond}, clock.sleeps)
+	})
+
+	t.Run("shared budget", func(t *testing.T) {
+		clock := &fakeClock{now: time.Now()}
+		policy := clock.policy().WithMaxAttempts(3).WithBudget(3)
+
+		ctx := vk.NewCtx(nil, nil, nil)
+
+		first, second, third := 0, 0, 0
+
+		assert.Error(t, ctx.Retry(policy, failing(5, &first)))
+		assert.Error(t, ctx.Retry(policy, failing(5, &second)))
+		assert.Error(t, ctx.Retry(policy, failing(5, &third)))
+
+		assert.Equal(t, 3, first)
+		assert.Equal(t, 2, second)
+		assert.Equal(t, 1, third)
+		assert.Len(t, clock.sleeps, 3)
+	})
+}
@@ -0,0 +1,91 @@
+package test_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+)
+
+func routeDumpServer(opts ...vk.OptionsModifier) *vk.Server {
+	server := vk.New(append([]vk.OptionsModifier{vk.UseLogger(vlog.Noop()), vk.UseAppName("dumper")}, opts...)...)
+
+	server.GET("/users/:id", snapshotHandler)
+	server.POST("/users", snapshotHandler)
+	server.GET(`/odd/"quoted"`, snapshotHandler)
+
+	return server
+}
+
+func TestRouteDump(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "routes.json")
+
+	server := routeDumpServer(vk.UseRouteDump(path))
+
+	_, err := os.Stat(path)
+	require.True(t, os.IsNotExist(err), "the routes should only be dumped once they are mounted")
+
+	require.NoError(t, server.TestStart())
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	var dump vk.RouteSnapshot
+	require.NoError(t, json.Unmarshal(data, &dump))
+
+	require.NotNil(t, dump.Build)
+	assert.Equal(t, "dumper", dump.Build.App)
+	assert.Equal(t, runtime.Version(), dump.Build.Go)
+
+	dump.Build = nil
+	assert.Equal(t, server.Snapshot(), dump)
+
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1, "no temporary file should be left behind")
+}
+
+func TestRouteDumpFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missing", "routes.json")
+
+	server := routeDumpServer(vk.UseRouteDump(path))
+
+	require.NoError(t, server.TestStart(), "failing to dump the routes should not stop the server")
+
+	_, err := os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestRouteInfoMetrics(t *testing.T) {
+	server := routeDumpServer()
+	server.AddGroup(vk.OpsGroup(vk.OpsConfig{
+		OpsOptions: vk.OpsOptions{EnableMetrics: true},
+		AppName:    "dumper",
+		Snapshot:   server.Snapshot,
+	}))
+
+	require.NoError(t, server.TestStart())
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/-/metrics", nil))
+
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain; version=0.0.4"))
+
+	assert.Equal(t, `# HELP vk_route_info The routes served by the application.
+# TYPE vk_route_info gauge
+vk_route_info{method="GET",path="/odd/\"quoted\"",name="dumper",domain="default"} 1
+vk_route_info{method="POST",path="/users",name="dumper",domain="default"} 1
+vk_route_info{method="GET",path="/users/:id",name="dumper",domain="default"} 1
+`, w.Body.String(), "ops routes should be left out")
+}
@@ -0,0 +1,276 @@
+package test_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+	"github.com/suborbital/vektor/vtest"
+)
+
+// amount is a decimal with two places, which the API encodes as a string
+type amount struct {
+	cents int64
+}
+
+func encodeAmount(v interface{}) (interface{}, error) {
+	a := v.(amount)
+	return fmt.Sprintf("%d.%02d", a.cents/100, a.cents%100), nil
+}
+
+func decodeAmount(data []byte) (interface{}, error) {
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return nil, err
+	}
+
+	whole, frac, _ := strings.Cut(str, ".")
+
+	w, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := strconv.ParseInt(frac, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	return amount{cents: w*100 + f}, nil
+}
+
+type audit struct {
+	CreatedAt time.Time  `json:"created_at"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+type lineItem struct {
+	SKU   string `json:"sku"`
+	Price amount `json:"price"`
+}
+
+type invoice struct {
+	audit
+	ID       int                 `json:"id,string"`
+	Items    []lineItem          `json:"items"`
+	Totals   map[string]amount   `json:"totals"`
+	Paid     *amount             `json:"paid"`
+	Refunds  []*amount           `json:"refunds,omitempty"`
+	Notes    string              `json:"notes,omitempty"`
+	Extra    interface{}         `json:"extra"`
+	History  map[int][]time.Time `json:"history,omitempty"`
+	internal string
+}
+
+func registerScalars(t testing.TB) {
+	vk.RegisterScalar(reflect.TypeOf(time.Time{}), vk.EncodeTimeRFC3339Milli, vk.DecodeTimeRFC3339)
+	vk.RegisterScalar(reflect.TypeOf(amount{}), encodeAmount, decodeAmount)
+
+	t.Cleanup(func() {
+		vk.UnregisterScalar(reflect.TypeOf(time.Time{}))
+		vk.UnregisterScalar(reflect.TypeOf(amount{}))
+	})
+}
+
+func testInvoice() invoice {
+	created := time.Date(2022, 6, 1, 14, 30, 0, 123456789, time.FixedZone("EST", -5*60*60))
+	paid := amount{cents: 1999}
+
+	return invoice{
+		audit: audit{CreatedAt: created},
+		ID:    42,
+		Items: []lineItem{
+			{SKU: "a-1", Price: amount{cents: 1250}},
+			{SKU: "b-2", Price: amount{cents: 749}},
+		},
+		Totals:   map[string]amount{"net": {cents: 1999}, "tax": {cents: 0}},
+		Paid:     &paid,
+		Refunds:  []*amount{{cents: 100}, nil},
+		Extra:    map[string]interface{}{"at": created},
+		History:  map[int][]time.Time{2: {created}},
+		internal: "hidden",
+	}
+}
+
+const testInvoiceJSON = `{
+	"created_at": "2022-06-01T19:30:00.123Z",
+	"id": "42",
+	"items": [{"sku": "a-1", "price": "12.50"}, {"sku": "b-2", "price": "7.49"}],
+	"totals": {"net": "19.99", "tax": "0.00"},
+	"paid": "19.99",
+	"refunds": ["1.00", null],
+	"extra": {"at": "2022-06-01T19:30:00.123Z"},
+	"history": {"2": ["2022-06-01T19:30:00.123Z"]}
+}`
+
+func TestEncodeJSON(t *testing.T) {
+	registerScalars(t)
+
+	t.Run("nested", func(t *testing.T) {
+		data, err := vk.EncodeJSON(testInvoice())
+		require.NoError(t, err)
+
+		assert.JSONEq(t, testInvoiceJSON, string(data))
+	})
+
+	t.Run("pointer", func(t *testing.T) {
+		inv := testInvoice()
+
+		data, err := vk.EncodeJSON(&inv)
+		require.NoError(t, err)
+
+		assert.JSONEq(t, testInvoiceJSON, string(data))
+	})
+
+	t.Run("field order", func(t *testing.T) {
+		data, err := vk.EncodeJSON(lineItem{SKU: "a-1", Price: amount{cents: 5}})
+		require.NoError(t, err)
+
+		assert.Equal(t, `{"sku":"a-1","price":"0.05"}`, string(data))
+	})
+
+	t.Run("without scalars", func(t *testing.T) {
+		plain := map[string][]string{"a": {"<b>"}}
+
+		expected, _ := json.Marshal(plain)
+
+		data, err := vk.EncodeJSON(plain)
+		require.NoError(t, err)
+
+		assert.Equal(t, string(expected), string(data))
+	})
+}
+
+func TestDecodeJSON(t *testing.T) {
+	registerScalars(t)
+
+	var inv invoice
+	require.NoError(t, vk.DecodeJSON([]byte(testInvoiceJSON), &inv))
+
+	expected := testInvoice()
+
+	assert.True(t, expected.CreatedAt.Equal(inv.CreatedAt.Add(456789)))
+	assert.Equal(t, time.UTC, inv.CreatedAt.Location())
+	assert.Equal(t, 42, inv.ID)
+	assert.Equal(t, expected.Items, inv.Items)
+	assert.Equal(t, expected.Totals, inv.Totals)
+	assert.Equal(t, expected.Paid, inv.Paid)
+	assert.Equal(t, expected.Refunds, inv.Refunds)
+	assert.Len(t, inv.History[2], 1)
+
+	var bad invoice
+	err := vk.DecodeJSON([]byte(`{"items":[{"price":12.5}]}`), &bad)
+	assert.Error(t, err)
+}
+
+func TestScalarsInResponses(t *testing.T) {
+	registerScalars(t)
+
+	logs := &logCapture{}
+
+	server := vk.New(
+		vk.UseLogger(vlog.Default(vlog.Level(vlog.LogLevelInfo), vlog.WithWriter(logs))),
+		vk.UseDevMode(true),
+	)
+
+	server.POST("/invoices", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		var inv invoice
+		if err := vk.ReadJSON(r, &inv); err != nil {
+			return err
+		}
+
+		inv.Paid = nil
+
+		return vk.RespondJSON(ctx.Context, w, inv, http.StatusCreated)
+	})
+
+	type naive struct {
+		At time.Time `json:"at"`
+	}
+
+	server.GET("/naive", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.RespondJSON(ctx.Context, w, naive{}, http.StatusOK)
+	})
+
+	vt := vtest.New(server)
+
+	t.Run("round trip", func(t *testing.T) {
+		r, _ := http.NewRequest(http.MethodPost, "/invoices", strings.NewReader(testInvoiceJSON))
+
+		resp := vt.Do(r, t).AssertStatus(http.StatusCreated)
+
+		var body map[string]interface{}
+		require.NoError(t, json.Unmarshal(resp.Body, &body))
+
+		assert.Equal(t, "2022-06-01T19:30:00.123Z", body["created_at"])
+		assert.Equal(t, "42", body["id"])
+		assert.Nil(t, body["paid"])
+	})
+
+	t.Run("bad request", func(t *testing.T) {
+		r, _ := http.NewRequest(http.MethodPost, "/invoices", strings.NewReader(`{"created_at":"yesterday"}`))
+
+		vt.Do(r, t).AssertStatus(http.StatusBadRequest)
+	})
+
+	t.Run("naive time in dev mode", func(t *testing.T) {
+		vk.UnregisterScalar(reflect.TypeOf(time.Time{}))
+
+		r, _ := http.NewRequest(http.MethodGet, "/naive", nil)
+		vt.Do(r, t).AssertStatus(http.StatusOK)
+		vt.Do(r, t).AssertStatus(http.StatusOK)
+
+		warnings := 0
+		for _, m := range logs.messages() {
+			if strings.Contains(m, "without a registered scalar") {
+				warnings++
+			}
+		}
+
+		assert.Equal(t, 1, warnings)
+	})
+}
+
+func BenchmarkEncodeJSON(b *testing.B) {
+	registerScalars(b)
+
+	inv := testInvoice()
+
+	b.Run("json.Marshal", func(b *testing.B) {
+		b.ReportAllocs()
+
+		for i := 0; i < b.N; i++ {
+			_, _ = json.Marshal(inv)
+		}
+	})
+
+	b.Run("EncodeJSON", func(b *testing.B) {
+		b.ReportAllocs()
+
+		for i := 0; i < b.N; i++ {
+			_, _ = vk.EncodeJSON(inv)
+		}
+	})
+
+	// types without scalars are handed straight to json.Marshal
+	plain := []lineItem{{SKU: "a-1"}, {SKU: "b-2"}}
+	vk.UnregisterScalar(reflect.TypeOf(amount{}))
+
+	b.Run("EncodeJSON without scalars", func(b *testing.B) {
+		b.ReportAllocs()
+
+		for i := 0; i < b.N; i++ {
+			_, _ = vk.EncodeJSON(plain)
+		}
+	})
+}
@@ -0,0 +1,189 @@
+package test_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+	"github.com/suborbital/vektor/vtest"
+)
+
+var (
+	stateKeyOld = bytes.Repeat([]byte{1}, vk.StateKeySize)
+	stateKeyNew = bytes.Repeat([]byte{2}, vk.StateKeySize)
+)
+
+type oauthState struct {
+	Redirect string `json:"redirect"`
+	Verifier string `json:"verifier"`
+}
+
+// stateServer seals a flow's state on /start, and opens it from the state query parameter or form field on /callback
+func stateServer(clock *healthClock, keys ...[]byte) *vk.Server {
+	server := vk.New(
+		vk.UseLogger(vlog.Noop()),
+		vk.UseStateSealing(vk.StateSealingOptions{Keys: keys, MaxBytes: 512, Now: clock.Now}),
+	)
+
+	server.POST("/start", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		var state oauthState
+		if err := json.NewDecoder(r.Body).Decode(&state); err != nil {
+			return vk.E(http.StatusBadRequest, "invalid state")
+		}
+
+		token, err := ctx.SealState(state, time.Minute)
+		if err != nil {
+			return err
+		}
+
+		return vk.RespondString(ctx.Context, w, token, http.StatusOK)
+	})
+
+	callback := func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		var state oauthState
+		if err := ctx.OpenState(r.FormValue("state"), &state); err != nil {
+			return err
+		}
+
+		return vk.RespondJSON(ctx.Context, w, state, http.StatusOK)
+	}
+
+	server.GET("/callback", callback)
+	server.POST("/callback", callback)
+
+	return server
+}
+
+func sealState(t *testing.T, vt *vtest.VTest, state oauthState) string {
+	body, _ := json.Marshal(state)
+
+	req, _ := http.NewRequest(http.MethodPost, "/start", bytes.NewReader(body))
+
+	return string(vt.Do(req, t).AssertStatus(http.StatusOK).Body)
+}
+
+func openState(t *testing.T, vt *vtest.VTest, token string) *vtest.Response {
+	req, _ := http.NewRequest(http.MethodGet, "/callback?state="+token, nil)
+
+	return vt.Do(req, t)
+}
+
+func assertStateCode(t *testing.T, resp *vtest.Response, code string) {
+	resp.AssertStatus(http.StatusBadRequest)
+
+	body := map[string]interface{}{}
+	assert.NoError(t, json.Unmarshal(resp.Body, &body))
+	assert.Equal(t, code, body["code"])
+}
+
+func TestSealedState(t *testing.T) {
+	clock := &healthClock{now: time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)}
+	vt := vtest.New(stateServer(clock, stateKeyOld))
+
+	state := oauthState{Redirect: "https://app.example.com/done?x=1&y=2", Verifier: "s3cr3t"}
+
+	token := sealState(t, vt, state)
+
+	t.Run("round trip in a query parameter", func(t *testing.T) {
+		assert.Equal(t, url.QueryEscape(token), token, "the token should be URL-safe")
+		assert.NotContains(t, token, "s3cr3t")
+
+		resp := openState(t, vt, token).AssertStatus(http.StatusOK)
+		assert.JSONEq(t, `{"redirect": "https://app.example.com/done?x=1&y=2", "verifier": "s3cr3t"}`, string(resp.Body))
+	})
+
+	t.Run("round trip in a form field", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodPost, "/callback", strings.NewReader(url.Values{"state": {token}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		vt.Do(req, t).AssertStatus(http.StatusOK)
+	})
+
+	t.Run("tampered", func(t *testing.T) {
+		sealed, err := base64.RawURLEncoding.DecodeString(token)
+		require.NoError(t, err)
+
+		for _, i := range []int{0, 1, 10, len(sealed) - 1} {
+			tampered := append([]byte{}, sealed...)
+			tampered[i] ^= 0x01
+
+			assertStateCode(t, openState(t, vt, base64.RawURLEncoding.EncodeToString(tampered)), vk.StateInvalid)
+		}
+
+		assertStateCode(t, openState(t, vt, "not-a-token"), vk.StateInvalid)
+		assertStateCode(t, openState(t, vt, token[:len(token)-4]), vk.StateInvalid)
+	})
+
+	t.Run("too large", func(t *testing.T) {
+		assertStateCode(t, openState(t, vt, strings.Repeat("A", 513)), vk.StateTooLarge)
+
+		body, _ := json.Marshal(oauthState{Verifier: strings.Repeat("v", 512)})
+		req, _ := http.NewRequest(http.MethodPost, "/start", bytes.NewReader(body))
+
+		assertStateCode(t, vt.Do(req, t), vk.StateTooLarge)
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		clock.advance(time.Minute - time.Millisecond)
+		openState(t, vt, token).AssertStatus(http.StatusOK)
+
+		clock.advance(time.Millisecond)
+		assertStateCode(t, openState(t, vt, token), vk.StateExpired)
+	})
+}
+
+func TestSealedStateRotation(t *testing.T) {
+	clock := &healthClock{now: time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)}
+
+	before := vtest.New(stateServer(clock, stateKeyOld))
+	during := vtest.New(stateServer(clock, stateKeyNew, stateKeyOld))
+	after := vtest.New(stateServer(clock, stateKeyNew))
+
+	state := oauthState{Redirect: "/done"}
+
+	oldToken := sealState(t, before, state)
+	newToken := sealState(t, during, state)
+
+	// the old key still opens its tokens, while the new one seals
+	openState(t, during, oldToken).AssertStatus(http.StatusOK)
+	openState(t, during, newToken).AssertStatus(http.StatusOK)
+	openState(t, after, newToken).AssertStatus(http.StatusOK)
+
+	// without it, its tokens are invalid
+	assertStateCode(t, openState(t, after, oldToken), vk.StateInvalid)
+	assertStateCode(t, openState(t, before, newToken), vk.StateInvalid)
+}
+
+func TestSealedStateErrors(t *testing.T) {
+	_, err := vk.NewStateSealer(vk.StateSealingOptions{})
+	assert.Error(t, err)
+
+	_, err = vk.NewStateSealer(vk.StateSealingOptions{Keys: [][]byte{[]byte("short")}})
+	assert.Error(t, err)
+
+	server := vk.New(vk.UseLogger(vlog.Noop()), vk.UseStateSealing(vk.StateSealingOptions{Keys: [][]byte{[]byte("short")}}))
+	assert.ErrorContains(t, server.Options().Validate(), "StateSealing: key 0 is 5 bytes, expected 32")
+
+	// without keys, state can't be sealed
+	ctx := vk.NewCtx(nil, nil, nil)
+
+	_, err = ctx.SealState("state", time.Minute)
+	assert.Error(t, err)
+
+	var stateErr *vk.StateError
+	assert.False(t, errors.As(err, &stateErr), "a server without keys isn't the client's fault")
+
+	var e vk.Error = vk.ErrStateExpired
+	assert.Equal(t, http.StatusBadRequest, e.Status())
+}
@@ -0,0 +1,144 @@
+package test_test
+
+import (
+	"math"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+	"github.com/suborbital/vektor/vtest"
+)
+
+func TestSheddingByPriority(t *testing.T) {
+	var load uint64 // float64 bits
+
+	setLoad := func(v float64) { atomic.StoreUint64(&load, math.Float64bits(v)) }
+
+	shedder := vk.NewShedder(vk.SheddingOptions{
+		Signal:        func() float64 { return math.Float64frombits(atomic.LoadUint64(&load)) },
+		LowWatermark:  0.6,
+		HighWatermark: 0.8,
+		Hysteresis:    0.1,
+	})
+
+	ok := func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.RespondString(ctx.Context, w, "ok", http.StatusOK)
+	}
+
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+
+	g := vk.Group("").WithMiddlewares(shedder.Middleware())
+	g.GET("/low", ok, vk.Priority(vk.Low))
+	g.GET("/normal", ok)
+	g.GET("/high", ok, vk.Priority(vk.High))
+	server.AddGroup(g)
+
+	vt := vtest.New(server)
+
+	assertStatuses := func(low, normal, high int) {
+		t.Helper()
+
+		for path, status := range map[string]int{"/low": low, "/normal": normal, "/high": high} {
+			r, err := http.NewRequest(http.MethodGet, path, nil)
+			require.NoError(t, err)
+
+			vt.Do(r, t).AssertStatus(status)
+		}
+	}
+
+	const shed = http.StatusServiceUnavailable
+
+	steps := []struct {
+		name              string
+		load              float64
+		low, normal, high int
+	}{
+		{"idle", 0.2, http.StatusOK, http.StatusOK, http.StatusOK},
+		{"low watermark", 0.6, shed, http.StatusOK, http.StatusOK},
+		{"high watermark", 0.85, shed, shed, http.StatusOK},
+		{"overloaded", 5, shed, shed, http.StatusOK},
+		{"within hysteresis of high", 0.75, shed, shed, http.StatusOK},
+		{"below high", 0.7, shed, http.StatusOK, http.StatusOK},
+		{"within hysteresis of low", 0.56, shed, http.StatusOK, http.StatusOK},
+		{"recovered", 0.5, http.StatusOK, http.StatusOK, http.StatusOK},
+	}
+
+	for _, step := range steps {
+		t.Run(step.name, func(t *testing.T) {
+			setLoad(step.load)
+			assertStatuses(step.low, step.normal, step.high)
+		})
+	}
+
+	stats := shedder.Stats()
+	assert.Empty(t, stats.Shedding)
+	assert.Equal(t, map[string]uint64{"low": 6, "normal": 3, "high": 0}, stats.Shed)
+}
+
+func TestSheddingInFlight(t *testing.T) {
+	shedder := vk.NewShedder(vk.SheddingOptions{LowWatermark: 1, HighWatermark: 2})
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+
+	blocking := func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		started <- struct{}{}
+		<-release
+
+		return vk.RespondString(ctx.Context, w, "ok", http.StatusOK)
+	}
+
+	ok := func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.RespondString(ctx.Context, w, "ok", http.StatusOK)
+	}
+
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+
+	g := vk.Group("").WithMiddlewares(shedder.Middleware())
+	g.GET("/block", blocking, vk.Priority(vk.High))
+	g.GET("/low", ok, vk.Priority(vk.Low))
+	g.GET("/normal", ok)
+	server.AddGroup(g)
+
+	vt := vtest.New(server)
+
+	get := func(path string) *http.Request {
+		r, err := http.NewRequest(http.MethodGet, path, nil)
+		require.NoError(t, err)
+
+		return r
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		vt.Do(get("/block"), t)
+	}()
+
+	<-started
+
+	assert.Equal(t, int64(1), shedder.Stats().InFlight)
+
+	vt.Do(get("/low"), t).AssertStatus(http.StatusServiceUnavailable)
+	vt.Do(get("/normal"), t).AssertStatus(http.StatusOK)
+
+	assert.Equal(t, []string{"low"}, shedder.Stats().Shedding)
+
+	close(release)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("blocked request did not complete")
+	}
+
+	vt.Do(get("/low"), t).AssertStatus(http.StatusOK)
+	assert.Equal(t, int64(0), shedder.Stats().InFlight)
+}
@@ -0,0 +1,250 @@
+package test_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+)
+
+// logCapture collects the messages written by a vlog.Logger
+type logCapture struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (l *logCapture) Write(p []byte) (int, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.buf.Write(p)
+}
+
+func (l *logCapture) messages() []string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	var messages []string
+
+	for _, line := range strings.Split(strings.TrimSpace(l.buf.String()), "\n") {
+		var structured struct {
+			Message string `json:"log_message"`
+		}
+
+		if json.Unmarshal([]byte(line), &structured) == nil {
+			messages = append(messages, structured.Message)
+		}
+	}
+
+	return messages
+}
+
+// summary returns the final shutdown summary message
+func (l *logCapture) summary() string {
+	for _, m := range l.messages() {
+		if strings.Contains(m, "shutdown completed") {
+			return m
+		}
+	}
+
+	return ""
+}
+
+// shutdownClock is a fake clock advanced by the phases under test
+type shutdownClock struct {
+	lock sync.Mutex
+	now  time.Time
+	ran  []string
+}
+
+func (c *shutdownClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.now
+}
+
+func (c *shutdownClock) phase(name string, d time.Duration) func(context.Context) error {
+	return func(context.Context) error {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+
+		c.ran = append(c.ran, name)
+		c.now = c.now.Add(d)
+
+		return nil
+	}
+}
+
+func shutdownServer(plan vk.ShutdownPlan) (*vk.Server, *logCapture) {
+	logs := &logCapture{}
+
+	server := vk.New(
+		vk.UseLogger(vlog.Default(vlog.Level(vlog.LogLevelInfo), vlog.WithWriter(logs))),
+		vk.UseShutdownPlan(plan),
+	)
+
+	return server, logs
+}
+
+func TestShutdownPlan(t *testing.T) {
+	clock := &shutdownClock{now: time.Now()}
+
+	plan := vk.ShutdownPlan{Now: clock.Now}.
+		Then("readiness-fail", time.Second, clock.phase("readiness-fail", 2*time.Second)).
+		Then(vk.ShutdownPhaseHTTPDrain, time.Second, nil).
+		Then("background-wait", time.Second, clock.phase("background-wait", 300*time.Millisecond)).
+		Then("hooks", time.Second, clock.phase("hooks", 50*time.Millisecond))
+
+	server, logs := shutdownServer(plan)
+
+	assert.NoError(t, server.Shutdown(context.Background()))
+	assert.Equal(t, []string{"readiness-fail", "background-wait", "hooks"}, clock.ran)
+	assert.Equal(t, "(I) shutdown completed in 2350ms: readiness-fail 2000ms, http-drain 0ms, background-wait 300ms, hooks 50ms", logs.summary())
+
+	var events []vk.ServerEvent
+	for event := range server.Events() {
+		events = append(events, event)
+	}
+
+	assert.Equal(t, []vk.ServerEvent{vk.ShutdownStarted{Reason: "shutdown"}, vk.DrainProgress{}, vk.Stopped{}}, events)
+}
+
+func TestShutdownPlanBudget(t *testing.T) {
+	clock := &shutdownClock{now: time.Now()}
+
+	stuck := make(chan struct{})
+	defer close(stuck)
+
+	plan := vk.DefaultShutdownPlan().
+		Then("ws-notify", 10*time.Millisecond, func(context.Context) error {
+			<-stuck // ignores its context
+			return nil
+		}).
+		Then("hooks", time.Second, clock.phase("hooks", 0))
+
+	server, logs := shutdownServer(plan)
+
+	err := server.Shutdown(context.Background())
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, err, server.Err())
+
+	assert.Equal(t, []string{"hooks"}, clock.ran, "later phases should run after a phase is abandoned")
+	assert.Contains(t, logs.summary(), "ws-notify")
+	assert.Contains(t, logs.summary(), "(exceeded budget), hooks")
+}
+
+func TestShutdownPlanDeadline(t *testing.T) {
+	clock := &shutdownClock{now: time.Now()}
+
+	plan := vk.ShutdownPlan{}.
+		Then("ws-notify", time.Second, func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}).
+		Then("hooks", time.Second, clock.phase("hooks", 0)).
+		WithDeadline(10 * time.Millisecond)
+
+	server, logs := shutdownServer(plan)
+
+	assert.Error(t, server.Shutdown(context.Background()))
+	assert.Empty(t, clock.ran, "phases after the deadline should be abandoned")
+	assert.Contains(t, logs.summary(), "hooks skipped")
+}
+
+// startCtxServer starts a server with StartCtx and makes a request to its /slow route, which waits for release. It
+// returns once the request is being handled
+func startCtxServer(t *testing.T, ctx context.Context, release chan struct{}, opts ...vk.OptionsModifier) (startErr, respErr chan error) {
+	port := freePort(t)
+
+	server := vk.New(append([]vk.OptionsModifier{vk.UseLogger(vlog.Noop()), vk.UseHTTPPort(port)}, opts...)...)
+
+	entered := make(chan struct{})
+
+	server.GET("/slow", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		close(entered)
+		<-release
+
+		return vk.RespondString(ctx.Context, w, "done", http.StatusOK)
+	})
+
+	events := server.Events()
+
+	startErr = make(chan error, 1)
+	go func() {
+		startErr <- server.StartCtx(ctx)
+	}()
+
+	for {
+		if _, ready := nextEvent(t, events).(vk.Ready); ready {
+			break
+		}
+	}
+
+	respErr = make(chan error, 1)
+	go func() {
+		resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/slow", port))
+		if err == nil {
+			_, err = io.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+
+		respErr <- err
+	}()
+
+	<-entered
+
+	return startErr, respErr
+}
+
+func TestStartCtxDrained(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	release := make(chan struct{})
+
+	startErr, respErr := startCtxServer(t, ctx, release, vk.UseShutdownTimeout(2*time.Second))
+
+	cancel()
+
+	select {
+	case <-startErr:
+		t.Fatal("the server stopped before its in-flight request completed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+
+	require.NoError(t, <-respErr)
+	assert.NoError(t, <-startErr)
+}
+
+func TestStartCtxTimedOut(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	release := make(chan struct{})
+
+	defer close(release)
+
+	startErr, respErr := startCtxServer(t, ctx, release, vk.UseShutdownTimeout(50*time.Millisecond))
+
+	cancel()
+
+	select {
+	case err := <-startErr:
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	case <-time.After(2 * time.Second):
+		t.Fatal("the server did not stop after its shutdown timeout")
+	}
+
+	assert.Error(t, <-respErr, "the request's connection should be closed")
+}
@@ -0,0 +1,331 @@
+package test_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+	"github.com/suborbital/vektor/vtest"
+)
+
+const (
+	partnerKeyID  = "AKIDPARTNER"
+	partnerSecret = "vk-partner-secret"
+)
+
+// signingVectors are the canonical requests, strings to sign and signatures of fixed requests, for partners to test
+// their clients against. They were computed independently of vk from the canonicalization of vk.SigningScheme
+var signingVectors = []struct {
+	name          string
+	method        string
+	url           string
+	headers       map[string]string
+	body          string
+	signed        []string
+	canonical     string
+	toSign        string
+	authorization string
+}{
+	{
+		name:   "POST with a query, an encoded path and a signed content type",
+		method: http.MethodPost,
+		url:    "https://api.example.com/v1/orders/A-100%20x?b=x+y&a=1&a-b=z&a=0",
+		headers: map[string]string{
+			"Content-Type": "  application/json ",
+			"X-Vk-Date":    "20261016T120000Z",
+			"X-Vk-Nonce":   "4f1c2a",
+		},
+		body:   `{"sku":"A-100","qty":2}`,
+		signed: []string{"Host", "X-Vk-Nonce", "content-type", "x-vk-date"},
+		canonical: "POST\n" +
+			"/v1/orders/A-100%20x\n" +
+			"a=0&a=1&a-b=z&b=x%20y\n" +
+			"content-type:application/json\n" +
+			"host:api.example.com\n" +
+			"x-vk-date:20261016T120000Z\n" +
+			"x-vk-nonce:4f1c2a\n" +
+			"content-type;host;x-vk-date;x-vk-nonce\n" +
+			"5d2fc70f93576c3347f25b51541151a9acfb5f1879400da4217bd0bb66e822e8",
+		toSign: "VK-HMAC-SHA256\n" +
+			"20261016T120000Z\n" +
+			"622d7d1dc752ae863d4d7d42416ca5bbd95784f027cb916e3ac9050986d518c5",
+		authorization: "VK-HMAC-SHA256 Credential=AKIDPARTNER, SignedHeaders=content-type;host;x-vk-date;x-vk-nonce, " +
+			"Signature=3d4ac9ad101fd947db4f0b0043f8e5764d922acb5dcd1d129a2b8cf51fda959c",
+	},
+	{
+		name:   "GET without a path, query or body",
+		method: http.MethodGet,
+		url:    "https://api.example.com",
+		headers: map[string]string{
+			"X-Vk-Date":  "20261016T120000Z",
+			"X-Vk-Nonce": "n2",
+		},
+		signed: []string{"host", "x-vk-date", "x-vk-nonce"},
+		canonical: "GET\n" +
+			"/\n" +
+			"\n" +
+			"host:api.example.com\n" +
+			"x-vk-date:20261016T120000Z\n" +
+			"x-vk-nonce:n2\n" +
+			"host;x-vk-date;x-vk-nonce\n" +
+			"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		authorization: "VK-HMAC-SHA256 Credential=AKIDPARTNER, SignedHeaders=host;x-vk-date;x-vk-nonce, " +
+			"Signature=928153b0d9718b228de1889112b7d83a56747caf7153a3d0a71c66e5ef1d8bd6",
+	},
+}
+
+func vectorRequest(t *testing.T, method, url string, headers map[string]string, body string) *http.Request {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	return req
+}
+
+func TestSigningVectors(t *testing.T) {
+	scheme := vk.SigningScheme{SignedHeaders: []string{"Content-Type"}}
+	signedAt, _ := time.Parse("20060102T150405Z", "20261016T120000Z")
+
+	for _, v := range signingVectors {
+		t.Run(v.name, func(t *testing.T) {
+			req := vectorRequest(t, v.method, v.url, v.headers, v.body)
+
+			canonical := scheme.CanonicalRequest(req, v.signed, []byte(v.body))
+			assert.Equal(t, v.canonical, canonical)
+
+			if v.toSign != "" {
+				assert.Equal(t, v.toSign, scheme.StringToSign("20261016T120000Z", canonical))
+			}
+
+			// a client signing the same headers gives the vector's signature
+			client := vk.SigningScheme{Now: func() time.Time { return signedAt }}
+			if _, ok := v.headers["Content-Type"]; ok {
+				client.SignedHeaders = []string{"Content-Type"}
+			}
+
+			signed := vectorRequest(t, v.method, v.url, v.headers, v.body)
+			assert.NoError(t, client.Sign(signed, partnerKeyID, []byte(partnerSecret)))
+			assert.Equal(t, v.authorization, signed.Header.Get("Authorization"))
+		})
+	}
+}
+
+func signingServer(now *time.Time, resolves *int32) *vk.Server {
+	keys := vk.CachedKeyResolver(vk.KeyResolverFunc(func(ctx context.Context, accessKeyID string) ([]byte, error) {
+		atomic.AddInt32(resolves, 1)
+
+		if accessKeyID != partnerKeyID {
+			return nil, vk.ErrUnknownAccessKey
+		}
+
+		return []byte(partnerSecret), nil
+	}), time.Minute)
+
+	scheme := vk.SigningScheme{
+		SignedHeaders: []string{"Content-Type"},
+		MaxSkew:       time.Minute,
+		Now:           func() time.Time { return *now },
+	}
+
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+
+	partners := vk.Group("/v1").WithMiddlewares(vk.SignedRequestMiddleware(scheme, keys))
+	partners.POST("/orders/:sku", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		var order map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&order); err != nil {
+			return vk.E(http.StatusBadRequest, "invalid order")
+		}
+
+		return vk.RespondJSON(ctx.Context, w, map[string]interface{}{"key": ctx.Get(vk.AccessKeyIDKey), "qty": order["qty"]}, http.StatusOK)
+	})
+
+	server.AddGroup(partners)
+
+	return server
+}
+
+func TestSignedRequestMiddleware(t *testing.T) {
+	now, _ := time.Parse("20060102T150405Z", "20261016T120000Z")
+
+	var resolves int32
+	vt := vtest.New(signingServer(&now, &resolves))
+
+	client := vk.SigningScheme{SignedHeaders: []string{"Content-Type"}, Now: func() time.Time { return now }}
+
+	signed := func(t *testing.T, keyID string, nonce string) *http.Request {
+		req := vectorRequest(t, http.MethodPost, "/v1/orders/A-100", map[string]string{"Content-Type": "application/json", "X-Vk-Nonce": nonce}, `{"qty":2}`)
+		req.Host = "api.example.com"
+
+		assert.NoError(t, client.Sign(req, keyID, []byte(partnerSecret)))
+
+		return req
+	}
+
+	assertCode := func(t *testing.T, resp *vtest.Response, code string) {
+		resp.AssertStatus(http.StatusUnauthorized).AssertHeader("WWW-Authenticate", "VK-HMAC-SHA256")
+
+		body := map[string]interface{}{}
+		assert.NoError(t, json.Unmarshal(resp.Body, &body))
+		assert.Equal(t, code, body["code"])
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		resp := vt.Do(signed(t, partnerKeyID, "nonce-1"), t).AssertStatus(http.StatusOK)
+		assert.JSONEq(t, `{"key": "AKIDPARTNER", "qty": 2}`, string(resp.Body))
+	})
+
+	t.Run("replayed", func(t *testing.T) {
+		assertCode(t, vt.Do(signed(t, partnerKeyID, "nonce-1"), t), vk.SignatureReplayed)
+	})
+
+	t.Run("tampered body", func(t *testing.T) {
+		req := signed(t, partnerKeyID, "nonce-2")
+		req.Body = vectorRequest(t, http.MethodPost, "/", nil, `{"qty":200}`).Body
+
+		resp := vt.Do(req, t)
+		assertCode(t, resp, vk.SignatureMismatch)
+		assert.NotContains(t, string(resp.Body), "body", "the error shouldn't say what didn't match")
+	})
+
+	t.Run("tampered query", func(t *testing.T) {
+		req := signed(t, partnerKeyID, "nonce-3")
+		req.URL.RawQuery = "dry_run=false"
+
+		assertCode(t, vt.Do(req, t), vk.SignatureMismatch)
+	})
+
+	t.Run("the tampered request's nonce can still be used", func(t *testing.T) {
+		vt.Do(signed(t, partnerKeyID, "nonce-3"), t).AssertStatus(http.StatusOK)
+	})
+
+	t.Run("unknown key", func(t *testing.T) {
+		assertCode(t, vt.Do(signed(t, "AKIDUNKNOWN", "nonce-4"), t), vk.SignatureUnknownKey)
+		assertCode(t, vt.Do(signed(t, "AKIDUNKNOWN", "nonce-5"), t), vk.SignatureUnknownKey)
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		req := signed(t, partnerKeyID, "nonce-6")
+		now = now.Add(2 * time.Minute)
+		defer func() { now = now.Add(-2 * time.Minute) }()
+
+		assertCode(t, vt.Do(req, t), vk.SignatureExpired)
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		req := vectorRequest(t, http.MethodPost, "/v1/orders/A-100", nil, `{"qty":2}`)
+		assertCode(t, vt.Do(req, t), vk.SignatureMissing)
+	})
+
+	t.Run("required header unsigned", func(t *testing.T) {
+		req := signed(t, partnerKeyID, "nonce-7")
+		req.Header.Set("Authorization", strings.Replace(req.Header.Get("Authorization"), "content-type;", "", 1))
+
+		assertCode(t, vt.Do(req, t), vk.SignatureMalformed)
+	})
+
+	// the cached resolver looked up each key once, including the unknown one
+	assert.Equal(t, int32(2), atomic.LoadInt32(&resolves))
+}
+
+func TestSignedRequestNonceLimit(t *testing.T) {
+	now, _ := time.Parse("20060102T150405Z", "20261016T120000Z")
+
+	keys := vk.KeyResolverFunc(func(ctx context.Context, accessKeyID string) ([]byte, error) {
+		return []byte(partnerSecret), nil
+	})
+
+	scheme := vk.SigningScheme{MaxSkew: time.Minute, MaxNonces: 2, Now: func() time.Time { return now }}
+
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+
+	partners := vk.Group("/v1").WithMiddlewares(vk.SignedRequestMiddleware(scheme, keys))
+	partners.GET("/orders", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.RespondString(ctx.Context, w, "orders", http.StatusOK)
+	})
+
+	server.AddGroup(partners)
+
+	vt := vtest.New(server)
+
+	do := func(keyID, nonce string) *vtest.Response {
+		req, _ := http.NewRequest(http.MethodGet, "/v1/orders", nil)
+		req.Host = "api.example.com"
+		req.Header.Set("X-Vk-Nonce", nonce)
+
+		assert.NoError(t, scheme.Sign(req, keyID, []byte(partnerSecret)))
+
+		return vt.Do(req, t)
+	}
+
+	do(partnerKeyID, "nonce-1").AssertStatus(http.StatusOK)
+	do(partnerKeyID, "nonce-2").AssertStatus(http.StatusOK)
+
+	// the key's nonces aren't forgotten to make room, so they can't be replayed
+	resp := do(partnerKeyID, "nonce-3").AssertStatus(http.StatusTooManyRequests)
+	assert.Contains(t, string(resp.Body), vk.SignatureTooMany)
+
+	resp = do(partnerKeyID, "nonce-1").AssertStatus(http.StatusUnauthorized)
+	assert.Contains(t, string(resp.Body), vk.SignatureReplayed)
+
+	// other keys have nonces of their own
+	do("AKIDOTHER", "nonce-1").AssertStatus(http.StatusOK)
+
+	// once the nonces expire, there is room again
+	now = now.Add(2 * time.Minute)
+
+	do(partnerKeyID, "nonce-3").AssertStatus(http.StatusOK)
+}
+
+func TestCachedKeyResolverBounded(t *testing.T) {
+	// vk caches at most 10000 access key IDs
+	const maxCachedKeys = 10000
+
+	var resolves int32
+
+	keys := vk.CachedKeyResolver(vk.KeyResolverFunc(func(ctx context.Context, accessKeyID string) ([]byte, error) {
+		atomic.AddInt32(&resolves, 1)
+
+		if accessKeyID != partnerKeyID {
+			return nil, vk.ErrUnknownAccessKey
+		}
+
+		return []byte(partnerSecret), nil
+	}), time.Hour)
+
+	resolve := func(accessKeyID string) error {
+		_, err := keys.ResolveKey(context.Background(), accessKeyID)
+		return err
+	}
+
+	assert.NoError(t, resolve(partnerKeyID))
+
+	// made up IDs sent within the ttl, none of which have expired
+	for i := 0; i < maxCachedKeys+100; i++ {
+		assert.ErrorIs(t, resolve(fmt.Sprintf("unknown-%d", i)), vk.ErrUnknownAccessKey)
+	}
+
+	assert.Equal(t, int32(maxCachedKeys+101), atomic.LoadInt32(&resolves))
+
+	// the most recent are still cached
+	assert.ErrorIs(t, resolve(fmt.Sprintf("unknown-%d", maxCachedKeys+99)), vk.ErrUnknownAccessKey)
+	assert.Equal(t, int32(maxCachedKeys+101), atomic.LoadInt32(&resolves))
+
+	// while the oldest have been evicted to stay within the limit
+	assert.NoError(t, resolve(partnerKeyID))
+	assert.ErrorIs(t, resolve("unknown-0"), vk.ErrUnknownAccessKey)
+	assert.Equal(t, int32(maxCachedKeys+103), atomic.LoadInt32(&resolves))
+}
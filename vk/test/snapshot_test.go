@@ -0,0 +1,99 @@
+package test_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+)
+
+func snapshotHandler(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+	return nil
+}
+
+// snapshotRouter builds the same route table, adding its groups and routes in the given order
+func snapshotRouter(reversed bool, maxBytes int64) *vk.Router {
+	users := vk.Group("/users").WithMiddlewares(vk.BodyLimitMiddleware(maxBytes))
+	users.GET("/:id", snapshotHandler)
+	users.DELETE("/:id", snapshotHandler)
+
+	beta := vk.Group("/beta").WithFlag("search").WithFlag("beta")
+	beta.GET("/search", snapshotHandler)
+
+	router := vk.NewRouter(vlog.Noop(), "")
+
+	groups := []*vk.RouteGroup{users, beta}
+	if reversed {
+		groups = []*vk.RouteGroup{beta, users}
+	}
+
+	for _, g := range groups {
+		router.AddGroup(g)
+	}
+
+	return router
+}
+
+func TestRouteSnapshot(t *testing.T) {
+	snapshot := snapshotRouter(false, 10).Snapshot()
+
+	assert.Equal(t, vk.RouteSnapshot{
+		Version: vk.RouteSnapshotVersion,
+		Routes: []vk.SnapshotRoute{
+			{Method: http.MethodGet, Path: "/beta/search", Middleware: []string{}, Flags: []string{"beta", "search"}},
+			{Method: http.MethodDelete, Path: "/users/:id", Middleware: []string{"bodylimit"}},
+			{Method: http.MethodGet, Path: "/users/:id", Middleware: []string{"bodylimit"}},
+		},
+	}, snapshot)
+
+	t.Run("stable", func(t *testing.T) {
+		assert.Equal(t, snapshot, snapshotRouter(true, 10).Snapshot(), "the order of registration doesn't matter")
+		assert.Equal(t, snapshot, snapshotRouter(false, 500).Snapshot(), "middleware configuration is left out")
+
+		data, err := json.Marshal(snapshot)
+		require.NoError(t, err)
+
+		var decoded vk.RouteSnapshot
+		require.NoError(t, json.Unmarshal(data, &decoded))
+		assert.True(t, vk.DiffSnapshots(snapshot, decoded).Empty())
+	})
+}
+
+func TestDiffSnapshots(t *testing.T) {
+	old := vk.RouteSnapshot{Routes: []vk.SnapshotRoute{
+		{Method: http.MethodGet, Path: "/users/:id", Middleware: []string{"auth"}},
+		{Method: http.MethodDelete, Path: "/users/:id", Middleware: []string{"auth"}},
+		{Method: http.MethodGet, Path: "/orders", Middleware: []string{"auth"}},
+		{Method: http.MethodGet, Path: "/health", Ops: true},
+	}}
+
+	new := vk.RouteSnapshot{Routes: []vk.SnapshotRoute{
+		{Method: http.MethodGet, Path: "/users/:id", Middleware: []string{"auth", "cache"}, Flags: []string{"v2"}},
+		{Method: http.MethodGet, Path: "/orders", Middleware: []string{"auth"}},
+		{Method: http.MethodPost, Path: "/orders", Middleware: []string{"auth"}},
+		{Method: http.MethodGet, Path: "/health"},
+		{Method: http.MethodGet, Path: "/admin"},
+	}}
+
+	diff := vk.DiffSnapshots(old, new)
+
+	assert.Equal(t, []vk.SnapshotRoute{new.Routes[4], new.Routes[2]}, diff.Added)
+	assert.Equal(t, []vk.SnapshotRoute{old.Routes[1]}, diff.Removed)
+
+	require.Len(t, diff.Modified, 2)
+	assert.Equal(t, "/health", diff.Modified[0].Path)
+	assert.Equal(t, []string{"ops"}, diff.Modified[0].Fields)
+	assert.Equal(t, "/users/:id", diff.Modified[1].Path)
+	assert.Equal(t, []string{"middleware", "flags"}, diff.Modified[1].Fields)
+	assert.Equal(t, old.Routes[0], diff.Modified[1].Old)
+
+	assert.Equal(t, "- DELETE /users/:id\n+ GET /admin\n+ POST /orders\n~ GET /health (ops)\n~ GET /users/:id (middleware, flags)", diff.String())
+
+	assert.True(t, vk.DiffSnapshots(new, new).Empty())
+	assert.Equal(t, diff.Added, vk.DiffSnapshots(new, old).Removed, "the diff is symmetric")
+}
@@ -0,0 +1,89 @@
+package test_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+	"github.com/suborbital/vektor/vtest"
+)
+
+// graphQLHandler is a stand-in for a GraphQL server, resolving each requested top-level field from the request context
+func graphQLHandler(resolvers map[string]func(ctx context.Context) interface{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Query string `json:"query"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		data := map[string]interface{}{}
+		for _, field := range strings.Fields(strings.Trim(req.Query, "{} ")) {
+			if resolve, ok := resolvers[field]; ok {
+				data[field] = resolve(r.Context())
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+	})
+}
+
+func TestWrapStdHandlerWithCtx(t *testing.T) {
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+
+	auth := func(inner vk.HandlerFunc) vk.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+			ctx.UseRequestID("req-123")
+			ctx.Set("claims", "user-1")
+
+			return inner(w, r, ctx)
+		}
+	}
+
+	schema := graphQLHandler(map[string]func(ctx context.Context) interface{}{
+		"requestID": func(ctx context.Context) interface{} { return vk.RequestIDFromContext(ctx) },
+		"user":      func(ctx context.Context) interface{} { return vk.CtxFromContext(ctx).Get("claims") },
+		"logged": func(ctx context.Context) interface{} {
+			vk.LoggerFromContext(ctx).Info("resolving")
+			return true
+		},
+		"boom": func(ctx context.Context) interface{} { panic("resolver failed") },
+	})
+
+	g := vk.Group("")
+	g.POST("/graphql", vk.WrapStdHandlerWithCtx(schema), auth)
+	server.AddGroup(g)
+
+	vt := vtest.New(server)
+
+	r, err := http.NewRequest(http.MethodPost, "/graphql", strings.NewReader(`{"query":"{ requestID user logged }"}`))
+	require.NoError(t, err)
+
+	vt.Do(r, t).
+		AssertStatus(http.StatusOK).
+		AssertBodyString(`{"data":{"logged":true,"requestID":"req-123","user":"user-1"}}` + "\n")
+
+	t.Run("resolver panics are recovered", func(t *testing.T) {
+		r, err := http.NewRequest(http.MethodPost, "/graphql", strings.NewReader(`{"query":"{ boom }"}`))
+		require.NoError(t, err)
+
+		vt.Do(r, t).AssertStatus(http.StatusInternalServerError)
+
+		reports := server.Panics().Reports()
+		require.Len(t, reports, 1)
+		assert.Equal(t, "resolver failed", reports[0].Message)
+	})
+}
@@ -0,0 +1,209 @@
+package test_test
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+)
+
+// failingReader returns its data and then fails
+type failingReader struct {
+	data string
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	if f.data == "" {
+		return 0, errors.New("disk on fire")
+	}
+
+	n := copy(p, f.data)
+	f.data = f.data[n:]
+
+	return n, nil
+}
+
+// streamingServer starts a server with the given routes behind a middleware that sets a header
+func streamingServer(t *testing.T, routes func(g *vk.RouteGroup)) *httptest.Server {
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+
+	g := vk.Group("").WithMiddlewares(vk.Named("header", func(inner vk.HandlerFunc) vk.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+			ctx.RespHeaders.Set("X-Middleware", "set")
+			return inner(w, r, ctx)
+		}
+	}))
+
+	routes(g)
+	server.AddGroup(g)
+
+	require.NoError(t, server.TestStart())
+
+	ts := httptest.NewServer(server)
+	t.Cleanup(ts.Close)
+
+	return ts
+}
+
+func TestRespondStream(t *testing.T) {
+	pr, pw := io.Pipe()
+
+	ts := streamingServer(t, func(g *vk.RouteGroup) {
+		g.GET("/pipe", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+			return vk.RespondStream(ctx, w, pr, "text/csv", http.StatusAccepted)
+		})
+
+		g.GET("/html", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+			return vk.RespondStream(ctx, w, strings.NewReader("<html></html>"), "", http.StatusOK)
+		})
+
+		g.GET("/fails-first", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+			return vk.RespondStream(ctx, w, &failingReader{}, "text/plain", http.StatusOK)
+		})
+
+		g.GET("/fails-later", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+			return vk.RespondStream(ctx, w, &failingReader{data: "partial"}, "text/plain", http.StatusOK)
+		})
+	})
+
+	t.Run("flushed as read", func(t *testing.T) {
+		go func() {
+			_, _ = pw.Write([]byte("a,b\n"))
+		}()
+
+		resp, err := http.Get(ts.URL + "/pipe")
+		require.NoError(t, err)
+
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+		assert.Equal(t, "text/csv", resp.Header.Get("Content-Type"))
+		assert.Equal(t, "set", resp.Header.Get("X-Middleware"))
+
+		// the first chunk arrives while the reader is still open
+		line, err := bufio.NewReader(resp.Body).ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "a,b\n", line)
+
+		pw.Close()
+	})
+
+	t.Run("no detection", func(t *testing.T) {
+		resp, err := http.Get(ts.URL + "/html")
+		require.NoError(t, err)
+
+		defer resp.Body.Close()
+
+		assert.Equal(t, "application/octet-stream", resp.Header.Get("Content-Type"))
+	})
+
+	t.Run("fails before starting", func(t *testing.T) {
+		resp, err := http.Get(ts.URL + "/fails-first")
+		require.NoError(t, err)
+
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	})
+
+	t.Run("fails mid-stream", func(t *testing.T) {
+		resp, err := http.Get(ts.URL + "/fails-later")
+		require.NoError(t, err)
+
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		body, err := io.ReadAll(resp.Body)
+		assert.Equal(t, "partial", string(body))
+		assert.ErrorIs(t, err, io.ErrUnexpectedEOF, "the client should be able to tell the response is incomplete")
+	})
+}
+
+func TestSSE(t *testing.T) {
+	stopped := make(chan struct{})
+
+	ts := streamingServer(t, func(g *vk.RouteGroup) {
+		g.GET("/events", vk.SSE(func(ctx *vk.Ctx, events chan<- vk.Event) error {
+			events <- vk.Event{ID: "1", Event: "greeting", Data: "hello\nworld"}
+			events <- vk.Event{Data: "plain", Retry: 3 * time.Second}
+
+			return nil
+		}))
+
+		g.GET("/panics", vk.SSE(func(ctx *vk.Ctx, events chan<- vk.Event) error {
+			events <- vk.Event{Data: "before"}
+
+			panic("producer panic")
+		}))
+
+		g.GET("/forever", vk.SSE(func(ctx *vk.Ctx, events chan<- vk.Event) error {
+			defer close(stopped)
+
+			for {
+				select {
+				case events <- vk.Event{Data: "tick"}:
+					time.Sleep(10 * time.Millisecond)
+				case <-ctx.Done():
+					return nil
+				}
+			}
+		}))
+	})
+
+	t.Run("frames", func(t *testing.T) {
+		resp, err := http.Get(ts.URL + "/events")
+		require.NoError(t, err)
+
+		defer resp.Body.Close()
+
+		assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+		assert.Equal(t, "no-cache", resp.Header.Get("Cache-Control"))
+		assert.Equal(t, "set", resp.Header.Get("X-Middleware"))
+
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+
+		assert.Equal(t, "id: 1\nevent: greeting\ndata: hello\ndata: world\n\nretry: 3000\ndata: plain\n\n", string(body))
+	})
+
+	t.Run("producer panics", func(t *testing.T) {
+		// the panic is recovered rather than crashing the process
+		resp, err := http.Get(ts.URL + "/panics")
+		require.NoError(t, err)
+
+		defer resp.Body.Close()
+
+		body, _ := io.ReadAll(resp.Body)
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "data: before\n\n", string(body), "no error response should follow the stream")
+	})
+
+	t.Run("client disconnects", func(t *testing.T) {
+		resp, err := http.Get(ts.URL + "/forever")
+		require.NoError(t, err)
+
+		line, err := bufio.NewReader(resp.Body).ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "data: tick\n", line)
+
+		resp.Body.Close()
+
+		select {
+		case <-stopped:
+		case <-time.After(2 * time.Second):
+			t.Fatal("the producer was not stopped when the client went away")
+		}
+	})
+}
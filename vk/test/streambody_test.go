@@ -0,0 +1,215 @@
+package test_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+)
+
+type streamOutcome struct {
+	result vk.StreamResult
+	err    error
+	stored []byte
+}
+
+func streamServer(outcomes chan streamOutcome, opts ...vk.StreamOption) *vk.Server {
+	server := vk.New()
+
+	server.PUT("/upload", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		// stands in for an object storage upload
+		stored := &bytes.Buffer{}
+
+		result, err := ctx.StreamBodyTo(stored, opts...)
+		outcomes <- streamOutcome{result: result, err: err, stored: stored.Bytes()}
+
+		if err != nil {
+			return err
+		}
+
+		return vk.RespondString(ctx.Context, w, result.Digest(vk.ChecksumSHA256), http.StatusCreated)
+	})
+
+	return server
+}
+
+func TestStreamBodyTo(t *testing.T) {
+	outcomes := make(chan streamOutcome, 1)
+
+	var progress []int64
+
+	server := streamServer(outcomes,
+		vk.WithChecksums(vk.ChecksumSHA256, vk.ChecksumCRC32C),
+		vk.WithMaxBytes(1<<20),
+		vk.WithProgress(func(copied int64) { progress = append(progress, copied) }),
+	)
+	require.NoError(t, server.TestStart())
+
+	body := strings.Repeat("object data ", 10000)
+	md5Sum := md5.Sum([]byte(body))
+	shaSum := sha256.Sum256([]byte(body))
+
+	do := func(body string, header http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPut, "/upload", strings.NewReader(body))
+		for key, values := range header {
+			r.Header[key] = values
+		}
+
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+
+		return w
+	}
+
+	t.Run("checksums match", func(t *testing.T) {
+		progress = nil
+
+		w := do(body, http.Header{
+			"Content-Md5":           {base64.StdEncoding.EncodeToString(md5Sum[:])},
+			"X-Amz-Checksum-Sha256": {base64.StdEncoding.EncodeToString(shaSum[:])},
+		})
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+		outcome := <-outcomes
+		require.NoError(t, outcome.err)
+
+		assert.Equal(t, body, string(outcome.stored))
+		assert.Equal(t, int64(len(body)), outcome.result.Bytes)
+		assert.Equal(t, shaSum[:], outcome.result.Digests[vk.ChecksumSHA256])
+		assert.Len(t, outcome.result.Digests[vk.ChecksumCRC32C], 4)
+		assert.Equal(t, base64.StdEncoding.EncodeToString(shaSum[:]), w.Body.String())
+
+		require.NotEmpty(t, progress)
+		assert.Greater(t, len(progress), 1)
+		assert.Equal(t, int64(len(body)), progress[len(progress)-1])
+	})
+
+	t.Run("checksum mismatch", func(t *testing.T) {
+		w := do(body+"tampered", http.Header{"Content-Md5": {base64.StdEncoding.EncodeToString(md5Sum[:])}})
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), "Content-MD5")
+
+		outcome := <-outcomes
+		assert.Error(t, outcome.err)
+	})
+
+	t.Run("invalid checksum header", func(t *testing.T) {
+		w := do(body, http.Header{"X-Amz-Checksum-Sha256": {"not base64!"}})
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		<-outcomes
+	})
+
+	t.Run("too large", func(t *testing.T) {
+		w := do(strings.Repeat("x", 1<<20+1), nil)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+		outcome := <-outcomes
+		assert.Empty(t, outcome.stored)
+	})
+}
+
+func TestStreamBodyToDecompressed(t *testing.T) {
+	outcomes := make(chan streamOutcome, 1)
+
+	server := streamServer(outcomes, vk.WithDecompression(), vk.WithChecksums(vk.ChecksumSHA256), vk.WithMaxBytes(1000))
+	require.NoError(t, server.TestStart())
+
+	compress := func(data string) []byte {
+		buf := &bytes.Buffer{}
+		gz := gzip.NewWriter(buf)
+		_, _ = gz.Write([]byte(data))
+		_ = gz.Close()
+
+		return buf.Bytes()
+	}
+
+	t.Run("decompressed", func(t *testing.T) {
+		body := strings.Repeat("a", 800)
+		compressed := compress(body)
+
+		// the client's checksum is of the body as it was sent
+		wireSum := md5.Sum(compressed)
+
+		r := httptest.NewRequest(http.MethodPut, "/upload", bytes.NewReader(compressed))
+		r.Header.Set("Content-Encoding", "gzip")
+		r.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(wireSum[:]))
+
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+		outcome := <-outcomes
+		shaSum := sha256.Sum256([]byte(body))
+
+		assert.Equal(t, body, string(outcome.stored))
+		assert.Equal(t, int64(len(compressed)), outcome.result.WireBytes)
+		assert.Equal(t, shaSum[:], outcome.result.Digests[vk.ChecksumSHA256])
+	})
+
+	t.Run("decompression bomb", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPut, "/upload", bytes.NewReader(compress(strings.Repeat("a", 100000))))
+		r.Header.Set("Content-Encoding", "gzip")
+
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+		outcome := <-outcomes
+		assert.LessOrEqual(t, len(outcome.stored), 1000)
+	})
+
+	t.Run("unsupported encoding", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPut, "/upload", strings.NewReader("data"))
+		r.Header.Set("Content-Encoding", "br")
+
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+
+		<-outcomes
+	})
+}
+
+func TestStreamBodyToClientAbort(t *testing.T) {
+	outcomes := make(chan streamOutcome, 1)
+
+	server := streamServer(outcomes, vk.WithChecksums(vk.ChecksumSHA256))
+	require.NoError(t, server.TestStart())
+
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	require.NoError(t, err)
+
+	// promises 1000 bytes, but goes away after 100
+	_, err = fmt.Fprintf(conn, "PUT /upload HTTP/1.1\r\nHost: example.com\r\nContent-Length: 1000\r\n\r\n%s", strings.Repeat("x", 100))
+	require.NoError(t, err)
+
+	time.Sleep(50 * time.Millisecond)
+	conn.Close()
+
+	select {
+	case outcome := <-outcomes:
+		require.Error(t, outcome.err)
+		assert.Contains(t, outcome.err.Error(), "ended early")
+		assert.Equal(t, int64(100), outcome.result.Bytes)
+		assert.Equal(t, strings.Repeat("x", 100), string(outcome.stored))
+	case <-time.After(2 * time.Second):
+		t.Fatal("handler did not return")
+	}
+}
@@ -0,0 +1,68 @@
+package test_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+)
+
+func TestStrictResponses(t *testing.T) {
+	handlers := map[string]struct {
+		handler    vk.HandlerFunc
+		permissive int
+		strict     int
+	}{
+		"json": {func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+			return vk.RespondJSON(ctx.Context, w, map[string]string{"a": "b"}, http.StatusOK)
+		}, http.StatusOK, http.StatusOK},
+		"status-only": {func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+			w.WriteHeader(http.StatusNoContent)
+			return nil
+		}, http.StatusNoContent, http.StatusNoContent},
+		"vk-error": {func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+			return vk.E(http.StatusConflict, "conflict")
+		}, http.StatusConflict, http.StatusConflict},
+		"other-error": {func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+			return errors.New("failed")
+		}, http.StatusInternalServerError, http.StatusInternalServerError},
+		"nothing-written": {func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+			return nil
+		}, http.StatusOK, http.StatusInternalServerError},
+		"headers-only": {func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+			ctx.RespHeaders.Set("X-Result", "pending")
+			return nil
+		}, http.StatusOK, http.StatusInternalServerError},
+	}
+
+	for mode, opts := range map[string][]vk.OptionsModifier{"permissive": nil, "strict": {vk.UseStrictResponses()}} {
+		server := vk.New(append(opts, vk.UseLogger(vlog.Noop()))...)
+
+		for name, h := range handlers {
+			server.GET("/"+name, h.handler)
+		}
+
+		if err := server.TestStart(); err != nil {
+			t.Fatal(err)
+		}
+
+		for name, h := range handlers {
+			t.Run(mode+"/"+name, func(t *testing.T) {
+				w := httptest.NewRecorder()
+				server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/"+name, nil))
+
+				expected := h.permissive
+				if mode == "strict" {
+					expected = h.strict
+				}
+
+				assert.Equal(t, expected, w.Code)
+			})
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package test_test
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+)
+
+func TestThrottlePacing(t *testing.T) {
+	throttler := vk.NewThrottler(vk.ThrottleOptions{BytesPerSecond: 100_000, Burst: 10_000})
+
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+
+	g := vk.Group("").WithMiddlewares(throttler.Middleware())
+
+	// export streams 60KB in chunks of 10KB
+	g.GET("/export", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		chunk := bytes.Repeat([]byte("a"), 10_000)
+
+		for i := 0; i < 6; i++ {
+			if _, err := w.Write(chunk); err != nil {
+				return err
+			}
+
+			w.(http.Flusher).Flush()
+		}
+
+		return nil
+	})
+
+	g.GET("/small", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		_, err := w.Write(bytes.Repeat([]byte("a"), 5_000))
+		return err
+	})
+
+	server.AddGroup(g)
+	require.NoError(t, server.TestStart())
+
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	get := func(path string) (int, time.Duration) {
+		start := time.Now()
+
+		resp, err := http.Get(ts.URL + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+
+		return len(body), time.Since(start)
+	}
+
+	t.Run("keeping up", func(t *testing.T) {
+		n, elapsed := get("/small")
+		assert.Equal(t, 5_000, n)
+		assert.Less(t, elapsed, 50*time.Millisecond, "writes within the burst aren't delayed")
+		assert.EqualValues(t, 0, throttler.Stats().Paced)
+	})
+
+	t.Run("paced", func(t *testing.T) {
+		// the first 10KB is the burst, and the remaining 50KB take half a second at 100KB/s
+		n, elapsed := get("/export")
+		assert.Equal(t, 60_000, n)
+		assert.Greater(t, elapsed, 400*time.Millisecond)
+		assert.Less(t, elapsed, 1500*time.Millisecond)
+		assert.EqualValues(t, 5, throttler.Stats().Paced)
+	})
+}
+
+func TestThrottleSlowWebSocket(t *testing.T) {
+	// firehose writes to the connection until a write fails, then reports the error
+	firehose := func(throttler *vk.Throttler, errs chan error) *httptest.Server {
+		server := vk.New(vk.UseLogger(vlog.Noop()))
+
+		g := vk.Group("").WithMiddlewares(throttler.Middleware())
+
+		g.WebSocket("/firehose", func(r *http.Request, ctx *vk.Ctx, conn *websocket.Conn) error {
+			payload := []byte(strings.Repeat("a", 64<<10))
+
+			for {
+				if err := conn.WriteMessage(websocket.BinaryMessage, payload); err != nil {
+					errs <- err
+					return nil
+				}
+			}
+		})
+
+		server.AddGroup(g)
+		require.NoError(t, server.TestStart())
+
+		ts := httptest.NewServer(server)
+		t.Cleanup(ts.Close)
+
+		return ts
+	}
+
+	dial := func(ts *httptest.Server) *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/firehose", nil)
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+
+		return conn
+	}
+
+	// drain reads from conn until it fails
+	drain := func(conn *websocket.Conn) error {
+		for {
+			require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return err
+			}
+		}
+	}
+
+	t.Run("close code", func(t *testing.T) {
+		throttler := vk.NewThrottler(vk.ThrottleOptions{SlowAfter: 200 * time.Millisecond, TerminateSlow: true})
+		errs := make(chan error, 1)
+
+		conn := dial(firehose(throttler, errs))
+
+		// stop reading for longer than SlowAfter, but not long enough for the blocked write to be reset
+		time.Sleep(300 * time.Millisecond)
+
+		err := drain(conn)
+		assert.True(t, websocket.IsCloseError(err, vk.WebSocketCloseSlowConsumer), "got %v", err)
+
+		assert.ErrorIs(t, <-errs, vk.ErrSlowConnection)
+
+		stats := throttler.Stats()
+		assert.EqualValues(t, 1, stats.Slow)
+		assert.EqualValues(t, 1, stats.Terminated)
+	})
+
+	t.Run("reset", func(t *testing.T) {
+		throttler := vk.NewThrottler(vk.ThrottleOptions{SlowAfter: 50 * time.Millisecond, TerminateSlow: true})
+		errs := make(chan error, 1)
+
+		conn := dial(firehose(throttler, errs))
+
+		// the client never reads, so the blocked write is reset
+		select {
+		case err := <-errs:
+			assert.Error(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("the blocked write was not reset")
+		}
+
+		assert.EqualValues(t, 1, throttler.Stats().Terminated)
+
+		err := drain(conn)
+		assert.False(t, websocket.IsCloseError(err, vk.WebSocketCloseSlowConsumer))
+	})
+
+	t.Run("not terminated", func(t *testing.T) {
+		throttler := vk.NewThrottler(vk.ThrottleOptions{SlowAfter: 50 * time.Millisecond})
+		errs := make(chan error, 1)
+
+		conn := dial(firehose(throttler, errs))
+
+		time.Sleep(200 * time.Millisecond)
+
+		// the client catches up, and the connection carries on
+		for i := 0; i < 100; i++ {
+			_, _, err := conn.ReadMessage()
+			require.NoError(t, err)
+		}
+
+		stats := throttler.Stats()
+		assert.EqualValues(t, 1, stats.Slow)
+		assert.EqualValues(t, 0, stats.Terminated)
+		assert.EqualValues(t, 1, stats.Active)
+	})
+}
@@ -0,0 +1,225 @@
+package test_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+)
+
+func TestCtxIsContext(t *testing.T) {
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+
+	cancelled := make(chan error, 1)
+
+	server.GET("/wait", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		// stands in for a database call taking a context
+		wait := func(c context.Context) error {
+			<-c.Done()
+			return c.Err()
+		}
+
+		cancelled <- wait(ctx)
+
+		return nil
+	})
+
+	require.NoError(t, server.TestStart())
+
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	reqCtx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	r, _ := http.NewRequestWithContext(reqCtx, http.MethodGet, ts.URL+"/wait", nil)
+
+	_, err := http.DefaultClient.Do(r)
+	require.Error(t, err)
+
+	select {
+	case err := <-cancelled:
+		assert.ErrorIs(t, err, context.Canceled, "the Ctx is cancelled when the client goes away")
+	case <-time.After(2 * time.Second):
+		t.Fatal("the Ctx was not cancelled")
+	}
+
+	var zero *vk.Ctx
+	assert.NoError(t, zero.Err())
+	assert.Nil(t, zero.Done())
+}
+
+func TestTimeoutMiddleware(t *testing.T) {
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+
+	release := make(chan struct{})
+
+	g := vk.Group("").WithMiddlewares(vk.TimeoutMiddleware(50 * time.Millisecond))
+
+	g.GET("/stubborn", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		// ignores the cancellation of its context until the test ends
+		<-release
+
+		ctx.RespHeaders.Set("X-Late", "true")
+		_, _ = w.Write([]byte("too late"))
+
+		return nil
+	})
+
+	g.GET("/racing", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		d, _ := time.ParseDuration(r.URL.Query().Get("sleep"))
+		time.Sleep(d)
+
+		return vk.RespondString(ctx.Context, w, "finished", http.StatusOK)
+	})
+
+	g.GET("/failing", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		ctx.RespHeaders.Set("Retry-After", "1")
+		return vk.E(http.StatusConflict, "conflict")
+	})
+
+	g.GET("/panicking", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		panic("oops")
+	})
+
+	server.AddGroup(g)
+	require.NoError(t, server.TestStart())
+
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	get := func(path string) (*http.Response, string) {
+		resp, err := http.Get(ts.URL + path)
+		require.NoError(t, err)
+
+		defer resp.Body.Close()
+
+		body, _ := io.ReadAll(resp.Body)
+
+		return resp, string(body)
+	}
+
+	t.Run("deadline", func(t *testing.T) {
+		start := time.Now()
+
+		// the response is read before the handler is released
+		respCh := make(chan *http.Response, 1)
+		go func() {
+			resp, err := http.Get(ts.URL + "/stubborn")
+			if err == nil {
+				_, _ = io.ReadAll(resp.Body)
+				resp.Body.Close()
+			}
+
+			respCh <- resp
+		}()
+
+		select {
+		case resp := <-respCh:
+			require.NotNil(t, resp)
+			assert.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+			assert.Empty(t, resp.Header.Get("X-Late"))
+			assert.Less(t, time.Since(start), time.Second)
+		case <-time.After(2 * time.Second):
+			t.Error("the 504 was not sent while the handler was running")
+		}
+
+		close(release)
+	})
+
+	t.Run("race", func(t *testing.T) {
+		// handlers finishing around the deadline get one response or the other, never both
+		for i := 0; i < 20; i++ {
+			resp, body := get("/racing?sleep=" + (45*time.Millisecond + time.Duration(i)*500*time.Microsecond).String())
+
+			switch resp.StatusCode {
+			case http.StatusOK:
+				assert.Equal(t, "finished", body)
+			case http.StatusGatewayTimeout:
+				assert.Equal(t, http.StatusText(http.StatusGatewayTimeout), body)
+			default:
+				t.Errorf("unexpected status %d", resp.StatusCode)
+			}
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		resp, _ := get("/failing")
+		assert.Equal(t, http.StatusConflict, resp.StatusCode)
+		assert.Equal(t, "1", resp.Header.Get("Retry-After"), "headers set before an error are kept")
+
+		resp, _ = get("/panicking")
+		assert.Equal(t, http.StatusInternalServerError, resp.StatusCode, "panics are recovered by the router")
+	})
+}
+
+func TestWebSocketShutdown(t *testing.T) {
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+
+	closed := make(chan error, 1)
+
+	server.WebSocket("/sock", func(r *http.Request, ctx *vk.Ctx, conn *websocket.Conn) error {
+		<-ctx.Done()
+		closed <- ctx.Err()
+
+		return conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "shutting down"))
+	})
+
+	require.NoError(t, server.TestStart())
+
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/sock", nil)
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	require.NoError(t, server.Shutdown(context.Background()))
+
+	select {
+	case err := <-closed:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(2 * time.Second):
+		t.Fatal("the websocket handler's context was not cancelled")
+	}
+
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway))
+}
+
+func TestWebSocketShutdownCloseFrame(t *testing.T) {
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+
+	server.WebSocket("/sock", func(r *http.Request, ctx *vk.Ctx, conn *websocket.Conn) error {
+		<-ctx.Done()
+		return nil
+	})
+
+	require.NoError(t, server.TestStart())
+
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/sock", nil)
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	require.NoError(t, server.Shutdown(context.Background()))
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), "the handler returning should send a close frame, got %v", err)
+}
@@ -0,0 +1,126 @@
+package test_test
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+	"github.com/suborbital/vektor/vtest"
+)
+
+func TestLatencyHistogramQuantile(t *testing.T) {
+	h := &vk.LatencyHistogram{}
+
+	assert.Equal(t, time.Duration(0), h.Quantile(0.99))
+
+	// uniformly spread between 10ms and 110ms, so the p50 is 60ms and the p99 is 109ms
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		h.Observe(10*time.Millisecond + time.Duration(rnd.Int63n(int64(100*time.Millisecond))))
+	}
+
+	assert.Equal(t, uint64(10000), h.Count())
+	assert.InEpsilon(t, float64(60*time.Millisecond), float64(h.Quantile(0.5)), 0.1)
+	assert.InEpsilon(t, float64(109*time.Millisecond), float64(h.Quantile(0.99)), 0.1)
+
+	t.Run("overflow", func(t *testing.T) {
+		h := &vk.LatencyHistogram{}
+		h.Observe(3 * time.Hour)
+
+		assert.Equal(t, 3*time.Hour, h.Quantile(1))
+	})
+}
+
+func TestTimeoutRecommendations(t *testing.T) {
+	latencies := vk.New(vk.UseLogger(vlog.Noop()), vk.UseTimeoutLearning()).RouteLatencies()
+	require.NotNil(t, latencies)
+
+	// 99 fast requests and one slow one, so the p99 is the fast ones' latency
+	for i := 0; i < 99; i++ {
+		latencies.Observe(http.MethodGet, "/users/:id", 20*time.Millisecond)
+	}
+	latencies.Observe(http.MethodGet, "/users/:id", time.Second)
+
+	for i := 0; i < 50; i++ {
+		latencies.Observe(http.MethodPost, "/reports", 2*time.Second)
+	}
+
+	recommendations := latencies.TimeoutRecommendations(99, 1.5)
+	require.Len(t, recommendations, 2)
+
+	reports, users := recommendations[0], recommendations[1]
+
+	assert.Equal(t, http.MethodPost, reports.Method)
+	assert.Equal(t, "/reports", reports.Route)
+	assert.Equal(t, uint64(50), reports.Samples)
+	assert.InEpsilon(t, float64(2*time.Second), float64(reports.Percentile), 0.1)
+	assert.InEpsilon(t, float64(3*time.Second), float64(reports.Recommended), 0.1)
+
+	assert.Equal(t, "/users/:id", users.Route)
+	assert.Equal(t, uint64(100), users.Samples)
+	assert.InEpsilon(t, float64(20*time.Millisecond), float64(users.Percentile), 0.1)
+	assert.InEpsilon(t, float64(30*time.Millisecond), float64(users.Recommended), 0.1)
+
+	t.Run("admin", func(t *testing.T) {
+		admin := vk.NewRouter(vlog.Noop(), "")
+		latencies.RegisterAdmin(admin)
+		admin.WithMiddlewares(vk.ErrorMiddleware())
+		admin.Finalize()
+
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/timeouts?percentile=50&multiplier=2", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var body []vk.TimeoutRecommendation
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		require.Len(t, body, 2)
+		assert.InEpsilon(t, float64(40*time.Millisecond), float64(body[1].Recommended), 0.1)
+
+		w = httptest.NewRecorder()
+		admin.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/timeouts?percentile=101", nil))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
+
+func TestTimeoutLearningSkipsStreaming(t *testing.T) {
+	server := vk.New(vk.UseLogger(vlog.Noop()), vk.UseTimeoutLearning())
+
+	server.GET("/users/:id", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return vk.RespondString(ctx.Context, w, "user", http.StatusOK)
+	})
+	server.GET("/events", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		_, err := w.Write([]byte("data: hello\n\n"))
+
+		return err
+	})
+
+	vt := vtest.New(server)
+
+	for _, path := range []string{"/users/1", "/users/2", "/events"} {
+		r, _ := http.NewRequest(http.MethodGet, path, nil)
+		vt.Do(r, t)
+	}
+
+	recommendations := server.RouteLatencies().TimeoutRecommendations(99, 1.5)
+	require.Len(t, recommendations, 1)
+	assert.Equal(t, "/users/:id", recommendations[0].Route)
+	assert.Equal(t, uint64(2), recommendations[0].Samples)
+	assert.Positive(t, recommendations[0].Recommended)
+}
+
+func TestTimeoutLearningDisabled(t *testing.T) {
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+
+	assert.Nil(t, server.RouteLatencies())
+	assert.Empty(t, vk.NewRouter(nil, "").TimeoutRecommendations(99, 1.5))
+}
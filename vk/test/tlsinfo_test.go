@@ -0,0 +1,162 @@
+package test_test
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+	"github.com/suborbital/vektor/vtest"
+)
+
+type tlsDetails struct {
+	isTLS   bool
+	version string
+	state   *tls.ConnectionState
+}
+
+func tlsServer(opts ...vk.OptionsModifier) (*vk.Server, *tlsDetails) {
+	details := &tlsDetails{}
+
+	server := vk.New(append([]vk.OptionsModifier{vk.UseLogger(vlog.Noop())}, opts...)...)
+	server.GET("/tls", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		details.isTLS = ctx.IsTLS()
+		details.version = ctx.TLSVersion()
+		details.state = ctx.TLS()
+
+		return nil
+	})
+
+	return server, details
+}
+
+func TestCtxTLS(t *testing.T) {
+	server, details := tlsServer()
+	require.NoError(t, server.TestStart())
+
+	ts := httptest.NewTLSServer(server)
+	defer ts.Close()
+
+	for version, name := range map[uint16]string{tls.VersionTLS12: "TLS 1.2", tls.VersionTLS13: "TLS 1.3"} {
+		t.Run(name, func(t *testing.T) {
+			client := ts.Client()
+			transport := client.Transport.(*http.Transport).Clone()
+			transport.TLSClientConfig.MinVersion = version
+			transport.TLSClientConfig.MaxVersion = version
+			client.Transport = transport
+
+			resp, err := client.Get(ts.URL + "/tls")
+			require.NoError(t, err)
+			resp.Body.Close()
+
+			assert.True(t, details.isTLS)
+			assert.Equal(t, name, details.version)
+
+			if assert.NotNil(t, details.state) {
+				assert.Equal(t, version, details.state.Version)
+				assert.Equal(t, resp.TLS.CipherSuite, details.state.CipherSuite)
+			}
+		})
+	}
+}
+
+func TestCtxTLSForwarded(t *testing.T) {
+	cases := map[string]struct {
+		trust    bool
+		proto    string
+		isTLS    bool
+		expected string
+	}{
+		"plaintext":         {false, "", false, ""},
+		"untrusted":         {false, "https", false, ""},
+		"trusted":           {true, "https", true, vk.TLSTerminatedUpstream},
+		"trusted list":      {true, "HTTPS, http", true, vk.TLSTerminatedUpstream},
+		"trusted plaintext": {true, "http", false, ""},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			var opts []vk.OptionsModifier
+			if c.trust {
+				opts = append(opts, vk.UseTrustProxy())
+			}
+
+			server, details := tlsServer(opts...)
+
+			r, _ := http.NewRequest(http.MethodGet, "/tls", nil)
+			if c.proto != "" {
+				r.Header.Set("X-Forwarded-Proto", c.proto)
+			}
+
+			vtest.New(server).Do(r, t)
+
+			assert.Equal(t, c.isTLS, details.isTLS)
+			assert.Equal(t, c.expected, details.version)
+			assert.Nil(t, details.state)
+		})
+	}
+
+	assert.False(t, vk.NewCtx(nil, nil, nil).IsTLS())
+}
+
+func TestTLSRequestLog(t *testing.T) {
+	// the completion line of the request, without its duration
+	completed := func(logs *logCapture) string {
+		for _, m := range logs.messages() {
+			if strings.Contains(m, "(I) GET /tls completed") {
+				return regexp.MustCompile(` in \d+ms`).ReplaceAllString(m, "")
+			}
+		}
+
+		return ""
+	}
+
+	t.Run("TLS", func(t *testing.T) {
+		logs := &logCapture{}
+
+		server, _ := tlsServer(vk.UseLogger(vlog.Default(vlog.Level(vlog.LogLevelInfo), vlog.WithWriter(logs))))
+		require.NoError(t, server.TestStart())
+
+		ts := httptest.NewTLSServer(server)
+		defer ts.Close()
+
+		resp, err := ts.Client().Get(ts.URL + "/tls")
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		expected := fmt.Sprintf("(I) GET /tls completed (200: OK) [TLS 1.3 %s]", tls.CipherSuiteName(resp.TLS.CipherSuite))
+		assert.Equal(t, expected, completed(logs))
+	})
+
+	t.Run("terminated upstream", func(t *testing.T) {
+		logs := &logCapture{}
+
+		server, _ := tlsServer(vk.UseTrustProxy(), vk.UseLogger(vlog.Default(vlog.Level(vlog.LogLevelInfo), vlog.WithWriter(logs))))
+
+		r, _ := http.NewRequest(http.MethodGet, "/tls", nil)
+		r.Header.Set("X-Forwarded-Proto", "https")
+
+		vtest.New(server).Do(r, t)
+
+		assert.Equal(t, "(I) GET /tls completed (200: OK) [terminated-upstream]", completed(logs))
+	})
+
+	t.Run("plaintext", func(t *testing.T) {
+		logs := &logCapture{}
+
+		server, _ := tlsServer(vk.UseLogger(vlog.Default(vlog.Level(vlog.LogLevelInfo), vlog.WithWriter(logs))))
+
+		r, _ := http.NewRequest(http.MethodGet, "/tls", nil)
+		vtest.New(server).Do(r, t)
+
+		assert.Equal(t, "(I) GET /tls completed (200: OK)", completed(logs))
+	})
+}
@@ -0,0 +1,71 @@
+package test_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+)
+
+func passthrough(inner vk.HandlerFunc) vk.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		return inner(w, r, ctx)
+	}
+}
+
+func tenantMiddleware(inner vk.HandlerFunc) vk.HandlerFunc {
+	return passthrough(inner)
+}
+
+func TestTraceChain(t *testing.T) {
+	executed := false
+
+	handler := func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		executed = true
+		return nil
+	}
+
+	recoverMw := vk.Named("recover", passthrough)
+	requestIDMw := vk.Named("requestid", passthrough)
+	authMw := vk.Named("auth", passthrough)
+
+	t.Run("WrapHandler", func(t *testing.T) {
+		wrapped := vk.WrapHandler(handler, authMw, requestIDMw, recoverMw)
+
+		assert.Equal(t, []string{"recover", "requestid", "auth", "handler"}, vk.TraceChain(wrapped))
+		assert.False(t, executed, "tracing should not execute the chain")
+	})
+
+	t.Run("unwrapped", func(t *testing.T) {
+		assert.Equal(t, []string{"handler"}, vk.TraceChain(handler))
+		assert.False(t, executed, "tracing should not execute the handler")
+	})
+
+	t.Run("unnamed", func(t *testing.T) {
+		wrapped := vk.WrapHandler(handler, tenantMiddleware, vk.ContentTypeMiddleware("text/plain"))
+
+		assert.Equal(t, []string{"contenttype", "tenantMiddleware", "handler"}, vk.TraceChain(wrapped))
+	})
+
+	t.Run("groups", func(t *testing.T) {
+		inner := vk.Group("/v1").WithMiddlewares(authMw)
+		inner.GET("/me", handler, tenantMiddleware)
+
+		outer := vk.Group("/api").WithMiddlewares(requestIDMw, recoverMw)
+		outer.AddGroup(inner)
+
+		router := vk.NewRouter(vlog.Default(vlog.Level(vlog.LogLevelError)), "")
+		router.WithMiddlewares(vk.ErrorMiddleware())
+		router.AddGroup(outer)
+
+		routes := router.Routes()
+		assert.Len(t, routes, 1)
+		assert.Equal(t, http.MethodGet, routes[0].Method)
+		assert.Equal(t, "/api/v1/me", routes[0].Path)
+		assert.Equal(t, []string{"error", "recover", "requestid", "auth", "tenantMiddleware", "handler"}, routes[0].Chain)
+		assert.False(t, executed, "listing routes should not execute the chain")
+	})
+}
@@ -0,0 +1,263 @@
+package test_test
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+	"github.com/suborbital/vektor/vtest"
+)
+
+func upgradeRequest(t *testing.T, path string) *http.Request {
+	r, err := http.NewRequest(http.MethodGet, path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.Header.Add("Connection", "keep-alive, Upgrade")
+	r.Header.Add("Upgrade", "WebSocket")
+	r.Header.Add("Sec-WebSocket-Version", "13")
+	r.Header.Add("Sec-WebSocket-Key", "some-key")
+	r.Header.Add("Accept-Encoding", "gzip")
+
+	return r
+}
+
+func TestIsWebSocketUpgrade(t *testing.T) {
+	cases := map[string]struct {
+		method     string
+		connection string
+		upgrade    string
+		expected   bool
+	}{
+		"upgrade":         {http.MethodGet, "Upgrade", "websocket", true},
+		"case":            {http.MethodGet, "UPGRADE", "WebSocket", true},
+		"list":            {http.MethodGet, "keep-alive, upgrade", "websocket", true},
+		"no connection":   {http.MethodGet, "", "websocket", false},
+		"other protocol":  {http.MethodGet, "upgrade", "h2c", false},
+		"wrong method":    {http.MethodPost, "upgrade", "websocket", false},
+		"plain keepalive": {http.MethodGet, "keep-alive", "", false},
+	}
+
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+
+	var got bool
+	server.Handle(http.MethodGet, "/check", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		got = ctx.IsWebSocketUpgrade()
+		return nil
+	})
+	server.Handle(http.MethodPost, "/check", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		got = ctx.IsWebSocketUpgrade()
+		return nil
+	})
+
+	vt := vtest.New(server)
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			r, _ := http.NewRequest(c.method, "/check", nil)
+			r.Header.Set("Connection", c.connection)
+			r.Header.Set("Upgrade", c.upgrade)
+
+			vt.Do(r, t)
+
+			assert.Equal(t, c.expected, got)
+		})
+	}
+
+	assert.False(t, vk.NewCtx(nil, nil, nil).IsWebSocketUpgrade())
+}
+
+func TestBuiltinsAreUpgradeAware(t *testing.T) {
+	var ctxErr error
+
+	sock := func(r *http.Request, ctx *vk.Ctx, conn *websocket.Conn) error {
+		time.Sleep(20 * time.Millisecond)
+		ctxErr = ctx.Context.Err()
+
+		return nil
+	}
+
+	middleware := map[string]vk.Middleware{
+		"bodylimit":   vk.BodyLimitMiddleware(1),
+		"timeout":     vk.TimeoutMiddleware(time.Millisecond),
+		"compression": vk.CompressionMiddleware(),
+	}
+
+	for name, mw := range middleware {
+		t.Run(name, func(t *testing.T) {
+			ctxErr = nil
+
+			server := vk.New(vk.UseLogger(vlog.Noop()))
+
+			g := vk.Group("").WithMiddlewares(mw)
+			g.WebSocket("/sock", sock)
+			server.AddGroup(g)
+
+			vtest.New(server).Do(upgradeRequest(t, "/sock"), t).
+				AssertStatus(http.StatusSwitchingProtocols).
+				AssertHeader("Upgrade", "websocket")
+
+			assert.NoError(t, ctxErr)
+		})
+	}
+}
+
+func TestBuiltinsApplyToHTTP(t *testing.T) {
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+
+	g := vk.Group("").WithMiddlewares(vk.BodyLimitMiddleware(4), vk.TimeoutMiddleware(50*time.Millisecond), vk.CompressionMiddleware())
+	g.POST("/echo", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return vk.E(http.StatusRequestEntityTooLarge, err.Error())
+		}
+
+		return vk.RespondBytes(ctx.Context, w, body, http.StatusOK)
+	})
+	g.GET("/slow", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		<-ctx.Context.Done()
+		return ctx.Context.Err()
+	})
+	server.AddGroup(g)
+
+	vt := vtest.New(server)
+
+	t.Run("compressed", func(t *testing.T) {
+		r, _ := http.NewRequest(http.MethodPost, "/echo", bytes.NewBufferString("abcd"))
+		r.Header.Set("Accept-Encoding", "gzip")
+
+		resp := vt.Do(r, t).
+			AssertStatus(http.StatusOK).
+			AssertHeader("Content-Encoding", "gzip")
+
+		gz, err := gzip.NewReader(bytes.NewReader(resp.Body))
+		if assert.NoError(t, err) {
+			body, _ := io.ReadAll(gz)
+			assert.Equal(t, "abcd", string(body))
+		}
+	})
+
+	t.Run("too large", func(t *testing.T) {
+		r, _ := http.NewRequest(http.MethodPost, "/echo", bytes.NewBufferString("abcdef"))
+
+		vt.Do(r, t).AssertStatus(http.StatusRequestEntityTooLarge)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		r, _ := http.NewRequest(http.MethodGet, "/slow", nil)
+
+		vt.Do(r, t).AssertStatus(http.StatusGatewayTimeout)
+	})
+}
+
+// rawHandshake sends a websocket handshake to addr over a plain TCP connection, returning the response
+func rawHandshake(t *testing.T, addr, path string, headers map[string]string) *http.Response {
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+
+	t.Cleanup(func() { conn.Close() })
+
+	req := "GET " + path + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+	for k, v := range headers {
+		req += k + ": " + v + "\r\n"
+	}
+
+	_, err = conn.Write([]byte(req + "\r\n"))
+	require.NoError(t, err)
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+
+	return resp
+}
+
+func TestHandshakeResponseHeaders(t *testing.T) {
+	secure := func(inner vk.HandlerFunc) vk.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+			ctx.RespHeaders.Set("Strict-Transport-Security", "max-age=63072000")
+			ctx.RespHeaders.Set("X-Content-Type-Options", "nosniff")
+			ctx.RespHeaders.Set("Content-Type", "application/json")
+
+			if websocket.Subprotocols(r) != nil {
+				ctx.RespHeaders.Set("Sec-WebSocket-Protocol", websocket.Subprotocols(r)[0])
+			}
+
+			return inner(w, r, ctx)
+		}
+	}
+
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+
+	g := vk.Group("").WithMiddlewares(secure)
+	g.WebSocket("/sock", func(r *http.Request, ctx *vk.Ctx, conn *websocket.Conn) error {
+		return conn.Close()
+	})
+	server.AddGroup(g)
+
+	require.NoError(t, server.TestStart())
+
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	addr := strings.TrimPrefix(ts.URL, "http://")
+
+	handshake := map[string]string{
+		"Connection":             "Upgrade",
+		"Upgrade":                "websocket",
+		"Sec-WebSocket-Version":  "13",
+		"Sec-WebSocket-Key":      "dGhlIHNhbXBsZSBub25jZQ==",
+		"Sec-WebSocket-Protocol": "graphql-ws, chat",
+	}
+
+	t.Run("upgraded", func(t *testing.T) {
+		resp := rawHandshake(t, addr, "/sock", handshake)
+
+		assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+		assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", resp.Header.Get("Sec-WebSocket-Accept"))
+		assert.Equal(t, "max-age=63072000", resp.Header.Get("Strict-Transport-Security"))
+		assert.Equal(t, "nosniff", resp.Header.Get("X-Content-Type-Options"))
+		assert.Equal(t, []string{"graphql-ws"}, resp.Header.Values("Sec-WebSocket-Protocol"))
+		assert.Empty(t, resp.Header.Get("Content-Type"))
+	})
+
+	failures := map[string]struct {
+		key, value string
+		message    string
+	}{
+		"missing key": {"Sec-WebSocket-Key", "", "websocket: not a websocket handshake: 'Sec-WebSocket-Key' header is missing or blank"},
+		"bad version": {"Sec-WebSocket-Version", "8", "websocket: unsupported version: 13 not found in 'Sec-Websocket-Version' header"},
+	}
+
+	for name, f := range failures {
+		t.Run(name, func(t *testing.T) {
+			headers := map[string]string{}
+			for k, v := range handshake {
+				headers[k] = v
+			}
+
+			headers[f.key] = f.value
+
+			resp := rawHandshake(t, addr, "/sock", headers)
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+
+			assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+			assert.Equal(t, "13", resp.Header.Get("Sec-WebSocket-Version"))
+			assert.JSONEq(t, `{"status":400,"message":"`+f.message+`"}`, string(body))
+		})
+	}
+}
@@ -0,0 +1,224 @@
+package test_test
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+	"github.com/suborbital/vektor/vtest"
+)
+
+func TestCacheGetOrFillStampede(t *testing.T) {
+	cache := vk.NewCache(vk.ValueCacheOptions{})
+
+	var fills int32
+	release := make(chan struct{})
+
+	const callers = 20
+
+	var wg sync.WaitGroup
+	results := make(chan interface{}, callers)
+
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			value, err := cache.GetOrFill("countries", 0, func() (interface{}, error) {
+				atomic.AddInt32(&fills, 1)
+				<-release
+
+				return []string{"CA", "FR"}, nil
+			})
+
+			assert.NoError(t, err)
+			results <- value
+		}()
+	}
+
+	// give every caller time to reach GetOrFill before the fill completes
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	wg.Wait()
+	close(results)
+
+	for value := range results {
+		assert.Equal(t, []string{"CA", "FR"}, value)
+	}
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fills))
+
+	stats := cache.Stats()
+	assert.Equal(t, uint64(1), stats.Fills)
+	assert.Equal(t, 1, stats.Entries)
+}
+
+func TestCacheGetOrFillError(t *testing.T) {
+	cache := vk.NewCache(vk.ValueCacheOptions{})
+
+	_, err := cache.GetOrFill("config", 0, func() (interface{}, error) {
+		return nil, vk.E(http.StatusBadGateway, "config service unavailable")
+	})
+	assert.Error(t, err)
+
+	_, ok := cache.Get("config")
+	assert.False(t, ok, "errors should not be cached")
+
+	value, err := cache.GetOrFill("config", 0, func() (interface{}, error) {
+		return "enabled", nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "enabled", value)
+}
+
+func TestCacheTTL(t *testing.T) {
+	clock := &cacheClock{now: time.Now()}
+
+	cache := vk.NewCache(vk.ValueCacheOptions{TTL: time.Minute, Now: clock.Now})
+
+	cache.Set("default", "a", 0)
+	cache.Set("short", "b", 10*time.Second)
+
+	clock.Advance(30 * time.Second)
+
+	_, ok := cache.Get("short")
+	assert.False(t, ok, "the value should expire after its own TTL")
+
+	value, ok := cache.Get("default")
+	assert.True(t, ok)
+	assert.Equal(t, "a", value)
+
+	clock.Advance(30 * time.Second)
+
+	_, ok = cache.Get("default")
+	assert.False(t, ok, "the value should expire after the cache's TTL")
+
+	stats := cache.Stats()
+	assert.Equal(t, uint64(2), stats.Expired)
+	assert.Equal(t, uint64(1), stats.Hits)
+	assert.Equal(t, uint64(2), stats.Misses)
+	assert.Zero(t, stats.Entries)
+}
+
+func TestCacheBounds(t *testing.T) {
+	t.Run("bytes", func(t *testing.T) {
+		cache := vk.NewCache(vk.ValueCacheOptions{MaxBytes: 10})
+
+		cache.Set("a", "aaaa", 0)
+		cache.Set("b", "bbbb", 0)
+
+		// a is now the most recently used, so b is evicted to make room
+		_, ok := cache.Get("a")
+		require.True(t, ok)
+
+		cache.Set("c", "cccc", 0)
+
+		_, ok = cache.Get("b")
+		assert.False(t, ok)
+
+		_, ok = cache.Get("a")
+		assert.True(t, ok)
+
+		cache.Set("huge", "more than ten bytes", 0)
+
+		_, ok = cache.Get("huge")
+		assert.False(t, ok, "values larger than MaxBytes should not be cached")
+
+		stats := cache.Stats()
+		assert.Equal(t, int64(8), stats.Bytes)
+		assert.Equal(t, uint64(1), stats.Evictions)
+	})
+
+	t.Run("size function", func(t *testing.T) {
+		cache := vk.NewCache(vk.ValueCacheOptions{
+			MaxBytes: 100,
+			Size: func(value interface{}) int64 {
+				return int64(len(value.([]int)) * 8)
+			},
+		})
+
+		cache.Set("a", make([]int, 10), 0)
+		cache.Set("b", make([]int, 5), 0)
+
+		_, ok := cache.Get("a")
+		assert.False(t, ok)
+		assert.Equal(t, int64(40), cache.Stats().Bytes)
+	})
+
+	t.Run("entries", func(t *testing.T) {
+		cache := vk.NewCache(vk.ValueCacheOptions{MaxEntries: 2})
+
+		cache.Set("a", 1, 0)
+		cache.Set("b", 2, 0)
+		cache.Set("c", 3, 0)
+
+		_, ok := cache.Get("a")
+		assert.False(t, ok)
+		assert.Equal(t, 2, cache.Stats().Entries)
+	})
+}
+
+func TestCacheDelete(t *testing.T) {
+	cache := vk.NewCache(vk.ValueCacheOptions{})
+
+	cache.Set("flags/a", true, 0)
+	cache.Set("flags/b", false, 0)
+	cache.Set("countries", []string{"CA"}, 0)
+
+	cache.Delete("countries")
+	assert.Equal(t, 2, cache.DeleteByPrefix("flags/"))
+	assert.Zero(t, cache.Stats().Entries)
+
+	// a value being filled while its key is deleted is returned, but isn't cached
+	value, err := cache.GetOrFill("flags/c", 0, func() (interface{}, error) {
+		cache.DeleteByPrefix("flags/")
+		return "stale", nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "stale", value)
+
+	_, ok := cache.Get("flags/c")
+	assert.False(t, ok)
+}
+
+func TestCacheFromCtx(t *testing.T) {
+	server := vk.New(vk.UseLogger(vlog.Noop()), vk.UseCache(vk.ValueCacheOptions{TTL: time.Minute}))
+
+	var fills int32
+
+	server.GET("/countries", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		countries, err := vk.CacheFrom(ctx).GetOrFill("countries", 0, func() (interface{}, error) {
+			atomic.AddInt32(&fills, 1)
+			return []string{"CA", "FR"}, nil
+		})
+		if err != nil {
+			return err
+		}
+
+		return vk.RespondJSON(ctx.Context, w, countries, http.StatusOK)
+	})
+
+	vt := vtest.New(server)
+
+	for i := 0; i < 3; i++ {
+		r, _ := http.NewRequest(http.MethodGet, "/countries", nil)
+		vt.Do(r, t).AssertStatus(http.StatusOK).AssertBodyString(`["CA","FR"]`)
+	}
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fills))
+	assert.Equal(t, uint64(2), server.Cache().Stats().Hits)
+
+	var nilCache *vk.Cache
+	value, err := nilCache.GetOrFill("countries", 0, func() (interface{}, error) { return "filled", nil })
+	assert.NoError(t, err)
+	assert.Equal(t, "filled", value, "a nil Cache should call fill every time")
+}
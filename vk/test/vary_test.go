@@ -0,0 +1,93 @@
+package test_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+)
+
+// languageMiddleware stands in for content negotiation on Accept-Language
+func languageMiddleware() vk.Middleware {
+	return vk.Named("language", func(inner vk.HandlerFunc) vk.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+			ctx.AddVary("accept-language")
+
+			return inner(w, r, ctx)
+		}
+	})
+}
+
+func TestVary(t *testing.T) {
+	middlewares := map[string]vk.Middleware{
+		"compression": vk.CompressionMiddleware(),
+		"cors":        vk.CORSMiddleware(vk.CORSOptions{AllowedOrigins: []string{"https://example.com"}}),
+		"language":    languageMiddleware(),
+	}
+
+	orders := [][]string{
+		{"compression", "cors", "language"},
+		{"compression", "language", "cors"},
+		{"cors", "compression", "language"},
+		{"cors", "language", "compression"},
+		{"language", "compression", "cors"},
+		{"language", "cors", "compression"},
+	}
+
+	for _, order := range orders {
+		t.Run(strings.Join(order, ","), func(t *testing.T) {
+			mws := make([]vk.Middleware, len(order))
+			for i, name := range order {
+				mws[i] = middlewares[name]
+			}
+
+			server := vk.New()
+
+			g := vk.Group("/api").WithMiddlewares(mws...)
+
+			g.GET("/greeting", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+				// a direct Set is merged rather than replacing what the middleware added
+				ctx.RespHeaders.Set("Vary", "Cookie, Origin")
+
+				return vk.RespondString(ctx.Context, w, strings.Repeat("hello ", 100), http.StatusOK)
+			})
+
+			g.GET("/empty", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+				return nil
+			})
+
+			server.AddGroup(g)
+			require.NoError(t, server.TestStart())
+
+			for path, expected := range map[string]string{
+				"/api/greeting": "Accept-Encoding, Accept-Language, Cookie, Origin",
+				"/api/empty":    "Accept-Encoding, Accept-Language, Origin",
+			} {
+				r := httptest.NewRequest(http.MethodGet, path, nil)
+				r.Header.Set("Accept-Encoding", "gzip")
+				r.Header.Set("Origin", "https://example.com")
+
+				w := httptest.NewRecorder()
+				server.ServeHTTP(w, r)
+
+				assert.Equal(t, []string{expected}, w.Result().Header.Values("Vary"), path)
+			}
+		})
+	}
+}
+
+func TestAddVary(t *testing.T) {
+	ctx := vk.NewCtx(nil, nil, nil)
+
+	ctx.AddVary("origin")
+	ctx.AddVary("Accept-Encoding, Origin")
+	assert.Equal(t, "Accept-Encoding, Origin", ctx.RespHeaders.Get("Vary"))
+
+	ctx.AddVary("*")
+	assert.Equal(t, "*", ctx.RespHeaders.Get("Vary"))
+}
@@ -0,0 +1,109 @@
+package test_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+)
+
+func TestWebSocketLimits(t *testing.T) {
+	server := vk.New(
+		vk.UseLogger(vlog.Noop()),
+		vk.UseWebSocketLimits(0, 2),
+		vk.UseWebSocketClientKey(func(ctx *vk.Ctx) string {
+			return ctx.Get("client").(string)
+		}),
+	)
+
+	// stands in for authentication, identifying the client making the request
+	identify := vk.Named("identify", func(inner vk.HandlerFunc) vk.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+			ctx.Set("client", r.Header.Get("X-Client"))
+			return inner(w, r, ctx)
+		}
+	})
+
+	g := vk.Group("").WithMiddlewares(identify)
+
+	g.WebSocket("/ws", func(r *http.Request, ctx *vk.Ctx, conn *websocket.Conn) error {
+		// the connection outlives its handler, so its slot must be held until it closes
+		go func() {
+			defer conn.Close()
+
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+
+		return nil
+	})
+
+	server.AddGroup(g)
+
+	require.NoError(t, server.TestStart())
+
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	dial := func(client string) (*websocket.Conn, int) {
+		conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws", http.Header{"X-Client": {client}})
+		if err != nil {
+			require.NotNil(t, resp, err)
+			return nil, resp.StatusCode
+		}
+
+		t.Cleanup(func() { conn.Close() })
+
+		return conn, resp.StatusCode
+	}
+
+	first, status := dial("alice")
+	assert.Equal(t, http.StatusSwitchingProtocols, status)
+
+	_, status = dial("alice")
+	assert.Equal(t, http.StatusSwitchingProtocols, status)
+
+	_, status = dial("alice")
+	assert.Equal(t, http.StatusTooManyRequests, status)
+
+	_, status = dial("bob")
+	assert.Equal(t, http.StatusSwitchingProtocols, status)
+
+	stats := server.WebSockets().Stats()
+	assert.Equal(t, 3, stats.Open)
+	assert.Equal(t, 2, stats.Clients)
+	assert.Equal(t, uint64(1), stats.RejectedClient)
+
+	// closing a connection frees its slot once the server's read loop sees it go
+	first.Close()
+
+	assert.Eventually(t, func() bool {
+		return server.WebSockets().Stats().Open == 2
+	}, 2*time.Second, 10*time.Millisecond)
+
+	_, status = dial("alice")
+	assert.Equal(t, http.StatusSwitchingProtocols, status)
+
+	// the limits can be changed while the server is running
+	server.WebSockets().SetLimits(3, 2)
+
+	_, status = dial("carol")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+
+	stats = server.WebSockets().Stats()
+	assert.Equal(t, 3, stats.Open)
+	assert.Equal(t, 3, stats.MaxConnections)
+	assert.Equal(t, uint64(1), stats.RejectedGlobal)
+	assert.Equal(t, uint64(1), stats.RejectedClient)
+}
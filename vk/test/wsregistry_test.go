@@ -0,0 +1,155 @@
+package test_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+)
+
+func TestConnRegistry(t *testing.T) {
+	server := vk.New(vk.UseLogger(vlog.Noop()), vk.UseWebSocketOptions(vk.WSOptions{PingInterval: 50 * time.Millisecond}))
+
+	// echoes each message to its sender through the registry, so that the write can't race with broadcasts
+	echo := func(r *http.Request, ctx *vk.Ctx, conn *websocket.Conn) error {
+		for {
+			msgType, data, err := conn.ReadMessage()
+			if err != nil {
+				return nil
+			}
+
+			if err := ctx.Sockets().Send(ctx.RequestID(), msgType, data); err != nil {
+				return err
+			}
+		}
+	}
+
+	server.WebSocket("/ws", echo)
+
+	g := vk.Group("/strict").WithMiddlewares(vk.WebSocketOptions(vk.WSOptions{
+		CheckOrigin: func(r *http.Request) bool {
+			return r.Header.Get("Origin") == "https://example.com"
+		},
+	}))
+	g.WebSocket("/ws", echo)
+	server.AddGroup(g)
+
+	server.POST("/broadcast", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		if err := ctx.Sockets().Broadcast(websocket.TextMessage, []byte("hello")); err != nil {
+			return err
+		}
+
+		return vk.RespondString(ctx.Context, w, "sent", http.StatusOK)
+	})
+
+	require.NoError(t, server.TestStart())
+
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http")
+
+	dial := func(path, id string) *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL+path, http.Header{"X-Request-ID": {id}})
+		require.NoError(t, err)
+
+		t.Cleanup(func() { conn.Close() })
+
+		return conn
+	}
+
+	// reads the connection's messages, which also answers the server's pings
+	listen := func(conn *websocket.Conn) <-chan string {
+		messages := make(chan string, 8)
+
+		go func() {
+			defer close(messages)
+
+			for {
+				_, data, err := conn.ReadMessage()
+				if err != nil {
+					return
+				}
+
+				messages <- string(data)
+			}
+		}()
+
+		return messages
+	}
+
+	next := func(t *testing.T, messages <-chan string) string {
+		select {
+		case msg := <-messages:
+			return msg
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out waiting for a message")
+		}
+
+		return ""
+	}
+
+	alive := []*websocket.Conn{dial("/ws", "a"), dial("/ws", "b")}
+	messages := []<-chan string{listen(alive[0]), listen(alive[1])}
+
+	// never reads, so it doesn't answer the server's pings
+	dial("/ws", "silent")
+
+	killed := dial("/ws", "killed")
+
+	require.Eventually(t, func() bool { return server.Sockets().Len() == 4 }, time.Second, 10*time.Millisecond)
+
+	t.Run("broadcast", func(t *testing.T) {
+		resp, err := http.Post(ts.URL+"/broadcast", "text/plain", nil)
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		for _, m := range messages {
+			assert.Equal(t, "hello", next(t, m))
+		}
+	})
+
+	t.Run("send", func(t *testing.T) {
+		require.NoError(t, alive[1].WriteMessage(websocket.TextMessage, []byte("ping b")))
+		assert.Equal(t, "ping b", next(t, messages[1]))
+
+		assert.ErrorIs(t, server.Sockets().Send("nobody", websocket.TextMessage, []byte("x")), vk.ErrConnNotFound)
+	})
+
+	t.Run("reaped", func(t *testing.T) {
+		// goes away without a close frame, while the silent connection times out on the server's read
+		killed.UnderlyingConn().Close()
+
+		assert.Eventually(t, func() bool { return server.Sockets().Len() == 2 }, 500*time.Millisecond, 10*time.Millisecond)
+
+		// the live connections keep answering pings
+		time.Sleep(200 * time.Millisecond)
+
+		assert.Equal(t, 2, server.Sockets().Len())
+
+		require.NoError(t, alive[0].WriteMessage(websocket.TextMessage, []byte("still here")))
+		assert.Equal(t, "still here", next(t, messages[0]))
+	})
+
+	t.Run("origin", func(t *testing.T) {
+		_, resp, err := websocket.DefaultDialer.Dial(wsURL+"/strict/ws", http.Header{"Origin": {"https://evil.example"}})
+		require.Error(t, err)
+		require.NotNil(t, resp)
+
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL+"/strict/ws", http.Header{"Origin": {"https://example.com"}})
+		require.NoError(t, err)
+		conn.Close()
+	})
+}
@@ -0,0 +1,447 @@
+package vk
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// WebSocketCloseSlowConsumer is the close code sent to websocket clients that are terminated by a Throttler
+const WebSocketCloseSlowConsumer = 4008
+
+// ErrSlowConnection is returned by the writes of responses that a Throttler has terminated
+var ErrSlowConnection = errors.New("connection terminated for not keeping up with its writes")
+
+// ThrottleOptions configures a Throttler
+type ThrottleOptions struct {
+	// BytesPerSecond is the rate that each connection's writes are paced at, with bursts of up to Burst bytes (which
+	// defaults to BytesPerSecond). A rate of 0 disables pacing
+	BytesPerSecond int64
+	Burst          int64
+
+	// SlowAfter is how long a write can block before its connection is considered slow, as its client has stopped
+	// reading for that long. 0 disables slow connection detection
+	SlowAfter time.Duration
+
+	// TerminateSlow terminates slow connections. Once the frame being written completes, websocket clients are sent
+	// CloseCode (WebSocketCloseSlowConsumer by default) and the connection is closed, and the remaining writes of
+	// HTTP responses fail with ErrSlowConnection. A websocket connection whose write is still blocked after twice
+	// SlowAfter is reset
+	TerminateSlow bool
+	CloseCode     int
+}
+
+// ThrottleStats reports the state of a Throttler
+type ThrottleStats struct {
+	Active     int64  `json:"active"`     // the connections currently being throttled
+	Paced      uint64 `json:"paced"`      // the writes that were delayed to keep to the rate
+	Slow       uint64 `json:"slow"`       // the connections that were slow
+	Terminated uint64 `json:"terminated"` // the slow connections that were terminated
+}
+
+// Throttler paces the writes of streamed responses and websocket connections, so that a single client can't have
+// the server buffer more for it than it can read, and detects (and optionally terminates) clients that stop
+// reading. Writes are only delayed once a connection has used its burst, so clients that keep up see no latency
+type Throttler struct {
+	opts ThrottleOptions
+
+	active     int64
+	paced      uint64
+	slow       uint64
+	terminated uint64
+
+	lock     sync.Mutex
+	conns    map[*throttle]struct{} // connections that the watchdog can reset
+	watching bool
+}
+
+// NewThrottler creates a Throttler
+func NewThrottler(opts ThrottleOptions) *Throttler {
+	if opts.Burst <= 0 {
+		opts.Burst = opts.BytesPerSecond
+	}
+
+	if opts.CloseCode == 0 {
+		opts.CloseCode = WebSocketCloseSlowConsumer
+	}
+
+	t := &Throttler{
+		opts:  opts,
+		conns: map[*throttle]struct{}{},
+	}
+
+	return t
+}
+
+// Middleware returns a Middleware that throttles the writes of the route's responses, and those of the
+// websocket connections it upgrades
+func (t *Throttler) Middleware() Middleware {
+	return Named("throttle", func(inner HandlerFunc) HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request, ctx *Ctx) error {
+			th := &throttle{t: t, tokens: float64(t.opts.Burst), last: time.Now()}
+
+			atomic.AddInt64(&t.active, 1)
+			defer atomic.AddInt64(&t.active, -1)
+			defer t.unwatch(th)
+
+			return inner(&throttledWriter{ResponseWriter: w, th: th}, r, ctx)
+		}
+	})
+}
+
+// Stats returns the throttler's counters
+func (t *Throttler) Stats() ThrottleStats {
+	stats := ThrottleStats{
+		Active:     atomic.LoadInt64(&t.active),
+		Paced:      atomic.LoadUint64(&t.paced),
+		Slow:       atomic.LoadUint64(&t.slow),
+		Terminated: atomic.LoadUint64(&t.terminated),
+	}
+
+	return stats
+}
+
+// RegisterAdmin mounts GET /throttle on the admin router, reporting the throttler's stats
+func (t *Throttler) RegisterAdmin(r *Router) {
+	r.GET("/throttle", func(w http.ResponseWriter, _ *http.Request, ctx *Ctx) error {
+		return RespondJSON(ctx.Context, w, t.Stats(), http.StatusOK)
+	})
+}
+
+// watch has the watchdog reset th's connection if a write blocks for too long, starting the watchdog if needed
+func (t *Throttler) watch(th *throttle) {
+	if t.opts.SlowAfter <= 0 || !t.opts.TerminateSlow {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.conns[th] = struct{}{}
+
+	if !t.watching {
+		t.watching = true
+		go t.watchdog()
+	}
+}
+
+func (t *Throttler) unwatch(th *throttle) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	delete(t.conns, th)
+}
+
+// watchdog resets the connections whose writes have been blocked for twice SlowAfter, until there are none left
+// to watch. No timer is set for each write, so that writes cost nothing extra while the client keeps up
+func (t *Throttler) watchdog() {
+	ticker := time.NewTicker(t.opts.SlowAfter / 4)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		t.lock.Lock()
+
+		if len(t.conns) == 0 {
+			t.watching = false
+			t.lock.Unlock()
+			return
+		}
+
+		var stuck []*throttle
+
+		for th := range t.conns {
+			if started := atomic.LoadInt64(&th.writing); started != 0 && now.Sub(time.Unix(0, started)) > 2*t.opts.SlowAfter {
+				stuck = append(stuck, th)
+				delete(t.conns, th)
+			}
+		}
+
+		t.lock.Unlock()
+
+		for _, th := range stuck {
+			if th.terminate() {
+				th.reset()
+			}
+		}
+	}
+}
+
+// throttle is the token bucket and slow connection state of a single connection
+type throttle struct {
+	t *Throttler
+
+	tokens float64
+	last   time.Time
+
+	writing    int64 // when the current write started, in unix nanoseconds, or 0
+	slow       bool
+	terminated int32
+
+	conn net.Conn // set once a websocket connection has been hijacked
+}
+
+// write paces p to the throttle's rate and writes it with write, which must write all of p or return an error
+func (th *throttle) write(p []byte, write func([]byte) (int, error)) (int, error) {
+	if atomic.LoadInt32(&th.terminated) == 1 {
+		return 0, ErrSlowConnection
+	}
+
+	written := 0
+
+	for len(p) > 0 {
+		chunk := p
+		if burst := int(th.t.opts.Burst); burst > 0 && len(chunk) > burst {
+			chunk = chunk[:burst]
+		}
+
+		th.wait(len(chunk))
+
+		n, err := th.timed(chunk, write)
+		written += n
+
+		if err != nil {
+			return written, err
+		}
+
+		p = p[len(chunk):]
+	}
+
+	return written, nil
+}
+
+// shouldTerminate returns true if the connection is slow and should be terminated, marking it as terminated
+func (th *throttle) shouldTerminate() bool {
+	return th.slow && th.t.opts.TerminateSlow && th.terminate()
+}
+
+// wait blocks until n bytes can be written at the throttle's rate
+func (th *throttle) wait(n int) {
+	rate := th.t.opts.BytesPerSecond
+	if rate <= 0 {
+		return
+	}
+
+	now := time.Now()
+
+	th.tokens += now.Sub(th.last).Seconds() * float64(rate)
+	if burst := float64(th.t.opts.Burst); th.tokens > burst {
+		th.tokens = burst
+	}
+
+	th.last = now
+	th.tokens -= float64(n)
+
+	if th.tokens < 0 {
+		atomic.AddUint64(&th.t.paced, 1)
+
+		// only connections that are over their rate ever wait
+		time.Sleep(time.Duration(-th.tokens / float64(rate) * float64(time.Second)))
+	}
+}
+
+// timed writes p with write, recording how long it blocked
+func (th *throttle) timed(p []byte, write func([]byte) (int, error)) (int, error) {
+	if th.t.opts.SlowAfter <= 0 {
+		return write(p)
+	}
+
+	start := time.Now()
+
+	atomic.StoreInt64(&th.writing, start.UnixNano())
+	n, err := write(p)
+	atomic.StoreInt64(&th.writing, 0)
+
+	if !th.slow && time.Since(start) > th.t.opts.SlowAfter {
+		th.slow = true
+		atomic.AddUint64(&th.t.slow, 1)
+	}
+
+	return n, err
+}
+
+// terminate marks the connection as terminated, returning false if it already was
+func (th *throttle) terminate() bool {
+	if !atomic.CompareAndSwapInt32(&th.terminated, 0, 1) {
+		return false
+	}
+
+	atomic.AddUint64(&th.t.terminated, 1)
+
+	return true
+}
+
+// close sends the websocket close frame and closes the connection
+func (th *throttle) close() {
+	reason := "slow consumer"
+
+	// an unmasked close frame, as sent by a server (RFC 6455, section 5.5.1)
+	frame := make([]byte, 4, 4+len(reason))
+	frame[0] = 0x88
+	frame[1] = byte(2 + len(reason))
+	binary.BigEndian.PutUint16(frame[2:], uint16(th.t.opts.CloseCode))
+	frame = append(frame, reason...)
+
+	_ = th.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	_, _ = th.conn.Write(frame)
+	_ = th.conn.Close()
+}
+
+// reset closes the connection without waiting for its blocked write, discarding whatever is unsent
+func (th *throttle) reset() {
+	if tcp, ok := th.conn.(interface{ SetLinger(int) error }); ok {
+		_ = tcp.SetLinger(0)
+	}
+
+	_ = th.conn.Close()
+}
+
+// throttledWriter throttles the writes of a response, and those of its connection if it is hijacked
+type throttledWriter struct {
+	http.ResponseWriter
+	th *throttle
+}
+
+func (tw *throttledWriter) Write(b []byte) (int, error) {
+	n, err := tw.th.write(b, tw.ResponseWriter.Write)
+	if err == nil && tw.th.shouldTerminate() {
+		return n, ErrSlowConnection
+	}
+
+	return n, err
+}
+
+// Flush flushes the underlying ResponseWriter if it supports flushing, which counts towards slow detection as the
+// buffered response is written to the connection
+func (tw *throttledWriter) Flush() {
+	f, ok := tw.ResponseWriter.(http.Flusher)
+	if !ok || atomic.LoadInt32(&tw.th.terminated) == 1 {
+		return
+	}
+
+	_, _ = tw.th.timed(nil, func([]byte) (int, error) {
+		f.Flush()
+		return 0, nil
+	})
+}
+
+// Hijack hijacks the underlying ResponseWriter's connection, wrapping it to throttle its writes
+func (tw *throttledWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := tw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("ResponseWriter does not implement http.Hijacker")
+	}
+
+	conn, rw, err := h.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tw.th.conn = conn
+	tw.th.t.watch(tw.th)
+
+	return &throttledConn{Conn: conn, th: tw.th}, rw, nil
+}
+
+// throttledConn throttles the writes of a hijacked websocket connection
+type throttledConn struct {
+	net.Conn
+	th     *throttle
+	frames frameTracker
+}
+
+func (c *throttledConn) Write(b []byte) (int, error) {
+	n, err := c.th.write(b, c.Conn.Write)
+	c.frames.advance(b[:n])
+
+	// the close frame can't be written in the middle of another frame, so a slow connection is terminated at the
+	// end of the first write that completes a frame
+	if err == nil && c.frames.between() && c.th.shouldTerminate() {
+		c.th.close()
+		return n, ErrSlowConnection
+	}
+
+	return n, err
+}
+
+// frameTracker follows the frames written to a websocket connection, starting after the handshake response
+type frameTracker struct {
+	upgraded  bool
+	header    []byte // the part of the next frame's header that has been written
+	remaining uint64 // the bytes of the current frame's payload that haven't been written
+}
+
+func (f *frameTracker) advance(p []byte) {
+	if !f.upgraded {
+		// the handshake response is written all at once
+		f.upgraded = bytes.HasSuffix(p, []byte("\r\n\r\n"))
+		return
+	}
+
+	for len(p) > 0 {
+		if f.remaining > 0 {
+			n := uint64(len(p))
+			if n > f.remaining {
+				n = f.remaining
+			}
+
+			f.remaining -= n
+			p = p[n:]
+
+			continue
+		}
+
+		f.header = append(f.header, p[0])
+		p = p[1:]
+
+		if size, ok := framePayloadSize(f.header); ok {
+			f.remaining = size
+			f.header = f.header[:0]
+		}
+	}
+}
+
+// between returns true if the last frame has been written completely
+func (f *frameTracker) between() bool {
+	return f.upgraded && f.remaining == 0 && len(f.header) == 0
+}
+
+// framePayloadSize returns the size of the frame's payload, or false if header is not yet a complete frame header
+// (RFC 6455, section 5.2)
+func framePayloadSize(header []byte) (uint64, bool) {
+	if len(header) < 2 {
+		return 0, false
+	}
+
+	size, length := uint64(header[1]&0x7f), 2
+
+	switch size {
+	case 126:
+		length += 2
+	case 127:
+		length += 8
+	}
+
+	if header[1]&0x80 != 0 {
+		length += 4 // the masking key
+	}
+
+	if len(header) < length {
+		return 0, false
+	}
+
+	switch size {
+	case 126:
+		size = uint64(binary.BigEndian.Uint16(header[2:4]))
+	case 127:
+		size = binary.BigEndian.Uint64(header[2:10])
+	}
+
+	return size, true
+}
@@ -0,0 +1,193 @@
+package vk
+
+import (
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultRecommendationPercentile = 99
+	defaultRecommendationMultiplier = 1.5
+)
+
+// streamingContentTypes are the media types of responses that are streamed, whose duration says nothing about
+// how long their route should be allowed to take
+var streamingContentTypes = map[string]bool{
+	eventStreamContentType: true,
+	ndjsonContentType:      true,
+	multipartContentType:   true,
+}
+
+// TimeoutRecommendation is the suggested timeout of a route, based on the latencies recorded for it
+type TimeoutRecommendation struct {
+	Method      string        `json:"method"`
+	Route       string        `json:"route"` // the pattern of the route, i.e. /users/:id
+	Samples     uint64        `json:"samples"`
+	Percentile  time.Duration `json:"percentile"`  // the latency at the requested percentile
+	Recommended time.Duration `json:"recommended"` // the percentile times the multiplier
+}
+
+// RouteLatencies records the latency of each route's requests while learning timeouts, see UseTimeoutLearning
+type RouteLatencies struct {
+	routes sync.Map // routeKey -> *routeLatency
+}
+
+type routeKey struct {
+	method string
+	route  string
+}
+
+// routeLatency is the latency histogram of a route, and whether any of its requests were streamed
+type routeLatency struct {
+	hist      LatencyHistogram
+	streaming int32
+}
+
+func newRouteLatencies() *RouteLatencies {
+	return &RouteLatencies{}
+}
+
+// Observe records the latency of a request to route, as the router does for every request it handles
+func (l *RouteLatencies) Observe(method, route string, d time.Duration) {
+	if l == nil {
+		return
+	}
+
+	l.route(method, route).hist.Observe(d)
+}
+
+// TimeoutRecommendations returns a suggested timeout for each route with recorded latencies: the latency at
+// percentile (i.e. 99), times multiplier (i.e. 1.5). Websocket routes and routes that have streamed a response
+// (such as server-sent events) are left out
+func (l *RouteLatencies) TimeoutRecommendations(percentile, multiplier float64) []TimeoutRecommendation {
+	recommendations := []TimeoutRecommendation{}
+	if l == nil {
+		return recommendations
+	}
+
+	l.routes.Range(func(k, v interface{}) bool {
+		key, latency := k.(routeKey), v.(*routeLatency)
+
+		samples := latency.hist.Count()
+		if samples == 0 || atomic.LoadInt32(&latency.streaming) == 1 {
+			return true
+		}
+
+		p := latency.hist.Quantile(percentile / 100)
+
+		recommendations = append(recommendations, TimeoutRecommendation{
+			Method:      key.method,
+			Route:       key.route,
+			Samples:     samples,
+			Percentile:  p,
+			Recommended: time.Duration(float64(p) * multiplier),
+		})
+
+		return true
+	})
+
+	sort.Slice(recommendations, func(i, j int) bool {
+		if recommendations[i].Route == recommendations[j].Route {
+			return recommendations[i].Method < recommendations[j].Method
+		}
+
+		return recommendations[i].Route < recommendations[j].Route
+	})
+
+	return recommendations
+}
+
+// RegisterAdmin mounts GET /timeouts on the admin router, reporting the timeout recommendations. The percentile and
+// multiplier query parameters default to 99 and 1.5
+func (l *RouteLatencies) RegisterAdmin(r *Router) {
+	r.GET("/timeouts", func(w http.ResponseWriter, req *http.Request, ctx *Ctx) error {
+		percentile, err := queryFloat(req, "percentile", defaultRecommendationPercentile)
+		if err != nil || percentile <= 0 || percentile > 100 {
+			return E(http.StatusBadRequest, "percentile must be above 0 and at most 100")
+		}
+
+		multiplier, err := queryFloat(req, "multiplier", defaultRecommendationMultiplier)
+		if err != nil || multiplier <= 0 {
+			return E(http.StatusBadRequest, "multiplier must be above 0")
+		}
+
+		return RespondJSON(ctx.Context, w, l.TimeoutRecommendations(percentile, multiplier), http.StatusOK)
+	})
+}
+
+// route returns the latency of a route, creating it if it hasn't been recorded yet
+func (l *RouteLatencies) route(method, route string) *routeLatency {
+	key := routeKey{method: method, route: route}
+
+	if latency, ok := l.routes.Load(key); ok {
+		return latency.(*routeLatency)
+	}
+
+	latency, _ := l.routes.LoadOrStore(key, &routeLatency{})
+
+	return latency.(*routeLatency)
+}
+
+// observeRequest records the latency of a request that the router has handled, or marks its route as streaming
+func (l *RouteLatencies) observeRequest(method, route string, start time.Time, w http.ResponseWriter, ctx *Ctx) {
+	if l == nil {
+		return
+	}
+
+	latency := l.route(method, route)
+
+	if ctx.IsWebSocketUpgrade() || isStreamingResponse(w.Header()) {
+		atomic.StoreInt32(&latency.streaming, 1)
+		return
+	}
+
+	latency.hist.Observe(time.Since(start))
+}
+
+// isStreamingResponse returns true if the response's content type is one that is streamed
+func isStreamingResponse(h http.Header) bool {
+	mediaType, _, err := mime.ParseMediaType(h.Get(contentTypeHeaderKey))
+	if err != nil {
+		return false
+	}
+
+	return streamingContentTypes[mediaType]
+}
+
+// queryFloat parses the query parameter name as a float, returning def if it is absent
+func queryFloat(r *http.Request, name string, def float64) (float64, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return def, nil
+	}
+
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid %s", name)
+	}
+
+	return f, nil
+}
+
+// useRouteLatencies sets the registry that the router records latencies in, or nil to disable learning
+func (rt *Router) useRouteLatencies(latencies *RouteLatencies) {
+	rt.latencies = latencies
+}
+
+// TimeoutRecommendations returns suggested timeouts for the routes handled while learning timeouts (see
+// UseTimeoutLearning), or none if it is disabled. See RouteLatencies.TimeoutRecommendations
+func (rt *Router) TimeoutRecommendations(percentile, multiplier float64) []TimeoutRecommendation {
+	return rt.latencies.TimeoutRecommendations(percentile, multiplier)
+}
+
+// RouteLatencies returns the server's route latency registry, which is nil unless UseTimeoutLearning is set
+func (s *Server) RouteLatencies() *RouteLatencies {
+	return s.latencies
+}
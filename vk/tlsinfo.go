@@ -0,0 +1,84 @@
+package vk
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+// TLSTerminatedUpstream is returned by Ctx.TLSVersion when TLS was terminated by a trusted proxy, in which case
+// the version that the client negotiated is unknown
+const TLSTerminatedUpstream = "terminated-upstream"
+
+var tlsVersionNames = map[uint16]string{
+	tls.VersionTLS10: "TLS 1.0",
+	tls.VersionTLS11: "TLS 1.1",
+	tls.VersionTLS12: "TLS 1.2",
+	tls.VersionTLS13: "TLS 1.3",
+}
+
+// TLS returns the state of the request's TLS connection, or nil if it was not served over TLS
+func (c *Ctx) TLS() *tls.ConnectionState {
+	if c == nil || c.request == nil {
+		return nil
+	}
+
+	return c.request.TLS
+}
+
+// IsTLS returns true if the request was served over TLS, or if the proxy is trusted (see UseTrustProxy)
+// and it reports that the client connected using HTTPS
+func (c *Ctx) IsTLS() bool {
+	return c.TLS() != nil || c.forwardedTLS()
+}
+
+// TLSVersion returns the TLS version of the request's connection (i.e. "TLS 1.3"), TLSTerminatedUpstream if
+// TLS was terminated by a trusted proxy, or an empty string for plaintext requests
+func (c *Ctx) TLSVersion() string {
+	if state := c.TLS(); state != nil {
+		return tlsVersionName(state.Version)
+	}
+
+	if c.forwardedTLS() {
+		return TLSTerminatedUpstream
+	}
+
+	return ""
+}
+
+// forwardedTLS returns true if a trusted proxy reports that the client connected using HTTPS
+func (c *Ctx) forwardedTLS() bool {
+	if c == nil || c.request == nil || !c.trustProxy {
+		return false
+	}
+
+	proto, _, _ := strings.Cut(c.request.Header.Get("X-Forwarded-Proto"), ",")
+
+	return strings.EqualFold(strings.TrimSpace(proto), "https")
+}
+
+// useTrustProxy sets whether the router's requests trust X-Forwarded-* headers
+func (rt *Router) useTrustProxy(trust bool) {
+	rt.trustProxy = trust
+}
+
+func tlsVersionName(version uint16) string {
+	if name, ok := tlsVersionNames[version]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("0x%04X", version)
+}
+
+// tlsLogDetails describes the request's TLS connection for the access log, or returns an empty string for plaintext
+func tlsLogDetails(ctx *Ctx) string {
+	if state := ctx.TLS(); state != nil {
+		return fmt.Sprintf("[%s %s]", tlsVersionName(state.Version), tls.CipherSuiteName(state.CipherSuite))
+	}
+
+	if ctx.forwardedTLS() {
+		return fmt.Sprintf("[%s]", TLSTerminatedUpstream)
+	}
+
+	return ""
+}
@@ -0,0 +1,142 @@
+package vk
+
+import (
+	"net/http"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+const handlerLayerName = "handler"
+
+// chainLink is a single named layer of a handler chain. It keeps a reference to the
+// handler it wrapped so that the chain can be walked without executing any of it
+type chainLink struct {
+	name    string
+	next    HandlerFunc
+	handler HandlerFunc
+	value   interface{} // metadata attached to the layer, see chainValues
+}
+
+// serve runs the layer's handler, unless the Ctx is probing for the chain's metadata
+func (l *chainLink) serve(w http.ResponseWriter, r *http.Request, ctx *Ctx) error {
+	if ctx != nil && ctx.chainProbe != nil {
+		*ctx.chainProbe = l
+		return nil
+	}
+
+	if ctx != nil && ctx.devCapture != nil {
+		returned := false
+		defer ctx.devCapture.enter(l.name)(&returned)
+
+		err := l.handler(w, r, ctx)
+		returned = true
+
+		return err
+	}
+
+	return l.handler(w, r, ctx)
+}
+
+// linkServePC identifies HandlerFuncs that were created by a chainLink
+var linkServePC = reflect.ValueOf((&chainLink{}).serve).Pointer()
+
+// Named gives a Middleware a name which is reported by TraceChain and Router.Routes.
+// Middleware that are not named are reported using the name of their function.
+func Named(name string, mw Middleware) Middleware {
+	return func(inner HandlerFunc) HandlerFunc {
+		return link(name, inner, mw(inner))
+	}
+}
+
+// namedWithValue is Named for a Middleware whose layers carry value as their metadata, see chainValues
+func namedWithValue(name string, value interface{}, mw Middleware) Middleware {
+	return func(inner HandlerFunc) HandlerFunc {
+		l := &chainLink{name: name, next: inner, handler: mw(inner), value: value}
+
+		return l.serve
+	}
+}
+
+// TraceChain returns the ordered list of layer names that a request would pass through, starting
+// with the outermost middleware and ending with "handler", without executing any of them.
+func TraceChain(handler HandlerFunc) []string {
+	chain := []string{}
+
+	for {
+		l := linkOf(handler)
+		if l == nil {
+			break
+		}
+
+		chain = append(chain, l.name)
+		handler = l.next
+	}
+
+	if handler != nil {
+		chain = append(chain, handlerLayerName)
+	}
+
+	return chain
+}
+
+// chainValues returns the values attached to the layers of handler's chain, outermost first
+func chainValues(handler HandlerFunc) []interface{} {
+	var values []interface{}
+
+	for l := linkOf(handler); l != nil; l = linkOf(l.next) {
+		if l.value != nil {
+			values = append(values, l.value)
+		}
+	}
+
+	return values
+}
+
+// link wraps handler (which is the result of a middleware being applied to next) in a chainLink
+func link(name string, next, handler HandlerFunc) HandlerFunc {
+	l := &chainLink{
+		name:    name,
+		next:    next,
+		handler: handler,
+	}
+
+	return l.serve
+}
+
+// linkOf returns the chainLink that created handler, or nil if handler is not part of a traceable chain
+func linkOf(handler HandlerFunc) *chainLink {
+	if handler == nil || reflect.ValueOf(handler).Pointer() != linkServePC {
+		return nil
+	}
+
+	var l *chainLink
+	handler(nil, nil, &Ctx{chainProbe: &l})
+
+	return l
+}
+
+var closureSuffix = regexp.MustCompile(`(\.func\d+)+$`)
+
+// middlewareName derives a name for an unnamed Middleware from its function name,
+// i.e. "github.com/org/pkg.AuthMiddleware.func1" becomes "AuthMiddleware"
+func middlewareName(mw Middleware) string {
+	fn := runtime.FuncForPC(reflect.ValueOf(mw).Pointer())
+	if fn == nil {
+		return "middleware"
+	}
+
+	name := fn.Name()
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+
+	if i := strings.Index(name, "."); i >= 0 {
+		name = name[i+1:]
+	}
+
+	name = strings.TrimSuffix(name, "-fm")
+
+	return closureSuffix.ReplaceAllString(name, "")
+}
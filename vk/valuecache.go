@@ -0,0 +1,367 @@
+package vk
+
+import (
+	"container/list"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const defaultValueCacheMaxEntries = 1000
+
+// errFillPanicked is returned to the GetOrFill calls waiting for a fill that panicked
+var errFillPanicked = errors.New("the cache's fill function panicked")
+
+// ValueCacheOptions configures a Cache
+type ValueCacheOptions struct {
+	// TTL is how long values set with a TTL of 0 are kept, forever by default
+	TTL time.Duration
+
+	// MaxEntries is the number of values kept, 1000 by default. Once it is reached, the least recently used
+	// value is evicted to make room for a new one
+	MaxEntries int
+
+	// MaxBytes bounds the total size of the values kept (see Size), unlimited by default. Values larger than it
+	// aren't cached at all
+	MaxBytes int64
+
+	// Size approximates the size of a value in bytes. By default strings and byte slices count their length and
+	// other values count nothing, so set it when MaxBytes is used with other values
+	Size func(value interface{}) int64
+
+	// Now returns the current time, time.Now by default
+	Now func() time.Time
+}
+
+// ValueCacheStats counts the lookups and evictions of a Cache
+type ValueCacheStats struct {
+	Entries   int    `json:"entries"`
+	Bytes     int64  `json:"bytes"`
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Fills     uint64 `json:"fills"`     // calls to the fill functions of GetOrFill
+	Evictions uint64 `json:"evictions"` // values removed to stay within MaxEntries and MaxBytes
+	Expired   uint64 `json:"expired"`
+}
+
+// valueEntry is a cached value, and its element in the cache's recency list
+type valueEntry struct {
+	key     string
+	value   interface{}
+	size    int64
+	expires time.Time // zero if it never expires
+	elem    *list.Element
+}
+
+// valueCall is the fill of a key, which other GetOrFill calls for the key wait for
+type valueCall struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+
+	// guarded by the cache's lock, set when the key is deleted during the fill so that its result isn't stored
+	invalidated bool
+}
+
+// Cache is a concurrency-safe in-memory cache of values with a TTL, for small reference data (such as feature
+// configuration) that handlers would otherwise fetch for every request. It is bounded by a number of entries and
+// an approximate total size, evicting the least recently used values. A Server has one (see Server.Cache), which
+// handlers and middleware get with CacheFrom. It is unrelated to ResponseCache, which caches HTTP responses.
+//
+// A nil *Cache is safe to use and caches nothing
+type Cache struct {
+	opts ValueCacheOptions
+
+	lock    sync.Mutex
+	entries map[string]*valueEntry
+	recency *list.List // most recently used at the front
+	bytes   int64
+	calls   map[string]*valueCall
+
+	hits      uint64
+	misses    uint64
+	fills     uint64
+	evictions uint64
+	expired   uint64
+}
+
+// NewCache creates a Cache
+func NewCache(opts ValueCacheOptions) *Cache {
+	if opts.MaxEntries <= 0 {
+		opts.MaxEntries = defaultValueCacheMaxEntries
+	}
+
+	if opts.Size == nil {
+		opts.Size = defaultValueSize
+	}
+
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+
+	c := &Cache{
+		opts:    opts,
+		entries: map[string]*valueEntry{},
+		recency: list.New(),
+		calls:   map[string]*valueCall{},
+	}
+
+	return c
+}
+
+// CacheFrom returns the Cache of the server handling the request, or nil (which caches nothing) if the Ctx wasn't
+// created by a Server's router
+func CacheFrom(ctx *Ctx) *Cache {
+	if ctx == nil {
+		return nil
+	}
+
+	return ctx.cache
+}
+
+// Get returns the value cached for key, if it hasn't expired
+func (c *Cache) Get(key string) (interface{}, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.get(key)
+}
+
+// Set caches value for key, for ttl or the cache's TTL if it is 0
+func (c *Cache) Set(key string, value interface{}, ttl time.Duration) {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.set(key, value, ttl)
+}
+
+// GetOrFill returns the value cached for key, or calls fill to get it and caches it for ttl (or the cache's TTL if
+// it is 0). Concurrent calls for the same key wait for the first one's fill rather than all calling fill. Errors
+// are returned to every caller waiting for the fill, and aren't cached
+func (c *Cache) GetOrFill(key string, ttl time.Duration, fill func() (interface{}, error)) (interface{}, error) {
+	if c == nil {
+		return fill()
+	}
+
+	c.lock.Lock()
+
+	if value, ok := c.get(key); ok {
+		c.lock.Unlock()
+		return value, nil
+	}
+
+	if call, ok := c.calls[key]; ok {
+		c.lock.Unlock()
+		<-call.done
+
+		return call.value, call.err
+	}
+
+	call := &valueCall{done: make(chan struct{})}
+	c.calls[key] = call
+
+	c.lock.Unlock()
+
+	atomic.AddUint64(&c.fills, 1)
+
+	// waiters are released even if fill panics
+	defer func() {
+		c.lock.Lock()
+		delete(c.calls, key)
+
+		if call.err == nil && !call.invalidated {
+			c.set(key, call.value, ttl)
+		}
+
+		c.lock.Unlock()
+
+		close(call.done)
+	}()
+
+	call.err = errFillPanicked
+	call.value, call.err = fill()
+
+	return call.value, call.err
+}
+
+// Delete removes the value cached for key. A fill in progress for it isn't cached
+func (c *Cache) Delete(key string) {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		c.remove(e)
+	}
+
+	if call, ok := c.calls[key]; ok {
+		call.invalidated = true
+	}
+}
+
+// DeleteByPrefix removes the values cached for the keys starting with prefix, and returns how many there were.
+// Fills in progress for such keys aren't cached. An empty prefix removes every value
+func (c *Cache) DeleteByPrefix(prefix string) int {
+	if c == nil {
+		return 0
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	removed := 0
+
+	for key, e := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			c.remove(e)
+			removed++
+		}
+	}
+
+	for key, call := range c.calls {
+		if strings.HasPrefix(key, prefix) {
+			call.invalidated = true
+		}
+	}
+
+	return removed
+}
+
+// Stats returns the number and size of the cached values, and how lookups were served
+func (c *Cache) Stats() ValueCacheStats {
+	if c == nil {
+		return ValueCacheStats{}
+	}
+
+	c.lock.Lock()
+	entries, bytes := len(c.entries), c.bytes
+	c.lock.Unlock()
+
+	stats := ValueCacheStats{
+		Entries:   entries,
+		Bytes:     bytes,
+		Hits:      atomic.LoadUint64(&c.hits),
+		Misses:    atomic.LoadUint64(&c.misses),
+		Fills:     atomic.LoadUint64(&c.fills),
+		Evictions: atomic.LoadUint64(&c.evictions),
+		Expired:   atomic.LoadUint64(&c.expired),
+	}
+
+	return stats
+}
+
+// RegisterAdmin mounts GET /values on the admin router, reporting the cache's stats, and DELETE /values, which
+// removes the values whose keys start with the prefix query parameter (or every value without it)
+func (c *Cache) RegisterAdmin(r *Router) {
+	r.GET("/values", func(w http.ResponseWriter, _ *http.Request, ctx *Ctx) error {
+		return RespondJSON(ctx.Context, w, c.Stats(), http.StatusOK)
+	})
+
+	r.DELETE("/values", func(w http.ResponseWriter, r *http.Request, ctx *Ctx) error {
+		removed := c.DeleteByPrefix(r.URL.Query().Get("prefix"))
+
+		return RespondJSON(ctx.Context, w, map[string]int{"removed": removed}, http.StatusOK)
+	})
+}
+
+// get returns the value for key, removing it if it has expired. The lock must be held
+func (c *Cache) get(key string) (interface{}, bool) {
+	e, ok := c.entries[key]
+	if ok && !e.expires.IsZero() && !c.opts.Now().Before(e.expires) {
+		c.remove(e)
+		atomic.AddUint64(&c.expired, 1)
+
+		ok = false
+	}
+
+	if !ok {
+		atomic.AddUint64(&c.misses, 1)
+		return nil, false
+	}
+
+	c.recency.MoveToFront(e.elem)
+	atomic.AddUint64(&c.hits, 1)
+
+	return e.value, true
+}
+
+// set stores value for key, evicting the least recently used values until it fits. The lock must be held
+func (c *Cache) set(key string, value interface{}, ttl time.Duration) {
+	if old, ok := c.entries[key]; ok {
+		c.remove(old)
+	}
+
+	size := c.opts.Size(value)
+	if c.opts.MaxBytes > 0 && size > c.opts.MaxBytes {
+		return
+	}
+
+	if ttl <= 0 {
+		ttl = c.opts.TTL
+	}
+
+	e := &valueEntry{key: key, value: value, size: size}
+	if ttl > 0 {
+		e.expires = c.opts.Now().Add(ttl)
+	}
+
+	for len(c.entries) >= c.opts.MaxEntries || (c.opts.MaxBytes > 0 && c.bytes+size > c.opts.MaxBytes) {
+		c.evictOldest()
+	}
+
+	e.elem = c.recency.PushFront(e)
+	c.entries[key] = e
+	c.bytes += size
+}
+
+// evictOldest removes the least recently used value. The lock must be held
+func (c *Cache) evictOldest() {
+	if oldest := c.recency.Back(); oldest != nil {
+		c.remove(oldest.Value.(*valueEntry))
+		atomic.AddUint64(&c.evictions, 1)
+	}
+}
+
+// remove removes an entry. The lock must be held
+func (c *Cache) remove(e *valueEntry) {
+	c.recency.Remove(e.elem)
+	delete(c.entries, e.key)
+	c.bytes -= e.size
+}
+
+// defaultValueSize counts the length of strings and byte slices, and nothing for other values
+func defaultValueSize(value interface{}) int64 {
+	switch v := value.(type) {
+	case string:
+		return int64(len(v))
+	case []byte:
+		return int64(len(v))
+	}
+
+	return 0
+}
+
+// useCache sets the Cache returned by CacheFrom for the router's requests
+func (rt *Router) useCache(c *Cache) {
+	rt.cache = c
+}
+
+// Cache returns the server's Cache of values, which handlers get with CacheFrom, see UseCache
+func (s *Server) Cache() *Cache {
+	return s.cache
+}
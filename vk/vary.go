@@ -0,0 +1,139 @@
+package vk
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// AddVary adds field (or a comma-separated list of fields) to the response's Vary header. Fields are collected for
+// the whole request and the Vary header is written once, deduplicated and sorted, when the response starts, merged
+// with any Vary values set directly on the headers, so middleware and handlers can't overwrite each other's fields
+func (c *Ctx) AddVary(field string) {
+	if c == nil {
+		return
+	}
+
+	c.vary = appendVary(c.vary, field)
+
+	if c.RespHeaders != nil {
+		applyVary(c.RespHeaders, c.vary)
+	}
+}
+
+// appendVary adds the fields in value to fields, canonicalized and without duplicates
+func appendVary(fields []string, value string) []string {
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		if field != "*" {
+			field = http.CanonicalHeaderKey(field)
+		}
+
+		found := false
+		for _, f := range fields {
+			if f == field {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			fields = append(fields, field)
+		}
+	}
+
+	return fields
+}
+
+// applyVary replaces the Vary header of h with a single value holding its fields and those in fields, sorted, or
+// "*" if either contains it (as nothing else matters then)
+func applyVary(h http.Header, fields []string) {
+	merged := append([]string{}, fields...)
+	for _, value := range h.Values("Vary") {
+		merged = appendVary(merged, value)
+	}
+
+	if len(merged) == 0 {
+		return
+	}
+
+	for _, f := range merged {
+		if f == "*" {
+			h.Set("Vary", "*")
+			return
+		}
+	}
+
+	sort.Strings(merged)
+
+	h.Set("Vary", strings.Join(merged, ", "))
+}
+
+// varyWriter writes the fields added with Ctx.AddVary to the Vary header when the response starts
+type varyWriter struct {
+	http.ResponseWriter
+	ctx     *Ctx
+	started bool
+}
+
+func (vw *varyWriter) start() {
+	if vw.started {
+		return
+	}
+
+	vw.started = true
+
+	applyVary(vw.ResponseWriter.Header(), vw.ctx.vary)
+}
+
+func (vw *varyWriter) WriteHeader(status int) {
+	vw.start()
+	vw.ResponseWriter.WriteHeader(status)
+}
+
+func (vw *varyWriter) Write(b []byte) (int, error) {
+	vw.start()
+	return vw.ResponseWriter.Write(b)
+}
+
+// ReadFrom copies from src using the underlying ResponseWriter's ReadFrom if it has one, see readFrom
+func (vw *varyWriter) ReadFrom(src io.Reader) (int64, error) {
+	vw.start()
+	return readFrom(vw.ResponseWriter, src)
+}
+
+// Flush flushes the underlying ResponseWriter if it supports flushing
+func (vw *varyWriter) Flush() {
+	vw.start()
+
+	if f, ok := vw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack hijacks the underlying ResponseWriter's connection
+func (vw *varyWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := vw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("ResponseWriter does not implement http.Hijacker")
+	}
+
+	vw.start()
+
+	return h.Hijack()
+}
+
+// finish writes the Vary header for a handler that returned without writing anything, whose (empty) response is
+// started by the server once the handler has returned
+func (vw *varyWriter) finish() {
+	vw.start()
+}
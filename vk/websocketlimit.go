@@ -0,0 +1,192 @@
+package vk
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// WebSocketStats reports the websocket connections open through a WebSocketLimiter and the upgrades it rejected
+type WebSocketStats struct {
+	Open           int    `json:"open"`
+	Clients        int    `json:"clients"`         // clients with at least one open connection
+	MaxConnections int    `json:"max_connections"` // 0 if unlimited
+	MaxPerClient   int    `json:"max_per_client"`  // 0 if unlimited
+	RejectedGlobal uint64 `json:"rejected_global"` // upgrades rejected with 503 because the server was at MaxConnections
+	RejectedClient uint64 `json:"rejected_client"` // upgrades rejected with 429 because the client was at MaxPerClient
+}
+
+// WebSocketLimiter caps the number of websocket connections open at once, across the server and for each client.
+// Upgrades beyond the global cap are rejected with 503, and those beyond a client's cap with 429. A connection's
+// slot is held until the connection is closed or its reads fail (i.e. the client went away), rather than until its
+// handler returns, so connections handed off to other goroutines (such as a Hub) are still counted
+type WebSocketLimiter struct {
+	clientKey func(ctx *Ctx) string
+
+	lock           sync.Mutex
+	maxConnections int
+	maxPerClient   int
+	open           int
+	clients        map[string]int
+
+	rejectedGlobal uint64
+	rejectedClient uint64
+}
+
+// NewWebSocketLimiter creates a WebSocketLimiter. A limit of 0 is unlimited. Clients are identified by clientKey,
+// or by their IP address (see UseTrustProxy) if it is nil
+func NewWebSocketLimiter(maxConnections, maxPerClient int, clientKey func(ctx *Ctx) string) *WebSocketLimiter {
+	if clientKey == nil {
+		clientKey = func(ctx *Ctx) string {
+			return clientIP(ctx.request, ctx.trustProxy)
+		}
+	}
+
+	l := &WebSocketLimiter{
+		clientKey:      clientKey,
+		maxConnections: maxConnections,
+		maxPerClient:   maxPerClient,
+		clients:        map[string]int{},
+	}
+
+	return l
+}
+
+// SetLimits changes the limits, taking effect for the next upgrade. Connections that are already open are not
+// closed if they exceed the new limits
+func (l *WebSocketLimiter) SetLimits(maxConnections, maxPerClient int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.maxConnections = maxConnections
+	l.maxPerClient = maxPerClient
+}
+
+// Stats returns the number of open connections, the limits, and the number of rejected upgrades
+func (l *WebSocketLimiter) Stats() WebSocketStats {
+	if l == nil {
+		return WebSocketStats{}
+	}
+
+	l.lock.Lock()
+	stats := WebSocketStats{
+		Open:           l.open,
+		Clients:        len(l.clients),
+		MaxConnections: l.maxConnections,
+		MaxPerClient:   l.maxPerClient,
+	}
+	l.lock.Unlock()
+
+	stats.RejectedGlobal = atomic.LoadUint64(&l.rejectedGlobal)
+	stats.RejectedClient = atomic.LoadUint64(&l.rejectedClient)
+
+	return stats
+}
+
+// RegisterAdmin mounts GET /websockets on the admin router, reporting the limiter's stats
+func (l *WebSocketLimiter) RegisterAdmin(r *Router) {
+	r.GET("/websockets", func(w http.ResponseWriter, _ *http.Request, ctx *Ctx) error {
+		return RespondJSON(ctx.Context, w, l.Stats(), http.StatusOK)
+	})
+}
+
+// acquire takes a slot for the client making the request, returning a function that releases it (which is safe
+// to call more than once), or a vk.Error if either limit has been reached
+func (l *WebSocketLimiter) acquire(ctx *Ctx) (release func(), err error) {
+	key := l.clientKey(ctx)
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.maxConnections > 0 && l.open >= l.maxConnections {
+		atomic.AddUint64(&l.rejectedGlobal, 1)
+		return nil, E(http.StatusServiceUnavailable, "too many websocket connections")
+	}
+
+	if l.maxPerClient > 0 && l.clients[key] >= l.maxPerClient {
+		atomic.AddUint64(&l.rejectedClient, 1)
+		return nil, E(http.StatusTooManyRequests, "too many websocket connections from this client")
+	}
+
+	l.open++
+	l.clients[key]++
+
+	var once sync.Once
+
+	release = func() {
+		once.Do(func() {
+			l.lock.Lock()
+			defer l.lock.Unlock()
+
+			l.open--
+
+			if l.clients[key]--; l.clients[key] <= 0 {
+				delete(l.clients, key)
+			}
+		})
+	}
+
+	return release, nil
+}
+
+// useWebSocketLimiter sets the limiter applied to the router's websocket upgrades, or nil for no limits
+func (rt *Router) useWebSocketLimiter(limiter *WebSocketLimiter) {
+	rt.webSockets = limiter
+}
+
+// WebSockets returns the server's websocket limiter, whose limits can be changed while the server is running
+func (s *Server) WebSockets() *WebSocketLimiter {
+	return s.webSockets
+}
+
+// slotWriter hands the connection it hijacks a websocket slot, so that the slot is released when it closes
+type slotWriter struct {
+	http.ResponseWriter
+	release  func()
+	hijacked bool
+}
+
+// Hijack hijacks the underlying ResponseWriter's connection, wrapping it to release the slot
+func (sw *slotWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := sw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("ResponseWriter does not implement http.Hijacker")
+	}
+
+	conn, rw, err := h.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sw.hijacked = true
+
+	return &slotConn{Conn: conn, release: sw.release}, rw, nil
+}
+
+// slotConn releases its websocket slot when it is closed, or when a read fails because the client has gone away
+type slotConn struct {
+	net.Conn
+	release func()
+}
+
+func (c *slotConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if err != nil {
+		// a timeout leaves the connection usable, as far as the net package is concerned
+		if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+			c.release()
+		}
+	}
+
+	return n, err
+}
+
+func (c *slotConn) Close() error {
+	c.release()
+
+	return c.Conn.Close()
+}
@@ -0,0 +1,297 @@
+package vk
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultWSBufferSize = 1024
+	defaultWSWriteWait  = 10 * time.Second
+)
+
+// ErrConnNotFound is returned by ConnRegistry.Send when no open connection has the ID
+var ErrConnNotFound = errors.New("websocket connection not found")
+
+// WSOptions configures the websocket upgrades of WrapWebsocket, and the keepalive of the connections it registers
+type WSOptions struct {
+	ReadBufferSize  int                        // 1024 by default
+	WriteBufferSize int                        // 1024 by default
+	CheckOrigin     func(r *http.Request) bool // allows every origin by default
+
+	// PingInterval is how often connections are pinged, 0 to not ping them. A connection that hasn't answered with a
+	// pong for PongWait (twice PingInterval by default) fails its next read, and one whose ping fails is closed
+	PingInterval time.Duration
+	PongWait     time.Duration
+
+	WriteWait time.Duration // how long a ping, or a message from Send or Broadcast, can take to write, 10s by default
+}
+
+// merge returns the options with those set in override replacing them
+func (o WSOptions) merge(override WSOptions) WSOptions {
+	if override.ReadBufferSize != 0 {
+		o.ReadBufferSize = override.ReadBufferSize
+	}
+
+	if override.WriteBufferSize != 0 {
+		o.WriteBufferSize = override.WriteBufferSize
+	}
+
+	if override.CheckOrigin != nil {
+		o.CheckOrigin = override.CheckOrigin
+	}
+
+	if override.PingInterval != 0 {
+		o.PingInterval = override.PingInterval
+	}
+
+	if override.PongWait != 0 {
+		o.PongWait = override.PongWait
+	}
+
+	if override.WriteWait != 0 {
+		o.WriteWait = override.WriteWait
+	}
+
+	return o
+}
+
+// withDefaults returns the options with their defaults in place of the ones that aren't set
+func (o WSOptions) withDefaults() WSOptions {
+	if o.ReadBufferSize <= 0 {
+		o.ReadBufferSize = defaultWSBufferSize
+	}
+
+	if o.WriteBufferSize <= 0 {
+		o.WriteBufferSize = defaultWSBufferSize
+	}
+
+	if o.CheckOrigin == nil {
+		o.CheckOrigin = func(r *http.Request) bool {
+			return true
+		}
+	}
+
+	if o.PongWait <= 0 {
+		o.PongWait = 2 * o.PingInterval
+	}
+
+	if o.WriteWait <= 0 {
+		o.WriteWait = defaultWSWriteWait
+	}
+
+	return o
+}
+
+// WebSocketOptions is a Middleware that configures the websocket routes it is added to, such as with a longer
+// PingInterval for a group of routes. Options that aren't set keep the value of an outer WebSocketOptions, or the
+// server's (see UseWebSocketOptions)
+func WebSocketOptions(opts WSOptions) Middleware {
+	return Named("websocketoptions", func(inner HandlerFunc) HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request, ctx *Ctx) error {
+			merged := ctx.wsOptions.merge(opts)
+			ctx.wsOptions = merged
+
+			return inner(w, r, ctx)
+		}
+	})
+}
+
+// useWebSocketOptions sets the default options of the router's websocket routes
+func (rt *Router) useWebSocketOptions(opts WSOptions) {
+	rt.wsOptions = opts
+}
+
+// useSockets sets the registry of the router's websocket connections
+func (rt *Router) useSockets(sockets *ConnRegistry) {
+	rt.sockets = sockets
+}
+
+// Sockets returns the registry of the websocket connections open through the router
+func (rt *Router) Sockets() *ConnRegistry {
+	return rt.sockets
+}
+
+// Sockets returns the registry of the websocket connections open through the server
+func (s *Server) Sockets() *ConnRegistry {
+	return s.sockets
+}
+
+// Sockets returns the registry of the server's websocket connections, such as to Broadcast to them from a handler
+func (c *Ctx) Sockets() *ConnRegistry {
+	return c.sockets
+}
+
+// ConnRegistry tracks the websocket connections upgraded by WrapWebsocket, keyed by the RequestID of the request that
+// opened them, from the upgrade until their handler returns or they fail a ping. A websocket connection supports a
+// single writer at a time, so once a connection is registered, its handler must write to it with Send rather than
+// directly for its writes not to race with Broadcast. It is safe for concurrent use
+type ConnRegistry struct {
+	lock  sync.RWMutex
+	conns map[string]*registeredConn
+}
+
+// NewConnRegistry creates an empty ConnRegistry
+func NewConnRegistry() *ConnRegistry {
+	r := &ConnRegistry{
+		conns: map[string]*registeredConn{},
+	}
+
+	return r
+}
+
+// Len returns the number of registered connections
+func (r *ConnRegistry) Len() int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return len(r.conns)
+}
+
+// Send writes a message to the connection with the ID, returning ErrConnNotFound if it isn't registered. A connection
+// whose write fails is closed
+func (r *ConnRegistry) Send(id string, msgType int, data []byte) error {
+	r.lock.RLock()
+	c, ok := r.conns[id]
+	r.lock.RUnlock()
+
+	if !ok {
+		return ErrConnNotFound
+	}
+
+	msg, err := websocket.NewPreparedMessage(msgType, data)
+	if err != nil {
+		return errors.Wrap(err, "failed to NewPreparedMessage")
+	}
+
+	return c.write(msg)
+}
+
+// Broadcast writes a message to every registered connection, returning an error if any of the writes failed.
+// Connections whose write fails are closed
+func (r *ConnRegistry) Broadcast(msgType int, data []byte) error {
+	msg, err := websocket.NewPreparedMessage(msgType, data)
+	if err != nil {
+		return errors.Wrap(err, "failed to NewPreparedMessage")
+	}
+
+	r.lock.RLock()
+	conns := make([]*registeredConn, 0, len(r.conns))
+	for _, c := range r.conns {
+		conns = append(conns, c)
+	}
+	r.lock.RUnlock()
+
+	failed := 0
+
+	for _, c := range conns {
+		if err := c.write(msg); err != nil {
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("failed to broadcast to %d of %d websocket connections", failed, len(conns))
+	}
+
+	return nil
+}
+
+// register adds the connection to the registry and starts pinging it if opts has a PingInterval. cancel is called
+// when the connection is closed for failing a ping or a write, to stop its handler
+func (r *ConnRegistry) register(id string, conn *websocket.Conn, opts WSOptions, cancel context.CancelFunc) *registeredConn {
+	c := &registeredConn{
+		registry: r,
+		id:       id,
+		conn:     conn,
+		opts:     opts,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+
+	r.lock.Lock()
+	r.conns[id] = c
+	r.lock.Unlock()
+
+	if opts.PingInterval > 0 {
+		conn.SetReadDeadline(time.Now().Add(opts.PongWait))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(opts.PongWait))
+		})
+
+		go c.keepAlive()
+	}
+
+	return c
+}
+
+// unregister removes the connection from the registry and stops pinging it
+func (r *ConnRegistry) unregister(c *registeredConn) {
+	r.lock.Lock()
+	if r.conns[c.id] == c {
+		delete(r.conns, c.id)
+	}
+	r.lock.Unlock()
+
+	c.stopOnce.Do(func() { close(c.done) })
+}
+
+// registeredConn is a connection in a ConnRegistry, whose writes are serialized by writeLock
+type registeredConn struct {
+	registry *ConnRegistry
+	id       string
+	conn     *websocket.Conn
+	opts     WSOptions
+	cancel   context.CancelFunc
+
+	writeLock sync.Mutex
+	done      chan struct{} // closed when the connection is unregistered
+	stopOnce  sync.Once
+}
+
+// write writes the message, closing the connection if it fails
+func (c *registeredConn) write(msg *websocket.PreparedMessage) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	c.conn.SetWriteDeadline(time.Now().Add(c.opts.WriteWait))
+
+	if err := c.conn.WritePreparedMessage(msg); err != nil {
+		c.close()
+		return err
+	}
+
+	return nil
+}
+
+// keepAlive pings the connection every PingInterval until it is unregistered, closing it if a ping fails
+func (c *registeredConn) keepAlive() {
+	ticker := time.NewTicker(c.opts.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			// WriteControl can be called concurrently with the other writes
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(c.opts.WriteWait)); err != nil {
+				c.close()
+				return
+			}
+		}
+	}
+}
+
+// close unregisters and closes the connection, and cancels its handler's context
+func (c *registeredConn) close() {
+	c.registry.unregister(c)
+	c.cancel()
+	c.conn.Close()
+}
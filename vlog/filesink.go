@@ -0,0 +1,361 @@
+package vlog
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultSinkMaxFiles    = 5
+	defaultSinkBufferLines = 1024
+)
+
+// FileSinkOptions configures a FileSink
+type FileSinkOptions struct {
+	// Path is the file that lines are written to. It can contain the placeholders %Y, %m, %d and %H (the year, month,
+	// day and hour, in UTC), i.e. /var/log/app/access-%Y-%m-%d.log, in which case a new file is started whenever the
+	// path they expand to changes
+	Path string
+
+	MaxBytes    int64 // the size a file is rotated at, never if 0
+	MaxFiles    int   // the rotated files kept of each path, 5 by default
+	Compress    bool  // gzip rotated files
+	BufferLines int   // the lines waiting to be written before more are dropped, 1024 by default
+
+	// ReopenOnSignal reopens the file when the process receives SIGUSR2, for external tools (such as logrotate)
+	// that move the file away. Not supported on Windows
+	ReopenOnSignal bool
+}
+
+// FileSinkStats counts what a FileSink has done with the lines written to it
+type FileSinkStats struct {
+	Written   uint64 `json:"written"`
+	Dropped   uint64 `json:"dropped"` // lines dropped because the buffer was full
+	Failed    uint64 `json:"failed"`  // lines lost to errors writing the file
+	Rotations uint64 `json:"rotations"`
+}
+
+// FileSink writes lines to files, rotating them by size and by the date in their path. Writes never block: each is
+// queued for a background goroutine to write, and is dropped (and counted) if the queue is full, so that a slow or
+// full disk doesn't stall the requests being logged. Use it as a Logger's output with WithWriter
+type FileSink struct {
+	opts FileSinkOptions
+
+	lines  chan []byte
+	reopen chan struct{}
+	done   chan struct{}
+	wg     sync.WaitGroup
+
+	// held for reading while a line is queued, and for writing while the sink is closed, so that every line queued
+	// before Close is written by it
+	closeLock sync.RWMutex
+	closed    bool
+
+	signals chan os.Signal
+
+	// owned by the writing goroutine
+	file *os.File
+	path string
+	size int64
+
+	written   uint64
+	dropped   uint64
+	failed    uint64
+	rotations uint64
+}
+
+// NewFileSink creates a FileSink and opens its first file
+func NewFileSink(opts FileSinkOptions) (*FileSink, error) {
+	if opts.Path == "" {
+		return nil, fmt.Errorf("file sink has no path")
+	}
+
+	if opts.MaxFiles <= 0 {
+		opts.MaxFiles = defaultSinkMaxFiles
+	}
+
+	if opts.BufferLines <= 0 {
+		opts.BufferLines = defaultSinkBufferLines
+	}
+
+	s := &FileSink{
+		opts:   opts,
+		lines:  make(chan []byte, opts.BufferLines),
+		reopen: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+
+	if err := s.open(expandSinkPath(opts.Path, time.Now())); err != nil {
+		return nil, err
+	}
+
+	if opts.ReopenOnSignal && len(reopenSignals) > 0 {
+		s.signals = make(chan os.Signal, 1)
+		signal.Notify(s.signals, reopenSignals...)
+	}
+
+	s.wg.Add(1)
+	go s.run()
+
+	return s, nil
+}
+
+// Write queues p to be written as a single line (it should end with a newline). It never blocks, and only fails
+// once the sink is closed; a line that can't be queued is dropped and counted in Stats
+func (s *FileSink) Write(p []byte) (int, error) {
+	s.closeLock.RLock()
+	defer s.closeLock.RUnlock()
+
+	if s.closed {
+		return 0, os.ErrClosed
+	}
+
+	line := append([]byte{}, p...)
+
+	select {
+	case s.lines <- line:
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+	}
+
+	return len(p), nil
+}
+
+// Reopen closes the file and opens it again at its path, such as after it has been moved away
+func (s *FileSink) Reopen() {
+	select {
+	case s.reopen <- struct{}{}:
+	default:
+	}
+}
+
+// Stats returns the sink's counters
+func (s *FileSink) Stats() FileSinkStats {
+	return FileSinkStats{
+		Written:   atomic.LoadUint64(&s.written),
+		Dropped:   atomic.LoadUint64(&s.dropped),
+		Failed:    atomic.LoadUint64(&s.failed),
+		Rotations: atomic.LoadUint64(&s.rotations),
+	}
+}
+
+// Close writes the lines that are queued, and closes the file. Writes made after Close fail
+func (s *FileSink) Close() error {
+	s.closeLock.Lock()
+	wasClosed := s.closed
+	s.closed = true
+	s.closeLock.Unlock()
+
+	if wasClosed {
+		return nil
+	}
+
+	if s.signals != nil {
+		signal.Stop(s.signals)
+	}
+
+	close(s.done)
+	s.wg.Wait()
+
+	if s.file == nil {
+		return nil
+	}
+
+	return s.file.Close()
+}
+
+// run writes the queued lines until the sink is closed
+func (s *FileSink) run() {
+	defer s.wg.Done()
+
+	for {
+		select {
+		case line := <-s.lines:
+			s.write(line)
+		case <-s.reopen:
+			s.reopenFile()
+		case <-s.signals:
+			s.reopenFile()
+		case <-s.done:
+			for {
+				select {
+				case line := <-s.lines:
+					s.write(line)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// write writes a line, first starting a new file if the path has changed or the line would make the file too large.
+// Each line is written whole by the one goroutine, so lines never interleave
+func (s *FileSink) write(line []byte) {
+	if path := expandSinkPath(s.opts.Path, time.Now()); path != s.path || s.file == nil {
+		// a file that failed to open is retried with each line
+		if s.file != nil {
+			s.file.Close()
+		}
+
+		if err := s.open(path); err != nil {
+			s.fail(err)
+			return
+		}
+	} else if s.opts.MaxBytes > 0 && s.size > 0 && s.size+int64(len(line)) > s.opts.MaxBytes {
+		if err := s.rotate(); err != nil {
+			s.fail(err)
+			return
+		}
+	}
+
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+
+	if err != nil {
+		s.fail(err)
+		return
+	}
+
+	atomic.AddUint64(&s.written, 1)
+}
+
+// fail counts a line lost to err. The error is reported on stderr, as there is nowhere else to log it
+func (s *FileSink) fail(err error) {
+	if atomic.AddUint64(&s.failed, 1) == 1 {
+		os.Stderr.Write([]byte("[vlog] file sink failed to write: " + err.Error() + "\n"))
+	}
+}
+
+// open opens the file at path for appending
+func (s *FileSink) open(path string) error {
+	s.file, s.path, s.size = nil, path, 0
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	s.file, s.size = file, info.Size()
+
+	return nil
+}
+
+func (s *FileSink) reopenFile() {
+	if s.file != nil {
+		s.file.Close()
+	}
+
+	if err := s.open(s.path); err != nil {
+		s.fail(err)
+	}
+}
+
+// rotate moves the file to path.1 (or path.1.gz), shifting the older files up and removing the oldest
+func (s *FileSink) rotate() error {
+	s.file.Close()
+	s.file = nil
+
+	ext := ""
+	if s.opts.Compress {
+		ext = ".gz"
+	}
+
+	rotated := func(i int) string {
+		return fmt.Sprintf("%s.%d%s", s.path, i, ext)
+	}
+
+	_ = os.Remove(rotated(s.opts.MaxFiles))
+
+	for i := s.opts.MaxFiles - 1; i >= 1; i-- {
+		_ = os.Rename(rotated(i), rotated(i+1))
+	}
+
+	var err error
+	if s.opts.Compress {
+		err = gzipFile(s.path, rotated(1))
+	} else {
+		err = os.Rename(s.path, rotated(1))
+	}
+
+	if err != nil {
+		return err
+	}
+
+	atomic.AddUint64(&s.rotations, 1)
+
+	return s.open(s.path)
+}
+
+// gzipFile compresses src into dst, and removes src
+func gzipFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+
+	defer in.Close()
+
+	tmp := dst + ".tmp"
+
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(out)
+
+	if _, err := io.Copy(gz, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	if err := gz.Close(); err != nil {
+		out.Close()
+		return err
+	}
+
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, dst); err != nil {
+		return err
+	}
+
+	return os.Remove(src)
+}
+
+// expandSinkPath replaces the date placeholders of path with the UTC date and hour of t
+func expandSinkPath(path string, t time.Time) string {
+	if !strings.Contains(path, "%") {
+		return path
+	}
+
+	t = t.UTC()
+
+	return strings.NewReplacer(
+		"%Y", fmt.Sprintf("%04d", t.Year()),
+		"%m", fmt.Sprintf("%02d", t.Month()),
+		"%d", fmt.Sprintf("%02d", t.Day()),
+		"%H", fmt.Sprintf("%02d", t.Hour()),
+	).Replace(path)
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package vlog
+
+import "os"
+
+// reopenSignals is empty where there is no SIGUSR2, see FileSinkOptions.ReopenOnSignal
+var reopenSignals = []os.Signal{}
@@ -0,0 +1,194 @@
+package vlog
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// sinkLines returns the lines of a sink's file, decompressing it if it is gzipped, failing the test if any isn't JSON
+func sinkLines(t *testing.T, path string) []string {
+	t.Helper()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer file.Close()
+
+	var r io.Reader = file
+
+	if filepath.Ext(path) == ".gz" {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			t.Fatalf("%s is not gzipped: %s", path, err)
+		}
+
+		r = gz
+	}
+
+	var lines []string
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if !json.Valid(scanner.Bytes()) {
+			t.Errorf("corrupted line in %s: %s", path, scanner.Text())
+		}
+
+		lines = append(lines, scanner.Text())
+	}
+
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	return lines
+}
+
+func TestFileSinkRotation(t *testing.T) {
+	dir := t.TempDir()
+
+	sink, err := NewFileSink(FileSinkOptions{
+		Path:        filepath.Join(dir, "access-%Y-%m-%d.log"),
+		MaxBytes:    4096,
+		MaxFiles:    3,
+		Compress:    true,
+		BufferLines: 10000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := Default(WithWriter(sink), Level(LogLevelInfo))
+
+	var wg sync.WaitGroup
+
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+
+		go func(worker int) {
+			defer wg.Done()
+
+			for i := 0; i < 100; i++ {
+				logger.CreateScoped(map[string]int{"worker": worker, "line": i}).Info("handled request")
+			}
+		}(worker)
+	}
+
+	wg.Wait()
+
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "access-"+time.Now().UTC().Format("2006-01-02")+".log")
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(files)
+
+	expected := []string{path, path + ".1.gz", path + ".2.gz", path + ".3.gz"}
+	if fmt.Sprint(files) != fmt.Sprint(expected) {
+		t.Fatalf("got files %v, want %v", files, expected)
+	}
+
+	stats := sink.Stats()
+	if stats.Written != 800 || stats.Dropped != 0 || stats.Failed != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	if stats.Rotations < 4 {
+		t.Errorf("expected more than MaxFiles rotations, got %d", stats.Rotations)
+	}
+
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		lines := sinkLines(t, file)
+
+		if file != path && (len(lines) == 0 || info.Size() >= 4096) {
+			t.Errorf("%s has %d lines in %d compressed bytes", file, len(lines), info.Size())
+		}
+	}
+
+	if _, err := sink.Write([]byte("{}\n")); err == nil {
+		t.Error("writes after Close should fail")
+	}
+}
+
+func TestFileSinkDrops(t *testing.T) {
+	sink, err := NewFileSink(FileSinkOptions{Path: filepath.Join(t.TempDir(), "access.log"), BufferLines: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 1000; i++ {
+		if _, err := sink.Write([]byte(fmt.Sprintf("{\"line\":%d}\n", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sink.Close()
+
+	// every line is either written or dropped, none block the writer
+	stats := sink.Stats()
+	if stats.Written+stats.Dropped != 1000 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestFileSinkCloseWhileWriting(t *testing.T) {
+	for round := 0; round < 20; round++ {
+		sink, err := NewFileSink(FileSinkOptions{Path: filepath.Join(t.TempDir(), "access.log"), BufferLines: 64})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var accepted uint64
+
+		var wg sync.WaitGroup
+
+		for worker := 0; worker < 8; worker++ {
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+
+				for {
+					if _, err := sink.Write([]byte("{}\n")); err != nil {
+						return
+					}
+
+					atomic.AddUint64(&accepted, 1)
+				}
+			}()
+		}
+
+		time.Sleep(time.Millisecond)
+
+		sink.Close()
+		wg.Wait()
+
+		// a line accepted while Close was running is still written, or counted as dropped
+		stats := sink.Stats()
+		if stats.Written+stats.Dropped != atomic.LoadUint64(&accepted) {
+			t.Fatalf("accepted %d lines, but %+v", accepted, stats)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+//go:build unix
+
+package vlog
+
+import (
+	"os"
+	"syscall"
+)
+
+// reopenSignals are the signals that make a FileSink reopen its file, see FileSinkOptions.ReopenOnSignal
+var reopenSignals = []os.Signal{syscall.SIGUSR2}
@@ -0,0 +1,63 @@
+//go:build unix
+
+package vlog
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestFileSinkReopenOnSignal(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+
+	sink, err := NewFileSink(FileSinkOptions{Path: path, ReopenOnSignal: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer sink.Close()
+
+	sink.Write([]byte("{\"before\":true}\n"))
+
+	// wait for the line to be written, then move the file away like logrotate does
+	for sink.Stats().Written < 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := os.Rename(path, path+".old"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGUSR2); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("the file was not reopened")
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	sink.Write([]byte("{\"after\":true}\n"))
+	sink.Close()
+
+	if lines := sinkLines(t, path); len(lines) != 1 || lines[0] != `{"after":true}` {
+		t.Errorf("reopened file has lines %v", lines)
+	}
+
+	if lines := sinkLines(t, path+".old"); len(lines) != 1 || lines[0] != `{"before":true}` {
+		t.Errorf("moved file has lines %v", lines)
+	}
+}
@@ -42,6 +42,8 @@ type Options struct {
 	PreLogHook   LogHookFunc
 }
 
+// LogHookFunc is called with each structured log line, without its newline. The line is written to the output once
+// the hook returns and its buffer is then reused, so a hook must not modify it, and must copy it to keep it
 type LogHookFunc func([]byte)
 
 // OptionsModifier is a options modifier function
@@ -106,7 +108,8 @@ func AppMeta(meta interface{}) OptionsModifier {
 	}
 }
 
-// PreLogHook sets a function to be run before each logged value
+// PreLogHook sets a function to be run before each logged value. The bytes it is given are reused once it returns,
+// so a hook must not modify them, and must copy them to keep them, see LogHookFunc
 func PreLogHook(hook LogHookFunc) OptionsModifier {
 	return func(opt *Options) {
 		opt.PreLogHook = hook
@@ -1,6 +1,7 @@
 package vlog
 
 import (
+	"bytes"
 	"encoding/json"
 	"io"
 	"os"
@@ -19,7 +20,7 @@ type Producer interface {
 }
 
 // Logger is the main logger object, responsible for taking input from the
-// producer and managing scoped loggers
+// producer and managing scoped loggers. A nil *Logger is safe to use and logs nothing.
 type Logger struct {
 	producer Producer
 	scope    interface{}
@@ -41,6 +42,19 @@ func Default(opts ...OptionsModifier) *Logger {
 	return New(prod, opts...)
 }
 
+// Noop returns a Logger that discards everything logged to it, regardless of environment configuration
+func Noop() *Logger {
+	v := &Logger{
+		producer: &defaultProducer{},
+		scope:    nil,
+		opts:     &Options{Level: levelStringMap[LogLevelNull]},
+		output:   io.Discard,
+		lock:     &sync.Mutex{},
+	}
+
+	return v
+}
+
 // New returns a Logger with the provided producer and options
 func New(producer Producer, opts ...OptionsModifier) *Logger {
 	options := newOptions(opts...)
@@ -63,8 +77,13 @@ func New(producer Producer, opts ...OptionsModifier) *Logger {
 	return v
 }
 
-// CreateScoped creates a duplicate logger which has a particular scope
+// CreateScoped creates a duplicate logger which has a particular scope.
+// Calling CreateScoped on a nil Logger returns a scoped Noop logger.
 func (v *Logger) CreateScoped(scope interface{}) *Logger {
+	if v == nil {
+		v = Noop()
+	}
+
 	sl := &Logger{
 		producer: v.producer,
 		scope:    scope,
@@ -78,6 +97,10 @@ func (v *Logger) CreateScoped(scope interface{}) *Logger {
 
 // ErrorString logs a string as an error
 func (v *Logger) ErrorString(msgs ...interface{}) {
+	if v == nil {
+		return
+	}
+
 	msg := v.producer.ErrorString(msgs...)
 
 	v.log(msg, v.scope, 1)
@@ -85,6 +108,10 @@ func (v *Logger) ErrorString(msgs ...interface{}) {
 
 // Error logs an error as an error
 func (v *Logger) Error(err error) {
+	if v == nil {
+		return
+	}
+
 	msg := v.producer.Error(err)
 
 	v.log(msg, v.scope, 1)
@@ -92,6 +119,10 @@ func (v *Logger) Error(err error) {
 
 // Warn logs a string as an warning
 func (v *Logger) Warn(msgs ...interface{}) {
+	if v == nil {
+		return
+	}
+
 	msg := v.producer.Warn(msgs...)
 
 	v.log(msg, v.scope, 2)
@@ -99,6 +130,10 @@ func (v *Logger) Warn(msgs ...interface{}) {
 
 // Info logs a string as an info message
 func (v *Logger) Info(msgs ...interface{}) {
+	if v == nil {
+		return
+	}
+
 	msg := v.producer.Info(msgs...)
 
 	v.log(msg, v.scope, 3)
@@ -106,6 +141,10 @@ func (v *Logger) Info(msgs ...interface{}) {
 
 // Debug logs a string as debug output
 func (v *Logger) Debug(msgs ...interface{}) {
+	if v == nil {
+		return
+	}
+
 	msg := v.producer.Debug(msgs...)
 
 	v.log(msg, v.scope, 4)
@@ -113,6 +152,10 @@ func (v *Logger) Debug(msgs ...interface{}) {
 
 // Trace logs a function name and returns a function to be deferred, logging the completion of a function
 func (v *Logger) Trace(fnName string) func() {
+	if v == nil {
+		return func() {}
+	}
+
 	msg, traceFunc := v.producer.Trace(fnName)
 
 	v.log(msg, v.scope, 5)
@@ -151,23 +194,53 @@ func (v *Logger) log(message string, scope interface{}, level int) {
 		ScopeMeta:  scope,
 	}
 
-	structuredJSON, err := json.Marshal(structured)
-	if err != nil {
-		os.Stderr.Write([]byte("[vlog] failed to marshal structured log"))
+	buf := bufferPool.Get().(*lineBuffer)
+	defer putBuffer(buf)
+
+	// the encoder ends the line with a newline, which the hook isn't given
+	if err := buf.enc.Encode(structured); err != nil {
+		os.Stderr.Write([]byte("[vlog] failed to marshal structured log: " + err.Error() + "\n"))
+		buf.WriteByte('\n')
 	}
 
 	if v.opts.PreLogHook != nil {
-		v.opts.PreLogHook(structuredJSON)
+		v.opts.PreLogHook(buf.Bytes()[:buf.Len()-1])
 	}
 
-	structuredOut := append(structuredJSON, []byte("\n")...)
-
-	_, err = v.output.Write(structuredOut)
+	_, err := v.output.Write(buf.Bytes())
 	if err != nil {
 		os.Stderr.Write([]byte("[vlog] failed to write to configured output: " + err.Error() + "\n"))
 	}
 }
 
+// maxPooledBufferBytes is the capacity of the largest buffer returned to the pool, so that one huge line doesn't pin
+// its memory
+const maxPooledBufferBytes = 64 << 10
+
+// lineBuffer is a pooled buffer that log lines are encoded into, along with the encoder that writes to it
+type lineBuffer struct {
+	bytes.Buffer
+	enc *json.Encoder
+}
+
+var bufferPool = sync.Pool{New: func() interface{} {
+	buf := &lineBuffer{}
+	buf.enc = json.NewEncoder(&buf.Buffer)
+
+	return buf
+}}
+
+// putBuffer returns buf to the pool, unless it has grown too large. An encoder only keeps the errors of its writer,
+// and a bytes.Buffer never fails, so it can be reused after a value fails to encode
+func putBuffer(buf *lineBuffer) {
+	if buf.Cap() > maxPooledBufferBytes {
+		return
+	}
+
+	buf.Reset()
+	bufferPool.Put(buf)
+}
+
 func outputForOptions(opts *Options) (io.Writer, error) {
 	var output io.Writer
 
@@ -0,0 +1,50 @@
+package vlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestPreLogHook(t *testing.T) {
+	output := &bytes.Buffer{}
+
+	var hooked []string
+
+	logger := Default(WithWriter(output), Level(LogLevelInfo), PreLogHook(func(line []byte) {
+		// the line's buffer is reused once the hook returns
+		hooked = append(hooked, string(line))
+	}))
+
+	logger.Info("first")
+
+	// a scope that can't be encoded fails its line, without affecting the encoder used for the next ones
+	logger.CreateScoped(make(chan int)).Info("unencodable")
+
+	logger.Info("second")
+
+	lines := strings.Split(strings.TrimSuffix(output.String(), "\n"), "\n")
+	if len(lines) != 3 || len(hooked) != 3 {
+		t.Fatalf("expected 3 lines written and hooked, got %q and %q", lines, hooked)
+	}
+
+	for i, message := range []string{"(I) first", "", "(I) second"} {
+		if hooked[i] != lines[i] {
+			t.Errorf("hook was given %q, but %q was written", hooked[i], lines[i])
+		}
+
+		if message == "" {
+			continue
+		}
+
+		var structured structuredLog
+		if err := json.Unmarshal([]byte(lines[i]), &structured); err != nil {
+			t.Fatal(err)
+		}
+
+		if structured.LogMessage != message {
+			t.Errorf("expected %q, got %q", message, structured.LogMessage)
+		}
+	}
+}
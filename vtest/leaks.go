@@ -0,0 +1,326 @@
+package vtest
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/suborbital/vektor/vk"
+)
+
+const (
+	defaultLeakSettle = 2 * time.Second
+	leakRetryInterval = 10 * time.Millisecond
+)
+
+// defaultLeakAllowlist are the goroutines of the runtime, the testing package and the standard library's
+// connection handling, which outlive requests without leaking
+var defaultLeakAllowlist = []string{
+	"runtime.",
+	"testing.",
+	"os/signal.",
+	"net/http.(*persistConn).",
+	"net/http.(*conn).serve",
+	"net/http.(*Server).Serve",
+}
+
+// LeakOption configures LeakCheck
+type LeakOption func(*leakCheck)
+
+// AllowGoroutines adds the functions whose goroutines aren't leaks, such as those of a database driver's connection
+// pool, by their full names (i.e. github.com/lib/pq.(*conn).watchCancel), which also allows the anonymous functions
+// within them. A name ending with a dot, such as database/sql., allows every function of a package or type
+func AllowGoroutines(prefixes ...string) LeakOption {
+	return func(l *leakCheck) {
+		l.allow = append(l.allow, prefixes...)
+	}
+}
+
+// SettleFor sets how long LeakCheck waits for the goroutines started by the test's requests to exit, 2s by default
+func SettleFor(settle time.Duration) LeakOption {
+	return func(l *leakCheck) {
+		l.settle = settle
+	}
+}
+
+// MaxHeapGrowth fails the check if the live heap has grown by more than maxBytes once the requests have settled
+func MaxHeapGrowth(maxBytes uint64) LeakOption {
+	return func(l *leakCheck) {
+		l.maxHeapGrowth = maxBytes
+	}
+}
+
+// LeakModule sets the module whose frames are shown in the stacks of leaked goroutines, the main module of the test
+// binary (the one being tested) by default
+func LeakModule(path string) LeakOption {
+	return func(l *leakCheck) {
+		l.module = path
+	}
+}
+
+type leakCheck struct {
+	server        *vk.Server
+	allow         []string
+	settle        time.Duration
+	maxHeapGrowth uint64
+	module        string
+
+	goroutines map[string]bool // the IDs of the goroutines running when the check started
+	cleanups   vk.CleanupStats
+	heap       uint64
+}
+
+// leakedGoroutine is a goroutine started since the check started, with its stack
+type leakedGoroutine struct {
+	id     string
+	header string
+	funcs  []string // the functions of its stack, innermost first
+	stack  string
+}
+
+// LeakCheck fails the test if the requests it handles leak: if goroutines they started are still running, or if
+// callbacks they registered with Ctx.OnCleanup haven't run, once the test has finished and they have had time to
+// settle. Call it once the server has started (after New) and before the requests:
+//
+//	vt := vtest.New(server)
+//	vtest.LeakCheck(t, server)
+//
+// Each leaked goroutine is named along with the frames of its stack in the module being tested. The goroutines of
+// the runtime, the testing package, HTTP connections and vk's own background features (see vk.BackgroundGoroutines)
+// aren't leaks, and others can be allowed with AllowGoroutines. Tests that use LeakCheck shouldn't run in parallel
+// with other tests, whose goroutines would be counted
+func LeakCheck(t testing.TB, server *vk.Server, opts ...LeakOption) {
+	t.Helper()
+
+	l := &leakCheck{
+		server: server,
+		allow:  append(append([]string{}, defaultLeakAllowlist...), vk.BackgroundGoroutines()...),
+		settle: defaultLeakSettle,
+	}
+
+	if info, ok := debug.ReadBuildInfo(); ok {
+		l.module = info.Main.Path
+	}
+
+	for _, opt := range opts {
+		opt(l)
+	}
+
+	l.goroutines = map[string]bool{}
+	for _, g := range goroutines() {
+		l.goroutines[g.id] = true
+	}
+
+	l.cleanups = server.Cleanups()
+
+	if l.maxHeapGrowth > 0 {
+		l.heap = liveHeap()
+	}
+
+	t.Cleanup(func() {
+		l.check(t)
+	})
+}
+
+// check waits for the requests to settle, and fails the test with the leaks that remain
+func (l *leakCheck) check(t testing.TB) {
+	t.Helper()
+
+	deadline := time.Now().Add(l.settle)
+
+	var leaked []leakedGoroutine
+	var cleanups uint64
+
+	for {
+		leaked, cleanups = l.leaks(), l.pendingCleanups()
+		if (len(leaked) == 0 && cleanups == 0) || time.Now().After(deadline) {
+			break
+		}
+
+		time.Sleep(leakRetryInterval)
+	}
+
+	for _, g := range leaked {
+		t.Errorf("leaked goroutine %s", l.describe(g))
+	}
+
+	if cleanups > 0 {
+		t.Errorf("%d cleanups registered with OnCleanup haven't run", cleanups)
+	}
+
+	if l.maxHeapGrowth > 0 {
+		if heap := liveHeap(); heap > l.heap && heap-l.heap > l.maxHeapGrowth {
+			t.Errorf("the live heap grew by %d bytes, over the maximum of %d", heap-l.heap, l.maxHeapGrowth)
+		}
+	}
+}
+
+// leaks returns the goroutines started since the check started that aren't allowed
+func (l *leakCheck) leaks() []leakedGoroutine {
+	var leaked []leakedGoroutine
+
+	for _, g := range goroutines() {
+		if l.goroutines[g.id] || l.allowed(g) {
+			continue
+		}
+
+		leaked = append(leaked, g)
+	}
+
+	return leaked
+}
+
+// allowed returns true if the function that g started with is allowed: if it is one of the allowlist, an anonymous
+// function within one of them, or within a package or type of the allowlist ending with a dot, such as runtime.
+func (l *leakCheck) allowed(g leakedGoroutine) bool {
+	if len(g.funcs) == 0 {
+		return true
+	}
+
+	for _, entry := range g.entries() {
+		for _, allowed := range l.allow {
+			if entry == allowed || strings.HasPrefix(entry, allowed+".") {
+				return true
+			}
+
+			if strings.HasSuffix(allowed, ".") && strings.HasPrefix(entry, allowed) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// entries returns the function the goroutine started with and, if it is the wrapper the compiler generates for a go
+// statement with arguments (i.e. go h.write(c, nil)), the function that it calls
+func (g leakedGoroutine) entries() []string {
+	entry := g.funcs[len(g.funcs)-1]
+
+	if strings.Contains(entry, ".gowrap") && len(g.funcs) > 1 {
+		return []string{entry, g.funcs[len(g.funcs)-2]}
+	}
+
+	return []string{entry}
+}
+
+// pendingCleanups returns the number of cleanups registered since the check started that haven't run
+func (l *leakCheck) pendingCleanups() uint64 {
+	stats := l.server.Cleanups()
+
+	registered, run := stats.Registered-l.cleanups.Registered, stats.Run-l.cleanups.Run
+	if run >= registered {
+		return 0
+	}
+
+	return registered - run
+}
+
+// describe returns the goroutine's header and the frames of its stack in the module, or all of them if it has none
+func (l *leakCheck) describe(g leakedGoroutine) string {
+	var frames []string
+
+	if l.module != "" {
+		for _, fn := range g.funcs {
+			if strings.HasPrefix(fn, l.module+"/") || strings.HasPrefix(fn, l.module+".") {
+				frames = append(frames, fn)
+			}
+		}
+	}
+
+	if len(frames) == 0 {
+		return fmt.Sprintf("%s\n%s", g.header, g.stack)
+	}
+
+	return fmt.Sprintf("%s\n\t%s", g.header, strings.Join(frames, "\n\t"))
+}
+
+// goroutines returns every running goroutine but the current one
+func goroutines() []leakedGoroutine {
+	buf := make([]byte, 64<<10)
+
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+
+		buf = make([]byte, len(buf)*2)
+	}
+
+	stacks := bytes.Split(buf, []byte("\n\n"))
+
+	// the first stack is the current goroutine's
+	all := make([]leakedGoroutine, 0, len(stacks)-1)
+
+	for _, stack := range stacks[1:] {
+		if g, ok := parseGoroutine(string(stack)); ok {
+			all = append(all, g)
+		}
+	}
+
+	return all
+}
+
+// parseGoroutine parses a goroutine's stack as written by runtime.Stack, i.e.
+//
+//	goroutine 7 [chan receive]:
+//	main.worker(...)
+//		/src/main.go:12 +0x1d
+//	created by main.main in goroutine 1
+//		/src/main.go:8 +0x25
+func parseGoroutine(stack string) (leakedGoroutine, bool) {
+	lines := strings.Split(strings.TrimSpace(stack), "\n")
+	if len(lines) == 0 || !strings.HasPrefix(lines[0], "goroutine ") {
+		return leakedGoroutine{}, false
+	}
+
+	g := leakedGoroutine{header: lines[0], stack: strings.Join(lines[1:], "\n")}
+
+	fields := strings.Fields(lines[0])
+	if len(fields) < 2 {
+		return leakedGoroutine{}, false
+	}
+
+	if _, err := strconv.ParseUint(fields[1], 10, 64); err != nil {
+		return leakedGoroutine{}, false
+	}
+
+	g.id = fields[1]
+
+	for _, line := range lines[1:] {
+		if strings.HasPrefix(line, "\t") || strings.HasPrefix(line, "created by ") || strings.HasPrefix(line, "...") {
+			continue
+		}
+
+		fn := line
+		if open := strings.LastIndex(fn, "("); open > 0 {
+			fn = fn[:open]
+		}
+
+		// every goroutine returns to goexit, which isn't the function it started with
+		if fn == "runtime.goexit" {
+			continue
+		}
+
+		g.funcs = append(g.funcs, fn)
+	}
+
+	return g, true
+}
+
+// liveHeap returns the bytes allocated by live objects, after a garbage collection
+func liveHeap() uint64 {
+	runtime.GC()
+
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+
+	return stats.HeapAlloc
+}
@@ -0,0 +1,123 @@
+package vtest_test
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+	"github.com/suborbital/vektor/vtest"
+)
+
+// recordingTB records the failures and cleanups of a leak check, so that a check expected to fail can be asserted
+type recordingTB struct {
+	testing.TB
+	errors   []string
+	cleanups []func()
+}
+
+func (r *recordingTB) Helper() {}
+
+func (r *recordingTB) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func (r *recordingTB) Cleanup(fn func()) {
+	r.cleanups = append(r.cleanups, fn)
+}
+
+// finish runs the check's cleanups, as the end of a test would
+func (r *recordingTB) finish() {
+	for i := len(r.cleanups) - 1; i >= 0; i-- {
+		r.cleanups[i]()
+	}
+}
+
+func leakServer(release chan struct{}) *vk.Server {
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+
+	server.GET("/leak", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		go waitForever(release)
+
+		return vk.RespondString(ctx.Context, w, "leaked", http.StatusOK)
+	})
+
+	server.GET("/settles", func(w http.ResponseWriter, r *http.Request, ctx *vk.Ctx) error {
+		go time.Sleep(50 * time.Millisecond)
+
+		done := make(chan struct{})
+		ctx.OnCleanup(func() { close(done) })
+
+		return vk.RespondString(ctx.Context, w, "clean", http.StatusOK)
+	})
+
+	return server
+}
+
+// waitForever stands for a goroutine that a handler forgot to stop
+func waitForever(release chan struct{}) {
+	<-release
+}
+
+func TestLeakCheckCatchesLeaks(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	server := leakServer(release)
+	vt := vtest.New(server)
+
+	rec := &recordingTB{TB: t}
+	vtest.LeakCheck(rec, server, vtest.SettleFor(100*time.Millisecond))
+
+	req, _ := http.NewRequest(http.MethodGet, "/leak", nil)
+	vt.Do(req, t).AssertStatus(http.StatusOK)
+
+	rec.finish()
+
+	if len(rec.errors) != 1 {
+		t.Fatalf("expected the leak to be reported once, got %v", rec.errors)
+	}
+
+	if !strings.Contains(rec.errors[0], "vtest_test.waitForever") {
+		t.Errorf("expected the leak to name the leaking function, got %s", rec.errors[0])
+	}
+
+	if strings.Contains(rec.errors[0], "runtime.gopark") {
+		t.Errorf("expected the leak's stack to be limited to the module's frames, got %s", rec.errors[0])
+	}
+}
+
+func TestLeakCheckAllowsGoroutines(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	server := leakServer(release)
+	vt := vtest.New(server)
+
+	rec := &recordingTB{TB: t}
+	vtest.LeakCheck(rec, server, vtest.SettleFor(100*time.Millisecond), vtest.AllowGoroutines("github.com/suborbital/vektor/vtest_test.waitForever"))
+
+	req, _ := http.NewRequest(http.MethodGet, "/leak", nil)
+	vt.Do(req, t).AssertStatus(http.StatusOK)
+
+	rec.finish()
+
+	if len(rec.errors) != 0 {
+		t.Errorf("expected the allowed goroutine not to be reported, got %v", rec.errors)
+	}
+}
+
+func TestLeakCheckPassesCleanRequests(t *testing.T) {
+	server := leakServer(nil)
+	vt := vtest.New(server)
+
+	vtest.LeakCheck(t, server, vtest.MaxHeapGrowth(8<<20))
+
+	for i := 0; i < 10; i++ {
+		req, _ := http.NewRequest(http.MethodGet, "/settles", nil)
+		vt.Do(req, t).AssertStatus(http.StatusOK).AssertBodyString("clean")
+	}
+}
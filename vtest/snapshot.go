@@ -0,0 +1,68 @@
+package vtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/suborbital/vektor/vk"
+)
+
+// UpdateSnapshotsEnv is the environment variable that makes MatchSnapshotFile rewrite golden files rather than
+// compare against them, i.e. VTEST_UPDATE_SNAPSHOTS=1 go test ./...
+const UpdateSnapshotsEnv = "VTEST_UPDATE_SNAPSHOTS"
+
+// Snapshotter is anything with a route table to snapshot, such as a *vk.Server or a *vk.Router
+type Snapshotter interface {
+	Snapshot() vk.RouteSnapshot
+}
+
+// MatchSnapshotFile fails the test if the routes of source differ from the snapshot in the golden file at path,
+// listing the routes that were added, removed and modified. With VTEST_UPDATE_SNAPSHOTS set, the golden file is
+// written instead, for the change to be reviewed along with the code that caused it
+func MatchSnapshotFile(t *testing.T, source Snapshotter, path string) {
+	t.Helper()
+
+	current := source.Snapshot()
+
+	if os.Getenv(UpdateSnapshotsEnv) != "" {
+		data, err := json.MarshalIndent(current, "", "  ")
+		if err != nil {
+			t.Fatalf("failed to encode route snapshot: %s", err)
+		}
+
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("failed to create directory for %s: %s", path, err)
+		}
+
+		if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+			t.Fatalf("failed to write route snapshot: %s", err)
+		}
+
+		return
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read route snapshot %s (set %s=1 to create it): %s", path, UpdateSnapshotsEnv, err)
+	}
+
+	golden := vk.RouteSnapshot{}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(&golden); err != nil {
+		t.Fatalf("failed to decode route snapshot %s: %s", path, err)
+	}
+
+	if golden.Version != vk.RouteSnapshotVersion {
+		t.Fatalf("route snapshot %s has version %d, vk writes version %d (set %s=1 to regenerate it)", path, golden.Version, vk.RouteSnapshotVersion, UpdateSnapshotsEnv)
+	}
+
+	if diff := vk.DiffSnapshots(golden, current); !diff.Empty() {
+		t.Errorf("routes differ from %s (set %s=1 to accept the changes):\n%s", path, UpdateSnapshotsEnv, diff)
+	}
+}
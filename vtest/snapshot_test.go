@@ -0,0 +1,34 @@
+package vtest_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/suborbital/vektor/vk"
+	"github.com/suborbital/vektor/vlog"
+	"github.com/suborbital/vektor/vtest"
+)
+
+func TestMatchSnapshotFile(t *testing.T) {
+	server := vk.New(vk.UseLogger(vlog.Noop()))
+	server.GET("/hello", handleHello)
+
+	golden := filepath.Join(t.TempDir(), "testdata", "routes.golden.json")
+
+	t.Setenv(vtest.UpdateSnapshotsEnv, "1")
+	vtest.MatchSnapshotFile(t, server, golden)
+
+	data, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(string(data), `"path": "/hello"`) {
+		t.Errorf("golden file is missing the route: %s", data)
+	}
+
+	t.Setenv(vtest.UpdateSnapshotsEnv, "")
+	vtest.MatchSnapshotFile(t, server, golden)
+}
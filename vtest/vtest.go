@@ -73,3 +73,19 @@ func (vt *VTest) Do(req *http.Request, t *testing.T) *Response {
 		t:       t,
 	}
 }
+
+// AssertCleanups asserts that every callback registered with Ctx.OnCleanup by the requests handled so far has run.
+// Call it once the test's requests have completed to check that no cleanups are leaking
+func (vt *VTest) AssertCleanups(t *testing.T) {
+	t.Helper()
+
+	if stats := vt.server.Cleanups(); stats.Run != stats.Registered {
+		t.Errorf("%d of %d registered cleanups have run", stats.Run, stats.Registered)
+	}
+}
+
+// Override returns a copy of req whose handlers resolve value for the type T with vk.Resolve, instead of the value
+// provided to the server, i.e. to substitute a fake store for a single request
+func Override[T any](req *http.Request, value T) *http.Request {
+	return vk.OverrideDependency(req, value)
+}